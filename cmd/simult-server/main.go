@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -51,6 +54,8 @@ func configGlobal(cfg *config.Config) {
 		xlog.Info("config global.promresetonreload: prometheus metrics have reset")
 	}
 
+	lb.SetBufferMemoryLimit(cfg.Global.MaxBufferMemory)
+
 	rlimitNofile := cfg.Global.RlimitNofile
 	rLimit := &syscall.Rlimit{}
 	if rlimitNofile <= 0 {
@@ -70,6 +75,26 @@ func configGlobal(cfg *config.Config) {
 	} else {
 		xlog.Infof("config global.rlimitnofile: set to %d", rlimitNofile)
 	}
+
+	maxOpenConns := cfg.Global.MaxOpenConns
+	if maxOpenConns == 0 {
+		if syscall.Getrlimit(syscall.RLIMIT_NOFILE, rLimit) == nil {
+			rlimitNofile = rLimit.Cur
+		}
+		headroom := rlimitNofile / 10
+		if headroom < 64 {
+			headroom = 64
+		}
+		if rlimitNofile > headroom {
+			maxOpenConns = int64(rlimitNofile - headroom)
+		}
+	}
+	lb.SetConnReclaimWatermarks(maxOpenConns, maxOpenConns*9/10)
+	if maxOpenConns > 0 {
+		xlog.Infof("config global.maxopenconns: set to %d", maxOpenConns)
+	} else {
+		xlog.Info("config global.maxopenconns: idle connection reclaiming disabled")
+	}
 }
 
 func configReload(configFilename string) bool {
@@ -77,22 +102,30 @@ func configReload(configFilename string) bool {
 	f, err := os.Open(configFilename)
 	if err != nil {
 		xlog.Errorf("configuration file read error: %v", err)
+		lb.PromConfigReloaded(nil)
 		return false
 	}
 	defer f.Close()
 	cfg, err := config.LoadFrom(f)
 	if err != nil {
 		xlog.Errorf("configuration parse error: %v", err)
+		lb.PromConfigReloaded(nil)
 		return false
 	}
 	appMu.Lock()
 	defer appMu.Unlock()
-	an, err := app.Fork(cfg)
+	plan, err := app.PrepareReload(cfg)
 	if err != nil {
 		xlog.Errorf("configuration load error: %v", err)
+		lb.PromConfigReloaded(nil)
+		return false
+	}
+	an, err := app.Commit(plan)
+	if err != nil {
+		xlog.Errorf("configuration commit error: %v", err)
 		return false
 	}
-	xlog.Info("configuration loaded")
+	xlog.Infof("configuration loaded with hash %s: %d created, %d updated, %d destroyed", plan.Hash, len(plan.Created), len(plan.Updated), len(plan.Destroyed))
 	if app != nil {
 		xlog.Infof("closing old objects within %v", closeTimeout)
 		closeCtx, closeCtxCancel := context.WithTimeout(appCtx, closeTimeout)
@@ -106,6 +139,129 @@ func configReload(configFilename string) bool {
 	return true
 }
 
+func configCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, err := config.LoadFrom(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("configuration parse error: %v", err), http.StatusBadRequest)
+		return
+	}
+	appMu.Lock()
+	defer appMu.Unlock()
+	plan, err := app.PrepareReload(cfg)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("configuration load error: %v", err), http.StatusBadRequest)
+		return
+	}
+	app.Discard(plan)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	appMu.RLock()
+	st := app.Status()
+	appMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func connStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	since := time.Time{}
+	if v := q.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("since parse error: %v", err), http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	var st lb.ConnStatsStatus
+	appMu.RLock()
+	f, b := app.Frontend(q.Get("frontend")), app.Backend(q.Get("backend"))
+	appMu.RUnlock()
+	switch {
+	case f != nil:
+		st = f.ConnStats(since)
+	case b != nil:
+		st = b.ConnStats(since)
+	default:
+		http.Error(w, "frontend or backend not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func tapHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	appMu.RLock()
+	f := app.Frontend(q.Get("frontend"))
+	appMu.RUnlock()
+	if f == nil {
+		http.Error(w, "frontend not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		st, ok := f.TapStatus()
+		if !ok {
+			http.Error(w, "tap not started", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	case http.MethodPost:
+		opts := lb.HTTPFrontendTapOptions{
+			ClientIP:         q.Get("clientip"),
+			RequestIDPattern: q.Get("requestid"),
+		}
+		var err error
+		if v := q.Get("duration"); v != "" {
+			if opts.Duration, err = time.ParseDuration(v); err != nil {
+				http.Error(w, fmt.Sprintf("duration parse error: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("maxentries"); v != "" {
+			if opts.MaxEntries, err = strconv.Atoi(v); err != nil {
+				http.Error(w, fmt.Sprintf("maxentries parse error: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("maxbodybytes"); v != "" {
+			if opts.MaxBodyBytes, err = strconv.Atoi(v); err != nil {
+				http.Error(w, fmt.Sprintf("maxbodybytes parse error: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if err = f.StartTap(opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		xlog.Infof("tap started on frontend %q: clientip=%q requestid=%q", q.Get("frontend"), opts.ClientIP, opts.RequestIDPattern)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		f.StopTap()
+		xlog.Infof("tap stopped on frontend %q", q.Get("frontend"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
 func main() {
 	var configFilename string
 	var mngmtAddress string
@@ -140,7 +296,24 @@ func main() {
 	if !promMetricNameRgx.MatchString(promNamespace) {
 		xlog.Fatalf("prometheus exporter namespace %q is not a valid metric name", promNamespace)
 	}
-	lb.PromInitialize(promNamespace)
+	promOpts := lb.PromOptions{
+		Namespace: promNamespace,
+	}
+	// bucket profiles can't be changed by reloading, because histograms are created once
+	if cfg, err := config.LoadFromFile(configFilename); err == nil {
+		for profile, buckets := range cfg.Global.PromBucketProfiles {
+			if len(buckets) <= 0 {
+				xlog.Fatalf("config global.prombucketprofiles: profile %q has no buckets", profile)
+			}
+			for i := 1; i < len(buckets); i++ {
+				if buckets[i] <= buckets[i-1] {
+					xlog.Fatalf("config global.prombucketprofiles: profile %q buckets must be in increasing order", profile)
+				}
+			}
+		}
+		promOpts.BucketProfiles = cfg.Global.PromBucketProfiles
+	}
+	lb.PromInitialize(promOpts)
 
 	if mngmtAddress != "" {
 		mngmtLis, err := net.Listen("tcp", mngmtAddress)
@@ -149,6 +322,10 @@ func main() {
 		}
 		defer mngmtLis.Close()
 		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/config/check", configCheckHandler)
+		http.HandleFunc("/status", statusHandler)
+		http.HandleFunc("/status/tap", tapHandler)
+		http.HandleFunc("/status/connstats", connStatsHandler)
 		mngmtServer = &http.Server{
 			Handler:        nil,
 			ReadTimeout:    60 * time.Second,
@@ -167,13 +344,13 @@ func main() {
 	defer appCancel()
 
 	go func() {
-		sigCh := make(chan os.Signal)
+		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 		<-sigCh
 		appCancel()
 	}()
 
-	configReloadSigCh := make(chan os.Signal)
+	configReloadSigCh := make(chan os.Signal, 1)
 	signal.Notify(configReloadSigCh, syscall.SIGHUP)
 	done := false
 	for !done {
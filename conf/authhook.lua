@@ -0,0 +1,31 @@
+-- example auth hook program: HMAC-SHA256 over the method, uri and selected headers
+--
+-- clients send:
+--   X-Date: unix time in seconds
+--   X-Signature: hex(hmac_sha256(secret, method .. "\n" .. uri .. "\n" .. x-date .. "\n" .. x-client-id))
+--   X-Client-Id: client identifier
+
+local secrets = {
+  ["client-a"] = "secret-a",
+}
+
+local max_skew = 300
+
+function authorize(req)
+  local h = req.headers
+  local secret = secrets[h["x-client-id"] or ""]
+  if secret == nil then
+    return false, 401, { ["WWW-Authenticate"] = "HMAC" }
+  end
+  local date = tonumber(h["x-date"] or "")
+  if date == nil or math.abs(simult.time() - date) > max_skew then
+    return false, 401
+  end
+  local msg = req.method .. "\n" .. req.uri .. "\n" .. h["x-date"] .. "\n" .. h["x-client-id"]
+  local sig = simult.hex(simult.hmac_sha256(secret, msg))
+  if not simult.equal(sig, string.lower(h["x-signature"] or "")) then
+    return false, 403
+  end
+  -- headers of allowed requests are sent to backend
+  return true, nil, { ["X-Authenticated-Client"] = h["x-client-id"] }
+end
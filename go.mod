@@ -1,6 +1,6 @@
 module github.com/simult/simult
 
-go 1.13
+go 1.24
 
 require (
 	github.com/goinsane/accepter v1.2.7
@@ -8,5 +8,18 @@ require (
 	github.com/goinsane/xlog v0.1.0
 	github.com/goinsane/xmath v0.1.0
 	github.com/prometheus/client_golang v1.1.0
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	gopkg.in/yaml.v3 v3.0.0-20190924164351-c8b7dadae555
 )
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/common v0.6.0 // indirect
+	github.com/prometheus/procfs v0.0.3 // indirect
+	github.com/spaolacci/murmur3 v1.1.0 // indirect
+	golang.org/x/sys v0.0.0-20190801041406-cbf593c0f2f3 // indirect
+)
@@ -2,9 +2,15 @@ package config
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +29,9 @@ type App struct {
 	frontends    map[string]*lb.HTTPFrontend
 	backends     map[string]*lb.HTTPBackend
 	healthChecks map[string]interface{}
+	acme         *lb.ACMEManager
+
+	info lb.PromConfigInfo
 }
 
 // NewApp creates an App from given Config
@@ -33,7 +42,19 @@ func NewApp(cfg *Config) (a *App, err error) {
 
 // Fork forkes an App and its own load-balancing members, and activates them
 func (a *App) Fork(cfg *Config) (an *App, err error) {
-	an = &App{
+	plan, err := a.PrepareReload(cfg)
+	if err != nil {
+		lb.PromConfigReloaded(nil)
+		return
+	}
+	an, err = a.Commit(plan)
+	return
+}
+
+// PrepareReload forkes an App and its own load-balancing members by given Config without activating them.
+// The returned ReloadPlan must be committed by Commit or thrown away by Discard.
+func (a *App) PrepareReload(cfg *Config) (plan *ReloadPlan, err error) {
+	an := &App{
 		listeners:    make(map[string]*lb.Listener),
 		frontends:    make(map[string]*lb.HTTPFrontend),
 		backends:     make(map[string]*lb.HTTPBackend),
@@ -80,6 +101,24 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 				RiseThreshold: item.HTTP.Rise,
 				RespBody:      respBody,
 				UserAgent:     fmt.Sprintf("simult/%s healthcheck", strings.TrimPrefix(version.Version(), "v")),
+				DSCP:          item.HTTP.DSCP,
+			}
+		}
+		if item.GRPC != nil {
+			if h != nil {
+				err = fmt.Errorf("healthcheck %q another healthcheck defined", name)
+				return
+			}
+			h = &hc.HTTPCheckOptions{
+				HeaderHost:    item.GRPC.Host,
+				Interval:      item.GRPC.Interval,
+				Timeout:       item.GRPC.Timeout,
+				FallThreshold: item.GRPC.Fall,
+				RiseThreshold: item.GRPC.Rise,
+				UserAgent:     fmt.Sprintf("simult/%s healthcheck", strings.TrimPrefix(version.Version(), "v")),
+				DSCP:          item.GRPC.DSCP,
+				GRPC:          true,
+				GRPCService:   item.GRPC.Service,
 			}
 		}
 		an.healthChecks[name] = h
@@ -100,6 +139,13 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 		if item.MaxConn > 0 {
 			opts.MaxConn = item.MaxConn
 		}
+		if item.QueueTimeout > 0 {
+			opts.QueueTimeout = item.QueueTimeout
+		}
+		if item.MaxQueue > 0 {
+			opts.MaxQueue = item.MaxQueue
+		}
+		opts.ShedStatus = item.ShedStatus
 		if item.ServerMaxConn > 0 {
 			opts.ServerMaxConn = item.ServerMaxConn
 		}
@@ -118,6 +164,12 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 				opts.ConnectTimeout = 2 * time.Second
 			}
 		}
+		opts.TCPKeepAlivePeriod = item.TCPKeepAlivePeriod
+		opts.TCPNoDelay = item.TCPNoDelay
+		if item.ResponseHeaderTimeout > 0 {
+			opts.ResponseHeaderTimeout = item.ResponseHeaderTimeout
+		}
+		opts.MaxResponseBodySize = item.MaxResponseBodySize
 		opts.ReqHeader = make(http.Header, len(item.ReqHeaders))
 		for k, v := range item.ReqHeaders {
 			opts.ReqHeader.Set(k, v)
@@ -144,6 +196,8 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 				opts.Mode = lb.HTTPBackendModeLeastConn
 			case "affinitykey":
 				opts.Mode = lb.HTTPBackendModeAffinityKey
+			case "leastbytes":
+				opts.Mode = lb.HTTPBackendModeLeastBytes
 			default:
 				err = fmt.Errorf("backend %q mode %q unknown", name, item.Mode)
 				return
@@ -176,8 +230,65 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 			opts.AffinityKey.MaxServers = item.AffinityKey.MaxServers
 			opts.AffinityKey.Threshold = item.AffinityKey.Threshold
 		}
+		if item.StickyCookie.Name != "" {
+			for _, reserved := range cfg.Global.ReservedCookieNames {
+				if strings.EqualFold(item.StickyCookie.Name, reserved) {
+					err = fmt.Errorf("backend %q stickycookie name %q is reserved", name, item.StickyCookie.Name)
+					return
+				}
+			}
+			opts.StickyCookie.Name = item.StickyCookie.Name
+			opts.StickyCookie.Path = item.StickyCookie.Path
+			if opts.StickyCookie.Path == "" {
+				opts.StickyCookie.Path = "/"
+			}
+			opts.StickyCookie.MaxAge = item.StickyCookie.MaxAge
+			opts.StickyCookie.Secure = item.StickyCookie.Secure
+			opts.StickyCookie.HTTPOnly = item.StickyCookie.HTTPOnly
+			switch item.StickyCookie.SameSite {
+			case "":
+			case "lax":
+				opts.StickyCookie.SameSite = http.SameSiteLaxMode
+			case "strict":
+				opts.StickyCookie.SameSite = http.SameSiteStrictMode
+			case "none":
+				opts.StickyCookie.SameSite = http.SameSiteNoneMode
+			default:
+				err = fmt.Errorf("backend %q stickycookie samesite %q unknown", name, item.StickyCookie.SameSite)
+				return
+			}
+		}
 		opts.OverrideErrors = item.OverrideErrors
 		opts.Servers = item.Servers
+		opts.DeadlineAware = item.DeadlineAware
+		opts.DSCP = item.DSCP
+		opts.SourceAddress = item.SourceAddress
+		if item.SOCKS5Proxy != "" {
+			u, e := url.Parse(item.SOCKS5Proxy)
+			if e != nil || u.Scheme != "socks5" || u.Host == "" {
+				err = fmt.Errorf("backend %q socks5proxy %q invalid", name, item.SOCKS5Proxy)
+				return
+			}
+			d := &lb.SOCKS5Dialer{
+				Address: u.Host,
+			}
+			if u.User != nil {
+				d.Username = u.User.Username()
+				d.Password, _ = u.User.Password()
+			}
+			opts.Dialer = d
+		}
+		switch item.SendProxyProtocol {
+		case "":
+			opts.SendProxyProtocol = lb.HTTPBackendProxyProtocolNone
+		case "v1":
+			opts.SendProxyProtocol = lb.HTTPBackendProxyProtocolV1
+		case "v2":
+			opts.SendProxyProtocol = lb.HTTPBackendProxyProtocolV2
+		default:
+			err = fmt.Errorf("backend %q sendproxyprotocol %q unknown", name, item.SendProxyProtocol)
+			return
+		}
 
 		var b, bn *lb.HTTPBackend
 		if a != nil {
@@ -192,6 +303,21 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 		xlog.V(1).Infof("backend %q created", name)
 	}
 
+	if acmeCfg := cfg.Global.ACME; len(acmeCfg.Hosts) > 0 {
+		an.acme, err = lb.NewACMEManager(lb.ACMEManagerOptions{
+			Email:        acmeCfg.Email,
+			DirectoryURL: acmeCfg.DirectoryURL,
+			CacheDir:     acmeCfg.CacheDir,
+			Hosts:        acmeCfg.Hosts,
+			RenewBefore:  acmeCfg.RenewBefore,
+		})
+		if err != nil {
+			err = fmt.Errorf("global acme error: %w", err)
+			return
+		}
+		xlog.V(1).Infof("acme manager created for %d hosts", len(acmeCfg.Hosts))
+	}
+
 	for name, item := range cfg.Frontends {
 		if name == "" || !nameRgx.MatchString(name) {
 			err = fmt.Errorf("frontend %q has not a valid name", name)
@@ -221,6 +347,21 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 				opts.RequestTimeout = 5 * time.Second
 			}
 		}
+		if item.ReadHeaderTimeout > 0 {
+			opts.ReadHeaderTimeout = item.ReadHeaderTimeout
+		}
+		if item.RequestBodyTimeout > 0 {
+			opts.RequestBodyTimeout = item.RequestBodyTimeout
+		}
+		if item.WriteTimeout > 0 {
+			opts.WriteTimeout = item.WriteTimeout
+		}
+		if item.MaxHeaderBytes > 0 {
+			opts.MaxHeaderBytes = item.MaxHeaderBytes
+		}
+		if item.MaxBodyBytes > 0 {
+			opts.MaxBodyBytes = item.MaxBodyBytes
+		}
 		if item.MaxKeepAliveReqs != nil {
 			opts.MaxKeepAliveReqs = *item.MaxKeepAliveReqs
 		} else {
@@ -239,6 +380,9 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 				opts.KeepAliveTimeout = 65 * time.Second
 			}
 		}
+		if item.TLSHandshakeTimeout > 0 {
+			opts.TLSHandshakeTimeout = item.TLSHandshakeTimeout
+		}
 		if item.DefaultBackend != "" {
 			opts.DefaultBackend = an.backends[item.DefaultBackend]
 			if opts.DefaultBackend == nil {
@@ -253,11 +397,252 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 				return
 			}
 		}
+		opts.DefaultBackends = make(map[string]*lb.HTTPBackend, len(item.DefaultBackends))
+		for host, bName := range item.DefaultBackends {
+			opts.DefaultBackends[host] = an.backends[bName]
+			if opts.DefaultBackends[host] == nil {
+				err = fmt.Errorf("frontend %q defaultbackends host %q backend %q not found", name, host, bName)
+				return
+			}
+		}
+		if item.UnmatchedRequestAction != "" {
+			switch item.UnmatchedRequestAction {
+			case "default-backend":
+				opts.UnmatchedRequestAction = lb.HTTPFrontendUnmatchedActionDefaultBackend
+			case "404":
+				opts.UnmatchedRequestAction = lb.HTTPFrontendUnmatchedActionNotFound
+			case "421":
+				opts.UnmatchedRequestAction = lb.HTTPFrontendUnmatchedActionMisdirected
+			case "close":
+				opts.UnmatchedRequestAction = lb.HTTPFrontendUnmatchedActionClose
+			default:
+				err = fmt.Errorf("frontend %q unmatchedrequestaction %q unknown", name, item.UnmatchedRequestAction)
+				return
+			}
+		}
+		if item.WriteProfile != "" {
+			switch item.WriteProfile {
+			case "default":
+				opts.WriteProfile = lb.HTTPFrontendWriteProfileDefault
+			case "low-latency":
+				opts.WriteProfile = lb.HTTPFrontendWriteProfileLowLatency
+			case "throughput":
+				opts.WriteProfile = lb.HTTPFrontendWriteProfileThroughput
+			default:
+				err = fmt.Errorf("frontend %q writeprofile %q unknown", name, item.WriteProfile)
+				return
+			}
+		}
+		opts.EmitForwarded = item.EmitForwarded
+		if item.ForwardedHeaders != "" {
+			switch item.ForwardedHeaders {
+			case "append":
+				opts.ForwardedHeaders = lb.HTTPFrontendForwardedHeadersAppend
+			case "strip":
+				opts.ForwardedHeaders = lb.HTTPFrontendForwardedHeadersStrip
+			default:
+				err = fmt.Errorf("frontend %q forwardedheaders %q unknown", name, item.ForwardedHeaders)
+				return
+			}
+		}
+		if item.RequestID != "" {
+			switch item.RequestID {
+			case "none":
+				opts.RequestID = lb.HTTPFrontendRequestIDNone
+			case "generate":
+				opts.RequestID = lb.HTTPFrontendRequestIDGenerate
+			case "overwrite":
+				opts.RequestID = lb.HTTPFrontendRequestIDOverwrite
+			default:
+				err = fmt.Errorf("frontend %q requestid %q unknown", name, item.RequestID)
+				return
+			}
+		}
+		opts.RequestIDHeader = item.RequestIDHeader
+		opts.WebSocketPassthrough = item.WebSocketPassthrough
+		if item.TunnelIdleTimeout > 0 {
+			opts.TunnelIdleTimeout = item.TunnelIdleTimeout
+		}
+		opts.Via = item.Via
+		opts.ViaPseudonym = item.ViaPseudonym
+		opts.ViaLoopDetection = item.ViaLoopDetection
+		opts.AllowedUpstreamHosts = cfg.Global.AllowedUpstreamHosts
+		opts.TimeoutHeader = item.TimeoutHeader
+		if item.DrainTimeout > 0 {
+			opts.DrainTimeout = item.DrainTimeout
+		}
+		opts.DrainHeader = item.DrainHeader
+		opts.RedirectToHTTPS = item.RedirectToHTTPS
+		opts.RedirectToHTTPSPort = item.RedirectToHTTPSPort
+		opts.RedirectTemporary = item.RedirectTemporary
+		opts.H2C = item.H2C
+		opts.TCPKeepAlivePeriod = item.TCPKeepAlivePeriod
+		opts.TCPNoDelay = item.TCPNoDelay
+		opts.DSCP = item.DSCP
+		opts.StrictParsing = item.StrictParsing
+		opts.AllowedMethods = item.AllowedMethods
+		opts.StrictRoutes = item.StrictRoutes
+		for _, proxy := range item.TrustedProxies {
+			var network *net.IPNet
+			network, err = parseNetwork(proxy)
+			if err != nil {
+				err = fmt.Errorf("frontend %q trustedproxies %q parse error: %w", name, proxy, err)
+				return
+			}
+			opts.TrustedProxies = append(opts.TrustedProxies, network)
+		}
+		opts.AcceptProxyProtocol = item.AcceptProxyProtocol
+		for _, s := range item.ProxyProtocolNetworks {
+			var network *net.IPNet
+			network, err = parseNetwork(s)
+			if err != nil {
+				err = fmt.Errorf("frontend %q proxyprotocolnetworks %q parse error: %w", name, s, err)
+				return
+			}
+			opts.ProxyProtocolNetworks = append(opts.ProxyProtocolNetworks, network)
+		}
+		opts.OverrideHeader = item.OverrideHeader
+		opts.ACME = an.acme
+		for _, bName := range item.OverrideBackends {
+			b := an.backends[bName]
+			if b == nil {
+				err = fmt.Errorf("frontend %q overridebackends %q not found", name, bName)
+				return
+			}
+			opts.OverrideBackends = append(opts.OverrideBackends, b)
+		}
+		for _, s := range item.OverrideNetworks {
+			var network *net.IPNet
+			network, err = parseNetwork(s)
+			if err != nil {
+				err = fmt.Errorf("frontend %q overridenetworks %q parse error: %w", name, s, err)
+				return
+			}
+			opts.OverrideNetworks = append(opts.OverrideNetworks, network)
+		}
 		opts.Routes = make([]lb.HTTPFrontendRoute, 0, len(item.Routes))
 		for i := range item.Routes {
 			route, newRoute := &item.Routes[i], &lb.HTTPFrontendRoute{}
 			newRoute.Host = route.Host
+			newRoute.Hosts = route.Hosts
 			newRoute.Path = route.Path
+			newRoute.Query = route.Query
+			newRoute.HostIsRegexp = route.HostIsRegexp
+			newRoute.PathIsRegexp = route.PathIsRegexp
+			newRoute.Priority = route.Priority
+			newRoute.Methods = route.Methods
+			newRoute.Headers = route.Headers
+			newRoute.Timeout = route.Timeout
+			if route.ResponseHeaderTimeout > 0 {
+				newRoute.ResponseHeaderTimeout = route.ResponseHeaderTimeout
+			}
+			newRoute.MaxResponseBodySize = route.MaxResponseBodySize
+			newRoute.MaxBodyBytes = route.MaxBodyBytes
+			for code, mappedCode := range route.StatusMap {
+				if code < 200 || code > 999 || mappedCode < 200 || mappedCode > 999 {
+					err = fmt.Errorf("frontend %q route statusmap %d: %d out of range", name, code, mappedCode)
+					return
+				}
+			}
+			for code := range route.StatusMapBodies {
+				if _, ok := route.StatusMap[code]; !ok {
+					err = fmt.Errorf("frontend %q route statusmapbodies %d not in statusmap", name, code)
+					return
+				}
+			}
+			newRoute.StatusMap = route.StatusMap
+			newRoute.StatusMapBodies = route.StatusMapBodies
+			if route.StripPathPrefix != "" && !strings.HasPrefix(route.StripPathPrefix, "/") {
+				err = fmt.Errorf("frontend %q route stripprefix %q must start with /", name, route.StripPathPrefix)
+				return
+			}
+			newRoute.StripPathPrefix = route.StripPathPrefix
+			newRoute.SetHost = route.SetHost
+			for _, op := range route.RequestHeaders {
+				newOp := lb.HTTPFrontendHeaderOp{Name: op.Name, Value: op.Value}
+				newOp.Op, err = parseHeaderOpKind(op.Op)
+				if err != nil {
+					err = fmt.Errorf("frontend %q route requestheaders %q error: %w", name, op.Name, err)
+					return
+				}
+				newRoute.RequestHeaders = append(newRoute.RequestHeaders, newOp)
+			}
+			for _, op := range route.ResponseHeaders {
+				newOp := lb.HTTPFrontendHeaderOp{Name: op.Name, Value: op.Value}
+				newOp.Op, err = parseHeaderOpKind(op.Op)
+				if err != nil {
+					err = fmt.Errorf("frontend %q route responseheaders %q error: %w", name, op.Name, err)
+					return
+				}
+				newRoute.ResponseHeaders = append(newRoute.ResponseHeaders, newOp)
+			}
+			newRoute.RewritePath.Pattern = route.RewritePath.Pattern
+			newRoute.RewritePath.Replacement = route.RewritePath.Replacement
+			newRoute.RewriteLocation = route.RewriteLocation
+			newRoute.MaxResponseBytesPerSecond = route.MaxResponseBytesPerSecond
+			newRoute.PerClientBytesPerSecond = route.PerClientBytesPerSecond
+			newRoute.BucketProfile = route.BucketProfile
+			newRoute.CoalesceRequests = route.CoalesceRequests
+			newRoute.CoalesceMaxBytes = route.CoalesceMaxBytes
+			newRoute.MaxConcurrent = route.MaxConcurrent
+			newRoute.MaxQueue = route.MaxQueue
+			newRoute.QueueTimeout = route.QueueTimeout
+			newRoute.GRPC = route.GRPC
+			if route.AuthHook.Script != "" && route.AuthHook.File != "" {
+				err = fmt.Errorf("frontend %q route authhook has both script and file", name)
+				return
+			}
+			newRoute.AuthHook.Script = route.AuthHook.Script
+			if route.AuthHook.File != "" {
+				var script []byte
+				script, err = ioutil.ReadFile(route.AuthHook.File)
+				if err != nil {
+					err = fmt.Errorf("frontend %q route authhook file %q read error: %w", name, route.AuthHook.File, err)
+					return
+				}
+				newRoute.AuthHook.Script = string(script)
+			}
+			newRoute.AuthHook.Timeout = route.AuthHook.Timeout
+			newRoute.AuthHook.MaxInstructions = route.AuthHook.MaxInstructions
+			newRoute.AuthHook.FailOpen = route.AuthHook.FailOpen
+			if route.ForwardAuth.Backend != "" {
+				newRoute.ForwardAuth.Backend = an.backends[route.ForwardAuth.Backend]
+				if newRoute.ForwardAuth.Backend == nil {
+					err = fmt.Errorf("frontend %q route forwardauth error: backend %q not found", name, route.ForwardAuth.Backend)
+					return
+				}
+			}
+			newRoute.ForwardAuth.Headers = route.ForwardAuth.Headers
+			newRoute.ForwardAuth.ResponseHeaders = route.ForwardAuth.ResponseHeaders
+			newRoute.ForwardAuth.Timeout = route.ForwardAuth.Timeout
+			newRoute.ForwardAuth.FailOpen = route.ForwardAuth.FailOpen
+			newRoute.ForwardAuth.CacheHeader = route.ForwardAuth.CacheHeader
+			newRoute.ForwardAuth.CacheTTL = route.ForwardAuth.CacheTTL
+			newRoute.Redirect.Location = route.Redirect.Location
+			newRoute.Redirect.Code = route.Redirect.Code
+			newRoute.Response.StatusCode = route.Response.StatusCode
+			newRoute.Response.ContentType = route.Response.ContentType
+			newRoute.Response.Body = route.Response.Body
+			if route.Mirror.Backend != "" {
+				newRoute.Mirror.Backend = an.backends[route.Mirror.Backend]
+				if newRoute.Mirror.Backend == nil {
+					err = fmt.Errorf("frontend %q route mirror error: backend %q not found", name, route.Mirror.Backend)
+					return
+				}
+			}
+			newRoute.Mirror.MaxInflight = route.Mirror.MaxInflight
+			newRoute.Mirror.MaxBodyBytes = route.Mirror.MaxBodyBytes
+			newRoute.Mirror.Timeout = route.Mirror.Timeout
+			newRoute.BasicAuth.Realm = route.BasicAuth.Realm
+			newRoute.BasicAuth.Users = route.BasicAuth.Users
+			newRoute.BasicAuth.File = route.BasicAuth.File
+			newRoute.BasicAuth.ForwardUser = route.BasicAuth.ForwardUser
+			newRoute.JWT.Secret = route.JWT.Secret
+			newRoute.JWT.KeyFile = route.JWT.KeyFile
+			newRoute.JWT.Issuer = route.JWT.Issuer
+			newRoute.JWT.Audience = route.JWT.Audience
+			newRoute.JWT.ClockSkew = route.JWT.ClockSkew
+			newRoute.JWT.ClaimHeaders = route.JWT.ClaimHeaders
 			if route.Backend != "" {
 				newRoute.Backend = an.backends[route.Backend]
 				if newRoute.Backend == nil {
@@ -265,6 +650,18 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 					return
 				}
 			}
+			for j := range route.Backends {
+				wb := &route.Backends[j]
+				newWb := lb.HTTPFrontendWeightedBackend{
+					Backend: an.backends[wb.Backend],
+					Weight:  wb.Weight,
+				}
+				if newWb.Backend == nil {
+					err = fmt.Errorf("frontend %q route error: backends backend %q not found", name, wb.Backend)
+					return
+				}
+				newRoute.Backends = append(newRoute.Backends, newWb)
+			}
 			if route.Backup != "" {
 				newRoute.Backup = an.backends[route.Backup]
 				if newRoute.Backup == nil {
@@ -282,11 +679,28 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 						return
 					}
 				}
+				newRestriction.NetworkListFile = restriction.NetworkListFile
 				newRestriction.Path = restriction.Path
+				newRestriction.Query = restriction.Query
+				newRestriction.Methods = restriction.Methods
+				newRestriction.HeaderName = restriction.HeaderName
+				newRestriction.HeaderValue = restriction.HeaderValue
+				newRestriction.ClientCertSubject = restriction.CertSubject
+				newRestriction.RateLimit.Requests = restriction.RateLimit.Requests
+				newRestriction.RateLimit.Window = restriction.RateLimit.Window
+				newRestriction.RateLimit.Burst = restriction.RateLimit.Burst
+				newRestriction.TimeWindow.Days = restriction.TimeWindow.Days
+				newRestriction.TimeWindow.Start = restriction.TimeWindow.Start
+				newRestriction.TimeWindow.End = restriction.TimeWindow.End
+				newRestriction.TimeWindow.Location = restriction.TimeWindow.Location
 				newRestriction.Invert = restriction.Invert
 				newRestriction.AndAfter = restriction.AndAfter
 				newRoute.Restrictions = append(newRoute.Restrictions, *newRestriction)
 			}
+			newRoute.DeniedStatusCode = route.DeniedStatusCode
+			newRoute.DeniedBody = route.DeniedBody
+			newRoute.DeniedRetryAfter = route.DeniedRetryAfter
+			newRoute.ContinueOnRestricted = route.ContinueOnRestricted
 			opts.Routes = append(opts.Routes, *newRoute)
 		}
 
@@ -301,6 +715,9 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 		}
 		an.frontends[name] = fn
 		xlog.V(1).Infof("frontend %q created", name)
+		for _, shadow := range fn.ShadowedRoutes() {
+			xlog.V(1).Warningf("frontend %q %v", name, shadow)
+		}
 
 		for _, lItem := range item.Listeners {
 			lName := lItem.Address
@@ -317,6 +734,11 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 			opts.Network = "tcp"
 			opts.Address = lItem.Address
 			opts.Fe = fn
+			if lItem.HTTP2 && !lItem.TLS {
+				err = fmt.Errorf("frontend %q listener %q needs tls for http2", name, lName)
+				return
+			}
+			opts.HTTP2 = lItem.HTTP2
 			if lItem.TLS {
 				tlsParams := lItem.TLSParams
 				if tlsParams == nil {
@@ -326,11 +748,64 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 					err = fmt.Errorf("frontend %q listener %q needs TLSParams", name, lName)
 					return
 				}
-				opts.TLSConfig, err = tlsParams.Config()
+				opts.TLSConfig, opts.TLSCertStore, err = tlsParams.Config(an.acme)
 				if err != nil {
 					err = fmt.Errorf("frontend %q listener %q tls error: %w", name, lName, err)
 					return
 				}
+				var ok bool
+				if opts.TLSMinVersion, ok = parseTLSVersion(lItem.TLSMinVersion); !ok {
+					err = fmt.Errorf("frontend %q listener %q has unknown tlsminversion %q", name, lName, lItem.TLSMinVersion)
+					return
+				}
+				if opts.TLSMaxVersion, ok = parseTLSVersion(lItem.TLSMaxVersion); !ok {
+					err = fmt.Errorf("frontend %q listener %q has unknown tlsmaxversion %q", name, lName, lItem.TLSMaxVersion)
+					return
+				}
+				if opts.TLSMinVersion != 0 && opts.TLSMaxVersion != 0 && opts.TLSMaxVersion < opts.TLSMinVersion {
+					err = fmt.Errorf("frontend %q listener %q has tlsmaxversion lower than tlsminversion", name, lName)
+					return
+				}
+				for _, cipher := range lItem.TLSCiphers {
+					id, ok := parseTLSCipherSuite(cipher)
+					if !ok {
+						err = fmt.Errorf("frontend %q listener %q has unknown tlsciphers %q", name, lName, cipher)
+						return
+					}
+					opts.TLSCipherSuites = append(opts.TLSCipherSuites, id)
+				}
+				opts.TLSVersionWarnOnly = lItem.TLSVersionWarnOnly
+				opts.TLSVersionWarnHeader = lItem.TLSVersionWarnHeader
+				switch lItem.TLSClientAuth {
+				case "", "none":
+					opts.TLSClientAuth = lb.ListenerClientAuthNone
+				case "verify-if-given":
+					opts.TLSClientAuth = lb.ListenerClientAuthVerifyIfGiven
+				case "require":
+					opts.TLSClientAuth = lb.ListenerClientAuthRequire
+				default:
+					err = fmt.Errorf("frontend %q listener %q has unknown tlsclientauth %q", name, lName, lItem.TLSClientAuth)
+					return
+				}
+				if opts.TLSClientAuth != lb.ListenerClientAuthNone {
+					if lItem.TLSClientCAs == "" {
+						err = fmt.Errorf("frontend %q listener %q needs tlsclientcas", name, lName)
+						return
+					}
+					var pemCerts []byte
+					pemCerts, err = ioutil.ReadFile(lItem.TLSClientCAs)
+					if err != nil {
+						err = fmt.Errorf("frontend %q listener %q tlsclientcas error: %w", name, lName, err)
+						return
+					}
+					opts.TLSClientCAs = x509.NewCertPool()
+					if !opts.TLSClientCAs.AppendCertsFromPEM(pemCerts) {
+						err = fmt.Errorf("frontend %q listener %q tlsclientcas %q has no certificate", name, lName, lItem.TLSClientCAs)
+						return
+					}
+				}
+				opts.TLSClientSANs = lItem.TLSClientSANs
+				opts.TLSClientPEMHeader = lItem.TLSClientPEMHeader
 			}
 
 			var l, ln *lb.Listener
@@ -347,6 +822,23 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 		}
 	}
 
+	an.info, err = an.configInfo()
+	if err != nil {
+		err = fmt.Errorf("config hash error: %w", err)
+		return
+	}
+	plan = newReloadPlan(a, an)
+	return
+}
+
+// Commit activates the App of given ReloadPlan and returns it. The old App should be closed after Commit.
+// Config metrics are updated by the result.
+func (a *App) Commit(plan *ReloadPlan) (an *App, err error) {
+	if err = plan.finish(a); err != nil {
+		lb.PromConfigReloaded(nil)
+		return
+	}
+	an = plan.app
 	for name, item := range an.backends {
 		item.Activate()
 		xlog.V(1).Infof("backend %q activated", name)
@@ -355,21 +847,150 @@ func (a *App) Fork(cfg *Config) (an *App, err error) {
 		item.Activate()
 		xlog.V(1).Infof("listener %q activated", name)
 	}
+	if an.acme != nil {
+		an.acme.Activate()
+		xlog.V(1).Infof("acme manager activated")
+	}
+	if n := lb.SweepArtifactCache(); n > 0 {
+		xlog.V(1).Infof("%d unused compiled artifacts swept", n)
+	}
+	lb.PromConfigReloaded(&an.info)
+	return
+}
 
+// Discard closes the App of given ReloadPlan without affecting the running App
+func (a *App) Discard(plan *ReloadPlan) (err error) {
+	if err = plan.finish(a); err != nil {
+		return
+	}
+	plan.app.Close(nil)
+	return
+}
+
+// AppStatus describes the current status of an App
+type AppStatus struct {
+	Backends    []lb.HTTPBackendStatus `json:"backends"`
+	Connections lb.ConnReclaimStatus   `json:"connections"`
+}
+
+// Status returns the current status of the App with backends ordered by name
+func (a *App) Status() (st AppStatus) {
+	st.Backends = []lb.HTTPBackendStatus{}
+	st.Connections = lb.ConnReclaimerStatus()
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	for _, item := range a.backends {
+		st.Backends = append(st.Backends, item.Status())
+	}
+	a.mu.Unlock()
+	sort.Slice(st.Backends, func(i, j int) bool { return st.Backends[i].Name < st.Backends[j].Name })
 	return
 }
 
-// Close closes the App and its own load-balancing structures
+// Frontend returns the frontend by given name, or nil if it doesn't exist
+func (a *App) Frontend(name string) *lb.HTTPFrontend {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.frontends[name]
+}
+
+// Backend returns the backend by given name, or nil if it doesn't exist
+func (a *App) Backend(name string) *lb.HTTPBackend {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.backends[name]
+}
+
+// Close closes the App and its own load-balancing structures. Frontends and backends wait for their in-flight requests
+// until ctx is done.
 func (a *App) Close(ctx context.Context) {
 	a.mu.Lock()
+	// keep-alive connections are closed after their next responses while listeners are waiting for them
+	for _, item := range a.frontends {
+		item.Drain()
+	}
 	for _, item := range a.listeners {
 		item.Close(ctx)
 	}
 	for _, item := range a.frontends {
-		item.Close()
+		if ctx != nil {
+			item.Shutdown(ctx)
+		} else {
+			item.Close()
+		}
 	}
 	for _, item := range a.backends {
+		if ctx != nil {
+			item.Drain(ctx)
+		}
 		item.Close()
 	}
+	if a.acme != nil {
+		a.acme.Close()
+	}
 	a.mu.Unlock()
 }
+
+// parseTLSVersion parses the tls version as 1.0, 1.1, 1.2 or 1.3. Empty version is parsed as zero.
+func parseTLSVersion(s string) (version uint16, ok bool) {
+	switch s {
+	case "":
+		return 0, true
+	case "1.0":
+		return tls.VersionTLS10, true
+	case "1.1":
+		return tls.VersionTLS11, true
+	case "1.2":
+		return tls.VersionTLS12, true
+	case "1.3":
+		return tls.VersionTLS13, true
+	}
+	return 0, false
+}
+
+// parseTLSCipherSuite parses the tls cipher suite by its standard name, eg TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func parseTLSCipherSuite(s string) (id uint16, ok bool) {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == s {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// parseNetwork parses the network in CIDR notation, or the IP address as the network of the single address
+func parseNetwork(s string) (network *net.IPNet, err error) {
+	if strings.IndexByte(s, '/') >= 0 {
+		_, network, err = net.ParseCIDR(s)
+		return
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// parseHeaderOpKind parses the header operation of routes
+func parseHeaderOpKind(s string) (kind lb.HTTPFrontendHeaderOpKind, err error) {
+	switch s {
+	case "add":
+		return lb.HTTPFrontendHeaderOpAdd, nil
+	case "set":
+		return lb.HTTPFrontendHeaderOpSet, nil
+	case "remove":
+		return lb.HTTPFrontendHeaderOpRemove, nil
+	}
+	return 0, fmt.Errorf("op %q unknown", s)
+}
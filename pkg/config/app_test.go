@@ -0,0 +1,389 @@
+package config
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simult/simult/pkg/lb"
+	"github.com/simult/simult/pkg/lb/lbtest"
+)
+
+func TestMain(m *testing.M) {
+	lb.PromInitialize(lb.PromOptions{Namespace: "test"})
+	os.Exit(m.Run())
+}
+
+func testFreeAddress(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func testLoadConfig(t *testing.T, data string) *Config {
+	cfg, err := LoadFrom(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestAppPrepareReload(t *testing.T) {
+	addr1, addr2 := testFreeAddress(t), testFreeAddress(t)
+	a, err := NewApp(testLoadConfig(t, `
+backends:
+  b1:
+    servers: ["http://127.0.0.1:1"]
+frontends:
+  f1:
+    defaultbackend: b1
+    listeners:
+      - address: "`+addr1+`"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close(nil)
+
+	cfg := testLoadConfig(t, `
+backends:
+  b2:
+    servers: ["http://127.0.0.1:1"]
+frontends:
+  f1:
+    defaultbackend: b2
+    listeners:
+      - address: "`+addr1+`"
+      - address: "`+addr2+`"
+`)
+	plan, err := a.PrepareReload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]ReloadPlanItem{
+		"created":   {{"backend", "b2"}, {"listener", addr2}},
+		"updated":   {{"frontend", "f1"}, {"listener", addr1}},
+		"destroyed": {{"backend", "b1"}},
+	}
+	for key, got := range map[string][]ReloadPlanItem{"created": plan.Created, "updated": plan.Updated, "destroyed": plan.Destroyed} {
+		if len(got) != len(want[key]) {
+			t.Errorf("%s: got %v, want %v", key, got, want[key])
+			continue
+		}
+		for i := range got {
+			if got[i] != want[key][i] {
+				t.Errorf("%s: got %v, want %v", key, got, want[key])
+			}
+		}
+	}
+	if err := a.Discard(plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Discard(plan); err == nil {
+		t.Error("expected error on second discard")
+	}
+
+	lis, err := net.Listen("tcp", addr2)
+	if err != nil {
+		t.Fatalf("listener of discarded plan is still open: %v", err)
+	}
+	lis.Close()
+
+	an, err := a.Fork(cfg)
+	if err != nil {
+		t.Fatalf("fork after discard: %v", err)
+	}
+	an.Close(nil)
+}
+
+func TestAppStickyCookie(t *testing.T) {
+	for _, tc := range []struct {
+		stickyCookie string
+		ok           bool
+	}{
+		{`{name: lb, samesite: lax}`, true},
+		{`{name: SESSION}`, false},
+		{`{name: lb, samesite: loose}`, false},
+	} {
+		a, err := NewApp(testLoadConfig(t, `
+global:
+  reservedcookienames: [session]
+backends:
+  b1:
+    stickycookie: `+tc.stickyCookie+`
+    servers: ["http://127.0.0.1:1"]
+`))
+		if (err == nil) != tc.ok {
+			t.Errorf("stickycookie %s: got error %v", tc.stickyCookie, err)
+		}
+		if a != nil {
+			a.Close(nil)
+		}
+	}
+}
+
+func TestAppTrustedProxies(t *testing.T) {
+	for _, tc := range []struct {
+		trustedProxies string
+		ok             bool
+	}{
+		{`["10.0.0.0/8", "192.0.2.1", "2001:db8::1"]`, true},
+		{`["10.0.0.0/33"]`, false},
+		{`["proxy"]`, false},
+	} {
+		a, err := NewApp(testLoadConfig(t, `
+frontends:
+  f1:
+    trustedproxies: `+tc.trustedProxies+`
+    listeners: [{address: "127.0.0.1:0"}]
+`))
+		if (err == nil) != tc.ok {
+			t.Errorf("trustedproxies %s: got error %v", tc.trustedProxies, err)
+		}
+		if a != nil {
+			a.Close(nil)
+		}
+	}
+}
+
+func TestAppProxyProtocolNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		networks string
+		ok       bool
+	}{
+		{`["10.0.0.0/8", "192.0.2.1"]`, true},
+		{`["10.0.0.0/33"]`, false},
+	} {
+		a, err := NewApp(testLoadConfig(t, `
+frontends:
+  f1:
+    acceptproxyprotocol: true
+    proxyprotocolnetworks: `+tc.networks+`
+    listeners: [{address: "127.0.0.1:0"}]
+`))
+		if (err == nil) != tc.ok {
+			t.Errorf("proxyprotocolnetworks %s: got error %v", tc.networks, err)
+		}
+		if a != nil {
+			a.Close(nil)
+		}
+	}
+}
+
+func TestAppDefaultBackends(t *testing.T) {
+	for _, tc := range []struct {
+		defaultBackends string
+		ok              bool
+	}{
+		{`{"*.example.com": b1, "api.example.com": b1}`, true},
+		{`{"*.example.com": b2}`, false},
+	} {
+		a, err := NewApp(testLoadConfig(t, `
+backends:
+  b1:
+    servers: ["http://127.0.0.1:1"]
+frontends:
+  f1:
+    defaultbackends: `+tc.defaultBackends+`
+    listeners: [{address: "127.0.0.1:0"}]
+`))
+		if (err == nil) != tc.ok {
+			t.Errorf("defaultbackends %s: got error %v", tc.defaultBackends, err)
+		}
+		if a != nil {
+			a.Close(nil)
+		}
+	}
+}
+
+func TestAppBackendOverride(t *testing.T) {
+	for _, tc := range []struct {
+		backends, networks string
+		ok                 bool
+	}{
+		{`[b1]`, `["10.0.0.0/8", "192.0.2.1"]`, true},
+		{`[b2]`, `["10.0.0.0/8"]`, false},
+		{`[b1]`, `["office"]`, false},
+		{`[b1]`, `[]`, false},
+	} {
+		a, err := NewApp(testLoadConfig(t, `
+backends:
+  b1:
+    servers: ["http://127.0.0.1:1"]
+frontends:
+  f1:
+    overrideheader: X-Simult-Backend
+    overridebackends: `+tc.backends+`
+    overridenetworks: `+tc.networks+`
+    listeners: [{address: "127.0.0.1:0"}]
+`))
+		if (err == nil) != tc.ok {
+			t.Errorf("overridebackends %s overridenetworks %s: got error %v", tc.backends, tc.networks, err)
+		}
+		if a != nil {
+			a.Close(nil)
+		}
+	}
+}
+
+func TestAppConfigInfo(t *testing.T) {
+	cfgs := []string{`
+backends:
+  b1:
+    timeout: 10s
+    servers: ["http://127.0.0.1:1", "http://127.0.0.1:2"]
+  b2:
+    servers: ["http://127.0.0.1:3"]
+frontends:
+  f1:
+    defaultbackend: b1
+    routes:
+      - {host: example.com, backend: b2}
+      - {path: /api, backend: b1}
+`, `
+frontends:
+  f1:
+    routes:
+      - {backend: b2, host: example.com}
+      - {backend: b1, path: /api}
+    defaultbackend: b1
+backends:
+  b2:
+    servers: ["http://127.0.0.1:3"]
+  b1:
+    servers: ["http://127.0.0.1:1", "http://127.0.0.1:2"]
+    timeout: 10s
+`, `
+backends:
+  b1:
+    timeout: 10s
+    servers: ["http://127.0.0.1:1", "http://127.0.0.1:2"]
+  b2:
+    servers: ["http://127.0.0.1:3"]
+frontends:
+  f1:
+    defaultbackend: b2
+    routes:
+      - {host: example.com, backend: b2}
+      - {path: /api, backend: b1}
+`}
+	success := prometheus.Labels{"result": "success"}
+	hashes := make([]string, 0, len(cfgs))
+	for i, data := range cfgs {
+		base := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_reload_total", success)
+		a, err := NewApp(testLoadConfig(t, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, a.info.Hash)
+		if v := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_reload_total", success); v != base+1 {
+			t.Errorf("config %d: got %v successful reloads, want %v", i, v, base+1)
+		}
+		if v := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_info", prometheus.Labels{"hash": a.info.Hash}); v != 1 {
+			t.Errorf("config %d: got config info %v, want 1", i, v)
+		}
+		if v := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_info", nil); v != 1 {
+			t.Errorf("config %d: got config info sum %v, want 1", i, v)
+		}
+		for name, want := range map[string]float64{"frontends": 1, "routes": 2, "backends": 2, "servers": 3} {
+			if v := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_"+name, nil); v != want {
+				t.Errorf("config %d: got %v %s, want %v", i, v, name, want)
+			}
+		}
+		a.Close(nil)
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("reordered config: got hash %s, want %s", hashes[1], hashes[0])
+	}
+	if hashes[0] == hashes[2] {
+		t.Errorf("changed config: got same hash %s", hashes[2])
+	}
+
+	failure := prometheus.Labels{"result": "failure"}
+	base := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_reload_total", failure)
+	if _, err := NewApp(testLoadConfig(t, "frontends:\n  f1:\n    defaultbackend: b3\n")); err == nil {
+		t.Fatal("expected error")
+	}
+	if v := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_reload_total", failure); v != base+1 {
+		t.Errorf("got %v failed reloads, want %v", v, base+1)
+	}
+	if v := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_lb_config_info", prometheus.Labels{"hash": hashes[2]}); v != 1 {
+		t.Errorf("got config info %v after failed reload, want 1", v)
+	}
+}
+
+func TestAppConfigInfoRouteBackends(t *testing.T) {
+	data := func(route string) string {
+		return `
+backends:
+  b1:
+    servers: ["http://127.0.0.1:1"]
+  b2:
+    servers: ["http://127.0.0.1:2"]
+frontends:
+  f1:
+    defaultbackend: b1
+    routes:
+      - {path: /api, backend: b1, ` + route + `}
+`
+	}
+	for _, routes := range [][2]string{
+		{"forwardauth: {backend: b1}", "forwardauth: {backend: b2}"},
+		{"mirror: {backend: b1}", "mirror: {backend: b2}"},
+	} {
+		var hashes [2]string
+		for i, route := range routes {
+			a, err := NewApp(testLoadConfig(t, data(route)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashes[i] = a.info.Hash
+			a.Close(nil)
+		}
+		if hashes[0] == hashes[1] {
+			t.Errorf("routes %q and %q: got same hash %s", routes[0], routes[1], hashes[0])
+		}
+	}
+}
+
+func TestAppShadowedRoutes(t *testing.T) {
+	data := func(strict bool) string {
+		s := "false"
+		if strict {
+			s = "true"
+		}
+		return `
+backends:
+  b1:
+    servers: ["http://127.0.0.1:1"]
+frontends:
+  f1:
+    defaultbackend: b1
+    strictroutes: ` + s + `
+    routes:
+      - path: "/*"
+        backend: b1
+      - host: "www.example.com"
+        path: "/api/*"
+        backend: b1
+`
+	}
+	plan, err := (*App)(nil).PrepareReload(testLoadConfig(t, data(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*App)(nil).Discard(plan)
+	want := `frontend "f1" route 1 (host "www.example.com" path "/api/*") is shadowed by route 0`
+	if len(plan.Warnings) != 1 || plan.Warnings[0] != want {
+		t.Errorf("got warnings %q, want [%q]", plan.Warnings, want)
+	}
+
+	if _, err := (*App)(nil).PrepareReload(testLoadConfig(t, data(true))); err == nil || !strings.Contains(err.Error(), "shadowed") {
+		t.Errorf("got error %v, want shadowed route error in strict mode", err)
+	}
+}
@@ -13,8 +13,20 @@ import (
 // Config stores configuration
 type Config struct {
 	Global struct {
-		PromResetOnReload bool
-		RlimitNofile      uint64
+		PromResetOnReload    bool
+		RlimitNofile         uint64
+		AllowedUpstreamHosts []string
+		PromBucketProfiles   map[string][]float64
+		ReservedCookieNames  []string
+		MaxBufferMemory      int64
+		MaxOpenConns         int64
+		ACME                 struct {
+			Email        string
+			DirectoryURL string
+			CacheDir     string
+			Hosts        []string
+			RenewBefore  time.Duration
+		}
 	}
 	Defaults struct {
 		TLSParams        *TLSParams
@@ -24,49 +36,225 @@ type Config struct {
 		ConnectTimeout   *time.Duration
 	}
 	Frontends map[string]struct {
-		MaxConn          int
-		MaxIdleConn      int
-		Timeout          time.Duration
-		RequestTimeout   *time.Duration
-		MaxKeepAliveReqs *int
-		KeepAliveTimeout *time.Duration
-		DefaultBackend   string
-		DefaultBackup    string
-		Routes           []struct {
-			Host         string
-			Path         string
-			Backend      string
-			Backup       string
+		MaxConn                int
+		MaxIdleConn            int
+		Timeout                time.Duration
+		RequestTimeout         *time.Duration
+		ReadHeaderTimeout      time.Duration
+		RequestBodyTimeout     time.Duration
+		WriteTimeout           time.Duration
+		MaxHeaderBytes         int
+		MaxBodyBytes           int64
+		MaxKeepAliveReqs       *int
+		KeepAliveTimeout       *time.Duration
+		TLSHandshakeTimeout    time.Duration
+		DefaultBackend         string
+		DefaultBackup          string
+		DefaultBackends        map[string]string
+		UnmatchedRequestAction string
+		WriteProfile           string
+		ForwardedHeaders       string
+		EmitForwarded          bool
+		RequestID              string
+		RequestIDHeader        string
+		WebSocketPassthrough   bool
+		TunnelIdleTimeout      time.Duration
+		Via                    bool
+		ViaPseudonym           string
+		ViaLoopDetection       bool
+		TimeoutHeader          string
+		DrainTimeout           time.Duration
+		DrainHeader            bool
+		RedirectToHTTPS        bool
+		RedirectToHTTPSPort    int
+		RedirectTemporary      bool
+		H2C                    bool
+		TCPKeepAlivePeriod     time.Duration
+		TCPNoDelay             bool
+		DSCP                   int
+		StrictParsing          bool
+		AllowedMethods         []string
+		StrictRoutes           bool
+		TrustedProxies         []string
+		AcceptProxyProtocol    bool
+		ProxyProtocolNetworks  []string
+		OverrideHeader         string
+		OverrideBackends       []string
+		OverrideNetworks       []string
+		Routes                 []struct {
+			Host                      string
+			Hosts                     []string
+			Path                      string
+			Query                     string
+			HostIsRegexp              bool
+			PathIsRegexp              bool
+			Priority                  int
+			Methods                   []string
+			Headers                   map[string]string
+			Backend                   string
+			Backup                    string
+			DeniedStatusCode          int
+			DeniedBody                string
+			DeniedRetryAfter          time.Duration
+			ContinueOnRestricted      bool
+			Timeout                   time.Duration
+			ResponseHeaderTimeout     time.Duration
+			MaxResponseBodySize       int64
+			MaxBodyBytes              int64
+			StatusMap                 map[int]int
+			StatusMapBodies           map[int]string
+			StripPathPrefix           string
+			SetHost                   string
+			RewriteLocation           bool
+			MaxResponseBytesPerSecond int64
+			PerClientBytesPerSecond   int64
+			BucketProfile             string
+			CoalesceRequests          bool
+			CoalesceMaxBytes          int64
+			MaxConcurrent             int
+			MaxQueue                  int
+			QueueTimeout              time.Duration
+			GRPC                      bool
+			AuthHook                  struct {
+				Script          string
+				File            string
+				Timeout         time.Duration
+				MaxInstructions int
+				FailOpen        bool
+			}
+			ForwardAuth struct {
+				Backend         string
+				Headers         []string
+				ResponseHeaders []string
+				Timeout         time.Duration
+				FailOpen        bool
+				CacheHeader     string
+				CacheTTL        time.Duration
+			}
+			Backends []struct {
+				Backend string
+				Weight  int
+			}
+			RewritePath struct {
+				Pattern     string
+				Replacement string
+			}
+			Redirect struct {
+				Location string
+				Code     int
+			}
+			Response struct {
+				StatusCode  int
+				ContentType string
+				Body        string
+			}
+			Mirror struct {
+				Backend      string
+				MaxInflight  int
+				MaxBodyBytes int
+				Timeout      time.Duration
+			}
+			BasicAuth struct {
+				Realm       string
+				Users       []string
+				File        string
+				ForwardUser bool
+			}
+			JWT struct {
+				Secret       string
+				KeyFile      string
+				Issuer       string
+				Audience     string
+				ClockSkew    time.Duration
+				ClaimHeaders map[string]string
+			}
+			RequestHeaders []struct {
+				Op    string
+				Name  string
+				Value string
+			}
+			ResponseHeaders []struct {
+				Op    string
+				Name  string
+				Value string
+			}
 			Restrictions []struct {
-				Network  string
-				Path     string
-				Invert   bool
-				AndAfter bool
+				Network         string
+				NetworkListFile string
+				Path            string
+				Query           string
+				Methods         []string
+				HeaderName      string
+				HeaderValue     string
+				CertSubject     string
+				Invert          bool
+				AndAfter        bool
+				RateLimit       struct {
+					Requests int
+					Window   time.Duration
+					Burst    int
+				}
+				TimeWindow struct {
+					Days     []string
+					Start    string
+					End      string
+					Location string
+				}
 			}
 		}
 		Listeners []struct {
-			Address   string
-			TLS       bool
-			TLSParams *TLSParams
+			Address              string
+			TLS                  bool
+			TLSParams            *TLSParams
+			TLSMinVersion        string
+			TLSMaxVersion        string
+			TLSCiphers           []string
+			TLSVersionWarnOnly   bool
+			TLSVersionWarnHeader bool
+			TLSClientAuth        string
+			TLSClientCAs         string
+			TLSClientSANs        []string
+			TLSClientPEMHeader   bool
+			HTTP2                bool
 		}
 	}
 	Backends map[string]struct {
-		MaxConn           int
-		ServerMaxConn     int
-		ServerMaxIdleConn int
-		Timeout           time.Duration
-		ConnectTimeout    *time.Duration
-		ReqHeaders        map[string]string
-		ServerHashSecret  string
-		HealthCheck       string
-		Mode              string
-		AffinityKey       struct {
+		MaxConn               int
+		QueueTimeout          time.Duration
+		MaxQueue              int
+		ShedStatus            int
+		ServerMaxConn         int
+		ServerMaxIdleConn     int
+		Timeout               time.Duration
+		ConnectTimeout        *time.Duration
+		TCPKeepAlivePeriod    time.Duration
+		TCPNoDelay            bool
+		ResponseHeaderTimeout time.Duration
+		MaxResponseBodySize   int64
+		ReqHeaders            map[string]string
+		ServerHashSecret      string
+		HealthCheck           string
+		Mode                  string
+		AffinityKey           struct {
 			Source     string
 			MaxServers int
 			Threshold  int
 		}
-		OverrideErrors string
-		Servers        []string
+		StickyCookie struct {
+			Name     string
+			Path     string
+			MaxAge   int
+			Secure   bool
+			HTTPOnly bool
+			SameSite string
+		}
+		OverrideErrors    string
+		Servers           []string
+		DeadlineAware     bool
+		DSCP              int
+		SourceAddress     string
+		SOCKS5Proxy       string
+		SendProxyProtocol string
 	}
 	HealthChecks map[string]struct {
 		HTTP *struct {
@@ -74,6 +262,14 @@ type Config struct {
 			Interval, Timeout time.Duration
 			Fall, Rise        int
 			Resp              string
+			DSCP              int
+		}
+		GRPC *struct {
+			Service           string
+			Host              string
+			Interval, Timeout time.Duration
+			Fall, Rise        int
+			DSCP              int
 		}
 	}
 }
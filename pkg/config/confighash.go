@@ -0,0 +1,136 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/simult/simult/pkg/lb"
+)
+
+// hashFrontendRoute replaces backend pointers of lb.HTTPFrontendRoute with backend names
+type hashFrontendRoute struct {
+	lb.HTTPFrontendRoute
+	Backend            string
+	Backup             string
+	Backends           []hashWeightedBackend
+	ForwardAuthBackend string
+	MirrorBackend      string
+}
+
+// hashWeightedBackend replaces the backend pointer of lb.HTTPFrontendWeightedBackend with the backend name
+type hashWeightedBackend struct {
+	Backend string
+	Weight  int
+}
+
+// hashFrontendOptions replaces backend pointers of lb.HTTPFrontendOptions with backend names
+type hashFrontendOptions struct {
+	lb.HTTPFrontendOptions
+	DefaultBackend   string
+	DefaultBackup    string
+	DefaultBackends  map[string]string
+	OverrideBackends []string
+	Routes           []hashFrontendRoute
+}
+
+// hashListenerOptions replaces the frontend, the tls config and the certificate store of lb.ListenerOptions with the
+// frontend name, the certificates and the certificate store options
+type hashListenerOptions struct {
+	lb.ListenerOptions
+	Fe           string
+	TLSConfig    [][][]byte
+	TLSCertStore *lb.TLSCertStoreOptions
+}
+
+func hashBackendName(b *lb.HTTPBackend) string {
+	if b == nil {
+		return ""
+	}
+	return b.GetOpts().Name
+}
+
+// configInfo computes the config metrics info of the App. The hash is computed over the normalized options of
+// load-balancing members ordered by kind and name, so it doesn't depend on the order in the config file.
+func (a *App) configInfo() (info lb.PromConfigInfo, err error) {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	names := a.memberNames()
+	for _, name := range names["backend"] {
+		opts := a.backends[name].GetOpts()
+		if err = enc.Encode(opts); err != nil {
+			return
+		}
+		info.Backends++
+		info.Servers += len(opts.Servers)
+	}
+	for _, name := range names["frontend"] {
+		opts := a.frontends[name].GetOpts()
+		hOpts := hashFrontendOptions{
+			HTTPFrontendOptions: opts,
+			DefaultBackend:      hashBackendName(opts.DefaultBackend),
+			DefaultBackup:       hashBackendName(opts.DefaultBackup),
+			DefaultBackends:     make(map[string]string, len(opts.DefaultBackends)),
+			Routes:              make([]hashFrontendRoute, 0, len(opts.Routes)),
+		}
+		for host, b := range opts.DefaultBackends {
+			hOpts.DefaultBackends[host] = hashBackendName(b)
+		}
+		for _, b := range opts.OverrideBackends {
+			hOpts.OverrideBackends = append(hOpts.OverrideBackends, hashBackendName(b))
+		}
+		for _, route := range opts.Routes {
+			hRoute := hashFrontendRoute{
+				HTTPFrontendRoute:  route,
+				Backend:            hashBackendName(route.Backend),
+				Backup:             hashBackendName(route.Backup),
+				ForwardAuthBackend: hashBackendName(route.ForwardAuth.Backend),
+				MirrorBackend:      hashBackendName(route.Mirror.Backend),
+			}
+			for _, wb := range route.Backends {
+				hRoute.Backends = append(hRoute.Backends, hashWeightedBackend{
+					Backend: hashBackendName(wb.Backend),
+					Weight:  wb.Weight,
+				})
+			}
+			hOpts.Routes = append(hOpts.Routes, hRoute)
+		}
+		if err = enc.Encode(hOpts); err != nil {
+			return
+		}
+		info.Frontends++
+		info.Routes += len(opts.Routes)
+	}
+	for _, name := range names["listener"] {
+		opts := a.listeners[name].GetOpts()
+		hOpts := hashListenerOptions{
+			ListenerOptions: opts,
+		}
+		if f, ok := opts.Fe.(*lb.HTTPFrontend); ok {
+			hOpts.Fe = f.GetOpts().Name
+		}
+		if opts.TLSConfig != nil {
+			for _, cert := range opts.TLSConfig.Certificates {
+				hOpts.TLSConfig = append(hOpts.TLSConfig, cert.Certificate)
+			}
+		}
+		if opts.TLSCertStore != nil {
+			csOpts := opts.TLSCertStore.GetOpts()
+			hOpts.TLSCertStore = &csOpts
+			for _, cert := range opts.TLSCertStore.Certificates() {
+				hOpts.TLSConfig = append(hOpts.TLSConfig, cert.Certificate)
+			}
+		}
+		if err = enc.Encode(hOpts); err != nil {
+			return
+		}
+	}
+	// the certificates of acme are renewed without reloading, so only its options are hashed
+	if a.acme != nil {
+		if err = enc.Encode(a.acme.GetOpts()); err != nil {
+			return
+		}
+	}
+	info.Hash = hex.EncodeToString(h.Sum(nil))
+	return
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ReloadPlanItem describes a load-balancing member in a ReloadPlan
+type ReloadPlanItem struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// ReloadPlan describes what would be created, updated or destroyed by a prepared reload
+type ReloadPlan struct {
+	Created   []ReloadPlanItem `json:"created"`
+	Updated   []ReloadPlanItem `json:"updated"`
+	Destroyed []ReloadPlanItem `json:"destroyed"`
+	// Hash is the config hash of the prepared App, as in lb_config_info metric
+	Hash string `json:"hash"`
+	// Warnings are the problems which don't fail the reload, eg shadowed routes, ordered by frontend name
+	Warnings []string `json:"warnings"`
+
+	old      *App
+	app      *App
+	finished bool
+	mu       sync.Mutex
+}
+
+func newReloadPlan(a, an *App) (plan *ReloadPlan) {
+	plan = &ReloadPlan{
+		Created:   []ReloadPlanItem{},
+		Updated:   []ReloadPlanItem{},
+		Destroyed: []ReloadPlanItem{},
+		Hash:      an.info.Hash,
+		Warnings:  []string{},
+		old:       a,
+		app:       an,
+	}
+	var oldNames, newNames map[string][]string
+	if a != nil {
+		oldNames = a.memberNames()
+	}
+	newNames = an.memberNames()
+	for _, name := range newNames["frontend"] {
+		for _, shadow := range an.frontends[name].ShadowedRoutes() {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("frontend %q %v", name, shadow))
+		}
+	}
+	for _, kind := range []string{"healthcheck", "backend", "frontend", "listener"} {
+		old := make(map[string]struct{}, len(oldNames[kind]))
+		for _, name := range oldNames[kind] {
+			old[name] = struct{}{}
+		}
+		for _, name := range newNames[kind] {
+			item := ReloadPlanItem{Kind: kind, Name: name}
+			if _, ok := old[name]; ok {
+				delete(old, name)
+				plan.Updated = append(plan.Updated, item)
+				continue
+			}
+			plan.Created = append(plan.Created, item)
+		}
+		for _, name := range oldNames[kind] {
+			if _, ok := old[name]; ok {
+				plan.Destroyed = append(plan.Destroyed, ReloadPlanItem{Kind: kind, Name: name})
+			}
+		}
+	}
+	return
+}
+
+func (plan *ReloadPlan) finish(a *App) error {
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	if plan.old != a {
+		return errors.New("reload plan prepared by another app")
+	}
+	if plan.finished {
+		return errors.New("reload plan already committed or discarded")
+	}
+	plan.finished = true
+	return nil
+}
+
+func (a *App) memberNames() (names map[string][]string) {
+	names = make(map[string][]string, 4)
+	for name := range a.healthChecks {
+		names["healthcheck"] = append(names["healthcheck"], name)
+	}
+	for name := range a.backends {
+		names["backend"] = append(names["backend"], name)
+	}
+	for name := range a.frontends {
+		names["frontend"] = append(names["frontend"], name)
+	}
+	for name := range a.listeners {
+		names["listener"] = append(names["listener"], name)
+	}
+	for _, n := range names {
+		sort.Strings(n)
+	}
+	return
+}
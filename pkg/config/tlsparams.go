@@ -2,99 +2,32 @@ package config
 
 import (
 	"crypto/tls"
-	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+
+	"github.com/simult/simult/pkg/lb"
 )
 
 // TLSParams is a configuration holder to create tls.Config
 type TLSParams struct {
-	CertPath string
-	KeyPath  string
+	CertPath    string
+	KeyPath     string
+	DefaultCert string
+	StrictSNI   bool
 }
 
-// Config creates a *tls.Config from its own variables
-func (t *TLSParams) Config() (c *tls.Config, err error) {
-	certPath := t.CertPath
-	if certPath == "" {
-		certPath = "."
-	}
-	certFile, err := os.Open(certPath)
-	if err != nil {
-		err = fmt.Errorf("cert path %q open error: %w", certPath, err)
-		return
-	}
-	defer certFile.Close()
-	certStat, err := certFile.Stat()
-	if err != nil {
-		err = fmt.Errorf("cert path %q stat error: %w", certPath, err)
-		return
-	}
-
-	keyPath := t.KeyPath
-	if keyPath == "" {
-		keyPath = "."
-	}
-	keyFile, err := os.Open(keyPath)
-	if err != nil {
-		err = fmt.Errorf("key path %q open error: %w", keyPath, err)
-		return
-	}
-	defer keyFile.Close()
-	keyStat, err := keyFile.Stat()
-	if err != nil {
-		err = fmt.Errorf("key path %q stat error: %w", keyPath, err)
-		return
-	}
-
-	if certStat.IsDir() != keyStat.IsDir() {
-		err = fmt.Errorf("files on cert path %q and key path %q have different file type", certPath, keyPath)
-		return
-	}
-
-	if !certStat.IsDir() {
-		certs := make([]tls.Certificate, 1)
-		certs[0], err = tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			err = fmt.Errorf("error loading certificate pair %q and %q: %w", certPath, keyPath, err)
-			return
-		}
-		c = &tls.Config{
-			Certificates: certs,
-		}
-		return
-	}
-
-	certFileInfos, err := certFile.Readdir(0)
+// Config creates a *tls.Config from its own variables. Its certificates are served by the returned certificate store
+// by server name, with the certificates of acme if it isn't nil.
+func (t *TLSParams) Config(acme *lb.ACMEManager) (c *tls.Config, cs *lb.TLSCertStore, err error) {
+	cs, err = lb.NewTLSCertStore(lb.TLSCertStoreOptions{
+		CertPath:    t.CertPath,
+		KeyPath:     t.KeyPath,
+		DefaultCert: t.DefaultCert,
+		StrictSNI:   t.StrictSNI,
+		ACME:        acme,
+	})
 	if err != nil {
-		err = fmt.Errorf("cert path %q readdir error: %w", certPath, err)
 		return
 	}
-	certs := make([]tls.Certificate, 0, len(certFileInfos))
-	for _, certFi := range certFileInfos {
-		if certFi.IsDir() {
-			continue
-		}
-		certFn := certFi.Name()
-		certExt := filepath.Ext(certFn)
-		if certExt != ".crt" {
-			continue
-		}
-		name := strings.TrimSuffix(certFn, certExt)
-		keyFn := name + ".key"
-		singleCertFile := certPath + "/" + certFn
-		singleKeyFile := keyPath + "/" + keyFn
-		var cert tls.Certificate
-		cert, err = tls.LoadX509KeyPair(singleCertFile, singleKeyFile)
-		if err != nil {
-			err = fmt.Errorf("error loading certificate pair %q and %q: %w", singleCertFile, singleKeyFile, err)
-			return
-		}
-		certs = append(certs, cert)
-	}
 	c = &tls.Config{
-		Certificates:             certs,
 		PreferServerCipherSuites: true,
 	}
 	return
@@ -0,0 +1,110 @@
+package hc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// grpcHealthCheckPath is the path of the Check method of the standard gRPC health service grpc.health.v1.Health
+const grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+// grpcHealthServing is the SERVING status of grpc.health.v1.HealthCheckResponse
+const grpcHealthServing = 1
+
+// grpcMaxRespBytes is the maximum length of the response message of the Check method
+const grpcMaxRespBytes = 4096
+
+// checkGRPC calls the Check method of the standard gRPC health service with the service GRPCService, and it is ok if
+// the call succeeds and the status is SERVING. Messages are encoded by hand, they have only the service and the status.
+func (h *HTTPCheck) checkGRPC(ctx context.Context) (ok bool, err error) {
+	// HealthCheckRequest has the service in field 1, it is omitted if empty
+	var msg []byte
+	if h.opts.GRPCService != "" {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(h.opts.GRPCService)))
+		msg = append(msg, h.opts.GRPCService...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+	req, err := http.NewRequest(http.MethodPost, h.server+grpcHealthCheckPath, bytes.NewReader(frame))
+	if err != nil {
+		return
+	}
+	if h.opts.HeaderHost != "" {
+		req.Host = h.opts.HeaderHost
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	userAgent := "healthcheck"
+	if h.opts.UserAgent != "" {
+		userAgent = h.opts.UserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, grpcMaxRespBytes+1))
+	if err != nil {
+		return
+	}
+	// grpc-status is in the header of trailers-only responses
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" || len(body) < 5 || len(body) > grpcMaxRespBytes || body[0] != 0 {
+		return
+	}
+	msg = body[5:]
+	if int(binary.BigEndian.Uint32(body[1:5])) != len(msg) {
+		return
+	}
+	// HealthCheckResponse has the status in field 1, it is UNKNOWN if omitted
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return
+		}
+		msg = msg[n:]
+		var value uint64
+		switch key & 7 {
+		case 0:
+			if value, n = binary.Uvarint(msg); n <= 0 {
+				return
+			}
+		case 1:
+			n = 8
+		case 2:
+			var l uint64
+			if l, n = binary.Uvarint(msg); n <= 0 || l > uint64(len(msg)-n) {
+				return
+			}
+			n += int(l)
+		case 5:
+			n = 4
+		default:
+			return
+		}
+		if n > len(msg) {
+			return
+		}
+		msg = msg[n:]
+		if key == 1<<3 {
+			ok = value == grpcHealthServing
+		}
+	}
+	return
+}
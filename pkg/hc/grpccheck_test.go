@@ -0,0 +1,61 @@
+package hc
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPCheckGRPC(t *testing.T) {
+	// the health service knows the service "up" which is SERVING, and the service "down" which is NOT_SERVING
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.ProtoMajor != 2 || r.URL.Path != grpcHealthCheckPath || r.Header.Get("Te") != "trailers" || len(body) < 5 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		var status byte
+		switch string(body[5:]) {
+		case "", "\x0a\x02up":
+			status = 1
+		case "\x0a\x04down":
+			status = 2
+		default:
+			// trailers-only response of NOT_FOUND
+			w.Header().Set("Grpc-Status", "5")
+			return
+		}
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	tlsSrv := httptest.NewUnstartedServer(srv.Config.Handler)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	for _, tc := range []struct {
+		server, service string
+		want            bool
+	}{
+		{srv.URL, "", true},
+		{srv.URL, "up", true},
+		{srv.URL, "down", false},
+		{srv.URL, "unknown", false},
+		{tlsSrv.URL, "up", true},
+		{tlsSrv.URL, "down", false},
+	} {
+		h := NewHTTPCheck(tc.server, HTTPCheckOptions{GRPC: true, GRPCService: tc.service})
+		ok, err := h.check(context.Background())
+		h.Close()
+		if ok != tc.want {
+			t.Errorf("got %v %v for service %q on %s, want %v", ok, err, tc.service, tc.server, tc.want)
+		}
+	}
+}
@@ -10,15 +10,28 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/simult/simult/pkg/sockopt"
 )
 
-// HTTPCheckOptions holds HTTP health-check options
+// Dialer dials connections of health-checks
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// HTTPCheckOptions holds HTTP health-check options.
+// Dialer dials connections instead of the default one which has Timeout and DSCP if it is set.
+// If GRPC is set, the server is checked by the standard gRPC health service over HTTP/2 instead of Path and RespBody.
 type HTTPCheckOptions struct {
 	Path, HeaderHost             string
 	Interval, Timeout            time.Duration
 	FallThreshold, RiseThreshold int
 	RespBody                     []byte
 	UserAgent                    string
+	DSCP                         int
+	Dialer                       Dialer
+	GRPC                         bool
+	GRPCService                  string
 }
 
 // CopyFrom sets the underlying HTTPCheckOptions by given HTTPCheckOptions
@@ -69,28 +82,58 @@ type HTTPCheck struct {
 
 // NewHTTPCheck creates a new HTTPCheck with given options
 func NewHTTPCheck(server string, opts HTTPCheckOptions) (h *HTTPCheck) {
+	return newHTTPCheck(server, opts, -1)
+}
+
+// NewHTTPCheckWithDelay creates a new HTTPCheck with given options. The first check starts after given delay instead of interval
+func NewHTTPCheckWithDelay(server string, opts HTTPCheckOptions, delay time.Duration) (h *HTTPCheck) {
+	if delay < 0 {
+		delay = 0
+	}
+	return newHTTPCheck(server, opts, delay)
+}
+
+func newHTTPCheck(server string, opts HTTPCheckOptions, delay time.Duration) (h *HTTPCheck) {
 	h = &HTTPCheck{
 		server: server,
 	}
 	h.opts.CopyFrom(&opts)
+	if delay < 0 {
+		delay = h.opts.Interval
+	}
+	dialer := &net.Dialer{
+		Timeout:   h.opts.Timeout,
+		KeepAlive: h.opts.Timeout / 2,
+		DualStack: true,
+	}
+	if h.opts.DSCP != 0 {
+		dialer.Control = sockopt.DSCPControl(h.opts.DSCP)
+	}
+	dialContext := dialer.DialContext
+	if h.opts.Dialer != nil {
+		dialContext = h.opts.Dialer.DialContext
+	}
+	transport := &http.Transport{
+		DialContext:           dialContext,
+		DisableKeepAlives:     true,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeTimeout:   h.opts.Timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if h.opts.GRPC {
+		// h2 for https servers, h2c with prior knowledge for http servers
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
 	h.client = &http.Client{
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   h.opts.Timeout,
-				KeepAlive: h.opts.Timeout / 2,
-				DualStack: true,
-			}).DialContext,
-			DisableKeepAlives:     true,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-			TLSHandshakeTimeout:   h.opts.Timeout,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
 	h.c = make(chan bool, 1)
-	h.workerTmr = time.NewTimer(h.opts.Interval)
+	h.workerTmr = time.NewTimer(delay)
 	h.workerCtx, h.workerCtxCancel = context.WithCancel(context.Background())
 	h.workerWg.Add(1)
 	go h.worker(h.workerCtx)
@@ -107,6 +150,12 @@ func (h *HTTPCheck) Close() {
 	h.healthyMu.Unlock()
 }
 
+// GetOpts returns a copy of underlying HTTPCheck's options
+func (h *HTTPCheck) GetOpts() (opts HTTPCheckOptions) {
+	opts.CopyFrom(&h.opts)
+	return
+}
+
 // Healthy gives current health status
 func (h *HTTPCheck) Healthy() bool {
 	h.healthyMu.RLock()
@@ -121,6 +170,9 @@ func (h *HTTPCheck) Check() <-chan bool {
 }
 
 func (h *HTTPCheck) check(ctx context.Context) (ok bool, err error) {
+	if h.opts.GRPC {
+		return h.checkGRPC(ctx)
+	}
 	req, err := http.NewRequest(http.MethodGet, h.server+h.opts.Path, nil)
 	if err != nil {
 		return
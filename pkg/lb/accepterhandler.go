@@ -5,9 +5,12 @@ import (
 	"crypto/tls"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 type accepterHandler struct {
+	lis net.Listener
+
 	mu        sync.RWMutex
 	le        *Listener
 	fe        Frontend
@@ -15,6 +18,8 @@ type accepterHandler struct {
 
 	shared   bool
 	sharedMu sync.Mutex
+
+	closed uint32
 }
 
 func (ah *accepterHandler) Set(le *Listener, fe Frontend, tlsConfig *tls.Config) {
@@ -46,3 +51,11 @@ func (ah *accepterHandler) SetShared(status bool) bool {
 	ah.sharedMu.Unlock()
 	return r
 }
+
+func (ah *accepterHandler) SetClosed() {
+	atomic.StoreUint32(&ah.closed, 1)
+}
+
+func (ah *accepterHandler) IsClosed() bool {
+	return atomic.LoadUint32(&ah.closed) != 0
+}
@@ -0,0 +1,438 @@
+package lb
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goinsane/xlog"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// acmeHTTPChallengePrefix is the path prefix of HTTP-01 challenge requests
+	acmeHTTPChallengePrefix = "/.well-known/acme-challenge/"
+
+	// acmeDefaultRenewBefore is the default period before the expiry of a certificate to renew it
+	acmeDefaultRenewBefore = 30 * 24 * time.Hour
+
+	// acmeObtainTimeout is the maximum duration of obtaining a certificate
+	acmeObtainTimeout = 5 * time.Minute
+
+	// acmeAccountKeyFile is the name of the account key file in the cache directory
+	acmeAccountKeyFile = "acme_account.key"
+)
+
+// httpACMEBackend is the backend and server label of the requests which are answered with ACME challenge responses
+const httpACMEBackend = "<acme>"
+
+var (
+	// acmeCheckInterval is the interval of checking the certificates for renewal
+	acmeCheckInterval = time.Hour
+
+	// acmeRetryInterval is the interval of checking the certificates again after a failure
+	acmeRetryInterval = 10 * time.Minute
+)
+
+// ACMEManagerOptions holds ACMEManager options
+type ACMEManagerOptions struct {
+	// Email is the contact of the ACME account
+	Email string
+
+	// DirectoryURL is the ACME directory of the CA. Empty means Let's Encrypt.
+	DirectoryURL string
+
+	// CacheDir is the directory which holds the account key and the certificates
+	CacheDir string
+
+	// Hosts are the host names which certificates are obtained for
+	Hosts []string
+
+	// RenewBefore is the period before the expiry of a certificate to renew it. Zero means 30 days.
+	RenewBefore time.Duration
+}
+
+// CopyFrom sets the underlying ACMEManagerOptions by given ACMEManagerOptions
+func (o *ACMEManagerOptions) CopyFrom(src *ACMEManagerOptions) {
+	*o = *src
+	o.Hosts = make([]string, 0, len(src.Hosts))
+	for _, host := range src.Hosts {
+		o.Hosts = append(o.Hosts, strings.TrimSuffix(strings.ToLower(host), "."))
+	}
+	sort.Strings(o.Hosts)
+}
+
+// ACMEManager obtains the certificates of allowed hosts from an ACME CA by HTTP-01 challenges, and renews them in
+// the background before they expire. The challenges are answered by the HTTP frontends which have the ACMEManager, and
+// the certificates are served by the TLS certificate stores which have the ACMEManager.
+type ACMEManager struct {
+	opts  ACMEManagerOptions
+	hosts map[string]struct{}
+
+	certs    atomic.Value
+	certsMu  sync.Mutex
+	tokens   map[string]string
+	tokensMu sync.RWMutex
+	client   *acme.Client
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	workerWg  sync.WaitGroup
+	activated uint32
+}
+
+// NewACMEManager creates a new ACMEManager by given options and loads the cached certificates
+func NewACMEManager(opts ACMEManagerOptions) (m *ACMEManager, err error) {
+	m = &ACMEManager{
+		hosts:  make(map[string]struct{}),
+		tokens: make(map[string]string),
+	}
+	m.opts.CopyFrom(&opts)
+	if m.opts.CacheDir == "" {
+		return nil, errors.New("cache dir required")
+	}
+	if m.opts.RenewBefore <= 0 {
+		m.opts.RenewBefore = acmeDefaultRenewBefore
+	}
+	if err = os.MkdirAll(m.opts.CacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("cache dir %q: %w", m.opts.CacheDir, err)
+	}
+	certs := make(map[string]*tls.Certificate, len(m.opts.Hosts))
+	for _, host := range m.opts.Hosts {
+		if host == "" || strings.ContainsAny(host, "*/\\") {
+			return nil, fmt.Errorf("host %q invalid", host)
+		}
+		m.hosts[host] = struct{}{}
+		if cert, e := m.loadCert(host); e == nil {
+			certs[host] = cert
+		} else if !os.IsNotExist(e) {
+			xlog.V(1).Warningf("acme certificate of host %q cache load error: %v", host, e)
+		}
+	}
+	m.certs.Store(certs)
+	m.ctx, m.ctxCancel = context.WithCancel(context.Background())
+	return
+}
+
+// Activate starts obtaining the missing certificates and renewing the others in the background
+func (m *ACMEManager) Activate() {
+	if !atomic.CompareAndSwapUint32(&m.activated, 0, 1) {
+		return
+	}
+	m.workerWg.Add(1)
+	go m.worker()
+}
+
+// Close stops obtaining certificates
+func (m *ACMEManager) Close() {
+	m.ctxCancel()
+	m.workerWg.Wait()
+}
+
+// GetOpts returns a copy of underlying ACMEManager's options
+func (m *ACMEManager) GetOpts() (opts ACMEManagerOptions) {
+	opts.CopyFrom(&m.opts)
+	return
+}
+
+// IsAllowed returns whether the host is one of the allowed hosts
+func (m *ACMEManager) IsAllowed(host string) bool {
+	_, ok := m.hosts[strings.TrimSuffix(strings.ToLower(host), ".")]
+	return ok
+}
+
+// Certificate returns the certificate of the host, or nil if it hasn't been obtained yet
+func (m *ACMEManager) Certificate(host string) *tls.Certificate {
+	return m.certs.Load().(map[string]*tls.Certificate)[strings.TrimSuffix(strings.ToLower(host), ".")]
+}
+
+// Certificates returns the certificates which are in use ordered by host
+func (m *ACMEManager) Certificates() []tls.Certificate {
+	certs := m.certs.Load().(map[string]*tls.Certificate)
+	result := make([]tls.Certificate, 0, len(certs))
+	for _, host := range m.opts.Hosts {
+		if cert, ok := certs[host]; ok {
+			result = append(result, *cert)
+		}
+	}
+	return result
+}
+
+// HTTPChallengeResponse returns the key authorization of the HTTP-01 challenge on the path, ok is false if the path
+// isn't a challenge in progress
+func (m *ACMEManager) HTTPChallengeResponse(path string) (keyAuth string, ok bool) {
+	m.tokensMu.RLock()
+	defer m.tokensMu.RUnlock()
+	keyAuth, ok = m.tokens[path]
+	return
+}
+
+// setCert swaps the certificate of the host atomically
+func (m *ACMEManager) setCert(host string, cert *tls.Certificate) {
+	m.certsMu.Lock()
+	defer m.certsMu.Unlock()
+	old := m.certs.Load().(map[string]*tls.Certificate)
+	certs := make(map[string]*tls.Certificate, len(old)+1)
+	for k, v := range old {
+		certs[k] = v
+	}
+	certs[host] = cert
+	m.certs.Store(certs)
+}
+
+func (m *ACMEManager) worker() {
+	defer m.workerWg.Done()
+	for {
+		d := acmeCheckInterval
+		if !m.check() {
+			d = acmeRetryInterval
+		}
+		tmr := time.NewTimer(d)
+		select {
+		case <-tmr.C:
+		case <-m.ctx.Done():
+			tmr.Stop()
+			return
+		}
+	}
+}
+
+// check obtains the certificates which are missing or due to renewal, ok is false if any of them couldn't be obtained
+func (m *ACMEManager) check() (ok bool) {
+	ok = true
+	for _, host := range m.opts.Hosts {
+		if cert := m.Certificate(host); cert != nil && time.Until(cert.Leaf.NotAfter) > m.opts.RenewBefore {
+			continue
+		}
+		cert, err := m.obtain(host)
+		if err != nil {
+			if m.ctx.Err() != nil {
+				return
+			}
+			ok = false
+			xlog.V(1).Warningf("acme certificate of host %q obtain error: %v", host, err)
+			continue
+		}
+		m.setCert(host, cert)
+		if err = m.saveCert(host, cert); err != nil {
+			xlog.V(1).Warningf("acme certificate of host %q cache save error: %v", host, err)
+		}
+		xlog.V(2).Infof("acme certificate of host %q obtained, expires at %v", host, cert.Leaf.NotAfter)
+	}
+	return
+}
+
+// acmeClient returns the client of the account, registering the account on first use
+func (m *ACMEManager) acmeClient(ctx context.Context) (client *acme.Client, err error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+	key, err := m.loadAccountKey()
+	if err != nil {
+		return nil, err
+	}
+	client = &acme.Client{
+		Key:          key,
+		DirectoryURL: m.opts.DirectoryURL,
+	}
+	acct := &acme.Account{}
+	if m.opts.Email != "" {
+		acct.Contact = []string{"mailto:" + m.opts.Email}
+	}
+	if _, err = client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("account register error: %w", err)
+	}
+	m.client = client
+	return client, nil
+}
+
+// obtain orders a certificate of the host, and answers its HTTP-01 challenges
+func (m *ACMEManager) obtain(host string) (cert *tls.Certificate, err error) {
+	ctx, ctxCancel := context.WithTimeout(m.ctx, acmeObtainTimeout)
+	defer ctxCancel()
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return nil, fmt.Errorf("order error: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err = m.authorize(ctx, client, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("order wait error: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{host}}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize error: %w", err)
+	}
+	cert = &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  key,
+	}
+	if cert.Leaf, err = x509.ParseCertificate(der[0]); err != nil {
+		return nil, fmt.Errorf("certificate parse error: %w", err)
+	}
+	if err = cert.Leaf.VerifyHostname(host); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// authorize answers the HTTP-01 challenge of the pending authorization, and waits until it's valid
+func (m *ACMEManager) authorize(ctx context.Context, client *acme.Client, authzURL string) (err error) {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("authorization error: %w", err)
+	}
+	if authz.Status != acme.StatusPending {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("authorization of %q has no http-01 challenge", authz.Identifier.Value)
+	}
+	keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	path := client.HTTP01ChallengePath(chal.Token)
+	m.tokensMu.Lock()
+	m.tokens[path] = keyAuth
+	m.tokensMu.Unlock()
+	defer func() {
+		m.tokensMu.Lock()
+		delete(m.tokens, path)
+		m.tokensMu.Unlock()
+	}()
+	if _, err = client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("challenge accept error: %w", err)
+	}
+	if _, err = client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization wait error: %w", err)
+	}
+	return nil
+}
+
+// loadAccountKey loads the account key from the cache directory, or generates and saves a new one
+func (m *ACMEManager) loadAccountKey() (key crypto.Signer, err error) {
+	fn := filepath.Join(m.opts.CacheDir, acmeAccountKeyFile)
+	data, err := ioutil.ReadFile(fn)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("account key %q invalid", fn)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.writeCacheFile(acmeAccountKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return ecKey, nil
+}
+
+// loadCert loads the certificate of the host from the cache directory
+func (m *ACMEManager) loadCert(host string) (cert *tls.Certificate, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(m.opts.CacheDir, host+".pem"))
+	if err != nil {
+		return nil, err
+	}
+	c, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if err = c.Leaf.VerifyHostname(host); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// saveCert saves the key and the certificate chain of the host into the cache directory as a PEM file
+func (m *ACMEManager) saveCert(host string, cert *tls.Certificate) (err error) {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, b := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	return m.writeCacheFile(host+".pem", data)
+}
+
+// writeCacheFile replaces the file in the cache directory atomically
+func (m *ACMEManager) writeCacheFile(name string, data []byte) (err error) {
+	f, err := ioutil.TempFile(m.opts.CacheDir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(m.opts.CacheDir, name))
+}
+
+// serveACMEChallenge answers the HTTP-01 challenge request of an allowed host
+func (f *HTTPFrontend) serveACMEChallenge(reqDesc *httpReqDesc, m *ACMEManager) (err error) {
+	hdr := make(http.Header, 4)
+	keyAuth, ok := m.HTTPChallengeResponse(reqDesc.feURL.Path)
+	if !ok {
+		return f.serveDirectResponse(reqDesc, httpACMEBackend, http.StatusNotFound, hdr, nil)
+	}
+	hdr.Set("Content-Type", "text/plain")
+	return f.serveDirectResponse(reqDesc, httpACMEBackend, http.StatusOK, hdr, []byte(keyAuth))
+}
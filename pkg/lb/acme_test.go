@@ -0,0 +1,319 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme"
+)
+
+// testACMECA is a minimal RFC 8555 CA which validates HTTP-01 challenges on the frontend address validateAddr. It
+// issues certificates for an hour.
+type testACMECA struct {
+	*httptest.Server
+	validateAddr string
+	caCert       *x509.Certificate
+	caKey        *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	nonce      int
+	thumbprint string
+	host       string
+	status     string
+	cert       []byte
+	issued     int
+}
+
+func newTestACMECA(t *testing.T) *testACMECA {
+	ca := &testACMECA{}
+	var err error
+	ca.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.caKey.PublicKey, ca.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.caCert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.Server = httptest.NewServer(http.HandlerFunc(ca.serve))
+	return ca
+}
+
+// payload decodes the JWS request, and returns its payload and the thumbprint of its jwk if it has
+func (ca *testACMECA) payload(r *http.Request) (payload []byte, thumbprint string, err error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return
+	}
+	if payload, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil {
+		return
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return
+	}
+	var hdr struct {
+		JWK *struct {
+			X string `json:"x"`
+			Y string `json:"y"`
+		} `json:"jwk"`
+	}
+	if err = json.Unmarshal(protected, &hdr); err != nil || hdr.JWK == nil {
+		return
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(hdr.JWK.X)
+	y, _ := base64.RawURLEncoding.DecodeString(hdr.JWK.Y)
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	thumbprint, err = acme.JWKThumbprint(pub)
+	return
+}
+
+func (ca *testACMECA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", ca.nonce))
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.URL + "/nonce",
+			"newAccount": ca.URL + "/account",
+			"newOrder":   ca.URL + "/order",
+			"revokeCert": ca.URL + "/revoke",
+			"keyChange":  ca.URL + "/keychange",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	payload, thumbprint, err := ca.payload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	order := func(code int) {
+		w.Header().Set("Location", ca.URL+"/order/1")
+		w.WriteHeader(code)
+		o := map[string]interface{}{
+			"status":         ca.status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": ca.host}},
+			"authorizations": []string{ca.URL + "/authz/1"},
+			"finalize":       ca.URL + "/finalize/1",
+		}
+		if ca.status == "valid" {
+			o["certificate"] = ca.URL + "/cert/1"
+		}
+		json.NewEncoder(w).Encode(o)
+	}
+	challenge := map[string]string{"type": "http-01", "url": ca.URL + "/chal/1", "token": "token1", "status": "pending"}
+	switch r.URL.Path {
+	case "/account":
+		ca.thumbprint = thumbprint
+		w.Header().Set("Location", ca.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &req)
+		ca.host, ca.status = req.Identifiers[0].Value, "pending"
+		order(http.StatusCreated)
+	case "/order/1":
+		order(http.StatusOK)
+	case "/authz/1":
+		authzStatus := "pending"
+		if ca.status != "pending" {
+			authzStatus, challenge["status"] = "valid", "valid"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     authzStatus,
+			"identifier": map[string]string{"type": "dns", "value": ca.host},
+			"challenges": []map[string]string{challenge},
+		})
+	case "/chal/1":
+		// the challenge is validated on the frontend by the host of the order
+		req, _ := http.NewRequest("GET", "http://"+ca.validateAddr+acmeHTTPChallengePrefix+"token1", nil)
+		req.Host = ca.host
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && string(body) == "token1."+ca.thumbprint {
+				ca.status, challenge["status"] = "ready", "valid"
+			}
+		}
+		json.NewEncoder(w).Encode(challenge)
+	case "/finalize/1":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		csrDer, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(csrDer)
+		if err != nil || ca.status != "ready" {
+			http.Error(w, "order not ready", http.StatusForbidden)
+			return
+		}
+		ca.issued++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(ca.issued) + 1),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ca.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+		ca.status = "valid"
+		order(http.StatusOK)
+	case "/cert/1":
+		w.Write(ca.cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestACMEManager(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "acme", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestACMECA(t)
+	defer ca.Close()
+	m, err := NewACMEManager(ACMEManagerOptions{
+		Email:        "admin@example.com",
+		DirectoryURL: ca.URL + "/dir",
+		CacheDir:     dir,
+		Hosts:        []string{"ACME.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "acme",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+		ACME:             m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+	ca.validateAddr = fLis.Addr().String()
+
+	labels := prometheus.Labels{"frontend": "acme", "backend": httpACMEBackend, "server": httpACMEBackend, "code": "4xx", "error": ""}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	if resp, _ := doTestRequestOnce(t, fLis, "GET /.well-known/acme-challenge/unknown HTTP/1.1\r\nHost: acme.example.com\r\n\r\n"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d for unknown token, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 1 {
+		t.Errorf("got %v acme requests, want 1", n)
+	}
+	if resp, body := doTestRequestOnce(t, fLis, "GET /.well-known/acme-challenge/unknown HTTP/1.1\r\nHost: other.example.com\r\n\r\n"); resp.StatusCode != http.StatusOK || body != "OK" {
+		t.Errorf("got %d %q for host which isn't allowed, want backend response", resp.StatusCode, body)
+	}
+
+	cs, err := NewTLSCertStore(TLSCertStoreOptions{StrictSNI: true, ACME: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLis := runTestListener(t, ListenerOptions{
+		Fe:           f,
+		TLSConfig:    &tls.Config{},
+		TLSCertStore: cs,
+	})
+	defer tlsLis.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.caCert)
+	handshake := func() (serial int64, err error) {
+		conn, err := tls.Dial("tcp", tlsLis.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "acme.example.com"})
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+	}
+	if _, err := handshake(); err == nil {
+		t.Error("expected handshake error before the certificate is obtained")
+	}
+
+	// the certificates of an hour are always due to renewal by default, so they are renewed on every check
+	defer func(d time.Duration) { acmeCheckInterval = d }(acmeCheckInterval)
+	acmeCheckInterval = 200 * time.Millisecond
+	m.Activate()
+	for i := 0; i < 100 && m.Certificate("acme.example.com") == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	serial, err := handshake()
+	if err != nil {
+		t.Fatalf("got handshake error %v, want obtained certificate", err)
+	}
+	var renewed int64
+	for i := 0; i < 100; i++ {
+		if renewed, err = handshake(); err != nil || renewed != serial {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil || renewed == serial {
+		t.Errorf("got certificate serial %d %v, want renewed certificate after serial %d", renewed, err, serial)
+	}
+	m.Close()
+
+	// the certificate is loaded from the cache directory without obtaining it
+	m, err = NewACMEManager(ACMEManagerOptions{
+		CacheDir: dir,
+		Hosts:    []string{"acme.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if certs := m.Certificates(); len(certs) != 1 || certs[0].Leaf.Subject.CommonName != "acme.example.com" {
+		t.Errorf("got %d cached certificates, want certificate of allowed host", len(certs))
+	}
+}
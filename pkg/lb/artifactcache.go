@@ -0,0 +1,56 @@
+package lb
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// artifactCache is a content-addressed cache of compiled artifacts, eg regexes, shared across Fork generations.
+// Entries that aren't used between two sweeps are removed by the sweep.
+type artifactCache struct {
+	mu    sync.Mutex
+	items map[string]*artifactCacheItem
+}
+
+type artifactCacheItem struct {
+	value interface{}
+	used  uint32
+}
+
+var compiledArtifacts = &artifactCache{
+	items: make(map[string]*artifactCacheItem),
+}
+
+// Get returns cached artifact by given key, or builds and caches it if not exists
+func (c *artifactCache) Get(key string, build func() interface{}) interface{} {
+	c.mu.Lock()
+	item, ok := c.items[key]
+	if !ok {
+		item = &artifactCacheItem{
+			value: build(),
+		}
+		c.items[key] = item
+	}
+	c.mu.Unlock()
+	atomic.StoreUint32(&item.used, 1)
+	return item.value
+}
+
+// Sweep removes the artifacts which haven't been used since previous sweep, and returns the count of them
+func (c *artifactCache) Sweep() (n int) {
+	c.mu.Lock()
+	for key, item := range c.items {
+		if atomic.SwapUint32(&item.used, 0) == 0 {
+			delete(c.items, key)
+			n++
+		}
+	}
+	c.mu.Unlock()
+	return
+}
+
+// SweepArtifactCache removes compiled artifacts which aren't used by any Fork since previous call, and returns the count of them.
+// It should be called after a reload completes.
+func SweepArtifactCache() int {
+	return compiledArtifacts.Sweep()
+}
@@ -0,0 +1,260 @@
+package lb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	authHookDefaultTimeout         = 10 * time.Millisecond
+	authHookDefaultMaxInstructions = 100000
+)
+
+var errAuthHookInstructionBudget = errors.New("instruction budget exceeded")
+
+var authHookClosedCh = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// authHookContext cancels a Lua call after the given number of instructions, because the Lua VM checks Done once per instruction
+type authHookContext struct {
+	context.Context
+	remaining int
+}
+
+func (c *authHookContext) Done() <-chan struct{} {
+	c.remaining--
+	if c.remaining < 0 {
+		return authHookClosedCh
+	}
+	return c.Context.Done()
+}
+
+func (c *authHookContext) Err() error {
+	if c.remaining < 0 {
+		return errAuthHookInstructionBudget
+	}
+	return c.Context.Err()
+}
+
+type authHookState struct {
+	L         *lua.LState
+	authorize *lua.LFunction
+}
+
+type authHookResult struct {
+	Allow  bool
+	Status int
+	Header http.Header
+}
+
+// authHook runs the authorize function of a Lua program with pooled states
+type authHook struct {
+	proto           *lua.FunctionProto
+	timeout         time.Duration
+	maxInstructions int
+	states          sync.Pool
+}
+
+func newAuthHook(script string, timeout time.Duration, maxInstructions int) (h *authHook, err error) {
+	h = &authHook{
+		timeout:         timeout,
+		maxInstructions: maxInstructions,
+	}
+	if h.timeout <= 0 {
+		h.timeout = authHookDefaultTimeout
+	}
+	if h.maxInstructions <= 0 {
+		h.maxInstructions = authHookDefaultMaxInstructions
+	}
+	chunk, err := parse.Parse(strings.NewReader(script), "authhook")
+	if err != nil {
+		h = nil
+		return
+	}
+	h.proto, err = lua.Compile(chunk, "authhook")
+	if err != nil {
+		h = nil
+		return
+	}
+	var s *authHookState
+	s, err = h.newState(context.Background())
+	if err != nil {
+		h = nil
+		return
+	}
+	h.states.Put(s)
+	return
+}
+
+func (h *authHook) newState(ctx context.Context) (s *authHookState, err error) {
+	L := lua.NewState(lua.Options{
+		CallStackSize:   64,
+		RegistrySize:    1024,
+		RegistryMaxSize: 64 * 1024,
+		SkipOpenLibs:    true,
+	})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "print", "_printregs", "module", "require", "collectgarbage", "getfenv", "setfenv", "newproxy"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if strTbl, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		strTbl.RawSetString("rep", lua.LNil)
+		strTbl.RawSetString("dump", lua.LNil)
+	}
+	L.SetGlobal("simult", L.SetFuncs(L.NewTable(), authHookFuncs))
+
+	ctx, ctxCancel := context.WithTimeout(ctx, h.timeout)
+	defer ctxCancel()
+	L.SetContext(&authHookContext{Context: ctx, remaining: h.maxInstructions})
+	L.Push(L.NewFunctionFromProto(h.proto))
+	err = L.PCall(0, 0, nil)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return
+	}
+	fn, ok := L.GetGlobal("authorize").(*lua.LFunction)
+	if !ok {
+		L.Close()
+		err = errors.New("authorize function not defined")
+		return
+	}
+	s = &authHookState{
+		L:         L,
+		authorize: fn,
+	}
+	return
+}
+
+// Authorize calls the authorize function of the program with the request and returns its decision.
+// The call is cancelled when the timeout or the instruction budget exceeded.
+func (h *authHook) Authorize(ctx context.Context, method, uri, path string, header http.Header, clientIP string) (res authHookResult, err error) {
+	s, _ := h.states.Get().(*authHookState)
+	if s == nil {
+		s, err = h.newState(ctx)
+		if err != nil {
+			return
+		}
+	}
+	L := s.L
+
+	req := L.NewTable()
+	req.RawSetString("method", lua.LString(method))
+	req.RawSetString("uri", lua.LString(uri))
+	req.RawSetString("path", lua.LString(path))
+	req.RawSetString("client_ip", lua.LString(clientIP))
+	hdr := L.NewTable()
+	for k, v := range header {
+		hdr.RawSetString(strings.ToLower(k), lua.LString(strings.Join(v, ", ")))
+	}
+	req.RawSetString("headers", hdr)
+
+	ctx, ctxCancel := context.WithTimeout(ctx, h.timeout)
+	defer ctxCancel()
+	L.SetContext(&authHookContext{Context: ctx, remaining: h.maxInstructions})
+	err = L.CallByParam(lua.P{Fn: s.authorize, NRet: 3, Protect: true}, req)
+	L.RemoveContext()
+	if err != nil {
+		// the state may be left inconsistent by a cancelled call
+		L.Close()
+		return
+	}
+
+	res.Allow = lua.LVAsBool(L.Get(-3))
+	if n, ok := L.Get(-2).(lua.LNumber); ok {
+		res.Status = int(n)
+	}
+	if tbl, ok := L.Get(-1).(*lua.LTable); ok {
+		res.Header = make(http.Header)
+		tbl.ForEach(func(k, v lua.LValue) {
+			if k.Type() != lua.LTString || (v.Type() != lua.LTString && v.Type() != lua.LTNumber) {
+				return
+			}
+			name, value := k.String(), v.String()
+			// header injection must not be possible
+			if name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+				return
+			}
+			// framing and hop-by-hop headers belong to the connections of the proxy
+			if isHopByHopOrFramingHeader(http.CanonicalHeaderKey(name)) {
+				return
+			}
+			res.Header.Set(name, value)
+		})
+	}
+	L.Pop(3)
+	h.states.Put(s)
+
+	if !res.Allow && res.Status != 0 && (res.Status < 400 || res.Status > 599) {
+		err = fmt.Errorf("deny status %d out of range", res.Status)
+		return
+	}
+	return
+}
+
+var authHookFuncs = map[string]lua.LGFunction{
+	"hmac_sha256": func(L *lua.LState) int {
+		m := hmac.New(sha256.New, []byte(L.CheckString(1)))
+		m.Write([]byte(L.CheckString(2)))
+		L.Push(lua.LString(m.Sum(nil)))
+		return 1
+	},
+	"sha256": func(L *lua.LState) int {
+		sum := sha256.Sum256([]byte(L.CheckString(1)))
+		L.Push(lua.LString(sum[:]))
+		return 1
+	},
+	"hex": func(L *lua.LState) int {
+		L.Push(lua.LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+		return 1
+	},
+	"base64": func(L *lua.LState) int {
+		L.Push(lua.LString(base64.StdEncoding.EncodeToString([]byte(L.CheckString(1)))))
+		return 1
+	},
+	"unbase64": func(L *lua.LState) int {
+		b, err := base64.StdEncoding.DecodeString(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(lua.LString(b))
+		return 1
+	},
+	"equal": func(L *lua.LState) int {
+		L.Push(lua.LBool(subtle.ConstantTimeCompare([]byte(L.CheckString(1)), []byte(L.CheckString(2))) == 1))
+		return 1
+	},
+	"time": func(L *lua.LState) int {
+		L.Push(lua.LNumber(time.Now().Unix()))
+		return 1
+	},
+}
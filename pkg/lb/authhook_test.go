@@ -0,0 +1,172 @@
+package lb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuthHookExample(t testing.TB) *authHook {
+	script, err := ioutil.ReadFile("../../conf/authhook.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newAuthHook(string(script), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testAuthHookSign(secret, method, uri string, hdr http.Header) {
+	date := strconv.FormatInt(time.Now().Unix(), 10)
+	hdr.Set("X-Date", date)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(method + "\n" + uri + "\n" + date + "\n" + hdr.Get("X-Client-Id")))
+	hdr.Set("X-Signature", hex.EncodeToString(m.Sum(nil)))
+}
+
+func TestAuthHook(t *testing.T) {
+	h, err := newAuthHook(`
+function authorize(req)
+  if req.path == "/deny" then
+    return false, 429, { ["Retry-After"] = 10, ["Bad\r\nName"] = "x", ["X-Bad"] = "a\r\nb", ["content-length"] = 1 }
+  end
+  if req.path == "/error" then
+    error("failed")
+  end
+  if req.path == "/loop" then
+    while true do end
+  end
+  if req.path == "/status" then
+    return false, 200
+  end
+  if req.path == "/headers" then
+    return true, 0, { ["X-User-Id"] = 1, Host = "evil", ["Content-Length"] = 0, ["Transfer-Encoding"] = "chunked", Connection = "close", ["keep-alive"] = "x", Upgrade = "h2c" }
+  end
+  return req.headers["x-user"] == "alice" and req.method == "GET" and req.client_ip == "127.0.0.1"
+end
+`, 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := http.Header{"X-User": {"alice"}}
+	for _, tc := range []struct {
+		path  string
+		allow bool
+		err   bool
+	}{
+		{"/", true, false},
+		{"/deny", false, false},
+		{"/error", false, true},
+		{"/loop", false, true},
+		{"/status", false, true},
+		{"/headers", true, false},
+		{"/", true, false},
+	} {
+		res, err := h.Authorize(context.Background(), "GET", tc.path, tc.path, hdr, "127.0.0.1")
+		if (err != nil) != tc.err || res.Allow != tc.allow {
+			t.Errorf("path %q: got allow %v error %v", tc.path, res.Allow, err)
+		}
+		if tc.path == "/loop" && !strings.Contains(err.Error(), errAuthHookInstructionBudget.Error()) {
+			t.Errorf("path %q: expected instruction budget error, got %v", tc.path, err)
+		}
+		if tc.path == "/deny" && (res.Status != 429 || len(res.Header) != 1 || res.Header.Get("Retry-After") != "10") {
+			t.Errorf("path %q: got status %d header %v", tc.path, res.Status, res.Header)
+		}
+		if tc.path == "/headers" && (len(res.Header) != 1 || res.Header.Get("X-User-Id") != "1") {
+			t.Errorf("path %q: got header %v", tc.path, res.Header)
+		}
+	}
+
+	h, err = newAuthHook(`
+function authorize(req)
+  local x = 0
+  while true do x = x + 1 end
+end
+`, 5*time.Millisecond, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := time.Now()
+	if _, err := h.Authorize(context.Background(), "GET", "/", "/", http.Header{}, ""); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	if d := time.Now().Sub(startTime); d > time.Second {
+		t.Errorf("timeout exceeded by %v", d)
+	}
+
+	for _, script := range []string{
+		`function authorize(req`,
+		`x = 1`,
+		`while true do end`,
+		`os.exit(1)`,
+		`function authorize(req) return true end; require("os")`,
+	} {
+		if _, err := newAuthHook(script, 0, 0); err == nil {
+			t.Errorf("script %q: expected error", script)
+		}
+	}
+}
+
+func TestAuthHookExample(t *testing.T) {
+	h := testAuthHookExample(t)
+
+	hdr := http.Header{"X-Client-Id": {"client-a"}}
+	testAuthHookSign("secret-a", "GET", "/x?y=1", hdr)
+	if res, err := h.Authorize(context.Background(), "GET", "/x?y=1", "/x", hdr, ""); err != nil || !res.Allow || res.Header.Get("X-Authenticated-Client") != "client-a" {
+		t.Errorf("signed request: got %+v %v", res, err)
+	}
+	if res, err := h.Authorize(context.Background(), "POST", "/x?y=1", "/x", hdr, ""); err != nil || res.Allow || res.Status != 403 {
+		t.Errorf("signed request with other method: got %+v %v", res, err)
+	}
+	testAuthHookSign("secret-b", "GET", "/x?y=1", hdr)
+	if res, err := h.Authorize(context.Background(), "GET", "/x?y=1", "/x", hdr, ""); err != nil || res.Allow || res.Status != 403 {
+		t.Errorf("request signed with wrong secret: got %+v %v", res, err)
+	}
+	if res, err := h.Authorize(context.Background(), "GET", "/", "/", http.Header{}, ""); err != nil || res.Allow || res.Status != 401 || res.Header.Get("WWW-Authenticate") != "HMAC" {
+		t.Errorf("unsigned request: got %+v %v", res, err)
+	}
+}
+
+func BenchmarkAuthHook(b *testing.B) {
+	h := testAuthHookExample(b)
+	hdr := http.Header{
+		"X-Client-Id":     {"client-a"},
+		"Accept":          {"*/*"},
+		"User-Agent":      {"benchmark"},
+		"Accept-Encoding": {"gzip"},
+	}
+	testAuthHookSign("secret-a", "GET", "/x?y=1", hdr)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if res, err := h.Authorize(context.Background(), "GET", "/x?y=1", "/x", hdr, "127.0.0.1"); err != nil || !res.Allow {
+			b.Fatal(res, err)
+		}
+	}
+}
+
+func BenchmarkAuthHookParallel(b *testing.B) {
+	h := testAuthHookExample(b)
+	hdr := http.Header{"X-Client-Id": {"client-a"}}
+	testAuthHookSign("secret-a", "GET", "/x?y=1", hdr)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if res, err := h.Authorize(context.Background(), "GET", "/x?y=1", "/x", hdr, "127.0.0.1"); err != nil || !res.Allow {
+				b.Fatal(errors.New("not allowed"), err)
+			}
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package lb
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// httpBackendRegistry is the engine-level registry of active HTTPBackends by name.
+// Routes which refer a backend by name hold the reference of the name, so they pick up the HTTPBackend which replaces
+// the previous one without forking the frontend.
+type httpBackendRegistry struct {
+	mu   sync.Mutex
+	refs map[string]*httpBackendRef
+}
+
+// httpBackendRef refers the active HTTPBackend of a name. It holds nil if there isn't any.
+type httpBackendRef struct {
+	b atomic.Value
+}
+
+var httpBackends = &httpBackendRegistry{
+	refs: make(map[string]*httpBackendRef),
+}
+
+// Get returns the active HTTPBackend of the reference, or nil
+func (r *httpBackendRef) Get() *HTTPBackend {
+	b, _ := r.b.Load().(*HTTPBackend)
+	return b
+}
+
+// Register registers given HTTPBackend by its name, and replaces the previous one which is marked as retired
+func (g *httpBackendRegistry) Register(b *HTTPBackend) {
+	g.mu.Lock()
+	ref, ok := g.refs[b.opts.Name]
+	if !ok {
+		ref = &httpBackendRef{}
+		g.refs[b.opts.Name] = ref
+	}
+	if prev := ref.Get(); prev != nil && prev != b {
+		atomic.StoreUint32(&prev.retired, 1)
+	}
+	ref.b.Store(b)
+	g.mu.Unlock()
+}
+
+// Unregister unregisters given HTTPBackend if it hasn't been replaced yet
+func (g *httpBackendRegistry) Unregister(b *HTTPBackend) {
+	g.mu.Lock()
+	if ref, ok := g.refs[b.opts.Name]; ok && ref.Get() == b {
+		ref.b.Store((*HTTPBackend)(nil))
+	}
+	g.mu.Unlock()
+}
+
+// Resolve returns the reference of given name. It returns an error if there isn't any active HTTPBackend by the name.
+func (g *httpBackendRegistry) Resolve(name string) (ref *httpBackendRef, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ref, ok := g.refs[name]
+	if !ok || ref.Get() == nil {
+		return nil, fmt.Errorf("backend %q unknown", name)
+	}
+	return
+}
+
+// LookupHTTPBackend returns the active HTTPBackend by given name, or nil if there isn't any.
+// A HTTPBackend is active from its Activate until its Close or its replacement by another one which has the same name.
+func LookupHTTPBackend(name string) *HTTPBackend {
+	ref, err := httpBackends.Resolve(name)
+	if err != nil {
+		return nil
+	}
+	return ref.Get()
+}
@@ -2,11 +2,17 @@ package lb
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,25 +22,38 @@ import (
 	"github.com/simult/simult/pkg/hc"
 )
 
-var backendServerDialer = &net.Dialer{
-	Timeout:   0,
-	KeepAlive: 1 * time.Second,
-	DualStack: true,
-}
+// backendServerPinFailHoldDown is the duration that backend server is marked as unhealthy after a tls pin mismatch
+const backendServerPinFailHoldDown = 10 * time.Second
+
+var errBackendServerTLSPinMismatch = errors.New("tls certificate doesn't match any pinned spki hash")
 
 type backendServer struct {
-	server          string
-	serverURL       *url.URL
-	address         string
-	useTLS          bool
-	weight          float64
-	bcs             map[*bufConn]struct{}
-	bcsMu           sync.Mutex
-	healthCheck     hc.HealthCheck
-	healthCheckMu   sync.RWMutex
-	activeConnCount int64
-	idleConnCount   int64
-	totalConnCount  int64
+	server           string
+	serverURL        *url.URL
+	address          string
+	useTLS           bool
+	weight           float64
+	bcs              map[*bufConn]struct{}
+	bcsMu            sync.Mutex
+	healthCheck      hc.HealthCheck
+	healthCheckNext  hc.HealthCheck
+	healthCheckMu    sync.RWMutex
+	activeConnCount  int64
+	idleConnCount    int64
+	totalConnCount   int64
+	outstandingBytes int64
+	tlsServerName    string
+	tlsPins          []string
+	tlsVerifyCA      bool
+	tlsPinFailTime   int64
+	dscp             int
+	sourceAddress    string
+	keepAlivePeriod  time.Duration
+	customDialer     Dialer
+	dialer           Dialer
+	h2Transport      *http.Transport
+	draining         uint32
+	stats            backendServerStats
 
 	workerTkr *time.Ticker
 	workerWg  sync.WaitGroup
@@ -46,6 +65,147 @@ type backendServer struct {
 	sharedMu sync.Mutex
 }
 
+// windowCounterSlots is the count of one second slots of windowCounter
+const windowCounterSlots = 60
+
+const (
+	windowCounterCountBits = 30
+	windowCounterCountMask = 1<<windowCounterCountBits - 1
+)
+
+// windowCounter counts events in the last windowCounterSlots seconds without locking.
+// Every slot holds the second it belongs to in the high bits and the count of that second in the low bits.
+type windowCounter struct {
+	slots [windowCounterSlots]uint64
+}
+
+// Add increments the slot of given unix second
+func (c *windowCounter) Add(sec int64) {
+	slot := &c.slots[sec%windowCounterSlots]
+	for {
+		old := atomic.LoadUint64(slot)
+		var x uint64
+		switch oldSec := int64(old >> windowCounterCountBits); {
+		case oldSec == sec:
+			if old&windowCounterCountMask == windowCounterCountMask {
+				return
+			}
+			x = old + 1
+		case oldSec < sec:
+			x = uint64(sec)<<windowCounterCountBits | 1
+		default:
+			return
+		}
+		if atomic.CompareAndSwapUint64(slot, old, x) {
+			return
+		}
+	}
+}
+
+// Sum returns the count of events in the window which ends at given unix second
+func (c *windowCounter) Sum(sec int64) (n int64) {
+	for i := range c.slots {
+		x := atomic.LoadUint64(&c.slots[i])
+		if d := sec - int64(x>>windowCounterCountBits); d >= 0 && d < windowCounterSlots {
+			n += int64(x & windowCounterCountMask)
+		}
+	}
+	return
+}
+
+// latencyWindowSamples is the count of the last response latencies of latencyWindow
+const latencyWindowSamples = 64
+
+// latencyWindowMinSamples is the minimum count of samples in the window to estimate latency
+const latencyWindowMinSamples = 8
+
+const (
+	latencyWindowMicrosBits = 32
+	latencyWindowMicrosMask = 1<<latencyWindowMicrosBits - 1
+)
+
+// latencyWindow holds the last response latencies of a backend server without locking, and estimates their p50.
+// Every sample holds the second it belongs to in the high bits and the latency in microseconds in the low bits.
+type latencyWindow struct {
+	next    uint64
+	samples [latencyWindowSamples]uint64
+	p50     int64
+}
+
+// Add records a response latency at given unix second
+func (w *latencyWindow) Add(sec int64, d time.Duration) {
+	micros := uint64(d / time.Microsecond)
+	if micros > latencyWindowMicrosMask {
+		micros = latencyWindowMicrosMask
+	}
+	i := (atomic.AddUint64(&w.next, 1) - 1) % latencyWindowSamples
+	atomic.StoreUint64(&w.samples[i], uint64(sec)<<latencyWindowMicrosBits|micros)
+}
+
+// Update estimates p50 of the samples in the last windowCounterSlots seconds which end at given unix second.
+// The estimate is zero if there are less than latencyWindowMinSamples samples, so the server isn't known as slow
+// after it has been avoided for a while.
+func (w *latencyWindow) Update(sec int64) {
+	values := make([]int64, 0, latencyWindowSamples)
+	for i := range w.samples {
+		x := atomic.LoadUint64(&w.samples[i])
+		if d := sec - int64(x>>latencyWindowMicrosBits); x != 0 && d >= 0 && d < windowCounterSlots {
+			values = append(values, int64(x&latencyWindowMicrosMask))
+		}
+	}
+	p50 := int64(0)
+	if len(values) >= latencyWindowMinSamples {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		p50 = values[len(values)/2]
+	}
+	atomic.StoreInt64(&w.p50, p50*int64(time.Microsecond))
+}
+
+// P50 returns the last estimate of Update
+func (w *latencyWindow) P50() time.Duration {
+	return time.Duration(atomic.LoadInt64(&w.p50))
+}
+
+// backendServerStats holds request statistics of a backend server
+type backendServerStats struct {
+	requestsTotal  int64
+	readBytes      int64
+	writeBytes     int64
+	errors         sync.Map
+	requestsWindow windowCounter
+	errorsWindow   windowCounter
+	latency        latencyWindow
+}
+
+// RequestDone records a completed request with its error description, and bytes read from and written to the backend server.
+// Empty errDesc means the request has succeeded.
+func (s *backendServerStats) RequestDone(errDesc string, r, w int64) {
+	sec := time.Now().Unix()
+	atomic.AddInt64(&s.requestsTotal, 1)
+	atomic.AddInt64(&s.readBytes, r)
+	atomic.AddInt64(&s.writeBytes, w)
+	s.requestsWindow.Add(sec)
+	if errDesc == "" {
+		return
+	}
+	p, ok := s.errors.Load(errDesc)
+	if !ok {
+		p, _ = s.errors.LoadOrStore(errDesc, new(int64))
+	}
+	atomic.AddInt64(p.(*int64), 1)
+	s.errorsWindow.Add(sec)
+}
+
+// Errors returns error counts by error descriptions
+func (s *backendServerStats) Errors() map[string]int64 {
+	m := make(map[string]int64)
+	s.errors.Range(func(key, value interface{}) bool {
+		m[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return m
+}
+
 func newBackendServer(server string) (bs *backendServer, err error) {
 	var serverURL *url.URL
 	var address string
@@ -84,7 +244,9 @@ func newBackendServer(server string) (bs *backendServer, err error) {
 		address:   address,
 		useTLS:    useTLS,
 		bcs:       make(map[*bufConn]struct{}, 16),
+		dialer:    newBackendDialer(&HTTPBackendOptions{}, 0),
 	}
+	bs.h2Transport = bs.newH2Transport()
 	bs.workerTkr = time.NewTicker(100 * time.Millisecond)
 	bs.ctx, bs.ctxCancel = context.WithCancel(context.Background())
 
@@ -105,15 +267,18 @@ func (bs *backendServer) Close() {
 
 	bs.bcsMu.Lock()
 	for bcr := range bs.bcs {
-		delete(bs.bcs, bcr)
-		atomic.AddInt64(&bs.idleConnCount, -1)
-		atomic.AddInt64(&bs.totalConnCount, -1)
+		bs.connRemove(bcr)
 		bcr.Close()
 		xlog.V(200).Debugf("closed backend connection %q because backend server is closing", bcr.RemoteAddr().String())
 	}
 	bs.bcsMu.Unlock()
+	bs.h2Transport.CloseIdleConnections()
 
 	bs.healthCheckMu.Lock()
+	if bs.healthCheckNext != nil {
+		bs.healthCheckNext.Close()
+		bs.healthCheckNext = nil
+	}
 	if bs.healthCheck != nil {
 		bs.healthCheck.Close()
 		bs.healthCheck = nil
@@ -125,12 +290,11 @@ func (bs *backendServer) worker() {
 	for done := false; !done; {
 		select {
 		case <-bs.workerTkr.C:
+			bs.stats.latency.Update(time.Now().Unix())
 			bs.bcsMu.Lock()
 			for bcr := range bs.bcs {
 				if !bcr.Check() {
-					delete(bs.bcs, bcr)
-					atomic.AddInt64(&bs.idleConnCount, -1)
-					atomic.AddInt64(&bs.totalConnCount, -1)
+					bs.connRemove(bcr)
 					bcr.Close()
 					xlog.V(200).Debugf("closed backend connection %q in worker", bcr.RemoteAddr().String())
 					continue
@@ -161,6 +325,15 @@ func (bs *backendServer) SetShared(status bool) bool {
 
 func (bs *backendServer) SetHealthCheck(healthCheck hc.HealthCheck) {
 	bs.healthCheckMu.Lock()
+	if bs.healthCheckNext != nil {
+		bs.healthCheckNext.Close()
+		bs.healthCheckNext = nil
+	}
+	bs.setHealthCheck(healthCheck)
+	bs.healthCheckMu.Unlock()
+}
+
+func (bs *backendServer) setHealthCheck(healthCheck hc.HealthCheck) {
 	select {
 	case <-bs.ctx.Done():
 		if healthCheck != nil {
@@ -173,10 +346,131 @@ func (bs *backendServer) SetHealthCheck(healthCheck hc.HealthCheck) {
 		bs.healthCheck.Close()
 	}
 	bs.healthCheck = healthCheck
+}
+
+// HasHTTPCheck reports whether the current or starting health-check is a HTTPCheck with same options.
+// Dialers aren't compared, because they are created by the dial parameters of the backend server and
+// the backend server isn't shared if they change.
+func (bs *backendServer) HasHTTPCheck(opts *hc.HTTPCheckOptions) bool {
+	var o hc.HTTPCheckOptions
+	o.CopyFrom(opts)
+	o.Dialer = nil
+	bs.healthCheckMu.RLock()
+	defer bs.healthCheckMu.RUnlock()
+	for _, h := range []hc.HealthCheck{bs.healthCheckNext, bs.healthCheck} {
+		if h, ok := h.(*hc.HTTPCheck); ok {
+			ho := h.GetOpts()
+			ho.Dialer = nil
+			if reflect.DeepEqual(ho, o) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StartHealthCheck replaces the current health-check with given health-check after its first result
+func (bs *backendServer) StartHealthCheck(healthCheck hc.HealthCheck) {
+	bs.healthCheckMu.Lock()
+	if bs.healthCheckNext != nil {
+		bs.healthCheckNext.Close()
+	}
+	bs.healthCheckNext = healthCheck
 	bs.healthCheckMu.Unlock()
+	go func() {
+		<-healthCheck.Check()
+		bs.healthCheckMu.Lock()
+		if bs.healthCheckNext == healthCheck {
+			bs.healthCheckNext = nil
+			bs.setHealthCheck(healthCheck)
+		}
+		bs.healthCheckMu.Unlock()
+	}()
+}
+
+// SetTLSParams sets tls verification parameters. Empty serverName means the host of server url.
+func (bs *backendServer) SetTLSParams(serverName string, pins []string, verifyCA bool) {
+	bs.tlsServerName = serverName
+	bs.tlsPins = pins
+	bs.tlsVerifyCA = verifyCA
+}
+
+// SetDialParams sets the dialer of connections with the parameters which it is created by
+func (bs *backendServer) SetDialParams(dialer Dialer, dscp int, sourceAddress string, keepAlivePeriod time.Duration, customDialer Dialer) {
+	bs.dialer = dialer
+	bs.dscp = dscp
+	bs.sourceAddress = sourceAddress
+	bs.keepAlivePeriod = keepAlivePeriod
+	bs.customDialer = customDialer
+}
+
+// SameDialParams reports whether the backend server has same dial parameters with given backend server
+func (bs *backendServer) SameDialParams(bs2 *backendServer) bool {
+	return bs.dscp == bs2.dscp && bs.sourceAddress == bs2.sourceAddress && bs.keepAlivePeriod == bs2.keepAlivePeriod && reflect.DeepEqual(bs.customDialer, bs2.customDialer)
+}
+
+// SameTLSParams reports whether the backend server has same tls parameters with given backend server
+func (bs *backendServer) SameTLSParams(bs2 *backendServer) bool {
+	return bs.tlsServerName == bs2.tlsServerName && bs.tlsVerifyCA == bs2.tlsVerifyCA && reflect.DeepEqual(bs.tlsPins, bs2.tlsPins)
+}
+
+// SetDraining sets drain status. Draining backend server isn't chosen for new requests,
+// and the responses of requests which it still serves close the frontend connections.
+func (bs *backendServer) SetDraining(status bool) {
+	var x uint32
+	if status {
+		x = 1
+	}
+	atomic.StoreUint32(&bs.draining, x)
+}
+
+// IsDraining reports whether the backend server is draining
+func (bs *backendServer) IsDraining() bool {
+	return atomic.LoadUint32(&bs.draining) != 0
+}
+
+// EffectiveWeight returns the weight which is used to choose the backend server currently
+func (bs *backendServer) EffectiveWeight() float64 {
+	if bs.IsDraining() || !bs.Healthy() {
+		return 0
+	}
+	return bs.weight
+}
+
+func (bs *backendServer) tlsClientConfig() *tls.Config {
+	c := &tls.Config{
+		ServerName:         bs.tlsServerName,
+		InsecureSkipVerify: !bs.tlsVerifyCA,
+	}
+	if c.ServerName == "" && bs.tlsVerifyCA {
+		c.ServerName = bs.serverURL.Hostname()
+	}
+	if len(bs.tlsPins) > 0 {
+		c.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errBackendServerTLSPinMismatch
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			hash := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pin := range bs.tlsPins {
+				if pin == hash {
+					return nil
+				}
+			}
+			return errBackendServerTLSPinMismatch
+		}
+	}
+	return c
 }
 
 func (bs *backendServer) Healthy() bool {
+	if t := atomic.LoadInt64(&bs.tlsPinFailTime); t != 0 && time.Now().Sub(time.Unix(0, t)) < backendServerPinFailHoldDown {
+		return false
+	}
 	bs.healthCheckMu.RLock()
 	defer bs.healthCheckMu.RUnlock()
 	if bs.healthCheck != nil {
@@ -185,12 +479,23 @@ func (bs *backendServer) Healthy() bool {
 	return true
 }
 
-func (bs *backendServer) ConnAcquire(ctx context.Context) (bc *bufConn, err error) {
+// ConnAcquire returns an idle connection which has been established with given PROXY protocol header, or establishes a
+// new connection and sends the header at its start. Empty proxyHeader means no PROXY protocol. Connections with the
+// header are kept idle only until proxyCtx, the context of the client connection which they are established for, is done.
+func (bs *backendServer) ConnAcquire(ctx context.Context, proxyHeader string, proxyCtx context.Context) (bc *bufConn, err error) {
 	bs.bcsMu.Lock()
 	for bcr := range bs.bcs {
-		delete(bs.bcs, bcr)
-		atomic.AddInt64(&bs.idleConnCount, -1)
-		atomic.AddInt64(&bs.totalConnCount, -1)
+		// the header is sent once per connection, so the connection advertises the client which it has been established for.
+		// connections of other clients are left in the pool until their client connections end or the backend server
+		// closes them.
+		if bcr.proxyHeader != proxyHeader {
+			if !bcr.Check() {
+				bs.connRemove(bcr)
+				bcr.Close()
+			}
+			continue
+		}
+		bs.connRemove(bcr)
 		if bcr.Check() {
 			if r, w := bcr.Stats(); r != 0 || w != 0 {
 				bcr.Close()
@@ -208,18 +513,43 @@ func (bs *backendServer) ConnAcquire(ctx context.Context) (bc *bufConn, err erro
 	atomic.AddInt64(&bs.totalConnCount, 1)
 	if bc == nil {
 		var conn net.Conn
-		conn, err = backendServerDialer.DialContext(ctx, "tcp", bs.address)
+		conn, err = bs.dialer.DialContext(ctx, "tcp", bs.address)
 		if err != nil {
 			atomic.AddInt64(&bs.activeConnCount, -1)
 			atomic.AddInt64(&bs.totalConnCount, -1)
 			return
 		}
+		// PROXY protocol header precedes TLS
+		if proxyHeader != "" {
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetWriteDeadline(deadline)
+			}
+			if _, err = conn.Write([]byte(proxyHeader)); err != nil {
+				conn.Close()
+				atomic.AddInt64(&bs.activeConnCount, -1)
+				atomic.AddInt64(&bs.totalConnCount, -1)
+				return
+			}
+			conn.SetWriteDeadline(time.Time{})
+		}
 		if bs.useTLS {
-			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			tlsConn := tls.Client(conn, bs.tlsClientConfig())
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				if errors.Is(err, errBackendServerTLSPinMismatch) {
+					atomic.StoreInt64(&bs.tlsPinFailTime, time.Now().UnixNano())
+				}
+				tlsConn.Close()
+				atomic.AddInt64(&bs.activeConnCount, -1)
+				atomic.AddInt64(&bs.totalConnCount, -1)
+				return
+			}
+			conn = tlsConn
 		}
 		bc = newBufConn(conn)
+		bc.proxyHeader = proxyHeader
 		xlog.V(200).Debugf("established backend connection %q", bc.RemoteAddr().String())
 	}
+	bc.proxyCtx = proxyCtx
 	return
 }
 
@@ -241,10 +571,27 @@ func (bs *backendServer) ConnRelease(bc *bufConn) {
 				xlog.V(200).Debugf("closed backend connection %q because unexpected read or write", bc.RemoteAddr().String())
 				break
 			}
+			if bc.proxyHeader != "" && (bc.proxyCtx == nil || bc.proxyCtx.Err() != nil) {
+				bc.Close()
+				xlog.V(200).Debugf("closed backend connection %q because client connection has ended", bc.RemoteAddr().String())
+				break
+			}
 			if _, ok := bs.bcs[bc]; !ok {
 				bs.bcs[bc] = struct{}{}
 				atomic.AddInt64(&bs.idleConnCount, 1)
 				atomic.AddInt64(&bs.totalConnCount, 1)
+				// nothing else can reuse the connection after the client connection ends
+				if bc.proxyHeader != "" {
+					bc.proxyStop = context.AfterFunc(bc.proxyCtx, func() {
+						bs.bcsMu.Lock()
+						defer bs.bcsMu.Unlock()
+						if _, ok := bs.bcs[bc]; ok {
+							bs.connRemove(bc)
+							bc.Close()
+							xlog.V(200).Debugf("closed backend connection %q because client connection has ended", bc.RemoteAddr().String())
+						}
+					})
+				}
 			}
 			break
 		}
@@ -253,3 +600,15 @@ func (bs *backendServer) ConnRelease(bc *bufConn) {
 	}
 	bs.bcsMu.Unlock()
 }
+
+// connRemove removes the idle connection from the pool, and stops closing it when its client connection ends.
+// It must be called with bcsMu locked.
+func (bs *backendServer) connRemove(bc *bufConn) {
+	delete(bs.bcs, bc)
+	atomic.AddInt64(&bs.idleConnCount, -1)
+	atomic.AddInt64(&bs.totalConnCount, -1)
+	if bc.proxyStop != nil {
+		bc.proxyStop()
+		bc.proxyStop = nil
+	}
+}
@@ -0,0 +1,160 @@
+package lb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/goinsane/xlog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const httpBasicAuthDefaultRealm = "Restricted"
+
+var (
+	httpBasicAuthDummyHash     []byte
+	httpBasicAuthDummyHashOnce sync.Once
+)
+
+// httpBasicAuthCompare compares the password with the bcrypt hash. If the user is unknown, the password is compared
+// with a dummy hash so that unknown users take as long as known users.
+func httpBasicAuthCompare(hash []byte, password string) bool {
+	if hash == nil {
+		httpBasicAuthDummyHashOnce.Do(func() {
+			httpBasicAuthDummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(httpBasicAuthDummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// parseHTPasswd parses the lines of htpasswd format which have a username and a bcrypt hash separated by ":". Empty
+// lines and comments which start with "#" are ignored.
+func parseHTPasswd(lines []string) (users map[string][]byte, err error) {
+	users = make(map[string][]byte, len(lines))
+	for n, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: missing username", n+1)
+		}
+		user, hash := line[:idx], []byte(line[idx+1:])
+		if _, e := bcrypt.Cost(hash); e != nil {
+			return nil, fmt.Errorf("line %d: user %q hash isn't bcrypt: %w", n+1, user, e)
+		}
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("line %d: user %q duplicated", n+1, user)
+		}
+		users[user] = hash
+	}
+	return
+}
+
+// httpBasicAuthFile is a htpasswd file which is loaded from a watched file
+type httpBasicAuthFile struct {
+	*watchedFile
+}
+
+// newHTTPBasicAuthFile loads the users from the htpasswd file
+func newHTTPBasicAuthFile(path string) (a *httpBasicAuthFile, err error) {
+	w, err := newWatchedFile(path, "htpasswd", func(f *os.File) (interface{}, error) {
+		var lines []string
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return parseHTPasswd(lines)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &httpBasicAuthFile{w}, nil
+}
+
+// Hash returns the hash of the user, or nil if the user isn't in the file
+func (a *httpBasicAuthFile) Hash(user string) []byte {
+	return a.Load().(map[string][]byte)[user]
+}
+
+// httpBasicAuth authenticates requests of a route by the users of its options and its htpasswd file
+type httpBasicAuth struct {
+	users       map[string][]byte
+	file        *httpBasicAuthFile
+	forwardUser bool
+	response    []byte
+}
+
+func newHTTPBasicAuth(route *HTTPFrontendRoute) (a *httpBasicAuth, err error) {
+	if route.redirect != nil || route.response != nil {
+		return nil, errors.New("has redirect or response")
+	}
+	opts := &route.BasicAuth
+	realm := opts.Realm
+	if realm == "" {
+		realm = httpBasicAuthDefaultRealm
+	}
+	// the realm is sent in a quoted string without escaping
+	if strings.IndexFunc(realm, func(r rune) bool { return r < 0x20 || r > 0x7e || r == '"' || r == '\\' }) >= 0 {
+		return nil, fmt.Errorf("invalid realm %q", realm)
+	}
+	a = &httpBasicAuth{
+		forwardUser: opts.ForwardUser,
+		response:    []byte("HTTP/1.0 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"" + realm + "\"\r\n\r\nUnauthorized\r\n"),
+	}
+	a.users, err = parseHTPasswd(opts.Users)
+	if err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+	if opts.File != "" {
+		a.file, err = newHTTPBasicAuthFile(opts.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Authenticate returns the user of the credentials in the Authorization header, if they are valid. Users of the
+// options precede users of the htpasswd file.
+func (a *httpBasicAuth) Authenticate(hdr http.Header) (user string, ok bool) {
+	user, password, ok := (&http.Request{Header: hdr}).BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash := a.users[user]
+	if hash == nil && a.file != nil {
+		hash = a.file.Hash(user)
+	}
+	if !httpBasicAuthCompare(hash, password) {
+		return "", false
+	}
+	return user, true
+}
+
+// serveBasicAuth authenticates the request. Requests without valid credentials are answered with 401.
+func (f *HTTPFrontend) serveBasicAuth(reqDesc *httpReqDesc, a *httpBasicAuth) (err error) {
+	user, ok := a.Authenticate(reqDesc.feHdr)
+	if !ok {
+		err = errHTTPBasicAuthDenied
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		reqDesc.beStatusCode = "401"
+		reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+		reqDesc.feConn.Write(a.response)
+		return
+	}
+	if a.forwardUser {
+		reqDesc.feHdr.Set("X-Forwarded-User", user)
+	}
+	return
+}
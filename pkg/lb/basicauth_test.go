@@ -0,0 +1,133 @@
+package lb
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHTTPFrontendBasicAuth(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "basicauth", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-User")))
+	})
+	defer closer()
+
+	hash := func(password string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(h)
+	}
+	file, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	modTime := time.Now()
+	writeFile := func(content string) {
+		if err := ioutil.WriteFile(file.Name(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the modification time changes even if the file is written in the same tick
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(file.Name(), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("# users\nfile:" + hash("filepass") + "\n")
+
+	route := HTTPFrontendRoute{Path: "/*", Backend: b}
+	route.BasicAuth.Realm = "internal tools"
+	route.BasicAuth.Users = []string{"admin:" + hash("secret")}
+	route.BasicAuth.File = file.Name()
+	route.BasicAuth.ForwardUser = true
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "basicauth",
+		Routes: []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	request := func(credentials, forwardedUser string) (resp *http.Response, body string) {
+		req := "GET / HTTP/1.1\r\nHost: example.com\r\n"
+		if credentials != "" {
+			req += "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+		}
+		if forwardedUser != "" {
+			req += "X-Forwarded-User: " + forwardedUser + "\r\n"
+		}
+		return doTestRequestOnce(t, fLis, req+"\r\n")
+	}
+	for _, tc := range []struct {
+		credentials string
+		code        int
+		user        string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{"admin:wrong", http.StatusUnauthorized, ""},
+		{"unknown:secret", http.StatusUnauthorized, ""},
+		{"admin:secret", http.StatusOK, "admin"},
+		{"file:filepass", http.StatusOK, "file"},
+	} {
+		resp, body := request(tc.credentials, "forged")
+		if resp.StatusCode != tc.code {
+			t.Errorf("credentials %q: got %d, want %d", tc.credentials, resp.StatusCode, tc.code)
+			continue
+		}
+		if tc.code == http.StatusUnauthorized {
+			if got, want := resp.Header.Get("WWW-Authenticate"), `Basic realm="internal tools"`; got != want {
+				t.Errorf("credentials %q: got WWW-Authenticate %q, want %q", tc.credentials, got, want)
+			}
+			continue
+		}
+		if body != tc.user {
+			t.Errorf("credentials %q: got forwarded user %q, want %q", tc.credentials, body, tc.user)
+		}
+	}
+
+	// the changed file is reloaded by the worker, and a broken file doesn't replace the users in use
+	writeFile("other:" + hash("otherpass") + "\n")
+	var code int
+	for i := 0; i < 60 && code != http.StatusOK; i++ {
+		time.Sleep(50 * time.Millisecond)
+		resp, _ := request("other:otherpass", "")
+		code = resp.StatusCode
+	}
+	if code != http.StatusOK {
+		t.Fatalf("got %d with reloaded user, want 200", code)
+	}
+	writeFile("broken\n")
+	time.Sleep(2 * watchedFileCheckInterval)
+	if resp, _ := request("other:otherpass", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d after broken file, want 200", resp.StatusCode)
+	}
+	writeFile("file:" + hash("filepass") + "\n")
+
+	for _, tc := range []struct {
+		name   string
+		modify func(route *HTTPFrontendRoute)
+	}{
+		{"non-bcrypt hash", func(route *HTTPFrontendRoute) { route.BasicAuth.Users = []string{"admin:{SHA}secret"} }},
+		{"missing username", func(route *HTTPFrontendRoute) { route.BasicAuth.Users = []string{":" + hash("secret")} }},
+		{"invalid realm", func(route *HTTPFrontendRoute) { route.BasicAuth.Realm = `a"b` }},
+		{"missing file", func(route *HTTPFrontendRoute) { route.BasicAuth.File += ".missing" }},
+		{"both basic auth and response", func(route *HTTPFrontendRoute) { route.Backend, route.Response.Body = nil, "ok" }},
+	} {
+		badRoute := route
+		tc.modify(&badRoute)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "basicauth", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
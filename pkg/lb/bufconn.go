@@ -2,6 +2,7 @@ package lb
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -14,6 +15,10 @@ type bufConn struct {
 	*bufio.Reader
 	*bufio.Writer
 	conn            net.Conn
+	remoteAddr      net.Addr
+	proxyHeader     string
+	proxyCtx        context.Context
+	proxyStop       func() bool
 	timeToFirstByte *time.Time
 	sr              *statsReader
 	sw              *statsWriter
@@ -21,6 +26,8 @@ type bufConn struct {
 	pw              *io.PipeWriter
 	pe              error
 	peMu            sync.Mutex
+	noDelayCleared  bool
+	tracked         bool
 }
 
 const (
@@ -35,6 +42,11 @@ func newBufConn(conn net.Conn) (bc *bufConn) {
 	}
 	bc.pr, bc.pw = io.Pipe()
 	bc.Reader, bc.Writer = bufio.NewReaderSize(bc.pr, bufConnBufferSize), bufio.NewWriterSize(bc.sw, bufConnBufferSize)
+	// only the connections which hold a file descriptor are counted by connReclaim, until their read side ends
+	bc.tracked = bc.tcpConn() != nil
+	if bc.tracked {
+		connReclaim.Opened()
+	}
 	go bc.pipeRead()
 	return
 }
@@ -46,7 +58,7 @@ func (bc *bufConn) pipeRead() {
 		var n int
 		n, err = bc.sr.Read(buf)
 		if n > 0 {
-			if bc.timeToFirstByte == nil {
+			if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&bc.timeToFirstByte))) == nil {
 				now := time.Now()
 				atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&bc.timeToFirstByte)), nil, unsafe.Pointer(&now))
 			}
@@ -57,6 +69,9 @@ func (bc *bufConn) pipeRead() {
 	bc.peMu.Lock()
 	bc.pe = err
 	bc.peMu.Unlock()
+	if bc.tracked {
+		connReclaim.Closed()
+	}
 }
 
 func (bc *bufConn) Close() error {
@@ -72,7 +87,11 @@ func (bc *bufConn) LocalAddr() net.Addr {
 	return bc.conn.LocalAddr()
 }
 
+// RemoteAddr returns the address advertised by PROXY protocol if it is set, otherwise the remote address of conn
 func (bc *bufConn) RemoteAddr() net.Addr {
+	if bc.remoteAddr != nil {
+		return bc.remoteAddr
+	}
 	return bc.conn.RemoteAddr()
 }
 
@@ -92,6 +111,34 @@ func (bc *bufConn) Conn() net.Conn {
 	return bc.conn
 }
 
+// tcpConn returns the underlying TCP connection, also the one under TLS
+func (bc *bufConn) tcpConn() *net.TCPConn {
+	conn := bc.conn
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = c.NetConn()
+	}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+// SetNoDelay sets TCP_NODELAY option of the underlying TCP connection if it isn't set already.
+// It must not be called concurrently.
+func (bc *bufConn) SetNoDelay(noDelay bool) {
+	if bc.noDelayCleared != noDelay {
+		return
+	}
+	if tcpConn := bc.tcpConn(); tcpConn != nil && tcpConn.SetNoDelay(noDelay) == nil {
+		bc.noDelayCleared = !noDelay
+	}
+}
+
+// SetCork sets TCP_CORK option of the underlying TCP connection on Linux, it does nothing on other systems
+func (bc *bufConn) SetCork(cork bool) {
+	if tcpConn := bc.tcpConn(); tcpConn != nil {
+		setTCPCork(tcpConn, cork)
+	}
+}
+
 func (bc *bufConn) TimeToFirstByte() time.Time {
 	timeToFirstByte := (*time.Time)(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&bc.timeToFirstByte)), nil))
 	if timeToFirstByte == nil {
@@ -0,0 +1,25 @@
+package lb
+
+import (
+	"net"
+	"syscall"
+)
+
+func setTCPCork(tcpConn *net.TCPConn, cork bool) error {
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	value := 0
+	if cork {
+		value = 1
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, value)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
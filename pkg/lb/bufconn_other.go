@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+import (
+	"net"
+)
+
+func setTCPCork(tcpConn *net.TCPConn, cork bool) error {
+	return nil
+}
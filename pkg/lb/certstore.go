@@ -0,0 +1,219 @@
+package lb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TLSCertStoreOptions holds TLSCertStore options
+type TLSCertStoreOptions struct {
+	// CertPath and KeyPath are a certificate and key file pair, or directories of name.crt and name.key pairs
+	CertPath string
+	KeyPath  string
+
+	// DefaultCert is the name of the certificate pair in the directories which is served for unknown server names.
+	// Empty means the first one by name.
+	DefaultCert string
+
+	// StrictSNI aborts handshakes of unknown or missing server names instead of serving the default certificate
+	StrictSNI bool
+
+	// ACME serves the certificates of its allowed hosts before the wildcard names. The certificate files are optional
+	// when it's set and both paths are empty.
+	ACME *ACMEManager
+}
+
+// tlsCertIndex holds the certificates of a TLSCertStore by their lowercase DNS names, wildcard names as *.example.com
+type tlsCertIndex struct {
+	certs []tls.Certificate
+	names map[string]*tls.Certificate
+	def   *tls.Certificate
+}
+
+// TLSCertStore serves certificates by the server name of tls handshakes. It parses the certificate and key files
+// again when their modification times or sizes change, and swaps the certificates atomically. Certificates which
+// couldn't be reloaded stay in use.
+type TLSCertStore struct {
+	opts      TLSCertStoreOptions
+	index     atomic.Value
+	files     string
+	lastCheck time.Time
+}
+
+// NewTLSCertStore creates a new TLSCertStore and loads its certificates by given options
+func NewTLSCertStore(opts TLSCertStoreOptions) (s *TLSCertStore, err error) {
+	s = &TLSCertStore{
+		opts: opts,
+	}
+	if _, err = s.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetOpts returns a copy of underlying TLSCertStore's options
+func (s *TLSCertStore) GetOpts() (opts TLSCertStoreOptions) {
+	return s.opts
+}
+
+// Certificates returns the certificates which are in use
+func (s *TLSCertStore) Certificates() []tls.Certificate {
+	return s.index.Load().(*tlsCertIndex).certs
+}
+
+// GetCertificate returns the certificate of the exact server name, the ACME certificate of the server name, or the
+// certificate of the wildcard name which matches its first label. It can be used as GetCertificate of tls.Config.
+func (s *TLSCertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	idx := s.index.Load().(*tlsCertIndex)
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name != "" {
+		if cert, ok := idx.names[name]; ok {
+			return cert, nil
+		}
+		if s.opts.ACME != nil {
+			if cert := s.opts.ACME.Certificate(name); cert != nil {
+				return cert, nil
+			}
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := idx.names["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	if s.opts.StrictSNI || idx.def == nil {
+		return nil, fmt.Errorf("no certificate for server name %q", name)
+	}
+	return idx.def, nil
+}
+
+// Reload loads the certificates if any of their files has been changed since last load. It mustn't be called
+// concurrently.
+func (s *TLSCertStore) Reload() (reloaded bool, err error) {
+	s.lastCheck = time.Now()
+	pairs, files, err := s.listPairs()
+	if err != nil {
+		return false, err
+	}
+	if s.index.Load() != nil && files == s.files {
+		return false, nil
+	}
+	// certificates which couldn't be loaded aren't loaded again until their files change
+	s.files = files
+	idx := &tlsCertIndex{
+		certs: make([]tls.Certificate, 0, len(pairs)),
+		names: make(map[string]*tls.Certificate),
+	}
+	defIdx := -1
+	for i, pair := range pairs {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(pair[1], pair[2])
+		if err != nil {
+			return false, fmt.Errorf("error loading certificate pair %q and %q: %w", pair[1], pair[2], err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, fmt.Errorf("error parsing certificate %q: %w", pair[1], err)
+		}
+		idx.certs = append(idx.certs, cert)
+		if pair[0] == s.opts.DefaultCert {
+			defIdx = i
+		}
+	}
+	if defIdx < 0 && s.opts.DefaultCert != "" {
+		return false, fmt.Errorf("default certificate %q not found", s.opts.DefaultCert)
+	}
+	if defIdx < 0 && len(idx.certs) > 0 {
+		defIdx = 0
+	}
+	if defIdx >= 0 {
+		idx.def = &idx.certs[defIdx]
+	}
+	for i := range idx.certs {
+		cert := &idx.certs[i]
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		// the first certificate by name is served for the names of several certificates
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := idx.names[name]; !ok {
+				idx.names[name] = cert
+			}
+		}
+	}
+	s.index.Store(idx)
+	return true, nil
+}
+
+// Check reloads the certificates if the check interval has been elapsed since last check
+func (s *TLSCertStore) Check() (reloaded bool, err error) {
+	if time.Since(s.lastCheck) < watchedFileCheckInterval {
+		return false, nil
+	}
+	return s.Reload()
+}
+
+// listPairs returns the certificate pairs as name, certificate file and key file ordered by name, and describes the
+// modification times and sizes of their files
+func (s *TLSCertStore) listPairs() (pairs [][3]string, files string, err error) {
+	certPath, keyPath := s.opts.CertPath, s.opts.KeyPath
+	if s.opts.ACME != nil && certPath == "" && keyPath == "" {
+		return nil, "", nil
+	}
+	if certPath == "" {
+		certPath = "."
+	}
+	if keyPath == "" {
+		keyPath = "."
+	}
+	certStat, err := os.Stat(certPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("cert path %q stat error: %w", certPath, err)
+	}
+	keyStat, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("key path %q stat error: %w", keyPath, err)
+	}
+	if certStat.IsDir() != keyStat.IsDir() {
+		return nil, "", fmt.Errorf("files on cert path %q and key path %q have different file type", certPath, keyPath)
+	}
+
+	if !certStat.IsDir() {
+		name := strings.TrimSuffix(filepath.Base(certPath), filepath.Ext(certPath))
+		pairs = append(pairs, [3]string{name, certPath, keyPath})
+	} else {
+		var fns []string
+		fns, err = filepath.Glob(filepath.Join(certPath, "*.crt"))
+		if err != nil {
+			return nil, "", fmt.Errorf("cert path %q readdir error: %w", certPath, err)
+		}
+		sort.Strings(fns)
+		for _, fn := range fns {
+			if fi, e := os.Stat(fn); e == nil && fi.IsDir() {
+				continue
+			}
+			name := strings.TrimSuffix(filepath.Base(fn), ".crt")
+			pairs = append(pairs, [3]string{name, fn, filepath.Join(keyPath, name+".key")})
+		}
+	}
+
+	var sb strings.Builder
+	for _, pair := range pairs {
+		for _, fn := range pair[1:] {
+			fi, e := os.Stat(fn)
+			if e != nil {
+				return nil, "", fmt.Errorf("file %q stat error: %w", fn, e)
+			}
+			fmt.Fprintf(&sb, "%s %d %d\n", fn, fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return pairs, sb.String(), nil
+}
@@ -0,0 +1,171 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate pair of given DNS names as name.crt and name.key into dir
+func writeTestCert(t *testing.T, dir, name string, modTime time.Time, dnsNames ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		name + ".crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		name + ".key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+	for fn, data := range files {
+		fn = filepath.Join(dir, fn)
+		if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	modTime := time.Now()
+	writeTestCert(t, dir, "a", modTime, "a.example.com")
+	writeTestCert(t, dir, "b", modTime, "*.example.com", "example.com")
+	writeTestCert(t, dir, "c", modTime, "c.example.org")
+
+	for _, tc := range []struct {
+		defaultCert string
+		strictSNI   bool
+		serverName  string
+		want        string
+	}{
+		{"", false, "a.example.com", "a"},
+		{"", false, "A.Example.COM.", "a"},
+		{"", false, "x.example.com", "b"},
+		{"", false, "example.com", "b"},
+		{"", false, "x.y.example.com", "a"},
+		{"", false, "", "a"},
+		{"c", false, "unknown.local", "c"},
+		{"", true, "c.example.org", "c"},
+		{"", true, "unknown.local", ""},
+		{"", true, "", ""},
+	} {
+		cs, err := NewTLSCertStore(TLSCertStoreOptions{CertPath: dir, KeyPath: dir, DefaultCert: tc.defaultCert, StrictSNI: tc.strictSNI})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: tc.serverName})
+		got := ""
+		if err == nil {
+			got = cert.Leaf.Subject.CommonName
+		}
+		if got != tc.want {
+			t.Errorf("defaultcert %q strictsni %v server name %q: got certificate %q %v, want %q", tc.defaultCert, tc.strictSNI, tc.serverName, got, err, tc.want)
+		}
+	}
+
+	if _, err := NewTLSCertStore(TLSCertStoreOptions{CertPath: dir, KeyPath: dir, DefaultCert: "d"}); err == nil {
+		t.Error("expected error for unknown default certificate")
+	}
+	cs, err := NewTLSCertStore(TLSCertStoreOptions{CertPath: filepath.Join(dir, "c.crt"), KeyPath: filepath.Join(dir, "c.key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"}); err != nil || cert.Leaf.Subject.CommonName != "c" {
+		t.Errorf("single certificate pair: got %v, want certificate %q", err, "c")
+	}
+}
+
+func TestHTTPFrontendTLSCertStoreReload(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "certstore", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "certstore",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	modTime := time.Now()
+	writeTestCert(t, dir, "a", modTime, "a.example.com")
+	cs, err := NewTLSCertStore(TLSCertStoreOptions{CertPath: dir, KeyPath: dir, StrictSNI: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.watchTLSCertStore(cs)
+	fLis := runTestListener(t, ListenerOptions{
+		Fe:           f,
+		TLSConfig:    &tls.Config{},
+		TLSCertStore: cs,
+	})
+	defer fLis.Close()
+
+	handshake := func(serverName string) (dnsNames []string, err error) {
+		conn, err := tls.Dial("tcp", fLis.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].DNSNames, nil
+	}
+	if names, err := handshake("a.example.com"); err != nil || len(names) != 1 || names[0] != "a.example.com" {
+		t.Errorf("got certificate of %v %v, want %q", names, err, "a.example.com")
+	}
+	if _, err := handshake("b.example.com"); err == nil {
+		t.Error("expected handshake error for unknown server name")
+	}
+
+	// the changed certificates are swapped by the worker without restarting the listener
+	writeTestCert(t, dir, "a", modTime.Add(time.Second), "a.example.com", "b.example.com")
+	var names []string
+	for i := 0; i < 60; i++ {
+		if names, err = handshake("b.example.com"); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil || len(names) != 2 {
+		t.Errorf("got certificate of %v %v after reload, want %q", names, err, "b.example.com")
+	}
+}
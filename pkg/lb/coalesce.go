@@ -0,0 +1,505 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goinsane/xlog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	httpCoalesceDefaultMaxBytes = 1024 * 1024
+	httpCoalesceChunkSize       = 16 * 1024
+)
+
+var (
+	errHTTPCoalesceBufferFull   = errors.New("coalesce buffer size exceeded")
+	errHTTPCoalesceBufferMemory = errors.New("buffer memory limit exceeded")
+)
+
+// httpCoalescer coalesces identical concurrent requests of a route into a single shared backend fetch.
+// The response of the fetch is buffered up to maxBytes, and it is sent to every waiting request if it is shareable.
+// Otherwise it is sent only to the request which has started the fetch, and other requests are served by the backend themselves.
+type httpCoalescer struct {
+	maxBytes int64
+	mu       sync.Mutex
+	calls    map[string]*httpCoalesceCall
+}
+
+type httpCoalesceCall struct {
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	done      chan struct{}
+	waiters   int
+	joined    int
+	res       *httpCoalesceResult
+}
+
+func newHTTPCoalescer(maxBytes int64) *httpCoalescer {
+	if maxBytes <= 0 {
+		maxBytes = httpCoalesceDefaultMaxBytes
+	}
+	return &httpCoalescer{
+		maxBytes: maxBytes,
+		calls:    make(map[string]*httpCoalesceCall),
+	}
+}
+
+// Join joins the call of given key, or creates it if not exists. The caller which creates the call must start its fetch.
+func (c *httpCoalescer) Join(key string) (call *httpCoalesceCall, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call = c.calls[key]
+	if call == nil {
+		call = &httpCoalesceCall{
+			done: make(chan struct{}),
+		}
+		call.ctx, call.ctxCancel = context.WithCancel(context.Background())
+		c.calls[key] = call
+		leader = true
+	}
+	call.waiters++
+	call.joined++
+	return
+}
+
+// Leave leaves the call before using its result. The fetch of the call is cancelled if no waiters remain.
+func (c *httpCoalescer) Leave(key string, call *httpCoalesceCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-call.done:
+		if call.res != nil {
+			call.res.Release()
+		}
+		return
+	default:
+	}
+	call.waiters--
+	if call.waiters <= 0 {
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		call.ctxCancel()
+	}
+}
+
+// finish sets the result of the call, and returns the count of requests which have joined the call
+func (c *httpCoalescer) finish(key string, call *httpCoalesceCall, res *httpCoalesceResult) (joined int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	if res != nil {
+		res.refs = int32(call.waiters)
+		if res.refs <= 0 {
+			res.buf.Release()
+		}
+	}
+	call.res = res
+	close(call.done)
+	call.ctxCancel()
+	return call.joined
+}
+
+// httpCoalesceResult is the response which has been buffered by the fetch of a call
+type httpCoalesceResult struct {
+	statusLine    string
+	statusVersion string
+	statusCode    string
+	statusMsg     string
+	hdr           http.Header
+	lines         []httpHeaderLine
+	server        string
+	keepAlive     bool
+	drain         bool
+	shareable     bool
+	buf           *coalesceBuffer
+	bodyOffset    int64
+	refs          int32
+}
+
+// Release releases the buffer of the result when the last waiter has released it
+func (r *httpCoalesceResult) Release() {
+	if atomic.AddInt32(&r.refs, -1) == 0 {
+		r.buf.Release()
+	}
+}
+
+// parseHTTPCoalesceResult parses the response in buf, interim responses are skipped.
+// It returns nil if the response can't be replayed, eg it switches protocols.
+func parseHTTPCoalesceResult(buf *coalesceBuffer) (res *httpCoalesceResult) {
+	rd := bufio.NewReader(buf.Reader())
+	r := &httpCoalesceResult{
+		buf: buf,
+	}
+	for {
+		var nr int64
+		var err error
+		r.statusLine, r.hdr, r.lines, nr, err = splitHTTPHeader(rd, maxHTTPHeadersLen)
+		if err != nil {
+			return
+		}
+		r.bodyOffset += nr
+		parts := strings.SplitN(r.statusLine, " ", 3)
+		if len(parts) < 3 {
+			return
+		}
+		r.statusVersion, r.statusCode, r.statusMsg = strings.ToUpper(parts[0]), parts[1], parts[2]
+		if groupHTTPStatusCode(r.statusCode) != "1xx" {
+			break
+		}
+		if r.statusCode == "101" {
+			return
+		}
+	}
+	r.shareable = isHTTPResponseShareable(r.hdr)
+	return r
+}
+
+// isHTTPRequestCoalescable reports whether the request can share the response of identical concurrent requests.
+// Requests with credentials aren't coalesced, because their responses may be private even if they aren't marked.
+func isHTTPRequestCoalescable(reqDesc *httpReqDesc, b *HTTPBackend) bool {
+	hdr := reqDesc.feHdr
+	if reqDesc.feStatusMethod != "GET" || b.opts.StickyCookie.Name != "" {
+		return false
+	}
+	if hdr.Get("Authorization") != "" || hdr.Get("Cookie") != "" || hdr.Get("Upgrade") != "" {
+		return false
+	}
+	if cl := hdr.Get("Content-Length"); (cl != "" && cl != "0") || hdr.Get("Transfer-Encoding") != "" {
+		return false
+	}
+	return true
+}
+
+// isHTTPResponseShareable reports whether the response can be sent to other clients than the one which requested it
+func isHTTPResponseShareable(hdr http.Header) bool {
+	if len(hdr["Set-Cookie"]) > 0 {
+		return false
+	}
+	for _, v := range hdr["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			name := strings.ToLower(strings.TrimSpace(strings.SplitN(directive, "=", 2)[0]))
+			if name == "private" || name == "no-store" {
+				return false
+			}
+		}
+	}
+	for _, v := range hdr["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(field)) {
+			case "accept", "accept-encoding", "":
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// httpCoalesceKey returns the key of the request, the request line and the header fields by which the responses vary are included
+func httpCoalesceKey(reqDesc *httpReqDesc) string {
+	return strings.ToLower(reqDesc.feHdr.Get("Host")) + " " + reqDesc.feStatusLine + "\n" +
+		reqDesc.feHdr.Get("Accept") + "\n" + reqDesc.feHdr.Get("Accept-Encoding")
+}
+
+// serveCoalesced serves the request by the shared fetch of identical concurrent requests.
+// The request is served by the backend itself if the fetch fails, or its response isn't shareable and it hasn't started the fetch.
+func (f *HTTPFrontend) serveCoalesced(ctx context.Context, reqDesc *httpReqDesc, b *HTTPBackend) (err error) {
+	c := reqDesc.feRoute.coalescer
+	key := httpCoalesceKey(reqDesc)
+	call, leader := c.Join(key)
+	if leader {
+		go f.coalesceFetch(c, key, call, newHTTPCoalesceFetchDesc(reqDesc, c.maxBytes), b)
+	}
+
+	checkTkr := time.NewTicker(httpClientCheckInterval)
+	defer checkTkr.Stop()
+	for done := false; !done; {
+		select {
+		case <-call.done:
+			done = true
+		case <-ctx.Done():
+			c.Leave(key, call)
+			reqDesc.beFinal = true
+			err = errHTTPFrontendTimeout
+			if !reqDesc.feBudgetDeadline.IsZero() && !time.Now().Before(reqDesc.feBudgetDeadline) {
+				err = errHTTPRequestBudgetExceeded
+				if reqDesc.claimResponse() {
+					reqDesc.feConn.Write([]byte(httpGatewayTimeout))
+				}
+			}
+			xlog.V(100).Debugf("serve error on %s: wait coalesced response: %v", reqDesc.FrontendSummary(), err)
+			return
+		case <-checkTkr.C:
+			if !reqDesc.feConn.Check() {
+				c.Leave(key, call)
+				reqDesc.beFinal = true
+				err = wrapHTTPError(httpErrGroupClientCommunication, io.EOF)
+				xlog.V(100).Debugf("serve error on %s: wait coalesced response: %v", reqDesc.FrontendSummary(), err)
+				return
+			}
+		}
+	}
+
+	res := call.res
+	if res != nil {
+		defer res.Release()
+	}
+	if res == nil || (!res.shareable && !leader) {
+		return b.serve(ctx, reqDesc)
+	}
+	if !leader {
+		f.promCoalescedRequestsTotal.With(prometheus.Labels{
+			"host":     reqDesc.feHost,
+			"path":     reqDesc.fePath,
+			"listener": reqDesc.leName,
+		}).Inc()
+	}
+
+	reqDesc.beFinal = true
+	reqDesc.beServer = res.server
+	reqDesc.beStatusLine = res.statusLine
+	reqDesc.beStatusVersion = res.statusVersion
+	reqDesc.beStatusCode = res.statusCode
+	reqDesc.beStatusMsg = res.statusMsg
+	reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(res.statusCode)
+	reqDesc.beHdr = res.hdr
+	reqDesc.beHdrLines = res.lines
+
+	feHdr := stripHopByHopHeaders(res.hdr, false)
+	// the response has the request id of the request which has fetched it
+	if reqDesc.feRequestIDHeader != "" {
+		feHdr = feHdr.Clone()
+		feHdr.Set(reqDesc.feRequestIDHeader, reqDesc.feRequestID)
+	}
+	if reqDesc.leTLSWarnHeader {
+		feHdr = feHdr.Clone()
+		feHdr.Add("Warning", `299 - "TLS upgrade required"`)
+	}
+	if res.drain {
+		reqDesc.feClose, reqDesc.feDrain = true, true
+	}
+	if reqDesc.feClose {
+		feHdr = feHdr.Clone()
+		feHdr.Set("Connection", "close")
+		if reqDesc.feDrain && reqDesc.feDrainHeader {
+			feHdr.Set("X-Drain", "true")
+		}
+	}
+
+	if !reqDesc.claimResponse() {
+		err = errHTTPRequestBudgetExceeded
+		return
+	}
+	_, err = writeHTTPHeader(reqDesc.feConn.Writer, res.statusLine, feHdr, res.lines, true)
+	if err != nil {
+		err = sideHTTPError(err, httpErrGroupClientCommunication, httpErrGroupProtocol)
+		xlog.V(100).Debugf("serve error on %s: write coalesced header to frontend: %v", reqDesc.BackendSummary(), err)
+		return
+	}
+	if reqDesc.feTap != nil {
+		reqDesc.feTap.SetResponse(res.statusLine, feHdr)
+	}
+
+	var feW io.Writer = reqDesc.feConn.Writer
+	if reqDesc.feThrottle != nil {
+		tw := *reqDesc.feThrottle
+		tw.W = feW
+		tw.Ctx, tw.CtxErrGroup = ctx, httpErrGroupFrontendTimeout
+		feW = &tw
+	}
+	if reqDesc.feTap != nil {
+		feW = reqDesc.feTap.ResponseBodyWriter(feW)
+	}
+	if _, e := res.buf.CopyTo(feW, res.bodyOffset); e != nil {
+		err = wrapHTTPError(httpErrGroupClientCommunication, e)
+		if he := (*httpError)(nil); errors.As(e, &he) {
+			err = he
+		}
+		xlog.V(100).Debugf("serve error on %s: write coalesced body to frontend: %v", reqDesc.BackendSummary(), err)
+		return
+	}
+
+	if !res.keepAlive {
+		err = wrapHTTPError("communication", errExpectedEOF)
+	}
+	return
+}
+
+// newHTTPCoalesceFetchDesc returns a copy of the request which writes its response to a coalesce buffer
+func newHTTPCoalesceFetchDesc(reqDesc *httpReqDesc, maxBytes int64) *httpReqDesc {
+	fetchDesc := *reqDesc
+	fetchDesc.feConn = newBufConn(&coalesceConn{
+		buf: &coalesceBuffer{
+			maxBytes: maxBytes,
+		},
+		localAddr:  reqDesc.feConn.LocalAddr(),
+		remoteAddr: reqDesc.feConn.RemoteAddr(),
+		closeCh:    make(chan struct{}),
+	})
+	fetchDesc.feHdr = reqDesc.feHdr.Clone()
+	// the fetch is shared, so the options of the client which has started it aren't used
+	fetchDesc.leTLSWarnHeader = false
+	fetchDesc.feThrottle = nil
+	fetchDesc.feTap = nil
+	fetchDesc.feMirror = nil
+	fetchDesc.feBudgetDeadline = time.Time{}
+	fetchDesc.feRespClaimed = 0
+	fetchDesc.feClose = false
+	fetchDesc.feDrain = false
+	fetchDesc.beFinal = true
+	fetchDesc.isTransferErrLogged = 0
+	return &fetchDesc
+}
+
+func (f *HTTPFrontend) coalesceFetch(c *httpCoalescer, key string, call *httpCoalesceCall, fetchDesc *httpReqDesc, b *HTTPBackend) {
+	fetchDesc.beName = b.opts.Name
+	err := b.serve(call.ctx, fetchDesc)
+	fetchDesc.feConn.Flush()
+	fetchDesc.feConn.Close()
+	buf := fetchDesc.feConn.Conn().(*coalesceConn).buf
+
+	var res *httpCoalesceResult
+	if err == nil || errors.Is(err, errExpectedEOF) {
+		res = parseHTTPCoalesceResult(buf)
+	} else {
+		xlog.V(100).Debugf("coalesced fetch error on %s: %v", fetchDesc.BackendSummary(), err)
+	}
+	if res != nil {
+		res.server = fetchDesc.beServer
+		res.keepAlive = err == nil
+		res.drain = fetchDesc.feDrain
+	} else {
+		buf.Release()
+	}
+
+	if joined := c.finish(key, call, res); joined > 1 && res != nil && res.shareable {
+		f.promStampedesPrevented.With(prometheus.Labels{
+			"host":     fetchDesc.feHost,
+			"path":     fetchDesc.fePath,
+			"listener": fetchDesc.leName,
+		}).Inc()
+	}
+}
+
+// coalesceBuffer buffers the response of a shared fetch in chunks, which are acquired from the buffer memory budget
+type coalesceBuffer struct {
+	maxBytes int64
+	chunks   [][]byte
+	size     int64
+	acquired int64
+}
+
+func (cb *coalesceBuffer) Write(p []byte) (n int, err error) {
+	if cb.size+int64(len(p)) > cb.maxBytes {
+		return 0, errHTTPCoalesceBufferFull
+	}
+	for len(p) > 0 {
+		last := len(cb.chunks) - 1
+		if last < 0 || len(cb.chunks[last]) == cap(cb.chunks[last]) {
+			if !bufferMemory.TryAcquire(memBudgetFeatureCoalesce, httpCoalesceChunkSize) {
+				return n, errHTTPCoalesceBufferMemory
+			}
+			cb.acquired += httpCoalesceChunkSize
+			cb.chunks = append(cb.chunks, make([]byte, 0, httpCoalesceChunkSize))
+			last++
+		}
+		chunk := cb.chunks[last]
+		m := copy(chunk[len(chunk):cap(chunk)], p)
+		cb.chunks[last] = chunk[:len(chunk)+m]
+		p = p[m:]
+		n += m
+		cb.size += int64(m)
+	}
+	return
+}
+
+// Reader returns a new reader of the buffered data
+func (cb *coalesceBuffer) Reader() io.Reader {
+	rds := make([]io.Reader, 0, len(cb.chunks))
+	for _, chunk := range cb.chunks {
+		rds = append(rds, bytes.NewReader(chunk))
+	}
+	return io.MultiReader(rds...)
+}
+
+// CopyTo writes the buffered data after offset to dst
+func (cb *coalesceBuffer) CopyTo(dst io.Writer, offset int64) (nw int64, err error) {
+	for _, chunk := range cb.chunks {
+		if offset >= int64(len(chunk)) {
+			offset -= int64(len(chunk))
+			continue
+		}
+		var n int
+		n, err = dst.Write(chunk[offset:])
+		nw += int64(n)
+		if err != nil {
+			return
+		}
+		offset = 0
+	}
+	return
+}
+
+// Release releases the memory of the buffer
+func (cb *coalesceBuffer) Release() {
+	bufferMemory.Release(cb.acquired)
+	cb.acquired = 0
+	cb.chunks = nil
+}
+
+// coalesceConn is the frontend connection of a shared fetch. It writes to its buffer, and it has no data to read.
+type coalesceConn struct {
+	buf        *coalesceBuffer
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	closeCh    chan struct{}
+	closeOnce  sync.Once
+}
+
+func (c *coalesceConn) Read(b []byte) (n int, err error) {
+	<-c.closeCh
+	return 0, io.EOF
+}
+
+func (c *coalesceConn) Write(b []byte) (n int, err error) {
+	return c.buf.Write(b)
+}
+
+func (c *coalesceConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closeCh) })
+	return nil
+}
+
+func (c *coalesceConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *coalesceConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *coalesceConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *coalesceConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *coalesceConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,162 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendCoalesceRequests(t *testing.T) {
+	var hits int64
+	b, bCloser := newTestHTTPBackend(t, "coalesce", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		time.Sleep(300 * time.Millisecond)
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Encoding, Cookie")
+		}
+		w.Write([]byte("shared " + r.URL.Path))
+	})
+	defer bCloser()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "coalesce",
+		DefaultBackend: b,
+		TimeoutHeader:  "X-Request-Timeout",
+		RequestID:      HTTPFrontendRequestIDGenerate,
+		Routes: []HTTPFrontendRoute{
+			{Backend: b, CoalesceRequests: true, ResponseHeaders: []HTTPFrontendHeaderOp{
+				{Op: HTTPFrontendHeaderOpAdd, Name: "X-Frame-Options", Value: "DENY"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	do := func(reqs []string) (codes []int, bodies []string, hdrs []http.Header) {
+		codes, bodies, hdrs = make([]int, len(reqs)), make([]string, len(reqs)), make([]http.Header, len(reqs))
+		var wg sync.WaitGroup
+		for i := range reqs {
+			// the first request starts the fetch
+			time.Sleep(20 * time.Millisecond)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", fLis.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte(reqs[i]))
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				if err != nil {
+					return
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				codes[i], bodies[i], hdrs[i] = resp.StatusCode, string(body), resp.Header
+			}(i)
+		}
+		wg.Wait()
+		return
+	}
+
+	base := BufferMemoryUsage()
+	labels := prometheus.Labels{"frontend": "coalesce"}
+	for _, tc := range []struct {
+		path     string
+		reqs     int
+		hits     int64
+		shared   bool
+		budgeted bool
+	}{
+		{"/a", 5, 1, true, false},
+		{"/a", 3, 1, true, true},
+		{"/private", 3, 3, false, false},
+		{"/vary", 3, 3, false, false},
+	} {
+		atomic.StoreInt64(&hits, 0)
+		baseCoalesced := testCounterSum(promHTTPFrontendCoalescedRequestsTotal, labels)
+		baseStampedes := testCounterSum(promHTTPFrontendStampedesPrevented, labels)
+		reqs := make([]string, tc.reqs)
+		for i := range reqs {
+			reqs[i] = "GET " + tc.path + " HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		}
+		if tc.budgeted {
+			// the waiter which has started the fetch leaves early, the fetch is continued for other waiters
+			reqs[0] = "GET " + tc.path + " HTTP/1.1\r\nHost: example.com\r\nX-Request-Timeout: 100\r\n\r\n"
+		}
+		codes, bodies, hdrs := do(reqs)
+		requestIDs := make(map[string]struct{}, len(reqs))
+		for i := range reqs {
+			code, body := http.StatusOK, "shared "+tc.path
+			if tc.budgeted && i == 0 {
+				code, body = http.StatusGatewayTimeout, ""
+			}
+			if codes[i] != code || (code == http.StatusOK && bodies[i] != body) {
+				t.Errorf("path %q request %d: got %d %q, want %d %q", tc.path, i, codes[i], bodies[i], code, body)
+			}
+			if code != http.StatusOK {
+				continue
+			}
+			// the shared response is sent with the response headers once, and with the request id of each request
+			if got := strings.Join(hdrs[i]["X-Frame-Options"], ","); got != "DENY" {
+				t.Errorf("path %q request %d: got X-Frame-Options %q, want %q", tc.path, i, got, "DENY")
+			}
+			requestID := hdrs[i].Get("X-Request-Id")
+			if _, ok := requestIDs[requestID]; ok || requestID == "" {
+				t.Errorf("path %q request %d: got request id %q, want a unique one", tc.path, i, requestID)
+			}
+			requestIDs[requestID] = struct{}{}
+		}
+		if n := atomic.LoadInt64(&hits); n != tc.hits {
+			t.Errorf("path %q: got %d backend hits, want %d", tc.path, n, tc.hits)
+		}
+		wantCoalesced, wantStampedes := float64(0), float64(0)
+		if tc.shared {
+			wantCoalesced, wantStampedes = float64(tc.reqs-1), 1
+		}
+		if n := testCounterSum(promHTTPFrontendCoalescedRequestsTotal, labels) - baseCoalesced; n != wantCoalesced {
+			t.Errorf("path %q: got %v coalesced requests, want %v", tc.path, n, wantCoalesced)
+		}
+		if n := testCounterSum(promHTTPFrontendStampedesPrevented, labels) - baseStampedes; n != wantStampedes {
+			t.Errorf("path %q: got %v stampedes prevented, want %v", tc.path, n, wantStampedes)
+		}
+	}
+	if n := BufferMemoryUsage() - base; n != 0 {
+		t.Errorf("got buffer memory %d after requests, want 0", n)
+	}
+}
+
+func TestIsHTTPResponseShareable(t *testing.T) {
+	for _, tc := range []struct {
+		hdr       http.Header
+		shareable bool
+	}{
+		{http.Header{}, true},
+		{http.Header{"Cache-Control": {"public, max-age=60"}, "Vary": {"Accept-Encoding"}}, true},
+		{http.Header{"Vary": {"accept, Accept-Encoding"}}, true},
+		{http.Header{"Set-Cookie": {"a=b"}}, false},
+		{http.Header{"Cache-Control": {"max-age=0", "No-Store"}}, false},
+		{http.Header{"Cache-Control": {`private="X-Foo"`}}, false},
+		{http.Header{"Vary": {"*"}}, false},
+		{http.Header{"Vary": {"Accept-Language"}}, false},
+	} {
+		if shareable := isHTTPResponseShareable(tc.hdr); shareable != tc.shareable {
+			t.Errorf("header %v: got shareable %v, want %v", tc.hdr, shareable, tc.shareable)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/goinsane/xlog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// httpConcurrencyLimiter limits the count of requests of a route which are served concurrently. Requests beyond the
+// limit wait in the queue up to QueueTimeout if it is set, otherwise they are answered with 503 immediately.
+type httpConcurrencyLimiter struct {
+	slots        chan struct{}
+	queueLen     int64
+	maxQueue     int64
+	queueTimeout time.Duration
+}
+
+func newHTTPConcurrencyLimiter(route *HTTPFrontendRoute) (l *httpConcurrencyLimiter, err error) {
+	if route.MaxConcurrent <= 0 {
+		if route.MaxQueue > 0 || route.QueueTimeout > 0 {
+			return nil, errors.New("has queue without max concurrent")
+		}
+		return nil, nil
+	}
+	return &httpConcurrencyLimiter{
+		slots:        make(chan struct{}, route.MaxConcurrent),
+		maxQueue:     int64(route.MaxQueue),
+		queueTimeout: route.QueueTimeout,
+	}, nil
+}
+
+// Release releases the slot which is acquired by admit
+func (l *httpConcurrencyLimiter) Release() {
+	<-l.slots
+}
+
+// admit acquires a slot of the route for the request. It is shed when MaxQueue requests are already waiting. Shed and
+// timed out requests are answered, requests whose clients close the connection while waiting aren't.
+func (l *httpConcurrencyLimiter) admit(ctx context.Context, reqDesc *httpReqDesc) (err error) {
+	select {
+	case l.slots <- struct{}{}:
+		return
+	default:
+	}
+	unavailable := func(e error) error {
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), e)
+		reqDesc.beStatusCode = "503"
+		reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+		reqDesc.feConn.Write([]byte(httpServiceUnavailable))
+		return e
+	}
+	if l.queueTimeout <= 0 {
+		return unavailable(errHTTPRouteExhausted)
+	}
+	defer atomic.AddInt64(&l.queueLen, -1)
+	if n := atomic.AddInt64(&l.queueLen, 1); l.maxQueue > 0 && n > l.maxQueue {
+		return unavailable(errHTTPRouteExhausted)
+	}
+
+	queueTmr := time.NewTimer(l.queueTimeout)
+	defer queueTmr.Stop()
+	checkTkr := time.NewTicker(httpClientCheckInterval)
+	defer checkTkr.Stop()
+	for {
+		select {
+		case l.slots <- struct{}{}:
+			return
+		case <-queueTmr.C:
+			return unavailable(errHTTPRouteQueueTimeout)
+		case <-ctx.Done():
+			err = errHTTPFrontendTimeout
+			if !reqDesc.feBudgetDeadline.IsZero() && !time.Now().Before(reqDesc.feBudgetDeadline) {
+				err = errHTTPRequestBudgetExceeded
+				reqDesc.feConn.Write([]byte(httpGatewayTimeout))
+			}
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+			return
+		case <-checkTkr.C:
+			if !reqDesc.feConn.Check() {
+				err = errHTTPQueueClientAbort
+				xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+				return
+			}
+		}
+	}
+}
+
+// serveConcurrencyLimited admits the request by the concurrency limiter of the route, and counts it as in-flight until
+// release is called
+func (f *HTTPFrontend) serveConcurrencyLimited(ctx context.Context, reqDesc *httpReqDesc, l *httpConcurrencyLimiter) (release func(), err error) {
+	if err = l.admit(ctx, reqDesc); err != nil {
+		return nil, err
+	}
+	gauge := f.promInflightRequests.With(prometheus.Labels{
+		"host":     reqDesc.feHost,
+		"path":     reqDesc.fePath,
+		"listener": reqDesc.leName,
+	})
+	gauge.Inc()
+	return func() {
+		gauge.Dec()
+		l.Release()
+	}, nil
+}
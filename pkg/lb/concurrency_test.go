@@ -0,0 +1,122 @@
+package lb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendMaxConcurrent(t *testing.T) {
+	startedCh := make(chan struct{}, 8)
+	unblockCh := make(chan struct{})
+	b, closer := newTestHTTPBackend(t, "concurrency", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			startedCh <- struct{}{}
+			<-unblockCh
+		}
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	route := HTTPFrontendRoute{Path: "/*", Backend: b, MaxConcurrent: 1}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "concurrency",
+		Routes: []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	inflight := func() float64 {
+		return testCounterSum(promHTTPFrontendInflightRequests, prometheus.Labels{"frontend": "concurrency"})
+	}
+	slowCh := make(chan int, 8)
+	doSlow := func() {
+		go func() {
+			resp, _ := doTestRequestOnce(t, fLis, "GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			slowCh <- resp.StatusCode
+		}()
+	}
+	waitSlow := func() {
+		select {
+		case <-startedCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("slow request isn't started")
+		}
+	}
+
+	// requests beyond the limit are answered immediately without queue
+	doSlow()
+	waitSlow()
+	if n := inflight(); n != 1 {
+		t.Errorf("got %v in-flight requests, want 1", n)
+	}
+	labels := prometheus.Labels{"frontend": "concurrency", "code": "5xx", "error": httpErrGroupRouteExhausted}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", resp.StatusCode)
+	}
+	unblockCh <- struct{}{}
+	if code := <-slowCh; code != http.StatusOK {
+		t.Errorf("got %d, want 200", code)
+	}
+	n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	for i := 0; i < 50 && (n < 1 || inflight() != 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	}
+	if n != 1 {
+		t.Errorf("got %v route exhausted requests, want 1", n)
+	}
+	if n := inflight(); n != 0 {
+		t.Errorf("got %v in-flight requests, want 0", n)
+	}
+	if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want 200", resp.StatusCode)
+	}
+
+	// queued requests are served when a slot is released, or answered after the queue timeout
+	route.MaxQueue = 1
+	route.QueueTimeout = 5 * time.Second
+	if err := f.SetRoutes([]HTTPFrontendRoute{route}); err != nil {
+		t.Fatal(err)
+	}
+	doSlow()
+	waitSlow()
+	doSlow()
+	time.Sleep(100 * time.Millisecond)
+	if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d beyond max queue, want 503", resp.StatusCode)
+	}
+	unblockCh <- struct{}{}
+	waitSlow()
+	unblockCh <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if code := <-slowCh; code != http.StatusOK {
+			t.Errorf("got %d, want 200", code)
+		}
+	}
+
+	route.QueueTimeout = 100 * time.Millisecond
+	if err := f.SetRoutes([]HTTPFrontendRoute{route}); err != nil {
+		t.Fatal(err)
+	}
+	doSlow()
+	waitSlow()
+	if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d after queue timeout, want 503", resp.StatusCode)
+	}
+	unblockCh <- struct{}{}
+	<-slowCh
+
+	badRoute := route
+	badRoute.MaxConcurrent = 0
+	if err := f.SetRoutes([]HTTPFrontendRoute{badRoute}); err == nil {
+		t.Error("queue without max concurrent: expected error")
+	}
+}
@@ -0,0 +1,123 @@
+package lb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// connReclaimer keeps the count of open connections of frontends and backends below the file descriptor limit.
+// When the count crosses the high watermark, the longest-idle keep-alive connections of frontends are closed until
+// the count goes below the low watermark. Only connections which are waiting for the next request are closed.
+type connReclaimer struct {
+	high           int64
+	low            int64
+	open           int64
+	pending        int64
+	reclaimedTotal int64
+
+	mu   sync.Mutex
+	idle list.List
+}
+
+// idleConn is a keep-alive connection of a frontend which is waiting for the next request
+type idleConn struct {
+	elem *list.Element
+	ch   chan struct{}
+	left bool
+}
+
+// connReclaim is the engine-level reclaimer of idle connections
+var connReclaim connReclaimer
+
+// SetConnReclaimWatermarks sets the watermarks of open connection count which start and stop reclaiming idle
+// connections. Zero or negative high disables reclaiming. The low watermark is capped by the high watermark.
+func SetConnReclaimWatermarks(high, low int64) {
+	if low > high {
+		low = high
+	}
+	atomic.StoreInt64(&connReclaim.high, high)
+	atomic.StoreInt64(&connReclaim.low, low)
+}
+
+// ConnReclaimStatus describes the current status of reclaiming idle connections
+type ConnReclaimStatus struct {
+	OpenConnections int64 `json:"open_connections"`
+	IdleConnections int   `json:"idle_connections"`
+	HighWatermark   int64 `json:"high_watermark"`
+	LowWatermark    int64 `json:"low_watermark"`
+	ReclaimedTotal  int64 `json:"reclaimed_total"`
+}
+
+// ConnReclaimerStatus returns the current status of reclaiming idle connections
+func ConnReclaimerStatus() (st ConnReclaimStatus) {
+	st.OpenConnections = atomic.LoadInt64(&connReclaim.open)
+	st.HighWatermark = atomic.LoadInt64(&connReclaim.high)
+	st.LowWatermark = atomic.LoadInt64(&connReclaim.low)
+	st.ReclaimedTotal = atomic.LoadInt64(&connReclaim.reclaimedTotal)
+	connReclaim.mu.Lock()
+	st.IdleConnections = connReclaim.idle.Len()
+	connReclaim.mu.Unlock()
+	return
+}
+
+// Opened counts a new connection, and reclaims idle connections if the count crosses the high watermark
+func (r *connReclaimer) Opened() {
+	if n := atomic.AddInt64(&r.open, 1); r.crossed(n) {
+		r.reclaim(n)
+	}
+}
+
+// Closed uncounts a connection
+func (r *connReclaimer) Closed() {
+	atomic.AddInt64(&r.open, -1)
+}
+
+// Enter adds an idle connection as the most recent one. The channel of the result is closed when it is reclaimed.
+func (r *connReclaimer) Enter() (ic *idleConn) {
+	ic = &idleConn{
+		ch: make(chan struct{}),
+	}
+	r.mu.Lock()
+	ic.elem = r.idle.PushBack(ic)
+	r.mu.Unlock()
+	if n := atomic.LoadInt64(&r.open); r.crossed(n) {
+		r.reclaim(n)
+	}
+	return
+}
+
+// Leave removes the idle connection, or marks it as given up if it has been reclaimed. It is safe to call Leave more than once.
+func (r *connReclaimer) Leave(ic *idleConn) {
+	r.mu.Lock()
+	if !ic.left {
+		ic.left = true
+		if ic.elem != nil {
+			r.idle.Remove(ic.elem)
+			ic.elem = nil
+		} else {
+			atomic.AddInt64(&r.pending, -1)
+		}
+	}
+	r.mu.Unlock()
+}
+
+func (r *connReclaimer) crossed(n int64) bool {
+	high := atomic.LoadInt64(&r.high)
+	return high > 0 && n > high
+}
+
+// reclaim closes the channels of the longest-idle connections to get n open connections below the low watermark.
+// The connections which have been reclaimed but haven't left yet aren't counted.
+func (r *connReclaimer) reclaim(n int64) {
+	r.mu.Lock()
+	count := n - atomic.LoadInt64(&r.pending) - atomic.LoadInt64(&r.low)
+	for ; count > 0 && r.idle.Len() > 0; count-- {
+		ic := r.idle.Remove(r.idle.Front()).(*idleConn)
+		ic.elem = nil
+		close(ic.ch)
+		atomic.AddInt64(&r.pending, 1)
+		atomic.AddInt64(&r.reclaimedTotal, 1)
+	}
+	r.mu.Unlock()
+}
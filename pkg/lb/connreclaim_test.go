@@ -0,0 +1,127 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestConnReclaimer(t *testing.T) {
+	r := &connReclaimer{high: 10, low: 8}
+	isReclaimed := func(ic *idleConn) bool {
+		select {
+		case <-ic.ch:
+			return true
+		default:
+			return false
+		}
+	}
+	for i := 0; i < 10; i++ {
+		r.Opened()
+	}
+	ics := make([]*idleConn, 5)
+	for i := range ics {
+		ics[i] = r.Enter()
+	}
+	r.Leave(ics[1])
+
+	// crossing the high watermark reclaims the longest-idle connections down to the low watermark
+	r.Opened()
+	for i, reclaimed := range []bool{true, false, true, true, false} {
+		if isReclaimed(ics[i]) != reclaimed {
+			t.Errorf("idle connection %d: got reclaimed %v, want %v", i, !reclaimed, reclaimed)
+		}
+	}
+
+	// reclaimed connections which haven't left yet aren't counted
+	r.Closed()
+	r.Opened()
+	if isReclaimed(ics[4]) {
+		t.Error("got idle connection 4 reclaimed before reclaimed connections left")
+	}
+	for _, i := range []int{0, 2, 3} {
+		r.Leave(ics[i])
+		r.Closed()
+	}
+	for i := 0; i < 3; i++ {
+		r.Opened()
+	}
+	if !isReclaimed(ics[4]) {
+		t.Error("expected idle connection 4 to be reclaimed")
+	}
+	r.Leave(ics[4])
+	if r.pending != 0 || r.idle.Len() != 0 || r.reclaimedTotal != 4 {
+		t.Errorf("got pending %d idle %d reclaimed %d, want 0 0 4", r.pending, r.idle.Len(), r.reclaimedTotal)
+	}
+}
+
+func TestHTTPFrontendReclaimIdleConnections(t *testing.T) {
+	b, bCloser := newTestHTTPBackend(t, "reclaim", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "keep-alive")
+		w.Write([]byte("OK"))
+	})
+	defer bCloser()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "reclaim",
+		DefaultBackend:   b,
+		MaxKeepAliveReqs: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	conns := make([]net.Conn, 4)
+	rds := make([]*bufio.Reader, len(conns))
+	for i := range conns {
+		conns[i], err = net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+		rds[i] = bufio.NewReader(conns[i])
+		resp := doTestRequest(t, conns[i], rds[i], req)
+		ioutil.ReadAll(resp.Body)
+		// keeps the order of idle connections
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	labels := prometheus.Labels{"frontend": "reclaim"}
+	base := testCounterSum(promHTTPFrontendReclaimedConnTotal, labels)
+	st := ConnReclaimerStatus()
+	if st.IdleConnections != len(conns) {
+		t.Fatalf("got %d idle connections, want %d", st.IdleConnections, len(conns))
+	}
+	// the new connection crosses the high watermark, and the three longest-idle connections are reclaimed
+	SetConnReclaimWatermarks(st.OpenConnections, st.OpenConnections-2)
+	defer SetConnReclaimWatermarks(0, 0)
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < len(conns)-1; i++ {
+		conns[i].SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := rds[i].ReadByte(); err == nil {
+			t.Errorf("expected idle connection %d to be closed", i)
+		}
+	}
+	if n := testCounterSum(promHTTPFrontendReclaimedConnTotal, labels) - base; n != 3 {
+		t.Errorf("got %v reclaimed connections, want 3", n)
+	}
+	if resp, body := doTestRequestOnce(t, fLis, req); resp.StatusCode != 200 || body != "OK" {
+		t.Errorf("new connection: got %d %q, want 200 %q", resp.StatusCode, body, "OK")
+	}
+	if resp := doTestRequest(t, conns[len(conns)-1], rds[len(conns)-1], req); resp.StatusCode != 200 {
+		t.Errorf("most recent idle connection: got %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,201 @@
+package lb
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	connStatsTick       = time.Second
+	connStatsResolution = 10 * time.Second
+	connStatsBuckets    = 24 * 3600 / 10
+)
+
+// connStatsSample is a sample of connection counts of a frontend or a backend
+type connStatsSample struct {
+	active   int64
+	idle     int64
+	inflight int64
+}
+
+// connStatsSource returns a sample of its owner. It must be cheap, because it is called by every tick.
+type connStatsSource func() connStatsSample
+
+// connStatsAgg aggregates samples of a value in a bucket
+type connStatsAgg struct {
+	min int64
+	max int64
+	sum int64
+}
+
+func (a *connStatsAgg) add(v int64, first bool) {
+	if first || v < a.min {
+		a.min = v
+	}
+	if first || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+}
+
+// connStatsBucket aggregates samples over connStatsResolution
+type connStatsBucket struct {
+	slot     int64
+	count    int64
+	active   connStatsAgg
+	idle     connStatsAgg
+	inflight connStatsAgg
+}
+
+// connStatsRing keeps the last connStatsBuckets buckets of a frontend or a backend by name.
+// Sources of the same name, eg the previous and the next one during a reload, are summed.
+type connStatsRing struct {
+	sources map[*connStatsSource]struct{}
+	cur     connStatsBucket
+	buckets []connStatsBucket
+	next    int
+}
+
+func (r *connStatsRing) sample(slot int64) {
+	var s connStatsSample
+	for src := range r.sources {
+		x := (*src)()
+		s.active += x.active
+		s.idle += x.idle
+		s.inflight += x.inflight
+	}
+	if r.cur.count > 0 && r.cur.slot != slot {
+		if len(r.buckets) < connStatsBuckets {
+			r.buckets = append(r.buckets, r.cur)
+		} else {
+			r.buckets[r.next] = r.cur
+			r.next = (r.next + 1) % connStatsBuckets
+		}
+		r.cur = connStatsBucket{}
+	}
+	first := r.cur.count == 0
+	r.cur.slot = slot
+	r.cur.count++
+	r.cur.active.add(s.active, first)
+	r.cur.idle.add(s.idle, first)
+	r.cur.inflight.add(s.inflight, first)
+}
+
+// connStatsSampler samples connection counts of frontends and backends by every tick in the background
+type connStatsSampler struct {
+	mu    sync.Mutex
+	rings map[string]*connStatsRing
+}
+
+// connStats is the engine-level sampler of connection counts
+var connStats = newConnStatsSampler()
+
+func newConnStatsSampler() (s *connStatsSampler) {
+	s = &connStatsSampler{
+		rings: make(map[string]*connStatsRing),
+	}
+	go s.worker()
+	return
+}
+
+func (s *connStatsSampler) worker() {
+	tkr := time.NewTicker(connStatsTick)
+	for tm := range tkr.C {
+		slot := tm.UnixNano() / int64(connStatsResolution)
+		s.mu.Lock()
+		for _, r := range s.rings {
+			r.sample(slot)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Register registers the source by given key. The result must be passed to Unregister.
+func (s *connStatsSampler) Register(key string, source connStatsSource) (src *connStatsSource) {
+	src = &source
+	s.mu.Lock()
+	r, ok := s.rings[key]
+	if !ok {
+		r = &connStatsRing{
+			sources: make(map[*connStatsSource]struct{}),
+		}
+		s.rings[key] = r
+	}
+	r.sources[src] = struct{}{}
+	s.mu.Unlock()
+	return
+}
+
+// Unregister unregisters the source by given key. The buckets of the key are discarded with its last source.
+func (s *connStatsSampler) Unregister(key string, src *connStatsSource) {
+	s.mu.Lock()
+	if r, ok := s.rings[key]; ok {
+		delete(r.sources, src)
+		if len(r.sources) == 0 {
+			delete(s.rings, key)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// ConnStatsValue describes the minimum, average and maximum of a value in a bucket
+type ConnStatsValue struct {
+	Min int64   `json:"min"`
+	Avg float64 `json:"avg"`
+	Max int64   `json:"max"`
+}
+
+// ConnStatsBucket describes the samples of a frontend or a backend in a bucket started at Time.
+// InflightRequests of a frontend equals to its ActiveConnections, because pipelining isn't supported.
+type ConnStatsBucket struct {
+	Time              time.Time      `json:"time"`
+	Samples           int64          `json:"samples"`
+	ActiveConnections ConnStatsValue `json:"active_connections"`
+	IdleConnections   ConnStatsValue `json:"idle_connections"`
+	InflightRequests  ConnStatsValue `json:"inflight_requests"`
+}
+
+// ConnStatsStatus describes the sampled connection counts of a frontend or a backend ordered by time.
+// The last bucket is the current one and it is still being filled.
+type ConnStatsStatus struct {
+	Name              string            `json:"name"`
+	ResolutionSeconds int               `json:"resolution_seconds"`
+	Buckets           []ConnStatsBucket `json:"buckets"`
+}
+
+// Status returns the buckets of given key since the given time
+func (s *connStatsSampler) Status(key string, since time.Time) (st ConnStatsStatus) {
+	st.ResolutionSeconds = int(connStatsResolution / time.Second)
+	st.Buckets = []ConnStatsBucket{}
+	value := func(a *connStatsAgg, count int64) ConnStatsValue {
+		return ConnStatsValue{
+			Min: a.min,
+			Avg: float64(a.sum) / float64(count),
+			Max: a.max,
+		}
+	}
+	appendBucket := func(b *connStatsBucket) {
+		tm := time.Unix(0, b.slot*int64(connStatsResolution))
+		if b.count == 0 || tm.Add(connStatsResolution).Before(since) {
+			return
+		}
+		st.Buckets = append(st.Buckets, ConnStatsBucket{
+			Time:              tm,
+			Samples:           b.count,
+			ActiveConnections: value(&b.active, b.count),
+			IdleConnections:   value(&b.idle, b.count),
+			InflightRequests:  value(&b.inflight, b.count),
+		})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rings[key]
+	if !ok {
+		return
+	}
+	for i := range r.buckets {
+		appendBucket(&r.buckets[(r.next+i)%len(r.buckets)])
+	}
+	appendBucket(&r.cur)
+	return
+}
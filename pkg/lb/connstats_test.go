@@ -0,0 +1,67 @@
+package lb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnStatsSampler(t *testing.T) {
+	s := &connStatsSampler{
+		rings: make(map[string]*connStatsRing),
+	}
+	var active1, active2 int64
+	src1 := s.Register("test", func() connStatsSample { return connStatsSample{active: active1, idle: 1, inflight: active1} })
+	src2 := s.Register("test", func() connStatsSample { return connStatsSample{active: active2} })
+	sample := func(slot int64) {
+		s.mu.Lock()
+		s.rings["test"].sample(slot)
+		s.mu.Unlock()
+	}
+
+	// sources of the same key are summed
+	for i, v := range []int64{2, 4, 9} {
+		active1, active2 = v, 1
+		sample(int64(i / 2))
+	}
+	st := s.Status("test", time.Time{})
+	if len(st.Buckets) != 2 {
+		t.Fatalf("got %d buckets, want 2", len(st.Buckets))
+	}
+	if b := st.Buckets[0]; b.Samples != 2 || b.ActiveConnections != (ConnStatsValue{Min: 3, Avg: 4, Max: 5}) ||
+		b.IdleConnections != (ConnStatsValue{Min: 1, Avg: 1, Max: 1}) || b.InflightRequests != (ConnStatsValue{Min: 2, Avg: 3, Max: 4}) {
+		t.Errorf("got first bucket %+v", b)
+	}
+	if b := st.Buckets[1]; b.Samples != 1 || b.ActiveConnections.Max != 10 || !b.Time.Equal(time.Unix(0, int64(connStatsResolution))) {
+		t.Errorf("got current bucket %+v", b)
+	}
+	if st := s.Status("test", time.Unix(0, int64(connStatsResolution)+1)); len(st.Buckets) != 1 {
+		t.Errorf("got %d buckets since the current one, want 1", len(st.Buckets))
+	}
+
+	// the ring keeps the last connStatsBuckets buckets in order
+	for slot := int64(2); slot < connStatsBuckets+5; slot++ {
+		sample(slot)
+	}
+	st = s.Status("test", time.Time{})
+	if len(st.Buckets) != connStatsBuckets+1 {
+		t.Fatalf("got %d buckets, want %d", len(st.Buckets), connStatsBuckets+1)
+	}
+	for i := 1; i < len(st.Buckets); i++ {
+		if !st.Buckets[i-1].Time.Before(st.Buckets[i].Time) {
+			t.Fatalf("buckets %d and %d aren't ordered by time", i-1, i)
+		}
+	}
+	if tm := time.Unix(0, 4*int64(connStatsResolution)); !st.Buckets[0].Time.Equal(tm) {
+		t.Errorf("got oldest bucket at %v, want %v", st.Buckets[0].Time, tm)
+	}
+
+	// buckets are discarded with the last source
+	s.Unregister("test", src1)
+	if len(s.Status("test", time.Time{}).Buckets) == 0 {
+		t.Error("expected buckets while a source is registered")
+	}
+	s.Unregister("test", src2)
+	if len(s.Status("test", time.Time{}).Buckets) != 0 {
+		t.Error("expected no buckets after the last source unregistered")
+	}
+}
@@ -0,0 +1,215 @@
+package lb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/simult/simult/pkg/sockopt"
+)
+
+// Dialer dials connections to backend servers
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newBackendDialer returns the dialer of given backend options. The default one is a net.Dialer which has given
+// dscp, and binds SourceAddress if it is set. It has no timeout, connect timeouts are given by the dial contexts.
+// SOCKS5Dialer without Forward dials the proxy by the default one.
+// Dialers given by options are used as is, so dscp, SourceAddress and TCPKeepAlivePeriod aren't applied.
+func newBackendDialer(opts *HTTPBackendOptions, dscp int) (dialer Dialer) {
+	d := &net.Dialer{
+		KeepAlive: opts.TCPKeepAlivePeriod,
+		DualStack: true,
+	}
+	if opts.TCPKeepAlivePeriod == 0 {
+		// keep-alive is enabled with the period of the OS
+		d.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: -1, Interval: -1, Count: -1}
+	}
+	if dscp != 0 {
+		d.Control = sockopt.DSCPControl(dscp)
+	}
+	if opts.SourceAddress != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(opts.SourceAddress)}
+	}
+	switch o := opts.Dialer.(type) {
+	case nil:
+		return d
+	case *SOCKS5Dialer:
+		if o.Forward == nil {
+			s := *o
+			s.Forward = d
+			return &s
+		}
+	}
+	return opts.Dialer
+}
+
+// SOCKS5Dialer dials connections through a SOCKS5 proxy with CONNECT command. It authenticates by username and
+// password if Username is set. Forward dials the proxy; it is a net.Dialer if it is nil.
+type SOCKS5Dialer struct {
+	Address  string
+	Username string
+	Password string
+	Forward  Dialer
+}
+
+var (
+	errSOCKS5Network      = errors.New("network not supported")
+	errSOCKS5Version      = errors.New("unexpected protocol version")
+	errSOCKS5NoAuthMethod = errors.New("no acceptable authentication method")
+	errSOCKS5AuthFailed   = errors.New("authentication failed")
+	errSOCKS5AddrType     = errors.New("unknown address type")
+)
+
+// socks5Replies are the messages of SOCKS5 reply codes
+var socks5Replies = []string{
+	1: "general server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "ttl expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// DialContext dials given address through the proxy. The handshake is interrupted when ctx is done.
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5 proxy %s: %w", d.Address, errSOCKS5Network)
+	}
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err = forward.DialContext(ctx, "tcp", d.Address)
+	if err != nil {
+		return
+	}
+
+	stopCh, exitCh := make(chan struct{}), make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stopCh:
+		}
+		close(exitCh)
+	}()
+	err = d.handshake(conn, addr)
+	close(stopCh)
+	<-exitCh
+	if err != nil {
+		conn.Close()
+		conn = nil
+		if e := ctx.Err(); e != nil {
+			err = e
+		}
+		err = fmt.Errorf("socks5 proxy %s: %w", d.Address, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+func (d *SOCKS5Dialer) handshake(conn net.Conn, addr string) (err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("port %q invalid", portStr)
+	}
+
+	method := byte(0x00)
+	if d.Username != "" {
+		method = 0x02
+	}
+	if _, err = conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return
+	}
+	buf := make([]byte, 2, 512)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if buf[0] != 0x05 {
+		return errSOCKS5Version
+	}
+	if buf[1] != method {
+		return errSOCKS5NoAuthMethod
+	}
+
+	if method == 0x02 {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := append([]byte{0x01, byte(len(d.Username))}, d.Username...)
+		req = append(append(req, byte(len(d.Password))), d.Password...)
+		if _, err = conn.Write(req); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if buf[1] != 0x00 {
+			return errSOCKS5AuthFailed
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host too long")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+
+	buf = buf[:4]
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if buf[0] != 0x05 {
+		return errSOCKS5Version
+	}
+	if rep := int(buf[1]); rep != 0x00 {
+		if rep < len(socks5Replies) && socks5Replies[rep] != "" {
+			return errors.New(socks5Replies[rep])
+		}
+		return fmt.Errorf("unknown reply %d", rep)
+	}
+	n := 0
+	switch buf[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x04:
+		n = net.IPv6len
+	case 0x03:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		n = int(buf[0])
+	default:
+		return errSOCKS5AddrType
+	}
+	// bound address and port
+	_, err = io.ReadFull(conn, buf[:n+2])
+	return
+}
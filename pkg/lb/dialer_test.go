@@ -0,0 +1,331 @@
+package lb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simult/simult/pkg/hc"
+)
+
+// runTestSOCKS5Proxy runs a SOCKS5 proxy which requires given credentials, and responds CONNECT requests with reply.
+// It records the targets of CONNECT requests.
+func runTestSOCKS5Proxy(t *testing.T, username, password string, reply byte) (lis net.Listener, targets func() []string) {
+	var targetsMu sync.Mutex
+	var targetList []string
+	_, lis = runTestBackendServer(t, func(conn net.Conn) {
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		methods := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		method := byte(0xff)
+		for _, m := range methods {
+			if (username == "" && m == 0x00) || (username != "" && m == 0x02) {
+				method = m
+			}
+		}
+		conn.Write([]byte{0x05, method})
+		if method == 0xff {
+			return
+		}
+		if method == 0x02 {
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			user := make([]byte, buf[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, buf[:1])
+			pass := make([]byte, buf[0])
+			io.ReadFull(conn, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		host := ""
+		switch buf[3] {
+		case 0x01:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 0x03:
+			io.ReadFull(conn, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(conn, buf[:n])
+			host = string(buf[:n])
+		default:
+			return
+		}
+		io.ReadFull(conn, buf[:2])
+		target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+		targetsMu.Lock()
+		targetList = append(targetList, target)
+		targetsMu.Unlock()
+		if reply != 0x00 {
+			conn.Write([]byte{0x05, reply, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x03, 4, 'h', 'o', 's', 't', 0, 80})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	})
+	targets = func() []string {
+		targetsMu.Lock()
+		defer targetsMu.Unlock()
+		return append([]string(nil), targetList...)
+	}
+	return
+}
+
+func TestHTTPBackendSOCKS5Dialer(t *testing.T) {
+	var healthChecks int64
+	var healthChecksMu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			healthChecksMu.Lock()
+			healthChecks++
+			healthChecksMu.Unlock()
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+	srvAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, tc := range []struct {
+		username, password string
+		reply              byte
+		code               int
+	}{
+		{"", "", 0x00, 200},
+		{"user", "pass", 0x00, 200},
+		{"user", "wrong", 0x00, 502},
+		{"", "", 0x02, 502},
+	} {
+		proxyUsername, proxyPassword := "", ""
+		if tc.username != "" {
+			proxyUsername, proxyPassword = "user", "pass"
+		}
+		proxyLis, targets := runTestSOCKS5Proxy(t, proxyUsername, proxyPassword, tc.reply)
+		b, err := NewHTTPBackend(HTTPBackendOptions{
+			Name:    "socks5",
+			Servers: []string{srv.URL},
+			Dialer: &SOCKS5Dialer{
+				Address:  proxyLis.Addr().String(),
+				Username: tc.username,
+				Password: tc.password,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Activate()
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:           "socks5",
+			DefaultBackend: b,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+
+		labels := prometheus.Labels{"frontend": "socks5", "error": httpErrGroupBackendConnect}
+		base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+		if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != tc.code {
+			t.Errorf("username %q password %q reply %d: got %d, want %d", tc.username, tc.password, tc.reply, resp.StatusCode, tc.code)
+		}
+		fLis.Close()
+		f.Close()
+		b.Close()
+		proxyLis.Close()
+		if tc.code == 200 {
+			if tg := targets(); len(tg) != 1 || tg[0] != srvAddr {
+				t.Errorf("got proxy targets %q, want %q", tg, srvAddr)
+			}
+			continue
+		}
+		// proxy failures are classified as native connect failures
+		n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+		for i := 0; i < 50 && n < 1; i++ {
+			time.Sleep(10 * time.Millisecond)
+			n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+		}
+		if n != 1 {
+			t.Errorf("username %q password %q reply %d: got %v backend connect errors, want 1", tc.username, tc.password, tc.reply, n)
+		}
+	}
+
+	// health-checks are dialed through the proxy too
+	proxyLis, targets := runTestSOCKS5Proxy(t, "", "", 0x00)
+	defer proxyLis.Close()
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "socks5",
+		Servers: []string{srv.URL},
+		HealthCheckHTTPOpts: &hc.HTTPCheckOptions{
+			Path:     "/health",
+			Interval: 50 * time.Millisecond,
+			Timeout:  time.Second,
+		},
+		Dialer: &SOCKS5Dialer{Address: proxyLis.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+	time.Sleep(200 * time.Millisecond)
+	b.Close()
+	healthChecksMu.Lock()
+	checks := healthChecks
+	healthChecksMu.Unlock()
+	if tg := targets(); checks == 0 || len(tg) < int(checks) {
+		t.Errorf("got %d health-checks and %d proxy targets, want health-checks through proxy", checks, len(tg))
+	}
+}
+
+func TestSOCKS5DialerContext(t *testing.T) {
+	// proxy which never responds the greeting
+	_, lis := runTestBackendServer(t, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer lis.Close()
+	d := &SOCKS5Dialer{Address: lis.Addr().String()}
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer ctxCancel()
+	startTime := time.Now()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Now().Sub(startTime); d > time.Second {
+		t.Errorf("dial took %v after context deadline", d)
+	}
+	if _, err := d.DialContext(context.Background(), "udp", "example.com:80"); !errors.Is(err, errSOCKS5Network) {
+		t.Errorf("got error %v, want %v", err, errSOCKS5Network)
+	}
+}
+
+func TestHTTPBackendSourceAddress(t *testing.T) {
+	var remoteAddr string
+	var remoteAddrMu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrMu.Lock()
+		remoteAddr = r.RemoteAddr
+		remoteAddrMu.Unlock()
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+
+	// the loopback network is bound on 127.0.0.0/8 on linux
+	if lis, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("source address unavailable: %v", err)
+	} else {
+		lis.Close()
+	}
+
+	if _, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:          "source",
+		Servers:       []string{srv.URL},
+		SourceAddress: "not-an-ip",
+	}); err == nil {
+		t.Error("expected error for invalid source address")
+	}
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:          "source",
+		Servers:       []string{srv.URL},
+		SourceAddress: "127.0.0.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+	defer b.Close()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "source",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+	if resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 || body != "OK" {
+		t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "OK")
+	}
+	remoteAddrMu.Lock()
+	defer remoteAddrMu.Unlock()
+	if host, _, _ := net.SplitHostPort(remoteAddr); host != "127.0.0.2" {
+		t.Errorf("got remote address %q, want source address 127.0.0.2", remoteAddr)
+	}
+}
+
+func TestHTTPBackendForkKeepsHealthCheckDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+
+	opts := HTTPBackendOptions{
+		Name:    "hcdialer",
+		Servers: []string{srv.URL},
+		HealthCheckHTTPOpts: &hc.HTTPCheckOptions{
+			Path:     "/health",
+			Interval: 50 * time.Millisecond,
+			Timeout:  time.Second,
+			DSCP:     10,
+		},
+		SourceAddress: "127.0.0.1",
+	}
+	b, err := NewHTTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+	defer b.Close()
+	currentCheck := func(b *HTTPBackend) hc.HealthCheck {
+		bs := b.bss[srv.URL]
+		bs.healthCheckMu.RLock()
+		defer bs.healthCheckMu.RUnlock()
+		if bs.healthCheckNext != nil {
+			return bs.healthCheckNext
+		}
+		return bs.healthCheck
+	}
+	h := currentCheck(b)
+	if h == nil {
+		t.Fatal("expected health-check")
+	}
+
+	// health-check isn't restarted while the dial parameters are unchanged
+	bn, err := b.Fork(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bn.Activate()
+	defer bn.Close()
+	if hn := currentCheck(bn); hn != h {
+		t.Error("health-check restarted after fork with same options")
+	}
+}
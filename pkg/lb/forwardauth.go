@@ -0,0 +1,295 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goinsane/xlog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	forwardAuthDefaultTimeout  = 5 * time.Second
+	forwardAuthMaxBodySize     = 64 * 1024
+	forwardAuthCacheMaxEntries = 10000
+)
+
+var errForwardAuthBackendUnavailable = errors.New("auth backend unavailable")
+
+type forwardAuthCacheEntry struct {
+	header  http.Header
+	expires time.Time
+}
+
+// forwardAuth authorizes requests of a route by subrequests to its auth backend, and caches positive decisions
+type forwardAuth struct {
+	backend         *HTTPBackend
+	backendRef      *httpBackendRef
+	headers         []string
+	responseHeaders []string
+	timeout         time.Duration
+	failOpen        bool
+	cacheHeader     string
+	cacheTTL        time.Duration
+
+	cacheMu sync.Mutex
+	cache   map[string]forwardAuthCacheEntry
+}
+
+func newForwardAuth(route *HTTPFrontendRoute) (a *forwardAuth, err error) {
+	opts := &route.ForwardAuth
+	a = &forwardAuth{
+		backend:     opts.Backend,
+		timeout:     opts.Timeout,
+		failOpen:    opts.FailOpen,
+		cacheHeader: http.CanonicalHeaderKey(opts.CacheHeader),
+		cacheTTL:    opts.CacheTTL,
+		cache:       make(map[string]forwardAuthCacheEntry),
+	}
+	if a.timeout <= 0 {
+		a.timeout = forwardAuthDefaultTimeout
+	}
+	if opts.BackendName != "" {
+		if opts.Backend != nil {
+			return nil, fmt.Errorf("has both backend and backend name %q", opts.BackendName)
+		}
+		a.backendRef, err = httpBackends.Resolve(opts.BackendName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	isHeaderName := func(name string) bool {
+		return name != "" && strings.IndexFunc(name, isNotToken) < 0
+	}
+	for _, name := range opts.Headers {
+		if !isHeaderName(name) {
+			return nil, fmt.Errorf("header name %q invalid", name)
+		}
+		a.headers = append(a.headers, http.CanonicalHeaderKey(name))
+	}
+	for _, name := range opts.ResponseHeaders {
+		if !isHeaderName(name) {
+			return nil, fmt.Errorf("response header name %q invalid", name)
+		}
+		a.responseHeaders = append(a.responseHeaders, http.CanonicalHeaderKey(name))
+	}
+	if opts.CacheHeader != "" && !isHeaderName(opts.CacheHeader) {
+		return nil, fmt.Errorf("cache header name %q invalid", opts.CacheHeader)
+	}
+	return
+}
+
+// Backend returns the auth backend, or nil if the referred one isn't active
+func (a *forwardAuth) Backend() *HTTPBackend {
+	if a.backendRef != nil {
+		return a.backendRef.Get()
+	}
+	return a.backend
+}
+
+// Cached returns the response headers of the cached positive decision by given key
+func (a *forwardAuth) Cached(key string) (hdr http.Header, ok bool) {
+	if key == "" || a.cacheTTL <= 0 {
+		return
+	}
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	e, ok := a.cache[key]
+	if !ok {
+		return
+	}
+	if !time.Now().Before(e.expires) {
+		delete(a.cache, key)
+		return nil, false
+	}
+	return e.header, true
+}
+
+// Store caches the positive decision by given key. Expired entries are swept when the cache is full, and the decision
+// isn't cached if the cache is still full.
+func (a *forwardAuth) Store(key string, hdr http.Header) {
+	if key == "" || a.cacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	if len(a.cache) >= forwardAuthCacheMaxEntries {
+		for k, e := range a.cache {
+			if !now.Before(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= forwardAuthCacheMaxEntries {
+			return
+		}
+	}
+	a.cache[key] = forwardAuthCacheEntry{
+		header:  hdr,
+		expires: now.Add(a.cacheTTL),
+	}
+}
+
+// authSubrequest sends a GET request of the request URI with given headers to a server of the backend, and reads its
+// response. The subrequest doesn't pass through routes, admission or metrics of the backend.
+func (b *HTTPBackend) authSubrequest(ctx context.Context, reqDesc *httpReqDesc, headers []string) (resp *http.Response, body []byte, err error) {
+	atomic.AddInt64(&b.connCount, 1)
+	defer atomic.AddInt64(&b.connCount, -1)
+
+	bs := b.findServer(reqDesc)
+	if bs == nil {
+		return nil, nil, errHTTPBackendFind
+	}
+	connectCtx := ctx
+	if b.opts.ConnectTimeout > 0 {
+		var connectCtxCancel context.CancelFunc
+		connectCtx, connectCtxCancel = context.WithTimeout(ctx, b.opts.ConnectTimeout)
+		defer connectCtxCancel()
+	}
+	bc, err := bs.ConnAcquire(connectCtx, b.proxyProtocolHeader(reqDesc), reqDesc.feConnCtx)
+	if err != nil {
+		return nil, nil, newfHTTPError(httpErrGroupBackendConnect, "could not connect to auth backend server %q: %w", bs.server, err)
+	}
+	keepAlive := false
+	defer func() {
+		if !keepAlive || (b.opts.ServerMaxIdleConn > 0 && bs.idleConnCount >= int64(b.opts.ServerMaxIdleConn)) {
+			bc.Close()
+		}
+		bc.Stats()
+		bs.ConnRelease(bc)
+	}()
+	// the read of this connection can't be interrupted otherwise
+	if deadline, ok := ctx.Deadline(); ok {
+		bc.SetDeadline(deadline)
+	}
+
+	hdr := make(http.Header, len(headers)+8)
+	for _, name := range headers {
+		if values, ok := reqDesc.feHdr[name]; ok {
+			hdr[name] = values
+		}
+	}
+	hdr.Set("X-Forwarded-Method", reqDesc.feStatusMethod)
+	hdr.Set("X-Forwarded-Uri", reqDesc.feStatusURI)
+	hdr.Set("X-Forwarded-Proto", reqDesc.feURL.Scheme)
+	hdr.Set("X-Forwarded-Host", reqDesc.feURL.Host)
+	hdr.Set("X-Forwarded-For", reqDesc.feRemoteIP)
+	hdr.Set("X-Real-IP", reqDesc.feRemoteIP)
+	hdr.Set("Connection", "keep-alive")
+	hdr.Del("Content-Length")
+	hdr.Del("Transfer-Encoding")
+	bc.Writer.WriteString("GET " + reqDesc.feStatusURI + " HTTP/1.1\r\nHost: " + reqDesc.feURL.Host + "\r\n")
+	hdr.Write(bc.Writer)
+	bc.Writer.WriteString("\r\n")
+	if err = bc.Flush(); err != nil {
+		return nil, nil, wrapHTTPError(httpErrGroupBackendCommunication, err)
+	}
+
+	resp, err = http.ReadResponse(bc.Reader, nil)
+	if err != nil {
+		return nil, nil, wrapHTTPError(httpErrGroupBackendCommunication, err)
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, forwardAuthMaxBodySize+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, wrapHTTPError(httpErrGroupBackendCommunication, err)
+	}
+	if len(body) > forwardAuthMaxBodySize {
+		return nil, nil, errHTTPResponseTooLarge
+	}
+	bc.SetDeadline(time.Time{})
+	keepAlive = !resp.Close && strings.EqualFold(resp.Header.Get("Connection"), "keep-alive")
+	return
+}
+
+// serveForwardAuth authorizes the request by the forward auth of its route. Response headers of allowed requests are
+// set on the request sent to backend, and denied requests are answered with the response of the auth backend.
+func (f *HTTPFrontend) serveForwardAuth(ctx context.Context, reqDesc *httpReqDesc, a *forwardAuth) (err error) {
+	promLabels := prometheus.Labels{
+		"host":     reqDesc.feHost,
+		"path":     reqDesc.fePath,
+		"listener": reqDesc.leName,
+	}
+	promTotal := f.promForwardAuthTotal.MustCurryWith(promLabels)
+
+	// clients must not be able to set the headers given by the auth backend
+	for _, name := range a.responseHeaders {
+		reqDesc.feHdr.Del(name)
+	}
+	setHeaders := func(hdr http.Header) {
+		for name, values := range hdr {
+			reqDesc.feHdr[name] = values
+		}
+	}
+
+	cacheKey := ""
+	if a.cacheHeader != "" {
+		cacheKey = reqDesc.feHdr.Get(a.cacheHeader)
+	}
+	if hdr, ok := a.Cached(cacheKey); ok {
+		promTotal.With(prometheus.Labels{"result": "cached"}).Inc()
+		setHeaders(hdr)
+		return
+	}
+
+	var resp *http.Response
+	var body []byte
+	b := a.Backend()
+	if b == nil {
+		err = wrapHTTPError(httpErrGroupForwardAuthFailed, errForwardAuthBackendUnavailable)
+	} else {
+		subCtx, subCtxCancel := context.WithTimeout(ctx, a.timeout)
+		startTime := time.Now()
+		resp, body, err = b.authSubrequest(subCtx, reqDesc, a.headers)
+		subCtxCancel()
+		f.promForwardAuthDuration.With(promLabels).Observe(time.Now().Sub(startTime).Seconds())
+		if err != nil {
+			err = wrapHTTPError(httpErrGroupForwardAuthFailed, err)
+		}
+	}
+	if err != nil {
+		promTotal.With(prometheus.Labels{"result": "error"}).Inc()
+		if !a.failOpen {
+			xlog.V(100).Debugf("serve error on %s: forward auth: %v", reqDesc.FrontendSummary(), err)
+			reqDesc.feConn.Write([]byte(httpServiceUnavailable))
+			return
+		}
+		xlog.V(100).Debugf("forward auth error on %s, failing open: %v", reqDesc.FrontendSummary(), err)
+		return nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		promTotal.With(prometheus.Labels{"result": "deny"}).Inc()
+		err = errHTTPForwardAuthDenied
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Upgrade"} {
+			resp.Header.Del(name)
+		}
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		reqDesc.feConn.Write([]byte("HTTP/1.0 " + resp.Status + "\r\n"))
+		resp.Header.Write(reqDesc.feConn)
+		reqDesc.feConn.Write([]byte("\r\n"))
+		reqDesc.feConn.Write(body)
+		return
+	}
+
+	promTotal.With(prometheus.Labels{"result": "allow"}).Inc()
+	hdr := make(http.Header, len(a.responseHeaders))
+	for _, name := range a.responseHeaders {
+		if values, ok := resp.Header[name]; ok {
+			hdr[name] = values
+		}
+	}
+	a.Store(cacheKey, hdr)
+	setHeaders(hdr)
+	return
+}
@@ -0,0 +1,115 @@
+package lb
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendForwardAuth(t *testing.T) {
+	var authCalls int64
+	authB, authCloser := newTestHTTPBackend(t, "forwardauth-auth", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&authCalls, 1)
+		if r.Method != "GET" || r.Header.Get("X-Forwarded-Uri") != r.URL.RequestURI() || r.Header.Get("Cookie") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Connection", "keep-alive")
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Header().Set("X-Auth-User", "alice")
+		case "Bearer slow":
+			time.Sleep(300 * time.Millisecond)
+		default:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("denied"))
+		}
+	})
+	defer authCloser()
+	b, closer := newTestHTTPBackend(t, "forwardauth", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Auth-User")))
+	})
+	defer closer()
+
+	route := HTTPFrontendRoute{Path: "/api/*", Backend: b}
+	route.ForwardAuth.Backend = authB
+	route.ForwardAuth.Headers = []string{"authorization"}
+	route.ForwardAuth.ResponseHeaders = []string{"X-Auth-User"}
+	route.ForwardAuth.Timeout = 100 * time.Millisecond
+	route.ForwardAuth.CacheHeader = "Authorization"
+	route.ForwardAuth.CacheTTL = time.Minute
+	failOpenRoute := route
+	failOpenRoute.Path = "/failopen/*"
+	failOpenRoute.ForwardAuth.CacheTTL = 0
+	failOpenRoute.ForwardAuth.FailOpen = true
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "forwardauth",
+		Routes:         []HTTPFrontendRoute{route, failOpenRoute},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	results := []string{"allow", "cached", "deny", "error"}
+	base := make(map[string]float64, len(results))
+	for _, result := range results {
+		base[result] = testCounterSum(promHTTPFrontendForwardAuthTotal, prometheus.Labels{"frontend": "forwardauth", "result": result})
+	}
+	for _, tc := range []struct {
+		uri, hdr string
+		code     int
+		body     string
+		calls    int64
+	}{
+		{"/api/x?y=1", "Authorization: Bearer good\r\nCookie: a=b\r\n", http.StatusOK, "alice", 1},
+		{"/api/x?y=1", "Authorization: Bearer good\r\n", http.StatusOK, "alice", 0},
+		{"/api/x", "Authorization: Bearer bad\r\nX-Auth-User: mallory\r\n", http.StatusUnauthorized, "denied", 1},
+		{"/api/x", "X-Auth-User: mallory\r\n", http.StatusUnauthorized, "denied", 1},
+		{"/api/x", "Authorization: Bearer slow\r\n", http.StatusServiceUnavailable, "Service Unavailable\r\n", 1},
+		{"/failopen/x", "Authorization: Bearer slow\r\nX-Auth-User: mallory\r\n", http.StatusOK, "", 1},
+		{"/other", "X-Auth-User: mallory\r\n", http.StatusOK, "mallory", 0},
+	} {
+		calls := atomic.LoadInt64(&authCalls)
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: example.com\r\n"+tc.hdr+"\r\n")
+		if resp.StatusCode != tc.code || body != tc.body {
+			t.Errorf("uri %q header %q: got %d %q, want %d %q", tc.uri, tc.hdr, resp.StatusCode, body, tc.code, tc.body)
+		}
+		if tc.code == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("uri %q header %q: got WWW-Authenticate %q", tc.uri, tc.hdr, resp.Header.Get("WWW-Authenticate"))
+		}
+		if n := atomic.LoadInt64(&authCalls) - calls; n != tc.calls {
+			t.Errorf("uri %q header %q: got %d auth subrequests, want %d", tc.uri, tc.hdr, n, tc.calls)
+		}
+	}
+	for result, want := range map[string]float64{"allow": 1, "cached": 1, "deny": 2, "error": 2} {
+		if n := testCounterSum(promHTTPFrontendForwardAuthTotal, prometheus.Labels{"frontend": "forwardauth", "result": result}) - base[result]; n != want {
+			t.Errorf("got %v %s decisions, want %v", n, result, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(route *HTTPFrontendRoute)
+	}{
+		{"invalid header", func(route *HTTPFrontendRoute) { route.ForwardAuth.Headers = []string{"bad header"} }},
+		{"invalid response header", func(route *HTTPFrontendRoute) { route.ForwardAuth.ResponseHeaders = []string{""} }},
+		{"unknown backend name", func(route *HTTPFrontendRoute) {
+			route.ForwardAuth.Backend, route.ForwardAuth.BackendName = nil, "forwardauth-unknown"
+		}},
+		{"both backend and backend name", func(route *HTTPFrontendRoute) { route.ForwardAuth.BackendName = "forwardauth-auth" }},
+	} {
+		badRoute := route
+		tc.modify(&badRoute)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "forwardauth", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
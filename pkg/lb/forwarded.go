@@ -0,0 +1,145 @@
+package lb
+
+import (
+	"net"
+	"strings"
+)
+
+// parseForwarded parses the elements of RFC 7239 Forwarded header values. Parameter names of the elements are
+// lowercase, and quoted values are unquoted. It reports false if any value is malformed.
+func parseForwarded(values []string) (elements []map[string]string, ok bool) {
+	for _, value := range values {
+		element := make(map[string]string)
+		for i := 0; ; {
+			for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+				i++
+			}
+			j := i
+			for j < len(value) && isTokenRune(rune(value[j])) {
+				j++
+			}
+			if j == i || j >= len(value) || value[j] != '=' {
+				return nil, false
+			}
+			name := strings.ToLower(value[i:j])
+			i = j + 1
+			var v string
+			if i < len(value) && value[i] == '"' {
+				var sb strings.Builder
+				for i++; i < len(value) && value[i] != '"'; i++ {
+					if value[i] == '\\' {
+						i++
+						if i >= len(value) {
+							return nil, false
+						}
+					}
+					sb.WriteByte(value[i])
+				}
+				if i >= len(value) {
+					return nil, false
+				}
+				i++
+				v = sb.String()
+			} else {
+				j = i
+				for j < len(value) && isTokenRune(rune(value[j])) {
+					j++
+				}
+				if j == i {
+					return nil, false
+				}
+				v, i = value[i:j], j
+			}
+			if _, dup := element[name]; dup {
+				return nil, false
+			}
+			element[name] = v
+			for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+				i++
+			}
+			if i >= len(value) {
+				elements = append(elements, element)
+				break
+			}
+			switch value[i] {
+			case ';':
+			case ',':
+				elements = append(elements, element)
+				element = make(map[string]string)
+			default:
+				return nil, false
+			}
+			i++
+		}
+	}
+	return elements, true
+}
+
+// parseForwardedNode returns the IP of the node of a Forwarded "for" parameter, eg "192.0.2.1:80" or
+// "[2001:db8::1]". It returns nil for unknown and obfuscated nodes.
+func parseForwardedNode(node string) net.IP {
+	host := node
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 || (end+1 < len(node) && node[end+1] != ':') {
+			return nil
+		}
+		host = node[1:end]
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return ip
+		}
+		return nil
+	}
+	if i := strings.IndexByte(node, ':'); i >= 0 {
+		host = node[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return ip
+	}
+	return nil
+}
+
+// formatForwardedElement returns the Forwarded element of the request from peer by proto and host. IPv6 peers are
+// quoted in brackets, and an unknown peer is "unknown".
+func formatForwardedElement(peer net.IP, proto, host string) string {
+	node := "unknown"
+	if peer != nil {
+		node = peer.String()
+		if peer.To4() == nil {
+			node = "[" + node + "]"
+		}
+	}
+	element := "for=" + quoteForwardedValue(node) + ";proto=" + quoteForwardedValue(proto)
+	if host != "" {
+		element += ";host=" + quoteForwardedValue(host)
+	}
+	return element
+}
+
+// quoteForwardedValue returns value as a token, or as a quoted string if it isn't a token
+func quoteForwardedValue(value string) string {
+	if value != "" && strings.IndexFunc(value, isNotToken) < 0 {
+		return value
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(value[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// setForwardedHeader sets the Forwarded header of the request toward backends. The element of the request is appended
+// to the Forwarded headers which are received from a trusted proxy, and it replaces the ones from other clients.
+func (f *HTTPFrontend) setForwardedHeader(reqDesc *httpReqDesc) {
+	peer := net.ParseIP(reqDesc.feRemoteIP)
+	element := formatForwardedElement(peer, reqDesc.feURL.Scheme, reqDesc.feURL.Host)
+	if values := reqDesc.feHdr["Forwarded"]; len(values) > 0 && peer != nil && isTrustedProxy(peer, f.options().TrustedProxies) {
+		element = strings.Join(values, ", ") + ", " + element
+	}
+	reqDesc.feHdr.Set("Forwarded", element)
+}
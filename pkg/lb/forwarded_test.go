@@ -0,0 +1,106 @@
+package lb
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   []map[string]string
+	}{
+		{[]string{"for=192.0.2.1"}, []map[string]string{{"for": "192.0.2.1"}}},
+		{[]string{`For="[2001:db8::1]:4711";proto=https;by=203.0.113.1`}, []map[string]string{{"for": "[2001:db8::1]:4711", "proto": "https", "by": "203.0.113.1"}}},
+		{[]string{"for=192.0.2.1, for=198.51.100.1 ; host=example.com", `for="\"quoted\""`}, []map[string]string{
+			{"for": "192.0.2.1"},
+			{"for": "198.51.100.1", "host": "example.com"},
+			{"for": `"quoted"`},
+		}},
+		{[]string{""}, nil},
+		{[]string{"for"}, nil},
+		{[]string{"for=192.0.2.1,"}, nil},
+		{[]string{`for="192.0.2.1`}, nil},
+		{[]string{"for=192.0.2.1;for=192.0.2.2"}, nil},
+		{[]string{"for=[2001:db8::1]"}, nil},
+	} {
+		got, ok := parseForwarded(tc.values)
+		if ok != (tc.want != nil) || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v %v, want %v", tc.values, got, ok, tc.want)
+		}
+	}
+}
+
+func TestFormatForwardedElement(t *testing.T) {
+	for _, tc := range []struct {
+		peer        net.IP
+		proto, host string
+		want        string
+	}{
+		{net.ParseIP("192.0.2.1"), "http", "example.com", "for=192.0.2.1;proto=http;host=example.com"},
+		{net.ParseIP("2001:db8::1"), "https", "example.com:8443", `for="[2001:db8::1]";proto=https;host="example.com:8443"`},
+		{nil, "http", "", "for=unknown;proto=http"},
+	} {
+		if got := formatForwardedElement(tc.peer, tc.proto, tc.host); got != tc.want {
+			t.Errorf("%v %s %s: got %q, want %q", tc.peer, tc.proto, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestForwardedClientIPByForwarded(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	for _, tc := range []struct {
+		forwarded []string
+		want      string
+	}{
+		{[]string{"for=203.0.113.1"}, "203.0.113.1"},
+		{[]string{`for=198.51.100.1, for="[2001:db8::1]:4711", for="127.0.0.2:80"`}, "2001:db8::1"},
+		{[]string{"for=198.51.100.1, for=_hidden, for=127.0.0.2"}, "127.0.0.2"},
+		{[]string{"for=198.51.100.1;", "for=127.0.0.2"}, "127.0.0.1"},
+	} {
+		hdr := http.Header{"Forwarded": tc.forwarded, "X-Forwarded-For": {"192.0.2.1"}}
+		if got := forwardedClientIP(net.ParseIP("127.0.0.1"), hdr, []*net.IPNet{trusted}); !got.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("forwarded %q: got %v, want %s", tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPFrontendEmitForwarded(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "forwarded", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Forwarded")))
+	})
+	defer closer()
+
+	// the test client is in the local network
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	for _, tc := range []struct {
+		name    string
+		trusted []*net.IPNet
+		mode    HTTPFrontendForwardedHeaders
+		want    string
+	}{
+		{"trusted proxy", []*net.IPNet{local}, HTTPFrontendForwardedHeadersAppend, "for=192.0.2.1, for=127.0.0.1;proto=http;host=example.com"},
+		{"other client", nil, HTTPFrontendForwardedHeadersAppend, "for=127.0.0.1;proto=http;host=example.com"},
+		{"strip mode", []*net.IPNet{local}, HTTPFrontendForwardedHeadersStrip, "for=127.0.0.1;proto=http;host=example.com"},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:             "forwarded",
+			DefaultBackend:   b,
+			TrustedProxies:   tc.trusted,
+			ForwardedHeaders: tc.mode,
+			EmitForwarded:    true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+		_, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\nForwarded: for=192.0.2.1\r\n\r\n")
+		if body != tc.want {
+			t.Errorf("%s: backend got Forwarded %q, want %q", tc.name, body, tc.want)
+		}
+		fLis.Close()
+		f.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// GeoIPLookup resolves the countries of IP addresses, eg by a MaxMind database reader. CountryOf returns the ISO 3166-1
+// alpha-2 code of the country of ip, or an empty string if the country is unknown. Lookups must be safe for
+// concurrent use, so that a lookup can be shared by frontends. The lookup of frontend options can be swapped by Fork
+// on reloads.
+type GeoIPLookup interface {
+	CountryOf(ip net.IP) string
+}
+
+// httpCountrySet is the set of uppercase country codes of a restriction
+type httpCountrySet map[string]struct{}
+
+func newHTTPCountrySet(countries []string) (s httpCountrySet, err error) {
+	s = make(httpCountrySet, len(countries))
+	for _, country := range countries {
+		if !isCountryCode(country) {
+			return nil, fmt.Errorf("country %q invalid", country)
+		}
+		s[strings.ToUpper(country)] = struct{}{}
+	}
+	return s, nil
+}
+
+// matchCountry reports whether the country condition of the restriction holds for ip. It holds for the IPs whose
+// country is unknown if RestrictUnknownCountry is set, regardless of the inversions.
+func (r *HTTPFrontendRestriction) matchCountry(ip net.IP) bool {
+	country := ""
+	if ip != nil {
+		country = strings.ToUpper(r.geoIP.CountryOf(ip))
+	}
+	if country == "" {
+		return r.RestrictUnknownCountry
+	}
+	_, c := r.countries[country]
+	return c != r.InvertCountries != r.Invert
+}
+
+// isCountryCode reports whether s is a two letter country code
+func isCountryCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i] | 0x20; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
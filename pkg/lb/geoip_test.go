@@ -0,0 +1,106 @@
+package lb
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+type testGeoIPLookup map[string]string
+
+func (l testGeoIPLookup) CountryOf(ip net.IP) string {
+	return l[ip.String()]
+}
+
+func TestHTTPFrontendRestrictionCountries(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "restrictcountries", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	routes := []HTTPFrontendRoute{
+		{Path: "/blocked/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+			{Countries: []string{"tr", "DE"}},
+		}},
+		{Path: "/allowed/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+			{Countries: []string{"TR"}, InvertCountries: true},
+		}},
+		{Path: "/known/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+			{Countries: []string{"TR"}, InvertCountries: true, RestrictUnknownCountry: true},
+		}},
+		// countries are combined with the other conditions, the test client is in the local network
+		{Path: "/chained/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+			{Countries: []string{"TR"}, AndAfter: true},
+			{Path: "/chained/admin/*"},
+		}},
+	}
+	opts := HTTPFrontendOptions{
+		Name:   "restrictcountries",
+		Routes: routes,
+		GeoIP:  testGeoIPLookup{"127.0.0.1": "tr"},
+	}
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	check := func(name string, f *HTTPFrontend, want map[string]int) {
+		fLis := runTestFrontend(t, f)
+		defer fLis.Close()
+		for path, code := range want {
+			resp, _ := doTestRequestOnce(t, fLis, "GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			if resp.StatusCode != code {
+				t.Errorf("%s %s: got %d, want %d", name, path, resp.StatusCode, code)
+			}
+		}
+	}
+	check("known country", f, map[string]int{
+		"/blocked/x":       http.StatusForbidden,
+		"/allowed/x":       http.StatusOK,
+		"/known/x":         http.StatusOK,
+		"/chained/x":       http.StatusOK,
+		"/chained/admin/x": http.StatusForbidden,
+	})
+
+	// the lookup is swapped by forking
+	opts.GeoIP = testGeoIPLookup{"127.0.0.1": "US"}
+	fn, err := f.Fork(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fn.Close()
+	check("other country", fn, map[string]int{
+		"/blocked/x":       http.StatusOK,
+		"/allowed/x":       http.StatusForbidden,
+		"/known/x":         http.StatusForbidden,
+		"/chained/admin/x": http.StatusOK,
+	})
+
+	opts.GeoIP = testGeoIPLookup{}
+	if fn, err = f.Fork(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer fn.Close()
+	check("unknown country", fn, map[string]int{
+		"/blocked/x": http.StatusOK,
+		"/allowed/x": http.StatusOK,
+		"/known/x":   http.StatusForbidden,
+	})
+
+	for _, tc := range []struct {
+		name        string
+		geoIP       GeoIPLookup
+		restriction HTTPFrontendRestriction
+	}{
+		{"without geoip lookup", nil, HTTPFrontendRestriction{Countries: []string{"TR"}}},
+		{"invalid country", testGeoIPLookup{}, HTTPFrontendRestriction{Countries: []string{"TUR"}}},
+		{"invert without countries", testGeoIPLookup{}, HTTPFrontendRestriction{Path: "/x", InvertCountries: true}},
+	} {
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "restrictcountries", GeoIP: tc.geoIP, Routes: []HTTPFrontendRoute{
+			{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{tc.restriction}},
+		}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
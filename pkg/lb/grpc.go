@@ -0,0 +1,141 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/goinsane/xlog"
+)
+
+// newH2Transport returns the HTTP/2 transport of the backend server, h2 for https servers and h2c with prior knowledge
+// for http servers. Connections are dialed by the dialer and the tls parameters of the backend server at dial time.
+func (bs *backendServer) newH2Transport() *http.Transport {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return bs.dialer.DialContext(ctx, "tcp", bs.address)
+		},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := bs.dialer.DialContext(ctx, "tcp", bs.address)
+			if err != nil {
+				return nil, err
+			}
+			c := bs.tlsClientConfig()
+			c.NextProtos = []string{http2ALPNProto}
+			tlsConn := tls.Client(conn, c)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				if errors.Is(err, errBackendServerTLSPinMismatch) {
+					atomic.StoreInt64(&bs.tlsPinFailTime, time.Now().UnixNano())
+				}
+				tlsConn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		Protocols:         protocols,
+		ForceAttemptHTTP2: true,
+	}
+}
+
+// H2ConnAcquire returns a connection which a request is written into as HTTP/1.1, like connections of ConnAcquire. The
+// request is sent to the backend server over HTTP/2 by the connections of the HTTP/2 transport, which multiplex
+// requests of all clients, so PROXY protocol isn't sent. The response is read back with chunked body and trailers, and
+// "Connection: close" header, so the connection isn't reused.
+func (bs *backendServer) H2ConnAcquire(ctx context.Context) (bc *bufConn, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	atomic.AddInt64(&bs.activeConnCount, 1)
+	atomic.AddInt64(&bs.totalConnCount, 1)
+	srvConn, cliConn := net.Pipe()
+	go bs.serveH2Bridge(srvConn)
+	bc = newBufConn(cliConn)
+	return
+}
+
+// serveH2Bridge reads a request from conn, sends it to the backend server over HTTP/2, and writes its response into conn.
+// The request body and the response body are relayed concurrently, so streaming RPCs aren't blocked. A failed request
+// is answered with 502, which gRPC clients take as UNAVAILABLE.
+func (bs *backendServer) serveH2Bridge(conn net.Conn) {
+	defer conn.Close()
+	ctx, ctxCancel := context.WithCancel(bs.ctx)
+	defer ctxCancel()
+	req, err := http.ReadRequest(bufio.NewReaderSize(conn, bufConnBufferSize))
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.RequestURI = ""
+	req.URL = &url.URL{
+		Scheme:   bs.serverURL.Scheme,
+		Host:     bs.address,
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	for _, name := range append(req.Header.Values("Connection"), "Connection", "Keep-Alive", "Proxy-Connection", "Upgrade") {
+		req.Header.Del(name)
+	}
+	req.Header.Set("Te", "trailers")
+	req.Close = false
+	resp, err := bs.h2Transport.RoundTrip(req)
+	bw := bufio.NewWriterSize(conn, bufConnBufferSize)
+	if err != nil {
+		xlog.V(100).Debugf("h2 request error on backend server %q: %v", bs.server, err)
+		bw.WriteString(httpBadGateway)
+		bw.Flush()
+		return
+	}
+	defer resp.Body.Close()
+	hdr := resp.Header.Clone()
+	for _, name := range append(hdr.Values("Connection"), "Connection", "Keep-Alive", "Content-Length", "Transfer-Encoding") {
+		hdr.Del(name)
+	}
+	hdr.Set("Connection", "close")
+	bodiless := req.Method == "HEAD" || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+	if !bodiless {
+		hdr.Set("Transfer-Encoding", "chunked")
+	}
+	fmt.Fprintf(bw, "HTTP/1.1 %s\r\n", resp.Status)
+	hdr.Write(bw)
+	bw.WriteString("\r\n")
+	if err = bw.Flush(); err != nil || bodiless {
+		return
+	}
+	cw := httputil.NewChunkedWriter(bw)
+	buf := make([]byte, bufConnBufferSize)
+	for {
+		n, e := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err = cw.Write(buf[:n]); err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			xlog.V(100).Debugf("h2 response body error on backend server %q: %v", bs.server, e)
+			return
+		}
+	}
+	cw.Close()
+	resp.Trailer.Write(bw)
+	bw.WriteString("\r\n")
+	bw.Flush()
+}
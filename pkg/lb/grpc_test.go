@@ -0,0 +1,150 @@
+package lb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPFrontendGRPC(t *testing.T) {
+	// the backend server speaks h2c only for gRPC, and echoes every line of the request stream immediately
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			fmt.Fprintf(w, "%s %s", r.Proto, r.Method)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("X-Te", r.Header.Get("Te"))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			fmt.Fprintf(w, "echo %s\n", sc.Text())
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "grpc",
+		Servers: []string{srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+	defer b.Close()
+	tlsSrv := httptest.NewUnstartedServer(handler)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	tlsB, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "grpc-tls",
+		Servers: []string{tlsSrv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsB.Activate()
+	defer tlsB.Close()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "grpc",
+		H2C:            true,
+		DefaultBackend: b,
+		Routes: []HTTPFrontendRoute{
+			{Path: "/echo.Echo/*", Backend: b, GRPC: true},
+			{Path: "/tls.Echo/*", Backend: tlsB, GRPC: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	defer client.CloseIdleConnections()
+	url := "http://" + fLis.Addr().String()
+
+	// the messages of the bidirectional stream are relayed one by one, and trailers are kept
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", url+"/echo.Echo/Stream", pr)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Te") != "trailers" {
+		t.Errorf("got %d %v, want 200 with te trailers to backend", resp.StatusCode, resp.Header)
+	}
+	rd := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(pw, "message%d\n", i)
+		done := make(chan string, 1)
+		go func() {
+			line, _ := rd.ReadString('\n')
+			done <- line
+		}()
+		select {
+		case line := <-done:
+			if want := fmt.Sprintf("echo message%d\n", i); line != want {
+				t.Errorf("got %q, want %q", line, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %d hasn't been relayed before the end of the stream", i)
+		}
+	}
+	pw.Close()
+	if rest, _ := ioutil.ReadAll(rd); len(rest) != 0 {
+		t.Errorf("got %q after the stream, want nothing", rest)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "done" {
+		t.Errorf("got trailers %v, want grpc-status and grpc-message", resp.Trailer)
+	}
+
+	// https backend servers are requested by h2
+	req, _ = http.NewRequest("POST", url+"/tls.Echo/Unary", strings.NewReader("hello\n"))
+	if resp, err := client.Do(req); err != nil {
+		t.Error(err)
+	} else {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "echo hello\n" || resp.Trailer.Get("Grpc-Status") != "0" {
+			t.Errorf("got %q %v from https backend server, want echo with trailers", body, resp.Trailer)
+		}
+	}
+
+	// other routes are sent to backend servers over HTTP/1.1
+	if resp, err := client.Get(url + "/other"); err != nil {
+		t.Error(err)
+	} else {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "HTTP/1.1 GET" {
+			t.Errorf("got %q for other route, want HTTP/1.1 request", body)
+		}
+	}
+
+	// HTTP/1.1 clients of gRPC routes are answered with the trailers in the chunked body
+	resp, body := doTestRequestOnce(t, fLis, "POST /echo.Echo/Unary HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello\n\r\n0\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || body != "echo hello\n" || resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("got %d %q %v for HTTP/1.1 request, want echo with trailers", resp.StatusCode, body, resp.Trailer)
+	}
+}
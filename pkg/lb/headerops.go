@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HTTPFrontendHeaderOpKind is type of operations on request headers toward backends and response headers toward clients
+type HTTPFrontendHeaderOpKind int
+
+const (
+	// HTTPFrontendHeaderOpAdd defines add operation, which appends the value to the values of the header
+	HTTPFrontendHeaderOpAdd = HTTPFrontendHeaderOpKind(iota)
+
+	// HTTPFrontendHeaderOpSet defines set operation, which replaces all values of the header by the value
+	HTTPFrontendHeaderOpSet
+
+	// HTTPFrontendHeaderOpRemove defines remove operation, which removes all values of the header
+	HTTPFrontendHeaderOpRemove
+)
+
+// HTTPFrontendHeaderOp defines an operation on request or response headers of a route. $host, $path and $remote_ip in
+// Value are substituted with the host, the path and query of the request URI and the peer IP.
+type HTTPFrontendHeaderOp struct {
+	Op    HTTPFrontendHeaderOpKind
+	Name  string
+	Value string
+}
+
+// httpRequestHeaderOpForbiddenNames are the request headers which can't be changed by header operations, because they
+// frame the request or they are set by other route options
+var httpRequestHeaderOpForbiddenNames = map[string]struct{}{
+	"Host":              {},
+	"Content-Length":    {},
+	"Transfer-Encoding": {},
+	"Connection":        {},
+}
+
+// httpResponseHeaderOpForbiddenNames are the response headers which can't be changed by header operations, because
+// they frame the response
+var httpResponseHeaderOpForbiddenNames = map[string]struct{}{
+	"Content-Length":    {},
+	"Transfer-Encoding": {},
+	"Connection":        {},
+}
+
+// httpHeaderOp is the validated form of HTTPFrontendHeaderOp by canonical header name
+type httpHeaderOp struct {
+	op    HTTPFrontendHeaderOpKind
+	name  string
+	value string
+}
+
+func newHTTPHeaderOps(ops []HTTPFrontendHeaderOp, forbiddenNames map[string]struct{}) (hops []httpHeaderOp, err error) {
+	hops = make([]httpHeaderOp, 0, len(ops))
+	for _, op := range ops {
+		if op.Name == "" || strings.IndexFunc(op.Name, isNotToken) >= 0 {
+			return nil, fmt.Errorf("header name %q invalid", op.Name)
+		}
+		name := http.CanonicalHeaderKey(op.Name)
+		if _, ok := forbiddenNames[name]; ok {
+			return nil, fmt.Errorf("header %q can't be changed", name)
+		}
+		switch op.Op {
+		case HTTPFrontendHeaderOpAdd, HTTPFrontendHeaderOpSet:
+			// substituted values don't contain CR and LF, because they are parts of the parsed request header
+			if strings.ContainsAny(op.Value, "\r\n\x00") {
+				return nil, fmt.Errorf("header %q value %q invalid", name, op.Value)
+			}
+		case HTTPFrontendHeaderOpRemove:
+			if op.Value != "" {
+				return nil, fmt.Errorf("header %q remove operation with value", name)
+			}
+		default:
+			return nil, fmt.Errorf("header %q operation %d unknown", name, op.Op)
+		}
+		hops = append(hops, httpHeaderOp{op: op.Op, name: name, value: op.Value})
+	}
+	return hops, nil
+}
+
+// applyHTTPHeaderOps applies the header operations of the request to hdr in order
+func applyHTTPHeaderOps(reqDesc *httpReqDesc, hdr http.Header, hops []httpHeaderOp) {
+	var replacer *strings.Replacer
+	for _, hop := range hops {
+		value := hop.value
+		if strings.IndexByte(value, '$') >= 0 {
+			if replacer == nil {
+				path := reqDesc.feStatusURI
+				if !strings.HasPrefix(path, "/") {
+					path = reqDesc.feURL.RequestURI()
+				}
+				replacer = strings.NewReplacer("$host", reqDesc.feURL.Host, "$path", path, "$remote_ip", reqDesc.feRemoteIP)
+			}
+			value = replacer.Replace(value)
+		}
+		switch hop.op {
+		case HTTPFrontendHeaderOpAdd:
+			hdr[hop.name] = append(hdr[hop.name], value)
+		case HTTPFrontendHeaderOpSet:
+			hdr[hop.name] = []string{value}
+		case HTTPFrontendHeaderOpRemove:
+			delete(hdr, hop.name)
+		}
+	}
+}
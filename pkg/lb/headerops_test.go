@@ -0,0 +1,187 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPFrontendRequestHeaders(t *testing.T) {
+	names := []string{"X-Env", "X-Debug-Token", "X-Tag", "X-Origin"}
+	b, closer := newTestHTTPBackend(t, "requestheaders", func(w http.ResponseWriter, r *http.Request) {
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, strings.Join(r.Header[name], ","))
+		}
+		w.Write([]byte(strings.Join(values, "|")))
+	})
+	defer closer()
+
+	route := HTTPFrontendRoute{Path: "/api/*", Backend: b, RequestHeaders: []HTTPFrontendHeaderOp{
+		{Op: HTTPFrontendHeaderOpSet, Name: "x-env", Value: "production"},
+		{Op: HTTPFrontendHeaderOpRemove, Name: "X-Debug-Token"},
+		{Op: HTTPFrontendHeaderOpAdd, Name: "X-Tag", Value: "simult"},
+		{Op: HTTPFrontendHeaderOpSet, Name: "X-Origin", Value: "$remote_ip $host$path"},
+	}}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "requestheaders",
+		DefaultBackend: b,
+		Routes:         []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/api/x?a=b", "production||a,b,simult|127.0.0.1 example.com/api/x?a=b"},
+		// the operations of the route aren't applied to the other requests
+		{"/other", "staging|t1,t2|a,b|"},
+	} {
+		_, body := doTestRequestOnce(t, fLis, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n"+
+			"X-Env: staging\r\nX-Debug-Token: t1\r\nX-Tag: a\r\nX-Debug-Token: t2\r\nX-Tag: b\r\n\r\n")
+		if body != tc.want {
+			t.Errorf("%s: backend got headers %q, want %q", tc.path, body, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		op   HTTPFrontendHeaderOp
+	}{
+		{"CRLF injection", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpSet, Name: "X-Env", Value: "a\r\nX-Admin: 1"}},
+		{"invalid name", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpAdd, Name: "X Env", Value: "a"}},
+		{"framing header", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpRemove, Name: "content-length"}},
+		{"remove with value", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpRemove, Name: "X-Env", Value: "a"}},
+		{"unknown operation", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpKind(-1), Name: "X-Env"}},
+	} {
+		badRoute := route
+		badRoute.RequestHeaders = []HTTPFrontendHeaderOp{tc.op}
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "requestheaders", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestHTTPFrontendResponseHeaders(t *testing.T) {
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			switch req.URL.Path {
+			case "/chunked":
+				conn.Write([]byte("HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\nServer: backend\r\n\r\n"))
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nServer: backend\r\nX-Powered-By: php\r\nX-Frame-Options: SAMEORIGIN\r\n" +
+					"Connection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n"))
+			case "/empty":
+				conn.Write([]byte("HTTP/1.1 204 No Content\r\nServer: backend\r\nConnection: keep-alive\r\n\r\n"))
+			case "/notmodified":
+				conn.Write([]byte("HTTP/1.1 304 Not Modified\r\nServer: backend\r\nETag: \"v1\"\r\nContent-Length: 5\r\nConnection: keep-alive\r\n\r\n"))
+			}
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "responseheaders",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	route := HTTPFrontendRoute{Backend: b, ResponseHeaders: []HTTPFrontendHeaderOp{
+		{Op: HTTPFrontendHeaderOpSet, Name: "Strict-Transport-Security", Value: "max-age=31536000"},
+		{Op: HTTPFrontendHeaderOpAdd, Name: "X-Frame-Options", Value: "DENY"},
+		{Op: HTTPFrontendHeaderOpRemove, Name: "server"},
+		{Op: HTTPFrontendHeaderOpRemove, Name: "X-Powered-By"},
+	}}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "responseheaders",
+		MaxKeepAliveReqs: -1,
+		Routes:           []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	check := func(resp *http.Response, code int, frameOptions string) {
+		if resp.StatusCode != code {
+			t.Fatalf("got %d, want %d", resp.StatusCode, code)
+		}
+		if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=31536000" {
+			t.Errorf("%d: got Strict-Transport-Security %q", code, got)
+		}
+		if got := strings.Join(resp.Header["X-Frame-Options"], ","); got != frameOptions {
+			t.Errorf("%d: got X-Frame-Options %q, want %q", code, got, frameOptions)
+		}
+		if resp.Header.Get("Server") != "" || resp.Header.Get("X-Powered-By") != "" {
+			t.Errorf("%d: got removed headers %v", code, resp.Header)
+		}
+	}
+	// the connection is kept alive after each response, so the framing of the responses isn't broken
+	for i := 0; i < 2; i++ {
+		resp := doTestRequest(t, conn, rd, "GET /chunked HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		check(resp, 103, "DENY")
+		if resp.Header.Get("Link") == "" {
+			t.Errorf("got interim headers %v, want Link header", resp.Header)
+		}
+		resp, err = http.ReadResponse(rd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(resp, http.StatusOK, "SAMEORIGIN,DENY")
+		body, _ := ioutil.ReadAll(resp.Body)
+		if len(resp.TransferEncoding) == 0 || string(body) != "hello" {
+			t.Errorf("got %v %q, want chunked %q", resp.TransferEncoding, body, "hello")
+		}
+
+		resp = doTestRequest(t, conn, rd, "GET /empty HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		check(resp, http.StatusNoContent, "DENY")
+
+		resp = doTestRequest(t, conn, rd, "GET /notmodified HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		check(resp, http.StatusNotModified, "DENY")
+		if resp.Header.Get("ETag") != `"v1"` {
+			t.Errorf("got ETag %q", resp.Header.Get("ETag"))
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		op   HTTPFrontendHeaderOp
+	}{
+		{"CRLF injection", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpAdd, Name: "X-Frame-Options", Value: "DENY\r\nSet-Cookie: a=b"}},
+		{"framing header", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpSet, Name: "Transfer-Encoding", Value: "identity"}},
+		{"connection header", HTTPFrontendHeaderOp{Op: HTTPFrontendHeaderOpRemove, Name: "Connection"}},
+	} {
+		badRoute := route
+		badRoute.ResponseHeaders = []HTTPFrontendHeaderOp{tc.op}
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "responseheaders", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
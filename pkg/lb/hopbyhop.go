@@ -0,0 +1,117 @@
+package lb
+
+import (
+	"net/http"
+	"strings"
+)
+
+// httpHopByHopHeaders are the headers which are meaningful only for a single connection as RFC 7230 section 6.1, so
+// they aren't forwarded. Upgrade is forwarded only for websocket passthrough.
+var httpHopByHopHeaders = []string{
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// httpFramingHeaders are the headers which frame messages, they aren't removed even if they are named in Connection
+// header, because the messages are framed by them on both sides
+var httpFramingHeaders = map[string]struct{}{
+	"Host":              {},
+	"Content-Length":    {},
+	"Transfer-Encoding": {},
+}
+
+// hasConnectionOption reports whether the Connection header has the option, case-insensitively
+func hasConnectionOption(hdr http.Header, option string) bool {
+	for _, value := range hdr["Connection"] {
+		for _, o := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(o), option) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isHopByHopOrFramingHeader reports whether the canonical header name is a framing or hop-by-hop header, including
+// Connection
+func isHopByHopOrFramingHeader(name string) bool {
+	if _, ok := httpFramingHeaders[name]; ok || name == "Connection" {
+		return true
+	}
+	for _, n := range httpHopByHopHeaders {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isWebSocketUpgrade reports whether the header requests, or the response accepts, upgrade to websocket
+func isWebSocketUpgrade(hdr http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(hdr.Get("Upgrade")), "websocket") && hasConnectionOption(hdr, "upgrade")
+}
+
+// stripHopByHopHeaders returns the header without the hop-by-hop headers and the headers named in its Connection
+// header. Only close, keep-alive and, if upgrade is true, upgrade options are kept in the Connection header, and Upgrade
+// header is kept if upgrade is true. It returns hdr itself if it doesn't have any of them, otherwise a changed clone.
+func stripHopByHopHeaders(hdr http.Header, upgrade bool) http.Header {
+	var names []string
+	var options []string
+	changed := false
+	for _, value := range hdr["Connection"] {
+		for _, option := range strings.Split(value, ",") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				changed = true
+				continue
+			}
+			switch strings.ToLower(option) {
+			case "close", "keep-alive":
+				options = append(options, option)
+				continue
+			case "upgrade":
+				if upgrade {
+					options = append(options, option)
+					continue
+				}
+			}
+			changed = true
+			if name := http.CanonicalHeaderKey(option); name != "Connection" {
+				if _, ok := httpFramingHeaders[name]; !ok {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	if len(hdr["Connection"]) > 1 {
+		changed = true
+	}
+	for _, name := range httpHopByHopHeaders {
+		if _, ok := hdr[name]; ok && !(upgrade && name == "Upgrade") {
+			changed = true
+			names = append(names, name)
+		}
+	}
+	if !changed {
+		return hdr
+	}
+
+	hdr = hdr.Clone()
+	for _, name := range names {
+		if upgrade && name == "Upgrade" {
+			continue
+		}
+		delete(hdr, name)
+	}
+	if len(options) > 0 {
+		hdr["Connection"] = []string{strings.Join(options, ", ")}
+	} else {
+		delete(hdr, "Connection")
+	}
+	return hdr
+}
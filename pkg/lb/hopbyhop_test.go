@@ -0,0 +1,160 @@
+package lb
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripHopByHopHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		hdr     http.Header
+		upgrade bool
+		want    http.Header
+	}{
+		{http.Header{"Connection": {"close"}, "X-Tag": {"a"}}, false, http.Header{"Connection": {"close"}, "X-Tag": {"a"}}},
+		{http.Header{"Connection": {"Keep-Alive"}, "Keep-Alive": {"timeout=5"}}, false, http.Header{"Connection": {"Keep-Alive"}}},
+		{http.Header{"Connection": {"keep-alive, x-secret", "X-Other"}, "X-Secret": {"a"}, "X-Other": {"b"}, "X-Tag": {"c"}},
+			false, http.Header{"Connection": {"keep-alive"}, "X-Tag": {"c"}}},
+		{http.Header{"Te": {"trailers"}, "Trailer": {"Expires"}, "Proxy-Authorization": {"Basic eDp5"}, "X-Tag": {"a"}},
+			false, http.Header{"X-Tag": {"a"}}},
+		{http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, false, http.Header{}},
+		{http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, true, http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}},
+		// framing headers named in Connection header aren't removed
+		{http.Header{"Connection": {"Content-Length, Transfer-Encoding, Host"}, "Content-Length": {"2"}},
+			false, http.Header{"Content-Length": {"2"}}},
+	} {
+		if got := stripHopByHopHeaders(tc.hdr, tc.upgrade); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v %v: got %v, want %v", tc.hdr, tc.upgrade, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPFrontendHopByHopHeaders(t *testing.T) {
+	names := []string{"Connection", "Keep-Alive", "Te", "Upgrade", "Proxy-Authorization", "X-Secret", "X-Real-Ip"}
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			if req.Header.Get("Upgrade") == "websocket" {
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello"))
+				return
+			}
+			values := make([]string, 0, len(names))
+			for _, name := range names {
+				values = append(values, strings.Join(req.Header[name], ","))
+			}
+			body := strings.Join(values, "|")
+			connection := "keep-alive"
+			if req.Close {
+				connection = "close"
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: " + connection + ", X-Internal\r\nKeep-Alive: timeout=5\r\nX-Internal: 1\r\n" +
+				"Proxy-Authenticate: Basic\r\nUpgrade: h2c\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+			if req.Close {
+				return
+			}
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "hopbyhop",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	opts := HTTPFrontendOptions{
+		Name:             "hopbyhop",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+	}
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		name       string
+		headers    string
+		want       string
+		connection string
+	}{
+		{"keep-alive", "Connection: keep-alive\r\nKeep-Alive: timeout=100\r\n", "keep-alive||||||127.0.0.1", "keep-alive"},
+		{"custom headers", "Connection: keep-alive, X-Secret, X-Real-IP\r\nX-Secret: a\r\nX-Real-IP: 192.0.2.1\r\nTE: trailers\r\n" +
+			"Proxy-Authorization: Basic eDp5\r\n", "keep-alive||||||127.0.0.1", "keep-alive"},
+		{"upgrade without passthrough", "Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n", "keep-alive||||||127.0.0.1", "keep-alive"},
+		{"close", "Connection: close, X-Secret\r\nX-Secret: a\r\n", "close||||||127.0.0.1", "close"},
+	} {
+		resp := doTestRequest(t, conn, rd, "GET / HTTP/1.1\r\nHost: example.com\r\n"+tc.headers+"\r\n")
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != tc.want {
+			t.Errorf("%s: backend got headers %q, want %q", tc.name, body, tc.want)
+		}
+		// Connection: close is removed from the header of the response by the client
+		got := strings.Join(resp.Header["Connection"], ",")
+		if resp.Close {
+			got = "close"
+		}
+		if got != tc.connection {
+			t.Errorf("%s: got Connection %q, want %q", tc.name, got, tc.connection)
+		}
+		for _, name := range []string{"Keep-Alive", "X-Internal", "Proxy-Authenticate", "Upgrade"} {
+			if resp.Header.Get(name) != "" {
+				t.Errorf("%s: got hop-by-hop response header %s", tc.name, name)
+			}
+		}
+	}
+	if _, err := rd.ReadByte(); err != io.EOF {
+		t.Errorf("got %v after Connection: close, want EOF", err)
+	}
+
+	passthrough := opts
+	passthrough.WebSocketPassthrough = true
+	fw, err := f.Fork(passthrough)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	fwLis := runTestFrontend(t, fw)
+	defer fwLis.Close()
+	wsConn, err := net.Dial("tcp", fwLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsConn.Close()
+	wsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	wsRd := bufio.NewReader(wsConn)
+	resp := doTestRequest(t, wsConn, wsRd, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, X-Secret\r\n"+
+		"Upgrade: websocket\r\nX-Secret: a\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" || resp.Header.Get("Connection") != "Upgrade" {
+		t.Fatalf("got %d %v, want websocket upgrade", resp.StatusCode, resp.Header)
+	}
+	if data, _ := ioutil.ReadAll(wsRd); string(data) != "hello" {
+		t.Errorf("got %q through websocket, want %q", data, "hello")
+	}
+}
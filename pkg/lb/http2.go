@@ -0,0 +1,334 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goinsane/xlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simult/simult/pkg/sockopt"
+)
+
+// http2ALPNProto is the ALPN protocol of HTTP/2 over tls
+const http2ALPNProto = "h2"
+
+// http2ClientPreface is the connection preface which HTTP/2 clients start with
+const http2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// http2StreamConn is the in-memory connection of an h2 stream, it has the addresses of the client connection
+type http2StreamConn struct {
+	net.Conn
+	localAddr, remoteAddr net.Addr
+}
+
+func (c *http2StreamConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *http2StreamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// http2PrefaceConn is the h2c client connection, it is read by the reader which the connection preface has been
+// peeked from
+type http2PrefaceConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *http2PrefaceConn) Read(b []byte) (n int, err error) {
+	return c.r.Read(b)
+}
+
+func (c *http2PrefaceConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// http2ConnListener is a net.Listener which accepts only its connection
+type http2ConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *http2ConnListener) Accept() (conn net.Conn, err error) {
+	err = io.EOF
+	l.once.Do(func() {
+		conn, err = l.conn, nil
+	})
+	return
+}
+
+func (l *http2ConnListener) Close() error {
+	return nil
+}
+
+func (l *http2ConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// serveHTTP2 serves the h2 connection by the HTTP/2 server of net/http, or the h2c connection with prior knowledge if
+// tlsState is nil. Every stream is written as an HTTP/1.1 request
+// into an in-memory connection, which is served like a request of HTTP/1.1 connections, and its response is read back
+// into the stream. So the requests of streams are sent to backend servers on their HTTP/1.1 connections, one by one,
+// and they are counted by the same metrics. The timeouts of the frontend apply to every stream, flow control of h2
+// blocks the reads and writes of them. Idle connections are closed after the keep-alive timeout.
+func (f *HTTPFrontend) serveHTTP2(ctx context.Context, l *Listener, conn net.Conn, proxyAddr net.Addr, tlsState *tls.ConnectionState) {
+	opts := f.options()
+	remoteAddr := conn.RemoteAddr()
+	if proxyAddr != nil {
+		remoteAddr = proxyAddr
+	}
+	rawConn := conn
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		rawConn = c.NetConn()
+	}
+	if tcpConn, ok := rawConn.(*net.TCPConn); ok && opts.DSCP != 0 {
+		if err := sockopt.SetDSCP(tcpConn, opts.DSCP); err != nil {
+			xlog.V(100).Debugf("dscp error for client %q on listener %q on frontend %q: %v", remoteAddr.String(), l.opts.Name, opts.Name, err)
+		}
+	}
+	xlog.V(200).Debugf("connected h2 client %q to listener %q on frontend %q", remoteAddr.String(), l.opts.Name, opts.Name)
+	defer xlog.V(200).Debugf("disconnected h2 client %q from listener %q on frontend %q", remoteAddr.String(), l.opts.Name, opts.Name)
+
+	promLabels := prometheus.Labels{
+		"listener": l.opts.Name,
+	}
+	f.promConnectionsTotal.With(promLabels).Inc()
+	if opts.MaxConn > 0 && f.totalConnCount >= int64(opts.MaxConn) {
+		err := errHTTPFrontendExhausted
+		xlog.V(100).Debugf("serve error on h2 client %q to listener %q on frontend %q: %v", remoteAddr.String(), l.opts.Name, opts.Name, err)
+		e := err.(*httpError)
+		f.promRequestsTotal.With(prometheus.Labels{
+			"host":     "",
+			"path":     "",
+			"method":   "",
+			"backend":  "",
+			"server":   "",
+			"code":     "",
+			"listener": l.opts.Name,
+			"error":    e.Group,
+			"class":    httpErrorClass(e.Group),
+		}).Inc()
+		conn.Close()
+		return
+	}
+	atomic.AddInt64(&f.totalConnCount, 1)
+	defer atomic.AddInt64(&f.totalConnCount, -1)
+
+	connDesc := f.newConnReqDesc(ctx, l, remoteAddr, tlsState)
+	var reqIdx int64 = -1
+	closed := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqDesc := new(httpReqDesc)
+			*reqDesc = connDesc
+			reqDesc.reqIdx = int(atomic.AddInt64(&reqIdx, 1))
+			f.serveHTTP2Stream(w, r, reqDesc, conn.LocalAddr(), remoteAddr, promLabels)
+		}),
+		IdleTimeout: opts.KeepAliveTimeout,
+		ErrorLog:    log.New(ioutil.Discard, "", 0),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				close(closed)
+			}
+		},
+	}
+	if tlsState == nil {
+		// HTTP/1.1 requests aren't served by net/http, the connection has the preface
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	srv.Serve(&http2ConnListener{conn: conn})
+
+	// the connection is closed gracefully by GOAWAY when the frontend drains, and forcibly after the drain timeout
+	tkr := time.NewTicker(100 * time.Millisecond)
+	defer tkr.Stop()
+	shutdown := false
+	for done := false; !done; {
+		select {
+		case <-closed:
+			done = true
+		case <-tkr.C:
+			if !shutdown && (f.IsDraining() || ctx.Err() != nil) {
+				shutdown = true
+				go srv.Shutdown(context.Background())
+			}
+		case <-f.drainCtx.Done():
+			xlog.V(200).Debugf("drain timeout exceeded for h2 client %q on listener %q on frontend %q", remoteAddr.String(), l.opts.Name, opts.Name)
+			f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "forced"}).Inc()
+			srv.Close()
+			<-closed
+			return
+		}
+	}
+	if shutdown && f.IsDraining() {
+		f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "voluntary"}).Inc()
+	}
+}
+
+// serveHTTP2Stream serves the request of an h2 stream like a request of HTTP/1.1 connections
+func (f *HTTPFrontend) serveHTTP2Stream(w http.ResponseWriter, r *http.Request, reqDesc *httpReqDesc, localAddr, remoteAddr net.Addr, promLabels prometheus.Labels) {
+	opts := f.options()
+	if r.Method == "CONNECT" {
+		// tunnels aren't supported on h2 streams
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	atomic.AddInt64(&f.activeConnCount, 1)
+	f.promActiveConnections.With(promLabels).Inc()
+	defer func() {
+		atomic.AddInt64(&f.activeConnCount, -1)
+		f.promActiveConnections.With(promLabels).Dec()
+	}()
+
+	srvConn, cliConn := net.Pipe()
+	defer cliConn.Close()
+	feConn := newBufConn(&http2StreamConn{Conn: srvConn, localAddr: localAddr, remoteAddr: remoteAddr})
+	reqDesc.feConn = feConn
+	if opts.RequestTimeout > 0 {
+		reqDesc.feReqDeadline = time.Now().Add(opts.RequestTimeout)
+		feConn.SetReadDeadline(reqDesc.feReqDeadline)
+	}
+	reqDesc.feClose = true
+	reqDesc.feDrain = f.IsDraining()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		f.serve(reqDesc.feConnCtx, reqDesc)
+		feConn.Flush()
+		feConn.Close()
+	}()
+	// the stream is aborted when the client resets it
+	go func() {
+		select {
+		case <-r.Context().Done():
+			cliConn.Close()
+		case <-served:
+		}
+	}()
+	go writeHTTP2Request(cliConn, r)
+
+	rd := bufio.NewReader(cliConn)
+	resp, err := http.ReadResponse(rd, r)
+	for err == nil && resp.StatusCode >= 100 && resp.StatusCode <= 199 {
+		// interim responses aren't relayed
+		resp, err = http.ReadResponse(rd, r)
+	}
+	if err != nil {
+		cliConn.Close()
+		<-served
+		panic(http.ErrAbortHandler)
+	}
+	defer resp.Body.Close()
+	hdr := w.Header()
+	for _, name := range resp.Header.Values("Connection") {
+		for _, token := range strings.Split(name, ",") {
+			resp.Header.Del(strings.TrimSpace(token))
+		}
+	}
+	for name, values := range resp.Header {
+		switch name {
+		case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "X-Drain":
+			continue
+		}
+		hdr[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	// the header is sent before the body, streaming responses may not have a body for long
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	buf := make([]byte, bufConnBufferSize)
+	for {
+		n, e := resp.Body.Read(buf)
+		if n > 0 {
+			if _, e := w.Write(buf[:n]); e != nil {
+				break
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if e != nil {
+			if e != io.EOF {
+				cliConn.Close()
+				<-served
+				panic(http.ErrAbortHandler)
+			}
+			break
+		}
+	}
+	// trailers are sent even if they haven't been declared, eg grpc-status of gRPC responses
+	for name, values := range resp.Trailer {
+		hdr[http.TrailerPrefix+name] = values
+	}
+	cliConn.Close()
+	<-served
+}
+
+// writeHTTP2Request writes the request of an h2 stream as an HTTP/1.1 request. The body is written by its length, or
+// chunked if the length is unknown.
+func writeHTTP2Request(w io.WriteCloser, r *http.Request) {
+	bw := bufio.NewWriterSize(w, bufConnBufferSize)
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, uri, r.Host)
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		switch name {
+		case "Host", "Connection", "Content-Length", "Transfer-Encoding", "Expect":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			fmt.Fprintf(bw, "%s: %s\r\n", name, value)
+		}
+	}
+	chunked := false
+	switch {
+	case r.ContentLength > 0 || (r.ContentLength == 0 && r.Header.Get("Content-Length") != ""):
+		fmt.Fprintf(bw, "Content-Length: %s\r\n", strconv.FormatInt(r.ContentLength, 10))
+	case r.ContentLength < 0:
+		chunked = true
+		bw.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil || r.ContentLength == 0 {
+		return
+	}
+	var body io.Writer = w
+	var cw io.WriteCloser
+	if chunked {
+		cw = httputil.NewChunkedWriter(w)
+		body = cw
+	}
+	if _, err := io.Copy(body, r.Body); err != nil {
+		w.Close()
+		return
+	}
+	if cw != nil {
+		cw.Close()
+		io.WriteString(w, "\r\n")
+	}
+}
@@ -0,0 +1,244 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendHTTP2(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "http2", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		case "/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(w, "event %d\n", i)
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		// backend servers are always requested by HTTP/1.1
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Proto, r.Method, r.Host, r.Header.Get("X-Tag"), body)
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "http2",
+		MaxKeepAliveReqs: -1,
+		Timeout:          200 * time.Millisecond,
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	fLis := runTestListener(t, ListenerOptions{
+		Fe:        f,
+		TLSConfig: &tls.Config{Certificates: certSrv.TLS.Certificates},
+		HTTP2:     true,
+	})
+	defer fLis.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	url := "https://" + fLis.Addr().String()
+
+	labels := prometheus.Labels{"frontend": "http2", "code": "2xx"}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", url+"/echo", strings.NewReader(fmt.Sprintf("body%d", i)))
+			req.Host = "example.com"
+			req.Header.Set("X-Tag", "tag")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if want := fmt.Sprintf("HTTP/1.1 POST example.com tag body%d", i); resp.Proto != "HTTP/2.0" || resp.StatusCode != http.StatusOK || string(body) != want {
+				t.Errorf("stream %d: got %s %d %q, want HTTP/2.0 200 %q", i, resp.Proto, resp.StatusCode, body, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 10 {
+		t.Errorf("got %v requests, want 10 h2 requests to be counted", n)
+	}
+
+	// bodies of unknown length are sent chunked, and responses are streamed
+	req, _ := http.NewRequest("PUT", url+"/echo", ioutil.NopCloser(bytes.NewReader([]byte("chunked"))))
+	req.ContentLength = -1
+	if resp, err := client.Do(req); err != nil {
+		t.Error(err)
+	} else {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.HasSuffix(string(body), " chunked") {
+			t.Errorf("got %q for chunked body, want it to be echoed", body)
+		}
+	}
+	if resp, err := client.Get(url + "/stream"); err != nil {
+		t.Error(err)
+	} else {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("Connection") != "" || string(body) != "event 0\nevent 1\nevent 2\n" {
+			t.Errorf("got %v %q for stream, want events without hop-by-hop headers", resp.Header, body)
+		}
+	}
+
+	// the timeout of the frontend applies to every stream, the stream is reset like the connection is closed on HTTP/1.1
+	if resp, err := client.Get(url + "/slow"); err == nil {
+		resp.Body.Close()
+		t.Errorf("got %d for slow stream, want stream error", resp.StatusCode)
+	}
+	if resp, err := client.Get(url + "/echo"); err != nil {
+		t.Error(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d after reset stream, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// listeners without HTTP2 don't offer h2
+	fLis1 := runTestListener(t, ListenerOptions{
+		Fe:        f,
+		TLSConfig: &tls.Config{Certificates: certSrv.TLS.Certificates},
+	})
+	defer fLis1.Close()
+	if resp, err := client.Get("https://" + fLis1.Addr().String() + "/echo"); err != nil {
+		t.Error(err)
+	} else {
+		resp.Body.Close()
+		if resp.Proto != "HTTP/1.1" || resp.StatusCode != http.StatusOK {
+			t.Errorf("got %s %d, want HTTP/1.1 200", resp.Proto, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPFrontendH2C(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "h2c", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Proto, r.Method, body)
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "h2c",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// the connection preface is rejected with a response unless h2c is enabled
+	resp, body := doTestRequestOnce(t, fLis, http2ClientPreface)
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported || body == "" {
+		t.Errorf("got %d %q for h2c preface, want %d with body", resp.StatusCode, body, http.StatusHTTPVersionNotSupported)
+	}
+
+	f.Close()
+
+	f, err = NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "h2c",
+		DefaultBackend: b,
+		H2C:            true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis = runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// h2c clients with prior knowledge are served by HTTP/2, HTTP/1.1 clients are served as usual
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	defer client.CloseIdleConnections()
+	url := "http://" + fLis.Addr().String()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post(url+"/echo", "text/plain", strings.NewReader(fmt.Sprintf("body%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := fmt.Sprintf("HTTP/1.1 POST body%d", i); resp.Proto != "HTTP/2.0" || string(body) != want {
+			t.Errorf("got %s %q, want HTTP/2.0 %q", resp.Proto, body, want)
+		}
+	}
+	for _, req := range []string{"POST /echo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody", "PUT /echo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody"} {
+		if resp, body := doTestRequestOnce(t, fLis, req); resp.StatusCode != http.StatusOK || !strings.HasSuffix(body, " body") {
+			t.Errorf("got %d %q for HTTP/1.1 request, want backend response", resp.StatusCode, body)
+		}
+	}
+}
+
+func TestHTTPFrontendH2CShutdown(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "h2cshutdown", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "h2cshutdown",
+		DefaultBackend: b,
+		H2C:            true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// idle connections, and the ones which stall in the preface, are closed on shutdown without request timeout
+	var conns []net.Conn
+	for _, data := range []string{"", http2ClientPreface[:8]} {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(data))
+		conns = append(conns, conn)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	if err := f.Shutdown(ctx); err != nil {
+		t.Errorf("got shutdown error %v, want nil", err)
+	}
+	for i, conn := range conns {
+		if data, err := ioutil.ReadAll(conn); err != nil || len(data) != 0 {
+			t.Errorf("connection %d: got %q %v after shutdown, want closed connection", i, data, err)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package lb
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -19,6 +22,7 @@ import (
 	"github.com/goinsane/xlog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/simult/simult/pkg/hc"
+	"github.com/simult/simult/pkg/sockopt"
 )
 
 // HTTPBackendMode is type of HTTP backend modes
@@ -33,6 +37,23 @@ const (
 
 	// HTTPBackendModeAffinityKey defines affinitykey backend mode
 	HTTPBackendModeAffinityKey
+
+	// HTTPBackendModeLeastBytes defines leastbytes backend mode
+	HTTPBackendModeLeastBytes
+)
+
+// HTTPBackendProxyProtocol is type of PROXY protocol versions to send on backend server connections
+type HTTPBackendProxyProtocol int
+
+const (
+	// HTTPBackendProxyProtocolNone defines that PROXY protocol isn't sent
+	HTTPBackendProxyProtocolNone = HTTPBackendProxyProtocol(iota)
+
+	// HTTPBackendProxyProtocolV1 defines PROXY protocol v1, the human-readable header
+	HTTPBackendProxyProtocolV1
+
+	// HTTPBackendProxyProtocolV2 defines PROXY protocol v2, the binary header
+	HTTPBackendProxyProtocolV2
 )
 
 // HTTPBackendAffinityKeyKind is type of affinity-key kinds to use in affinity-key backend mode
@@ -52,26 +73,50 @@ const (
 	HTTPBackendAffinityKeyKindHTTPCookie
 )
 
+// HTTPBackendCookie defines a cookie which is issued by HTTPBackend.
+// Secure attribute is set only for the requests from TLS listeners.
+type HTTPBackendCookie struct {
+	Name     string
+	Path     string
+	MaxAge   int
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+}
+
 // HTTPBackendOptions holds HTTPBackend options
 type HTTPBackendOptions struct {
-	Name                string
-	MaxConn             int
-	ServerMaxConn       int
-	ServerMaxIdleConn   int
-	Timeout             time.Duration
-	ConnectTimeout      time.Duration
-	ReqHeader           http.Header
-	ServerHashSecret    string
-	HealthCheckHTTPOpts *hc.HTTPCheckOptions
-	Mode                HTTPBackendMode
-	AffinityKey         struct {
+	Name                  string
+	MaxConn               int
+	QueueTimeout          time.Duration
+	MaxQueue              int
+	ShedStatus            int
+	ServerMaxConn         int
+	ServerMaxIdleConn     int
+	Timeout               time.Duration
+	ConnectTimeout        time.Duration
+	TCPKeepAlivePeriod    time.Duration
+	TCPNoDelay            bool
+	ResponseHeaderTimeout time.Duration
+	MaxResponseBodySize   int64
+	ReqHeader             http.Header
+	ServerHashSecret      string
+	HealthCheckHTTPOpts   *hc.HTTPCheckOptions
+	Mode                  HTTPBackendMode
+	AffinityKey           struct {
 		Kind       HTTPBackendAffinityKeyKind
 		Key        string
 		MaxServers int
 		Threshold  int
 	}
-	OverrideErrors string
-	Servers        []string
+	StickyCookie      HTTPBackendCookie
+	OverrideErrors    string
+	Servers           []string
+	DeadlineAware     bool
+	DSCP              int
+	SourceAddress     string
+	Dialer            Dialer
+	SendProxyProtocol HTTPBackendProxyProtocol
 }
 
 // CopyFrom sets the underlying HTTPBackendOptions by given HTTPBackendOptions
@@ -93,6 +138,8 @@ type HTTPBackend struct {
 	bss       map[string]*backendServer
 	bssMu     sync.RWMutex
 	connCount int64
+	slots     chan struct{}
+	queueLen  int64
 
 	workerTkr *time.Ticker
 	workerWg  sync.WaitGroup
@@ -107,10 +154,21 @@ type HTTPBackend struct {
 	promTimeToFirstByteSeconds prometheus.ObserverVec
 	promActiveConnections      *prometheus.GaugeVec
 	promIdleConnections        *prometheus.GaugeVec
+	promOutstandingBytes       *prometheus.GaugeVec
+	promStatusMappedTotal      *prometheus.CounterVec
 	promServerHealth           *prometheus.GaugeVec
+	promQueueTimeoutTotal      *prometheus.CounterVec
+	promQueueClientAbortTotal  *prometheus.CounterVec
+	promShedTotal              *prometheus.CounterVec
 
 	bssNodes   wrh.Nodes
 	bssNodesMu sync.RWMutex
+
+	stickyServers map[string]*backendServer
+
+	connStatsSrc *connStatsSource
+
+	retired uint32
 }
 
 // NewHTTPBackend creates a new HTTPBackend by given options
@@ -137,7 +195,12 @@ func (b *HTTPBackend) Fork(opts HTTPBackendOptions) (bn *HTTPBackend, err error)
 	bn.promTimeToFirstByteSeconds = promHTTPBackendTimeToFirstByteSeconds.MustCurryWith(promLabels)
 	bn.promActiveConnections = promHTTPBackendActiveConnections.MustCurryWith(promLabels)
 	bn.promIdleConnections = promHTTPBackendIdleConnections.MustCurryWith(promLabels)
+	bn.promOutstandingBytes = promHTTPBackendOutstandingBytes.MustCurryWith(promLabels)
+	bn.promStatusMappedTotal = promHTTPBackendStatusMappedTotal.MustCurryWith(promLabels)
 	bn.promServerHealth = promHTTPBackendServerHealth.MustCurryWith(promLabels)
+	bn.promQueueTimeoutTotal = promHTTPBackendQueueTimeoutTotal.MustCurryWith(promLabels)
+	bn.promQueueClientAbortTotal = promHTTPBackendQueueClientAbortTotal.MustCurryWith(promLabels)
+	bn.promShedTotal = promHTTPBackendShedTotal.MustCurryWith(promLabels)
 
 	defer func() {
 		if err == nil {
@@ -147,6 +210,39 @@ func (b *HTTPBackend) Fork(opts HTTPBackendOptions) (bn *HTTPBackend, err error)
 		bn = nil
 	}()
 
+	if name := bn.opts.StickyCookie.Name; name != "" && !isCookieNameValid(name) {
+		err = fmt.Errorf("sticky cookie name %q invalid", name)
+		return
+	}
+
+	if bn.opts.MaxConn > 0 {
+		bn.slots = make(chan struct{}, bn.opts.MaxConn)
+	}
+	switch bn.opts.ShedStatus {
+	case 0:
+		bn.opts.ShedStatus = http.StatusServiceUnavailable
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+	default:
+		err = fmt.Errorf("shed status %d must be 503 or 429", bn.opts.ShedStatus)
+		return
+	}
+
+	if err = sockopt.CheckDSCP(bn.opts.DSCP); err != nil {
+		return
+	}
+	if bn.opts.HealthCheckHTTPOpts != nil {
+		if err = sockopt.CheckDSCP(bn.opts.HealthCheckHTTPOpts.DSCP); err != nil {
+			err = fmt.Errorf("healthcheck %w", err)
+			return
+		}
+	}
+
+	if bn.opts.SourceAddress != "" && net.ParseIP(bn.opts.SourceAddress) == nil {
+		err = fmt.Errorf("source address %q invalid", bn.opts.SourceAddress)
+		return
+	}
+	dialer := newBackendDialer(&bn.opts, bn.opts.DSCP)
+
 	if b != nil {
 		b.bssMu.Lock()
 		defer b.bssMu.Unlock()
@@ -171,7 +267,7 @@ func (b *HTTPBackend) Fork(opts HTTPBackendOptions) (bn *HTTPBackend, err error)
 			return
 		}
 		bs.weight = 1.0
-		if len(values) > 1 {
+		if len(values) > 1 && !strings.Contains(values[1], "=") {
 			var x uint64
 			x, err = strconv.ParseUint(values[1], 10, 8)
 			if err != nil {
@@ -180,18 +276,95 @@ func (b *HTTPBackend) Fork(opts HTTPBackendOptions) (bn *HTTPBackend, err error)
 				return
 			}
 			bs.weight = float64(x)
+			values = values[1:]
+		}
+		var serverName, verify string
+		var pins []string
+		var drain bool
+		for _, value := range values[1:] {
+			kv := strings.SplitN(value, "=", 2)
+			if len(kv) != 2 {
+				err = fmt.Errorf("backendserver %s has wrong parameter %q", bs.server, value)
+				bs.Close()
+				return
+			}
+			switch kv[0] {
+			case "servername":
+				serverName = kv[1]
+			case "pin":
+				pin := strings.TrimPrefix(kv[1], "sha256/")
+				if x, e := base64.StdEncoding.DecodeString(pin); e != nil || len(x) != sha256.Size {
+					err = fmt.Errorf("backendserver %s has wrong pin %q", bs.server, kv[1])
+					bs.Close()
+					return
+				}
+				pins = append(pins, pin)
+			case "verify":
+				verify = kv[1]
+			case "drain":
+				drain, err = strconv.ParseBool(kv[1])
+				if err != nil {
+					err = fmt.Errorf("backendserver %s has wrong drain %q", bs.server, kv[1])
+					bs.Close()
+					return
+				}
+			default:
+				err = fmt.Errorf("backendserver %s has unknown parameter %q", bs.server, kv[0])
+				bs.Close()
+				return
+			}
+		}
+		if (serverName != "" || len(pins) > 0 || verify != "") && !bs.useTLS {
+			err = fmt.Errorf("backendserver %s has tls parameters without https", bs.server)
+			bs.Close()
+			return
+		}
+		if verify == "" {
+			verify = "none"
+			if len(pins) > 0 {
+				verify = "pin"
+			}
 		}
+		switch verify {
+		case "none", "ca":
+			if len(pins) > 0 {
+				err = fmt.Errorf("backendserver %s has pins with verify %q", bs.server, verify)
+				bs.Close()
+				return
+			}
+		case "pin", "ca+pin":
+			if len(pins) <= 0 {
+				err = fmt.Errorf("backendserver %s has verify %q without pins", bs.server, verify)
+				bs.Close()
+				return
+			}
+		default:
+			err = fmt.Errorf("backendserver %s has unknown verify %q", bs.server, verify)
+			bs.Close()
+			return
+		}
+		bs.SetTLSParams(serverName, pins, verify == "ca" || verify == "ca+pin")
+		bs.SetDialParams(dialer, bn.opts.DSCP, bn.opts.SourceAddress, bn.opts.TCPKeepAlivePeriod, bn.opts.Dialer)
 		if b != nil {
-			if bsr, ok := b.bss[bs.server]; ok {
+			// connections of the backend server are established with its dial parameters, so it isn't shared if they change
+			if bsr, ok := b.bss[bs.server]; ok && bsr.SameTLSParams(bs) && bsr.SameDialParams(bs) {
 				if !bsr.SetShared(true) {
 					bs.Close()
 					bs = bsr
 				}
 			}
 		}
+		bs.SetDraining(drain)
 		bn.bss[bs.server] = bs
 	}
 
+	if bn.opts.StickyCookie.Name != "" {
+		bn.stickyServers = make(map[string]*backendServer, len(bn.bss))
+		for _, bsr := range bn.bss {
+			bn.stickyServers[bn.serverHash(bsr.server)] = bsr
+		}
+	}
+
 	bn.updateBssNodes()
 
 	bn.workerWg.Add(1)
@@ -200,17 +373,61 @@ func (b *HTTPBackend) Fork(opts HTTPBackendOptions) (bn *HTTPBackend, err error)
 	return
 }
 
-// Close closes the HTTPBackend and its own members
+// Close closes the HTTPBackend and its own members. It stops health-checks and closes idle connections of servers
+// which aren't shared with the next HTTPBackend. Metric series of the HTTPBackend are deleted if it hasn't been
+// replaced by another one which has the same name, otherwise only series of servers which the replacement doesn't have.
 func (b *HTTPBackend) Close() {
+	atomic.StoreUint32(&b.retired, 1)
+	httpBackends.Unregister(b)
+	if b.connStatsSrc != nil {
+		connStats.Unregister("backend:"+b.opts.Name, b.connStatsSrc)
+	}
 	b.ctxCancel()
 	b.workerTkr.Stop()
 	b.workerWg.Wait()
 	b.bssMu.Lock()
+	servers := make([]string, 0, len(b.bss))
 	for _, bsr := range b.bss {
+		servers = append(servers, bsr.server)
 		bsr.Close()
 	}
 	b.bss = nil
 	b.bssMu.Unlock()
+
+	bn := LookupHTTPBackend(b.opts.Name)
+	if bn == nil {
+		promDeleteHTTPBackend(b.opts.Name, nil)
+		return
+	}
+	removedServers := make([]string, 0, len(servers))
+	bn.bssMu.RLock()
+	for _, server := range servers {
+		if _, ok := bn.bss[server]; !ok {
+			removedServers = append(removedServers, server)
+		}
+	}
+	bn.bssMu.RUnlock()
+	promDeleteHTTPBackend(b.opts.Name, removedServers)
+}
+
+// Drain waits for the requests in flight and in queue of the HTTPBackend until they are done or ctx is done.
+// It should be called before Close to keep in-flight requests when the HTTPBackend is removed.
+func (b *HTTPBackend) Drain(ctx context.Context) (err error) {
+	tkr := time.NewTicker(10 * time.Millisecond)
+	defer tkr.Stop()
+	for atomic.LoadInt64(&b.connCount) > 0 || atomic.LoadInt64(&b.queueLen) > 0 {
+		select {
+		case <-tkr.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return
+}
+
+// IsRetired reports whether the HTTPBackend has been replaced by another one which has the same name, or closed
+func (b *HTTPBackend) IsRetired() bool {
+	return atomic.LoadUint32(&b.retired) != 0
 }
 
 // GetOpts returns a copy of underlying HTTPBackend's options
@@ -219,24 +436,118 @@ func (b *HTTPBackend) GetOpts() (opts HTTPBackendOptions) {
 	return
 }
 
-// Activate activates HTTPBackend after Fork
+// HTTPBackendServerStatus describes the current status of a backend server in a HTTPBackend.
+// Counts in window belong to the last HTTPBackendStatus.WindowSeconds seconds.
+type HTTPBackendServerStatus struct {
+	Server            string           `json:"server"`
+	Healthy           bool             `json:"healthy"`
+	Draining          bool             `json:"draining"`
+	Weight            float64          `json:"weight"`
+	EffectiveWeight   float64          `json:"effective_weight"`
+	ActiveConnections int64            `json:"active_connections"`
+	IdleConnections   int64            `json:"idle_connections"`
+	RequestsTotal     int64            `json:"requests_total"`
+	RequestsInWindow  int64            `json:"requests_in_window"`
+	ErrorsTotal       map[string]int64 `json:"errors_total"`
+	ErrorsInWindow    int64            `json:"errors_in_window"`
+	ReadBytes         int64            `json:"read_bytes"`
+	WriteBytes        int64            `json:"write_bytes"`
+	LatencyP50Seconds float64          `json:"latency_p50_seconds"`
+}
+
+// HTTPBackendStatus describes the current status of a HTTPBackend
+type HTTPBackendStatus struct {
+	Name          string                    `json:"name"`
+	WindowSeconds int                       `json:"window_seconds"`
+	Servers       []HTTPBackendServerStatus `json:"servers"`
+}
+
+// Status returns the current status of the HTTPBackend and its servers ordered by server
+func (b *HTTPBackend) Status() (st HTTPBackendStatus) {
+	st.Name = b.opts.Name
+	st.WindowSeconds = windowCounterSlots
+	st.Servers = make([]HTTPBackendServerStatus, 0, len(b.opts.Servers))
+	sec := time.Now().Unix()
+	b.bssMu.RLock()
+	for _, bsr := range b.bss {
+		st.Servers = append(st.Servers, HTTPBackendServerStatus{
+			Server:            bsr.server,
+			Healthy:           bsr.Healthy(),
+			Draining:          bsr.IsDraining(),
+			Weight:            bsr.weight,
+			EffectiveWeight:   bsr.EffectiveWeight(),
+			ActiveConnections: atomic.LoadInt64(&bsr.activeConnCount),
+			IdleConnections:   atomic.LoadInt64(&bsr.idleConnCount),
+			RequestsTotal:     atomic.LoadInt64(&bsr.stats.requestsTotal),
+			RequestsInWindow:  bsr.stats.requestsWindow.Sum(sec),
+			ErrorsTotal:       bsr.stats.Errors(),
+			ErrorsInWindow:    bsr.stats.errorsWindow.Sum(sec),
+			ReadBytes:         atomic.LoadInt64(&bsr.stats.readBytes),
+			WriteBytes:        atomic.LoadInt64(&bsr.stats.writeBytes),
+			LatencyP50Seconds: bsr.stats.latency.P50().Seconds(),
+		})
+	}
+	b.bssMu.RUnlock()
+	sort.Slice(st.Servers, func(i, j int) bool { return st.Servers[i].Server < st.Servers[j].Server })
+	return
+}
+
+// Activate activates HTTPBackend after Fork, and registers it by its name in place of the previous one.
+// Health-checks of unchanged servers keep running, and the first checks of new ones are staggered over one interval.
 func (b *HTTPBackend) Activate() {
+	httpBackends.Register(b)
+	if b.connStatsSrc == nil {
+		b.connStatsSrc = connStats.Register("backend:"+b.opts.Name, b.connStatsSample)
+	}
+	if b.opts.HealthCheckHTTPOpts == nil {
+		for _, bsr := range b.bss {
+			bsr.SetHealthCheck(nil)
+		}
+		return
+	}
+	var opts hc.HTTPCheckOptions
+	opts.CopyFrom(b.opts.HealthCheckHTTPOpts)
+	if b.opts.SourceAddress != "" || b.opts.Dialer != nil {
+		opts.Dialer = newBackendDialer(&b.opts, opts.DSCP)
+	}
+	bss := make([]*backendServer, 0, len(b.bss))
 	for _, bsr := range b.bss {
-		var h hc.HealthCheck
-		if h == nil && b.opts.HealthCheckHTTPOpts != nil {
-			h = hc.NewHTTPCheck(bsr.server, *b.opts.HealthCheckHTTPOpts)
-		}
-		if h != nil {
-			go func(bsr *backendServer) {
-				<-h.Check()
-				bsr.SetHealthCheck(h)
-			}(bsr)
+		if bsr.HasHTTPCheck(&opts) {
 			continue
 		}
-		bsr.SetHealthCheck(nil)
+		bss = append(bss, bsr)
+	}
+	sort.Slice(bss, func(i, j int) bool { return bss[i].server < bss[j].server })
+	for i, bsr := range bss {
+		delay := opts.Interval * time.Duration(i) / time.Duration(len(bss))
+		bsr.StartHealthCheck(hc.NewHTTPCheckWithDelay(bsr.server, opts, delay))
 	}
 }
 
+// ConnStats returns the connection counts of the backend name sampled since given time
+func (b *HTTPBackend) ConnStats(since time.Time) (st ConnStatsStatus) {
+	st = connStats.Status("backend:"+b.opts.Name, since)
+	st.Name = b.opts.Name
+	return
+}
+
+// connStatsSample returns the connection counts of servers only if the HTTPBackend is the active one by its name,
+// because servers are shared with the next HTTPBackend while the previous one is closing.
+// Requests in queue are counted as in-flight.
+func (b *HTTPBackend) connStatsSample() (s connStatsSample) {
+	s.inflight = atomic.LoadInt64(&b.connCount) + atomic.LoadInt64(&b.queueLen)
+	if LookupHTTPBackend(b.opts.Name) != b {
+		return
+	}
+	b.bssMu.RLock()
+	for _, bsr := range b.bss {
+		s.active += atomic.LoadInt64(&bsr.activeConnCount)
+		s.idle += atomic.LoadInt64(&bsr.idleConnCount)
+	}
+	b.bssMu.RUnlock()
+	return
+}
+
 func (b *HTTPBackend) worker() {
 	for done := false; !done; {
 		select {
@@ -257,6 +568,7 @@ func (b *HTTPBackend) updateBssNodes() {
 		serverList = append(serverList, bsr.server)
 		b.promActiveConnections.With(prometheus.Labels{"server": bsr.server}).Set(float64(bsr.activeConnCount))
 		b.promIdleConnections.With(prometheus.Labels{"server": bsr.server}).Set(float64(bsr.idleConnCount))
+		b.promOutstandingBytes.With(prometheus.Labels{"server": bsr.server}).Set(float64(atomic.LoadInt64(&bsr.outstandingBytes)))
 		if !bsr.Healthy() {
 			if !bsr.IsShared() {
 				b.promServerHealth.With(prometheus.Labels{"server": bsr.server}).Set(0)
@@ -273,7 +585,7 @@ func (b *HTTPBackend) updateBssNodes() {
 	seed := uint32(0)
 	for _, server := range serverList {
 		weight := 0.0
-		if bsr, ok := healthyMap[server]; ok {
+		if bsr, ok := healthyMap[server]; ok && !bsr.IsDraining() {
 			weight = bsr.weight
 		}
 		nodes = append(nodes, wrh.Node{
@@ -289,20 +601,129 @@ func (b *HTTPBackend) updateBssNodes() {
 	b.bssNodesMu.Unlock()
 }
 
+// serverHash returns the hash of given server which is sent to clients instead of the server address
+func (b *HTTPBackend) serverHash(server string) string {
+	h := md5.New()
+	io.WriteString(h, b.opts.ServerHashSecret)
+	io.WriteString(h, server)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// findStickyServer returns the backend server in the sticky cookie of the request if it can be chosen
+func (b *HTTPBackend) findStickyServer(reqDesc *httpReqDesc) (bs *backendServer) {
+	name := b.opts.StickyCookie.Name
+	if name == "" {
+		return
+	}
+	for _, cookie := range reqDesc.feCookies {
+		if cookie != nil && cookie.Name == name {
+			bs = b.stickyServers[cookie.Value]
+			break
+		}
+	}
+	if bs == nil {
+		return
+	}
+	b.bssNodesMu.RLock()
+	defer b.bssNodesMu.RUnlock()
+	for i := range b.bssNodes {
+		node := &b.bssNodes[i]
+		if node.Data.(*backendServer) == bs && node.Weight > 0 {
+			return
+		}
+	}
+	return nil
+}
+
+// stickyCookie returns the Set-Cookie value for the backend server which serves the request.
+// It returns empty string if the client already has the cookie for the server, or the response already sets a cookie with same name.
+func (b *HTTPBackend) stickyCookie(reqDesc *httpReqDesc, respHdr http.Header) string {
+	opts := &b.opts.StickyCookie
+	if opts.Name == "" {
+		return ""
+	}
+	value := b.serverHash(reqDesc.beServer)
+	for _, cookie := range reqDesc.feCookies {
+		if cookie != nil && cookie.Name == opts.Name && cookie.Value == value {
+			return ""
+		}
+	}
+	if hasSetCookie(respHdr, opts.Name) {
+		xlog.V(100).Debugf("sticky cookie %q is already set by backend server on %s", opts.Name, reqDesc.BackendSummary())
+		return ""
+	}
+	cookie := &http.Cookie{
+		Name:     opts.Name,
+		Value:    value,
+		Path:     opts.Path,
+		MaxAge:   opts.MaxAge,
+		Secure:   opts.Secure && reqDesc.leTLS,
+		HttpOnly: opts.HTTPOnly,
+		SameSite: opts.SameSite,
+	}
+	return cookie.String()
+}
+
+// deadlineAwareNodes returns a copy of nodes with zero weights for the servers whose latency p50 exceeds budget.
+// It returns nodes itself if no server is slow, or all servers are slow.
+func deadlineAwareNodes(nodes wrh.Nodes, budget time.Duration) wrh.Nodes {
+	var result wrh.Nodes
+	fast := false
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Weight <= 0 {
+			continue
+		}
+		if node.Data.(*backendServer).stats.latency.P50() <= budget {
+			fast = true
+			continue
+		}
+		if result == nil {
+			result = make(wrh.Nodes, len(nodes))
+			copy(result, nodes)
+		}
+		result[i].Weight = 0
+	}
+	if result == nil || !fast {
+		return nodes
+	}
+	return result
+}
+
+// proxyProtocolHeader returns the PROXY protocol header which is sent at the start of the backend server connections
+// of the request, or empty if the backend doesn't send PROXY protocol. It advertises the client connection of the request.
+func (b *HTTPBackend) proxyProtocolHeader(reqDesc *httpReqDesc) string {
+	if b.opts.SendProxyProtocol == HTTPBackendProxyProtocolNone {
+		return ""
+	}
+	return string(newProxyProtocolHeader(b.opts.SendProxyProtocol == HTTPBackendProxyProtocolV2, reqDesc.feConn.RemoteAddr(), reqDesc.feConn.LocalAddr()))
+}
+
 func (b *HTTPBackend) findServer(reqDesc *httpReqDesc) (bs *backendServer) {
+	if bs = b.findStickyServer(reqDesc); bs != nil {
+		return
+	}
 	b.bssNodesMu.RLock()
+	nodes := b.bssNodes
+	if b.opts.DeadlineAware && !reqDesc.feBudgetDeadline.IsZero() {
+		nodes = deadlineAwareNodes(nodes, time.Until(reqDesc.feBudgetDeadline))
+	}
 	switch b.opts.Mode {
 	case HTTPBackendModeRoundRobin:
 		bval := genRandByteSlice(8)
-		respNodes := wrh.ResponsibleNodes2(b.bssNodes, bval, 1)
+		respNodes := wrh.ResponsibleNodes2(nodes, bval, 1)
 		node := &respNodes[0]
 		if node.Weight <= 0 {
 			break
 		}
 		bs = node.Data.(*backendServer)
 	case HTTPBackendModeLeastConn:
-		for i := range b.bssNodes {
-			bsr := b.bssNodes[i].Data.(*backendServer)
+		for i := range nodes {
+			node := &nodes[i]
+			if node.Weight <= 0 {
+				continue
+			}
+			bsr := node.Data.(*backendServer)
 			if bsr.activeConnCount == 0 {
 				bs = bsr
 				break
@@ -311,6 +732,22 @@ func (b *HTTPBackend) findServer(reqDesc *httpReqDesc) (bs *backendServer) {
 				bs = bsr
 			}
 		}
+	case HTTPBackendModeLeastBytes:
+		for i := range nodes {
+			node := &nodes[i]
+			if node.Weight <= 0 {
+				continue
+			}
+			bsr := node.Data.(*backendServer)
+			if bs == nil {
+				bs = bsr
+				continue
+			}
+			oldBytes, newBytes := atomic.LoadInt64(&bs.outstandingBytes), atomic.LoadInt64(&bsr.outstandingBytes)
+			if oldBytes > newBytes || (oldBytes == newBytes && bs.activeConnCount > bsr.activeConnCount) {
+				bs = bsr
+			}
+		}
 	case HTTPBackendModeAffinityKey:
 		kind := b.opts.AffinityKey.Kind
 		key := b.opts.AffinityKey.Key
@@ -334,7 +771,7 @@ func (b *HTTPBackend) findServer(reqDesc *httpReqDesc) (bs *backendServer) {
 			bval := genRandByteSlice(8)
 			val = string(bval)
 		}
-		bssNodesLen := len(b.bssNodes)
+		bssNodesLen := len(nodes)
 		maxServers := b.opts.AffinityKey.MaxServers
 		switch {
 		case maxServers == 0:
@@ -346,7 +783,7 @@ func (b *HTTPBackend) findServer(reqDesc *httpReqDesc) (bs *backendServer) {
 		if threshold < 0 {
 			threshold = 0
 		}
-		respNodes := wrh.ResponsibleNodes2(b.bssNodes, []byte(val), maxServers)
+		respNodes := wrh.ResponsibleNodes2(nodes, []byte(val), maxServers)
 		if maxServers > 1 {
 			sort.Sort(respNodes)
 		}
@@ -378,8 +815,28 @@ func (b *HTTPBackend) serveIngress(ctx context.Context, errCh chan<- error, reqD
 	var err error
 	defer func() { errCh <- err }()
 
-	_, err = writeHTTPHeader(reqDesc.beConn.Writer, reqDesc.feStatusLine, reqDesc.feHdr)
+	// the header is flushed with the body in throughput write profile, unless the request has a body. the client may
+	// wait for 100 Continue of the backend server, or send the body slowly.
+	throughput := reqDesc.feWriteProfile == HTTPFrontendWriteProfileThroughput
+	flush := !throughput || reqDesc.feHdr.Get("Expect") != "" || reqDesc.feHdr.Get("Transfer-Encoding") != "" ||
+		(reqDesc.feHdr.Get("Content-Length") != "" && reqDesc.feHdr.Get("Content-Length") != "0")
+	if throughput {
+		if !flush {
+			reqDesc.beConn.SetCork(true)
+		}
+		defer func() {
+			if e := reqDesc.beConn.Flush(); e != nil && err == nil {
+				err = wrapHTTPError(httpErrGroupBackendCommunication, e)
+			}
+			if !flush {
+				reqDesc.beConn.SetCork(false)
+			}
+		}()
+	}
+
+	_, err = writeHTTPHeader(reqDesc.beConn.Writer, reqDesc.feStatusLine, reqDesc.feHdr, reqDesc.feHdrLines, flush)
 	if err != nil {
+		err = sideHTTPError(err, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
 		if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
 			xlog.V(100).Debugf("serve error on %s: write header to backend: %v", reqDesc.BackendSummary(), err)
 		}
@@ -396,25 +853,129 @@ func (b *HTTPBackend) serveIngress(ctx context.Context, errCh chan<- error, reqD
 		}
 		return
 	}
-	if contentLength < 0 {
+	// chunked body is framed by its chunks, otherwise the request has no body without Content-Length
+	transferEncoding := reqDesc.feHdr.Get("Transfer-Encoding")
+	if contentLength < 0 && transferEncoding == "" {
 		contentLength = 0
 	}
-	_, err = writeHTTPBody(reqDesc.beConn.Writer, reqDesc.feConn.Reader, contentLength, reqDesc.feHdr.Get("Transfer-Encoding"))
+	var beW io.Writer = reqDesc.beConn.Writer
+	if reqDesc.feTap != nil {
+		beW = reqDesc.feTap.RequestBodyWriter(beW)
+	}
+	if reqDesc.feMirror != nil {
+		reqDesc.feMirror.SetRequest(reqDesc.feStatusLine, reqDesc.feHdr)
+		beW = reqDesc.feMirror.RequestBodyWriter(beW)
+	}
+	if reqDesc.feRequestBodyTimeout > 0 && contentLength > 0 {
+		reqDesc.feConn.SetReadDeadline(time.Now().Add(reqDesc.feRequestBodyTimeout))
+		defer reqDesc.feConn.SetReadDeadline(time.Time{})
+		beW = &deadlineWriter{W: beW, Conn: reqDesc.feConn, Timeout: reqDesc.feRequestBodyTimeout}
+	}
+	beSW := &sideWriter{W: beW}
+	_, err = writeHTTPBodyMax(beSW, reqDesc.feConn.Reader, contentLength, transferEncoding, reqDesc.feWriteProfile == HTTPFrontendWriteProfileLowLatency, reqDesc.feMaxBodyBytes)
 	if err != nil {
+		if e := (*net.OpError)(nil); beSW.Err != nil {
+			err = sideHTTPError(err, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
+		} else if errors.Is(err, errHTTPResponseTooLarge) {
+			// the request to backend server is cancelled by closing its connection
+			err = errHTTPRequestBodyTooLarge
+			if reqDesc.claimResponse() {
+				reqDesc.feConn.Write([]byte(httpPayloadTooLarge))
+			}
+		} else if reqDesc.feRequestBodyTimeout > 0 && errors.As(err, &e) && e.Timeout() {
+			err = wrapHTTPError(httpErrGroupRequestBodyTimeout, err)
+			if reqDesc.claimResponse() {
+				reqDesc.feConn.Write([]byte(httpRequestTimeout))
+			}
+		} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// client closed the connection before sending whole body, the request to backend server is cancelled by closing its connection
+			err = wrapHTTPError(httpErrGroupRequestBodyTruncated, err)
+		} else {
+			err = sideHTTPError(err, httpErrGroupClientCommunication, httpErrGroupProtocol)
+		}
 		if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) && !errors.Is(err, errExpectedEOF) {
 			xlog.V(100).Debugf("serve error on %s: write body to backend: %v", reqDesc.BackendSummary(), err)
 		}
 		return
 	}
+	if reqDesc.feMirror != nil {
+		reqDesc.feMirror.Complete()
+	}
 }
 
 func (b *HTTPBackend) serveEngress(ctx context.Context, errCh chan<- error, reqDesc *httpReqDesc) {
 	var err error
 	defer func() { errCh <- err }()
 
+	// writes to the client extend its write deadline, it is reset after the last flush of the response
+	if reqDesc.feWriteTimeout > 0 {
+		defer reqDesc.feConn.SetWriteDeadline(time.Time{})
+	}
+
+	responseHeaderTimeout := b.opts.ResponseHeaderTimeout
+	if reqDesc.feRoute != nil && reqDesc.feRoute.ResponseHeaderTimeout > 0 {
+		responseHeaderTimeout = reqDesc.feRoute.ResponseHeaderTimeout
+	}
+	if responseHeaderTimeout > 0 {
+		reqDesc.beConn.SetReadDeadline(time.Now().Add(responseHeaderTimeout))
+	}
+
+	// the final header is flushed with the body in throughput write profile, interim ones are flushed immediately
+	throughput, corked := reqDesc.feWriteProfile == HTTPFrontendWriteProfileThroughput, false
+	defer func() {
+		if !corked {
+			return
+		}
+		if e := reqDesc.feConn.Flush(); e != nil && err == nil {
+			err = wrapHTTPError(httpErrGroupClientCommunication, e)
+		}
+		reqDesc.feConn.SetCork(false)
+	}()
+
+	maxBodySize := b.opts.MaxResponseBodySize
+	if reqDesc.feRoute != nil && reqDesc.feRoute.MaxResponseBodySize != 0 {
+		maxBodySize = reqDesc.feRoute.MaxResponseBodySize
+	}
+	if maxBodySize <= 0 || reqDesc.feStatusMethod == "CONNECT" {
+		maxBodySize = -1
+	}
+
+	var mappedBody *string
+	var bodiless bool
 	for i := 0; ; i++ {
-		reqDesc.beStatusLine, reqDesc.beHdr, _, err = splitHTTPHeader(reqDesc.beConn.Reader)
+		reqDesc.beStatusLine, reqDesc.beHdr, reqDesc.beHdrLines, _, err = splitHTTPHeader(reqDesc.beConn.Reader, reqDesc.feMaxHeaderBytes)
 		if err != nil {
+			if err == errHTTPHeaderTooLarge {
+				err = errHTTPResponseHeaderTooLarge
+				if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
+					xlog.V(100).Debugf("serve error on %s: read header from backend: %v", reqDesc.BackendSummary(), err)
+				}
+				if i == 0 && !reqDesc.claimResponse() {
+					return
+				}
+				if b.opts.OverrideErrors != "" {
+					reqDesc.feConn.Write([]byte(b.opts.OverrideErrors))
+					return
+				}
+				reqDesc.feConn.Write([]byte(httpBadGateway))
+				return
+			}
+			if e := (*net.OpError)(nil); responseHeaderTimeout > 0 && errors.As(err, &e) && e.Timeout() {
+				err = wrapHTTPError(httpErrGroupBackendRespHdrTimeout, err)
+				if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
+					xlog.V(100).Debugf("serve error on %s: read header from backend: %v", reqDesc.BackendSummary(), err)
+				}
+				if i == 0 && !reqDesc.claimResponse() {
+					return
+				}
+				if b.opts.OverrideErrors != "" {
+					reqDesc.feConn.Write([]byte(b.opts.OverrideErrors))
+					return
+				}
+				reqDesc.feConn.Write([]byte(httpGatewayTimeout))
+				return
+			}
+			err = sideHTTPError(err, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
 			if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
 				xlog.V(100).Debugf("serve error on %s: read header from backend: %v", reqDesc.BackendSummary(), err)
 			}
@@ -423,7 +984,7 @@ func (b *HTTPBackend) serveEngress(ctx context.Context, errCh chan<- error, reqD
 
 		beStatusLineParts := strings.SplitN(reqDesc.beStatusLine, " ", 3)
 		if len(beStatusLineParts) < 3 {
-			err = errHTTPStatusLine
+			err = sideHTTPError(errHTTPStatusLine, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
 			if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
 				xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
 			}
@@ -432,7 +993,7 @@ func (b *HTTPBackend) serveEngress(ctx context.Context, errCh chan<- error, reqD
 
 		reqDesc.beStatusVersion = strings.ToUpper(beStatusLineParts[0])
 		if reqDesc.beStatusVersion != "HTTP/1.0" && reqDesc.beStatusVersion != "HTTP/1.1" {
-			err = errHTTPStatusVersion
+			err = sideHTTPError(errHTTPStatusVersion, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
 			if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
 				xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
 			}
@@ -440,52 +1001,223 @@ func (b *HTTPBackend) serveEngress(ctx context.Context, errCh chan<- error, reqD
 		}
 
 		reqDesc.beStatusCode = beStatusLineParts[1]
+		bodiless = reqDesc.beStatusCode == "204" || reqDesc.beStatusCode == "304"
 
 		reqDesc.beStatusMsg = beStatusLineParts[2]
 
 		reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
 
+		if i >= httpMaxInterimResponses && reqDesc.beStatusCodeGrouped == "1xx" && reqDesc.beStatusCode != "101" {
+			err = sideHTTPError(errHTTPTooManyInterimResponses, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
+			if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
+				xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
+			}
+			return
+		}
+
 		if b.opts.ServerHashSecret != "" && reqDesc.beHdr.Get("X-Server-Name") == "" {
-			h := md5.New()
-			io.WriteString(h, b.opts.ServerHashSecret)
-			io.WriteString(h, reqDesc.beServer)
-			s := fmt.Sprintf("%x", h.Sum(nil))
-			reqDesc.beHdr.Set("X-Server-Name", s)
+			reqDesc.beHdr.Set("X-Server-Name", b.serverHash(reqDesc.beServer))
 		}
 
 		reqDesc.beHdr.Del("Keep-Alive")
 
-		_, err = writeHTTPHeader(reqDesc.feConn.Writer, reqDesc.beStatusLine, reqDesc.beHdr)
-		if err != nil {
-			if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
-				xlog.V(100).Debugf("serve error on %s: write header to frontend: %v", reqDesc.BackendSummary(), err)
+		// backend connection is reused by the hop-by-hop headers of reqDesc.beHdr, and they aren't forwarded to client
+		feHdr := stripHopByHopHeaders(reqDesc.beHdr, reqDesc.feUpgrade && reqDesc.beStatusCode == "101")
+		if origCode, e := strconv.Atoi(reqDesc.beStatusCode); e == nil && origCode >= 200 && reqDesc.feRoute != nil {
+			if code, ok := reqDesc.feRoute.StatusMap[origCode]; ok {
+				reqDesc.beStatusCode = strconv.Itoa(code)
+				reqDesc.beStatusMsg = http.StatusText(code)
+				reqDesc.beStatusLine = reqDesc.beStatusVersion + " " + reqDesc.beStatusCode + " " + reqDesc.beStatusMsg
+				reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+				feHdr = feHdr.Clone()
+				feHdr.Set("X-Upstream-Status", strconv.Itoa(origCode))
+				if body, ok := reqDesc.feRoute.StatusMapBodies[origCode]; ok {
+					mappedBody = &body
+					feHdr.Del("Transfer-Encoding")
+					feHdr.Del("Content-Encoding")
+					feHdr.Set("Content-Length", strconv.Itoa(len(body)))
+				}
+				b.promStatusMappedTotal.With(prometheus.Labels{
+					"server":   reqDesc.beServer,
+					"code":     reqDesc.beStatusCode,
+					"origcode": strconv.Itoa(origCode),
+					"frontend": reqDesc.feName,
+					"host":     reqDesc.feHost,
+					"path":     reqDesc.fePath,
+					"method":   reqDesc.feStatusMethodGrouped,
+					"listener": reqDesc.leName,
+				}).Inc()
 			}
+		}
+
+		if reqDesc.feStrippedPrefix != "" && reqDesc.feRoute.RewriteLocation {
+			if loc := feHdr.Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+				feHdr.Set("Location", reqDesc.feStrippedPrefix+loc)
+			}
+		}
+
+		// the framing headers aren't changed, so the body is relayed as is
+		if reqDesc.feRoute != nil && reqDesc.feRoute.responseHeaders != nil {
+			feHdr = feHdr.Clone()
+			applyHTTPHeaderOps(reqDesc, feHdr, reqDesc.feRoute.responseHeaders)
+		}
+
+		// the request id is sent to client as it is sent to backend
+		if reqDesc.feRequestIDHeader != "" && reqDesc.beStatusCodeGrouped != "1xx" {
+			feHdr = feHdr.Clone()
+			feHdr.Set(reqDesc.feRequestIDHeader, reqDesc.feRequestID)
+		}
+
+		if reqDesc.feViaPseudonym != "" {
+			feHdr = feHdr.Clone()
+			addVia(feHdr, reqDesc.beStatusVersion, reqDesc.feViaPseudonym)
+		}
+
+		if reqDesc.leTLSWarnHeader && reqDesc.beStatusCodeGrouped != "1xx" {
+			feHdr.Add("Warning", `299 - "TLS upgrade required"`)
+		}
+
+		if reqDesc.beStatusCodeGrouped != "1xx" {
+			if cookie := b.stickyCookie(reqDesc, feHdr); cookie != "" {
+				feHdr = feHdr.Clone()
+				feHdr.Add("Set-Cookie", cookie)
+			}
+		}
+
+		if reqDesc.beBackendServer.IsDraining() {
+			reqDesc.feClose, reqDesc.feDrain = true, true
+		}
+		if reqDesc.feClose && reqDesc.beStatusCodeGrouped != "1xx" {
+			feHdr = feHdr.Clone()
+			feHdr.Set("Connection", "close")
+			if reqDesc.feDrain && reqDesc.feDrainHeader {
+				feHdr.Set("X-Drain", "true")
+			}
+		}
+
+		// tunneled traffic isn't limited, and the body of a declared larger response isn't transferred
+		if reqDesc.beStatusCode == "101" {
+			maxBodySize = -1
+		}
+		if maxBodySize >= 0 && mappedBody == nil && !bodiless && reqDesc.feStatusMethod != "HEAD" && reqDesc.beStatusCodeGrouped != "1xx" {
+			if contentLength, e := httpContentLength(reqDesc.beHdr); e == nil && contentLength > maxBodySize {
+				err = errHTTPResponseTooLarge
+				if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
+					xlog.V(100).Debugf("serve error on %s: content length %d: %v", reqDesc.BackendSummary(), contentLength, err)
+				}
+				if i == 0 && !reqDesc.claimResponse() {
+					return
+				}
+				if b.opts.OverrideErrors != "" {
+					reqDesc.feConn.Write([]byte(b.opts.OverrideErrors))
+					return
+				}
+				reqDesc.feConn.Write([]byte(httpBadGateway))
+				return
+			}
+		}
+
+		if i == 0 && !reqDesc.claimResponse() {
+			err = errHTTPRequestBudgetExceeded
 			return
 		}
+		// interim responses are forwarded, and the final response is waited. 101 switches protocols, so it is final.
+		// HTTP/1.0 clients don't get interim responses, RFC 7231 section 6.2.
+		interim := reqDesc.beStatusCodeGrouped == "1xx" && reqDesc.beStatusCode != "101"
+		if !interim || reqDesc.feStatusVersion != "HTTP/1.0" {
+			flush := !throughput || reqDesc.beStatusCodeGrouped == "1xx"
+			if !flush && !corked {
+				reqDesc.feConn.SetCork(true)
+				corked = true
+			}
+			if reqDesc.feWriteTimeout > 0 {
+				reqDesc.feConn.SetWriteDeadline(time.Now().Add(reqDesc.feWriteTimeout))
+			}
+			_, err = writeHTTPHeader(reqDesc.feConn.Writer, reqDesc.beStatusLine, feHdr, reqDesc.beHdrLines, flush)
+			if err != nil {
+				err = clientWriteHTTPError(err)
+				if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
+					xlog.V(100).Debugf("serve error on %s: write header to frontend: %v", reqDesc.BackendSummary(), err)
+				}
+				return
+			}
+			if reqDesc.feTap != nil {
+				reqDesc.feTap.SetResponse(reqDesc.beStatusLine, feHdr)
+			}
+		}
 
-		if expect := reqDesc.feHdr.Get("Expect"); expect != "" && i == 0 {
-			expectCode := strings.SplitN(expect, "-", 2)[0]
-			if expectCode == reqDesc.beStatusCode {
-				continue
+		if interim {
+			if i == 0 {
+				reqDesc.beInterimFirstByte = reqDesc.beConn.TimeToFirstByte()
 			}
+			continue
 		}
+		reqDesc.beFinalHdrTime = time.Now()
 
 		break
 	}
+	if responseHeaderTimeout > 0 {
+		reqDesc.beConn.SetReadDeadline(time.Time{})
+	}
 
 	if reqDesc.feStatusMethod == "HEAD" {
 		return
 	}
 
+	// the rest of the connection after switching protocols is relayed by the tunnel
+	if reqDesc.beStatusCode == "101" {
+		return
+	}
+
+	// 204 and 304 responses of backend don't have a body, even if they have Content-Length or Transfer-Encoding
 	var contentLength int64
-	contentLength, err = httpContentLength(reqDesc.beHdr)
-	if err != nil {
-		if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
-			xlog.V(100).Debugf("serve error on %s: write body to frontend: %v", reqDesc.BackendSummary(), err)
+	if !bodiless {
+		contentLength, err = httpContentLength(reqDesc.beHdr)
+		if err != nil {
+			err = sideHTTPError(err, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
+			if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) {
+				xlog.V(100).Debugf("serve error on %s: write body to frontend: %v", reqDesc.BackendSummary(), err)
+			}
+			return
+		}
+	}
+	feCW := &counterWriter{
+		W: reqDesc.feConn.Writer,
+		C: &reqDesc.beBackendServer.outstandingBytes,
+	}
+	defer feCW.Release()
+	if mappedBody == nil {
+		var feW io.Writer = feCW
+		if reqDesc.feWriteTimeout > 0 {
+			feW = &writeDeadlineWriter{W: feW, Conn: reqDesc.feConn, Timeout: reqDesc.feWriteTimeout}
+		}
+		if reqDesc.feThrottle != nil {
+			tw := *reqDesc.feThrottle
+			tw.W = feW
+			tw.Ctx, tw.CtxErrGroup = ctx, httpErrGroupBackendTimeout
+			feW = &tw
+		}
+		if reqDesc.feTap != nil {
+			feW = reqDesc.feTap.ResponseBodyWriter(feW)
+		}
+		feSW := &sideWriter{W: feW}
+		_, err = writeHTTPBodyMax(feSW, reqDesc.beConn.Reader, contentLength, reqDesc.beHdr.Get("Transfer-Encoding"), reqDesc.feWriteProfile == HTTPFrontendWriteProfileLowLatency, maxBodySize)
+		if feSW.Err != nil {
+			err = clientWriteHTTPError(err)
+		} else if errors.Is(err, errHTTPResponseTooLarge) {
+			err = errHTTPResponseTooLarge
+		} else {
+			err = sideHTTPError(err, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
+		}
+	} else {
+		_, err = writeHTTPBody(&nopWriter{}, reqDesc.beConn.Reader, contentLength, reqDesc.beHdr.Get("Transfer-Encoding"), false)
+		err = sideHTTPError(err, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
+		if err == nil || errors.Is(err, errExpectedEOF) {
+			if _, e := writeHTTPBody(feCW, bufio.NewReader(strings.NewReader(*mappedBody)), int64(len(*mappedBody)), "", false); e != nil {
+				err = sideHTTPError(e, httpErrGroupClientCommunication, httpErrGroupProtocol)
+			}
 		}
-		return
 	}
-	_, err = writeHTTPBody(reqDesc.feConn.Writer, reqDesc.beConn.Reader, contentLength, reqDesc.beHdr.Get("Transfer-Encoding"))
 	if err != nil {
 		if atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1) && !errors.Is(err, errExpectedEOF) {
 			xlog.V(100).Debugf("serve error on %s: write body to frontend: %v", reqDesc.BackendSummary(), err)
@@ -513,28 +1245,38 @@ func (b *HTTPBackend) serveAsync(ctx context.Context, errCh chan<- error, reqDes
 		return
 	}
 
+	if reqDesc.beStatusCode == "101" {
+		atomic.StoreUint32(&reqDesc.feTunneled, 1)
+		err = serveHTTPTunnel(reqDesc.feConn, reqDesc.beConn, reqDesc.feTunnelIdleTimeout)
+		if !errors.Is(err, errExpectedEOF) {
+			xlog.V(100).Debugf("serve error on %s: tunnel: %v", reqDesc.BackendSummary(), err)
+		}
+		return
+	}
+
 	if reqDesc.beConn.Reader.Buffered() != 0 {
-		err = errHTTPBufferOrder
+		err = sideHTTPError(errHTTPBufferOrder, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol)
 		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
 		return
 	}
 
-	switch connection := strings.ToLower(reqDesc.beHdr.Get("Connection")); {
-	case connection == "keep-alive" && reqDesc.beStatusVersion == "HTTP/1.1":
-	case connection == "close":
-		fallthrough
-	default:
+	// Connection header may name hop-by-hop headers besides keep-alive
+	if hasConnectionOption(reqDesc.beHdr, "close") || !hasConnectionOption(reqDesc.beHdr, "keep-alive") || reqDesc.beStatusVersion != "HTTP/1.1" {
 		err = wrapHTTPError("communication", errExpectedEOF)
 		return
 	}
 }
 
-func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err error) {
-	feWr := io.Writer(reqDesc.feConn)
-	if !reqDesc.beFinal {
-		feWr = &nopWriter{}
+// admit acquires a connection slot of the backend for the request. If the backend is exhausted, the request waits in the queue
+// up to QueueTimeout. It is shed when MaxQueue requests are already waiting. Shed and timed out requests are answered,
+// requests whose clients close the connection while waiting aren't. None of them reach a backend server.
+func (b *HTTPBackend) admit(ctx context.Context, reqDesc *httpReqDesc, feWr io.Writer) (err error) {
+	select {
+	case b.slots <- struct{}{}:
+		return
+	default:
 	}
-	if b.opts.MaxConn > 0 && b.connCount >= int64(b.opts.MaxConn) {
+	if b.opts.QueueTimeout <= 0 {
 		err = errHTTPBackendExhausted
 		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
 		if b.opts.OverrideErrors != "" {
@@ -544,8 +1286,90 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 		feWr.Write([]byte(httpServiceUnavailable))
 		return
 	}
+
+	promLabels := prometheus.Labels{
+		"frontend": reqDesc.feName,
+		"host":     reqDesc.feHost,
+		"path":     reqDesc.fePath,
+		"method":   reqDesc.feStatusMethodGrouped,
+		"listener": reqDesc.leName,
+	}
+	defer atomic.AddInt64(&b.queueLen, -1)
+	if n := atomic.AddInt64(&b.queueLen, 1); b.opts.MaxQueue > 0 && n > int64(b.opts.MaxQueue) {
+		err = errHTTPBackendShed
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
+		b.promShedTotal.With(promLabels).Inc()
+		if b.opts.ShedStatus == http.StatusTooManyRequests {
+			feWr.Write([]byte(httpTooManyRequests))
+			return
+		}
+		if b.opts.OverrideErrors != "" {
+			feWr.Write([]byte(b.opts.OverrideErrors))
+			return
+		}
+		feWr.Write([]byte(httpServiceUnavailable))
+		return
+	}
+
+	queueTmr := time.NewTimer(b.opts.QueueTimeout)
+	defer queueTmr.Stop()
+	checkTkr := time.NewTicker(httpClientCheckInterval)
+	defer checkTkr.Stop()
+	for {
+		select {
+		case b.slots <- struct{}{}:
+			return
+		case <-queueTmr.C:
+			err = errHTTPBackendQueueTimeout
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
+			b.promQueueTimeoutTotal.With(promLabels).Inc()
+			if b.opts.OverrideErrors != "" {
+				feWr.Write([]byte(b.opts.OverrideErrors))
+				return
+			}
+			feWr.Write([]byte(httpServiceUnavailable))
+			return
+		case <-ctx.Done():
+			err = errHTTPFrontendTimeout
+			if !reqDesc.feBudgetDeadline.IsZero() && !time.Now().Before(reqDesc.feBudgetDeadline) {
+				err = errHTTPRequestBudgetExceeded
+				if reqDesc.claimResponse() {
+					feWr.Write([]byte(httpGatewayTimeout))
+				}
+			}
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
+			return
+		case <-checkTkr.C:
+			if !reqDesc.feConn.Check() {
+				// the request isn't sent to the backup backend
+				reqDesc.beFinal = true
+				err = errHTTPQueueClientAbort
+				xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
+				b.promQueueClientAbortTotal.With(promLabels).Inc()
+				return
+			}
+		}
+	}
+}
+
+func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err error) {
+	feWr := io.Writer(reqDesc.feConn)
+	if !reqDesc.beFinal {
+		feWr = &nopWriter{}
+	}
+	if b.slots != nil {
+		if err = b.admit(ctx, reqDesc, feWr); err != nil {
+			return
+		}
+		defer func() { <-b.slots }()
+	}
 	atomic.AddInt64(&b.connCount, 1)
 	defer atomic.AddInt64(&b.connCount, -1)
+	defer func() {
+		if b.IsRetired() {
+			reqDesc.feReloading = true
+		}
+	}()
 
 	bs := b.findServer(reqDesc)
 	if bs == nil {
@@ -559,6 +1383,19 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 		return
 	}
 	reqDesc.beServer = bs.server
+	reqDesc.beBackendServer = bs
+
+	var r, w int64
+	defer func() {
+		errDesc := ""
+		if err != nil && !errors.Is(err, errExpectedEOF) {
+			errDesc = "unknown"
+			if e := (*httpError)(nil); errors.As(err, &e) {
+				errDesc = e.Group
+			}
+		}
+		bs.stats.RequestDone(errDesc, r, w)
+	}()
 
 	if b.opts.ServerMaxConn > 0 && bs.activeConnCount >= int64(b.opts.ServerMaxConn) {
 		err = errHTTPBackendServerExhausted
@@ -577,9 +1414,13 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 		connectCtx, connectCtxCancel = context.WithTimeout(ctx, b.opts.ConnectTimeout)
 		defer connectCtxCancel()
 	}
-	reqDesc.beConn, err = bs.ConnAcquire(connectCtx)
+	if reqDesc.feRoute != nil && reqDesc.feRoute.GRPC {
+		reqDesc.beConn, err = bs.H2ConnAcquire(connectCtx)
+	} else {
+		reqDesc.beConn, err = bs.ConnAcquire(connectCtx, b.proxyProtocolHeader(reqDesc), reqDesc.feConnCtx)
+	}
 	if err != nil {
-		if e := (*net.OpError)(nil); errors.As(err, &e) && e.Timeout() {
+		if e := net.Error(nil); (errors.As(err, &e) && e.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
 			err = newfHTTPError(httpErrGroupBackendConnectTimeout, "timeout exceeded while connecting to backend server: %w", err)
 			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
 			if b.opts.OverrideErrors != "" {
@@ -589,6 +1430,16 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 			feWr.Write([]byte(httpGatewayTimeout))
 			return
 		}
+		if errors.Is(err, errBackendServerTLSPinMismatch) {
+			err = newfHTTPError(httpErrGroupBackendTLSPinMismatch, "could not connect to backend server: %w", err)
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
+			if b.opts.OverrideErrors != "" {
+				feWr.Write([]byte(b.opts.OverrideErrors))
+				return
+			}
+			feWr.Write([]byte(httpBadGateway))
+			return
+		}
 		err = newfHTTPError(httpErrGroupBackendConnect, "could not connect to backend server: %w", err)
 		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
 		if b.opts.OverrideErrors != "" {
@@ -598,6 +1449,8 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 		feWr.Write([]byte(httpBadGateway))
 		return
 	}
+	// backend connections are shared by frontends, so the option is set for every request
+	reqDesc.beConn.SetNoDelay(b.opts.TCPNoDelay || reqDesc.feWriteProfile != HTTPFrontendWriteProfileThroughput)
 	defer func() {
 		if b.opts.ServerMaxIdleConn > 0 && bs.idleConnCount >= int64(b.opts.ServerMaxIdleConn) {
 			reqDesc.beConn.Close()
@@ -606,11 +1459,6 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 	}()
 	reqDesc.beFinal = true
 
-	/*if tcpConn, ok := reqDesc.beConn.Conn().(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(1 * time.Second)
-	}*/
-
 	if b.opts.Timeout > 0 {
 		var ctxCancel context.CancelFunc
 		ctx, ctxCancel = context.WithTimeout(ctx, b.opts.Timeout)
@@ -639,7 +1487,17 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 		reqDesc.feHdr.Set("X-Real-IP", reqDesc.feRemoteIP)
 	}
 
-	reqDesc.feHdr.Del("Keep-Alive")
+	// headers of clients are removed on every listener, so the identity can't be spoofed through listeners without
+	// client certificate verification
+	setClientCertHeaders(reqDesc.feHdr, reqDesc.leClientCert, reqDesc.leClientPEM)
+
+	if reqDesc.feTimeoutHeader != "" {
+		if deadline, ok := ctx.Deadline(); ok {
+			reqDesc.feHdr.Set(reqDesc.feTimeoutHeader, strconv.FormatInt(int64(time.Until(deadline)/time.Millisecond), 10))
+		} else {
+			reqDesc.feHdr.Del(reqDesc.feTimeoutHeader)
+		}
+	}
 
 	for k, v := range b.opts.ReqHeader {
 		for ks, vs := range v {
@@ -657,26 +1515,44 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 
 	asyncErrCh := make(chan error, 1)
 	go b.serveAsync(ctx, asyncErrCh, reqDesc)
-	select {
-	case <-ctx.Done():
-		atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1)
-		err = errHTTPBackendTimeout
-		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
-		reqDesc.feConn.Flush()
-		reqDesc.feConn.Close()
-		reqDesc.beConn.Flush()
-		reqDesc.beConn.Close()
-		<-asyncErrCh
-	case err = <-asyncErrCh:
-		if err != nil {
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			// the tunnel replaces the backend timeout by the context of the frontend connection
+			if reqDesc.isTunneled() && ctx != reqDesc.feConnCtx {
+				ctx = reqDesc.feConnCtx
+				continue
+			}
+			done = true
+			atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1)
+			err = errHTTPBackendTimeout
+			if !reqDesc.feBudgetDeadline.IsZero() && !time.Now().Before(reqDesc.feBudgetDeadline) {
+				err = errHTTPRequestBudgetExceeded
+				if reqDesc.claimResponse() {
+					reqDesc.feConn.Write([]byte(httpGatewayTimeout))
+				}
+			} else {
+				// the latency of a request timed out by the backend is at least its duration
+				bs.stats.latency.Add(time.Now().Unix(), time.Now().Sub(startTime))
+			}
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.BackendSummary(), err)
 			reqDesc.feConn.Flush()
 			reqDesc.feConn.Close()
 			reqDesc.beConn.Flush()
 			reqDesc.beConn.Close()
+			<-asyncErrCh
+		case err = <-asyncErrCh:
+			done = true
+			if err != nil {
+				reqDesc.feConn.Flush()
+				reqDesc.feConn.Close()
+				reqDesc.beConn.Flush()
+				reqDesc.beConn.Close()
+			}
 		}
 	}
 	// resetting and reading stats before bs.ConnRelease(...)
-	r, w := reqDesc.beConn.Stats()
+	r, w = reqDesc.beConn.Stats()
 
 	// monitoring end
 	promLabels := prometheus.Labels{
@@ -700,8 +1576,18 @@ func (b *HTTPBackend) serve(ctx context.Context, reqDesc *httpReqDesc) (err erro
 		}
 	} else {
 		//b.promRequestDurationSeconds.With(promLabels).Observe(time.Now().Sub(startTime).Seconds())
-		if tm := reqDesc.beConn.TimeToFirstByte(); !tm.IsZero() {
-			b.promTimeToFirstByteSeconds.With(promLabels).Observe(tm.Sub(startTime).Seconds())
+		promTimeToFirstByteSeconds := b.promTimeToFirstByteSeconds.MustCurryWith(promLabels)
+		tm := reqDesc.beConn.TimeToFirstByte()
+		if !reqDesc.beInterimFirstByte.IsZero() {
+			promTimeToFirstByteSeconds.With(prometheus.Labels{"response": "interim"}).Observe(reqDesc.beInterimFirstByte.Sub(startTime).Seconds())
+			// the final response may be read with the interim responses, or its first byte may be a byte of body
+			if tm.IsZero() || tm.After(reqDesc.beFinalHdrTime) {
+				tm = reqDesc.beFinalHdrTime
+			}
+		}
+		if !tm.IsZero() {
+			promTimeToFirstByteSeconds.With(prometheus.Labels{"response": "final"}).Observe(tm.Sub(startTime).Seconds())
+			bs.stats.latency.Add(tm.Unix(), tm.Sub(startTime))
 		}
 	}
 	//b.promRequestsTotal.MustCurryWith(promLabels).With(prometheus.Labels{"error": errDesc}).Inc()
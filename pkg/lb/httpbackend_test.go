@@ -0,0 +1,786 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/simult/simult/pkg/hc"
+)
+
+func TestHTTPBackendModeLeastBytes(t *testing.T) {
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "test",
+		Mode:    HTTPBackendModeLeastBytes,
+		Servers: []string{"http://127.0.0.1:1", "http://127.0.0.1:2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	atomic.StoreInt64(&b.bss["http://127.0.0.1:1"].outstandingBytes, 1<<30)
+	atomic.StoreInt64(&b.bss["http://127.0.0.1:2"].outstandingBytes, 1<<10)
+	for i := 0; i < 10; i++ {
+		if bs := b.findServer(&httpReqDesc{}); bs == nil || bs.server != "http://127.0.0.1:2" {
+			t.Fatalf("expected server with least outstanding bytes, got %v", bs)
+		}
+	}
+}
+
+func TestHTTPBackendServerDrain(t *testing.T) {
+	for _, mode := range []HTTPBackendMode{HTTPBackendModeRoundRobin, HTTPBackendModeLeastConn, HTTPBackendModeAffinityKey} {
+		b, err := NewHTTPBackend(HTTPBackendOptions{
+			Name:    "test",
+			Mode:    mode,
+			Servers: []string{"http://127.0.0.1:1", "http://127.0.0.1:2 drain=true"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			reqDesc := &httpReqDesc{feRemoteIP: "10.0.0." + strconv.Itoa(i)}
+			if bs := b.findServer(reqDesc); bs == nil || bs.server != "http://127.0.0.1:1" {
+				t.Fatalf("mode %d: expected server which isn't draining, got %v", mode, bs)
+			}
+		}
+
+		bn, err := b.Fork(HTTPBackendOptions{
+			Name:    "test",
+			Mode:    mode,
+			Servers: []string{"http://127.0.0.1:1 drain=true", "http://127.0.0.1:2"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.bss["http://127.0.0.1:1"].IsDraining() || b.bss["http://127.0.0.1:2"].IsDraining() {
+			t.Fatalf("mode %d: drain status isn't shared with forked backend", mode)
+		}
+		if bs := bn.findServer(&httpReqDesc{}); bs == nil || bs.server != "http://127.0.0.1:2" {
+			t.Fatalf("mode %d: expected server which isn't draining after fork, got %v", mode, bs)
+		}
+		b.Close()
+		bn.Close()
+	}
+
+	if _, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "test",
+		Servers: []string{"http://127.0.0.1:1 drain=maybe"},
+	}); err == nil {
+		t.Fatal("expected error for wrong drain value")
+	}
+}
+
+func TestHTTPBackendStatusMap(t *testing.T) {
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			switch req.URL.Path {
+			case "/missing":
+				conn.Write([]byte("HTTP/1.1 404 Not Found\r\nTransfer-Encoding: chunked\r\nConnection: keep-alive\r\n\r\n5\r\nerror\r\n0\r\n\r\n"))
+			default:
+				conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\nContent-Length: 5\r\nConnection: keep-alive\r\n\r\nerror"))
+			}
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "test",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "test",
+		MaxKeepAliveReqs: -1,
+		Routes: []HTTPFrontendRoute{
+			{
+				Backend:         b,
+				StatusMap:       map[int]int{404: 200, 500: 502},
+				StatusMapBodies: map[int]string{404: "probe ok"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		path     string
+		code     int
+		origCode string
+		body     string
+	}{
+		{"/missing", 200, "404", "probe ok"},
+		{"/broken", 502, "500", "error"},
+		{"/missing", 200, "404", "probe ok"},
+	} {
+		resp := doTestRequest(t, conn, rd, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != tc.code || resp.Header.Get("X-Upstream-Status") != tc.origCode || string(body) != tc.body {
+			t.Errorf("path %q: got %d %q %q, want %d %q %q", tc.path, resp.StatusCode, resp.Header.Get("X-Upstream-Status"), body, tc.code, tc.origCode, tc.body)
+		}
+	}
+}
+
+func TestHTTPBackendReloadHealthCheck(t *testing.T) {
+	const serverCount = 5
+	const interval = 100 * time.Millisecond
+
+	var probesMu sync.Mutex
+	probes := make(map[string][]time.Time, serverCount)
+	servers := make([]string, 0, serverCount)
+	for i := 0; i < serverCount; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probesMu.Lock()
+			probes[r.Host] = append(probes[r.Host], time.Now())
+			probesMu.Unlock()
+		}))
+		defer srv.Close()
+		servers = append(servers, srv.URL)
+	}
+
+	opts := HTTPBackendOptions{
+		Name: "test",
+		HealthCheckHTTPOpts: &hc.HTTPCheckOptions{
+			Path:     "/health",
+			Interval: interval,
+			Timeout:  time.Second,
+		},
+		Servers: servers,
+	}
+	b, err := NewHTTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+
+	startTime := time.Now()
+	for i := 0; i < 50; i++ {
+		bn, err := b.Fork(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bn.Activate()
+		b.Close()
+		b = bn
+		time.Sleep(interval / 10)
+	}
+	time.Sleep(3 * interval)
+	b.Close()
+	duration := time.Now().Sub(startTime)
+
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	total := 0
+	for host, tms := range probes {
+		total += len(tms)
+		for i := 1; i < len(tms); i++ {
+			if d := tms[i].Sub(tms[i-1]); d < interval/2 {
+				t.Errorf("server %s probed twice within %v", host, d)
+			}
+		}
+	}
+	if max := serverCount * int(duration/interval+1); total > max {
+		t.Errorf("%d probes in %v exceeds %d", total, duration, max)
+	}
+}
+
+func TestWindowCounter(t *testing.T) {
+	var c windowCounter
+	for i := 0; i < 3; i++ {
+		c.Add(1000)
+	}
+	c.Add(1001)
+	c.Add(999 - windowCounterSlots)
+	if n := c.Sum(1001); n != 4 {
+		t.Errorf("got sum %d, want 4", n)
+	}
+	if n := c.Sum(1000 + windowCounterSlots); n != 1 {
+		t.Errorf("got sum %d after window passed, want 1", n)
+	}
+	c.Add(1000 + windowCounterSlots)
+	if n := c.Sum(1000 + windowCounterSlots); n != 2 {
+		t.Errorf("got sum %d after slot reused, want 2", n)
+	}
+
+	var wg sync.WaitGroup
+	c = windowCounter{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Add(2000)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := c.Sum(2000); n != 8000 {
+		t.Errorf("got concurrent sum %d, want 8000", n)
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	var w latencyWindow
+	for i := 1; i < latencyWindowMinSamples; i++ {
+		w.Add(1000, time.Duration(i)*time.Millisecond)
+	}
+	w.Update(1000)
+	if d := w.P50(); d != 0 {
+		t.Errorf("got p50 %v with too few samples, want 0", d)
+	}
+	w.Add(1000, 100*time.Millisecond)
+	w.Update(1000)
+	if d := w.P50(); d != 5*time.Millisecond {
+		t.Errorf("got p50 %v, want 5ms", d)
+	}
+	w.Update(1000 + windowCounterSlots)
+	if d := w.P50(); d != 0 {
+		t.Errorf("got p50 %v after window passed, want 0", d)
+	}
+	for i := 0; i < latencyWindowSamples; i++ {
+		w.Add(2000, time.Second)
+	}
+	w.Update(2000)
+	if d := w.P50(); d != time.Second {
+		t.Errorf("got p50 %v after samples replaced, want 1s", d)
+	}
+}
+
+func TestHTTPBackendDeadlineAware(t *testing.T) {
+	var hits [2]int64
+	servers := make([]string, 0, 2)
+	for i, delay := range []time.Duration{5 * time.Millisecond, 150 * time.Millisecond} {
+		i, delay := i, delay
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&hits[i], 1)
+			time.Sleep(delay)
+			w.Write([]byte(strconv.Itoa(i)))
+		}))
+		defer srv.Close()
+		servers = append(servers, srv.URL)
+	}
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:          "deadlineaware",
+		DeadlineAware: true,
+		Servers:       servers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "deadlineaware",
+		DefaultBackend: b,
+		TimeoutHeader:  "X-Request-Timeout",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// requests without budget warm up latency estimates of both servers
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var wg sync.WaitGroup
+		for i := 0; i < 2*latencyWindowMinSamples; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			}()
+		}
+		wg.Wait()
+		time.Sleep(200 * time.Millisecond)
+		st := b.Status()
+		if st.Servers[0].LatencyP50Seconds > 0 && st.Servers[1].LatencyP50Seconds > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("latency estimates aren't ready: %+v", st.Servers)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Request-Timeout: 100\r\n\r\n")
+		if resp.StatusCode != http.StatusOK || body != "0" {
+			t.Fatalf("request with 100ms budget: got %d from server %q, want 200 from fast server", resp.StatusCode, body)
+		}
+	}
+
+	// no server is fast enough, so the normal choice is made
+	base := [2]int64{atomic.LoadInt64(&hits[0]), atomic.LoadInt64(&hits[1])}
+	for i := 0; i < 20; i++ {
+		doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Request-Timeout: 2\r\n\r\n")
+	}
+	for i := range hits {
+		if atomic.LoadInt64(&hits[i]) == base[i] {
+			t.Errorf("request with 2ms budget: server %d has never been chosen", i)
+		}
+	}
+}
+
+func TestHTTPBackendStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "status",
+		Servers: []string{srv.URL + " 2", "http://127.0.0.1:1 drain=true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "status",
+		Routes: []HTTPFrontendRoute{{Backend: b}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, path := range []string{"/", "/", "/abort", "/"} {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+
+	var st HTTPBackendStatus
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		st = b.Status()
+		if st.Servers[1].RequestsTotal >= 4 {
+			break
+		}
+	}
+	if st.Name != "status" || st.WindowSeconds != windowCounterSlots || len(st.Servers) != 2 {
+		t.Fatalf("got status %+v", st)
+	}
+	drained, live := st.Servers[0], st.Servers[1]
+	if drained.Server != "http://127.0.0.1:1" || !drained.Draining || drained.Weight != 1 || drained.EffectiveWeight != 0 || drained.RequestsTotal != 0 {
+		t.Errorf("got draining server status %+v", drained)
+	}
+	if live.Draining || !live.Healthy || live.Weight != 2 || live.EffectiveWeight != 2 || live.ActiveConnections != 0 {
+		t.Errorf("got server status %+v", live)
+	}
+	if live.RequestsTotal != 4 || live.RequestsInWindow != 4 || live.ErrorsInWindow != 1 || len(live.ErrorsTotal) != 1 || live.ErrorsTotal[httpErrGroupBackendCommunication] != 1 {
+		t.Errorf("got server request counts %+v", live)
+	}
+	if live.ReadBytes <= 0 || live.WriteBytes <= 0 {
+		t.Errorf("got server byte counts %+v", live)
+	}
+}
+
+func TestHTTPBackendStickyCookie(t *testing.T) {
+	var servers []string
+	for i := 0; i < 2; i++ {
+		id := strconv.Itoa(i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Set-Cookie", "a=1; Path=/")
+			w.Header().Add("Set-Cookie", "b=2; HttpOnly")
+			if r.URL.Path == "/own" {
+				w.Header().Add("Set-Cookie", "lb=app")
+			}
+			w.Write([]byte(id))
+		}))
+		defer srv.Close()
+		servers = append(servers, srv.URL)
+	}
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name: "sticky",
+		StickyCookie: HTTPBackendCookie{
+			Name:     "lb",
+			Path:     "/",
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		Servers: servers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "sticky",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	setCookies := resp.Header["Set-Cookie"]
+	if len(setCookies) != 3 || setCookies[0] != "a=1; Path=/" || setCookies[1] != "b=2; HttpOnly" {
+		t.Fatalf("got Set-Cookie %q", setCookies)
+	}
+	sticky := setCookies[2]
+	value := strings.TrimPrefix(strings.SplitN(sticky, ";", 2)[0], "lb=")
+	if sticky != "lb="+value+"; Path=/; HttpOnly; SameSite=Lax" || b.stickyServers[value] == nil || b.stickyServers[value].server != servers[body[0]-'0'] {
+		t.Fatalf("got sticky Set-Cookie %q for server %s", sticky, body)
+	}
+
+	for i := 0; i < 10; i++ {
+		resp, got := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\nCookie: x=y; lb="+value+"\r\n\r\n")
+		if got != body {
+			t.Fatalf("got server %s with sticky cookie, want %s", got, body)
+		}
+		if n := len(resp.Header["Set-Cookie"]); n != 2 {
+			t.Fatalf("got Set-Cookie %q for client which has the sticky cookie", resp.Header["Set-Cookie"])
+		}
+	}
+
+	if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\nCookie: lb=unknown\r\n\r\n"); len(resp.Header["Set-Cookie"]) != 3 {
+		t.Errorf("got Set-Cookie %q for unknown sticky cookie", resp.Header["Set-Cookie"])
+	}
+
+	resp, _ = doTestRequestOnce(t, fLis, "GET /own HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if setCookies := resp.Header["Set-Cookie"]; len(setCookies) != 3 || setCookies[2] != "lb=app" {
+		t.Errorf("got Set-Cookie %q for response which sets cookie with same name", setCookies)
+	}
+
+	if _, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:         "sticky",
+		StickyCookie: HTTPBackendCookie{Name: "bad name"},
+		Servers:      servers,
+	}); err == nil {
+		t.Error("expected error for invalid sticky cookie name")
+	}
+}
+
+func TestHTTPBackendInterimResponses(t *testing.T) {
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			n := 1
+			if req.URL.Path == "/flood" {
+				n = httpMaxInterimResponses + 1
+			}
+			for i := 0; i < n; i++ {
+				conn.Write([]byte("HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n"))
+			}
+			time.Sleep(20 * time.Millisecond)
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: keep-alive\r\n\r\nOK"))
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "interim",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "interim",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	ttfbCount := func(response string) float64 {
+		return testCounterSum(promHTTPBackendTimeToFirstByteSeconds, prometheus.Labels{"backend": "interim", "response": response})
+	}
+	interimBase, finalBase := ttfbCount("interim"), ttfbCount("final")
+
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		resp := doTestRequest(t, conn, rd, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != 103 || resp.Header.Get("Link") == "" {
+			t.Fatalf("got %d %v, want 103 with Link header", resp.StatusCode, resp.Header)
+		}
+		resp, err = http.ReadResponse(rd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 200 || string(body) != "OK" {
+			t.Fatalf("got final response %d %q, want 200 %q", resp.StatusCode, body, "OK")
+		}
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && ttfbCount("final")-finalBase < 2; time.Sleep(10 * time.Millisecond) {
+	}
+	if n, m := ttfbCount("interim")-interimBase, ttfbCount("final")-finalBase; n != 2 || m != 2 {
+		t.Errorf("got %v interim and %v final time to first byte observations, want 2 and 2", n, m)
+	}
+
+	// HTTP/1.0 clients get only the final response
+	if resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 || body != "OK" {
+		t.Errorf("got %d %q for HTTP/1.0 request, want 200 %q without interim response", resp.StatusCode, body, "OK")
+	}
+
+	conn2, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte("GET /flood HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	data, _ := ioutil.ReadAll(conn2)
+	if n := strings.Count(string(data), "103 Early Hints"); n != httpMaxInterimResponses || strings.Contains(string(data), "200 OK") {
+		t.Errorf("got %d interim responses and final response %v, want %d interim responses without final", n, strings.Contains(string(data), "200 OK"), httpMaxInterimResponses)
+	}
+}
+
+func TestHTTPBackendCloseRemoved(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "keep-alive")
+		w.Write([]byte("OK"))
+	})
+	srv1 := httptest.NewServer(handler)
+	defer srv1.Close()
+	srv2 := httptest.NewServer(handler)
+	defer srv2.Close()
+	baseGoroutines := runtime.NumGoroutine()
+
+	seriesCount := func(labels prometheus.Labels) (count int) {
+		for _, vec := range []prometheus.Collector{
+			promHTTPBackendReadBytes,
+			promHTTPBackendRequestsTotal,
+			promHTTPBackendTimeToFirstByteSeconds,
+			promHTTPBackendActiveConnections,
+			promHTTPBackendIdleConnections,
+			promHTTPBackendServerHealth,
+		} {
+			ch := make(chan prometheus.Metric, 128)
+			go func() {
+				vec.Collect(ch)
+				close(ch)
+			}()
+			for m := range ch {
+				var pb dto.Metric
+				m.Write(&pb)
+				matched := 0
+				for _, lp := range pb.GetLabel() {
+					if v, ok := labels[lp.GetName()]; ok && v == lp.GetValue() {
+						matched++
+					}
+				}
+				if matched == len(labels) {
+					count++
+				}
+			}
+		}
+		return
+	}
+
+	opts := HTTPBackendOptions{
+		Name: "removed",
+		HealthCheckHTTPOpts: &hc.HTTPCheckOptions{
+			Path:     "/health",
+			Interval: 50 * time.Millisecond,
+			Timeout:  time.Second,
+		},
+		Servers: []string{srv1.URL, srv2.URL},
+	}
+	b, err := NewHTTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "removed",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fLis := runTestFrontend(t, f)
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		if resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 || body != "OK" {
+			t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "OK")
+		}
+	}
+	fLis.Close()
+	f.Close()
+	time.Sleep(200 * time.Millisecond)
+	for _, server := range opts.Servers {
+		if seriesCount(prometheus.Labels{"backend": "removed", "server": server}) == 0 {
+			t.Fatalf("expected series of server %s before close", server)
+		}
+	}
+
+	// series of the server which the replacement doesn't have are deleted
+	opts.Servers = []string{srv1.URL}
+	bn, err := b.Fork(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bn.Activate()
+	b.Close()
+	if n := seriesCount(prometheus.Labels{"backend": "removed", "server": srv2.URL}); n != 0 {
+		t.Errorf("got %d series of removed server, want 0", n)
+	}
+	if seriesCount(prometheus.Labels{"backend": "removed", "server": srv1.URL}) == 0 {
+		t.Error("expected series of remaining server after fork")
+	}
+
+	// all series are deleted when the backend is removed
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	if err := bn.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bn.Close()
+	if n := seriesCount(prometheus.Labels{"backend": "removed"}); n != 0 {
+		t.Errorf("got %d series of removed backend, want 0", n)
+	}
+	if LookupHTTPBackend("removed") != nil {
+		t.Error("removed backend is still registered")
+	}
+
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > baseGoroutines; i++ {
+		time.Sleep(20 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n > baseGoroutines {
+		t.Errorf("got %d goroutines after removing backend, want at most %d", n, baseGoroutines)
+	}
+}
+
+func TestHTTPBackendReloadInflight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+
+	opts := HTTPBackendOptions{
+		Name:    "reload",
+		Servers: []string{srv.URL},
+	}
+	b, err := NewHTTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "reload",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"outcome": "completed"}
+	base := testCounterSum(promLBReloadInflightRequestsTotal, labels)
+	done := make(chan *HTTPBackend)
+	go func() {
+		<-started
+		bn, err := b.Fork(opts)
+		if err != nil {
+			t.Error(err)
+			close(release)
+			done <- nil
+			return
+		}
+		bn.Activate()
+		if !b.IsRetired() {
+			t.Error("expected replaced backend to be retired")
+		}
+		close(release)
+		ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+		defer ctxCancel()
+		if err := b.Drain(ctx); err != nil {
+			t.Error(err)
+		}
+		b.Close()
+		done <- bn
+	}()
+
+	// the request started before the reload completes on the replaced backend
+	if resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 || body != "OK" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, "OK")
+	}
+	if bn := <-done; bn != nil {
+		bn.Close()
+	}
+	// the frontend closes the connection before it updates metrics
+	n := testCounterSum(promLBReloadInflightRequestsTotal, labels) - base
+	for i := 0; i < 50 && n < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = testCounterSum(promLBReloadInflightRequestsTotal, labels) - base
+	}
+	if n != 1 {
+		t.Errorf("got %v completed in-flight requests on reload, want 1", n)
+	}
+}
@@ -3,39 +3,102 @@ package lb
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	httpBadRequest          = "HTTP/1.0 400 Bad Request\r\n\r\nBad Request\r\n"
 	httpForbidden           = "HTTP/1.0 403 Forbidden\r\n\r\nForbidden\r\n"
+	httpNotFound            = "HTTP/1.0 404 Not Found\r\n\r\nNot Found\r\n"
 	httpRequestTimeout      = "HTTP/1.0 408 Request Timeout\r\n\r\nRequest Timeout\r\n"
+	httpMisdirectedRequest  = "HTTP/1.0 421 Misdirected Request\r\n\r\nMisdirected Request\r\n"
+	httpPayloadTooLarge     = "HTTP/1.0 413 Payload Too Large\r\n\r\nPayload Too Large\r\n"
+	httpHeaderTooLarge      = "HTTP/1.0 431 Request Header Fields Too Large\r\n\r\nRequest Header Fields Too Large\r\n"
+	httpTooManyRequests     = "HTTP/1.0 429 Too Many Requests\r\n\r\nToo Many Requests\r\n"
 	httpBadGateway          = "HTTP/1.0 502 Bad Gateway\r\n\r\nBad Gateway\r\n"
 	httpServiceUnavailable  = "HTTP/1.0 503 Service Unavailable\r\n\r\nService Unavailable\r\n"
 	httpGatewayTimeout      = "HTTP/1.0 504 Gateway Timeout\r\n\r\nGateway Timeout\r\n"
 	httpVersionNotSupported = "HTTP/1.0 505 HTTP Version Not Supported\r\n\r\nHTTP Version Not Supported\r\n"
+	httpLoopDetected        = "HTTP/1.0 508 Loop Detected\r\n\r\nLoop Detected\r\n"
 )
 
+// httpMaxInterimResponses is the maximum number of interim responses forwarded for a request. The request fails when backend server sends more.
+const httpMaxInterimResponses = 8
+
+// httpMaxTrailerBytes is the maximum size of the trailer section of a chunked body
+const httpMaxTrailerBytes = 16 * 1024
+
+// httpClientCheckInterval is the interval of checking whether the client has closed the connection while its request is waiting
+const httpClientCheckInterval = 50 * time.Millisecond
+
 var (
 	httpErrGroupProtocol               = "protocol"
 	httpErrGroupCommunication          = "communication"
+	httpErrGroupClientCommunication    = "client communication"
+	httpErrGroupBackendCommunication   = "backend communication"
+	httpErrGroupBackendProtocol        = "backend protocol"
+	httpErrGroupKeepAliveTimeout       = "keepalive timeout"
+	httpErrGroupRequestBudget          = "request budget"
 	httpErrGroupRestricted             = "restricted"
+	httpErrGroupRateLimited            = "rate limited"
+	httpErrGroupUnmatched              = "unmatched"
+	httpErrGroupStrictHeaderBytes      = "strict header bytes"
+	httpErrGroupStrictMethod           = "strict method"
+	httpErrGroupStrictPathEncoding     = "strict path encoding"
+	httpErrGroupStrictHost             = "strict host"
+	httpErrGroupBasicAuthDenied        = "basic auth denied"
+	httpErrGroupJWTDenied              = "jwt denied"
+	httpErrGroupAuthHookDenied         = "auth hook denied"
+	httpErrGroupAuthHookFailed         = "auth hook failed"
+	httpErrGroupForwardAuthDenied      = "forward auth denied"
+	httpErrGroupForwardAuthFailed      = "forward auth failed"
+	httpErrGroupUpstreamHostDenied     = "upstream host denied"
+	httpErrGroupMethodNotAllowed       = "method not allowed"
+	httpErrGroupViaLoop                = "via loop"
+	httpErrGroupSmuggling              = "smuggling"
+	httpErrGroupTunnelIdleTimeout      = "tunnel idle timeout"
+	httpErrGroupRequestHeaderTooLarge  = "request header too large"
+	httpErrGroupResponseHeaderTooLarge = "response header too large"
+	httpErrGroupRequestBodyTooLarge    = "request body too large"
 	httpErrGroupRequestTimeout         = "request timeout"
+	httpErrGroupReadHeaderTimeout      = "read header timeout"
+	httpErrGroupClientWriteTimeout     = "client write timeout"
+	httpErrGroupRequestBodyTimeout     = "request body timeout"
+	httpErrGroupRequestBodyTruncated   = "request body truncated"
+	httpErrGroupRequestBodyExcess      = "request body excess"
 	httpErrGroupFrontendTimeout        = "frontend timeout"
 	httpErrGroupFrontendExhausted      = "frontend exhausted"
+	httpErrGroupFrontendShutdown       = "frontend shutdown"
+	httpErrGroupProxyProtocol          = "proxy protocol"
 	httpErrGroupBackendTimeout         = "backend timeout"
+	httpErrGroupBackendRespHdrTimeout  = "backend response header timeout"
 	httpErrGroupBackendExhausted       = "backend exhausted"
+	httpErrGroupBackendQueueTimeout    = "backend queue timeout"
+	httpErrGroupBackendShed            = "backend shed"
+	httpErrGroupQueueClientAbort       = "queue client abort"
+	httpErrGroupRouteExhausted         = "route exhausted"
+	httpErrGroupRouteQueueTimeout      = "route queue timeout"
 	httpErrGroupBackendFind            = "backend find"
+	httpErrGroupBackendUnresolved      = "backend unresolved"
 	httpErrGroupBackendServerExhausted = "backend server exhausted"
 	httpErrGroupBackendConnect         = "backend connect"
 	httpErrGroupBackendConnectTimeout  = "backend connect timeout"
+	httpErrGroupBackendTLSPinMismatch  = "backend tls pin mismatch"
+	httpErrGroupResponseTooLarge       = "response_too_large"
 )
 
 var (
@@ -45,14 +108,54 @@ var (
 	errHTTPStatusURI                   = newHTTPError(httpErrGroupProtocol, "invalid status URI")
 	errHTTPStatusVersion               = newHTTPError(httpErrGroupProtocol, "invalid status version")
 	errHTTPRestrictedRequest           = newHTTPError(httpErrGroupRestricted, "restricted request")
+	errHTTPRateLimited                 = newHTTPError(httpErrGroupRateLimited, "request rate limit exceeded")
+	errHTTPUnmatchedRequest            = newHTTPError(httpErrGroupUnmatched, "request doesn't match any route")
+	errHTTPStrictBareCR                = newHTTPError(httpErrGroupStrictHeaderBytes, "bare CR in header block")
+	errHTTPStrictControlByte           = newHTTPError(httpErrGroupStrictHeaderBytes, "control byte in header block")
+	errHTTPStrictMethodToken           = newHTTPError(httpErrGroupStrictMethod, "non-token character in method")
+	errHTTPStrictUnsupportedMethod     = newHTTPError(httpErrGroupStrictMethod, "unsupported method")
+	errHTTPStrictPathEncodingMalformed = newHTTPError(httpErrGroupStrictPathEncoding, "malformed percent-encoding in path")
+	errHTTPStrictPathEncodingForbidden = newHTTPError(httpErrGroupStrictPathEncoding, "forbidden byte percent-encoded in path")
+	errHTTPStrictHostCount             = newHTTPError(httpErrGroupStrictHost, "missing or multiple host")
+	errHTTPStrictHost                  = newHTTPError(httpErrGroupStrictHost, "host isn't a valid DNS name or IP literal")
+	errHTTPBasicAuthDenied             = newHTTPError(httpErrGroupBasicAuthDenied, "invalid basic auth credentials")
+	errHTTPJWTDenied                   = newHTTPError(httpErrGroupJWTDenied, "invalid bearer token")
+	errHTTPAuthHookDenied              = newHTTPError(httpErrGroupAuthHookDenied, "denied by auth hook")
+	errHTTPForwardAuthDenied           = newHTTPError(httpErrGroupForwardAuthDenied, "denied by auth backend")
+	errHTTPUpstreamHostDenied          = newHTTPError(httpErrGroupUpstreamHostDenied, "upstream host not allowed")
+	errHTTPMethodNotAllowed            = newHTTPError(httpErrGroupMethodNotAllowed, "method not allowed")
+	errHTTPViaLoop                     = newHTTPError(httpErrGroupViaLoop, "request loop by via header")
+	errHTTPRedirectMissingHost         = newHTTPError(httpErrGroupProtocol, "missing host to redirect")
+	errHTTPSmugglingObsFold            = newHTTPError(httpErrGroupSmuggling, "obs-folded header line")
+	errHTTPSmugglingHeaderName         = newHTTPError(httpErrGroupSmuggling, "invalid header name")
+	errHTTPSmugglingContentLength      = newHTTPError(httpErrGroupSmuggling, "invalid or conflicting content-length")
+	errHTTPSmugglingTransferEncoding   = newHTTPError(httpErrGroupSmuggling, "transfer-encoding other than chunked")
+	errHTTPSmugglingFraming            = newHTTPError(httpErrGroupSmuggling, "both content-length and transfer-encoding")
+	errHTTPTunnelIdleTimeout           = newHTTPError(httpErrGroupTunnelIdleTimeout, "tunnel idle timeout exceeded")
+	errHTTPHeaderTooLarge              = newHTTPError(httpErrGroupProtocol, "max header bytes exceeded")
+	errHTTPRequestHeaderTooLarge       = newHTTPError(httpErrGroupRequestHeaderTooLarge, "request header too large")
+	errHTTPResponseHeaderTooLarge      = newHTTPError(httpErrGroupResponseHeaderTooLarge, "response header too large")
+	errHTTPRequestBodyTooLarge         = newHTTPError(httpErrGroupRequestBodyTooLarge, "request body exceeds maximum size")
+	errHTTPTooManyInterimResponses     = newHTTPError(httpErrGroupProtocol, "too many interim responses")
 	errHTTPBufferOrder                 = newHTTPError(httpErrGroupProtocol, "buffer order error")
+	errHTTPRequestBodyExcess           = newHTTPError(httpErrGroupRequestBodyExcess, "unexpected data after request body")
 	errHTTPRequestTimeout              = newHTTPError(httpErrGroupRequestTimeout, "request timeout exceeded")
 	errHTTPFrontendTimeout             = newHTTPError(httpErrGroupFrontendTimeout, "timeout exceeded")
 	errHTTPFrontendExhausted           = newHTTPError(httpErrGroupFrontendExhausted, "frontend maximum connection exceeded")
+	errHTTPFrontendShutdown            = newHTTPError(httpErrGroupFrontendShutdown, "shutdown deadline exceeded")
+	errHTTPProxyProtocolHeader         = newHTTPError(httpErrGroupProxyProtocol, "invalid proxy protocol header")
 	errHTTPBackendTimeout              = newHTTPError(httpErrGroupBackendTimeout, "timeout exceeded")
+	errHTTPRequestBudgetExceeded       = newHTTPError(httpErrGroupRequestBudget, "request timeout budget exceeded")
 	errHTTPBackendExhausted            = newHTTPError(httpErrGroupBackendExhausted, "backend maximum connection exceeded")
+	errHTTPBackendQueueTimeout         = newHTTPError(httpErrGroupBackendQueueTimeout, "queue timeout exceeded")
+	errHTTPBackendShed                 = newHTTPError(httpErrGroupBackendShed, "backend maximum queue exceeded")
+	errHTTPQueueClientAbort            = newHTTPError(httpErrGroupQueueClientAbort, "client closed connection while queued")
+	errHTTPRouteExhausted              = newHTTPError(httpErrGroupRouteExhausted, "route maximum concurrent requests exceeded")
+	errHTTPRouteQueueTimeout           = newHTTPError(httpErrGroupRouteQueueTimeout, "route queue timeout exceeded")
 	errHTTPBackendFind                 = newHTTPError(httpErrGroupBackendFind, "unable to find backend server")
+	errHTTPBackendUnresolved           = newHTTPError(httpErrGroupBackendUnresolved, "backend of route name isn't active")
 	errHTTPBackendServerExhausted      = newHTTPError(httpErrGroupBackendServerExhausted, "backend server maximum connection exceeded")
+	errHTTPResponseTooLarge            = newHTTPError(httpErrGroupResponseTooLarge, "response body exceeds maximum size")
 )
 
 type httpError struct {
@@ -81,6 +184,47 @@ func newfHTTPError(group string, format string, args ...interface{}) error {
 	}
 }
 
+// sideHTTPError regroups communication and protocol errors by the groups of the proxy side which produced them
+func sideHTTPError(err error, communicationGroup, protocolGroup string) error {
+	e := (*httpError)(nil)
+	if !errors.As(err, &e) {
+		return err
+	}
+	switch e.Group {
+	case httpErrGroupCommunication:
+		return wrapHTTPError(communicationGroup, e.Err)
+	case httpErrGroupProtocol:
+		return wrapHTTPError(protocolGroup, e.Err)
+	}
+	return err
+}
+
+// clientWriteHTTPError regroups the error of a write to the client, the writes which timed out are grouped separately
+func clientWriteHTTPError(err error) error {
+	if e := (*net.OpError)(nil); errors.As(err, &e) && e.Timeout() {
+		return wrapHTTPError(httpErrGroupClientWriteTimeout, e)
+	}
+	return sideHTTPError(err, httpErrGroupClientCommunication, httpErrGroupProtocol)
+}
+
+// httpErrorClass classifies error group by the party which caused the error
+func httpErrorClass(group string) string {
+	switch group {
+	case "":
+		return ""
+	case httpErrGroupClientCommunication, httpErrGroupRequestBodyTruncated, httpErrGroupQueueClientAbort:
+		return "client_abort"
+	case httpErrGroupRequestTimeout, httpErrGroupReadHeaderTimeout, httpErrGroupRequestBodyTimeout, httpErrGroupKeepAliveTimeout,
+		httpErrGroupClientWriteTimeout:
+		return "client_timeout"
+	case httpErrGroupBackendTimeout, httpErrGroupBackendRespHdrTimeout, httpErrGroupBackendFind, httpErrGroupBackendConnect,
+		httpErrGroupBackendConnectTimeout, httpErrGroupBackendTLSPinMismatch, httpErrGroupBackendCommunication, httpErrGroupBackendProtocol,
+		httpErrGroupRequestBudget, httpErrGroupResponseTooLarge, httpErrGroupResponseHeaderTooLarge:
+		return "backend_error"
+	}
+	return "lb_error"
+}
+
 func (e *httpError) Error() string {
 	if e.Group == "" {
 		return fmt.Sprintf("%v", e.Err)
@@ -98,23 +242,62 @@ type httpReqDesc struct {
 	leHost                string
 	lePort                string
 	leTLS                 bool
+	leTLSDeprecated       bool
+	leTLSWarnHeader       bool
+	leTLSServerName       string
+	leTLSVersion          string
+	leClientCert          *x509.Certificate
+	leClientPEM           bool
 	feName                string
 	feConn                *bufConn
+	feConnCtx             context.Context
+	feReqDeadline         time.Time
 	feStatusLine          string
 	feStatusMethod        string
 	feStatusURI           string
 	feStatusVersion       string
 	feStatusMethodGrouped string
 	feHdr                 http.Header
+	feHdrLines            []httpHeaderLine
 	feURL                 *url.URL
 	feCookies             []*http.Cookie
 	feRemoteIP            string
+	feClientIP            net.IP
 	feRealIP              string
 	feHost                string
 	fePath                string
+	feRoute               *HTTPFrontendRoute
+	feUnmatched           bool
+	feUnresolved          bool
+	feDirect              bool
+	feRateLimited         bool
+	feRetryAfter          time.Duration
+	feReloading           bool
+	feStrippedPrefix      string
+	feThrottle            *throttleWriter
+	feTap                 *httpTapRecord
+	feMirror              *httpMirrorRecord
+	feTimeoutHeader       string
+	feRequestIDHeader     string
+	feRequestID           string
+	feUpgrade             bool
+	feViaPseudonym        string
+	feRequestBodyTimeout  time.Duration
+	feWriteTimeout        time.Duration
+	feMaxHeaderBytes      int64
+	feMaxBodyBytes        int64
+	feTunnelIdleTimeout   time.Duration
+	feWriteProfile        HTTPFrontendWriteProfile
+	feBudgetDeadline      time.Time
+	feRespClaimed         uint32
+	feTunneled            uint32
+	feClose               bool
+	feDrain               bool
+	feDrainHeader         bool
 	beFinal               bool
 	beName                string
 	beServer              string
+	beBackendServer       *backendServer
 	beConn                *bufConn
 	beStatusLine          string
 	beStatusVersion       string
@@ -122,23 +305,39 @@ type httpReqDesc struct {
 	beStatusMsg           string
 	beStatusCodeGrouped   string
 	beHdr                 http.Header
+	beHdrLines            []httpHeaderLine
+	beInterimFirstByte    time.Time
+	beFinalHdrTime        time.Time
 	isTransferErrLogged   uint32
 }
 
+// claimResponse reports whether the caller is the first one to write response to the frontend
+func (r *httpReqDesc) claimResponse() bool {
+	return atomic.CompareAndSwapUint32(&r.feRespClaimed, 0, 1)
+}
+
+// isTunneled reports whether the connections were switched to a tunnel by the backend server. Tunnels are exempt from
+// the request timeouts, they are served in feConnCtx instead.
+func (r *httpReqDesc) isTunneled() bool {
+	return atomic.LoadUint32(&r.feTunneled) != 0
+}
+
 func (r *httpReqDesc) FrontendSummary() string {
-	return fmt.Sprintf("frontend=%q host=%q path=%q method=%q listener=%q remoteaddr=%q",
+	return fmt.Sprintf("frontend=%q host=%q path=%q method=%q listener=%q remoteaddr=%q clientip=%q requestid=%q",
 		r.feName,
 		r.feHost,
 		r.fePath,
 		r.feStatusMethod,
 		r.leName,
 		r.feConn.RemoteAddr().String(),
+		r.clientIPString(),
+		r.feRequestID,
 	)
 }
 
 func (r *httpReqDesc) BackendSummary() string {
 	sFinal := fmt.Sprintf("%v", r.beFinal)
-	return fmt.Sprintf("backend=%q server=%q final=%q code=%q frontend=%q host=%q path=%q method=%q listener=%q remoteaddr=%q",
+	return fmt.Sprintf("backend=%q server=%q final=%q code=%q frontend=%q host=%q path=%q method=%q listener=%q remoteaddr=%q clientip=%q requestid=%q",
 		r.beName,
 		r.beServer,
 		sFinal,
@@ -149,18 +348,39 @@ func (r *httpReqDesc) BackendSummary() string {
 		r.feStatusMethod,
 		r.leName,
 		r.feConn.RemoteAddr().String(),
+		r.clientIPString(),
+		r.feRequestID,
 	)
 }
 
-func splitHTTPHeader(rd *bufio.Reader) (statusLine string, hdr http.Header, nr int64, err error) {
+// clientIPString returns the client IP of the request, or empty string if it isn't known yet
+func (r *httpReqDesc) clientIPString() string {
+	if r.feClientIP == nil {
+		return ""
+	}
+	return r.feClientIP.String()
+}
+
+// httpHeaderLine is a header field line as it was read. Name and Value are substrings of Line, Key is the canonical form of Name.
+type httpHeaderLine struct {
+	Line  string
+	Name  string
+	Key   string
+	Value string
+}
+
+// splitHTTPHeader reads the header block from rd. It fails with errHTTPHeaderTooLarge if the status line, the fields
+// and the empty line ending them are longer than maxBytes.
+func splitHTTPHeader(rd *bufio.Reader, maxBytes int64) (statusLine string, hdr http.Header, lines []httpHeaderLine, nr int64, err error) {
 	hdr = make(http.Header, 16)
+	lines = make([]httpHeaderLine, 0, 16)
 	line := []byte(nil)
 	for {
 		var ln []byte
 		ln, err = rd.ReadSlice('\n')
 		nr += int64(len(ln))
-		if nr > maxHTTPHeadersLen {
-			err = newHTTPError(httpErrGroupProtocol, "max headers length exceeded")
+		if nr > maxBytes {
+			err = errHTTPHeaderTooLarge
 			break
 		}
 		if err != nil && err != bufio.ErrBufferFull {
@@ -186,15 +406,19 @@ func splitHTTPHeader(rd *bufio.Reader) (statusLine string, hdr http.Header, nr i
 			break
 		}
 		if statusLine != "" {
-			idx := bytes.IndexByte(line, ':')
-			name, value := "", ""
+			ln := httpHeaderLine{
+				Line: string(line),
+			}
+			idx := strings.IndexByte(ln.Line, ':')
 			if idx < 0 {
-				name = string(line)
+				ln.Name = ln.Line
 			} else {
-				name = string(line[:idx])
-				value = string(bytes.TrimLeft(line[idx+1:], " "))
+				ln.Name = ln.Line[:idx]
+				ln.Value = strings.TrimLeft(ln.Line[idx+1:], " ")
 			}
-			hdr.Add(name, value)
+			ln.Key = http.CanonicalHeaderKey(ln.Name)
+			hdr[ln.Key] = append(hdr[ln.Key], ln.Value)
+			lines = append(lines, ln)
 		} else {
 			statusLine = string(line)
 		}
@@ -203,7 +427,65 @@ func splitHTTPHeader(rd *bufio.Reader) (statusLine string, hdr http.Header, nr i
 	return
 }
 
-func writeHTTPHeader(dst io.Writer, srcStatusLine string, srcHdr http.Header) (nw int64, err error) {
+// writeHTTPHeaderFields writes hdr by the order, casing and duplicates of the lines which it has been read from.
+// The lines of unchanged fields are written as they were read, and values added to them are written after their last line.
+// Other changed fields are written at the place of their first line, the new fields are written at the end.
+func writeHTTPHeaderFields(dst io.Writer, hdr http.Header, lines []httpHeaderLine) (err error) {
+	if len(lines) == 0 {
+		return hdr.Write(dst)
+	}
+	origValues := make(map[string][]string, len(lines))
+	for _, ln := range lines {
+		origValues[ln.Key] = append(origValues[ln.Key], ln.Value)
+	}
+	written := make(map[string]int, len(origValues))
+	for _, ln := range lines {
+		values, ok := hdr[ln.Key]
+		if !ok {
+			continue
+		}
+		orig := origValues[ln.Key]
+		n, prefix := written[ln.Key], len(values) >= len(orig)
+		for i := 0; prefix && i < len(orig); i++ {
+			prefix = values[i] == orig[i]
+		}
+		switch {
+		case prefix:
+			// header injection must not be possible by invalid names or bare CRs, those lines are sanitized like other fields
+			if ln.Name != "" && strings.IndexFunc(ln.Name, isNotToken) < 0 && strings.IndexByte(ln.Line, '\r') < 0 {
+				_, err = io.WriteString(dst, ln.Line+"\r\n")
+			} else {
+				err = http.Header{ln.Name: {ln.Value}}.Write(dst)
+			}
+			if err != nil {
+				return
+			}
+			n++
+			if n == len(orig) && len(values) > n {
+				err = http.Header{ln.Name: values[n:]}.Write(dst)
+				if err != nil {
+					return
+				}
+			}
+		case n == 0:
+			n++
+			err = http.Header{ln.Name: values}.Write(dst)
+			if err != nil {
+				return
+			}
+		}
+		written[ln.Key] = n
+	}
+	newHdr := make(http.Header, len(hdr))
+	for k, v := range hdr {
+		if _, ok := origValues[k]; !ok {
+			newHdr[k] = v
+		}
+	}
+	return newHdr.Write(dst)
+}
+
+func writeHTTPHeader(dst io.Writer, srcStatusLine string, srcHdr http.Header, srcLines []httpHeaderLine, flush bool) (nw int64, err error) {
 	dstSW := &statsWriter{
 		W: dst,
 	}
@@ -213,7 +495,7 @@ func writeHTTPHeader(dst io.Writer, srcStatusLine string, srcHdr http.Header) (n
 		err = wrapHTTPError(httpErrGroupCommunication, err)
 		return
 	}
-	err = srcHdr.Write(dstSW)
+	err = writeHTTPHeaderFields(dstSW, srcHdr, srcLines)
 	if err != nil {
 		nw = dstSW.N
 		err = wrapHTTPError(httpErrGroupCommunication, err)
@@ -224,7 +506,7 @@ func writeHTTPHeader(dst io.Writer, srcStatusLine string, srcHdr http.Header) (n
 		nw = dstSW.N
 		return
 	}
-	if dstWr, ok := dst.(*bufio.Writer); ok {
+	if dstWr, ok := dst.(*bufio.Writer); ok && flush {
 		if e := dstWr.Flush(); e != nil && err == nil {
 			err = wrapHTTPError(httpErrGroupCommunication, e)
 		}
@@ -233,20 +515,41 @@ func writeHTTPHeader(dst io.Writer, srcStatusLine string, srcHdr http.Header) (n
 	return
 }
 
-func writeHTTPBody(dst io.Writer, src *bufio.Reader, contentLength int64, transferEncoding string) (nw int64, err error) {
+// writeHTTPBody copies the body from src to dst, and flushes dst at the end. If flushEach is true, dst is flushed after every read from src.
+func writeHTTPBody(dst io.Writer, src *bufio.Reader, contentLength int64, transferEncoding string, flushEach bool) (nw int64, err error) {
+	return writeHTTPBodyMax(dst, src, contentLength, transferEncoding, flushEach, -1)
+}
+
+// writeHTTPBodyMax is like writeHTTPBody, but it fails with errHTTPResponseTooLarge after maxSize bytes of decoded body.
+// Negative maxSize means unlimited.
+func writeHTTPBodyMax(dst io.Writer, src *bufio.Reader, contentLength int64, transferEncoding string, flushEach bool, maxSize int64) (nw int64, err error) {
 	if contentLength == 0 {
 		return
 	}
+	limit := func(r io.Reader) io.Reader {
+		if maxSize < 0 {
+			return r
+		}
+		return &maxBytesReader{R: r, N: maxSize}
+	}
+	var dstFl flusher
+	if flushEach {
+		dstFl, _ = dst.(flusher)
+	}
 	switch transferEncoding {
 	case "":
+		var dstW io.Writer = dst
+		if dstFl != nil {
+			dstW = &flushWriter{W: dst, F: dstFl}
+		}
 		if contentLength < 0 {
-			nw, err = io.Copy(dst, src)
+			nw, err = io.Copy(dstW, limit(src))
 			if err == nil {
 				err = errExpectedEOF
 			}
 			err = wrapHTTPError(httpErrGroupCommunication, err)
 		} else {
-			nw, err = io.CopyN(dst, src, contentLength)
+			nw, err = io.CopyN(dstW, src, contentLength)
 			if err != nil {
 				err = wrapHTTPError(httpErrGroupCommunication, err)
 			}
@@ -257,42 +560,28 @@ func writeHTTPBody(dst io.Writer, src *bufio.Reader, contentLength int64, transf
 			W: dst,
 		}
 		dstCk := httputil.NewChunkedWriter(dstSW)
-		_, err = io.Copy(dstCk, srcCk)
-		if err != nil {
-			nw = dstSW.N
-			err = wrapHTTPError(httpErrGroupCommunication, err)
-			break
-		}
-		err = dstCk.Close()
-		if err != nil {
-			nw = dstSW.N
-			err = wrapHTTPError(httpErrGroupCommunication, err)
-			break
+		var dstW io.Writer = dstCk
+		if dstFl != nil {
+			dstW = &flushWriter{W: dstCk, F: dstFl}
 		}
-		var crlfBuf [2]byte
-		var n int
-		n, err = src.Read(crlfBuf[:])
+		_, err = io.Copy(dstW, limit(srcCk))
 		if err != nil {
 			nw = dstSW.N
 			err = wrapHTTPError(httpErrGroupCommunication, err)
 			break
 		}
-		if n <= 0 || string(crlfBuf[:n]) != "\r\n" {
-			nw = dstSW.N
-			err = errHTTPChunkedTransferEncoding
-			break
-		}
-		_, err = dstSW.Write(crlfBuf[:n])
+		err = dstCk.Close()
 		if err != nil {
 			nw = dstSW.N
 			err = wrapHTTPError(httpErrGroupCommunication, err)
 			break
 		}
+		err = writeHTTPTrailer(dstSW, src)
 		nw = dstSW.N
 	default:
 		err = errHTTPUnsupportedTransferEncoding
 	}
-	if dstWr, ok := dst.(*bufio.Writer); ok {
+	if dstWr, ok := dst.(flusher); ok {
 		if e := dstWr.Flush(); e != nil && err == nil {
 			err = wrapHTTPError(httpErrGroupCommunication, e)
 		}
@@ -300,23 +589,227 @@ func writeHTTPBody(dst io.Writer, src *bufio.Reader, contentLength int64, transf
 	return
 }
 
-func normalizePath(path string) string {
+// writeHTTPTrailer copies the trailer section of a chunked body, which ends with an empty line, from src to dst. The
+// fields are copied as they are read, eg grpc-status of gRPC responses. Obs-folded lines, bare CRs and larger sections
+// than httpMaxTrailerBytes are rejected with errHTTPChunkedTransferEncoding.
+func writeHTTPTrailer(dst io.Writer, src *bufio.Reader) (err error) {
+	size := 0
 	for {
-		pathFirst := path
-		path = doubleslashRgx.ReplaceAllLiteralString(path, `/`)
-		path = slashDotRgx.ReplaceAllLiteralString(path, `/`)
-		if path == pathFirst {
-			break
+		var line []byte
+		line, err = src.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				return errHTTPChunkedTransferEncoding
+			}
+			return wrapHTTPError(httpErrGroupCommunication, err)
+		}
+		size += len(line)
+		fields := line[:len(line)-1]
+		if size > httpMaxTrailerBytes || len(fields) == 0 || fields[len(fields)-1] != '\r' {
+			return errHTTPChunkedTransferEncoding
+		}
+		fields = fields[:len(fields)-1]
+		if len(fields) > 0 && (fields[0] == ' ' || fields[0] == '\t' || bytes.IndexByte(fields, ':') <= 0 || bytes.IndexByte(fields, '\r') >= 0) {
+			return errHTTPChunkedTransferEncoding
+		}
+		if _, err = dst.Write(line); err != nil {
+			return wrapHTTPError(httpErrGroupCommunication, err)
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+	}
+}
+
+// normalizePath returns the form of the escaped path which routes and restrictions are matched against.
+// It percent-decodes path except %2F, which stays encoded to not introduce a new segment, collapses duplicate
+// slashes and removes dot segments as RFC 3986 section 5.2.4. Invalid escapes are left as is and decoded bytes
+// aren't decoded again, so an overlong UTF-8 sequence like %c0%ae or a double-encoded %252e never become a dot.
+func normalizePath(path string) string {
+	var sb strings.Builder
+	sb.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '%' && i+2 < len(path) && isHexDigit(path[i+1]) && isHexDigit(path[i+2]) {
+			c = unhexDigit(path[i+1])<<4 | unhexDigit(path[i+2])
+			i += 2
+			if c == '/' {
+				sb.WriteString("%2F")
+				continue
+			}
+		}
+		sb.WriteByte(c)
+	}
+	path = sb.String()
+	for strings.Contains(path, "//") {
+		path = strings.Replace(path, "//", "/", -1)
+	}
+	return removeDotSegments(path)
+}
+
+// removeDotSegments removes "." and ".." segments from path as RFC 3986 section 5.2.4.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segs := strings.Split(path, "/")
+	out := make([]string, 0, len(segs))
+	for i, seg := range segs {
+		switch seg {
+		case ".":
+		case "..":
+			if len(out) > 1 || (len(out) == 1 && out[0] != "") {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, seg)
+			continue
+		}
+		if i == len(segs)-1 {
+			out = append(out, "")
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhexDigit(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+// stripURIPrefix removes path prefix from uri. The prefix is matched case-insensitively like route paths. It reports
+// false if uri isn't under prefix.
+func stripURIPrefix(uri, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || len(uri) < len(prefix) || !strings.EqualFold(uri[:len(prefix)], prefix) {
+		return uri, false
+	}
+	rest := uri[len(prefix):]
+	switch {
+	case rest == "":
+		return "/", true
+	case rest[0] == '/':
+		return rest, true
+	case rest[0] == '?':
+		return "/" + rest, true
+	}
+	return uri, false
+}
+
+// rewriteURIPath replaces the matches of rgx in the path of uri with replacement, which may contain $1-style capture
+// groups. A query in the result is joined with the query of uri, and an empty path becomes "/". uri is returned as is
+// if it isn't in origin-form.
+func rewriteURIPath(uri string, rgx *regexp.Regexp, replacement string) string {
+	if !strings.HasPrefix(uri, "/") {
+		return uri
+	}
+	path, query := uri, ""
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		path, query = uri[:i], uri[i+1:]
+	}
+	path = rgx.ReplaceAllString(path, replacement)
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		switch newQuery := path[i+1:]; {
+		case query == "":
+			query = newQuery
+		case newQuery != "":
+			query = newQuery + "&" + query
 		}
-		pathFirst = path
+		path = path[:i]
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if query != "" || strings.IndexByte(uri, '?') >= 0 {
+		return path + "?" + query
 	}
 	return path
 }
 
+// parseTimeoutHeader parses a request timeout header value in milliseconds
+func parseTimeoutHeader(value string) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
 func uriToPath(uri string) string {
 	return normalizePath(strings.SplitN(uri, "?", 2)[0])
 }
 
+// isTrustedProxy reports whether ip is contained by any network of trusted
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP returns the client IP of the request which is received from peer. If peer is a trusted proxy, it
+// is the right-most entry of Forwarded headers, or X-Forwarded-For headers without Forwarded, which isn't a trusted
+// proxy, or the left-most entry if all of them are trusted. The entries on the left of an invalid entry aren't used,
+// and malformed Forwarded headers aren't used at all. The headers aren't used if peer isn't trusted, so clients can't
+// spoof them.
+func forwardedClientIP(peer net.IP, hdr http.Header, trusted []*net.IPNet) net.IP {
+	if peer == nil || !isTrustedProxy(peer, trusted) {
+		return peer
+	}
+	var entries []net.IP
+	if values := hdr["Forwarded"]; len(values) > 0 {
+		elements, ok := parseForwarded(values)
+		if !ok {
+			return peer
+		}
+		for _, element := range elements {
+			entries = append(entries, parseForwardedNode(element["for"]))
+		}
+	} else {
+		for _, value := range hdr["X-Forwarded-For"] {
+			for _, entry := range strings.Split(value, ",") {
+				entry = strings.TrimSpace(entry)
+				if host, _, err := net.SplitHostPort(entry); err == nil {
+					entry = host
+				}
+				entries = append(entries, net.ParseIP(entry))
+			}
+		}
+	}
+	ip := peer
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i] == nil {
+			return ip
+		}
+		ip = entries[i]
+		if !isTrustedProxy(ip, trusted) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// uriToQuery returns the raw query of uri without "?"
+func uriToQuery(uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		return uri[i+1:]
+	}
+	return ""
+}
+
 func httpContentLength(hdr http.Header) (contentLength int64, err error) {
 	contentLength = -1
 	s := hdr.Get("Content-Length")
@@ -349,20 +842,31 @@ func groupHTTPStatusCode(code string) string {
 	return string(c) + "xx"
 }
 
-func groupHTTPStatusMethod(method string) string {
-	groupped := method
-	switch groupped {
-	case "GET":
-	case "HEAD":
-	case "POST":
-	case "PUT":
-	case "DELETE":
-	case "CONNECT":
-	case "OPTIONS":
-	case "TRACE":
-	case "PATCH":
-	default:
-		groupped = "unknown"
+// httpDefaultAllowedMethods are the methods which frontends allow by default
+var httpDefaultAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPatch,
+}
+
+// httpOtherMethod is the grouped method of methods which aren't allowed
+const httpOtherMethod = "OTHER"
+
+// groupHTTPStatusMethod returns the method if it is in allowed methods, otherwise httpOtherMethod
+func groupHTTPStatusMethod(method string, allowedMethods map[string]struct{}) string {
+	if _, ok := allowedMethods[method]; !ok {
+		return httpOtherMethod
 	}
-	return groupped
+	return method
+}
+
+// httpMethodNotAllowed returns the 405 response which has given allowed methods in its Allow header
+func httpMethodNotAllowed(allow string) string {
+	return "HTTP/1.0 405 Method Not Allowed\r\nAllow: " + allow + "\r\n\r\nMethod Not Allowed\r\n"
 }
@@ -0,0 +1,249 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testReadRawHeader reads a raw header with its terminating empty line
+func testReadRawHeader(rd *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := rd.ReadString('\n')
+		buf.WriteString(line)
+		if err != nil {
+			return buf.String(), err
+		}
+		if line == "\r\n" {
+			return buf.String(), nil
+		}
+	}
+}
+
+func TestHTTPHeaderForwarding(t *testing.T) {
+	wantReq, err := ioutil.ReadFile("testdata/header_forwarding_request.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadFile("testdata/header_forwarding_response.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("0123456789abcdef", 64)
+
+	reqCh := make(chan string, 1)
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		hdr, err := testReadRawHeader(rd)
+		if err != nil {
+			return
+		}
+		body := make([]byte, 3)
+		if _, err := io.ReadFull(rd, body); err != nil {
+			return
+		}
+		reqCh <- hdr + string(body)
+		conn.Write([]byte(strings.Replace(string(resp), "{{long}}", long, -1) + "OK"))
+		rd.ReadByte()
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "headers",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "headers",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST /sig?x=1 HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"x-custom: a\r\n" +
+		"X-Other: 1\r\n" +
+		"X-CUSTOM: b\r\n" +
+		"X-Signature:   spaced  value  \r\n" +
+		"x-long: " + long + "\r\n" +
+		"x-forwarded-for: 192.0.2.1\r\n" +
+		"Keep-Alive: timeout=5\r\n" +
+		"x-custom: c\r\n" +
+		"Content-Length: 3\r\n" +
+		"\r\n" +
+		"abc"))
+	rd := bufio.NewReader(conn)
+	gotResp, err := testReadRawHeader(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(fLis.Addr().String())
+	want := strings.Replace(strings.Replace(string(wantReq), "{{long}}", long, -1), "{{port}}", port, -1)
+	if got := <-reqCh; got != want {
+		t.Errorf("backend got request\n%q\nwant\n%q", got, want)
+	}
+	want = strings.Replace(strings.Replace(string(resp), "{{long}}", long, -1), "Keep-Alive: timeout=5\r\n", "", -1)
+	if gotResp != want {
+		t.Errorf("client got response\n%q\nwant\n%q", gotResp, want)
+	}
+}
+
+func TestWriteHTTPHeaderFields(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nx-a: 1\r\nX-B: 2\r\nx-A: 3\r\nBad Name: x\r\nX-C: 4\r\nX-D: a\rb\r\n\r\n"
+	for _, tc := range []struct {
+		name   string
+		modify func(hdr http.Header)
+		want   string
+	}{
+		{"unchanged", func(hdr http.Header) {}, "x-a: 1\r\nX-B: 2\r\nx-A: 3\r\nX-C: 4\r\nX-D: a b\r\n"},
+		{"set", func(hdr http.Header) { hdr.Set("X-A", "5") }, "x-a: 5\r\nX-B: 2\r\nX-C: 4\r\nX-D: a b\r\n"},
+		{"add", func(hdr http.Header) { hdr.Add("X-A", "5") }, "x-a: 1\r\nX-B: 2\r\nx-A: 3\r\nx-A: 5\r\nX-C: 4\r\nX-D: a b\r\n"},
+		{"del", func(hdr http.Header) { hdr.Del("X-B") }, "x-a: 1\r\nx-A: 3\r\nX-C: 4\r\nX-D: a b\r\n"},
+		{"new", func(hdr http.Header) { hdr.Set("X-Z", "6"); hdr.Set("X-Y", "7") }, "x-a: 1\r\nX-B: 2\r\nx-A: 3\r\nX-C: 4\r\nX-D: a b\r\nX-Y: 7\r\nX-Z: 6\r\n"},
+		{"injection", func(hdr http.Header) { hdr.Set("X-B", "2\r\nX-Injected: 1") }, "x-a: 1\r\nX-B: 2  X-Injected: 1\r\nx-A: 3\r\nX-C: 4\r\nX-D: a b\r\n"},
+	} {
+		_, hdr, lines, _, err := splitHTTPHeader(bufio.NewReader(strings.NewReader(raw)), maxHTTPHeadersLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.modify(hdr)
+		var buf bytes.Buffer
+		if err := writeHTTPHeaderFields(&buf, hdr, lines); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, cidr := range []string{"127.0.0.0/8", "10.0.0.0/8"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, network)
+	}
+	for _, tc := range []struct {
+		peer string
+		xff  []string
+		want string
+	}{
+		{"127.0.0.1", nil, "127.0.0.1"},
+		{"127.0.0.1", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"127.0.0.1", []string{"198.51.100.1, 203.0.113.1, 10.0.0.1"}, "203.0.113.1"},
+		{"127.0.0.1", []string{"198.51.100.1", "203.0.113.1:1234, 10.0.0.1"}, "203.0.113.1"},
+		{"127.0.0.1", []string{"10.0.0.2, 10.0.0.1"}, "10.0.0.2"},
+		{"127.0.0.1", []string{"198.51.100.1, garbage, 10.0.0.1"}, "10.0.0.1"},
+		{"192.0.2.1", []string{"203.0.113.1"}, "192.0.2.1"},
+	} {
+		hdr := http.Header{}
+		for _, v := range tc.xff {
+			hdr.Add("X-Forwarded-For", v)
+		}
+		if got := forwardedClientIP(net.ParseIP(tc.peer), hdr, trusted); !got.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("peer %s xff %q: got %v, want %s", tc.peer, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"", ""},
+		{"*", "*"},
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"//a///b//", "/a/b/"},
+		{"/a/./b/.", "/a/b/"},
+		{"/a/b/../c", "/a/c"},
+		{"/a/b/..", "/a/"},
+		{"/../../a", "/a"},
+		{"/a//../b", "/b"},
+		{"/.hidden/..a/b..", "/.hidden/..a/b.."},
+		{"/%61dmin", "/admin"},
+		{"/%2e%2E/admin", "/admin"},
+		{"/x/%2e%2e/admin", "/admin"},
+		{"/x/.%2e/%2e/admin", "/admin"},
+		{"/%2fadmin", "/%2Fadmin"},
+		{"/a%2F..%2fadmin", "/a%2F..%2Fadmin"},
+		{"/x/%252e%252e/admin", "/x/%2e%2e/admin"},
+		{"/x/%c0%ae%c0%ae/admin", "/x/\xc0\xae\xc0\xae/admin"},
+		{"/x/%e0%80%ae/admin", "/x/\xe0\x80\xae/admin"},
+		{"/%zz/%4", "/%zz/%4"},
+	} {
+		if got := normalizePath(tc.path); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPForwardedHeaders(t *testing.T) {
+	names := []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port", "X-Forwarded-Prefix", "X-Real-IP"}
+	b, closer := newTestHTTPBackend(t, "forwardedheaders", func(w http.ResponseWriter, r *http.Request) {
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, strings.Join(r.Header[http.CanonicalHeaderKey(name)], ","))
+		}
+		w.Write([]byte(strings.Join(values, "|")))
+	})
+	defer closer()
+
+	for _, tc := range []struct {
+		mode HTTPFrontendForwardedHeaders
+		want string
+	}{
+		{HTTPFrontendForwardedHeadersAppend, "192.0.2.1, 127.0.0.1|https|public.example.com|443|/app|192.0.2.2"},
+		{HTTPFrontendForwardedHeadersStrip, "127.0.0.1|http|example.com|{{port}}||127.0.0.1"},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:             "forwardedheaders",
+			DefaultBackend:   b,
+			ForwardedHeaders: tc.mode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+		_, port, _ := net.SplitHostPort(fLis.Addr().String())
+		_, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+
+			"X-Forwarded-For: 192.0.2.1\r\n"+
+			"X-Forwarded-Proto: https\r\n"+
+			"X-Forwarded-Host: public.example.com\r\n"+
+			"X-Forwarded-Port: 443\r\n"+
+			"X-Forwarded-Prefix: /app\r\n"+
+			"X-Real-IP: 192.0.2.2\r\n"+
+			"\r\n")
+		if want := strings.Replace(tc.want, "{{port}}", port, -1); body != want {
+			t.Errorf("mode %d: backend got forwarded headers %q, want %q", tc.mode, body, want)
+		}
+		fLis.Close()
+		f.Close()
+	}
+}
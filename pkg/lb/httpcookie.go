@@ -46,6 +46,21 @@ func readCookies(h http.Header, filter string) []*http.Cookie {
 	return cookies
 }
 
+// hasSetCookie reports whether the Set-Cookie lines of h have a cookie with given name
+func hasSetCookie(h http.Header, name string) bool {
+	for _, line := range h["Set-Cookie"] {
+		part := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		j := strings.Index(part, "=")
+		if j < 0 {
+			continue
+		}
+		if strings.TrimSpace(part[:j]) == name {
+			return true
+		}
+	}
+	return false
+}
+
 func parseCookieValue(raw string, allowDoubleQuote bool) (string, bool) {
 	// Strip the quotes, if present.
 	if allowDoubleQuote && len(raw) > 1 && raw[0] == '"' && raw[len(raw)-1] == '"' {
@@ -2,11 +2,16 @@ package lb
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,85 +19,842 @@ import (
 
 	"github.com/goinsane/xlog"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simult/simult/pkg/sockopt"
 )
 
+// HTTPFrontendUnmatchedAction is type of actions for the requests which don't match any route
+type HTTPFrontendUnmatchedAction int
+
+const (
+	// HTTPFrontendUnmatchedActionDefaultBackend defines default-backend unmatched request action
+	HTTPFrontendUnmatchedActionDefaultBackend = HTTPFrontendUnmatchedAction(iota)
+
+	// HTTPFrontendUnmatchedActionNotFound defines 404 unmatched request action
+	HTTPFrontendUnmatchedActionNotFound
+
+	// HTTPFrontendUnmatchedActionMisdirected defines 421 unmatched request action
+	HTTPFrontendUnmatchedActionMisdirected
+
+	// HTTPFrontendUnmatchedActionClose defines close unmatched request action
+	HTTPFrontendUnmatchedActionClose
+)
+
+// HTTPFrontendWriteProfile is type of socket options and flush strategies for the client and backend connections of a frontend
+type HTTPFrontendWriteProfile int
+
+const (
+	// HTTPFrontendWriteProfileDefault defines default write profile, TCP_NODELAY is set and headers are flushed before bodies
+	HTTPFrontendWriteProfileDefault = HTTPFrontendWriteProfile(iota)
+
+	// HTTPFrontendWriteProfileLowLatency defines low-latency write profile, TCP_NODELAY is set and every read of bodies is flushed
+	HTTPFrontendWriteProfileLowLatency
+
+	// HTTPFrontendWriteProfileThroughput defines throughput write profile, TCP_NODELAY is cleared, headers are flushed with bodies
+	// and sockets are corked while a message is written on Linux
+	HTTPFrontendWriteProfileThroughput
+)
+
+// HTTPFrontendForwardedHeaders is type of handling of the client-supplied X-Forwarded-* and X-Real-IP headers toward backends
+type HTTPFrontendForwardedHeaders int
+
+const (
+	// HTTPFrontendForwardedHeadersAppend defines append mode for chained proxies, the peer address is appended to
+	// X-Forwarded-For and the client-supplied X-Forwarded-Proto, X-Forwarded-Host, X-Forwarded-Port and X-Real-IP are kept
+	HTTPFrontendForwardedHeadersAppend = HTTPFrontendForwardedHeaders(iota)
+
+	// HTTPFrontendForwardedHeadersStrip defines strip mode for edge deployments, the client-supplied headers and Forwarded
+	// are removed and set by the peer address and the listener
+	HTTPFrontendForwardedHeadersStrip
+)
+
+// httpForwardedHeaders are the headers which are removed in strip mode of forwarded headers
+var httpForwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Prefix",
+	"X-Real-IP",
+}
+
+// httpFrontendUnmatchedHost is the host label of the requests which don't match any route and aren't sent to the default backend
+const httpFrontendUnmatchedHost = "<unmatched>"
+
 // HTTPFrontendRestriction defines HTTP frontend restriction
 type HTTPFrontendRestriction struct {
-	Network  *net.IPNet
-	Path     string
-	Invert   bool
-	AndAfter bool
+	Network                *net.IPNet
+	NetworkListFile        string
+	Path                   string
+	Query                  string
+	Methods                []string
+	HeaderName             string
+	HeaderValue            string
+	RateLimit              HTTPFrontendRateLimit
+	TimeWindow             HTTPFrontendTimeWindow
+	Countries              []string
+	InvertCountries        bool
+	RestrictUnknownCountry bool
+	ClientCertSubject      string
+	Invert                 bool
+	AndAfter               bool
+
+	pathRgx     *regexp.Regexp
+	queryRgx    *regexp.Regexp
+	methods     map[string]struct{}
+	headerName  string
+	headerRgx   *regexp.Regexp
+	subjectRgx  *regexp.Regexp
+	networkList *httpNetworkList
+	rateLimiter *httpRateLimiter
+	timeWindow  *httpTimeWindow
+	countries   httpCountrySet
+	geoIP       GeoIPLookup
+}
+
+// match reports whether the restriction applies to the request of given peer IP, path, raw query, uppercase method,
+// header and verified client certificate at the current time. Every present condition is inverted by Invert separately, and the restriction applies if any of them
+// holds. A nil IP is the unknown peer address of a non-TCP connection, and it isn't contained by any network. A
+// missing header or client certificate doesn't match.
+func (r *HTTPFrontendRestriction) match(ip net.IP, path, query, method string, hdr http.Header, cert *x509.Certificate) (ok bool) {
+	if r.Network != nil {
+		c := ip != nil && r.Network.Contains(ip)
+		ok = ok || c != r.Invert
+	}
+	if r.networkList != nil {
+		c := ip != nil && r.networkList.Contains(ip)
+		ok = ok || c != r.Invert
+	}
+	if r.pathRgx != nil {
+		c := r.pathRgx.MatchString(path) || r.pathRgx.MatchString(path+"/")
+		ok = ok || c != r.Invert
+	}
+	if r.queryRgx != nil {
+		c := r.queryRgx.MatchString(query)
+		ok = ok || c != r.Invert
+	}
+	if r.methods != nil {
+		_, c := r.methods[method]
+		ok = ok || c != r.Invert
+	}
+	if r.headerRgx != nil {
+		c := false
+		for _, value := range hdr[r.headerName] {
+			if r.headerRgx.MatchString(strings.ToLower(value)) {
+				c = true
+				break
+			}
+		}
+		ok = ok || c != r.Invert
+	}
+	if r.subjectRgx != nil {
+		c := cert != nil && r.subjectRgx.MatchString(strings.ToLower(cert.Subject.String()))
+		ok = ok || c != r.Invert
+	}
+	if r.timeWindow != nil {
+		c := r.timeWindow.Contains(r.timeWindow.clock.Now())
+		ok = ok || c != r.Invert
+	}
+	if r.countries != nil {
+		ok = ok || r.matchCountry(ip)
+	}
+	return
+}
+
+// hasCondition reports whether the restriction has any condition
+func (r *HTTPFrontendRestriction) hasCondition() bool {
+	return r.Network != nil || r.networkList != nil || r.pathRgx != nil || r.queryRgx != nil || r.methods != nil || r.headerRgx != nil || r.subjectRgx != nil || r.timeWindow != nil || r.countries != nil
+}
 
-	pathRgx *regexp.Regexp
+// isHTTPRestricted evaluates the restrictions in order for the request of given peer IP, path, raw query, method,
+// header and verified client certificate. Rate limit restrictions aren't evaluated.
+// A restriction whose AndAfter is set is combined with the next one by AND, so consecutive restrictions form a chain
+// which ends with the first restriction whose AndAfter is cleared, or with the last restriction. Chains are combined
+// by OR, and the request is restricted if every restriction of any chain applies.
+func isHTTPRestricted(restrictions []HTTPFrontendRestriction, ip net.IP, path, query, method string, hdr http.Header, cert *x509.Certificate) bool {
+	chainOK, chained := true, false
+	for i := range restrictions {
+		restriction := &restrictions[i]
+		if restriction.rateLimiter != nil {
+			continue
+		}
+		chainOK = chainOK && restriction.match(ip, path, query, method, hdr, cert)
+		chained = true
+		if !restriction.AndAfter {
+			if chainOK {
+				return true
+			}
+			chainOK, chained = true, false
+		}
+	}
+	return chained && chainOK
 }
 
 // HTTPFrontendRoute defines HTTP frontend route
 type HTTPFrontendRoute struct {
-	Host         string
-	Path         string
-	Backend      *HTTPBackend
-	Backup       *HTTPBackend
-	Restrictions []HTTPFrontendRestriction
+	Host                      string
+	Hosts                     []string
+	Path                      string
+	Query                     string
+	HostIsRegexp              bool
+	PathIsRegexp              bool
+	Priority                  int
+	Methods                   []string
+	Headers                   map[string]string
+	Backend                   *HTTPBackend
+	Backup                    *HTTPBackend
+	BackendName               string
+	BackupName                string
+	Backends                  []HTTPFrontendWeightedBackend
+	Restrictions              []HTTPFrontendRestriction
+	DeniedStatusCode          int
+	DeniedBody                string
+	DeniedRetryAfter          time.Duration
+	ContinueOnRestricted      bool
+	Timeout                   time.Duration
+	ResponseHeaderTimeout     time.Duration
+	MaxResponseBodySize       int64
+	MaxBodyBytes              int64
+	StatusMap                 map[int]int
+	StatusMapBodies           map[int]string
+	StripPathPrefix           string
+	SetHost                   string
+	RequestHeaders            []HTTPFrontendHeaderOp
+	ResponseHeaders           []HTTPFrontendHeaderOp
+	RewriteLocation           bool
+	MaxResponseBytesPerSecond int64
+	PerClientBytesPerSecond   int64
+	BucketProfile             string
+	CoalesceRequests          bool
+	CoalesceMaxBytes          int64
+	MaxConcurrent             int
+	MaxQueue                  int
+	QueueTimeout              time.Duration
+	GRPC                      bool
+	AuthHook                  struct {
+		Script          string
+		Timeout         time.Duration
+		MaxInstructions int
+		FailOpen        bool
+	}
+	ForwardAuth struct {
+		Backend         *HTTPBackend
+		BackendName     string
+		Headers         []string
+		ResponseHeaders []string
+		Timeout         time.Duration
+		FailOpen        bool
+		CacheHeader     string
+		CacheTTL        time.Duration
+	}
+	RewritePath struct {
+		Pattern     string
+		Replacement string
+	}
+	Redirect struct {
+		Location string
+		Code     int
+	}
+	Response struct {
+		StatusCode  int
+		ContentType string
+		Body        string
+	}
+	Mirror struct {
+		Backend      *HTTPBackend
+		BackendName  string
+		MaxInflight  int
+		MaxBodyBytes int
+		Timeout      time.Duration
+	}
+	BasicAuth struct {
+		Realm       string
+		Users       []string
+		File        string
+		ForwardUser bool
+	}
+	JWT struct {
+		Secret       string
+		KeyFile      string
+		Issuer       string
+		Audience     string
+		ClockSkew    time.Duration
+		ClaimHeaders map[string]string
+	}
 
-	hostRgx *regexp.Regexp
-	pathRgx *regexp.Regexp
+	hosts                      []string
+	hostRgxs                   []*regexp.Regexp
+	pathRgx                    *regexp.Regexp
+	queryRgx                   *regexp.Regexp
+	rewritePathRgx             *regexp.Regexp
+	methods                    map[string]struct{}
+	headerRgxs                 map[string]*regexp.Regexp
+	patternErr                 error
+	deniedCode                 string
+	deniedResponse             []byte
+	backendRef                 *httpBackendRef
+	backupRef                  *httpBackendRef
+	split                      *httpTrafficSplit
+	throttle                   *httpThrottle
+	authHook                   *authHook
+	forwardAuth                *forwardAuth
+	requestHeaders             []httpHeaderOp
+	responseHeaders            []httpHeaderOp
+	redirect                   *httpRedirect
+	response                   *httpFixedResponse
+	mirror                     *httpMirror
+	coalescer                  *httpCoalescer
+	concurrency                *httpConcurrencyLimiter
+	basicAuth                  *httpBasicAuth
+	jwt                        *httpJWT
+	promRequestDurationSeconds prometheus.ObserverVec
 }
 
 // HTTPFrontendOptions holds HTTPFrontend options
 type HTTPFrontendOptions struct {
-	Name             string
-	MaxConn          int
-	MaxIdleConn      int
-	Timeout          time.Duration
-	RequestTimeout   time.Duration
-	MaxKeepAliveReqs int
-	KeepAliveTimeout time.Duration
-	DefaultBackend   *HTTPBackend
-	DefaultBackup    *HTTPBackend
-	Routes           []HTTPFrontendRoute
+	Name                   string
+	MaxConn                int
+	MaxIdleConn            int
+	Timeout                time.Duration
+	RequestTimeout         time.Duration
+	ReadHeaderTimeout      time.Duration
+	RequestBodyTimeout     time.Duration
+	WriteTimeout           time.Duration
+	MaxHeaderBytes         int
+	MaxBodyBytes           int64
+	MaxKeepAliveReqs       int
+	KeepAliveTimeout       time.Duration
+	TLSHandshakeTimeout    time.Duration
+	DefaultBackend         *HTTPBackend
+	DefaultBackup          *HTTPBackend
+	DefaultBackends        map[string]*HTTPBackend
+	UnmatchedRequestAction HTTPFrontendUnmatchedAction
+	WriteProfile           HTTPFrontendWriteProfile
+	ForwardedHeaders       HTTPFrontendForwardedHeaders
+	EmitForwarded          bool
+	RequestID              HTTPFrontendRequestID
+	RequestIDHeader        string
+	WebSocketPassthrough   bool
+	TunnelIdleTimeout      time.Duration
+	Via                    bool
+	ViaPseudonym           string
+	ViaLoopDetection       bool
+	Routes                 []HTTPFrontendRoute
+	AllowedUpstreamHosts   []string
+	TimeoutHeader          string
+	DrainTimeout           time.Duration
+	DrainHeader            bool
+	DSCP                   int
+	StrictParsing          bool
+	AllowedMethods         []string
+	StrictRoutes           bool
+	TrustedProxies         []*net.IPNet
+	AcceptProxyProtocol    bool
+	ProxyProtocolNetworks  []*net.IPNet
+	GeoIP                  GeoIPLookup
+	OverrideHeader         string
+	OverrideBackends       []*HTTPBackend
+	OverrideNetworks       []*net.IPNet
+	ACME                   *ACMEManager
+	RedirectToHTTPS        bool
+	RedirectToHTTPSPort    int
+	RedirectTemporary      bool
+	H2C                    bool
+	TCPKeepAlivePeriod     time.Duration
+	TCPNoDelay             bool
+
+	allowedUpstreamHostRgxs []*regexp.Regexp
+	defaultBackends         []httpFrontendDefaultBackend
+	allowedMethods          map[string]struct{}
+	allowHeader             string
+	shadowedRoutes          []HTTPFrontendRouteShadow
+	overrideHeader          string
+	overrideBackends        map[string]*HTTPBackend
+	requestIDHeader         string
+	viaPseudonym            string
+	maxHeaderBytes          int64
 }
 
-// CopyFrom sets the underlying HTTPFrontendOptions by given HTTPFrontendOptions
-func (o *HTTPFrontendOptions) CopyFrom(src *HTTPFrontendOptions) {
-	patternToRgx := func(pattern string) *regexp.Regexp {
-		reg := regexp.QuoteMeta(strings.ToLower(pattern))
+// httpFrontendDefaultBackend is the default backend of the hosts which match the host pattern
+type httpFrontendDefaultBackend struct {
+	host    string
+	hostRgx *regexp.Regexp
+	backend *HTTPBackend
+}
+
+// compiledRegexp is a cached result of regexp.Compile
+type compiledRegexp struct {
+	rgx *regexp.Regexp
+	err error
+}
+
+// patternToRgx returns the cached regexp of the lowercase wildcard pattern, * matches any string and ? matches any
+// character
+func patternToRgx(pattern string) *regexp.Regexp {
+	pattern = strings.ToLower(pattern)
+	return compiledArtifacts.Get("pattern:"+pattern, func() interface{} {
+		reg := regexp.QuoteMeta(pattern)
 		reg = strings.Replace(reg, "\\*", ".*", -1)
 		reg = strings.Replace(reg, "\\?", ".", -1)
 		reg = "^" + reg + "$"
 		return regexp.MustCompile(reg)
+	}).(*regexp.Regexp)
+}
+
+// CopyFrom sets the underlying HTTPFrontendOptions by given HTTPFrontendOptions
+func (o *HTTPFrontendOptions) CopyFrom(src *HTTPFrontendOptions) {
+	regexpToRgx := func(expr string) (*regexp.Regexp, error) {
+		c := compiledArtifacts.Get("regexp:"+expr, func() interface{} {
+			rgx, err := regexp.Compile(expr)
+			return compiledRegexp{rgx: rgx, err: err}
+		}).(compiledRegexp)
+		return c.rgx, c.err
 	}
 
 	*o = *src
+	o.AllowedUpstreamHosts = make([]string, len(src.AllowedUpstreamHosts))
+	copy(o.AllowedUpstreamHosts, src.AllowedUpstreamHosts)
+	o.allowedUpstreamHostRgxs = make([]*regexp.Regexp, 0, len(o.AllowedUpstreamHosts))
+	for _, host := range o.AllowedUpstreamHosts {
+		o.allowedUpstreamHostRgxs = append(o.allowedUpstreamHostRgxs, patternToRgx(host))
+	}
+	o.DefaultBackends = make(map[string]*HTTPBackend, len(src.DefaultBackends))
+	o.defaultBackends = make([]httpFrontendDefaultBackend, 0, len(src.DefaultBackends))
+	for host, b := range src.DefaultBackends {
+		o.DefaultBackends[host] = b
+		pattern := host
+		if strings.HasPrefix(pattern, "[") && strings.HasSuffix(pattern, "]") {
+			pattern = pattern[1 : len(pattern)-1]
+		}
+		o.defaultBackends = append(o.defaultBackends, httpFrontendDefaultBackend{host: host, hostRgx: patternToRgx(pattern), backend: b})
+	}
+	// more specific host patterns are matched first: the ones without wildcards, and then the longer ones
+	sort.Slice(o.defaultBackends, func(i, j int) bool {
+		hi, hj := o.defaultBackends[i].host, o.defaultBackends[j].host
+		if wi, wj := strings.ContainsAny(hi, "*?"), strings.ContainsAny(hj, "*?"); wi != wj {
+			return wj
+		}
+		if len(hi) != len(hj) {
+			return len(hi) > len(hj)
+		}
+		return hi < hj
+	})
+	o.AllowedMethods = make([]string, len(src.AllowedMethods))
+	copy(o.AllowedMethods, src.AllowedMethods)
+	o.TrustedProxies = make([]*net.IPNet, len(src.TrustedProxies))
+	copy(o.TrustedProxies, src.TrustedProxies)
+	o.ProxyProtocolNetworks = make([]*net.IPNet, len(src.ProxyProtocolNetworks))
+	copy(o.ProxyProtocolNetworks, src.ProxyProtocolNetworks)
+	o.OverrideBackends = make([]*HTTPBackend, len(src.OverrideBackends))
+	copy(o.OverrideBackends, src.OverrideBackends)
+	o.OverrideNetworks = make([]*net.IPNet, len(src.OverrideNetworks))
+	copy(o.OverrideNetworks, src.OverrideNetworks)
+	allowedMethods := o.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = httpDefaultAllowedMethods
+	}
+	o.allowedMethods = make(map[string]struct{}, len(allowedMethods))
+	allow := make([]string, 0, len(allowedMethods))
+	for _, method := range allowedMethods {
+		method = strings.ToUpper(method)
+		if _, ok := o.allowedMethods[method]; ok {
+			continue
+		}
+		o.allowedMethods[method] = struct{}{}
+		allow = append(allow, method)
+	}
+	o.allowHeader = strings.Join(allow, ", ")
 	o.Routes = make([]HTTPFrontendRoute, len(src.Routes))
 	copy(o.Routes, src.Routes)
+	// routes are evaluated by descending priority, and by the given order in the same priority
+	sort.SliceStable(o.Routes, func(i, j int) bool { return o.Routes[i].Priority > o.Routes[j].Priority })
 	for i := range o.Routes {
 		route := &o.Routes[i]
-		if route.Host == "" {
+		route.patternErr = nil
+		route.Hosts = append([]string(nil), route.Hosts...)
+		route.RequestHeaders = append([]HTTPFrontendHeaderOp(nil), route.RequestHeaders...)
+		route.ResponseHeaders = append([]HTTPFrontendHeaderOp(nil), route.ResponseHeaders...)
+		if route.Host == "" && len(route.Hosts) == 0 && !route.HostIsRegexp {
 			route.Host = "*"
 		}
-		route.hostRgx = patternToRgx(route.Host)
-		if route.Path == "" {
-			route.Path = "*"
+		route.hosts = make([]string, 0, 1+len(route.Hosts))
+		if route.Host != "" || len(route.Hosts) == 0 {
+			route.hosts = append(route.hosts, route.Host)
+		}
+		route.hosts = append(route.hosts, route.Hosts...)
+		route.hostRgxs = make([]*regexp.Regexp, len(route.hosts))
+		for j, host := range route.hosts {
+			if !route.HostIsRegexp {
+				// hosts are matched without port, so IPv6 literals are matched without brackets
+				if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+					host = host[1 : len(host)-1]
+				}
+				route.hostRgxs[j] = patternToRgx(host)
+				continue
+			}
+			var err error
+			route.hostRgxs[j], err = regexpToRgx(host)
+			if route.patternErr == nil {
+				route.patternErr = err
+			}
+		}
+		if route.PathIsRegexp {
+			var err error
+			route.pathRgx, err = regexpToRgx(route.Path)
+			if route.patternErr == nil {
+				route.patternErr = err
+			}
+		} else {
+			if route.Path == "" {
+				route.Path = "*"
+			}
+			route.pathRgx = patternToRgx(route.Path)
+		}
+		route.queryRgx = nil
+		if route.Query != "" {
+			route.queryRgx = patternToRgx(route.Query)
+		}
+		route.rewritePathRgx = nil
+		if route.RewritePath.Pattern != "" {
+			var err error
+			route.rewritePathRgx, err = regexpToRgx(route.RewritePath.Pattern)
+			if err != nil && route.patternErr == nil {
+				route.patternErr = fmt.Errorf("rewrite path: %w", err)
+			}
+		}
+		route.Backends = append([]HTTPFrontendWeightedBackend(nil), route.Backends...)
+		route.Methods = append([]string(nil), route.Methods...)
+		route.methods = nil
+		if len(route.Methods) > 0 {
+			route.methods = make(map[string]struct{}, len(route.Methods))
+			for _, method := range route.Methods {
+				route.methods[strings.ToUpper(method)] = struct{}{}
+			}
+		}
+		oldHeaders := route.Headers
+		route.Headers = make(map[string]string, len(oldHeaders))
+		route.headerRgxs = make(map[string]*regexp.Regexp, len(oldHeaders))
+		for name, pattern := range oldHeaders {
+			route.Headers[name] = pattern
+			route.headerRgxs[http.CanonicalHeaderKey(name)] = patternToRgx(pattern)
+		}
+
+		oldStatusMap := route.StatusMap
+		route.StatusMap = make(map[int]int, len(oldStatusMap))
+		for k, v := range oldStatusMap {
+			route.StatusMap[k] = v
+		}
+		oldStatusMapBodies := route.StatusMapBodies
+		route.StatusMapBodies = make(map[int]string, len(oldStatusMapBodies))
+		for k, v := range oldStatusMapBodies {
+			route.StatusMapBodies[k] = v
 		}
-		route.pathRgx = patternToRgx(route.Path)
 
 		oldRestrictions := route.Restrictions
 		route.Restrictions = make([]HTTPFrontendRestriction, len(oldRestrictions))
 		copy(route.Restrictions, oldRestrictions)
 		for j := range route.Restrictions {
 			restriction := &route.Restrictions[j]
-			if restriction.Path == "" {
-				restriction.pathRgx = nil
-				continue
+			restriction.pathRgx, restriction.queryRgx = nil, nil
+			if restriction.Path != "" {
+				restriction.pathRgx = patternToRgx(restriction.Path)
+			}
+			if restriction.Query != "" {
+				restriction.queryRgx = patternToRgx(restriction.Query)
+			}
+			restriction.Methods = append([]string(nil), restriction.Methods...)
+			restriction.TimeWindow.Days = append([]string(nil), restriction.TimeWindow.Days...)
+			restriction.Countries = append([]string(nil), restriction.Countries...)
+			restriction.methods = nil
+			if len(restriction.Methods) > 0 {
+				restriction.methods = make(map[string]struct{}, len(restriction.Methods))
+				for _, method := range restriction.Methods {
+					restriction.methods[strings.ToUpper(method)] = struct{}{}
+				}
+			}
+			restriction.headerName, restriction.headerRgx = "", nil
+			if restriction.HeaderName != "" {
+				headerValue := restriction.HeaderValue
+				if headerValue == "" {
+					headerValue = "*"
+				}
+				restriction.headerName = http.CanonicalHeaderKey(restriction.HeaderName)
+				restriction.headerRgx = patternToRgx(headerValue)
+			}
+			restriction.subjectRgx = nil
+			if restriction.ClientCertSubject != "" {
+				restriction.subjectRgx = patternToRgx(restriction.ClientCertSubject)
 			}
-			restriction.pathRgx = patternToRgx(restriction.Path)
 		}
 	}
+	o.shadowedRoutes = findShadowedRoutes(o.Routes)
+}
+
+// newHTTPFrontendOptionsSnapshot returns a copy of given options with the routes prepared to serve.
+// The snapshot must not be changed after it is stored in a HTTPFrontend.
+func newHTTPFrontendOptionsSnapshot(opts *HTTPFrontendOptions) (o *HTTPFrontendOptions, err error) {
+	o = &HTTPFrontendOptions{}
+	o.CopyFrom(opts)
+	if err = sockopt.CheckDSCP(o.DSCP); err != nil {
+		o = nil
+		return
+	}
+	o.overrideHeader = http.CanonicalHeaderKey(o.OverrideHeader)
+	o.overrideBackends, err = newHTTPBackendOverrides(o)
+	if err != nil {
+		o = nil
+		return
+	}
+	o.requestIDHeader, err = newHTTPRequestIDHeader(o)
+	if err != nil {
+		o = nil
+		return
+	}
+	o.viaPseudonym, err = newHTTPViaPseudonym(o)
+	if err != nil {
+		o = nil
+		return
+	}
+	o.maxHeaderBytes = int64(o.MaxHeaderBytes)
+	if o.maxHeaderBytes <= 0 {
+		o.maxHeaderBytes = httpDefaultMaxHeaderBytes
+	}
+	for _, method := range o.AllowedMethods {
+		if method == "" || strings.IndexFunc(method, isNotToken) >= 0 {
+			o, err = nil, fmt.Errorf("allowed method %q invalid", method)
+			return
+		}
+	}
+	if o.RedirectToHTTPSPort < 0 || o.RedirectToHTTPSPort > 65535 {
+		o, err = nil, fmt.Errorf("redirect to https port %d out of range", o.RedirectToHTTPSPort)
+		return
+	}
+	if o.StrictRoutes && len(o.shadowedRoutes) > 0 {
+		o, err = nil, fmt.Errorf("strict routes: %v", o.shadowedRoutes[0])
+		return
+	}
+	promLabels := prometheus.Labels{
+		"frontend": o.Name,
+	}
+	for i := range o.Routes {
+		route := &o.Routes[i]
+		if route.patternErr != nil {
+			o, err = nil, fmt.Errorf("route regexp error: %w", route.patternErr)
+			return
+		}
+		for _, method := range route.Methods {
+			if method == "" || strings.IndexFunc(method, isNotToken) >= 0 {
+				o, err = nil, fmt.Errorf("route method %q invalid", method)
+				return
+			}
+		}
+		for name := range route.Headers {
+			if name == "" || strings.IndexFunc(name, isNotToken) >= 0 {
+				o, err = nil, fmt.Errorf("route header name %q invalid", name)
+				return
+			}
+		}
+		for j := range route.Restrictions {
+			restriction := &route.Restrictions[j]
+			if restriction.HeaderName == "" && restriction.HeaderValue != "" {
+				o, err = nil, fmt.Errorf("route restriction header value %q without header name", restriction.HeaderValue)
+				return
+			}
+			if restriction.HeaderName != "" && strings.IndexFunc(restriction.HeaderName, isNotToken) >= 0 {
+				o, err = nil, fmt.Errorf("route restriction header name %q invalid", restriction.HeaderName)
+				return
+			}
+			restriction.rateLimiter = nil
+			if restriction.RateLimit != (HTTPFrontendRateLimit{}) {
+				if restriction.AndAfter {
+					o, err = nil, errors.New("route rate limit restriction can't be chained by andafter")
+					return
+				}
+				restriction.rateLimiter, err = newHTTPRateLimiter(&restriction.RateLimit)
+				if err != nil {
+					o, err = nil, fmt.Errorf("route rate limit restriction error: %w", err)
+					return
+				}
+			}
+			restriction.timeWindow = nil
+			if !restriction.TimeWindow.isZero() {
+				restriction.timeWindow, err = newHTTPTimeWindow(&restriction.TimeWindow)
+				if err != nil {
+					o, err = nil, fmt.Errorf("route time window restriction error: %w", err)
+					return
+				}
+			}
+			restriction.countries, restriction.geoIP = nil, nil
+			if len(restriction.Countries) > 0 {
+				if o.GeoIP == nil {
+					o, err = nil, errors.New("route country restriction without geoip lookup")
+					return
+				}
+				restriction.countries, err = newHTTPCountrySet(restriction.Countries)
+				if err != nil {
+					o, err = nil, fmt.Errorf("route country restriction error: %w", err)
+					return
+				}
+				restriction.geoIP = o.GeoIP
+			} else if restriction.InvertCountries || restriction.RestrictUnknownCountry {
+				o, err = nil, errors.New("route restriction country options without countries")
+				return
+			}
+			restriction.networkList = nil
+			if restriction.NetworkListFile != "" {
+				restriction.networkList, err = newHTTPNetworkList(restriction.NetworkListFile)
+				if err != nil {
+					o, err = nil, fmt.Errorf("route restriction error: %w", err)
+					return
+				}
+			}
+		}
+		route.deniedCode, route.deniedResponse = "", nil
+		if route.DeniedStatusCode != 0 || route.DeniedBody != "" || route.DeniedRetryAfter > 0 {
+			route.deniedCode, route.deniedResponse, err = newHTTPDeniedResponse(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route denied response error: %w", err)
+				return
+			}
+		}
+		if strings.ContainsAny(route.SetHost, " \t\r\n/") {
+			o, err = nil, fmt.Errorf("route set host %q invalid", route.SetHost)
+			return
+		}
+		route.backendRef, route.backupRef = nil, nil
+		if route.BackendName != "" {
+			if route.Backend != nil {
+				o, err = nil, fmt.Errorf("route has both backend and backend name %q", route.BackendName)
+				return
+			}
+			route.backendRef, err = httpBackends.Resolve(route.BackendName)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route error: %w", err)
+				return
+			}
+		}
+		if route.BackupName != "" {
+			if route.Backup != nil {
+				o, err = nil, fmt.Errorf("route has both backup and backup name %q", route.BackupName)
+				return
+			}
+			route.backupRef, err = httpBackends.Resolve(route.BackupName)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route backup error: %w", err)
+				return
+			}
+		}
+		route.split = nil
+		if len(route.Backends) > 0 {
+			route.split, err = newHTTPTrafficSplit(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route backends error: %w", err)
+				return
+			}
+		}
+		route.throttle = newHTTPThrottle(route.MaxResponseBytesPerSecond, route.PerClientBytesPerSecond)
+		route.promRequestDurationSeconds = nil
+		if route.BucketProfile != "" {
+			vec, ok := promHTTPFrontendProfileDurationSeconds[route.BucketProfile]
+			if !ok {
+				o, err = nil, fmt.Errorf("route bucket profile %q unknown", route.BucketProfile)
+				return
+			}
+			route.promRequestDurationSeconds = vec.MustCurryWith(promLabels)
+		}
+		if route.GRPC && route.CoalesceRequests {
+			o, err = nil, errors.New("route grpc can't coalesce requests")
+			return
+		}
+		route.coalescer = nil
+		if route.CoalesceRequests {
+			route.coalescer = newHTTPCoalescer(route.CoalesceMaxBytes)
+		}
+		route.authHook = nil
+		if route.AuthHook.Script != "" {
+			route.authHook, err = newAuthHook(route.AuthHook.Script, route.AuthHook.Timeout, route.AuthHook.MaxInstructions)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route auth hook error: %w", err)
+				return
+			}
+		}
+		route.forwardAuth = nil
+		if route.ForwardAuth.Backend != nil || route.ForwardAuth.BackendName != "" {
+			route.forwardAuth, err = newForwardAuth(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route forward auth error: %w", err)
+				return
+			}
+		}
+		route.requestHeaders = nil
+		if len(route.RequestHeaders) > 0 {
+			route.requestHeaders, err = newHTTPHeaderOps(route.RequestHeaders, httpRequestHeaderOpForbiddenNames)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route request headers error: %w", err)
+				return
+			}
+		}
+		route.responseHeaders = nil
+		if len(route.ResponseHeaders) > 0 {
+			route.responseHeaders, err = newHTTPHeaderOps(route.ResponseHeaders, httpResponseHeaderOpForbiddenNames)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route response headers error: %w", err)
+				return
+			}
+		}
+		route.redirect = nil
+		if route.Redirect.Location != "" || route.Redirect.Code != 0 {
+			route.redirect, err = newHTTPRedirect(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route redirect error: %w", err)
+				return
+			}
+		}
+		route.response = nil
+		if route.Response.StatusCode != 0 || route.Response.ContentType != "" || route.Response.Body != "" {
+			route.response, err = newHTTPFixedResponse(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route response error: %w", err)
+				return
+			}
+		}
+		route.mirror = nil
+		if route.Mirror.Backend != nil || route.Mirror.BackendName != "" {
+			route.mirror, err = newHTTPMirror(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route mirror error: %w", err)
+				return
+			}
+		}
+		route.basicAuth = nil
+		if len(route.BasicAuth.Users) > 0 || route.BasicAuth.File != "" {
+			route.basicAuth, err = newHTTPBasicAuth(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route basic auth error: %w", err)
+				return
+			}
+		}
+		route.jwt = nil
+		if route.JWT.Secret != "" || route.JWT.KeyFile != "" {
+			route.jwt, err = newHTTPJWT(route)
+			if err != nil {
+				o, err = nil, fmt.Errorf("route jwt error: %w", err)
+				return
+			}
+		}
+		route.concurrency, err = newHTTPConcurrencyLimiter(route)
+		if err != nil {
+			o, err = nil, fmt.Errorf("route concurrency error: %w", err)
+			return
+		}
+	}
+	return
 }
 
 // HTTPFrontend implements a frontend for HTTP
 type HTTPFrontend struct {
-	opts             HTTPFrontendOptions
+	opts             atomic.Value
+	optsMu           sync.Mutex
 	activeConnCount  int64
 	idleConnCount    int64
 	waitingConnCount int64
@@ -104,6 +866,25 @@ type HTTPFrontend struct {
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
+	draining       uint32
+	drainCtx       context.Context
+	drainCtxCancel context.CancelFunc
+
+	shutdownCtx       context.Context
+	shutdownCtxCancel context.CancelFunc
+
+	tap       atomic.Value
+	lastTap   *httpTap
+	lastTapMu sync.Mutex
+
+	tlsCertStores   []*TLSCertStore
+	tlsCertStoresMu sync.Mutex
+
+	upstreamHostDeniedLogTime  int64
+	upstreamHostDeniedLogCount int64
+
+	connStatsSrc *connStatsSource
+
 	promReadBytes              *prometheus.CounterVec
 	promWriteBytes             *prometheus.CounterVec
 	promRequestsTotal          *prometheus.CounterVec
@@ -112,6 +893,19 @@ type HTTPFrontend struct {
 	promActiveConnections      *prometheus.GaugeVec
 	promIdleConnections        *prometheus.GaugeVec
 	promWaitingConnections     *prometheus.GaugeVec
+	promDeprecatedTLSConnTotal *prometheus.CounterVec
+	promTLSHandshakeErrors     *prometheus.CounterVec
+	promThrottledBytes         *prometheus.CounterVec
+	promThrottledSeconds       *prometheus.CounterVec
+	promDrainedConnTotal       *prometheus.CounterVec
+	promAuthHookTotal          *prometheus.CounterVec
+	promForwardAuthTotal       *prometheus.CounterVec
+	promForwardAuthDuration    prometheus.ObserverVec
+	promCoalescedRequestsTotal *prometheus.CounterVec
+	promStampedesPrevented     *prometheus.CounterVec
+	promReclaimedConnTotal     *prometheus.CounterVec
+	promMirrorRequestsTotal    *prometheus.CounterVec
+	promInflightRequests       *prometheus.GaugeVec
 }
 
 // NewHTTPFrontend creates a new HTTPFrontend by given options
@@ -122,13 +916,19 @@ func NewHTTPFrontend(opts HTTPFrontendOptions) (f *HTTPFrontend, err error) {
 
 // Fork forkes a HTTPFrontend and its own members by given options
 func (f *HTTPFrontend) Fork(opts HTTPFrontendOptions) (fn *HTTPFrontend, err error) {
+	o, err := newHTTPFrontendOptionsSnapshot(&opts)
+	if err != nil {
+		return
+	}
 	fn = &HTTPFrontend{}
-	fn.opts.CopyFrom(&opts)
+	fn.opts.Store(o)
 	fn.workerTkr = time.NewTicker(100 * time.Millisecond)
 	fn.ctx, fn.ctxCancel = context.WithCancel(context.Background())
+	fn.drainCtx, fn.drainCtxCancel = context.WithCancel(context.Background())
+	fn.shutdownCtx, fn.shutdownCtxCancel = context.WithCancel(context.Background())
 
 	promLabels := prometheus.Labels{
-		"frontend": fn.opts.Name,
+		"frontend": o.Name,
 	}
 	fn.promReadBytes = promHTTPFrontendReadBytes.MustCurryWith(promLabels)
 	fn.promWriteBytes = promHTTPFrontendWriteBytes.MustCurryWith(promLabels)
@@ -138,6 +938,19 @@ func (f *HTTPFrontend) Fork(opts HTTPFrontendOptions) (fn *HTTPFrontend, err err
 	fn.promActiveConnections = promHTTPFrontendActiveConnections.MustCurryWith(promLabels)
 	fn.promIdleConnections = promHTTPFrontendIdleConnections.MustCurryWith(promLabels)
 	fn.promWaitingConnections = promHTTPFrontendWaitingConnections.MustCurryWith(promLabels)
+	fn.promDeprecatedTLSConnTotal = promHTTPFrontendDeprecatedTLSConnTotal.MustCurryWith(promLabels)
+	fn.promTLSHandshakeErrors = promHTTPFrontendTLSHandshakeErrorsTotal.MustCurryWith(promLabels)
+	fn.promThrottledBytes = promHTTPFrontendThrottledBytes.MustCurryWith(promLabels)
+	fn.promThrottledSeconds = promHTTPFrontendThrottledSeconds.MustCurryWith(promLabels)
+	fn.promDrainedConnTotal = promHTTPFrontendDrainedConnTotal.MustCurryWith(promLabels)
+	fn.promAuthHookTotal = promHTTPFrontendAuthHookTotal.MustCurryWith(promLabels)
+	fn.promForwardAuthTotal = promHTTPFrontendForwardAuthTotal.MustCurryWith(promLabels)
+	fn.promForwardAuthDuration = promHTTPFrontendForwardAuthDurationSeconds.MustCurryWith(promLabels)
+	fn.promCoalescedRequestsTotal = promHTTPFrontendCoalescedRequestsTotal.MustCurryWith(promLabels)
+	fn.promStampedesPrevented = promHTTPFrontendStampedesPrevented.MustCurryWith(promLabels)
+	fn.promReclaimedConnTotal = promHTTPFrontendReclaimedConnTotal.MustCurryWith(promLabels)
+	fn.promMirrorRequestsTotal = promHTTPFrontendMirrorRequestsTotal.MustCurryWith(promLabels)
+	fn.promInflightRequests = promHTTPFrontendInflightRequests.MustCurryWith(promLabels)
 
 	defer func() {
 		if err == nil {
@@ -150,26 +963,232 @@ func (f *HTTPFrontend) Fork(opts HTTPFrontendOptions) (fn *HTTPFrontend, err err
 	fn.workerWg.Add(1)
 	go fn.worker()
 
+	fn.connStatsSrc = connStats.Register("frontend:"+o.Name, fn.connStatsSample)
+
 	return
 }
 
-// Close closes the HTTPFrontend and its own members
+// Close closes the HTTPFrontend and its own members. Connections which are still served by the HTTPFrontend are drained.
 func (f *HTTPFrontend) Close() {
+	f.Drain()
+	if f.connStatsSrc != nil {
+		connStats.Unregister("frontend:"+f.options().Name, f.connStatsSrc)
+	}
 	f.ctxCancel()
 	f.workerTkr.Stop()
 	f.workerWg.Wait()
+	f.lastTapMu.Lock()
+	f.tap.Store((*httpTap)(nil))
+	if f.lastTap != nil {
+		f.lastTap.Close()
+	}
+	f.lastTapMu.Unlock()
+}
+
+// Drain starts draining the HTTPFrontend. The next responses of connections are sent with "Connection: close" and
+// the connections are closed after them. Idle connections are closed forcibly when the drain timeout exceeded.
+func (f *HTTPFrontend) Drain() {
+	if !atomic.CompareAndSwapUint32(&f.draining, 0, 1) {
+		return
+	}
+	if d := f.options().DrainTimeout; d > 0 {
+		time.AfterFunc(d, f.drainCtxCancel)
+	}
+}
+
+// Shutdown drains the HTTPFrontend, and waits for the requests in flight until they are done or ctx is done. Then idle
+// connections are closed, and the connections which are still serving requests are closed forcibly if ctx is done.
+// Finally it closes the HTTPFrontend.
+func (f *HTTPFrontend) Shutdown(ctx context.Context) (err error) {
+	f.Drain()
+	tkr := time.NewTicker(10 * time.Millisecond)
+	defer tkr.Stop()
+	for err == nil && atomic.LoadInt64(&f.activeConnCount) > 0 {
+		select {
+		case <-tkr.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	f.drainCtxCancel()
+	if err != nil {
+		f.shutdownCtxCancel()
+	}
+	f.Close()
+	return
+}
+
+// IsDraining reports whether the HTTPFrontend is draining
+func (f *HTTPFrontend) IsDraining() bool {
+	return atomic.LoadUint32(&f.draining) != 0
 }
 
-// GetOpts returns a copy of underlying HTTPFrontend's options
+// DrainingConnCount returns the number of connections which are still open on the HTTPFrontend while it is draining
+func (f *HTTPFrontend) DrainingConnCount() int64 {
+	if !f.IsDraining() {
+		return 0
+	}
+	return atomic.LoadInt64(&f.totalConnCount)
+}
+
+// GetOpts returns a copy of underlying HTTPFrontend's options.
+// It is safe to call concurrently with SetRoutes.
 func (f *HTTPFrontend) GetOpts() (opts HTTPFrontendOptions) {
-	opts.CopyFrom(&f.opts)
+	opts.CopyFrom(f.options())
 	return
 }
 
+// ShadowedRoutes returns the routes which can never match, because an earlier route matches all of their requests
+func (f *HTTPFrontend) ShadowedRoutes() []HTTPFrontendRouteShadow {
+	return append([]HTTPFrontendRouteShadow(nil), f.options().shadowedRoutes...)
+}
+
+// SetRoutes replaces the routes of the HTTPFrontend in place by storing a new options snapshot.
+// Requests which are already routed keep the previous routes, and throttling states of the routes start over.
+func (f *HTTPFrontend) SetRoutes(routes []HTTPFrontendRoute) (err error) {
+	f.optsMu.Lock()
+	defer f.optsMu.Unlock()
+	opts := *f.options()
+	opts.Routes = routes
+	o, err := newHTTPFrontendOptionsSnapshot(&opts)
+	if err != nil {
+		return
+	}
+	f.opts.Store(o)
+	return
+}
+
+// StartTap starts recording the requests which match given tap options, and replaces the previous tap.
+// The tap stops matching when its duration exceeded, but its entries are kept until the next tap or Close.
+func (f *HTTPFrontend) StartTap(opts HTTPFrontendTapOptions) (err error) {
+	t, err := newHTTPTap(opts)
+	if err != nil {
+		return
+	}
+	f.lastTapMu.Lock()
+	if f.lastTap != nil {
+		f.lastTap.Close()
+	}
+	f.lastTap = t
+	f.tap.Store(t)
+	f.lastTapMu.Unlock()
+	return
+}
+
+// StopTap stops recording requests. The entries of the last tap are kept.
+func (f *HTTPFrontend) StopTap() {
+	f.lastTapMu.Lock()
+	f.tap.Store((*httpTap)(nil))
+	f.lastTapMu.Unlock()
+}
+
+// TapStatus returns the status of the last tap. It returns false if no tap has been started.
+func (f *HTTPFrontend) TapStatus() (st HTTPFrontendTapStatus, ok bool) {
+	f.lastTapMu.Lock()
+	t := f.lastTap
+	f.lastTapMu.Unlock()
+	if t == nil {
+		return
+	}
+	st, ok = t.Status(), true
+	if f.activeTap() != t {
+		st.Active = false
+	}
+	return
+}
+
+// activeTap returns the active tap or nil
+func (f *HTTPFrontend) activeTap() *httpTap {
+	t, _ := f.tap.Load().(*httpTap)
+	return t
+}
+
+// ConnStats returns the connection counts of the frontend name sampled since given time
+func (f *HTTPFrontend) ConnStats(since time.Time) (st ConnStatsStatus) {
+	st = connStats.Status("frontend:"+f.options().Name, since)
+	st.Name = f.options().Name
+	return
+}
+
+// connStatsSample returns the connection counts of the frontend. Active connections are counted as in-flight.
+func (f *HTTPFrontend) connStatsSample() connStatsSample {
+	active := atomic.LoadInt64(&f.activeConnCount)
+	return connStatsSample{
+		active:   active,
+		idle:     atomic.LoadInt64(&f.idleConnCount),
+		inflight: active,
+	}
+}
+
+// watchTLSCertStore makes the worker reload the certificates of cs when they change
+func (f *HTTPFrontend) watchTLSCertStore(cs *TLSCertStore) {
+	f.tlsCertStoresMu.Lock()
+	defer f.tlsCertStoresMu.Unlock()
+	for _, cs2 := range f.tlsCertStores {
+		if cs2 == cs {
+			return
+		}
+	}
+	f.tlsCertStores = append(f.tlsCertStores, cs)
+}
+
+// options returns the current options snapshot which must not be changed
+func (f *HTTPFrontend) options() *HTTPFrontendOptions {
+	return f.opts.Load().(*HTTPFrontendOptions)
+}
+
 func (f *HTTPFrontend) worker() {
 	for done := false; !done; {
 		select {
 		case <-f.workerTkr.C:
+			opts := f.options()
+			routes := opts.Routes
+			for i := range routes {
+				if t := routes[i].throttle; t != nil {
+					t.Cleanup(10 * time.Second)
+				}
+				for j := range routes[i].Restrictions {
+					l := routes[i].Restrictions[j].networkList
+					if l == nil {
+						continue
+					}
+					if reloaded, err := l.Check(); err != nil {
+						xlog.V(1).Warningf("frontend %q route restriction network list reload error: %v", opts.Name, err)
+					} else if reloaded {
+						xlog.V(2).Infof("frontend %q route restriction network list file %q reloaded", opts.Name, l.path)
+					}
+				}
+				if a := routes[i].basicAuth; a != nil && a.file != nil {
+					if reloaded, err := a.file.Check(); err != nil {
+						xlog.V(1).Warningf("frontend %q route basic auth htpasswd reload error: %v", opts.Name, err)
+					} else if reloaded {
+						xlog.V(2).Infof("frontend %q route basic auth htpasswd file %q reloaded", opts.Name, a.file.path)
+					}
+				}
+				if j := routes[i].jwt; j != nil && j.file != nil {
+					if reloaded, err := j.file.Check(); err != nil {
+						xlog.V(1).Warningf("frontend %q route jwt key reload error: %v", opts.Name, err)
+					} else if reloaded {
+						xlog.V(2).Infof("frontend %q route jwt key file %q reloaded", opts.Name, j.file.path)
+					}
+				}
+			}
+			f.tlsCertStoresMu.Lock()
+			for _, cs := range f.tlsCertStores {
+				if reloaded, err := cs.Check(); err != nil {
+					xlog.V(1).Warningf("frontend %q tls certificate reload error: %v", opts.Name, err)
+				} else if reloaded {
+					xlog.V(2).Infof("frontend %q tls certificates on cert path %q reloaded", opts.Name, cs.opts.CertPath)
+				}
+			}
+			f.tlsCertStoresMu.Unlock()
+			if t := f.activeTap(); t != nil && t.Expired() {
+				f.lastTapMu.Lock()
+				if f.activeTap() == t {
+					f.tap.Store((*httpTap)(nil))
+				}
+				f.lastTapMu.Unlock()
+			}
 		case <-f.ctx.Done():
 			done = true
 		}
@@ -177,75 +1196,191 @@ func (f *HTTPFrontend) worker() {
 	f.workerWg.Done()
 }
 
-func (f *HTTPFrontend) isRouteRestricted(reqDesc *httpReqDesc, route *HTTPFrontendRoute, host, path string) bool {
-	andOK := true
-	for i := range route.Restrictions {
-		restriction := &route.Restrictions[i]
-		restrictionOK := false
-		if tcpAddr, ok := reqDesc.feConn.Conn().RemoteAddr().(*net.TCPAddr); ok && restriction.Network != nil {
-			ok := restriction.Network.Contains(tcpAddr.IP)
-			if restriction.Invert {
-				ok = !ok
-			}
-			restrictionOK = restrictionOK || ok
+func (f *HTTPFrontend) isRouteRestricted(reqDesc *httpReqDesc, route *HTTPFrontendRoute, host, path, query string) bool {
+	return isHTTPRestricted(route.Restrictions, reqDesc.feClientIP, path, query, reqDesc.feStatusMethod, reqDesc.feHdr, reqDesc.leClientCert)
+}
+
+// matchHost returns the first host pattern of the route which matches given lowercase host
+func (r *HTTPFrontendRoute) matchHost(host string) (pattern string, ok bool) {
+	for i, rgx := range r.hostRgxs {
+		if rgx.MatchString(host) {
+			return r.hosts[i], true
 		}
-		if restriction.pathRgx != nil {
-			ok := restriction.pathRgx.MatchString(path) || restriction.pathRgx.MatchString(path+"/")
-			if restriction.Invert {
-				ok = !ok
+	}
+	return "", false
+}
+
+// matchMethod reports whether the route matches given uppercase method. Routes without methods match all methods.
+func (r *HTTPFrontendRoute) matchMethod(method string) bool {
+	if r.methods == nil {
+		return true
+	}
+	_, ok := r.methods[method]
+	return ok
+}
+
+// matchHeaders reports whether every header pattern of the route matches a value of the header, case-insensitively.
+// A missing header doesn't match.
+func (r *HTTPFrontendRoute) matchHeaders(hdr http.Header) bool {
+	for name, rgx := range r.headerRgxs {
+		matched := false
+		for _, value := range hdr[name] {
+			if rgx.MatchString(strings.ToLower(value)) {
+				matched = true
+				break
 			}
-			restrictionOK = restrictionOK || ok
 		}
-		if !restriction.AndAfter {
-			if andOK && restrictionOK {
-				return true
-			}
-			andOK = true
-		} else {
-			andOK = andOK && restrictionOK
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *HTTPFrontend) isUpstreamHostAllowed(hostport string) bool {
+	host, _ := splitHostPort(hostport)
+	host = strings.ToLower(host)
+	for _, rgx := range f.options().allowedUpstreamHostRgxs {
+		if rgx.MatchString(host) {
+			return true
 		}
 	}
 	return false
 }
 
+// logUpstreamHostDenied logs the denied upstream host at most once per second, denials between logs are only counted
+// by the requests metric and reported by the next log.
+func (f *HTTPFrontend) logUpstreamHostDenied(hostport string, reqDesc *httpReqDesc) {
+	atomic.AddInt64(&f.upstreamHostDeniedLogCount, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&f.upstreamHostDeniedLogTime)
+	if now-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&f.upstreamHostDeniedLogTime, last, now) {
+		return
+	}
+	count := atomic.SwapInt64(&f.upstreamHostDeniedLogCount, 0)
+	xlog.V(1).Warningf("security: upstream host %q denied on %s, %d denied since last log", hostport, reqDesc.FrontendSummary(), count)
+}
+
 func (f *HTTPFrontend) findBackend(reqDesc *httpReqDesc) (b *HTTPBackend, bb *HTTPBackend) {
-	for i := range f.opts.Routes {
-		route := &f.opts.Routes[i]
-		host := strings.ToLower(reqDesc.feURL.Hostname())
-		path := strings.ToLower(normalizePath(reqDesc.feURL.Path))
-		if route.hostRgx.MatchString(host) &&
-			(route.pathRgx.MatchString(path) || route.pathRgx.MatchString(path+"/")) {
-			reqDesc.feHost = route.Host
+	opts := f.options()
+	var restricted *HTTPFrontendRoute
+	var restrictedHost string
+	host := strings.ToLower(reqDesc.feURL.Hostname())
+	path := strings.ToLower(normalizePath(reqDesc.feURL.EscapedPath()))
+	query := strings.ToLower(uriToQuery(reqDesc.feStatusURI))
+	for i := range opts.Routes {
+		route := &opts.Routes[i]
+		hostPattern, ok := route.matchHost(host)
+		if ok &&
+			(route.pathRgx.MatchString(path) || route.pathRgx.MatchString(path+"/")) &&
+			(route.queryRgx == nil || route.queryRgx.MatchString(query)) &&
+			route.matchMethod(reqDesc.feStatusMethod) && route.matchHeaders(reqDesc.feHdr) {
+			reqDesc.feHost = hostPattern
 			reqDesc.fePath = route.Path
-			if f.isRouteRestricted(reqDesc, route, host, path) {
+			reqDesc.feRoute = route
+			if f.isRouteRestricted(reqDesc, route, host, path, query) {
+				if !route.ContinueOnRestricted {
+					return nil, nil
+				}
+				if restricted == nil {
+					restricted, restrictedHost = route, hostPattern
+				}
+				continue
+			}
+			if limited, retryAfter := f.isRouteRateLimited(reqDesc, route, path, query); limited {
+				reqDesc.feRateLimited, reqDesc.feRetryAfter = true, retryAfter
 				return nil, nil
 			}
-			return route.Backend, route.Backup
+			if route.redirect != nil || route.response != nil {
+				reqDesc.feDirect = true
+				return nil, nil
+			}
+			b, bb = route.Backend, route.Backup
+			if route.backendRef != nil {
+				b = route.backendRef.Get()
+				reqDesc.feUnresolved = b == nil
+			}
+			if route.split != nil {
+				b = route.split.Next()
+				reqDesc.feUnresolved = b == nil
+			}
+			if route.backupRef != nil {
+				bb = route.backupRef.Get()
+			}
+			return
 		}
 	}
-	reqDesc.feHost = "*"
+	reqDesc.feRoute = nil
 	reqDesc.fePath = "*"
-	return f.opts.DefaultBackend, f.opts.DefaultBackup
+	for i := range opts.defaultBackends {
+		if d := &opts.defaultBackends[i]; d.backend != nil && d.hostRgx.MatchString(host) {
+			reqDesc.feHost = d.host
+			return d.backend, nil
+		}
+	}
+	if opts.UnmatchedRequestAction != HTTPFrontendUnmatchedActionDefaultBackend {
+		// the request is denied by the first route which it fell through
+		if restricted != nil {
+			reqDesc.feHost, reqDesc.fePath, reqDesc.feRoute = restrictedHost, restricted.Path, restricted
+			return nil, nil
+		}
+		reqDesc.feHost = httpFrontendUnmatchedHost
+		reqDesc.feUnmatched = true
+		return nil, nil
+	}
+	reqDesc.feHost = "*"
+	return opts.DefaultBackend, opts.DefaultBackup
 }
 
-func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, reqDesc *httpReqDesc) {
+// serveAsync serves the request in ctx, which is bounded by the frontend timeout. If the matched route has its own
+// timeout, the rest of the request is served in the context which rearm returns by the deadline of the route instead.
+func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, rearm func(deadline time.Time) context.Context, reqDesc *httpReqDesc) {
 	var err error
 	defer func() { errCh <- err }()
 
-	reqDesc.feStatusLine, reqDesc.feHdr, _, err = splitHTTPHeader(reqDesc.feConn.Reader)
+	startTime := time.Now()
+
+	// the read header timeout starts by the first byte of the request, the request timeout of the first request may end earlier
+	var headerDeadline time.Time
+	if timeout := f.options().ReadHeaderTimeout; timeout > 0 {
+		headerDeadline = startTime.Add(timeout)
+		if reqDesc.feReqDeadline.IsZero() || headerDeadline.Before(reqDesc.feReqDeadline) {
+			reqDesc.feConn.SetReadDeadline(headerDeadline)
+		}
+	}
+
+	reqDesc.feMaxHeaderBytes = f.options().maxHeaderBytes
+	reqDesc.feStatusLine, reqDesc.feHdr, reqDesc.feHdrLines, _, err = splitHTTPHeader(reqDesc.feConn.Reader, reqDesc.feMaxHeaderBytes)
 	if err != nil {
-		if e := (*net.OpError)(nil); reqDesc.reqIdx <= 0 && errors.As(err, &e) && e.Timeout() {
-			err = wrapHTTPError(httpErrGroupRequestTimeout, err)
+		if err == errHTTPHeaderTooLarge {
+			err = errHTTPRequestHeaderTooLarge
+			xlog.V(100).Debugf("serve error on %s: read header from frontend: %v", reqDesc.FrontendSummary(), err)
+			reqDesc.feConn.Write([]byte(httpHeaderTooLarge))
+			return
+		}
+		if e := (*net.OpError)(nil); (!reqDesc.feReqDeadline.IsZero() || !headerDeadline.IsZero()) && errors.As(err, &e) && e.Timeout() {
+			if !headerDeadline.IsZero() && !time.Now().Before(headerDeadline) {
+				err = wrapHTTPError(httpErrGroupReadHeaderTimeout, err)
+			} else {
+				err = wrapHTTPError(httpErrGroupRequestTimeout, err)
+			}
 			xlog.V(100).Debugf("serve error on %s: read header from frontend: %v", reqDesc.FrontendSummary(), err)
 			reqDesc.feConn.Write([]byte(httpRequestTimeout))
 			return
 		}
+		err = sideHTTPError(err, httpErrGroupClientCommunication, httpErrGroupProtocol)
 		xlog.V(100).Debugf("serve error on %s: read header from frontend: %v", reqDesc.FrontendSummary(), err)
 		reqDesc.feConn.Write([]byte(httpBadRequest))
 		return
 	}
 	reqDesc.feConn.SetReadDeadline(time.Time{})
 
+	if err = checkHTTPRequestSmuggling(reqDesc.feHdr, reqDesc.feHdrLines); err != nil {
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		reqDesc.feConn.Write([]byte(httpBadRequest))
+		return
+	}
+
 	feStatusLineParts := strings.SplitN(reqDesc.feStatusLine, " ", 3)
 	if len(feStatusLineParts) < 3 {
 		err = errHTTPStatusLine
@@ -254,7 +1389,19 @@ func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, reqDe
 		return
 	}
 
+	if f.options().StrictParsing {
+		if err = checkStrictHTTPRequest(reqDesc.feStatusLine, reqDesc.feHdr, reqDesc.feHdrLines); err != nil {
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+			reqDesc.feConn.Write([]byte(httpBadRequestReason(err)))
+			return
+		}
+	}
+
+	// methods are forwarded in uppercase
 	reqDesc.feStatusMethod = strings.ToUpper(feStatusLineParts[0])
+	if reqDesc.feStatusMethod != feStatusLineParts[0] {
+		reqDesc.feStatusLine = reqDesc.feStatusMethod + reqDesc.feStatusLine[len(feStatusLineParts[0]):]
+	}
 
 	reqDesc.feStatusURI = feStatusLineParts[1]
 	/*if !strings.HasPrefix(reqDesc.feStatusURI, "/") {
@@ -272,7 +1419,30 @@ func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, reqDe
 		return
 	}
 
-	reqDesc.feStatusMethodGrouped = groupHTTPStatusMethod(reqDesc.feStatusMethod)
+	reqDesc.feStatusMethodGrouped = groupHTTPStatusMethod(reqDesc.feStatusMethod, f.options().allowedMethods)
+	if reqDesc.feStatusMethodGrouped == httpOtherMethod {
+		err = errHTTPMethodNotAllowed
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		reqDesc.feConn.Write([]byte(httpMethodNotAllowed(f.options().allowHeader)))
+		return
+	}
+
+	// hop-by-hop headers of client are removed before any header toward backend is set
+	reqDesc.feUpgrade = f.options().WebSocketPassthrough && isWebSocketUpgrade(reqDesc.feHdr)
+	reqDesc.feHdr = stripHopByHopHeaders(reqDesc.feHdr, reqDesc.feUpgrade)
+
+	f.setRequestID(reqDesc)
+
+	if pseudonym := f.options().viaPseudonym; pseudonym != "" {
+		if f.options().ViaLoopDetection && hasViaPseudonym(reqDesc.feHdr, pseudonym) {
+			err = errHTTPViaLoop
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+			reqDesc.feConn.Write([]byte(httpLoopDetected))
+			return
+		}
+		reqDesc.feViaPseudonym = pseudonym
+		addVia(reqDesc.feHdr, reqDesc.feStatusVersion, pseudonym)
+	}
 
 	scheme := "http"
 	if reqDesc.leTLS {
@@ -304,9 +1474,18 @@ func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, reqDe
 		reqDesc.feURL.RawPath = strings.TrimPrefix(reqDesc.feURL.RawPath, "/")
 	}
 
+	// only CONNECT takes the upstream target from the request, absolute URIs are sent to configured backends
+	if reqDesc.feStatusMethod == "CONNECT" && !f.isUpstreamHostAllowed(reqDesc.feStatusURI) {
+		err = errHTTPUpstreamHostDenied
+		f.logUpstreamHostDenied(reqDesc.feStatusURI, reqDesc)
+		reqDesc.feConn.Write([]byte(httpForbidden))
+		return
+	}
+
 	reqDesc.feCookies = readCookies(reqDesc.feHdr, "")
 	if tcpAddr, ok := reqDesc.feConn.RemoteAddr().(*net.TCPAddr); ok {
 		reqDesc.feRemoteIP = tcpAddr.IP.String()
+		reqDesc.feClientIP = forwardedClientIP(tcpAddr.IP, reqDesc.feHdr, f.options().TrustedProxies)
 	}
 
 	reqDesc.feRealIP = reqDesc.feHdr.Get("X-Real-IP")
@@ -318,16 +1497,239 @@ func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, reqDe
 		}
 	}
 
+	if t := f.activeTap(); t != nil && t.Match(reqDesc) {
+		reqDesc.feTap = newHTTPTapRecord(t, reqDesc, startTime)
+	}
+
+	// ACME challenges of allowed hosts are answered before route matching
+	if m := f.options().ACME; m != nil && strings.HasPrefix(reqDesc.feURL.Path, acmeHTTPChallengePrefix) && m.IsAllowed(reqDesc.feURL.Hostname()) {
+		reqDesc.feHost, reqDesc.fePath = strings.ToLower(reqDesc.feURL.Hostname()), acmeHTTPChallengePrefix
+		err = f.serveACMEChallenge(reqDesc, m)
+		return
+	}
+	if f.options().RedirectToHTTPS {
+		err = f.serveHTTPSRedirect(reqDesc)
+		return
+	}
+
 	b, bb := f.findBackend(reqDesc)
+	if ob := f.overrideBackend(reqDesc); ob != nil && b != nil {
+		b, bb = ob, nil
+	}
+	if route := reqDesc.feRoute; route != nil && route.Timeout > 0 {
+		ctx = rearm(startTime.Add(route.Timeout))
+	}
+	if reqDesc.feUnmatched {
+		err = errHTTPUnmatchedRequest
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		switch f.options().UnmatchedRequestAction {
+		case HTTPFrontendUnmatchedActionNotFound:
+			reqDesc.feConn.Write([]byte(httpNotFound))
+		case HTTPFrontendUnmatchedActionMisdirected:
+			reqDesc.feConn.Write([]byte(httpMisdirectedRequest))
+		}
+		return
+	}
+	if reqDesc.feRateLimited {
+		err = errHTTPRateLimited
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		reqDesc.beStatusCode = "429"
+		reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+		reqDesc.feConn.Write([]byte(httpRateLimitedResponse(reqDesc.feRetryAfter)))
+		return
+	}
+	if reqDesc.feDirect {
+		if route := reqDesc.feRoute; route.redirect != nil {
+			err = f.serveRedirect(reqDesc, route.redirect)
+		} else {
+			err = f.serveFixedResponse(reqDesc, route.response)
+		}
+		return
+	}
+	if reqDesc.feUnresolved {
+		err = errHTTPBackendUnresolved
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		reqDesc.feConn.Write([]byte(httpServiceUnavailable))
+		return
+	}
 	if b == nil {
 		err = errHTTPRestrictedRequest
 		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
-		reqDesc.feConn.Write([]byte(httpForbidden))
+		code, denied := "403", []byte(httpForbidden)
+		if route := reqDesc.feRoute; route != nil && route.deniedResponse != nil {
+			code, denied = route.deniedCode, route.deniedResponse
+		}
+		reqDesc.beStatusCode = code
+		reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+		reqDesc.feConn.Write(denied)
+		return
+	}
+
+	if route := reqDesc.feRoute; route != nil && route.basicAuth != nil {
+		if err = f.serveBasicAuth(reqDesc, route.basicAuth); err != nil {
+			return
+		}
+	}
+
+	if route := reqDesc.feRoute; route != nil && route.jwt != nil {
+		if err = f.serveJWT(reqDesc, route.jwt); err != nil {
+			return
+		}
+	}
+
+	if route := reqDesc.feRoute; route != nil && route.authHook != nil {
+		promLabels := prometheus.Labels{
+			"host":     reqDesc.feHost,
+			"path":     reqDesc.fePath,
+			"listener": reqDesc.leName,
+		}
+		res, e := route.authHook.Authorize(ctx, reqDesc.feStatusMethod, reqDesc.feStatusURI, reqDesc.feURL.Path, reqDesc.feHdr, reqDesc.feRemoteIP)
+		switch {
+		case e != nil:
+			f.promAuthHookTotal.MustCurryWith(promLabels).With(prometheus.Labels{"result": "error"}).Inc()
+			if !route.AuthHook.FailOpen {
+				err = wrapHTTPError(httpErrGroupAuthHookFailed, e)
+				xlog.V(100).Debugf("serve error on %s: auth hook: %v", reqDesc.FrontendSummary(), err)
+				reqDesc.feConn.Write([]byte(httpServiceUnavailable))
+				return
+			}
+			xlog.V(100).Debugf("auth hook error on %s, failing open: %v", reqDesc.FrontendSummary(), e)
+		case !res.Allow:
+			f.promAuthHookTotal.MustCurryWith(promLabels).With(prometheus.Labels{"result": "deny"}).Inc()
+			err = errHTTPAuthHookDenied
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+			code := res.Status
+			if code == 0 {
+				code = http.StatusForbidden
+			}
+			reqDesc.feConn.Write([]byte(fmt.Sprintf("HTTP/1.0 %d %s\r\n", code, http.StatusText(code))))
+			res.Header.Write(reqDesc.feConn)
+			reqDesc.feConn.Write([]byte("\r\n" + http.StatusText(code) + "\r\n"))
+			return
+		default:
+			f.promAuthHookTotal.MustCurryWith(promLabels).With(prometheus.Labels{"result": "allow"}).Inc()
+			for k, v := range res.Header {
+				reqDesc.feHdr[k] = v
+			}
+		}
+	}
+
+	if route := reqDesc.feRoute; route != nil && route.forwardAuth != nil {
+		if err = f.serveForwardAuth(ctx, reqDesc, route.forwardAuth); err != nil {
+			return
+		}
+	}
+
+	if f.options().ForwardedHeaders == HTTPFrontendForwardedHeadersStrip {
+		for _, name := range httpForwardedHeaders {
+			reqDesc.feHdr.Del(name)
+		}
+	}
+	if f.options().EmitForwarded {
+		f.setForwardedHeader(reqDesc)
+	}
+
+	if route := reqDesc.feRoute; route != nil && route.requestHeaders != nil {
+		applyHTTPHeaderOps(reqDesc, reqDesc.feHdr, route.requestHeaders)
+	}
+
+	if route := reqDesc.feRoute; route != nil && (route.StripPathPrefix != "" || route.rewritePathRgx != nil) {
+		uri := reqDesc.feStatusURI
+		if route.StripPathPrefix != "" {
+			if u, ok := stripURIPrefix(uri, route.StripPathPrefix); ok {
+				uri = u
+				reqDesc.feStrippedPrefix = strings.TrimSuffix(route.StripPathPrefix, "/")
+				reqDesc.feHdr.Set("X-Forwarded-Prefix", reqDesc.feStrippedPrefix)
+			}
+		}
+		if route.rewritePathRgx != nil {
+			uri = rewriteURIPath(uri, route.rewritePathRgx, route.RewritePath.Replacement)
+		}
+		if uri != reqDesc.feStatusURI {
+			reqDesc.feStatusLine = reqDesc.feStatusMethod + " " + uri + " " + reqDesc.feStatusVersion
+		}
+	}
+
+	// the original host is sent in X-Forwarded-Host header
+	if route := reqDesc.feRoute; route != nil && route.SetHost != "" {
+		reqDesc.feHdr.Set("Host", route.SetHost)
+	}
+
+	if route := reqDesc.feRoute; route != nil && route.throttle != nil {
+		promLabels := prometheus.Labels{
+			"host":     reqDesc.feHost,
+			"path":     reqDesc.fePath,
+			"listener": reqDesc.leName,
+		}
+		reqDesc.feThrottle = &throttleWriter{
+			Buckets:          route.throttle.Buckets(reqDesc.feRemoteIP),
+			ThrottledBytes:   f.promThrottledBytes.With(promLabels),
+			ThrottledSeconds: f.promThrottledSeconds.With(promLabels),
+		}
+	}
+
+	if timeoutHeader := f.options().TimeoutHeader; timeoutHeader != "" {
+		reqDesc.feTimeoutHeader = timeoutHeader
+		if budget, ok := parseTimeoutHeader(reqDesc.feHdr.Get(timeoutHeader)); ok {
+			reqDesc.feBudgetDeadline = startTime.Add(budget)
+			var ctxCancel context.CancelFunc
+			ctx, ctxCancel = context.WithDeadline(ctx, reqDesc.feBudgetDeadline)
+			defer ctxCancel()
+			if !time.Now().Before(reqDesc.feBudgetDeadline) {
+				err = errHTTPRequestBudgetExceeded
+				xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+				reqDesc.feConn.Write([]byte(httpGatewayTimeout))
+				return
+			}
+		}
+	}
+
+	// larger declared bodies are rejected before reaching a backend, chunked bodies are limited while being relayed
+	reqDesc.feMaxBodyBytes = f.options().MaxBodyBytes
+	if route := reqDesc.feRoute; route != nil && route.MaxBodyBytes != 0 {
+		reqDesc.feMaxBodyBytes = route.MaxBodyBytes
+	}
+	if reqDesc.feMaxBodyBytes <= 0 {
+		reqDesc.feMaxBodyBytes = -1
+	}
+	if contentLength, e := httpContentLength(reqDesc.feHdr); e == nil && reqDesc.feMaxBodyBytes >= 0 && contentLength > reqDesc.feMaxBodyBytes {
+		err = errHTTPRequestBodyTooLarge
+		xlog.V(100).Debugf("serve error on %s: content length %d: %v", reqDesc.FrontendSummary(), contentLength, err)
+		reqDesc.feConn.Write([]byte(httpPayloadTooLarge))
 		return
 	}
+
+	if route := reqDesc.feRoute; route != nil && route.concurrency != nil {
+		var release func()
+		if release, err = f.serveConcurrencyLimited(ctx, reqDesc, route.concurrency); err != nil {
+			return
+		}
+		defer release()
+	}
+
+	if route := reqDesc.feRoute; route != nil && route.mirror != nil {
+		if r := f.newHTTPMirrorRecord(reqDesc, route.mirror); r != nil {
+			reqDesc.feMirror = r
+			defer f.finishHTTPMirrorRecord(reqDesc, r)
+		}
+	}
+
+	reqDesc.feRequestBodyTimeout = f.options().RequestBodyTimeout
+	reqDesc.feWriteTimeout = f.options().WriteTimeout
+	reqDesc.feTunnelIdleTimeout = f.options().TunnelIdleTimeout
+	reqDesc.feWriteProfile = f.options().WriteProfile
+	if route := reqDesc.feRoute; route != nil && route.GRPC {
+		// streaming RPCs aren't buffered, every read is flushed
+		reqDesc.feWriteProfile = HTTPFrontendWriteProfileLowLatency
+	}
 	reqDesc.beFinal = bb == nil
 	reqDesc.beName = b.opts.Name
-	if err = b.serve(ctx, reqDesc); err != nil {
+	if route := reqDesc.feRoute; route != nil && route.coalescer != nil && isHTTPRequestCoalescable(reqDesc, b) {
+		err = f.serveCoalesced(ctx, reqDesc, b)
+	} else {
+		err = b.serve(ctx, reqDesc)
+	}
+	if err != nil {
 		if bb == nil || reqDesc.beFinal {
 			return
 		}
@@ -342,12 +1744,14 @@ func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, reqDe
 			"code":     reqDesc.beStatusCodeGrouped,
 			"listener": reqDesc.leName,
 			"error":    "dropped: " + e.Group,
+			"class":    httpErrorClass(e.Group),
 		}
 		f.promRequestsTotal.With(promLabels).Inc()
 
 		reqDesc.beFinal = true
 		reqDesc.beName = bb.opts.Name
 		reqDesc.beServer = ""
+		reqDesc.beBackendServer = nil
 		reqDesc.beConn = nil
 		err = bb.serve(ctx, reqDesc)
 		if err != nil {
@@ -355,18 +1759,26 @@ func (f *HTTPFrontend) serveAsync(ctx context.Context, errCh chan<- error, reqDe
 		}
 	}
 
-	// it can be happened when client has been started new request before ending request body transfer!
+	// it can be happened when client has been sent more than content length, or started new request before ending response transfer.
+	// pipelining isn't supported, so the connection is closed. bad request response is sent unless a response has been sent.
 	if reqDesc.feConn.Reader.Buffered() != 0 {
-		err = errHTTPBufferOrder
+		err = errHTTPRequestBodyExcess
 		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		if reqDesc.claimResponse() {
+			reqDesc.feConn.Write([]byte(httpBadRequest))
+		}
 		return
 	}
 }
 
 func (f *HTTPFrontend) serve(ctx context.Context, reqDesc *httpReqDesc) (err error) {
-	if f.opts.Timeout > 0 {
+	// the request is aborted by cancelling its context when the frontend is shut down
+	ctx, serveCtxCancel := context.WithCancel(ctx)
+	defer serveCtxCancel()
+	baseCtx := ctx
+	if timeout := f.options().Timeout; timeout > 0 {
 		var ctxCancel context.CancelFunc
-		ctx, ctxCancel = context.WithTimeout(ctx, f.opts.Timeout)
+		ctx, ctxCancel = context.WithTimeout(ctx, timeout)
 		defer ctxCancel()
 	}
 
@@ -374,19 +1786,57 @@ func (f *HTTPFrontend) serve(ctx context.Context, reqDesc *httpReqDesc) (err err
 	startTime := time.Now()
 
 	asyncErrCh := make(chan error, 1)
-	go f.serveAsync(ctx, asyncErrCh, reqDesc)
-	select {
-	case <-ctx.Done():
-		atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1)
-		err = errHTTPFrontendTimeout
-		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
-		reqDesc.feConn.Flush()
-		reqDesc.feConn.Close()
-		<-asyncErrCh
-	case err = <-asyncErrCh:
-		if err != nil {
+	asyncCtxCh := make(chan context.Context, 1)
+	var routeCtxCancel context.CancelFunc
+	defer func() {
+		if routeCtxCancel != nil {
+			routeCtxCancel()
+		}
+	}()
+	rearm := func(deadline time.Time) context.Context {
+		var routeCtx context.Context
+		routeCtx, routeCtxCancel = context.WithDeadline(baseCtx, deadline)
+		asyncCtxCh <- routeCtx
+		return routeCtx
+	}
+	go f.serveAsync(ctx, asyncErrCh, rearm, reqDesc)
+	for done := false; !done; {
+		select {
+		case ctx = <-asyncCtxCh:
+		case <-ctx.Done():
+			// the route timeout replaces the frontend one, even if it has been sent just before the frontend timeout
+			select {
+			case ctx = <-asyncCtxCh:
+				continue
+			default:
+			}
+			// the tunnel is exempt from the request timeouts, it ends with the frontend connection
+			if reqDesc.isTunneled() && ctx != reqDesc.feConnCtx {
+				ctx = reqDesc.feConnCtx
+				continue
+			}
+			done = true
+			atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1)
+			err = errHTTPFrontendTimeout
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+			reqDesc.feConn.Flush()
+			reqDesc.feConn.Close()
+			<-asyncErrCh
+		case <-f.shutdownCtx.Done():
+			done = true
+			atomic.CompareAndSwapUint32(&reqDesc.isTransferErrLogged, 0, 1)
+			err = errHTTPFrontendShutdown
+			xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+			serveCtxCancel()
 			reqDesc.feConn.Flush()
 			reqDesc.feConn.Close()
+			<-asyncErrCh
+		case err = <-asyncErrCh:
+			done = true
+			if err != nil {
+				reqDesc.feConn.Flush()
+				reqDesc.feConn.Close()
+			}
 		}
 	}
 	// resetting and reading stats
@@ -413,34 +1863,236 @@ func (f *HTTPFrontend) serve(ctx context.Context, reqDesc *httpReqDesc) (err err
 			xlog.V(100).Debugf("unknown error on listener %q on frontend %q. may be it is a bug: %v", reqDesc.leName, reqDesc.feName, err)
 		}
 	} else {
-		f.promRequestDurationSeconds.With(promLabels).Observe(time.Now().Sub(startTime).Seconds())
+		promRequestDurationSeconds := f.promRequestDurationSeconds
+		if reqDesc.feRoute != nil && reqDesc.feRoute.promRequestDurationSeconds != nil {
+			promRequestDurationSeconds = reqDesc.feRoute.promRequestDurationSeconds
+		}
+		promRequestDurationSeconds.With(promLabels).Observe(time.Now().Sub(startTime).Seconds())
+	}
+	f.promRequestsTotal.MustCurryWith(promLabels).With(prometheus.Labels{"error": errDesc, "class": httpErrorClass(errDesc)}).Inc()
+
+	// requests which are served by a frontend or backend while it is being replaced or drained
+	if reqDesc.feReloading || f.IsDraining() {
+		outcome := httpErrorClass(errDesc)
+		if outcome == "" {
+			outcome = "completed"
+		}
+		promLBReloadInflightRequestsTotal.With(prometheus.Labels{"outcome": outcome}).Inc()
+	}
+
+	if reqDesc.feTap != nil {
+		tapErr := err
+		if errDesc == "" {
+			tapErr = nil
+		}
+		reqDesc.feTap.Finish(reqDesc, tapErr)
+	}
+
+	return
+}
+
+// readProxyProtocol reads the PROXY protocol header on the connection from a trusted peer before TLS, and returns the
+// source address advertised by it. The connections from other peers don't have the header.
+func (f *HTTPFrontend) readProxyProtocol(conn net.Conn) (addr net.Addr, err error) {
+	opts := f.options()
+	if !opts.AcceptProxyProtocol {
+		return
+	}
+	rawConn := conn
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		rawConn = c.NetConn()
+	}
+	tcpAddr, ok := rawConn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !isTrustedProxy(tcpAddr.IP, opts.ProxyProtocolNetworks) {
+		return
+	}
+	if opts.RequestTimeout > 0 {
+		rawConn.SetReadDeadline(time.Now().Add(opts.RequestTimeout))
+		defer rawConn.SetReadDeadline(time.Time{})
+	}
+	return readProxyProtocolHeader(rawConn)
+}
+
+// tlsHandshake makes the handshake of the client connection within the tls handshake timeout, or the request timeout
+// without it
+func (f *HTTPFrontend) tlsHandshake(tlsConn *tls.Conn) error {
+	opts := f.options()
+	timeout := opts.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = opts.RequestTimeout
 	}
-	f.promRequestsTotal.MustCurryWith(promLabels).With(prometheus.Labels{"error": errDesc}).Inc()
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	return tlsConn.Handshake()
+}
+
+// readH2CPreface peeks the client connection whether it starts with the connection preface of HTTP/2, within the request
+// timeout. The bytes are peeked one more at a time while they match, not to wait for more bytes of HTTP/1.1 requests.
+// Like the first read of requests, the peek is interrupted when ctx or the drain context is done, and its error is returned.
+func (f *HTTPFrontend) readH2CPreface(ctx context.Context, feConn *bufConn) (h2c bool, err error) {
+	if timeout := f.options().RequestTimeout; timeout > 0 {
+		feConn.SetReadDeadline(time.Now().Add(timeout))
+		defer feConn.SetReadDeadline(time.Time{})
+	}
+	resultCh := make(chan bool, 1)
+	go func() {
+		for n := 1; n <= len(http2ClientPreface); n++ {
+			b, e := feConn.Peek(n)
+			if e != nil || !strings.HasPrefix(http2ClientPreface, string(b)) {
+				resultCh <- false
+				return
+			}
+		}
+		resultCh <- true
+	}()
+	select {
+	case h2c = <-resultCh:
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-f.drainCtx.Done():
+		err = f.drainCtx.Err()
+	}
+	// the connection isn't read after the peek is interrupted
+	feConn.SetReadDeadline(time.Unix(1, 0))
+	<-resultCh
+	return
+}
 
+// newConnReqDesc returns the descriptor of the client connection from remoteAddr, which the descriptors of its requests
+// are copied from. The connection is counted if it has a deprecated tls state.
+func (f *HTTPFrontend) newConnReqDesc(ctx context.Context, l *Listener, remoteAddr net.Addr, tlsState *tls.ConnectionState) (connDesc httpReqDesc) {
+	opts := f.options()
+	connDesc = httpReqDesc{
+		leName:        l.opts.Name,
+		leTLS:         l.opts.TLSConfig != nil,
+		leClientPEM:   l.opts.TLSClientPEMHeader,
+		feName:        opts.Name,
+		feConnCtx:     ctx,
+		feDrainHeader: opts.DrainHeader,
+	}
+	connDesc.leHost, connDesc.lePort = splitHostPort(l.opts.Address)
+	if tlsState == nil {
+		return
+	}
+	connDesc.leTLSServerName, connDesc.leTLSVersion = strings.ToLower(tlsState.ServerName), tlsVersionName(tlsState.Version)
+	if len(tlsState.VerifiedChains) > 0 {
+		connDesc.leClientCert = tlsState.VerifiedChains[0][0]
+	}
+	if l.isTLSDeprecated(tlsState) {
+		connDesc.leTLSDeprecated = true
+		connDesc.leTLSWarnHeader = l.opts.TLSVersionWarnHeader
+		xlog.V(100).Debugf("deprecated tls connection from client %q to listener %q on frontend %q: %s %s sni %q", remoteAddr.String(), l.opts.Name, opts.Name, connDesc.leTLSVersion, tls.CipherSuiteName(tlsState.CipherSuite), connDesc.leTLSServerName)
+		// the server name is given by clients, so its label is bounded by the certificates of the listener
+		f.promDeprecatedTLSConnTotal.With(prometheus.Labels{
+			"listener": l.opts.Name,
+			"version":  connDesc.leTLSVersion,
+			"cipher":   tls.CipherSuiteName(tlsState.CipherSuite),
+			"sni":      l.tlsServerNameLabel(connDesc.leTLSServerName),
+		}).Inc()
+	}
 	return
 }
 
 // Serve implements Frontend's Serve method
 func (f *HTTPFrontend) Serve(ctx context.Context, l *Listener, conn net.Conn) {
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(5 * time.Second)
+	opts := f.options()
+	// the context of the connection is done when it ends, so backend connections established for it are closed
+	ctx, ctxCancel := context.WithCancel(ctx)
+	defer ctxCancel()
+	rawConn := conn
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		rawConn = c.NetConn()
+	}
+	if tcpConn, ok := rawConn.(*net.TCPConn); ok {
+		// keep-alive of accepted connections is left disabled by listeners, zero period means the period of the OS
+		if opts.TCPKeepAlivePeriod >= 0 {
+			tcpConn.SetKeepAlive(true)
+		}
+		if opts.TCPKeepAlivePeriod > 0 {
+			tcpConn.SetKeepAlivePeriod(opts.TCPKeepAlivePeriod)
+		}
+	}
+	proxyAddr, err := f.readProxyProtocol(conn)
+	if err != nil {
+		xlog.V(100).Debugf("serve error: read proxy protocol header from client %q to listener %q on frontend %q: %v", conn.RemoteAddr().String(), l.opts.Name, opts.Name, err)
+		e := err.(*httpError)
+		f.promRequestsTotal.With(prometheus.Labels{
+			"host":     "",
+			"path":     "",
+			"method":   "",
+			"backend":  "",
+			"server":   "",
+			"code":     "",
+			"listener": l.opts.Name,
+			"error":    e.Group,
+			"class":    httpErrorClass(e.Group),
+		}).Inc()
+		conn.Close()
+		return
+	}
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := f.tlsHandshake(tlsConn); err != nil {
+			reason := "failure"
+			if e := net.Error(nil); errors.As(err, &e) && e.Timeout() {
+				reason = "timeout"
+			}
+			xlog.V(100).Debugf("tls handshake error from client %q to listener %q on frontend %q: %v", conn.RemoteAddr().String(), l.opts.Name, opts.Name, err)
+			f.promTLSHandshakeErrors.With(prometheus.Labels{"listener": l.opts.Name, "reason": reason}).Inc()
+			conn.Close()
+			return
+		}
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+	if tlsState != nil && tlsState.NegotiatedProtocol == http2ALPNProto {
+		f.serveHTTP2(ctx, l, conn, proxyAddr, tlsState)
+		return
 	}
 	feConn := newBufConn(conn)
+	feConn.remoteAddr = proxyAddr
+	if opts.H2C && tlsState == nil {
+		h2c, err := f.readH2CPreface(ctx, feConn)
+		if err != nil {
+			// the peek is interrupted by the drain context unless ctx is done
+			if ctx.Err() == nil {
+				xlog.V(200).Debugf("drain timeout exceeded for client %q on listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, opts.Name)
+				f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "forced"}).Inc()
+			}
+			return
+		}
+		if h2c {
+			f.serveHTTP2(ctx, l, &http2PrefaceConn{Conn: conn, r: feConn}, proxyAddr, nil)
+			return
+		}
+	}
 	defer feConn.Flush()
-	xlog.V(200).Debugf("connected client %q to listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, f.opts.Name)
-	defer xlog.V(200).Debugf("disconnected client %q from listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, f.opts.Name)
+	if opts.TCPNoDelay {
+		feConn.SetNoDelay(true)
+	} else if opts.WriteProfile != HTTPFrontendWriteProfileDefault {
+		feConn.SetNoDelay(opts.WriteProfile != HTTPFrontendWriteProfileThroughput)
+	}
+	if tcpConn := feConn.tcpConn(); tcpConn != nil && opts.DSCP != 0 {
+		if err := sockopt.SetDSCP(tcpConn, opts.DSCP); err != nil {
+			xlog.V(100).Debugf("dscp error for client %q on listener %q on frontend %q: %v", feConn.RemoteAddr().String(), l.opts.Name, opts.Name, err)
+		}
+	}
+	xlog.V(200).Debugf("connected client %q to listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, opts.Name)
+	defer xlog.V(200).Debugf("disconnected client %q from listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, opts.Name)
 
 	promLabels := prometheus.Labels{
 		"listener": l.opts.Name,
 	}
 	f.promConnectionsTotal.With(promLabels).Inc()
 
-	if f.opts.MaxConn > 0 && f.totalConnCount >= int64(f.opts.MaxConn) {
+	if opts.MaxConn > 0 && f.totalConnCount >= int64(opts.MaxConn) {
 		err := errHTTPFrontendExhausted
 		xlog.V(100).Debugf("serve error on %s: %v", (&httpReqDesc{
 			leName: l.opts.Name,
-			feName: f.opts.Name,
+			feName: opts.Name,
 			feConn: feConn,
 		}).FrontendSummary(), err)
 		e := err.(*httpError)
@@ -453,6 +2105,7 @@ func (f *HTTPFrontend) Serve(ctx context.Context, l *Listener, conn net.Conn) {
 			"code":     "",
 			"listener": l.opts.Name,
 			"error":    e.Group,
+			"class":    httpErrorClass(e.Group),
 		}
 		f.promRequestsTotal.With(promLabels).Inc()
 		return
@@ -460,6 +2113,8 @@ func (f *HTTPFrontend) Serve(ctx context.Context, l *Listener, conn net.Conn) {
 	atomic.AddInt64(&f.totalConnCount, 1)
 	defer atomic.AddInt64(&f.totalConnCount, -1)
 
+	connDesc := f.newConnReqDesc(ctx, l, feConn.RemoteAddr(), tlsState)
+
 	for reqIdx, done := 0, false; !done; reqIdx++ {
 		if reqIdx > 0 {
 			atomic.AddInt64(&f.idleConnCount, 1)
@@ -469,12 +2124,26 @@ func (f *HTTPFrontend) Serve(ctx context.Context, l *Listener, conn net.Conn) {
 			f.promWaitingConnections.With(promLabels).Inc()
 		}
 
+		var idle *idleConn
+		reclaimCh := (<-chan struct{})(nil)
+		if reqIdx > 0 {
+			idle = connReclaim.Enter()
+			reclaimCh = idle.ch
+		}
+
+		var requestDeadline time.Time
+		if reqIdx <= 0 && opts.RequestTimeout > 0 {
+			requestDeadline = time.Now().Add(opts.RequestTimeout)
+		}
 		readErrCh := make(chan error, 1)
 		go func(reqIdx int) {
-			if reqIdx <= 0 && f.opts.RequestTimeout > 0 {
-				feConn.SetReadDeadline(time.Now().Add(f.opts.RequestTimeout))
+			if !requestDeadline.IsZero() {
+				feConn.SetReadDeadline(requestDeadline)
 			}
 			_, e := feConn.Reader.Peek(1)
+			if idle != nil {
+				connReclaim.Leave(idle)
+			}
 			if reqIdx > 0 {
 				atomic.AddInt64(&f.idleConnCount, -1)
 				f.promIdleConnections.With(promLabels).Dec()
@@ -486,8 +2155,8 @@ func (f *HTTPFrontend) Serve(ctx context.Context, l *Listener, conn net.Conn) {
 		}(reqIdx)
 
 		ctx, ctxCancel := ctx, context.CancelFunc(func() { /* null function */ })
-		if reqIdx > 0 && f.opts.KeepAliveTimeout > 0 {
-			ctx, ctxCancel = context.WithTimeout(ctx, f.opts.KeepAliveTimeout)
+		if reqIdx > 0 && opts.KeepAliveTimeout > 0 {
+			ctx, ctxCancel = context.WithTimeout(ctx, opts.KeepAliveTimeout)
 		}
 
 		select {
@@ -499,7 +2168,7 @@ func (f *HTTPFrontend) Serve(ctx context.Context, l *Listener, conn net.Conn) {
 						xlog.V(100).Debugf("serve error: read first byte from frontend: %v", err)
 						feConn.Write([]byte(httpRequestTimeout))
 					} else {
-						err = wrapHTTPError(httpErrGroupCommunication, err)
+						err = wrapHTTPError(httpErrGroupClientCommunication, err)
 						xlog.V(100).Debugf("serve error: read first byte from frontend: %v", err)
 					}
 					e := err.(*httpError)
@@ -512,32 +2181,71 @@ func (f *HTTPFrontend) Serve(ctx context.Context, l *Listener, conn net.Conn) {
 						"code":     "",
 						"listener": l.opts.Name,
 						"error":    e.Group,
+						"class":    httpErrorClass(e.Group),
 					}
 					f.promRequestsTotal.With(promLabels).Inc()
 				}
+				if f.IsDraining() {
+					f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "voluntary"}).Inc()
+				}
 				done = true
 				break
 			}
 			atomic.AddInt64(&f.activeConnCount, 1)
 			f.promActiveConnections.With(promLabels).Inc()
-			reqDesc := &httpReqDesc{
-				reqIdx: reqIdx,
-				leName: l.opts.Name,
-				leTLS:  l.opts.TLSConfig != nil,
-				feName: f.opts.Name,
-				feConn: feConn,
-			}
-			reqDesc.leHost, reqDesc.lePort = splitHostPort(l.opts.Address)
+			reqDesc := new(httpReqDesc)
+			*reqDesc = connDesc
+			reqDesc.reqIdx = reqIdx
+			reqDesc.feConn = feConn
+			reqDesc.feReqDeadline = requestDeadline
+			reqDesc.feClose = f.IsDraining() || (opts.MaxKeepAliveReqs >= 0 && reqIdx >= opts.MaxKeepAliveReqs)
+			reqDesc.feDrain = f.IsDraining()
+			forced := false
 			if e := f.serve(ctx, reqDesc); e != nil {
 				done = true
+				forced = errors.Is(e, errHTTPFrontendShutdown)
 			}
 			atomic.AddInt64(&f.activeConnCount, -1)
 			f.promActiveConnections.With(promLabels).Dec()
-			if (f.opts.MaxIdleConn > 0 && f.idleConnCount >= int64(f.opts.MaxIdleConn)) || (f.opts.MaxKeepAliveReqs >= 0 && reqIdx >= f.opts.MaxKeepAliveReqs) {
+			if reqDesc.feClose || (opts.MaxIdleConn > 0 && f.idleConnCount >= int64(opts.MaxIdleConn)) {
 				done = true
 			}
+			if forced {
+				f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "forced"}).Inc()
+			} else if done && reqDesc.feDrain {
+				f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "voluntary"}).Inc()
+			}
 		case <-ctx.Done():
+			if reqIdx > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				xlog.V(200).Debugf("keep-alive timeout exceeded for client %q on listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, opts.Name)
+				promLabels := prometheus.Labels{
+					"host":     "",
+					"path":     "",
+					"method":   "",
+					"backend":  "",
+					"server":   "",
+					"code":     "",
+					"listener": l.opts.Name,
+					"error":    httpErrGroupKeepAliveTimeout,
+					"class":    httpErrorClass(httpErrGroupKeepAliveTimeout),
+				}
+				f.promRequestsTotal.With(promLabels).Inc()
+				if f.IsDraining() {
+					f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "forced"}).Inc()
+				}
+			}
+			done = true
+		case <-f.drainCtx.Done():
+			xlog.V(200).Debugf("drain timeout exceeded for client %q on listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, opts.Name)
+			f.promDrainedConnTotal.With(prometheus.Labels{"listener": l.opts.Name, "close": "forced"}).Inc()
 			done = true
+		case <-reclaimCh:
+			xlog.V(200).Debugf("idle connection reclaimed for client %q on listener %q on frontend %q", feConn.RemoteAddr().String(), l.opts.Name, opts.Name)
+			f.promReclaimedConnTotal.With(promLabels).Inc()
+			done = true
+		}
+		if idle != nil {
+			connReclaim.Leave(idle)
 		}
 
 		ctxCancel()
@@ -0,0 +1,3001 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendAllowedUpstreamHosts(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:                 "test",
+		DefaultBackend:       b,
+		AllowedUpstreamHosts: []string{"*.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		req  string
+		code int
+	}{
+		{"GET / HTTP/1.1\r\nHost: internal.local\r\n\r\n", 200},
+		{"GET http://a.example.com/ HTTP/1.1\r\nHost: a.example.com\r\n\r\n", 200},
+		{"GET http://internal.local/ HTTP/1.1\r\nHost: a.example.com\r\n\r\n", 200},
+		{"GET http://a.example.com.internal.local:8080/ HTTP/1.1\r\nHost: a.example.com\r\n\r\n", 200},
+		{"CONNECT internal.local:443 HTTP/1.1\r\nHost: internal.local:443\r\n\r\n", 403},
+		{"CONNECT a.example.com.internal.local:443 HTTP/1.1\r\nHost: a.example.com.internal.local:443\r\n\r\n", 403},
+	} {
+		resp, _ := doTestRequestOnce(t, fLis, tc.req)
+		if resp.StatusCode != tc.code {
+			t.Errorf("request %q: got %d, want %d", tc.req, resp.StatusCode, tc.code)
+		}
+	}
+
+	labels := prometheus.Labels{"frontend": "test", "error": httpErrGroupUpstreamHostDenied}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	// the last log is in the future, so the denials are only counted
+	atomic.StoreInt64(&f.upstreamHostDeniedLogTime, time.Now().Add(time.Hour).UnixNano())
+	atomic.StoreInt64(&f.upstreamHostDeniedLogCount, 0)
+	for i := 0; i < 3; i++ {
+		if resp, _ := doTestRequestOnce(t, fLis, "CONNECT internal.local:443 HTTP/1.1\r\nHost: internal.local:443\r\n\r\n"); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("got %d, want %d", resp.StatusCode, http.StatusForbidden)
+		}
+	}
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 3 {
+		t.Errorf("got %v denied requests, want 3", n)
+	}
+	if n := atomic.LoadInt64(&f.upstreamHostDeniedLogCount); n != 3 {
+		t.Errorf("got %d denials waiting for log, want 3", n)
+	}
+}
+
+func TestHTTPFrontendTLSVersionWarnOnly(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "test",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	tlsConfig := &tls.Config{Certificates: certSrv.TLS.Certificates}
+
+	for _, tc := range []struct {
+		warnOnly bool
+		version  uint16
+		warning  string
+		fail     bool
+	}{
+		{true, tls.VersionTLS11, `299 - "TLS upgrade required"`, false},
+		{true, tls.VersionTLS12, "", false},
+		{false, tls.VersionTLS11, "", true},
+		{false, tls.VersionTLS12, "", false},
+	} {
+		fLis := runTestListener(t, ListenerOptions{
+			Fe:                   f,
+			TLSConfig:            tlsConfig,
+			TLSMinVersion:        tls.VersionTLS12,
+			TLSVersionWarnOnly:   tc.warnOnly,
+			TLSVersionWarnHeader: true,
+		})
+		conn, err := tls.Dial("tcp", fLis.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tc.version,
+			MaxVersion:         tc.version,
+		})
+		if err != nil {
+			if !tc.fail {
+				t.Errorf("warnonly %v version %x: handshake error: %v", tc.warnOnly, tc.version, err)
+			}
+			fLis.Close()
+			continue
+		}
+		if tc.fail {
+			t.Errorf("warnonly %v version %x: expected handshake error", tc.warnOnly, tc.version)
+		}
+		resp := doTestRequest(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != 200 || resp.Header.Get("Warning") != tc.warning {
+			t.Errorf("warnonly %v version %x: got %d %q, want 200 %q", tc.warnOnly, tc.version, resp.StatusCode, resp.Header.Get("Warning"), tc.warning)
+		}
+		conn.Close()
+		fLis.Close()
+	}
+
+	// deprecated connections are counted by the certificate name which matches their server name
+	fLis := runTestListener(t, ListenerOptions{
+		Fe:                 f,
+		TLSConfig:          tlsConfig,
+		TLSMinVersion:      tls.VersionTLS12,
+		TLSVersionWarnOnly: true,
+	})
+	defer fLis.Close()
+	for _, tc := range []struct {
+		serverName, sni string
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.com", "*.example.com"},
+		{"a.b.example.com", ""},
+		{"unknown.org", ""},
+	} {
+		labels := prometheus.Labels{"frontend": "test", "sni": tc.sni}
+		base := testCounterSum(promHTTPFrontendDeprecatedTLSConnTotal, labels)
+		conn, err := tls.Dial("tcp", fLis.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         tc.serverName,
+			MinVersion:         tls.VersionTLS11,
+			MaxVersion:         tls.VersionTLS11,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := doTestRequest(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp.Body.Close()
+		conn.Close()
+		if n := testCounterSum(promHTTPFrontendDeprecatedTLSConnTotal, labels) - base; n != 1 {
+			t.Errorf("server name %q: got %v deprecated connections with sni %q, want 1", tc.serverName, n, tc.sni)
+		}
+	}
+}
+
+func TestListenerTLSCipherSuites(t *testing.T) {
+	secure, insecure := tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA
+	for _, tc := range []struct {
+		configSuites, optSuites []uint16
+		warnOnly                bool
+		want                    []uint16
+	}{
+		{[]uint16{secure, insecure}, nil, true, []uint16{secure, insecure}},
+		{[]uint16{secure, insecure}, nil, false, []uint16{secure}},
+		{[]uint16{secure}, []uint16{insecure, secure}, true, []uint16{insecure, secure}},
+		{nil, []uint16{insecure, secure}, false, []uint16{secure}},
+	} {
+		opts := ListenerOptions{
+			TLSConfig:          &tls.Config{CipherSuites: tc.configSuites},
+			TLSMinVersion:      tls.VersionTLS12,
+			TLSVersionWarnOnly: tc.warnOnly,
+			TLSCipherSuites:    tc.optSuites,
+		}
+		if got := opts.tlsServerConfig().CipherSuites; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("config %v options %v warnonly %v: got cipher suites %v, want %v", tc.configSuites, tc.optSuites, tc.warnOnly, got, tc.want)
+		}
+	}
+	// without configured cipher suites, insecure ones are added in warn-only mode
+	opts := ListenerOptions{TLSConfig: &tls.Config{}, TLSMinVersion: tls.VersionTLS12, TLSVersionWarnOnly: true}
+	if got := opts.tlsServerConfig().CipherSuites; len(got) != len(tls.CipherSuites())+len(tls.InsecureCipherSuites()) {
+		t.Errorf("got %d cipher suites in warn-only mode, want secure and insecure ones", len(got))
+	}
+}
+
+func TestListenerTLSDefaults(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "tlsdefaults",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	fLis := runTestListener(t, ListenerOptions{
+		Fe:        f,
+		TLSConfig: &tls.Config{Certificates: certSrv.TLS.Certificates},
+	})
+	defer fLis.Close()
+
+	// tls 1.0, rsa key exchange and 3des are accepted without tlsminversion, like go 1.13
+	for _, suite := range []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA, tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA, tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA} {
+		conn, err := tls.Dial("tcp", fLis.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         tls.VersionTLS10,
+			CipherSuites:       []uint16{suite},
+		})
+		if err != nil {
+			t.Errorf("%s: got handshake error %v", tls.CipherSuiteName(suite), err)
+			continue
+		}
+		if st := conn.ConnectionState(); st.Version != tls.VersionTLS10 || st.CipherSuite != suite {
+			t.Errorf("%s: got tls version %x and cipher suite %s", tls.CipherSuiteName(suite), st.Version, tls.CipherSuiteName(st.CipherSuite))
+		}
+		conn.Close()
+	}
+}
+
+func TestHTTPFrontendTLSHandshake(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:                "tlshandshake",
+		DefaultBackend:      b,
+		TLSHandshakeTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	fLis := runTestListener(t, ListenerOptions{
+		Fe:            f,
+		TLSConfig:     &tls.Config{Certificates: certSrv.TLS.Certificates},
+		TLSMaxVersion: tls.VersionTLS12,
+	})
+	defer fLis.Close()
+
+	conn, err := tls.Dial("tcp", fLis.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := conn.ConnectionState().Version; v != tls.VersionTLS12 {
+		t.Errorf("got tls version %x, want %x", v, tls.VersionTLS12)
+	}
+	rd := bufio.NewReader(conn)
+	resp := doTestRequest(t, conn, rd, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "https" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, "https")
+	}
+	conn.Close()
+
+	reqBase := testCounterSum(promHTTPFrontendRequestsTotal, prometheus.Labels{"frontend": "tlshandshake"})
+	for _, tc := range []struct {
+		data   string
+		reason string
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "failure"},
+		{"", "timeout"},
+	} {
+		labels := prometheus.Labels{"frontend": "tlshandshake", "reason": tc.reason}
+		base := testCounterSum(promHTTPFrontendTLSHandshakeErrorsTotal, labels)
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(tc.data))
+		ioutil.ReadAll(conn)
+		conn.Close()
+		time.Sleep(50 * time.Millisecond)
+		if n := testCounterSum(promHTTPFrontendTLSHandshakeErrorsTotal, labels) - base; n != 1 {
+			t.Errorf("got %v tls handshake errors with reason %q, want 1", n, tc.reason)
+		}
+	}
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, prometheus.Labels{"frontend": "tlshandshake"}) - reqBase; n != 0 {
+		t.Errorf("got %v requests for tls handshake errors, want 0", n)
+	}
+}
+
+// newTestClientCert creates a certificate of given common name and DNS names, signed by parent. It is a CA certificate
+// if parent is nil.
+func newTestClientCert(t *testing.T, parent *tls.Certificate, cn string, dnsNames ...string) (cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+	} else {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Certificate, cert.PrivateKey = [][]byte{der}, key
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestHTTPFrontendClientCert(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Cert-Subject") + "|" + r.Header.Get("X-Client-Cert-SAN") + "|" + strconv.FormatBool(r.Header.Get("X-Client-Cert") != "")))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "clientcert",
+		Routes: []HTTPFrontendRoute{
+			{
+				Path:         "/billing/*",
+				Backend:      b,
+				Restrictions: []HTTPFrontendRestriction{{ClientCertSubject: "CN=billing,*", Invert: true}},
+			},
+		},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ca := newTestClientCert(t, nil, "ca")
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.Leaf)
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	fLis := runTestListener(t, ListenerOptions{
+		Fe:                 f,
+		TLSConfig:          &tls.Config{Certificates: certSrv.TLS.Certificates},
+		TLSClientAuth:      ListenerClientAuthRequire,
+		TLSClientCAs:       caPool,
+		TLSClientSANs:      []string{"*.internal.example.com"},
+		TLSClientPEMHeader: true,
+	})
+	defer fLis.Close()
+
+	request := func(cert *tls.Certificate, req string) (code int, body string, err error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", fLis.Addr().String(), tlsConfig)
+		if err != nil {
+			return 0, "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		resp := doTestRequest(t, conn, bufio.NewReader(conn), req)
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data), nil
+	}
+
+	billing := newTestClientCert(t, &ca, "billing", "billing.internal.example.com")
+	ops := newTestClientCert(t, &ca, "ops", "ops.internal.example.com")
+	other := newTestClientCert(t, &ca, "other", "other.example.org")
+	selfSigned := newTestClientCert(t, nil, "billing", "billing.internal.example.com")
+	for _, tc := range []struct {
+		cert *tls.Certificate
+		path string
+		code int
+		body string
+	}{
+		{&billing, "/billing/a", 200, "CN=billing,O=Example|billing.internal.example.com|true"},
+		{&ops, "/", 200, "CN=ops,O=Example|ops.internal.example.com|true"},
+		{&ops, "/billing/a", 403, ""},
+		{&other, "/", 0, ""},
+		{&selfSigned, "/", 0, ""},
+		{nil, "/", 0, ""},
+	} {
+		name := "no client certificate"
+		if tc.cert != nil {
+			name = tc.cert.Leaf.Subject.String()
+		}
+		// headers of clients are replaced by the verified identity
+		code, body, err := request(tc.cert, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\nX-Client-Cert-Subject: CN=billing\r\n\r\n")
+		if tc.code == 0 {
+			if err == nil {
+				t.Errorf("%s: got %d, want handshake error", name, code)
+			}
+			continue
+		}
+		if err != nil || code != tc.code || (tc.body != "" && body != tc.body) {
+			t.Errorf("%s %s: got %d %q %v, want %d %q", name, tc.path, code, body, err, tc.code, tc.body)
+		}
+	}
+
+	// headers of clients are removed on listeners without client certificate verification too
+	plainLis := runTestFrontend(t, f)
+	defer plainLis.Close()
+	resp, body := doTestRequestOnce(t, plainLis, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Client-Cert-Subject: CN=billing\r\nX-Client-Cert-SAN: billing.internal.example.com\r\nX-Client-Cert: x\r\n\r\n")
+	if want := "||false"; resp.StatusCode != 200 || body != want {
+		t.Errorf("plain listener: got %d %q, want 200 %q", resp.StatusCode, body, want)
+	}
+}
+
+func TestHTTPFrontendStripPathPrefix(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		if loc := r.URL.Query().Get("location"); loc != "" {
+			w.Header().Set("Location", loc)
+		}
+		w.Write([]byte(r.Header.Get("X-Forwarded-Prefix") + " " + r.URL.RequestURI()))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "test",
+		Routes: []HTTPFrontendRoute{
+			{
+				Path:            "/servicea/*",
+				Backend:         b,
+				StripPathPrefix: "/serviceA",
+				RewriteLocation: true,
+				Restrictions:    []HTTPFrontendRestriction{{Path: "/servicea/admin/*"}},
+			},
+		},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		uri, body, location string
+	}{
+		{"/serviceA/x?y=1", "/serviceA /x?y=1", ""},
+		{"/serviceA", "/serviceA /", ""},
+		{"/serviceA?y=/serviceA", "/serviceA /?y=/serviceA", ""},
+		{"/serviceA/?location=/login", "/serviceA /?location=/login", "/serviceA/login"},
+		{"/serviceA/?location=http://other/login", "/serviceA /?location=http://other/login", "http://other/login"},
+		{"/serviceA/?location=//other/login", "/serviceA /?location=//other/login", "//other/login"},
+		{"/serviceAB/x", " /serviceAB/x", ""},
+		{"/SERVICEA/x", "/serviceA /x", ""},
+	} {
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if body != tc.body || resp.Header.Get("Location") != tc.location {
+			t.Errorf("uri %q: got %q %q, want %q %q", tc.uri, body, resp.Header.Get("Location"), tc.body, tc.location)
+		}
+	}
+
+	// restrictions see the path before stripping
+	if resp, _ := doTestRequestOnce(t, fLis, "GET /serviceA/admin/x HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d, want %d for restricted path", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestHTTPFrontendRewritePath(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "rewritepath", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	})
+	defer closer()
+
+	users := HTTPFrontendRoute{Path: "/users/*", Backend: b}
+	users.RewritePath.Pattern = "^/users/([^/]+)/profile$"
+	users.RewritePath.Replacement = "/profile?user=$1"
+	legacy := HTTPFrontendRoute{Path: "/legacy/*", Backend: b, StripPathPrefix: "/legacy"}
+	legacy.RewritePath.Pattern = "^/index\\.html$"
+	legacy.RewritePath.Replacement = ""
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "rewritepath",
+		Routes: []HTTPFrontendRoute{users, legacy},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		uri, body string
+	}{
+		{"/users/42/profile", "/profile?user=42"},
+		{"/users/42/profile?tab=posts", "/profile?user=42&tab=posts"},
+		{"/users/42/settings?tab=posts", "/users/42/settings?tab=posts"},
+		{"/legacy/index.html?v=1", "/?v=1"},
+		{"/legacy/page.html", "/page.html"},
+	} {
+		if resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("uri %q: got %d %q, want 200 %q", tc.uri, resp.StatusCode, body, tc.body)
+		}
+	}
+
+	badRoute := users
+	badRoute.RewritePath.Pattern = "^/users/(["
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "rewritepath", Routes: []HTTPFrontendRoute{badRoute}}); err == nil || !strings.Contains(err.Error(), "rewrite path") {
+		t.Errorf("got error %v, want rewrite path error", err)
+	}
+}
+
+func TestHTTPFrontendSetHost(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "sethost", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.Header.Get("X-Forwarded-Host")))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "sethost",
+		Routes: []HTTPFrontendRoute{
+			{Host: "*.svc.example.com", Path: "/*", Backend: b, SetHost: "internal.local"},
+			{Path: "/internal/*", Backend: b, SetHost: "internal.local:8080"},
+		},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		req, body string
+	}{
+		{"GET /x HTTP/1.1\r\nHost: api.svc.example.com\r\n\r\n", "internal.local api.svc.example.com"},
+		{"GET /internal/x HTTP/1.0\r\n\r\n", "internal.local:8080 "},
+		{"GET /x HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "www.example.com www.example.com"},
+	} {
+		if resp, body := doTestRequestOnce(t, fLis, tc.req); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("request %q: got %d %q, want 200 %q", tc.req, resp.StatusCode, body, tc.body)
+		}
+	}
+
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "sethost", Routes: []HTTPFrontendRoute{{Backend: b, SetHost: "bad\r\nhost"}}}); err == nil {
+		t.Error("expected error for invalid set host")
+	}
+}
+
+func TestHTTPFrontendBandwidthLimit(t *testing.T) {
+	const rate = 64 * 1024
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, rate*3/2))
+	})
+	defer closer()
+
+	for _, route := range []HTTPFrontendRoute{
+		{Backend: b, MaxResponseBytesPerSecond: rate},
+		{Backend: b, PerClientBytesPerSecond: rate},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:   "test",
+			Routes: []HTTPFrontendRoute{route},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+
+		startTime := time.Now()
+		for i := 0; i < 2; i++ {
+			if _, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); len(body) != rate*3/2 {
+				t.Errorf("got body length %d, want %d", len(body), rate*3/2)
+			}
+		}
+		// bucket starts full, so 3*rate bytes take 2 seconds
+		if d := time.Now().Sub(startTime); d < 1800*time.Millisecond || d > 3*time.Second {
+			t.Errorf("route %d/%d: transfer took %v", route.MaxResponseBytesPerSecond, route.PerClientBytesPerSecond, d)
+		}
+		fLis.Close()
+		f.Close()
+	}
+}
+
+func TestThrottleWriterContext(t *testing.T) {
+	// the wait for the bucket is interrupted by the context, its error has the group of the writer
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer ctxCancel()
+	tb := newTokenBucket(1024)
+	tb.Take(1024)
+	tw := &throttleWriter{
+		W:                ioutil.Discard,
+		Ctx:              ctx,
+		CtxErrGroup:      httpErrGroupBackendTimeout,
+		Buckets:          []*tokenBucket{tb},
+		ThrottledBytes:   prometheus.NewCounter(prometheus.CounterOpts{Name: "throttled_bytes"}),
+		ThrottledSeconds: prometheus.NewCounter(prometheus.CounterOpts{Name: "throttled_seconds"}),
+	}
+	_, err := tw.Write(make([]byte, 4096))
+	if e, ok := err.(*httpError); !ok || e.Group != httpErrGroupBackendTimeout || e.Err != context.DeadlineExceeded {
+		t.Errorf("got error %#v, want %q group of context error", err, httpErrGroupBackendTimeout)
+	}
+}
+
+func TestHTTPFrontendTimeoutHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, err := time.ParseDuration(r.URL.Query().Get("sleep")); err == nil {
+			time.Sleep(d)
+		}
+		w.Write([]byte(r.Header.Get("X-Request-Timeout")))
+	}))
+	defer srv.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "test",
+		Timeout: 500 * time.Millisecond,
+		Servers: []string{srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "test",
+		DefaultBackend: b,
+		TimeoutHeader:  "X-Request-Timeout",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		header, sleep string
+		code          int
+		min, max      int
+	}{
+		{"200", "0", http.StatusOK, 100, 200},
+		{"200", "300ms", http.StatusGatewayTimeout, 0, 0},
+		{"0", "0", http.StatusGatewayTimeout, 0, 0},
+		{"10000", "0", http.StatusOK, 400, 500},
+		{"10000", "300ms", http.StatusOK, 400, 500},
+		{"abc", "300ms", http.StatusOK, 400, 500},
+		{"-5", "0", http.StatusOK, 400, 500},
+		{"", "0", http.StatusOK, 400, 500},
+	} {
+		hdr := ""
+		if tc.header != "" {
+			hdr = "X-Request-Timeout: " + tc.header + "\r\n"
+		}
+		resp, body := doTestRequestOnce(t, fLis, "GET /?sleep="+tc.sleep+" HTTP/1.1\r\nHost: example.com\r\n"+hdr+"\r\n")
+		if resp.StatusCode != tc.code {
+			t.Errorf("header %q sleep %s: got code %d, want %d", tc.header, tc.sleep, resp.StatusCode, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if v, err := strconv.Atoi(body); err != nil || v < tc.min || v > tc.max {
+			t.Errorf("header %q sleep %s: got forwarded %q, want between %d and %d", tc.header, tc.sleep, body, tc.min, tc.max)
+		}
+	}
+}
+
+func TestHTTPFrontendRouteTimeout(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "routetimeout", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:    "routetimeout",
+		Timeout: 100 * time.Millisecond,
+		Routes: []HTTPFrontendRoute{
+			{Path: "/export/*", Backend: b, Timeout: time.Second},
+			{Path: "/short/*", Backend: b, Timeout: 50 * time.Millisecond},
+		},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		req string
+		ok  bool
+	}{
+		{"GET /export/x HTTP/1.1\r\nHost: example.com\r\n\r\n", true},
+		{"GET /other HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		{"GET /short/x HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		// the frontend timeout still bounds reading the header
+		{"GET /export/x HTTP/1.1\r\nHost: example.com\r\n", false},
+	} {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(tc.req))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if ok := err == nil && resp.StatusCode == http.StatusOK; ok != tc.ok {
+			t.Errorf("request %q: got response %v error %v, want ok %v", tc.req, resp, err, tc.ok)
+		}
+		conn.Close()
+	}
+}
+
+func TestHTTPFrontendDrain(t *testing.T) {
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			if _, err := http.ReadRequest(rd); err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: keep-alive\r\n\r\nOK"))
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "test",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "drain",
+		MaxKeepAliveReqs: 1,
+		DrainTimeout:     200 * time.Millisecond,
+		DrainHeader:      true,
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	drainedCount := func(close string) float64 {
+		return testCounterSum(promHTTPFrontendDrainedConnTotal, prometheus.Labels{"frontend": "drain", "close": close})
+	}
+	voluntary, forced := drainedCount("voluntary"), drainedCount("forced")
+
+	const req = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	dial := func() (conn net.Conn, rd *bufio.Reader) {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	readResp := func(conn net.Conn, rd *bufio.Reader) *http.Response {
+		resp := doTestRequest(t, conn, rd, req)
+		ioutil.ReadAll(resp.Body)
+		return resp
+	}
+	expectEOF := func(conn net.Conn, rd *bufio.Reader) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := rd.ReadByte(); err == nil {
+			t.Fatal("expected closed connection")
+		}
+	}
+
+	// the last keep-alive request is signalled without drain header
+	conn1, rd1 := dial()
+	defer conn1.Close()
+	if resp := readResp(conn1, rd1); resp.Close {
+		t.Fatal("got Connection: close on first request")
+	}
+	if resp := readResp(conn1, rd1); !resp.Close || resp.Header.Get("X-Drain") != "" {
+		t.Fatalf("got close %v X-Drain %q on last keep-alive request", resp.Close, resp.Header.Get("X-Drain"))
+	}
+	expectEOF(conn1, rd1)
+
+	conn2, rd2 := dial()
+	defer conn2.Close()
+	readResp(conn2, rd2)
+	conn3, rd3 := dial()
+	defer conn3.Close()
+	readResp(conn3, rd3)
+
+	f.Drain()
+	if resp := readResp(conn2, rd2); !resp.Close || resp.Header.Get("X-Drain") != "true" {
+		t.Fatalf("got close %v X-Drain %q while draining", resp.Close, resp.Header.Get("X-Drain"))
+	}
+	expectEOF(conn2, rd2)
+	expectEOF(conn3, rd3)
+
+	// counters are increased after the connections closed
+	time.Sleep(50 * time.Millisecond)
+	if d := drainedCount("voluntary") - voluntary; d != 1 {
+		t.Errorf("got %v voluntary closes, want 1", d)
+	}
+	if d := drainedCount("forced") - forced; d != 1 {
+		t.Errorf("got %v forced closes, want 1", d)
+	}
+}
+
+func TestHTTPFrontendShutdown(t *testing.T) {
+	release := make(chan struct{})
+	b, closer := newTestHTTPBackend(t, "shutdown", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		} else if r.URL.Path == "/stuck" {
+			<-release
+		}
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+	defer close(release)
+
+	newFrontend := func() (*HTTPFrontend, net.Listener) {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:             "shutdown",
+			MaxKeepAliveReqs: -1,
+			DefaultBackend:   b,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f, runTestFrontend(t, f)
+	}
+	send := func(fLis net.Listener, uri string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET " + uri + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		return conn, bufio.NewReader(conn)
+	}
+	waitDraining := func(f *HTTPFrontend) {
+		for endTime := time.Now().Add(2 * time.Second); f.DrainingConnCount() <= 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(endTime) {
+				t.Fatal("no draining connection")
+			}
+		}
+	}
+
+	// the in-flight request is completed before the deadline
+	f, fLis := newFrontend()
+	defer fLis.Close()
+	conn, rd := send(fLis, "/slow")
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := f.DrainingConnCount(); n != 0 {
+		t.Errorf("got %d draining connections before shutdown, want 0", n)
+	}
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer ctxCancel()
+	shutdownErrCh := make(chan error, 1)
+	go func() { shutdownErrCh <- f.Shutdown(ctx) }()
+	waitDraining(f)
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("got %d %q while shutting down, want %d %q", resp.StatusCode, body, http.StatusOK, "OK")
+	}
+	if err := <-shutdownErrCh; err != nil {
+		t.Errorf("got shutdown error %v, want nil", err)
+	}
+	if n := f.DrainingConnCount(); n != 0 {
+		t.Errorf("got %d draining connections after shutdown, want 0", n)
+	}
+
+	// the stuck request is aborted when the deadline exceeded
+	labels := prometheus.Labels{"frontend": "shutdown", "error": httpErrGroupFrontendShutdown}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	f, fLis = newFrontend()
+	defer fLis.Close()
+	conn, rd = send(fLis, "/stuck")
+	defer conn.Close()
+	waitConn := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&f.activeConnCount) <= 0 && time.Now().Before(waitConn) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, ctxCancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer ctxCancel()
+	if err := f.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got shutdown error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if data, _ := ioutil.ReadAll(rd); len(data) != 0 {
+		t.Errorf("got %q from the aborted request, want closed connection", data)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 1 {
+		t.Errorf("got %v frontend shutdown errors, want 1", n)
+	}
+}
+
+func TestHTTPFrontendBucketProfile(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "bucketprofile",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/search", Backend: b, BucketProfile: "slow"},
+		},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"frontend": "bucketprofile"}
+	profileCount, defaultCount := testCounterSum(promHTTPFrontendProfileDurationSeconds["slow"], labels), testCounterSum(promHTTPFrontendRequestDurationSeconds, labels)
+	for _, uri := range []string{"/search", "/search", "/other"} {
+		doTestRequestOnce(t, fLis, "GET "+uri+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}
+	if d := testCounterSum(promHTTPFrontendProfileDurationSeconds["slow"], labels) - profileCount; d != 2 {
+		t.Errorf("got %v observations on profile histogram, want 2", d)
+	}
+	if d := testCounterSum(promHTTPFrontendRequestDurationSeconds, labels) - defaultCount; d != 1 {
+		t.Errorf("got %v observations on default histogram, want 1", d)
+	}
+
+	if _, err := f.Fork(HTTPFrontendOptions{
+		Name: "bucketprofile",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/search", Backend: b, BucketProfile: "unknown"},
+		},
+	}); err == nil {
+		t.Fatal("expected error for unknown bucket profile")
+	}
+}
+
+func TestHTTPFrontendAuthHook(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Authenticated-Client")))
+	})
+	defer closer()
+
+	script, err := ioutil.ReadFile("../../conf/authhook.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := HTTPFrontendRoute{Path: "/api/*", Backend: b}
+	route.AuthHook.Script = string(script)
+	failingRoute := HTTPFrontendRoute{Path: "/failing/*", Backend: b}
+	failingRoute.AuthHook.Script = `function authorize(req) error("failed") end`
+	failOpenRoute := HTTPFrontendRoute{Path: "/failopen/*", Backend: b}
+	failOpenRoute.AuthHook.Script = failingRoute.AuthHook.Script
+	failOpenRoute.AuthHook.FailOpen = true
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "test",
+		Routes:         []HTTPFrontendRoute{route, failingRoute, failOpenRoute},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	hdr := http.Header{"X-Client-Id": {"client-a"}}
+	testAuthHookSign("secret-a", "GET", "/api/x", hdr)
+	var signed strings.Builder
+	hdr.Write(&signed)
+
+	for _, tc := range []struct {
+		uri, hdr string
+		code     int
+		body     string
+	}{
+		{"/api/x", signed.String(), http.StatusOK, "client-a"},
+		{"/api/y", signed.String(), http.StatusForbidden, "Forbidden\r\n"},
+		{"/api/x", "", http.StatusUnauthorized, "Unauthorized\r\n"},
+		{"/failing/x", "", http.StatusServiceUnavailable, "Service Unavailable\r\n"},
+		{"/failopen/x", "", http.StatusOK, ""},
+		{"/other", "", http.StatusOK, ""},
+	} {
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: example.com\r\n"+tc.hdr+"\r\n")
+		if resp.StatusCode != tc.code || body != tc.body {
+			t.Errorf("uri %q: got %d %q, want %d %q", tc.uri, resp.StatusCode, body, tc.code, tc.body)
+		}
+		if tc.code == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "HMAC" {
+			t.Errorf("uri %q: got WWW-Authenticate %q", tc.uri, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+
+	badRoute := HTTPFrontendRoute{Path: "/", Backend: b}
+	badRoute.AuthHook.Script = `function authorize(req`
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "test", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+		t.Fatal("expected error for invalid auth hook script")
+	}
+}
+
+func TestHTTPFrontendErrorClass(t *testing.T) {
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			switch req.URL.Path {
+			case "/big":
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1073741824\r\n\r\n"))
+				buf := make([]byte, 64*1024)
+				for {
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			case "/broken":
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort"))
+				return
+			default:
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: keep-alive\r\n\r\nOK"))
+			}
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "test",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "errorclass",
+		RequestTimeout:   200 * time.Millisecond,
+		MaxKeepAliveReqs: -1,
+		KeepAliveTimeout: 200 * time.Millisecond,
+		Routes: []HTTPFrontendRoute{
+			{Host: "example.com", Backend: b},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	want := map[string]float64{
+		"":               1,
+		"client_abort":   1,
+		"client_timeout": 2,
+		"backend_error":  1,
+		"lb_error":       1,
+	}
+	countByClass := func() map[string]float64 {
+		m := make(map[string]float64, len(want))
+		for class := range want {
+			m[class] = testCounterSum(promHTTPFrontendRequestsTotal, prometheus.Labels{"frontend": "errorclass", "class": class})
+		}
+		return m
+	}
+	base := countByClass()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+
+	// client_abort: client closes while response body is transferring
+	conn, rd := dial()
+	doTestRequest(t, conn, rd, "GET /big HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	conn.Close()
+
+	// backend_error: backend closes before sending whole body
+	doTestRequestOnce(t, fLis, "GET /broken HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	// lb_error: restricted request
+	doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: other.com\r\n\r\n")
+
+	// client_timeout: request timeout and keep-alive timeout
+	conn, rd = dial()
+	defer conn.Close()
+	conn2, rd2 := dial()
+	defer conn2.Close()
+	doTestRequest(t, conn2, rd2, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	ioutil.ReadAll(rd)
+	ioutil.ReadAll(rd2)
+
+	for endTime := time.Now().Add(3 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		got := countByClass()
+		for class := range got {
+			got[class] -= base[class]
+		}
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(endTime) {
+			t.Fatalf("got requests by class %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHTTPFrontendOptionsPatternCache(t *testing.T) {
+	const pattern = "*.pattern-cache.example.com"
+	opts := HTTPFrontendOptions{
+		Routes: []HTTPFrontendRoute{
+			{Host: pattern},
+		},
+	}
+	var o1, o2 HTTPFrontendOptions
+	o1.CopyFrom(&opts)
+	o2.CopyFrom(&opts)
+	if o1.Routes[0].hostRgxs[0] != o2.Routes[0].hostRgxs[0] {
+		t.Error("compiled pattern isn't shared between copies")
+	}
+
+	has := func() bool {
+		compiledArtifacts.mu.Lock()
+		defer compiledArtifacts.mu.Unlock()
+		_, ok := compiledArtifacts.items["pattern:"+pattern]
+		return ok
+	}
+	SweepArtifactCache()
+	if !has() {
+		t.Fatal("used pattern swept")
+	}
+	SweepArtifactCache()
+	if has() {
+		t.Fatal("unused pattern isn't swept")
+	}
+}
+
+func TestHTTPFrontendRouteRegexp(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "regexp", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("regexp"))
+	})
+	defer closer()
+	other, otherCloser := newTestHTTPBackend(t, "regexp-other", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	})
+	defer otherCloser()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "regexp",
+		Routes: []HTTPFrontendRoute{
+			{Path: "^/v1/internal(/|$)", PathIsRegexp: true, Backend: other},
+			{Host: `^(api|www)\.example\.com$`, HostIsRegexp: true, Path: "^/v[12]/", PathIsRegexp: true, Backend: b},
+			// glob patterns aren't affected by regexp syntax
+			{Path: "/v[3]/*", Backend: b},
+		},
+		DefaultBackend: other,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		host, uri, body string
+	}{
+		{"api.example.com", "/v1/x", "regexp"},
+		{"WWW.Example.com", "/V2/x", "regexp"},
+		{"api.example.com", "/v1/internal/x", "other"},
+		{"api.example.com", "/v1/internals", "regexp"},
+		{"api.example.com", "/v3/x", "other"},
+		{"api.example.com.evil", "/v1/x", "other"},
+		{"api.example.com", "/v[3]/x", "regexp"},
+	} {
+		if resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: "+tc.host+"\r\n\r\n"); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("host %q uri %q: got %d %q, want 200 %q", tc.host, tc.uri, resp.StatusCode, body, tc.body)
+		}
+	}
+
+	for _, route := range []HTTPFrontendRoute{
+		{Host: "(api", HostIsRegexp: true, Backend: b},
+		{Path: "/v[12/", PathIsRegexp: true, Backend: b},
+	} {
+		if _, err := NewHTTPFrontend(HTTPFrontendOptions{Name: "regexp", Routes: []HTTPFrontendRoute{route}}); err == nil {
+			t.Errorf("host %q path %q: expected error for invalid regexp", route.Host, route.Path)
+		}
+		if err := f.SetRoutes([]HTTPFrontendRoute{route}); err == nil {
+			t.Errorf("host %q path %q: expected error for invalid regexp on SetRoutes", route.Host, route.Path)
+		}
+	}
+}
+
+func TestHTTPFrontendRoutePriority(t *testing.T) {
+	high, highCloser := newTestHTTPBackend(t, "priority-high", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("high"))
+	})
+	defer highCloser()
+	low, lowCloser := newTestHTTPBackend(t, "priority-low", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("low"))
+	})
+	defer lowCloser()
+
+	routes := []HTTPFrontendRoute{
+		{Path: "/*", Backend: low},
+		{Path: "/api/*", Backend: low, Priority: -1},
+		{Path: "/api/v1/*", Backend: high, Priority: 10},
+		{Path: "/static/*", Backend: high},
+		{Path: "/api/*", Backend: high, Priority: 10},
+	}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "priority",
+		Routes: routes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// ties keep the given order
+	want := []string{"/api/v1/*", "/api/*", "/*", "/static/*", "/api/*"}
+	got := f.GetOpts().Routes
+	for i := range want {
+		if got[i].Path != want[i] {
+			t.Fatalf("got route %d path %q, want %q", i, got[i].Path, want[i])
+		}
+	}
+	if routes[0].Path != "/*" {
+		t.Error("given routes are sorted")
+	}
+	for _, tc := range []struct {
+		uri, body string
+	}{
+		{"/api/v1/x", "high"},
+		{"/api/x", "high"},
+		{"/static/x", "low"},
+	} {
+		if resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("uri %q: got %d %q, want 200 %q", tc.uri, resp.StatusCode, body, tc.body)
+		}
+	}
+	if shadows := f.ShadowedRoutes(); len(shadows) != 2 || shadows[0].Index != 3 || shadows[1].Index != 4 {
+		t.Errorf("got shadowed routes %v, want routes 3 and 4 in evaluation order", shadows)
+	}
+}
+
+func TestHTTPFrontendRouteHosts(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "hosts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hosts"))
+	})
+	defer closer()
+	other, otherCloser := newTestHTTPBackend(t, "hosts-other", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	})
+	defer otherCloser()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "hosts",
+		Routes: []HTTPFrontendRoute{
+			{Host: "example.com", Hosts: []string{"*.example.com", "example.org"}, Path: "/*", Backend: b},
+			{Hosts: []string{"*.example.net"}, Path: "/*", Backend: b},
+			{Hosts: []string{"example.org", "www.example.com"}, Path: "/x", Backend: other},
+		},
+		DefaultBackend: other,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	if hosts := f.GetOpts().Routes[1].hosts; len(hosts) != 1 || hosts[0] != "*.example.net" {
+		t.Errorf("got hosts %q, want no default host with hosts", hosts)
+	}
+	if shadows := f.ShadowedRoutes(); len(shadows) != 1 || shadows[0].Index != 2 || shadows[0].Host != "example.org,www.example.com" {
+		t.Errorf("got shadowed routes %v, want route 2 shadowed by route 0", shadows)
+	}
+	for _, tc := range []struct {
+		host, pattern, body string
+	}{
+		{"example.com", "example.com", "hosts"},
+		{"WWW.example.com", "*.example.com", "hosts"},
+		{"example.org", "example.org", "hosts"},
+		{"www.example.net", "*.example.net", "hosts"},
+		{"example.net", "*", "other"},
+	} {
+		labels := prometheus.Labels{"frontend": "hosts", "host": tc.pattern}
+		base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+		if resp, body := doTestRequestOnce(t, fLis, "GET /x HTTP/1.1\r\nHost: "+tc.host+"\r\n\r\n"); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("host %q: got %d %q, want 200 %q", tc.host, resp.StatusCode, body, tc.body)
+		}
+		// requests are counted after their responses
+		n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+		for i := 0; i < 50 && n < 1; i++ {
+			time.Sleep(10 * time.Millisecond)
+			n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+		}
+		if n != 1 {
+			t.Errorf("host %q: got %v requests with host label %q, want 1", tc.host, n, tc.pattern)
+		}
+	}
+}
+
+func TestHTTPFrontendRouteHostPort(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "hostport", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("host " + r.Host))
+	})
+	defer closer()
+	ipv6, ipv6Closer := newTestHTTPBackend(t, "hostport-ipv6", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ipv6 " + r.Host))
+	})
+	defer ipv6Closer()
+	other, otherCloser := newTestHTTPBackend(t, "hostport-other", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other " + r.Host))
+	})
+	defer otherCloser()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "hostport",
+		Routes: []HTTPFrontendRoute{
+			{Host: "example.com", Path: "/*", Backend: b},
+			{Hosts: []string{"[2001:db8::1]", "::2"}, Path: "/*", Backend: ipv6},
+		},
+		DefaultBackend: other,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		hostHeader, body string
+	}{
+		{"Host: example.com\r\n", "host example.com"},
+		{"Host: EXAMPLE.com:8443\r\n", "host EXAMPLE.com:8443"},
+		{"Host: [2001:db8::1]\r\n", "ipv6 [2001:db8::1]"},
+		{"Host: [2001:db8::1]:8080\r\n", "ipv6 [2001:db8::1]:8080"},
+		{"Host: [::2]:8080\r\n", "ipv6 [::2]:8080"},
+		{"Host: example.com.evil:8443\r\n", "other example.com.evil:8443"},
+		{"", "other "},
+	} {
+		// the Host header is forwarded as it is
+		if resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.0\r\n"+tc.hostHeader+"\r\n"); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("header %q: got %d %q, want 200 %q", tc.hostHeader, resp.StatusCode, body, tc.body)
+		}
+	}
+}
+
+func TestHTTPFrontendRouteQuery(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "query", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("main"))
+	})
+	defer closer()
+	debug, debugCloser := newTestHTTPBackend(t, "query-debug", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("debug"))
+	})
+	defer debugCloser()
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "query",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/*", Query: "*debug=1*", Backend: debug},
+			{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+				{Network: network, Invert: true, AndAfter: true},
+				{Query: "*admin=*"},
+			}},
+			{Path: "/x", Query: "debug=1", Backend: debug},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// a route with query pattern shadows the routes whose query pattern is a subset of it, but not the routes without one
+	if shadows := f.ShadowedRoutes(); len(shadows) != 1 || shadows[0].Index != 2 || shadows[0].ShadowedBy != 0 {
+		t.Errorf("got shadowed routes %v, want route 2 shadowed by route 0", shadows)
+	}
+	for _, tc := range []struct {
+		uri  string
+		code int
+		body string
+	}{
+		{"/a?debug=1", http.StatusOK, "debug"},
+		{"/a?x=1&DEBUG=1", http.StatusOK, "debug"},
+		{"/a?debug=0", http.StatusOK, "main"},
+		{"/a", http.StatusOK, "main"},
+		{"/debug=1", http.StatusOK, "main"},
+		{"/a?admin=1", http.StatusForbidden, ""},
+		{"/admin", http.StatusOK, "main"},
+	} {
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code || (tc.body != "" && body != tc.body) {
+			t.Errorf("uri %q: got %d %q, want %d %q", tc.uri, resp.StatusCode, body, tc.code, tc.body)
+		}
+	}
+}
+
+func TestHTTPFrontendSetRoutes(t *testing.T) {
+	ba, baCloser := newTestHTTPBackend(t, "setroutes-a", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("a")) })
+	defer baCloser()
+	bb, bbCloser := newTestHTTPBackend(t, "setroutes-b", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("b")) })
+	defer bbCloser()
+
+	routesA := []HTTPFrontendRoute{{Path: "/x", Backend: ba}}
+	routesB := []HTTPFrontendRoute{{Path: "/x", Backend: bb}, {Path: "/y", Backend: ba}}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "setroutes",
+		Routes: routesA,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	if _, body := doTestRequestOnce(t, fLis, "GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"); body != "a" {
+		t.Fatalf("got body %q, want %q", body, "a")
+	}
+	if err := f.SetRoutes(routesB); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := doTestRequestOnce(t, fLis, "GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"); body != "b" {
+		t.Fatalf("got body %q after SetRoutes, want %q", body, "b")
+	}
+	if err := f.SetRoutes([]HTTPFrontendRoute{{Path: "/x", Backend: ba, BucketProfile: "unknown"}}); err == nil {
+		t.Fatal("expected error for unknown bucket profile")
+	}
+	if opts := f.GetOpts(); len(opts.Routes) != 2 || opts.Routes[0].Backend != bb || opts.Name != "setroutes" {
+		t.Fatalf("routes changed by failed SetRoutes: %+v", opts.Routes)
+	}
+
+	// run with -race to check snapshots
+	var wg sync.WaitGroup
+	stopCh := make(chan struct{})
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			routes := routesA
+			if i%2 == 0 {
+				routes = routesB
+			}
+			if err := f.SetRoutes(routes); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		close(stopCh)
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			opts := f.GetOpts()
+			if n := len(opts.Routes); n != 1 && n != 2 {
+				t.Errorf("got %d routes", n)
+				return
+			}
+			fn, err := f.Fork(opts)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fn.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			if _, body := doTestRequestOnce(t, fLis, "GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"); body != "a" && body != "b" {
+				t.Errorf("got body %q", body)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestHTTPFrontendRequestBodyFraming(t *testing.T) {
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\nConnection: keep-alive\r\n\r\n" + string(body)))
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "framing",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:               "framing",
+		RequestBodyTimeout: 100 * time.Millisecond,
+		DefaultBackend:     b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		name  string
+		req   string
+		close bool
+		codes []int
+		group string
+	}{
+		{"truncated", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\nabcde", true, nil, httpErrGroupRequestBodyTruncated},
+		{"stalled", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\nabcde", false, []int{408}, httpErrGroupRequestBodyTimeout},
+		// the complete response isn't followed by a bad request response
+		{"excess", "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\nabcXYZ", false, []int{200}, httpErrGroupRequestBodyExcess},
+	} {
+		labels := prometheus.Labels{"frontend": "framing", "error": tc.group}
+		base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(tc.req))
+		if tc.close {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+		rd := bufio.NewReader(conn)
+		var codes []int
+		for {
+			resp, err := http.ReadResponse(rd, nil)
+			if err != nil {
+				break
+			}
+			ioutil.ReadAll(resp.Body)
+			codes = append(codes, resp.StatusCode)
+		}
+		conn.Close()
+		if !reflect.DeepEqual(codes, tc.codes) {
+			t.Errorf("%s: got responses %v, want %v", tc.name, codes, tc.codes)
+		}
+
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if testCounterSum(promHTTPFrontendRequestsTotal, labels)-base >= 1 {
+				break
+			}
+		}
+		if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 1 {
+			t.Errorf("%s: got %v requests with error %q, want 1", tc.name, n, tc.group)
+		}
+	}
+}
+
+func TestHTTPFrontendChunkedRequestBody(t *testing.T) {
+	var bodiesMu sync.Mutex
+	var bodies []string
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return
+			}
+			if len(req.TransferEncoding) == 0 || req.TransferEncoding[0] != "chunked" {
+				body = []byte("not chunked")
+			}
+			bodiesMu.Lock()
+			bodies = append(bodies, string(body))
+			bodiesMu.Unlock()
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: keep-alive\r\n\r\nOK"))
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "chunked",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "chunked",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// both requests are relayed with their chunked bodies on the same connection
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	rd := bufio.NewReader(conn)
+	for _, req := range []string{
+		"POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\na\r\n0123456789\r\n0\r\n\r\n",
+	} {
+		if resp := doTestRequest(t, conn, rd, req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+		} else {
+			ioutil.ReadAll(resp.Body)
+		}
+	}
+	bodiesMu.Lock()
+	defer bodiesMu.Unlock()
+	if want := []string{"hello world", "0123456789"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("got backend bodies %q, want %q", bodies, want)
+	}
+}
+
+// testWriteCountConn counts write calls, the underlying connection is still reachable for socket options
+type testWriteCountConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c *testWriteCountConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func (c *testWriteCountConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// testWriteProfileRequests serves the frontend with given write profile, and returns the average count of write calls to the client per request
+func testWriteProfileRequests(tb testing.TB, profile HTTPFrontendWriteProfile, path string, n int) float64 {
+	server, bLis := runTestBackendServer(tb, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			switch req.URL.Path {
+			case "/stream":
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nConnection: keep-alive\r\n\r\n"))
+				for i := 0; i < 4; i++ {
+					time.Sleep(5 * time.Millisecond)
+					conn.Write([]byte("6\r\nevent\n\r\n"))
+				}
+				conn.Write([]byte("0\r\n\r\n"))
+			default:
+				body := strings.Repeat("x", 8*1024)
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\nConnection: keep-alive\r\n\r\n" + body))
+			}
+		}
+	})
+	defer bLis.Close()
+	b, err := NewHTTPBackend(HTTPBackendOptions{Name: "writeprofile", Servers: []string{server}})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{Name: "writeprofile", MaxKeepAliveReqs: -1, WriteProfile: profile, DefaultBackend: b})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer lis.Close()
+	var writes int64
+	go func() {
+		l := &Listener{}
+		l.opts.Name = "test"
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				f.Serve(context.Background(), l, &testWriteCountConn{Conn: conn, writes: &writes})
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	if bb, ok := tb.(*testing.B); ok {
+		bb.ResetTimer()
+	}
+	base := atomic.LoadInt64(&writes)
+	for i := 0; i < n; i++ {
+		conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		resp, err := http.ReadResponse(rd, nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+	}
+	return float64(atomic.LoadInt64(&writes)-base) / float64(n)
+}
+
+func TestHTTPFrontendWriteProfile(t *testing.T) {
+	for _, tc := range []struct {
+		path    string
+		profile HTTPFrontendWriteProfile
+		min     float64
+		max     float64
+	}{
+		{"/", HTTPFrontendWriteProfileDefault, 2, 3},
+		{"/", HTTPFrontendWriteProfileThroughput, 1, 3},
+		{"/stream", HTTPFrontendWriteProfileDefault, 1, 2},
+		{"/stream", HTTPFrontendWriteProfileLowLatency, 5, 6},
+		{"/stream", HTTPFrontendWriteProfileThroughput, 1, 1},
+	} {
+		if writes := testWriteProfileRequests(t, tc.profile, tc.path, 10); writes < tc.min || writes > tc.max {
+			t.Errorf("path %q profile %d: got %v writes per request, want between %v and %v", tc.path, tc.profile, writes, tc.min, tc.max)
+		}
+	}
+}
+
+func TestHTTPFrontendWriteProfileExpectContinue(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "expect", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "expect",
+		WriteProfile:   HTTPFrontendWriteProfileThroughput,
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// the header is sent to the backend server before the body, so it answers 100 Continue
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	rd := bufio.NewReader(conn)
+	resp := doTestRequest(t, conn, rd, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("got %d, want %d before the body", resp.StatusCode, http.StatusContinue)
+	}
+	conn.Write([]byte("body"))
+	resp, err = http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "body" {
+		t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "body")
+	}
+}
+
+func BenchmarkHTTPFrontendWriteProfile(b *testing.B) {
+	for _, profile := range []struct {
+		name    string
+		profile HTTPFrontendWriteProfile
+	}{
+		{"default", HTTPFrontendWriteProfileDefault},
+		{"low-latency", HTTPFrontendWriteProfileLowLatency},
+		{"throughput", HTTPFrontendWriteProfileThroughput},
+	} {
+		b.Run(profile.name, func(b *testing.B) {
+			b.ReportMetric(testWriteProfileRequests(b, profile.profile, "/", b.N), "writes/op")
+		})
+	}
+}
+
+func TestHTTPFrontendAllowedMethods(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "methods", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	})
+	defer closer()
+
+	for _, tc := range []struct {
+		allowedMethods []string
+		method         string
+		code           int
+		body           string
+		allow          string
+	}{
+		{nil, "GET", 200, "GET", ""},
+		{nil, "get", 200, "GET", ""},
+		{nil, "Patch", 200, "PATCH", ""},
+		{nil, "FOO", 405, "Method Not Allowed\r\n", "GET, HEAD, POST, PUT, DELETE, CONNECT, OPTIONS, TRACE, PATCH"},
+		{nil, "PURGE", 405, "Method Not Allowed\r\n", "GET, HEAD, POST, PUT, DELETE, CONNECT, OPTIONS, TRACE, PATCH"},
+		{[]string{"get", "PURGE"}, "purge", 200, "PURGE", ""},
+		{[]string{"get", "PURGE"}, "POST", 405, "Method Not Allowed\r\n", "GET, PURGE"},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:           "methods",
+			DefaultBackend: b,
+			AllowedMethods: tc.allowedMethods,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+		labels := prometheus.Labels{"frontend": "methods", "method": httpOtherMethod}
+		base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+		resp, body := doTestRequestOnce(t, fLis, tc.method+" / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code || body != tc.body || resp.Header.Get("Allow") != tc.allow {
+			t.Errorf("allowed %q method %q: got %d %q Allow %q, want %d %q Allow %q", tc.allowedMethods, tc.method,
+				resp.StatusCode, body, resp.Header.Get("Allow"), tc.code, tc.body, tc.allow)
+		}
+		fLis.Close()
+		f.Close()
+		if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; (tc.code == 405) != (n == 1) {
+			t.Errorf("allowed %q method %q: got %v requests with method label %q", tc.allowedMethods, tc.method, n, httpOtherMethod)
+		}
+	}
+
+	if _, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "methods",
+		AllowedMethods: []string{"GET", "BAD METHOD"},
+	}); err == nil {
+		t.Error("expected error for invalid allowed method")
+	}
+}
+
+func TestHTTPFrontendRouteMethods(t *testing.T) {
+	upload, uploadCloser := newTestHTTPBackend(t, "upload", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upload " + r.Method))
+	})
+	defer uploadCloser()
+	read, readCloser := newTestHTTPBackend(t, "read", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("read " + r.Method))
+	})
+	defer readCloser()
+
+	methods := []string{"post", "Put"}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "routemethods",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/api/upload", Methods: methods, Backend: upload},
+			{Path: "/api/upload", Backend: read},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// changes of the given and the returned methods don't affect the frontend
+	methods[0] = "GET"
+	if got := f.GetOpts().Routes[0].Methods; got[0] != "post" {
+		t.Errorf("got route methods %q, want the copy of the given ones", got)
+	}
+	f.GetOpts().Routes[0].Methods[1] = "GET"
+	for _, tc := range []struct {
+		method, body string
+	}{
+		{"POST", "upload POST"},
+		{"put", "upload PUT"},
+		{"GET", "read GET"},
+		{"DELETE", "read DELETE"},
+	} {
+		if resp, body := doTestRequestOnce(t, fLis, tc.method+" /api/upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n"); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("method %q: got %d %q, want 200 %q", tc.method, resp.StatusCode, body, tc.body)
+		}
+	}
+
+	// a route matching all methods isn't shadowed by a route matching some of them
+	if shadows := f.ShadowedRoutes(); len(shadows) != 0 {
+		t.Errorf("got shadowed routes %v, want none", shadows)
+	}
+	f2, err := f.Fork(HTTPFrontendOptions{
+		Name: "routemethods",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/api/*", Methods: []string{"GET", "POST"}, Backend: read},
+			{Path: "/api/upload", Methods: []string{"post"}, Backend: upload},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if shadows := f2.ShadowedRoutes(); len(shadows) != 1 || shadows[0].Index != 1 {
+		t.Errorf("got shadowed routes %v, want route 1", shadows)
+	}
+
+	if _, err := f.Fork(HTTPFrontendOptions{
+		Name:   "routemethods",
+		Routes: []HTTPFrontendRoute{{Path: "/", Methods: []string{"BAD METHOD"}, Backend: read}},
+	}); err == nil {
+		t.Error("expected error for invalid route method")
+	}
+}
+
+func TestHTTPFrontendRouteHeaders(t *testing.T) {
+	canary, canaryCloser := newTestHTTPBackend(t, "canary", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("canary"))
+	})
+	defer canaryCloser()
+	stable, stableCloser := newTestHTTPBackend(t, "stable", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stable"))
+	})
+	defer stableCloser()
+
+	headers := map[string]string{"x-api-version": "2", "X-Client": "beta-*"}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "routeheaders",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/api/*", Headers: headers, Backend: canary},
+			{Path: "/api/*", Headers: map[string]string{"X-Any": "*"}, Backend: canary},
+		},
+		DefaultBackend: stable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+	// changes of the given headers don't affect the frontend
+	headers["X-Client"] = "*"
+
+	for _, tc := range []struct {
+		hdr, body string
+	}{
+		{"X-Api-Version: 2\r\nX-Client: beta-ios\r\n", "canary"},
+		{"x-api-version: 2\r\nX-CLIENT: BETA-android\r\n", "canary"},
+		{"X-Client: stable\r\nX-Client: beta-ios\r\nX-Api-Version: 2\r\n", "canary"},
+		{"X-Api-Version: 1\r\nX-Client: beta-ios\r\n", "stable"},
+		{"X-Api-Version: 2\r\nX-Client: stable\r\n", "stable"},
+		{"X-Api-Version: 2\r\n", "stable"},
+		{"X-Client: beta-ios\r\n", "stable"},
+		{"X-Any: \r\n", "canary"},
+		{"", "stable"},
+	} {
+		if resp, body := doTestRequestOnce(t, fLis, "GET /api/x HTTP/1.1\r\nHost: example.com\r\n"+tc.hdr+"\r\n"); resp.StatusCode != 200 || body != tc.body {
+			t.Errorf("header %q: got %d %q, want 200 %q", tc.hdr, resp.StatusCode, body, tc.body)
+		}
+	}
+
+	// a route is shadowed by an earlier one if its header patterns are subsets of all of the earlier one's
+	f2, err := f.Fork(HTTPFrontendOptions{
+		Name: "routeheaders",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/api/*", Headers: map[string]string{"X-Client": "beta-*"}, Backend: canary},
+			{Path: "/api/*", Headers: map[string]string{"x-client": "beta-ios", "X-Api-Version": "2"}, Backend: canary},
+			{Path: "/api/*", Headers: map[string]string{"X-Api-Version": "2"}, Backend: canary},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if shadows := f2.ShadowedRoutes(); len(shadows) != 1 || shadows[0].Index != 1 {
+		t.Errorf("got shadowed routes %v, want route 1", shadows)
+	}
+
+	if _, err := f.Fork(HTTPFrontendOptions{
+		Name:   "routeheaders",
+		Routes: []HTTPFrontendRoute{{Path: "/", Headers: map[string]string{"Bad Header": "*"}, Backend: stable}},
+	}); err == nil {
+		t.Error("expected error for invalid route header name")
+	}
+}
+
+func TestIsHTTPRestricted(t *testing.T) {
+	_, matchedNetwork, _ := net.ParseCIDR("10.0.0.0/8")
+	_, unmatchedNetwork, _ := net.ParseCIDR("192.168.0.0/16")
+	matchedPath, unmatchedPath := regexp.MustCompile("^/a$"), regexp.MustCompile("^/b$")
+
+	// every restriction has a network and/or path condition which matches or not, with every flag combination
+	type condition struct {
+		network, path     bool
+		networkOK, pathOK bool
+		invert, andAfter  bool
+	}
+	conditions := make([]condition, 0, 32)
+	for kind := 0; kind < 3; kind++ {
+		for state := 0; state < 4; state++ {
+			for flags := 0; flags < 4; flags++ {
+				c := condition{
+					network:   kind != 1,
+					path:      kind != 0,
+					networkOK: state&1 != 0,
+					pathOK:    state&2 != 0,
+					invert:    flags&1 != 0,
+					andAfter:  flags&2 != 0,
+				}
+				if (!c.network && c.networkOK) || (!c.path && c.pathOK) {
+					continue
+				}
+				conditions = append(conditions, c)
+			}
+		}
+	}
+
+	// expected splits restrictions into AND chains, and ORs them
+	expected := func(cs []condition, ip net.IP) bool {
+		chains := [][]bool{{}}
+		for i, c := range cs {
+			ok := false
+			if c.network {
+				ok = ok || ((ip != nil && c.networkOK) != c.invert)
+			}
+			if c.path {
+				ok = ok || (c.pathOK != c.invert)
+			}
+			chains[len(chains)-1] = append(chains[len(chains)-1], ok)
+			if !c.andAfter && i < len(cs)-1 {
+				chains = append(chains, []bool{})
+			}
+		}
+		for _, chain := range chains {
+			all := true
+			for _, ok := range chain {
+				all = all && ok
+			}
+			if all {
+				return true
+			}
+		}
+		return false
+	}
+
+	var check func(cs []condition, n int)
+	check = func(cs []condition, n int) {
+		if len(cs) == n {
+			restrictions := make([]HTTPFrontendRestriction, len(cs))
+			for i, c := range cs {
+				r := &restrictions[i]
+				if c.network {
+					r.Network = unmatchedNetwork
+					if c.networkOK {
+						r.Network = matchedNetwork
+					}
+				}
+				if c.path {
+					r.pathRgx = unmatchedPath
+					if c.pathOK {
+						r.pathRgx = matchedPath
+					}
+				}
+				r.Invert, r.AndAfter = c.invert, c.andAfter
+			}
+			// nil IP is the peer of non-TCP connection
+			for _, ip := range []net.IP{net.ParseIP("10.0.0.1"), nil} {
+				if got, want := isHTTPRestricted(restrictions, ip, "/a", "", "GET", nil, nil), expected(cs, ip); got != want {
+					t.Fatalf("restrictions %+v ip %v: got restricted %v, want %v", cs, ip, got, want)
+				}
+			}
+			return
+		}
+		for _, c := range conditions {
+			check(append(cs, c), n)
+		}
+	}
+	for n := 1; n <= 3; n++ {
+		check(make([]condition, 0, n), n)
+	}
+
+	// restriction without any condition never applies
+	if isHTTPRestricted([]HTTPFrontendRestriction{{Invert: true}}, nil, "/a", "", "GET", nil, nil) {
+		t.Error("restriction without condition applied")
+	}
+}
+
+func TestHTTPFrontendRestrictionMethods(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "restrictmethods", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "restrictmethods",
+		Routes: []HTTPFrontendRoute{
+			// writes are restricted out of the network, the test client is in the local one
+			{Path: "/local/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+				{Network: local, Invert: true, AndAfter: true},
+				{Methods: []string{"PUT", "delete"}},
+			}},
+			{Path: "/internal/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+				{Network: internal, Invert: true, AndAfter: true},
+				{Methods: []string{"PUT", "delete"}},
+			}},
+			// only reads are allowed from anywhere
+			{Path: "/readonly/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+				{Methods: []string{"GET", "HEAD"}, Invert: true},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/local/x", http.StatusOK},
+		{"PUT", "/local/x", http.StatusOK},
+		{"DELETE", "/local/x", http.StatusOK},
+		{"GET", "/internal/x", http.StatusOK},
+		{"POST", "/internal/x", http.StatusOK},
+		{"PUT", "/internal/x", http.StatusForbidden},
+		{"delete", "/internal/x", http.StatusForbidden},
+		{"GET", "/readonly/x", http.StatusOK},
+		{"POST", "/readonly/x", http.StatusForbidden},
+	} {
+		resp, _ := doTestRequestOnce(t, fLis, tc.method+" "+tc.path+" HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n")
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.path, resp.StatusCode, tc.code)
+		}
+	}
+}
+
+func TestHTTPFrontendRestrictionNormalizedPath(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "restrictpath", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "restrictpath",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+				{Path: "/admin/*"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		uri  string
+		code int
+	}{
+		{"/admin/x", http.StatusForbidden},
+		{"/public/../admin/x", http.StatusForbidden},
+		{"//admin/x", http.StatusForbidden},
+		{"/./admin//x", http.StatusForbidden},
+		{"/%61dmin/x", http.StatusForbidden},
+		{"/ADMIN%2fx", http.StatusOK},
+		{"/public/%2E%2e/admin/x", http.StatusForbidden},
+		{"/public/.%2E/ADMIN/x?a=b", http.StatusForbidden},
+		{"/public/%252e%252e/admin/x", http.StatusOK},
+		{"/public/%c0%ae%c0%ae/admin/x", http.StatusOK},
+		{"/admin%2Fx", http.StatusOK},
+		{"/public/x", http.StatusOK},
+	} {
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.uri, resp.StatusCode, tc.code)
+			continue
+		}
+		// the backend receives the uri as sent by the client
+		if tc.code == http.StatusOK && body != tc.uri {
+			t.Errorf("%s: backend got uri %q", tc.uri, body)
+		}
+	}
+}
+
+func TestHTTPFrontendContinueOnRestricted(t *testing.T) {
+	newBackend := func(name string) (*HTTPBackend, func()) {
+		return newTestHTTPBackend(t, name, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	internal, closer := newBackend("internal")
+	defer closer()
+	public, closer := newBackend("public")
+	defer closer()
+	fallback, closer := newBackend("fallback")
+	defer closer()
+
+	// the test client is in the local network
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	routes := []HTTPFrontendRoute{
+		{Path: "/local/*", Backend: internal, ContinueOnRestricted: true, Restrictions: []HTTPFrontendRestriction{
+			{Network: local, Invert: true},
+		}},
+		{Path: "/local/*", Backend: public},
+		{Path: "/other/*", Backend: internal, ContinueOnRestricted: true, DeniedStatusCode: 404, Restrictions: []HTTPFrontendRestriction{
+			{Network: other, Invert: true},
+		}},
+		{Path: "/other/public/*", Backend: public},
+		{Path: "/strict/*", Backend: internal, Restrictions: []HTTPFrontendRestriction{
+			{Network: other, Invert: true},
+		}},
+		{Path: "/strict/*", Backend: public},
+	}
+	for _, tc := range []struct {
+		action HTTPFrontendUnmatchedAction
+		path   string
+		code   int
+		body   string
+	}{
+		{HTTPFrontendUnmatchedActionDefaultBackend, "/local/x", http.StatusOK, "internal"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "/other/public/x", http.StatusOK, "public"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "/other/x", http.StatusOK, "fallback"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "/strict/x", http.StatusForbidden, ""},
+		{HTTPFrontendUnmatchedActionNotFound, "/other/public/x", http.StatusOK, "public"},
+		{HTTPFrontendUnmatchedActionNotFound, "/other/x", http.StatusNotFound, ""},
+		{HTTPFrontendUnmatchedActionMisdirected, "/other/x", http.StatusNotFound, ""},
+		{HTTPFrontendUnmatchedActionMisdirected, "/x", http.StatusMisdirectedRequest, ""},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:                   "continueonrestricted",
+			DefaultBackend:         fallback,
+			UnmatchedRequestAction: tc.action,
+			Routes:                 routes,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code || (tc.code == http.StatusOK && body != tc.body) {
+			t.Errorf("action %d %s: got %d %q, want %d %q", tc.action, tc.path, resp.StatusCode, body, tc.code, tc.body)
+		}
+		fLis.Close()
+		f.Close()
+	}
+}
+
+func TestHTTPFrontendDefaultBackends(t *testing.T) {
+	newBackend := func(name string) (*HTTPBackend, func()) {
+		return newTestHTTPBackend(t, name, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	route, closer := newBackend("route")
+	defer closer()
+	api, closer := newBackend("api")
+	defer closer()
+	web, closer := newBackend("web")
+	defer closer()
+	global, closer := newBackend("global")
+	defer closer()
+
+	for _, tc := range []struct {
+		action      HTTPFrontendUnmatchedAction
+		host, path  string
+		code        int
+		body        string
+		hostPattern string
+	}{
+		{HTTPFrontendUnmatchedActionDefaultBackend, "api.example.com", "/v1/x", http.StatusOK, "route", "api.example.com"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "API.example.com:8080", "/x", http.StatusOK, "api", "api.example.com"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "v2.api.example.com", "/x", http.StatusOK, "api", "*.api.example.com"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "www.example.com", "/x", http.StatusOK, "web", "*.example.com"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "[::1]:8080", "/x", http.StatusOK, "web", "[::1]"},
+		{HTTPFrontendUnmatchedActionDefaultBackend, "example.org", "/x", http.StatusOK, "global", "*"},
+		{HTTPFrontendUnmatchedActionNotFound, "www.example.com", "/x", http.StatusOK, "web", "*.example.com"},
+		{HTTPFrontendUnmatchedActionNotFound, "example.org", "/x", http.StatusNotFound, "", httpFrontendUnmatchedHost},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:           "defaultbackends",
+			DefaultBackend: global,
+			DefaultBackends: map[string]*HTTPBackend{
+				"api.example.com":   api,
+				"*.api.example.com": api,
+				"*.example.com":     web,
+				"[::1]":             web,
+			},
+			UnmatchedRequestAction: tc.action,
+			Routes: []HTTPFrontendRoute{
+				{Host: "api.example.com", Path: "/v1/*", Backend: route},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+		labels := prometheus.Labels{"frontend": "defaultbackends", "host": tc.hostPattern}
+		base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.path+" HTTP/1.1\r\nHost: "+tc.host+"\r\n\r\n")
+		if resp.StatusCode != tc.code || (tc.code == http.StatusOK && body != tc.body) {
+			t.Errorf("action %d %s%s: got %d %q, want %d %q", tc.action, tc.host, tc.path, resp.StatusCode, body, tc.code, tc.body)
+		}
+		var n float64
+		for i := 0; i < 50 && n != 1; i++ {
+			if n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 1 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if n != 1 {
+			t.Errorf("action %d %s%s: got %v requests with host label %q, want 1", tc.action, tc.host, tc.path, n, tc.hostPattern)
+		}
+		fLis.Close()
+		f.Close()
+	}
+}
+
+func TestHTTPFrontendRestrictionHeaders(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "restrictheaders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	routes := []HTTPFrontendRoute{
+		{Path: "/bots/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+			{HeaderName: "user-agent", HeaderValue: "*bot*"},
+		}},
+		// a missing header doesn't match, so it is restricted by the inverted condition
+		{Path: "/secret/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+			{HeaderName: "X-Shared-Secret", HeaderValue: "s3cret", Invert: true},
+		}},
+	}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "restrictheaders",
+		Routes: routes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		path, header string
+		code         int
+	}{
+		{"/bots/x", "", http.StatusOK},
+		{"/bots/x", "User-Agent: curl/7.68.0\r\n", http.StatusOK},
+		{"/bots/x", "User-Agent: Googlebot/2.1\r\n", http.StatusForbidden},
+		{"/secret/x", "", http.StatusForbidden},
+		{"/secret/x", "X-Shared-Secret: wrong\r\n", http.StatusForbidden},
+		{"/secret/x", "X-Shared-Secret: s3cret\r\n", http.StatusOK},
+	} {
+		resp, _ := doTestRequestOnce(t, fLis, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n"+tc.header+"\r\n")
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s with %q: got %d, want %d", tc.path, tc.header, resp.StatusCode, tc.code)
+		}
+	}
+
+	for _, restriction := range []HTTPFrontendRestriction{
+		{HeaderValue: "*bot*"},
+		{HeaderName: "User Agent", HeaderValue: "*bot*"},
+	} {
+		badRoutes := []HTTPFrontendRoute{{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{restriction}}}
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "restrictheaders", Routes: badRoutes}); err == nil {
+			t.Errorf("restriction %+v: expected error", restriction)
+		}
+	}
+}
+
+func TestHTTPFrontendDeniedResponse(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "denied", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	restrictAll := []HTTPFrontendRestriction{{Path: "*"}}
+	routes := []HTTPFrontendRoute{
+		{Path: "/forbidden/*", Backend: b, Restrictions: restrictAll},
+		{Path: "/hidden/*", Backend: b, Restrictions: restrictAll, DeniedStatusCode: http.StatusNotFound},
+		{Path: "/limited/*", Backend: b, Restrictions: restrictAll, DeniedStatusCode: http.StatusTooManyRequests,
+			DeniedBody: "slow down\n", DeniedRetryAfter: 1500 * time.Millisecond},
+	}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "denied",
+		Routes: routes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		path, pattern string
+		code          int
+		body          string
+		retryAfter    string
+	}{
+		{"/forbidden/x", "/forbidden/*", http.StatusForbidden, "Forbidden\r\n", ""},
+		{"/hidden/x", "/hidden/*", http.StatusNotFound, "Not Found\r\n", ""},
+		{"/limited/x", "/limited/*", http.StatusTooManyRequests, "slow down\n", "2"},
+	} {
+		labels := prometheus.Labels{"frontend": "denied", "path": tc.pattern, "code": strconv.Itoa(tc.code/100) + "xx", "error": httpErrGroupRestricted}
+		base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+		resp, body := doTestRequestOnce(t, fLis, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code || body != tc.body || resp.Header.Get("Retry-After") != tc.retryAfter {
+			t.Errorf("%s: got %d body %q retry after %q, want %d body %q retry after %q", tc.path,
+				resp.StatusCode, body, resp.Header.Get("Retry-After"), tc.code, tc.body, tc.retryAfter)
+		}
+		n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+		for i := 0; i < 50 && n < 1; i++ {
+			time.Sleep(10 * time.Millisecond)
+			n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+		}
+		if n != 1 {
+			t.Errorf("%s: got %v restricted requests with code label %q, want 1", tc.path, n, labels["code"])
+		}
+	}
+
+	badRoutes := []HTTPFrontendRoute{{Path: "/*", Backend: b, Restrictions: restrictAll, DeniedStatusCode: http.StatusFound}}
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "denied", Routes: badRoutes}); err == nil {
+		t.Error("expected error for denied status code out of range")
+	}
+}
+
+func TestHTTPFrontendTrustedProxies(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "trustedproxies", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	})
+	defer closer()
+
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	opts := HTTPFrontendOptions{
+		Name: "trustedproxies",
+		Routes: []HTTPFrontendRoute{
+			// only internal clients are allowed, the test client is a proxy in the local network
+			{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{{Network: internal, Invert: true}}},
+		},
+	}
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	// X-Forwarded-For of untrusted clients is ignored
+	if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 10.0.0.1\r\n\r\n"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d from untrusted proxy, want 403", resp.StatusCode)
+	}
+
+	opts.TrustedProxies = []*net.IPNet{local}
+	fn, err := f.Fork(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fn.Close()
+	fnLis := runTestFrontend(t, fn)
+	defer fnLis.Close()
+	for _, tc := range []struct {
+		xff  string
+		code int
+	}{
+		{"10.0.0.1", http.StatusOK},
+		{"10.0.0.1, 203.0.113.1", http.StatusForbidden},
+		{"203.0.113.1, 10.0.0.1", http.StatusOK},
+		{"garbage", http.StatusForbidden},
+	} {
+		resp, body := doTestRequestOnce(t, fnLis, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: "+tc.xff+"\r\n\r\n")
+		if resp.StatusCode != tc.code {
+			t.Errorf("xff %q: got %d, want %d", tc.xff, resp.StatusCode, tc.code)
+		}
+		// the proxy is still appended to X-Forwarded-For
+		if tc.code == http.StatusOK && body != tc.xff+", 127.0.0.1" {
+			t.Errorf("xff %q: got forwarded %q", tc.xff, body)
+		}
+	}
+}
+
+func TestHTTPFrontendMaxHeaderBytes(t *testing.T) {
+	const maxHeaderBytes = 256
+	// padHeader pads the header block of prefix by X-Pad field to size bytes including the empty line
+	padHeader := func(prefix string, size int) string {
+		return prefix + "X-Pad: " + strings.Repeat("a", size-len(prefix)-len("X-Pad: \r\n\r\n")) + "\r\n\r\n"
+	}
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/"))
+			conn.Write([]byte(padHeader("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n", size) + "ok"))
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "maxheaderbytes",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "maxheaderbytes",
+		MaxHeaderBytes: maxHeaderBytes,
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	for _, tc := range []struct {
+		name      string
+		reqSize   int
+		respSize  int
+		code      int
+		errGroup  string
+		closeConn bool
+	}{
+		{"request at limit", maxHeaderBytes, 128, http.StatusOK, "", false},
+		{"request over limit", maxHeaderBytes + 1, 128, http.StatusRequestHeaderFieldsTooLarge, httpErrGroupRequestHeaderTooLarge, true},
+		{"response at limit", 128, maxHeaderBytes, http.StatusOK, "", false},
+		{"response over limit", 128, maxHeaderBytes + 1, http.StatusBadGateway, httpErrGroupResponseHeaderTooLarge, true},
+	} {
+		labels := prometheus.Labels{"frontend": "maxheaderbytes", "error": tc.errGroup}
+		base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(conn)
+		req := padHeader("GET /"+strconv.Itoa(tc.respSize)+" HTTP/1.1\r\nHost: example.com\r\n", tc.reqSize)
+		if len(req) != tc.reqSize {
+			t.Fatalf("%s: request header is %d bytes, want %d", tc.name, len(req), tc.reqSize)
+		}
+		resp := doTestRequest(t, conn, rd, req)
+		ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.code)
+		}
+		if tc.closeConn {
+			if data, _ := ioutil.ReadAll(rd); len(data) != 0 {
+				t.Errorf("%s: got %q, want closed connection", tc.name, data)
+			}
+		}
+		conn.Close()
+		time.Sleep(50 * time.Millisecond)
+		if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 1 {
+			t.Errorf("%s: got %v requests with error %q, want 1", tc.name, n, tc.errGroup)
+		}
+	}
+
+	// zero means the default limit
+	fd, err := f.Fork(HTTPFrontendOptions{Name: "maxheaderbytes", DefaultBackend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	fdLis := runTestFrontend(t, fd)
+	defer fdLis.Close()
+	resp, _ := doTestRequestOnce(t, fdLis, padHeader("GET /128 HTTP/1.1\r\nHost: example.com\r\n", httpDefaultMaxHeaderBytes+1))
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("got %d over default limit, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+}
+
+func TestHTTPFrontendMaxBodyBytes(t *testing.T) {
+	var hits int32
+	b, closer := newTestHTTPBackend(t, "maxbodybytes", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:         "maxbodybytes",
+		MaxBodyBytes: 8,
+		Routes: []HTTPFrontendRoute{
+			{Path: "/upload/*", Backend: b, MaxBodyBytes: -1},
+			{Path: "/small/*", Backend: b, MaxBodyBytes: 4},
+		},
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"frontend": "maxbodybytes", "error": httpErrGroupRequestBodyTooLarge}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	for _, tc := range []struct {
+		name     string
+		path     string
+		headers  string
+		body     string
+		code     int
+		rejected bool
+	}{
+		{"content-length at limit", "/", "Content-Length: 8\r\n", "12345678", http.StatusOK, false},
+		{"content-length over limit", "/", "Content-Length: 9\r\n", "123456789", http.StatusRequestEntityTooLarge, true},
+		{"chunked at limit", "/", "Transfer-Encoding: chunked\r\n", "5\r\n12345\r\n3\r\n678\r\n0\r\n\r\n", http.StatusOK, false},
+		{"chunked over limit", "/", "Transfer-Encoding: chunked\r\n", "5\r\n12345\r\n4\r\n6789\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge, false},
+		{"exempt route", "/upload/x", "Content-Length: 12\r\n", "123456789012", http.StatusOK, false},
+		{"route override", "/small/x", "Content-Length: 5\r\n", "12345", http.StatusRequestEntityTooLarge, true},
+	} {
+		before := atomic.LoadInt32(&hits)
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(conn)
+		resp := doTestRequest(t, conn, rd, "POST "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n"+tc.headers+"\r\n"+tc.body)
+		ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.code)
+		}
+		if tc.code != http.StatusOK {
+			if data, _ := ioutil.ReadAll(rd); len(data) != 0 {
+				t.Errorf("%s: got %q, want closed connection", tc.name, data)
+			}
+		}
+		conn.Close()
+		// declared larger bodies don't reach the backend
+		if tc.rejected && atomic.LoadInt32(&hits) != before {
+			t.Errorf("%s: got request on backend", tc.name)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 3 {
+		t.Errorf("got %v request body too large errors, want 3", n)
+	}
+}
+
+func TestHTTPFrontendReadHeaderTimeout(t *testing.T) {
+	// the backend keeps the connection alive, so the client connection is kept alive too
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			if _, err := http.ReadRequest(rd); err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nOK"))
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "readheadertimeout",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	opts := HTTPFrontendOptions{
+		Name:              "readheadertimeout",
+		Timeout:           5 * time.Second,
+		MaxKeepAliveReqs:  -1,
+		ReadHeaderTimeout: 200 * time.Millisecond,
+		DefaultBackend:    b,
+	}
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	dial := func(lis net.Listener) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	// trickle writes the header line by line with a delay, and reports the time until the response
+	trickle := func(conn net.Conn, rd *bufio.Reader, lines []string, delay time.Duration) (*http.Response, time.Duration) {
+		start := time.Now()
+		// writing after the response resets the connection before the client reads it
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for _, line := range lines {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := conn.Write([]byte(line)); err != nil {
+					return
+				}
+				time.Sleep(delay)
+			}
+		}()
+		resp, err := http.ReadResponse(rd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		return resp, time.Since(start)
+	}
+	lines := []string{"GET / HTTP/1.1\r\n", "Host: example.com\r\n", "Connection: keep-alive\r\n", "X-A: 1\r\n", "X-B: 2\r\n", "\r\n"}
+
+	labels := prometheus.Labels{"frontend": "readheadertimeout", "error": httpErrGroupReadHeaderTimeout, "class": "client_timeout"}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+
+	// slowloris on the first request
+	conn, rd := dial(fLis)
+	resp, d := trickle(conn, rd, lines, 150*time.Millisecond)
+	if resp.StatusCode != http.StatusRequestTimeout || d > time.Second {
+		t.Errorf("got %d after %v, want %d", resp.StatusCode, d, http.StatusRequestTimeout)
+	}
+	if data, _ := ioutil.ReadAll(rd); len(data) != 0 {
+		t.Errorf("got %q after 408, want closed connection", data)
+	}
+	conn.Close()
+
+	// slowloris on a keep-alive request
+	conn, rd = dial(fLis)
+	if resp, _ := trickle(conn, rd, lines, 0); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp, d := trickle(conn, rd, lines, 150*time.Millisecond); resp.StatusCode != http.StatusRequestTimeout || d > time.Second {
+		t.Errorf("keep-alive: got %d after %v, want %d", resp.StatusCode, d, http.StatusRequestTimeout)
+	}
+	conn.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 2 {
+		t.Errorf("got %v read header timeout errors, want 2", n)
+	}
+
+	// the header may be trickled within the overall timeout without read header timeout
+	unset := opts
+	unset.ReadHeaderTimeout = 0
+	fu, err := f.Fork(unset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fu.Close()
+	fuLis := runTestFrontend(t, fu)
+	defer fuLis.Close()
+	conn, rd = dial(fuLis)
+	defer conn.Close()
+	if resp, _ := trickle(conn, rd, lines, 150*time.Millisecond); resp.StatusCode != http.StatusOK {
+		t.Errorf("without read header timeout: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestHTTPFrontendWriteTimeout(t *testing.T) {
+	chunk := make([]byte, 64*1024)
+	b, closer := newTestHTTPBackend(t, "writetimeout", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			w.Write([]byte("OK"))
+			return
+		}
+		if r.URL.Path == "/throttled" {
+			w.Write(make([]byte, 96*1024))
+			return
+		}
+		for i := 0; i < 512; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "writetimeout",
+		Timeout:        time.Minute,
+		WriteTimeout:   200 * time.Millisecond,
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	if resp, body := doTestRequestOnce(t, fLis, "GET /small HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusOK || body != "OK" {
+		t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "OK")
+	}
+
+	labels := prometheus.Labels{"frontend": "writetimeout", "error": httpErrGroupClientWriteTimeout, "class": "client_timeout"}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4 * 1024)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	rd := bufio.NewReader(conn)
+	resp := doTestRequest(t, conn, rd, "GET /big HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// the client stops reading the body, so the response is aborted after the write timeout
+	for endTime := time.Now().Add(5 * time.Second); testCounterSum(promHTTPFrontendRequestsTotal, labels)-base < 1; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(endTime) {
+			t.Fatal("response to the stalled client wasn't aborted")
+		}
+	}
+
+	// the write timeout is applied to every throttled write, so the throttled response longer than it isn't aborted
+	fn, err := f.Fork(HTTPFrontendOptions{
+		Name:         "writetimeout",
+		Timeout:      time.Minute,
+		WriteTimeout: 200 * time.Millisecond,
+		Routes:       []HTTPFrontendRoute{{Backend: b, MaxResponseBytesPerSecond: 64 * 1024}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fn.Close()
+	fnLis := runTestFrontend(t, fn)
+	defer fnLis.Close()
+	startTime := time.Now()
+	if resp, body := doTestRequestOnce(t, fnLis, "GET /throttled HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusOK || len(body) != 96*1024 {
+		t.Errorf("got %d and body length %d, want %d and %d", resp.StatusCode, len(body), http.StatusOK, 96*1024)
+	}
+	// bucket starts full, so the rest of the body takes half a second
+	if d := time.Now().Sub(startTime); d < 400*time.Millisecond {
+		t.Errorf("throttled transfer took %v", d)
+	}
+}
+
+func TestHTTPFrontendMaxKeepAliveReqs(t *testing.T) {
+	// the backend keeps the connection alive, so the client connection is kept alive too
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		for {
+			if _, err := http.ReadRequest(rd); err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nOK"))
+		}
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "maxkeepalivereqs",
+		Servers: []string{server},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	check := func(maxKeepAliveReqs, count int, closed bool) {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:             "maxkeepalivereqs",
+			MaxKeepAliveReqs: maxKeepAliveReqs,
+			DefaultBackend:   b,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		fLis := runTestFrontend(t, f)
+		defer fLis.Close()
+
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(conn)
+		for i := 0; i < count; i++ {
+			resp := doTestRequest(t, conn, rd, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+				t.Fatalf("max %d, request %d: got %d %q, want %d %q", maxKeepAliveReqs, i, resp.StatusCode, body, http.StatusOK, "OK")
+			}
+			if want := closed && i == count-1; resp.Close != want {
+				t.Errorf("max %d, request %d: got close %v, want %v", maxKeepAliveReqs, i, resp.Close, want)
+			}
+		}
+		if closed {
+			if data, _ := ioutil.ReadAll(rd); len(data) != 0 {
+				t.Errorf("max %d: got %q after the last keep-alive request, want closed connection", maxKeepAliveReqs, data)
+			}
+		}
+	}
+	// the first request and maxKeepAliveReqs keep-alive requests are served on a connection
+	check(0, 1, true)
+	check(2, 3, true)
+	check(-1, 10, false)
+}
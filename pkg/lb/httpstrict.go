@@ -0,0 +1,157 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// strictHTTPMethods are the methods which are supported in strict parsing mode
+var strictHTTPMethods = map[string]struct{}{
+	http.MethodGet:     {},
+	http.MethodHead:    {},
+	http.MethodPost:    {},
+	http.MethodPut:     {},
+	http.MethodPatch:   {},
+	http.MethodDelete:  {},
+	http.MethodConnect: {},
+	http.MethodOptions: {},
+	http.MethodTrace:   {},
+}
+
+// checkStrictHTTPRequest validates the request header block by RFC 7230 strictly. It returns an error which describes
+// the first violation.
+func checkStrictHTTPRequest(statusLine string, hdr http.Header, lines []httpHeaderLine) (err error) {
+	if err = checkStrictHTTPHeaderBytes(statusLine); err != nil {
+		return
+	}
+	for i := range lines {
+		if err = checkStrictHTTPHeaderBytes(lines[i].Line); err != nil {
+			return
+		}
+	}
+
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 3 {
+		return errHTTPStatusLine
+	}
+	method, uri, version := parts[0], parts[1], parts[2]
+	if method == "" || strings.IndexFunc(method, isNotToken) >= 0 {
+		return errHTTPStrictMethodToken
+	}
+	if _, ok := strictHTTPMethods[method]; !ok {
+		return errHTTPStrictUnsupportedMethod
+	}
+
+	path := uri
+	if idx := strings.IndexAny(path, "?#"); idx >= 0 {
+		path = path[:idx]
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '%' {
+			continue
+		}
+		if i+2 >= len(path) {
+			return errHTTPStrictPathEncodingMalformed
+		}
+		c, e := strconv.ParseUint(path[i+1:i+3], 16, 8)
+		if e != nil {
+			return errHTTPStrictPathEncodingMalformed
+		}
+		if c < 0x20 || c == 0x7f {
+			return errHTTPStrictPathEncodingForbidden
+		}
+		i += 2
+	}
+
+	hosts := hdr["Host"]
+	if len(hosts) > 1 || (len(hosts) == 0 && version == "HTTP/1.1") {
+		return errHTTPStrictHostCount
+	}
+	for _, host := range hosts {
+		if !isStrictHTTPHost(host) {
+			return errHTTPStrictHost
+		}
+	}
+	return
+}
+
+// checkStrictHTTPHeaderBytes returns an error if the line of header block has a bare CR or another control byte except HTAB
+func checkStrictHTTPHeaderBytes(line string) error {
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\r':
+			return errHTTPStrictBareCR
+		case (c < 0x20 && c != '\t') || c == 0x7f:
+			return errHTTPStrictControlByte
+		}
+	}
+	return nil
+}
+
+// isStrictHTTPHost reports whether the value of Host header is a valid DNS name or IP literal with an optional port
+func isStrictHTTPHost(hostport string) bool {
+	host, port := hostport, ""
+	if strings.HasPrefix(host, "[") {
+		idx := strings.IndexByte(host, ']')
+		if idx < 0 {
+			return false
+		}
+		host, port = host[1:idx], host[idx+1:]
+		if !strings.Contains(host, ":") || net.ParseIP(host) == nil {
+			return false
+		}
+	} else {
+		if idx := strings.LastIndexByte(host, ':'); idx >= 0 {
+			host, port = host[:idx], host[idx:]
+		}
+		if net.ParseIP(host) == nil && !isDNSName(host) {
+			return false
+		}
+	}
+	if port != "" {
+		if len(port) < 2 || len(port) > 6 || port[0] != ':' {
+			return false
+		}
+		for i := 1; i < len(port); i++ {
+			if port[i] < '0' || port[i] > '9' {
+				return false
+			}
+		}
+		if n, _ := strconv.Atoi(port[1:]); n > 65535 {
+			return false
+		}
+	}
+	return true
+}
+
+// isDNSName reports whether name is a valid DNS name by the syntax of RFC 1123
+func isDNSName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// httpBadRequestReason returns the 400 response which has the reason of given error in its body
+func httpBadRequestReason(err error) string {
+	e := (*httpError)(nil)
+	if !errors.As(err, &e) {
+		return httpBadRequest
+	}
+	return "HTTP/1.0 400 Bad Request\r\n\r\nBad Request: " + e.Err.Error() + "\r\n"
+}
@@ -0,0 +1,115 @@
+package lb
+
+import (
+	"bufio"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var strictHTTPRequestCorpus = []struct {
+	req string
+	err error
+}{
+	{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", nil},
+	{"GET /a%20b?q=%00 HTTP/1.1\r\nHost: example.com:8080\r\nX-Tab: a\tb\r\n\r\n", nil},
+	{"OPTIONS * HTTP/1.1\r\nHost: 192.0.2.1\r\n\r\n", nil},
+	{"GET / HTTP/1.1\r\nHost: [2001:db8::1]:443\r\n\r\n", nil},
+	{"GET / HTTP/1.0\r\n\r\n", nil},
+	{"GET / HTTP/1.1\r\nHost: example.com\r\nX-A: a\rb\r\n\r\n", errHTTPStrictBareCR},
+	{"GET / HTTP/1.1\r\r\nHost: example.com\r\n\r\n", errHTTPStrictBareCR},
+	{"GET / HTTP/1.1\r\nHost: example.com\r\nX-A: a\x00b\r\n\r\n", errHTTPStrictControlByte},
+	{"GET /\x7f HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictControlByte},
+	{"G(T / HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictMethodToken},
+	{"get / HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictUnsupportedMethod},
+	{"PURGE / HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictUnsupportedMethod},
+	{"GET /a%0d%0aX-B:%20c HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictPathEncodingForbidden},
+	{"GET /%7F HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictPathEncodingForbidden},
+	{"GET /%zz HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictPathEncodingMalformed},
+	{"GET /a% HTTP/1.1\r\nHost: example.com\r\n\r\n", errHTTPStrictPathEncodingMalformed},
+	{"GET / HTTP/1.1\r\n\r\n", errHTTPStrictHostCount},
+	{"GET / HTTP/1.1\r\nHost: a.example.com\r\nHost: b.example.com\r\n\r\n", errHTTPStrictHostCount},
+	{"GET / HTTP/1.1\r\nHost: exa_mple.com\r\n\r\n", errHTTPStrictHost},
+	{"GET / HTTP/1.1\r\nHost: -example.com\r\n\r\n", errHTTPStrictHost},
+	{"GET / HTTP/1.1\r\nHost: example.com:\r\n\r\n", errHTTPStrictHost},
+	{"GET / HTTP/1.1\r\nHost: example.com:65536\r\n\r\n", errHTTPStrictHost},
+	{"GET / HTTP/1.1\r\nHost: [192.0.2.1]\r\n\r\n", errHTTPStrictHost},
+	{"GET / HTTP/1.1\r\nHost: user@example.com\r\n\r\n", errHTTPStrictHost},
+	{"GET / HTTP/1.1\r\nHost: \r\n\r\n", errHTTPStrictHost},
+}
+
+func checkStrictHTTPRawRequest(req string) error {
+	statusLine, hdr, lines, _, err := splitHTTPHeader(bufio.NewReader(strings.NewReader(req)), maxHTTPHeadersLen)
+	if err != nil {
+		return nil
+	}
+	return checkStrictHTTPRequest(statusLine, hdr, lines)
+}
+
+func TestCheckStrictHTTPRequest(t *testing.T) {
+	for _, tc := range strictHTTPRequestCorpus {
+		if err := checkStrictHTTPRawRequest(tc.req); err != tc.err {
+			t.Errorf("request %q: got error %v, want %v", tc.req, err, tc.err)
+		}
+	}
+}
+
+func TestCheckStrictHTTPRequestMutations(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	special := []byte("\x00\t\r\n %:[]@-.?#\x7f\xff")
+	for i := 0; i < 20000; i++ {
+		req := []byte(strictHTTPRequestCorpus[rnd.Intn(len(strictHTTPRequestCorpus))].req)
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			idx := rnd.Intn(len(req))
+			switch rnd.Intn(3) {
+			case 0:
+				req[idx] = special[rnd.Intn(len(special))]
+			case 1:
+				req[idx] = byte(rnd.Intn(256))
+			case 2:
+				req = append(req[:idx], req[idx+1:]...)
+			}
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("request %q: panic: %v", req, r)
+				}
+			}()
+			checkStrictHTTPRawRequest(string(req))
+		}()
+	}
+}
+
+func TestHTTPFrontendStrictParsing(t *testing.T) {
+	b, bCloser := newTestHTTPBackend(t, "strict", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	defer bCloser()
+
+	req := "GET /a%00 HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	for _, tc := range []struct {
+		strict bool
+		code   int
+		body   string
+	}{
+		{false, http.StatusOK, "OK"},
+		{true, http.StatusBadRequest, "Bad Request: forbidden byte percent-encoded in path\r\n"},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:           "strict",
+			DefaultBackend: b,
+			StrictParsing:  tc.strict,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+		if resp, body := doTestRequestOnce(t, fLis, req); resp.StatusCode != tc.code || body != tc.body {
+			t.Errorf("strict %v: got %d %q, want %d %q", tc.strict, resp.StatusCode, body, tc.code, tc.body)
+		}
+		fLis.Close()
+		f.Close()
+	}
+}
@@ -0,0 +1,394 @@
+package lb_test
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/simult/simult/pkg/lb"
+	"github.com/simult/simult/pkg/lb/lbtest"
+)
+
+func TestHTTPBackendResponseHeaderTimeout(t *testing.T) {
+	s := lbtest.NewFakeServer(t, lbtest.FakeServerOptions{
+		Handler: func(req *http.Request, body []byte) lbtest.Response {
+			delay, _ := time.ParseDuration(req.Header.Get("X-Delay"))
+			return lbtest.Response{Body: "OK", Latency: delay}
+		},
+	})
+	defer s.Close()
+
+	b, err := lb.NewHTTPBackend(lb.HTTPBackendOptions{
+		Name:                  "test",
+		ResponseHeaderTimeout: 5 * time.Second,
+		OverrideErrors:        "HTTP/1.0 504 Gateway Timeout\r\n\r\nCustom Gateway Timeout\r\n",
+		Servers:               []string{s.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f := lbtest.StartFrontend(t, lb.HTTPFrontendOptions{
+		Name:             "test",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+		Routes: []lb.HTTPFrontendRoute{
+			{
+				Path:                  "/search",
+				Backend:               b,
+				ResponseHeaderTimeout: 200 * time.Millisecond,
+			},
+		},
+	})
+	defer f.Close()
+
+	for _, tc := range []struct {
+		path  string
+		delay time.Duration
+		code  int
+		body  string
+	}{
+		{"/search", 50 * time.Millisecond, 200, "OK"},
+		{"/search", 500 * time.Millisecond, 504, "Custom Gateway Timeout\r\n"},
+		{"/other", 500 * time.Millisecond, 200, "OK"},
+	} {
+		resp, body := f.Do(t, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\nX-Delay: "+tc.delay.String()+"\r\n\r\n")
+		if resp.StatusCode != tc.code || body != tc.body {
+			t.Errorf("path %q with delay %v: got %d %q, want %d %q", tc.path, tc.delay, resp.StatusCode, body, tc.code, tc.body)
+		}
+	}
+}
+
+func TestHTTPBackendTLSPin(t *testing.T) {
+	s := lbtest.NewFakeServer(t, lbtest.FakeServerOptions{
+		Handler: func(req *http.Request, body []byte) lbtest.Response {
+			return lbtest.Response{Body: req.TLS.ServerName}
+		},
+		TLS: true,
+	})
+	defer s.Close()
+	sum := sha256.Sum256(s.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	for _, tc := range []struct {
+		params string
+		codes  []int
+		body   string
+	}{
+		{"servername=api.example.com pin=sha256/" + pin, []int{200}, "api.example.com"},
+		{"pin=" + wrongPin + " pin=" + pin, []int{200}, ""},
+		{"servername=example.com verify=ca+pin pin=" + pin, []int{502}, ""},
+		{"pin=" + wrongPin, []int{502, 503}, ""},
+	} {
+		b, err := lb.NewHTTPBackend(lb.HTTPBackendOptions{
+			Name:    "test",
+			Servers: []string{s.URL + " 1 " + tc.params},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Activate()
+		f := lbtest.StartFrontend(t, lb.HTTPFrontendOptions{
+			Name:           "test",
+			DefaultBackend: b,
+		})
+		for _, code := range tc.codes {
+			resp, body := f.Do(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			if resp.StatusCode != code || (code == 200 && body != tc.body) {
+				t.Errorf("params %q: got %d %q, want %d %q", tc.params, resp.StatusCode, body, code, tc.body)
+			}
+			// wait for worker to update server nodes
+			time.Sleep(200 * time.Millisecond)
+		}
+		f.Close()
+		b.Close()
+	}
+
+	for _, params := range []string{"pin=abc", "verify=pin", "verify=ca pin=" + pin, "foo=bar", "servername"} {
+		if b, err := lb.NewHTTPBackend(lb.HTTPBackendOptions{Name: "test", Servers: []string{s.URL + " " + params}}); err == nil {
+			b.Close()
+			t.Errorf("params %q: expected error", params)
+		}
+	}
+}
+
+func TestHTTPFrontendUnmatchedRequestAction(t *testing.T) {
+	s := lbtest.NewFakeServer(t, lbtest.FakeServerOptions{})
+	defer s.Close()
+	b, err := lb.NewHTTPBackend(lb.HTTPBackendOptions{Name: "unmatched", Servers: []string{s.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	for _, tc := range []struct {
+		action lb.HTTPFrontendUnmatchedAction
+		code   int
+		host   string
+	}{
+		{lb.HTTPFrontendUnmatchedActionDefaultBackend, 200, "*"},
+		{lb.HTTPFrontendUnmatchedActionNotFound, 404, "<unmatched>"},
+		{lb.HTTPFrontendUnmatchedActionMisdirected, 421, "<unmatched>"},
+		{lb.HTTPFrontendUnmatchedActionClose, 0, "<unmatched>"},
+	} {
+		name := "unmatched" + strconv.Itoa(int(tc.action))
+		f := lbtest.StartFrontend(t, lb.HTTPFrontendOptions{
+			Name:                   name,
+			DefaultBackend:         b,
+			UnmatchedRequestAction: tc.action,
+			Routes: []lb.HTTPFrontendRoute{
+				{Host: "example.com", Backend: b},
+			},
+		})
+		labels := prometheus.Labels{"frontend": name, "host": tc.host}
+		base := lbtest.MetricValue(t, prometheus.DefaultGatherer, "test_http_frontend_requests_total", labels)
+
+		if resp, _ := f.Do(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 {
+			t.Errorf("action %d: got %d for matched request, want 200", tc.action, resp.StatusCode)
+		}
+		conn := f.Dial(t)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: scanner.example.org\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		switch {
+		case tc.code == 0 && err == nil:
+			t.Errorf("action %d: got %d for unmatched request, want closed connection", tc.action, resp.StatusCode)
+		case tc.code != 0 && (err != nil || resp.StatusCode != tc.code):
+			t.Errorf("action %d: got %v %v for unmatched request, want %d", tc.action, resp, err, tc.code)
+		}
+
+		lbtest.AssertMetricDelta(t, prometheus.DefaultGatherer, "test_http_frontend_requests_total", labels, base, 1, time.Second)
+		f.Close()
+	}
+}
+
+func TestFrontendTLSListener(t *testing.T) {
+	s := lbtest.NewFakeServer(t, lbtest.FakeServerOptions{
+		Handler: func(req *http.Request, body []byte) lbtest.Response {
+			return lbtest.Response{Body: req.Header.Get("X-Forwarded-Proto")}
+		},
+	})
+	defer s.Close()
+	b, err := lb.NewHTTPBackend(lb.HTTPBackendOptions{Name: "tls", Servers: []string{s.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f := lbtest.StartFrontendListener(t, lb.HTTPFrontendOptions{Name: "tls", DefaultBackend: b}, lb.ListenerOptions{TLSConfig: lbtest.TLSConfig(t)})
+	defer f.Close()
+	if _, ok := f.Dial(t).(*tls.Conn); !ok {
+		t.Fatal("expected tls connection")
+	}
+	if resp, body := f.Do(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != 200 || body != "https" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, "https")
+	}
+}
+
+func TestHTTPBackendQueue(t *testing.T) {
+	s := lbtest.NewFakeServer(t, lbtest.FakeServerOptions{
+		Handler: func(req *http.Request, body []byte) lbtest.Response {
+			return lbtest.Response{Body: "OK", Latency: time.Second}
+		},
+	})
+	defer s.Close()
+	b, err := lb.NewHTTPBackend(lb.HTTPBackendOptions{
+		Name:         "queue",
+		MaxConn:      1,
+		QueueTimeout: 300 * time.Millisecond,
+		MaxQueue:     1,
+		ShedStatus:   http.StatusTooManyRequests,
+		Servers:      []string{s.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+	f := lbtest.StartFrontend(t, lb.HTTPFrontendOptions{Name: "queue", DefaultBackend: b})
+	defer f.Close()
+
+	g := prometheus.DefaultGatherer
+	labels := prometheus.Labels{"backend": "queue"}
+	metrics := []string{
+		"test_http_backend_queue_timeout_total",
+		"test_http_backend_queue_client_abort_total",
+		"test_http_backend_shed_total",
+		"test_http_backend_time_to_first_byte_seconds",
+	}
+	bases := make([]float64, len(metrics))
+	for i, name := range metrics {
+		bases[i] = lbtest.MetricValue(t, g, name, labels)
+	}
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	do := func(conn net.Conn) <-chan int {
+		ch := make(chan int, 1)
+		go func() {
+			defer conn.Close()
+			conn.Write([]byte(req))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				ch <- 0
+				return
+			}
+			ch <- resp.StatusCode
+		}()
+		return ch
+	}
+
+	// the first request holds the only connection slot for a second
+	served := do(f.Dial(t))
+	time.Sleep(50 * time.Millisecond)
+
+	aborted := f.Dial(t)
+	aborted.Write([]byte(req))
+	time.Sleep(100 * time.Millisecond)
+	aborted.Close()
+	lbtest.AssertMetricDelta(t, g, metrics[1], labels, bases[1], 1, time.Second)
+
+	timedOut := do(f.Dial(t))
+	time.Sleep(50 * time.Millisecond)
+	if code := <-do(f.Dial(t)); code != http.StatusTooManyRequests {
+		t.Errorf("shed request: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := <-timedOut; code != http.StatusServiceUnavailable {
+		t.Errorf("queue timed out request: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := <-served; code != http.StatusOK {
+		t.Errorf("served request: got %d, want %d", code, http.StatusOK)
+	}
+
+	for i, name := range metrics {
+		lbtest.AssertMetricDelta(t, g, name, labels, bases[i], 1, time.Second)
+	}
+	if n := s.Requests(); n != 1 {
+		t.Errorf("got %d requests on backend server, want 1", n)
+	}
+}
+
+func TestHTTPFrontendRouteBackendName(t *testing.T) {
+	newServer := func(body string) *lbtest.FakeServer {
+		return lbtest.NewFakeServer(t, lbtest.FakeServerOptions{
+			Handler: func(req *http.Request, _ []byte) lbtest.Response {
+				return lbtest.Response{Body: body}
+			},
+		})
+	}
+	s1, s2 := newServer("first"), newServer("second")
+	defer s1.Close()
+	defer s2.Close()
+
+	if _, err := lb.NewHTTPFrontend(lb.HTTPFrontendOptions{
+		Name:   "latebound",
+		Routes: []lb.HTTPFrontendRoute{{BackendName: "latebound"}},
+	}); err == nil {
+		t.Fatal("expected error for unknown backend name")
+	}
+
+	opts := lb.HTTPBackendOptions{Name: "latebound", Servers: []string{s1.URL}}
+	b, err := lb.NewHTTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Activate()
+	f := lbtest.StartFrontend(t, lb.HTTPFrontendOptions{
+		Name:   "latebound",
+		Routes: []lb.HTTPFrontendRoute{{BackendName: "latebound"}},
+	})
+	defer f.Close()
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	if resp, body := f.Do(t, req); resp.StatusCode != 200 || body != "first" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, "first")
+	}
+
+	// reload replaces only the backend, the frontend isn't forked
+	opts.Servers = []string{s2.URL}
+	bn, err := b.Fork(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bn.Activate()
+	b.Close()
+	if lb.LookupHTTPBackend("latebound") != bn {
+		t.Error("expected forked backend to be registered")
+	}
+	if resp, body := f.Do(t, req); resp.StatusCode != 200 || body != "second" {
+		t.Errorf("after reload: got %d %q, want 200 %q", resp.StatusCode, body, "second")
+	}
+
+	bn.Close()
+	if resp, _ := f.Do(t, req); resp.StatusCode != 503 {
+		t.Errorf("after close: got %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestHTTPBackendMaxResponseBodySize(t *testing.T) {
+	s := lbtest.NewFakeServer(t, lbtest.FakeServerOptions{
+		Handler: func(req *http.Request, body []byte) lbtest.Response {
+			switch req.URL.Path {
+			case "/chunked":
+				return lbtest.Response{
+					Header: http.Header{"Transfer-Encoding": {"chunked"}},
+					Body:   "8\r\n01234567\r\n8\r\n89abcdef\r\n0\r\n\r\n",
+				}
+			case "/small":
+				return lbtest.Response{Body: "small"}
+			}
+			return lbtest.Response{Body: "0123456789abcdef"}
+		},
+	})
+	defer s.Close()
+	b, err := lb.NewHTTPBackend(lb.HTTPBackendOptions{
+		Name:                "maxbody",
+		MaxResponseBodySize: 10,
+		Servers:             []string{s.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+	f := lbtest.StartFrontend(t, lb.HTTPFrontendOptions{
+		Name:           "maxbody",
+		DefaultBackend: b,
+		Routes: []lb.HTTPFrontendRoute{
+			{Path: "/download/*", Backend: b, MaxResponseBodySize: -1},
+		},
+	})
+	defer f.Close()
+
+	g := prometheus.DefaultGatherer
+	labels := prometheus.Labels{"frontend": "maxbody", "error": "response_too_large", "class": "backend_error"}
+	base := lbtest.MetricValue(t, g, "test_http_frontend_requests_total", labels)
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/small", 200, "small"},
+		{"/large", 502, "Bad Gateway\r\n"},
+		{"/chunked", 200, "0123456789"},
+		{"/download/large", 200, "0123456789abcdef"},
+		{"/download/chunked", 200, "0123456789abcdef"},
+	} {
+		resp, body := f.Do(t, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code || body != tc.body {
+			t.Errorf("path %q: got %d %q, want %d %q", tc.path, resp.StatusCode, body, tc.code, tc.body)
+		}
+	}
+	lbtest.AssertMetricDelta(t, g, "test_http_frontend_requests_total", labels, base, 2, time.Second)
+}
@@ -0,0 +1,458 @@
+package lb
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for RS256, PS256 and ES256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goinsane/xlog"
+)
+
+const (
+	httpJWTMissingResponse = "HTTP/1.0 401 Unauthorized\r\nWWW-Authenticate: Bearer\r\n\r\nUnauthorized\r\n"
+	httpJWTInvalidResponse = "HTTP/1.0 401 Unauthorized\r\nWWW-Authenticate: Bearer error=\"invalid_token\"\r\n\r\nUnauthorized\r\n"
+)
+
+// jwtMinNumericDate and jwtMaxNumericDate are the unix seconds of 0001-01-01T00:00:00Z and 9999-12-31T23:59:59Z, other
+// NumericDate values are malformed
+const (
+	jwtMinNumericDate = -62135596800
+	jwtMaxNumericDate = 253402300799
+)
+
+var (
+	errJWTMalformed        = errors.New("malformed token")
+	errJWTUnsupportedAlg   = errors.New("unsupported algorithm")
+	errJWTInvalidSignature = errors.New("invalid signature")
+	errJWTExpired          = errors.New("token expired")
+	errJWTNotValidYet      = errors.New("token not valid yet")
+	errJWTIssuer           = errors.New("unexpected issuer")
+	errJWTAudience         = errors.New("unexpected audience")
+)
+
+// jwtKey is a verification key: []byte for HMAC, *rsa.PublicKey or *ecdsa.PublicKey
+type jwtKey struct {
+	kid string
+	key interface{}
+}
+
+// parseJWTKeys parses a key file which is either a JWKS document or PEM blocks of public keys and certificates
+func parseJWTKeys(data []byte) (keys []jwtKey, err error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		keys, err = parseJWKS(data)
+	} else {
+		keys, err = parseJWTPEMKeys(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable key")
+	}
+	return
+}
+
+func parseJWTPEMKeys(data []byte) (keys []jwtKey, err error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("PEM block %q: %w", block.Type, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("PEM block %q: unsupported key type %T", block.Type, key)
+		}
+		keys = append(keys, jwtKey{key: key})
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		return nil, errors.New("invalid PEM data")
+	}
+	return
+}
+
+func parseJWKS(data []byte) (keys []jwtKey, err error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	decode := func(s string) *big.Int {
+		b, e := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if e != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			n, e := decode(k.N), decode(k.E)
+			if n == nil || e == nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+				return nil, fmt.Errorf("JWKS key %d: invalid RSA key", i)
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			curve := jwtCurve(k.Crv)
+			x, y := decode(k.X), decode(k.Y)
+			if curve == nil || x == nil || y == nil || !curve.IsOnCurve(x, y) {
+				return nil, fmt.Errorf("JWKS key %d: invalid EC key", i)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "oct":
+			secret, e := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.K, "="))
+			if e != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("JWKS key %d: invalid oct key", i)
+			}
+			key = secret
+		default:
+			// keys of other types can't verify supported algorithms
+			continue
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, key: key})
+	}
+	return
+}
+
+func jwtCurve(crv string) elliptic.Curve {
+	switch crv {
+	case "P-256":
+		return elliptic.P256()
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// jwtAlgCurve returns the curve of the ECDSA algorithm
+func jwtAlgCurve(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// jwtHash returns the hash of the supported algorithm, or zero if the algorithm isn't supported
+func jwtHash(alg string) crypto.Hash {
+	if len(alg) != 5 {
+		return 0
+	}
+	switch alg[:2] {
+	case "HS", "RS", "PS", "ES":
+	default:
+		return 0
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	}
+	return 0
+}
+
+// verifyJWTSignature verifies the signature of signed by the key for the algorithm. The key type must match the
+// algorithm, so that public keys can't be used as HMAC secrets.
+func verifyJWTSignature(alg string, key interface{}, signed, sig []byte) bool {
+	hash := jwtHash(alg)
+	if hash == 0 {
+		return false
+	}
+	switch k := key.(type) {
+	case []byte:
+		if alg[:2] != "HS" {
+			return false
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		h := hash.New()
+		h.Write(signed)
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, h.Sum(nil), sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(k, hash, h.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if k.Curve != jwtAlgCurve(alg) || len(sig) != 2*size {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, h.Sum(nil), r, s)
+	}
+	return false
+}
+
+// httpJWT validates the Bearer tokens of the requests of a route, and copies their claims to request headers
+type httpJWT struct {
+	secret       []byte
+	file         *watchedFile
+	issuer       string
+	audience     string
+	clockSkew    time.Duration
+	claimHeaders map[string]string
+}
+
+func newHTTPJWT(route *HTTPFrontendRoute) (j *httpJWT, err error) {
+	if route.redirect != nil || route.response != nil {
+		return nil, errors.New("has redirect or response")
+	}
+	opts := &route.JWT
+	j = &httpJWT{
+		issuer:       opts.Issuer,
+		audience:     opts.Audience,
+		clockSkew:    opts.ClockSkew,
+		claimHeaders: make(map[string]string, len(opts.ClaimHeaders)),
+	}
+	if opts.Secret != "" {
+		j.secret = []byte(opts.Secret)
+	}
+	if j.clockSkew < 0 {
+		j.clockSkew = 0
+	}
+	for claim, name := range opts.ClaimHeaders {
+		if claim == "" || name == "" || strings.IndexFunc(name, isNotToken) >= 0 {
+			return nil, fmt.Errorf("claim %q header %q invalid", claim, name)
+		}
+		j.claimHeaders[claim] = http.CanonicalHeaderKey(name)
+	}
+	if opts.KeyFile != "" {
+		j.file, err = newWatchedFile(opts.KeyFile, "jwt key", func(f *os.File) (interface{}, error) {
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return nil, err
+			}
+			return parseJWTKeys(data)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Verify verifies the token, and returns its claims if it is valid
+func (j *httpJWT) Verify(token string, now time.Time) (claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hdrData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hdrData, &header) != nil {
+		return nil, errJWTMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	if jwtHash(header.Alg) == 0 {
+		return nil, errJWTUnsupportedAlg
+	}
+
+	var keys []jwtKey
+	if j.secret != nil {
+		keys = append(keys, jwtKey{key: j.secret})
+	}
+	if j.file != nil {
+		keys = append(keys, j.file.Load().([]jwtKey)...)
+	}
+	signed, verified := []byte(parts[0]+"."+parts[1]), false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errJWTInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err = dec.Decode(&claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	numericDate := func(name string) (t time.Time, ok bool, err error) {
+		v, ok := claims[name]
+		if !ok {
+			return
+		}
+		n, isNum := v.(json.Number)
+		f, e := n.Float64()
+		// the range is checked before conversion, scaling to nanoseconds overflows after year 2262
+		if !isNum || e != nil || !(f >= jwtMinNumericDate && f < jwtMaxNumericDate+1) {
+			return t, false, errJWTMalformed
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), true, nil
+	}
+	if exp, ok, err := numericDate("exp"); err != nil {
+		return nil, err
+	} else if ok && !now.Before(exp.Add(j.clockSkew)) {
+		return nil, errJWTExpired
+	}
+	if nbf, ok, err := numericDate("nbf"); err != nil {
+		return nil, err
+	} else if ok && now.Add(j.clockSkew).Before(nbf) {
+		return nil, errJWTNotValidYet
+	}
+	if j.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.issuer {
+			return nil, errJWTIssuer
+		}
+	}
+	if j.audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == j.audience
+		case []interface{}:
+			for _, a := range aud {
+				if s, _ := a.(string); s == j.audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return nil, errJWTAudience
+		}
+	}
+	return
+}
+
+// jwtClaimHeaderValue formats the claim as a header value. Strings are sent as is, other values in JSON.
+func jwtClaimHeaderValue(v interface{}) (value string, ok bool) {
+	switch c := v.(type) {
+	case string:
+		value = c
+	case json.Number:
+		value = c.String()
+	case bool:
+		value = strconv.FormatBool(c)
+	default:
+		b, err := json.Marshal(c)
+		if err != nil {
+			return "", false
+		}
+		value = string(b)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", false
+	}
+	return value, true
+}
+
+// serveJWT validates the Bearer token of the request. Requests without a valid token are answered with 401. Claim
+// headers which are sent by the client are always removed.
+func (f *HTTPFrontend) serveJWT(reqDesc *httpReqDesc, j *httpJWT) (err error) {
+	for _, name := range j.claimHeaders {
+		reqDesc.feHdr.Del(name)
+	}
+	auth := reqDesc.feHdr.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") || strings.TrimSpace(auth[7:]) == "" {
+		err = errHTTPJWTDenied
+		xlog.V(100).Debugf("serve error on %s: %v: missing bearer token", reqDesc.FrontendSummary(), err)
+		reqDesc.beStatusCode = "401"
+		reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+		reqDesc.feConn.Write([]byte(httpJWTMissingResponse))
+		return
+	}
+	claims, e := j.Verify(strings.TrimSpace(auth[7:]), time.Now())
+	if e != nil {
+		err = errHTTPJWTDenied
+		xlog.V(100).Debugf("serve error on %s: %v: %v", reqDesc.FrontendSummary(), err, e)
+		reqDesc.beStatusCode = "401"
+		reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+		reqDesc.feConn.Write([]byte(httpJWTInvalidResponse))
+		return
+	}
+	for claim, name := range j.claimHeaders {
+		v, ok := claims[claim]
+		if !ok || v == nil {
+			continue
+		}
+		if value, ok := jwtClaimHeaderValue(v); ok {
+			reqDesc.feHdr.Set(name, value)
+		}
+	}
+	return
+}
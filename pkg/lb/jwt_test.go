@@ -0,0 +1,220 @@
+package lb
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	hdr := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		hdr["kid"] = kid
+	}
+	hdrData, _ := json.Marshal(hdr)
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdrData) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestHTTPJWTVerify(t *testing.T) {
+	route := &HTTPFrontendRoute{}
+	route.JWT.Secret = "secret"
+	route.JWT.Issuer = "https://issuer.example.com"
+	route.JWT.Audience = "api"
+	route.JWT.ClockSkew = 30 * time.Second
+	j, err := newHTTPJWT(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(modify func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://issuer.example.com", "aud": []string{"other", "api"}, "exp": now.Add(time.Minute).Unix()}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", signTestJWT(t, "HS256", "", []byte("secret"), claims(nil)), nil},
+		{"expired within clock skew", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["exp"] = now.Add(-10 * time.Second).Unix() })), nil},
+		{"expired", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() })), errJWTExpired},
+		{"far future expiry", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["exp"] = 1e11 })), nil},
+		{"fractional expiry", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["exp"] = float64(now.Unix()) - 20.5 })), nil},
+		{"huge expiry", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["exp"] = 1e300 })), errJWTMalformed},
+		{"huge negative not before", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["nbf"] = -1e19 })), errJWTMalformed},
+		{"not valid yet", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() })), errJWTNotValidYet},
+		{"unexpected issuer", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["iss"] = "other" })), errJWTIssuer},
+		{"unexpected audience", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { c["aud"] = "other" })), errJWTAudience},
+		{"missing audience", signTestJWT(t, "HS256", "", []byte("secret"), claims(func(c map[string]interface{}) { delete(c, "aud") })), errJWTAudience},
+		{"wrong secret", signTestJWT(t, "HS256", "", []byte("wrong"), claims(nil)), errJWTInvalidSignature},
+		{"key type mismatch", signTestJWT(t, "RS256", "", rsaKey, claims(nil)), errJWTInvalidSignature},
+		{"none algorithm", signTestJWT(t, "none", "", nil, claims(nil)), errJWTUnsupportedAlg},
+		{"malformed", "a.b", errJWTMalformed},
+	} {
+		if _, err := j.Verify(tc.token, now); err != tc.err {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestHTTPFrontendJWT(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "jwt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-JWT-Sub") + "|" + r.Header.Get("X-JWT-Admin")))
+	})
+	defer closer()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	file, err := ioutil.TempFile("", "jwtkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	modTime := time.Now()
+	writeFile := func(content string) {
+		if err := ioutil.WriteFile(file.Name(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the modification time changes even if the file is written in the same tick
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(file.Name(), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(pubPEM)
+
+	route := HTTPFrontendRoute{Path: "/*", Backend: b}
+	route.JWT.KeyFile = file.Name()
+	route.JWT.ClaimHeaders = map[string]string{"sub": "x-jwt-sub", "admin": "X-JWT-Admin"}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "jwt",
+		Routes: []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	request := func(token string) (resp *http.Response, body string) {
+		req := "GET / HTTP/1.1\r\nHost: example.com\r\nX-JWT-Sub: forged\r\n"
+		if token != "" {
+			req += "Authorization: Bearer " + token + "\r\n"
+		}
+		return doTestRequestOnce(t, fLis, req+"\r\n")
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	for _, tc := range []struct {
+		name            string
+		token           string
+		code            int
+		wwwAuthenticate string
+		body            string
+	}{
+		{"missing token", "", http.StatusUnauthorized, "Bearer", ""},
+		{"valid token", signTestJWT(t, "RS256", "", rsaKey, map[string]interface{}{"sub": "alice", "admin": true, "exp": exp}), http.StatusOK, "", "alice|true"},
+		{"valid token without claims", signTestJWT(t, "RS256", "", rsaKey, map[string]interface{}{"exp": exp}), http.StatusOK, "", "|"},
+		{"public key as HMAC secret", signTestJWT(t, "HS256", "", []byte(pubPEM), map[string]interface{}{"sub": "mallory"}), http.StatusUnauthorized, `Bearer error="invalid_token"`, ""},
+		{"other key", signTestJWT(t, "ES256", "", ecKey, map[string]interface{}{"sub": "bob"}), http.StatusUnauthorized, `Bearer error="invalid_token"`, ""},
+	} {
+		resp, body := request(tc.token)
+		if resp.StatusCode != tc.code || resp.Header.Get("WWW-Authenticate") != tc.wwwAuthenticate || (tc.code == http.StatusOK && body != tc.body) {
+			t.Errorf("%s: got %d WWW-Authenticate %q body %q, want %d WWW-Authenticate %q body %q",
+				tc.name, resp.StatusCode, resp.Header.Get("WWW-Authenticate"), body, tc.code, tc.wwwAuthenticate, tc.body)
+		}
+	}
+
+	// the changed key file is reloaded by the worker
+	jwk := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	writeFile(`{"keys": [{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": "` + jwk(ecKey.X) + `", "y": "` + jwk(ecKey.Y) + `"}]}`)
+	token := signTestJWT(t, "ES256", "ec1", ecKey, map[string]interface{}{"sub": "bob"})
+	var code int
+	for i := 0; i < 60 && code != http.StatusOK; i++ {
+		time.Sleep(50 * time.Millisecond)
+		resp, _ := request(token)
+		code = resp.StatusCode
+	}
+	if code != http.StatusOK {
+		t.Fatalf("got %d with reloaded key, want 200", code)
+	}
+	if resp, _ := request(signTestJWT(t, "ES256", "ec2", ecKey, map[string]interface{}{"sub": "bob"})); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d with other kid, want 401", resp.StatusCode)
+	}
+	writeFile(pubPEM)
+
+	for _, tc := range []struct {
+		name   string
+		modify func(route *HTTPFrontendRoute)
+	}{
+		{"missing key file", func(route *HTTPFrontendRoute) { route.JWT.KeyFile += ".missing" }},
+		{"invalid claim header", func(route *HTTPFrontendRoute) { route.JWT.ClaimHeaders = map[string]string{"sub": "X JWT"} }},
+		{"both jwt and response", func(route *HTTPFrontendRoute) { route.Backend, route.Response.Body = nil, "ok" }},
+	} {
+		badRoute := route
+		tc.modify(&badRoute)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "jwt", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+	if _, err := parseJWTKeys([]byte("not a key")); err == nil {
+		t.Error("invalid key file: expected error")
+	}
+}
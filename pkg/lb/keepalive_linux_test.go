@@ -0,0 +1,133 @@
+package lb
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testGetsockopt returns the value of the socket option of conn
+func testGetsockopt(t *testing.T, conn net.Conn, level, opt int) (value int) {
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e error
+	if err = rc.Control(func(fd uintptr) {
+		value, e = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil || e != nil {
+		t.Fatal(err, e)
+	}
+	return
+}
+
+// testOSKeepAliveIdle returns the keep-alive idle period of the OS in seconds, it is zero if unknown
+func testOSKeepAliveIdle() int {
+	b, _ := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_keepalive_time")
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
+
+func TestHTTPFrontendTCPKeepAlive(t *testing.T) {
+	lc := &net.ListenConfig{KeepAlive: -1}
+	lis, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	l := &Listener{}
+	l.opts.Name = "test"
+
+	for _, tc := range []struct {
+		period    time.Duration
+		noDelay   bool
+		keepAlive int
+		idle      int
+		wantDelay int
+	}{
+		{3 * time.Second, true, 1, 3, 1},
+		{0, false, 1, testOSKeepAliveIdle(), 0},
+		{-1, false, 0, 0, 0},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:               "keepalive",
+			WriteProfile:       HTTPFrontendWriteProfileThroughput,
+			TCPKeepAlivePeriod: tc.period,
+			TCPNoDelay:         tc.noDelay,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cliConn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go f.Serve(context.Background(), l, conn)
+		// the options are set before the request is read, TCP_NODELAY the last
+		var keepAlive, noDelay int
+		for i := 0; i < 100; i++ {
+			keepAlive, noDelay = testGetsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE), testGetsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+			if keepAlive == tc.keepAlive && (noDelay != 0) == (tc.wantDelay != 0) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if keepAlive != tc.keepAlive || (noDelay != 0) != (tc.wantDelay != 0) {
+			t.Errorf("period %v: got keep-alive %d nodelay %d, want %d %d", tc.period, keepAlive, noDelay, tc.keepAlive, tc.wantDelay)
+		}
+		if idle := testGetsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); tc.keepAlive != 0 && tc.idle != 0 && idle != tc.idle {
+			t.Errorf("period %v: got keep-alive idle %ds, want %ds", tc.period, idle, tc.idle)
+		}
+		cliConn.Close()
+		f.Close()
+	}
+}
+
+func TestBackendDialerTCPKeepAlive(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, tc := range []struct {
+		period    time.Duration
+		keepAlive int
+		idle      int
+	}{
+		{4 * time.Second, 1, 4},
+		{0, 1, testOSKeepAliveIdle()},
+		{-1, 0, 0},
+	} {
+		d := newBackendDialer(&HTTPBackendOptions{TCPKeepAlivePeriod: tc.period}, 0)
+		conn, err := d.DialContext(context.Background(), "tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keepAlive := testGetsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); keepAlive != tc.keepAlive {
+			t.Errorf("period %v: got keep-alive %d, want %d", tc.period, keepAlive, tc.keepAlive)
+		}
+		if idle := testGetsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); tc.keepAlive != 0 && tc.idle != 0 && idle != tc.idle {
+			t.Errorf("period %v: got keep-alive idle %ds, want %ds", tc.period, idle, tc.idle)
+		}
+		conn.Close()
+	}
+}
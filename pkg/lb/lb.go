@@ -3,22 +3,19 @@ package lb
 import (
 	"errors"
 	"math/rand"
-	"regexp"
 	"strings"
 )
 
 const (
 	maxHTTPHeaderLineLen = 1 * 1024 * 1024
 	maxHTTPHeadersLen    = 10 * 1024 * 1024
-)
 
-var (
-	errExpectedEOF = errors.New("expected EOF")
+	// httpDefaultMaxHeaderBytes is the maximum size of request and response header blocks if the frontend doesn't set one
+	httpDefaultMaxHeaderBytes = 64 * 1024
 )
 
 var (
-	doubleslashRgx = regexp.MustCompile(regexp.QuoteMeta(`//`))
-	slashDotRgx    = regexp.MustCompile(regexp.QuoteMeta(`/.`))
+	errExpectedEOF = errors.New("expected EOF")
 )
 
 func validOptionalPort(port string) bool {
@@ -71,5 +68,6 @@ type nopWriter struct {
 }
 
 func (w *nopWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
 	return
 }
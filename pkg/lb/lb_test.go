@@ -0,0 +1,150 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMain(m *testing.M) {
+	PromInitialize(PromOptions{
+		Namespace: "test",
+		BucketProfiles: map[string][]float64{
+			"slow": {1, 10, 100},
+		},
+	})
+	os.Exit(m.Run())
+}
+
+// runTestBackendServer listens on a random local port and calls handler for every accepted connection.
+func runTestBackendServer(t testing.TB, handler func(conn net.Conn)) (server string, lis net.Listener) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	server = "http://" + lis.Addr().String()
+	return
+}
+
+// runTestFrontend serves f on a random local port.
+func runTestFrontend(t *testing.T, f *HTTPFrontend) (lis net.Listener) {
+	return runTestListener(t, ListenerOptions{Fe: f})
+}
+
+// runTestListener serves opts.Fe on a random local port with given listener options.
+func runTestListener(t *testing.T, opts ListenerOptions) (lis net.Listener) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Name = "test"
+	opts.Network = "tcp"
+	opts.Address = lis.Addr().String()
+	l := &Listener{}
+	l.opts.CopyFrom(&opts)
+	l.tlsConfig = l.opts.tlsServerConfig()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			if l.tlsConfig != nil {
+				conn = tls.Server(conn, l.tlsConfig)
+			}
+			go func() {
+				defer conn.Close()
+				l.opts.Fe.Serve(context.Background(), l, conn)
+			}()
+		}
+	}()
+	return
+}
+
+// doTestRequest writes raw request to conn and reads a response.
+func doTestRequest(t *testing.T, conn net.Conn, rd *bufio.Reader, req string) (resp *http.Response) {
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// newTestHTTPBackend creates a HTTPBackend with a single server handled by handler.
+func newTestHTTPBackend(t *testing.T, name string, handler http.HandlerFunc) (b *HTTPBackend, closer func()) {
+	srv := httptest.NewServer(handler)
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    name,
+		Servers: []string{srv.URL},
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	b.Activate()
+	closer = func() {
+		b.Close()
+		srv.Close()
+	}
+	return
+}
+
+// doTestRequestOnce dials to lis, writes raw request and returns the response code with body.
+func doTestRequestOnce(t *testing.T, lis net.Listener, req string) (resp *http.Response, body string) {
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp = doTestRequest(t, conn, bufio.NewReader(conn), req)
+	b, _ := ioutil.ReadAll(resp.Body)
+	body = string(b)
+	return
+}
+
+// testCounterSum sums values of the counters and the gauges, or sample counts of the histograms, in vec which have given labels.
+func testCounterSum(vec prometheus.Collector, labels prometheus.Labels) (sum float64) {
+	ch := make(chan prometheus.Metric, 128)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		matched := 0
+		for _, lp := range pb.GetLabel() {
+			if v, ok := labels[lp.GetName()]; ok && v == lp.GetValue() {
+				matched++
+			}
+		}
+		if matched == len(labels) {
+			sum += pb.GetCounter().GetValue() + pb.GetGauge().GetValue() + float64(pb.GetHistogram().GetSampleCount())
+		}
+	}
+	return
+}
@@ -0,0 +1,296 @@
+// Package lbtest provides helpers for integration tests of programs which embed package lb.
+package lbtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Response describes how FakeServer responds a request
+type Response struct {
+	// StatusCode is 200 if it is zero
+	StatusCode int
+	Header     http.Header
+	Body       string
+	// Latency delays the response header
+	Latency time.Duration
+	// Drop closes the connection without response
+	Drop bool
+	// HangMidBody sends the header and the first half of the body, then hangs until FakeServer is closed
+	HangMidBody bool
+	// Close closes the connection after the response instead of keeping alive
+	Close bool
+}
+
+// Handler returns the response of the request. The body of the request has been read into body.
+type Handler func(req *http.Request, body []byte) Response
+
+// FakeServerOptions holds FakeServer options
+type FakeServerOptions struct {
+	// Handler responds 200 OK for every request if it is nil
+	Handler Handler
+	TLS     bool
+	// ProxyProtocol expects a PROXY protocol v1 header on every connection, and sets RemoteAddr of requests by it
+	ProxyProtocol bool
+}
+
+// FakeServer is a scriptable HTTP/1.1 backend server which listens on a random local port
+type FakeServer struct {
+	// URL is the server url to be used in HTTPBackendOptions
+	URL string
+
+	opts     FakeServerOptions
+	lis      net.Listener
+	cert     *x509.Certificate
+	closeCh  chan struct{}
+	conns    map[net.Conn]struct{}
+	connsMu  sync.Mutex
+	wg       sync.WaitGroup
+	requests int64
+}
+
+// NewFakeServer starts a new FakeServer by given options
+func NewFakeServer(t testing.TB, opts FakeServerOptions) (s *FakeServer) {
+	s = &FakeServer{
+		opts:    opts,
+		closeCh: make(chan struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	if s.opts.Handler == nil {
+		s.opts.Handler = func(req *http.Request, body []byte) Response { return Response{Body: "OK"} }
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.URL = "http://" + lis.Addr().String()
+	if s.opts.TLS {
+		tlsConfig := TLSConfig(t)
+		s.cert = tlsConfig.Certificates[0].Leaf
+		lis = tls.NewListener(lis, tlsConfig)
+		s.URL = "https://" + lis.Addr().String()
+	}
+	s.lis = lis
+	s.wg.Add(1)
+	go s.serve()
+	return
+}
+
+// Close closes the listener and all connections, and waits for handlers to return
+func (s *FakeServer) Close() {
+	select {
+	case <-s.closeCh:
+		return
+	default:
+	}
+	close(s.closeCh)
+	s.lis.Close()
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMu.Unlock()
+	s.wg.Wait()
+}
+
+// Requests returns the number of requests which have been read
+func (s *FakeServer) Requests() int64 {
+	return atomic.LoadInt64(&s.requests)
+}
+
+// Certificate returns the certificate of the server if it serves TLS
+func (s *FakeServer) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+func (s *FakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			return
+		}
+		s.connsMu.Lock()
+		select {
+		case <-s.closeCh:
+			s.connsMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.connsMu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			conn.Close()
+			s.connsMu.Lock()
+			delete(s.conns, conn)
+			s.connsMu.Unlock()
+		}()
+	}
+}
+
+func (s *FakeServer) serveConn(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+	remoteAddr := conn.RemoteAddr().String()
+	if s.opts.ProxyProtocol {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		addr, ok := parseProxyHeader(line)
+		if !ok {
+			return
+		}
+		if addr != "" {
+			remoteAddr = addr
+		}
+	}
+	for {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.requests, 1)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+		resp := s.opts.Handler(req, body)
+		if resp.Drop {
+			return
+		}
+		if resp.Latency > 0 {
+			select {
+			case <-time.After(resp.Latency):
+			case <-s.closeCh:
+				return
+			}
+		}
+		if !s.writeResponse(conn, req, &resp) || resp.Close {
+			return
+		}
+	}
+}
+
+func (s *FakeServer) writeResponse(conn net.Conn, req *http.Request, resp *Response) bool {
+	code := resp.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	hdr := http.Header{}
+	for k, v := range resp.Header {
+		hdr[k] = append([]string(nil), v...)
+	}
+	if hdr.Get("Content-Length") == "" && hdr.Get("Transfer-Encoding") == "" {
+		hdr.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	}
+	if resp.Close {
+		hdr.Set("Connection", "close")
+	} else {
+		hdr.Set("Connection", "keep-alive")
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	hdr.Write(&buf)
+	buf.WriteString("\r\n")
+	body := resp.Body
+	if req.Method == http.MethodHead {
+		body = ""
+	}
+	if resp.HangMidBody {
+		buf.WriteString(body[:len(body)/2])
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return false
+		}
+		<-s.closeCh
+		return false
+	}
+	buf.WriteString(body)
+	_, err := conn.Write(buf.Bytes())
+	return err == nil
+}
+
+// parseProxyHeader parses a PROXY protocol v1 header line, and returns the source address in it.
+// The address is empty for UNKNOWN protocol.
+func parseProxyHeader(line string) (addr string, ok bool) {
+	if !strings.HasSuffix(line, "\r\n") {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		ok = true
+	case "TCP4", "TCP6":
+		if len(fields) != 6 || net.ParseIP(fields[2]) == nil {
+			return
+		}
+		if _, err := strconv.ParseUint(fields[4], 10, 16); err != nil {
+			return
+		}
+		addr, ok = net.JoinHostPort(fields[2], fields[4]), true
+	}
+	return
+}
+
+// TLSConfig returns a tls.Config with a new self-signed certificate for 127.0.0.1 and localhost
+func TLSConfig(t testing.TB) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lbtest"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+			Leaf:        leaf,
+		}},
+	}
+}
@@ -0,0 +1,157 @@
+package lbtest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFakeServer(t *testing.T) {
+	s := NewFakeServer(t, FakeServerOptions{
+		Handler: func(req *http.Request, body []byte) Response {
+			switch req.URL.Path {
+			case "/drop":
+				return Response{Drop: true}
+			case "/hang":
+				return Response{Body: "abcdef", HangMidBody: true}
+			case "/slow":
+				return Response{StatusCode: 201, Body: "slow", Latency: 100 * time.Millisecond}
+			}
+			return Response{Header: http.Header{"X-Remote-Addr": {req.RemoteAddr}}, Body: "echo " + string(body)}
+		},
+	})
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	do := func(req string) (resp *http.Response, body string, err error) {
+		if _, err = conn.Write([]byte(req)); err != nil {
+			return
+		}
+		resp, err = http.ReadResponse(rd, nil)
+		if err != nil {
+			return
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		body = string(b)
+		return
+	}
+
+	if resp, body, err := do("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabc"); err != nil || resp.StatusCode != 200 || body != "echo abc" {
+		t.Fatalf("got %v %q %v", resp, body, err)
+	}
+	startTime := time.Now()
+	if resp, body, err := do("GET /slow HTTP/1.1\r\nHost: a\r\n\r\n"); err != nil || resp.StatusCode != 201 || body != "slow" || time.Now().Sub(startTime) < 100*time.Millisecond {
+		t.Fatalf("slow: got %v %q %v", resp, body, err)
+	}
+	if _, _, err := do("GET /drop HTTP/1.1\r\nHost: a\r\n\r\n"); err == nil {
+		t.Fatal("drop: expected error")
+	}
+	if n := s.Requests(); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+
+	conn, err = net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd = bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if resp, body, err := do("GET /hang HTTP/1.1\r\nHost: a\r\n\r\n"); resp == nil || body != "abc" || err == nil {
+		t.Fatalf("hang: got %v %q %v", resp, body, err)
+	}
+	startTime = time.Now()
+	s.Close()
+	if d := time.Now().Sub(startTime); d > time.Second {
+		t.Errorf("close took %v with hanging response", d)
+	}
+}
+
+func TestFakeServerProxyProtocolTLS(t *testing.T) {
+	s := NewFakeServer(t, FakeServerOptions{
+		Handler: func(req *http.Request, body []byte) Response {
+			return Response{Body: req.RemoteAddr}
+		},
+		TLS:           true,
+		ProxyProtocol: true,
+	})
+	defer s.Close()
+	if !strings.HasPrefix(s.URL, "https://") || s.Certificate() == nil {
+		t.Fatalf("got url %q certificate %v", s.URL, s.Certificate())
+	}
+
+	for _, tc := range []struct {
+		header string
+		body   string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\n", "192.0.2.1:1234"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\n", "[2001:db8::1]:1234"},
+		{"PROXY UNKNOWN\r\n", "127.0.0.1:"},
+		{"PROXY TCP4 localhost 192.0.2.2 1234 80\r\n", ""},
+		{"", ""},
+	} {
+		conn, err := tls.Dial("tcp", strings.TrimPrefix(s.URL, "https://"), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(tc.header + "GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		var body []byte
+		if err == nil {
+			body, _ = ioutil.ReadAll(resp.Body)
+		}
+		conn.Close()
+		if tc.body == "" && err == nil {
+			t.Errorf("header %q: expected dropped connection, got %q", tc.header, body)
+		}
+		if tc.body != "" && (err != nil || !strings.HasPrefix(string(body), tc.body)) {
+			t.Errorf("header %q: got %q %v, want %q", tc.header, body, err, tc.body)
+		}
+	}
+}
+
+func TestMetricValue(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"a", "b"})
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_seconds"}, []string{"a"})
+	reg.MustRegister(c, h)
+	c.With(prometheus.Labels{"a": "x", "b": "1"}).Add(2)
+	c.With(prometheus.Labels{"a": "x", "b": "2"}).Add(3)
+	c.With(prometheus.Labels{"a": "y", "b": "1"}).Add(5)
+	h.With(prometheus.Labels{"a": "x"}).Observe(1)
+
+	for _, tc := range []struct {
+		name   string
+		labels prometheus.Labels
+		value  float64
+	}{
+		{"test_total", nil, 10},
+		{"test_total", prometheus.Labels{"a": "x"}, 5},
+		{"test_total", prometheus.Labels{"a": "x", "b": "2"}, 3},
+		{"test_total", prometheus.Labels{"a": "z"}, 0},
+		{"test_seconds", prometheus.Labels{"a": "x"}, 1},
+		{"other", nil, 0},
+	} {
+		if v := MetricValue(t, reg, tc.name, tc.labels); v != tc.value {
+			t.Errorf("%s%v: got %v, want %v", tc.name, tc.labels, v, tc.value)
+		}
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.With(prometheus.Labels{"a": "y", "b": "1"}).Inc()
+	}()
+	AssertMetricDelta(t, reg, "test_total", prometheus.Labels{"a": "y"}, 5, 1, time.Second)
+}
@@ -0,0 +1,95 @@
+package lbtest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/simult/simult/pkg/lb"
+)
+
+// Frontend is a HTTPFrontend which is served by its own Listener on a random local port
+type Frontend struct {
+	Fe       *lb.HTTPFrontend
+	Listener *lb.Listener
+	Addr     string
+
+	tls bool
+}
+
+// StartFrontend creates a HTTPFrontend by given options and serves it on a random local port
+func StartFrontend(t testing.TB, opts lb.HTTPFrontendOptions) *Frontend {
+	return StartFrontendListener(t, opts, lb.ListenerOptions{})
+}
+
+// StartFrontendListener is like StartFrontend, but the Listener is created by given listener options, eg for TLS.
+// Name, Network, Address and Fe of listener options are overridden.
+func StartFrontendListener(t testing.TB, opts lb.HTTPFrontendOptions, lisOpts lb.ListenerOptions) (f *Frontend) {
+	fe, err := lb.NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fe.Close()
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	lisOpts.Name = addr
+	lisOpts.Network = "tcp"
+	lisOpts.Address = addr
+	lisOpts.Fe = fe
+	l, err := lb.NewListener(lisOpts)
+	if err != nil {
+		fe.Close()
+		t.Fatal(err)
+	}
+	l.Activate()
+	f = &Frontend{
+		Fe:       fe,
+		Listener: l,
+		Addr:     addr,
+		tls:      lisOpts.TLSConfig != nil,
+	}
+	return
+}
+
+// Close closes the Listener and the HTTPFrontend
+func (f *Frontend) Close() {
+	f.Listener.Close(nil)
+	f.Fe.Close()
+}
+
+// Dial connects to the Frontend, the connection is made with TLS if the Listener has TLS config
+func (f *Frontend) Dial(t testing.TB) (conn net.Conn) {
+	var err error
+	if f.tls {
+		conn, err = tls.Dial("tcp", f.Addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.Dial("tcp", f.Addr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Do dials to the Frontend, writes raw request and returns the response with its body
+func (f *Frontend) Do(t testing.TB, req string) (resp *http.Response, body string) {
+	conn := f.Dial(t)
+	defer conn.Close()
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	body = string(b)
+	return
+}
@@ -0,0 +1,56 @@
+package lbtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricValue sums values of the counters and the gauges, or sample counts of the histograms and the summaries,
+// which have given labels in the metric family name of g.
+// Metrics of package lb are registered to prometheus.DefaultRegisterer, so prometheus.DefaultGatherer reads them.
+func MetricValue(t testing.TB, g prometheus.Gatherer, name string, labels prometheus.Labels) (sum float64) {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			matched := 0
+			for _, lp := range m.GetLabel() {
+				if v, ok := labels[lp.GetName()]; ok && v == lp.GetValue() {
+					matched++
+				}
+			}
+			if matched != len(labels) {
+				continue
+			}
+			sum += m.GetCounter().GetValue() + m.GetGauge().GetValue() +
+				float64(m.GetHistogram().GetSampleCount()) + float64(m.GetSummary().GetSampleCount())
+		}
+	}
+	return
+}
+
+// WaitMetric polls MetricValue until it is equal to value or the timeout exceeded, and returns the last value.
+// Metrics are updated after responses are sent, so assertions right after the requests need to wait.
+func WaitMetric(t testing.TB, g prometheus.Gatherer, name string, labels prometheus.Labels, value float64, timeout time.Duration) (v float64) {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		v = MetricValue(t, g, name, labels)
+		if v == value || time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// AssertMetricDelta fails t unless the MetricValue has been increased by delta since base within the timeout
+func AssertMetricDelta(t testing.TB, g prometheus.Gatherer, name string, labels prometheus.Labels, base, delta float64, timeout time.Duration) {
+	t.Helper()
+	if v := WaitMetric(t, g, name, labels, base+delta, timeout); v-base != delta {
+		t.Errorf("metric %s%v: got delta %v, want %v", name, labels, v-base, delta)
+	}
+}
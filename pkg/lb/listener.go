@@ -3,21 +3,53 @@ package lb
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"sync"
 
 	"github.com/goinsane/accepter"
 	"github.com/goinsane/xlog"
 )
 
+// ListenerClientAuth is type of client certificate verification modes of tls listeners
+type ListenerClientAuth int
+
+const (
+	// ListenerClientAuthNone defines that client certificates aren't requested
+	ListenerClientAuthNone = ListenerClientAuth(iota)
+
+	// ListenerClientAuthVerifyIfGiven defines that client certificates are verified if clients send them
+	ListenerClientAuthVerifyIfGiven
+
+	// ListenerClientAuthRequire defines that clients must send verified certificates
+	ListenerClientAuthRequire
+)
+
 // ListenerOptions holds Listener options
 type ListenerOptions struct {
-	Name      string
-	Network   string
-	Address   string
-	Fe        Frontend
-	TLSConfig *tls.Config
+	Name                 string
+	Network              string
+	Address              string
+	Fe                   Frontend
+	TLSConfig            *tls.Config
+	TLSCertStore         *TLSCertStore
+	TLSMinVersion        uint16
+	TLSMaxVersion        uint16
+	TLSCipherSuites      []uint16
+	TLSVersionWarnOnly   bool
+	TLSVersionWarnHeader bool
+	TLSClientAuth        ListenerClientAuth
+	TLSClientCAs         *x509.CertPool
+	TLSClientSANs        []string
+	TLSClientPEMHeader   bool
+	HTTP2                bool
 }
 
 // CopyFrom sets the underlying ListenerOptions by given ListenerOptions
@@ -26,13 +58,127 @@ func (o *ListenerOptions) CopyFrom(src *ListenerOptions) {
 	if src != nil && src.TLSConfig != nil {
 		o.TLSConfig = src.TLSConfig.Clone()
 	}
+	if src != nil {
+		o.TLSCipherSuites = append([]uint16(nil), src.TLSCipherSuites...)
+		o.TLSClientSANs = append([]string(nil), src.TLSClientSANs...)
+	}
+}
+
+// tlsServerConfig returns the tls.Config handshakes are made with. In warn-only mode deprecated
+// versions and ciphers are accepted, otherwise they are rejected at handshake. The cipher suites of
+// the options, or else of TLSConfig, are kept except insecure ones which are removed unless in
+// warn-only mode, and they don't apply to TLS 1.3. Without TLSMinVersion, the minimum version and
+// the cipher suites default to the ones of go 1.13. Certificates are served by the certificate
+// store if there is. Client certificates are verified by the client CAs, and by the client SAN
+// patterns if there are. h2 is offered by ALPN if HTTP2 is set.
+func (o *ListenerOptions) tlsServerConfig() *tls.Config {
+	if o.TLSConfig == nil {
+		return nil
+	}
+	c := o.TLSConfig.Clone()
+	if o.TLSCertStore != nil {
+		c.GetCertificate = o.TLSCertStore.GetCertificate
+	}
+	switch o.TLSClientAuth {
+	case ListenerClientAuthVerifyIfGiven:
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	case ListenerClientAuthRequire:
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if o.TLSClientAuth != ListenerClientAuthNone {
+		c.ClientCAs = o.TLSClientCAs
+		if len(o.TLSClientSANs) > 0 {
+			sanRgxs := make([]*regexp.Regexp, 0, len(o.TLSClientSANs))
+			for _, san := range o.TLSClientSANs {
+				sanRgxs = append(sanRgxs, patternToRgx(san))
+			}
+			c.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				if len(verifiedChains) <= 0 {
+					return nil
+				}
+				for _, san := range clientCertSANs(verifiedChains[0][0]) {
+					for _, rgx := range sanRgxs {
+						if rgx.MatchString(strings.ToLower(san)) {
+							return nil
+						}
+					}
+				}
+				return errors.New("client certificate SAN not allowed")
+			}
+		}
+	}
+	if o.HTTP2 {
+		c.NextProtos = []string{http2ALPNProto, "http/1.1"}
+	}
+	if o.TLSMaxVersion != 0 {
+		c.MaxVersion = o.TLSMaxVersion
+	}
+	if len(o.TLSCipherSuites) > 0 {
+		c.CipherSuites = append([]uint16(nil), o.TLSCipherSuites...)
+	}
+	if o.TLSMinVersion != 0 {
+		c.MinVersion = o.TLSMinVersion
+		if o.TLSVersionWarnOnly {
+			c.MinVersion = tls.VersionTLS10
+		}
+		switch {
+		case len(c.CipherSuites) > 0 && !o.TLSVersionWarnOnly:
+			suites := make([]uint16, 0, len(c.CipherSuites))
+			for _, id := range c.CipherSuites {
+				if !isInsecureCipherSuite(id) {
+					suites = append(suites, id)
+				}
+			}
+			c.CipherSuites = suites
+		case len(c.CipherSuites) <= 0:
+			for _, cs := range tls.CipherSuites() {
+				c.CipherSuites = append(c.CipherSuites, cs.ID)
+			}
+			if o.TLSVersionWarnOnly {
+				for _, cs := range tls.InsecureCipherSuites() {
+					c.CipherSuites = append(c.CipherSuites, cs.ID)
+				}
+			}
+		}
+	} else {
+		// newer go versions don't accept tls 1.0, tls 1.1, rsa key exchange and 3des by default
+		if c.MinVersion == 0 {
+			c.MinVersion = tls.VersionTLS10
+		}
+		if len(c.CipherSuites) <= 0 {
+			c.CipherSuites = append([]uint16(nil), tlsGo113CipherSuites...)
+		}
+	}
+	return c
+}
+
+// tlsGo113CipherSuites are the default cipher suites of go 1.13 for tls 1.2 and earlier. Listeners without
+// TLSMinVersion and cipher suites are served with them, as they are before go 1.22.
+var tlsGo113CipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
 }
 
 // Listener implements a network listener
 type Listener struct {
-	opts   ListenerOptions
-	accr   *accepter.Accepter
-	accrMu sync.RWMutex
+	opts      ListenerOptions
+	tlsConfig *tls.Config
+	accr      *accepter.Accepter
+	accrMu    sync.RWMutex
 }
 
 // NewListener creates a new Listener by given options
@@ -45,6 +191,7 @@ func NewListener(opts ListenerOptions) (l *Listener, err error) {
 func (l *Listener) Fork(opts ListenerOptions) (ln *Listener, err error) {
 	ln = &Listener{}
 	ln.opts.CopyFrom(&opts)
+	ln.tlsConfig = ln.opts.tlsServerConfig()
 
 	defer func() {
 		if err == nil {
@@ -74,16 +221,21 @@ func (l *Listener) Fork(opts ListenerOptions) (ln *Listener, err error) {
 	}
 
 	var lis net.Listener
-	lis, err = net.Listen(ln.opts.Network, ln.opts.Address)
+	// keep-alive of accepted connections is set by frontends
+	lc := &net.ListenConfig{KeepAlive: -1}
+	lis, err = lc.Listen(context.Background(), ln.opts.Network, ln.opts.Address)
 	if err != nil {
 		return
 	}
+	ah := &accepterHandler{
+		lis: lis,
+	}
 	ln.accr = &accepter.Accepter{
-		Handler: &accepterHandler{},
+		Handler: ah,
 	}
 
 	go func(lis net.Listener, opts ListenerOptions, accr *accepter.Accepter) {
-		if e := accr.Serve(lis); e != nil {
+		if e := accr.Serve(lis); e != nil && !ah.IsClosed() {
 			xlog.Fatalf("listener %q serve error: %v", opts.Name, e)
 		}
 	}(lis, ln.opts, ln.accr)
@@ -95,12 +247,15 @@ func (l *Listener) Fork(opts ListenerOptions) (ln *Listener, err error) {
 func (l *Listener) Close(ctx context.Context) (err error) {
 	l.accrMu.Lock()
 	if l.accr != nil {
-		if !l.accr.Handler.(*accepterHandler).SetShared(false) {
+		if ah := l.accr.Handler.(*accepterHandler); !ah.SetShared(false) {
+			ah.SetClosed()
 			if ctx == nil {
 				err = l.accr.Close()
 			} else {
 				err = l.accr.Shutdown(ctx)
 			}
+			// accepter can't close the listener if it hasn't started to serve yet
+			ah.lis.Close()
 		}
 		l.accr = nil
 	}
@@ -118,7 +273,115 @@ func (l *Listener) GetOpts() (opts ListenerOptions) {
 func (l *Listener) Activate() {
 	l.accrMu.RLock()
 	if l.accr != nil {
-		l.accr.Handler.(*accepterHandler).Set(l, l.opts.Fe, l.opts.TLSConfig)
+		l.accr.Handler.(*accepterHandler).Set(l, l.opts.Fe, l.tlsConfig)
 	}
 	l.accrMu.RUnlock()
+	if f, ok := l.opts.Fe.(*HTTPFrontend); ok && l.opts.TLSCertStore != nil {
+		f.watchTLSCertStore(l.opts.TLSCertStore)
+	}
+}
+
+// tlsServerNameLabel returns the DNS name of the listener certificates which matches the server name, as the exact name
+// or the wildcard name of its first label. So the label is bounded by the certificates, and it is empty for unknown or
+// missing server names.
+func (l *Listener) tlsServerNameLabel(serverName string) string {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return ""
+	}
+	wildcard := ""
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		wildcard = "*" + name[i:]
+	}
+	var certs []tls.Certificate
+	if l.opts.TLSCertStore != nil {
+		certs = append(certs, l.opts.TLSCertStore.Certificates()...)
+		if acme := l.opts.TLSCertStore.GetOpts().ACME; acme != nil {
+			certs = append(certs, acme.Certificates()...)
+		}
+	}
+	if l.opts.TLSConfig != nil {
+		certs = append(certs, l.opts.TLSConfig.Certificates...)
+	}
+	for _, cert := range certs {
+		leaf := cert.Leaf
+		if leaf == nil {
+			if len(cert.Certificate) <= 0 {
+				continue
+			}
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				continue
+			}
+		}
+		for _, dnsName := range leaf.DNSNames {
+			if dnsName = strings.ToLower(dnsName); dnsName == name || dnsName == wildcard {
+				return dnsName
+			}
+		}
+	}
+	return ""
+}
+
+func (l *Listener) isTLSDeprecated(state *tls.ConnectionState) bool {
+	if l.opts.TLSMinVersion == 0 {
+		return false
+	}
+	return state.Version < l.opts.TLSMinVersion || isInsecureCipherSuite(state.CipherSuite)
+}
+
+// isInsecureCipherSuite reports whether the cipher suite is one of tls.InsecureCipherSuites
+func isInsecureCipherSuite(id uint16) bool {
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// clientCertSANs returns the DNS, email, IP and URI subject alternative names of the client certificate
+func clientCertSANs(cert *x509.Certificate) (sans []string) {
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	return
+}
+
+// setClientCertHeaders replaces the client certificate headers with the subject and the SANs of the verified client
+// certificate, and with its URL-encoded PEM if pemHeader is set. Headers sent by clients are removed, so they can't be
+// spoofed.
+func setClientCertHeaders(hdr http.Header, cert *x509.Certificate, pemHeader bool) {
+	hdr.Del("X-Client-Cert-Subject")
+	hdr.Del("X-Client-Cert-SAN")
+	hdr.Del("X-Client-Cert")
+	if cert == nil {
+		return
+	}
+	hdr.Set("X-Client-Cert-Subject", cert.Subject.String())
+	if sans := clientCertSANs(cert); len(sans) > 0 {
+		hdr.Set("X-Client-Cert-SAN", strings.Join(sans, ", "))
+	}
+	if pemHeader {
+		hdr.Set("X-Client-Cert", url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+	}
 }
@@ -0,0 +1,62 @@
+package lb
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// memBudgetFeatureTap defines the body capture of frontend taps
+	memBudgetFeatureTap = "tap"
+	// memBudgetFeatureCoalesce defines the response buffers of coalesced requests
+	memBudgetFeatureCoalesce = "coalesce"
+	// memBudgetFeatureMirror defines the request body copies of mirrored requests
+	memBudgetFeatureMirror = "mirror"
+)
+
+// memBudget is a non-blocking weighted semaphore which limits the total memory of buffered body data of all
+// frontends and backends. Features which buffer bodies acquire the exact capacity of their buffers before
+// allocating them, and degrade instead of failing the request when the budget is exhausted.
+type memBudget struct {
+	limit int64
+	used  int64
+}
+
+// bufferMemory is the engine-level memory budget of buffered body data
+var bufferMemory memBudget
+
+// SetBufferMemoryLimit sets the total memory limit in bytes of buffered body data, eg captured bodies of taps.
+// Zero or negative means unlimited. Buffers which are already allocated aren't affected.
+func SetBufferMemoryLimit(limit int64) {
+	atomic.StoreInt64(&bufferMemory.limit, limit)
+}
+
+// BufferMemoryUsage returns the total memory in bytes of buffered body data
+func BufferMemoryUsage() int64 {
+	return atomic.LoadInt64(&bufferMemory.used)
+}
+
+// TryAcquire acquires n bytes for given feature. It returns false if it exceeds the limit.
+func (m *memBudget) TryAcquire(feature string, n int64) bool {
+	for {
+		used := atomic.LoadInt64(&m.used)
+		if limit := atomic.LoadInt64(&m.limit); limit > 0 && used+n > limit {
+			promLBBufferMemoryRejectionsTotal.With(prometheus.Labels{"feature": feature}).Inc()
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.used, used, used+n) {
+			promLBBufferMemoryBytes.Add(float64(n))
+			return true
+		}
+	}
+}
+
+// Release releases n bytes which have been acquired
+func (m *memBudget) Release(n int64) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&m.used, -n)
+	promLBBufferMemoryBytes.Sub(float64(n))
+}
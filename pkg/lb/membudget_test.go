@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMemBudget(t *testing.T) {
+	const limit = 256 * 1024
+	m := &memBudget{limit: limit}
+	var maxUsed, acquired, rejected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			held := make([]int64, 0, 64)
+			for j := 0; j < 5000; j++ {
+				if len(held) > 0 && (len(held) >= 64 || rnd.Intn(4) == 0) {
+					k := rnd.Intn(len(held))
+					m.Release(held[k])
+					held[k] = held[len(held)-1]
+					held = held[:len(held)-1]
+					continue
+				}
+				n := int64(1 + rnd.Intn(16*1024))
+				if !m.TryAcquire(memBudgetFeatureTap, n) {
+					atomic.AddInt64(&rejected, 1)
+					continue
+				}
+				atomic.AddInt64(&acquired, 1)
+				held = append(held, n)
+				for used := atomic.LoadInt64(&m.used); ; used = atomic.LoadInt64(&m.used) {
+					old := atomic.LoadInt64(&maxUsed)
+					if used <= old || atomic.CompareAndSwapInt64(&maxUsed, old, used) {
+						break
+					}
+				}
+			}
+			for _, n := range held {
+				m.Release(n)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	if maxUsed > limit {
+		t.Errorf("got max usage %d, want at most %d", maxUsed, limit)
+	}
+	if acquired == 0 || rejected == 0 {
+		t.Errorf("got %d acquisitions and %d rejections, want both", acquired, rejected)
+	}
+	if m.used != 0 {
+		t.Errorf("got usage %d after all released, want 0", m.used)
+	}
+}
@@ -0,0 +1,267 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goinsane/xlog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	httpMirrorDefaultMaxInflight  = 100
+	httpMirrorDefaultMaxBodyBytes = 64 * 1024
+	httpMirrorDefaultTimeout      = 30 * time.Second
+)
+
+var errMirrorBackendUnavailable = errors.New("mirror backend unavailable")
+
+// httpMirror sends copies of the requests of a route to its mirror backend, and discards their responses
+type httpMirror struct {
+	inflight     int64
+	backend      *HTTPBackend
+	backendRef   *httpBackendRef
+	maxInflight  int64
+	maxBodyBytes int
+	timeout      time.Duration
+}
+
+func newHTTPMirror(route *HTTPFrontendRoute) (m *httpMirror, err error) {
+	if route.redirect != nil || route.response != nil {
+		return nil, errors.New("has redirect or response")
+	}
+	opts := &route.Mirror
+	m = &httpMirror{
+		backend:      opts.Backend,
+		maxInflight:  int64(opts.MaxInflight),
+		maxBodyBytes: opts.MaxBodyBytes,
+		timeout:      opts.Timeout,
+	}
+	if m.maxInflight <= 0 {
+		m.maxInflight = httpMirrorDefaultMaxInflight
+	}
+	if m.maxBodyBytes <= 0 {
+		m.maxBodyBytes = httpMirrorDefaultMaxBodyBytes
+	}
+	if m.timeout <= 0 {
+		m.timeout = httpMirrorDefaultTimeout
+	}
+	if opts.BackendName != "" {
+		if opts.Backend != nil {
+			return nil, fmt.Errorf("has both backend and backend name %q", opts.BackendName)
+		}
+		m.backendRef, err = httpBackends.Resolve(opts.BackendName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Backend returns the mirror backend, or nil if the referred one isn't active
+func (m *httpMirror) Backend() *HTTPBackend {
+	if m.backendRef != nil {
+		return m.backendRef.Get()
+	}
+	return m.backend
+}
+
+// TryAcquire acquires an in-flight slot. It returns false if all slots are in use.
+func (m *httpMirror) TryAcquire() bool {
+	if atomic.AddInt64(&m.inflight, 1) > m.maxInflight {
+		atomic.AddInt64(&m.inflight, -1)
+		return false
+	}
+	return true
+}
+
+// Release releases an in-flight slot which has been acquired
+func (m *httpMirror) Release() {
+	atomic.AddInt64(&m.inflight, -1)
+}
+
+// httpMirrorRecord captures a request sent to backend to mirror it. The body buffer is allocated with its maximum size
+// from the buffer memory when the request is set.
+type httpMirrorRecord struct {
+	m          *httpMirror
+	promTotal  *prometheus.CounterVec
+	statusLine string
+	hdr        http.Header
+	body       []byte
+	dropped    bool
+	complete   bool
+}
+
+// newHTTPMirrorRecord returns a record which mirrors the request by m, or nil if the request is dropped
+func (f *HTTPFrontend) newHTTPMirrorRecord(reqDesc *httpReqDesc, m *httpMirror) *httpMirrorRecord {
+	promTotal := f.promMirrorRequestsTotal.MustCurryWith(prometheus.Labels{
+		"host":     reqDesc.feHost,
+		"path":     reqDesc.fePath,
+		"listener": reqDesc.leName,
+	})
+	if !m.TryAcquire() {
+		promTotal.With(prometheus.Labels{"result": "dropped"}).Inc()
+		return nil
+	}
+	return &httpMirrorRecord{
+		m:         m,
+		promTotal: promTotal,
+	}
+}
+
+// SetRequest sets the request which is sent to backend. The body which has been captured for a previous backend is
+// discarded.
+func (r *httpMirrorRecord) SetRequest(statusLine string, hdr http.Header) {
+	r.statusLine = statusLine
+	r.hdr = hdr.Clone()
+	r.body = r.body[:0]
+	r.complete = false
+}
+
+// RequestBodyWriter returns a writer which passes writes to w and captures them as request body
+func (r *httpMirrorRecord) RequestBodyWriter(w io.Writer) io.Writer {
+	return &mirrorWriter{W: w, R: r}
+}
+
+// Complete marks the request as sent to backend with its whole body
+func (r *httpMirrorRecord) Complete() {
+	r.complete = !r.dropped
+}
+
+// finishHTTPMirrorRecord sends the captured request to the mirror backend asynchronously, by the context of the
+// frontend. Requests which haven't been sent to backend completely, or whose body couldn't be captured, are dropped.
+func (f *HTTPFrontend) finishHTTPMirrorRecord(reqDesc *httpReqDesc, r *httpMirrorRecord) {
+	if !r.complete {
+		r.promTotal.With(prometheus.Labels{"result": "dropped"}).Inc()
+		r.release()
+		return
+	}
+	b := r.m.Backend()
+	var bs *backendServer
+	proxyHeader := ""
+	if b != nil {
+		bs = b.findServer(reqDesc)
+		proxyHeader = b.proxyProtocolHeader(reqDesc)
+	}
+	proxyCtx := reqDesc.feConnCtx
+	summary := reqDesc.FrontendSummary()
+	go func() {
+		defer r.release()
+		ctx, ctxCancel := context.WithTimeout(f.ctx, r.m.timeout)
+		defer ctxCancel()
+		var err error
+		switch {
+		case b == nil:
+			err = errMirrorBackendUnavailable
+		case bs == nil:
+			err = errHTTPBackendFind
+		default:
+			err = b.mirrorRequest(ctx, bs, proxyHeader, proxyCtx, r.statusLine, r.hdr, r.body)
+		}
+		if err != nil {
+			r.promTotal.With(prometheus.Labels{"result": "error"}).Inc()
+			xlog.V(100).Debugf("mirror error on %s: %v", summary, err)
+			return
+		}
+		r.promTotal.With(prometheus.Labels{"result": "ok"}).Inc()
+	}()
+}
+
+func (r *httpMirrorRecord) release() {
+	bufferMemory.Release(int64(cap(r.body)))
+	r.body = nil
+	r.m.Release()
+}
+
+// mirrorWriter is a writer which captures the request body of a mirror record
+type mirrorWriter struct {
+	W io.Writer
+	R *httpMirrorRecord
+}
+
+func (mw *mirrorWriter) Write(p []byte) (n int, err error) {
+	n, err = mw.W.Write(p)
+	r := mw.R
+	if r.dropped || n <= 0 {
+		return
+	}
+	if r.body == nil {
+		if !bufferMemory.TryAcquire(memBudgetFeatureMirror, int64(r.m.maxBodyBytes)) {
+			r.dropped = true
+			return
+		}
+		r.body = make([]byte, 0, r.m.maxBodyBytes)
+	}
+	if len(r.body)+n > cap(r.body) {
+		r.dropped = true
+		return
+	}
+	r.body = append(r.body, p[:n]...)
+	return
+}
+
+func (mw *mirrorWriter) Flush() error {
+	if wr, ok := mw.W.(flusher); ok {
+		return wr.Flush()
+	}
+	return nil
+}
+
+// mirrorRequest sends the request to the server of the backend, and discards its response. The request doesn't pass
+// through admission or metrics of the backend.
+func (b *HTTPBackend) mirrorRequest(ctx context.Context, bs *backendServer, proxyHeader string, proxyCtx context.Context, statusLine string, hdr http.Header, body []byte) (err error) {
+	atomic.AddInt64(&b.connCount, 1)
+	defer atomic.AddInt64(&b.connCount, -1)
+
+	connectCtx := ctx
+	if b.opts.ConnectTimeout > 0 {
+		var connectCtxCancel context.CancelFunc
+		connectCtx, connectCtxCancel = context.WithTimeout(ctx, b.opts.ConnectTimeout)
+		defer connectCtxCancel()
+	}
+	bc, err := bs.ConnAcquire(connectCtx, proxyHeader, proxyCtx)
+	if err != nil {
+		return newfHTTPError(httpErrGroupBackendConnect, "could not connect to mirror backend server %q: %w", bs.server, err)
+	}
+	keepAlive := false
+	defer func() {
+		if !keepAlive || (b.opts.ServerMaxIdleConn > 0 && bs.idleConnCount >= int64(b.opts.ServerMaxIdleConn)) {
+			bc.Close()
+		}
+		bc.Stats()
+		bs.ConnRelease(bc)
+	}()
+	// the read of this connection can't be interrupted otherwise
+	if deadline, ok := ctx.Deadline(); ok {
+		bc.SetDeadline(deadline)
+	}
+
+	if _, err = writeHTTPHeader(bc.Writer, statusLine, hdr, nil, false); err != nil {
+		return wrapHTTPError(httpErrGroupBackendCommunication, err)
+	}
+	bc.Writer.Write(body)
+	if err = bc.Flush(); err != nil {
+		return wrapHTTPError(httpErrGroupBackendCommunication, err)
+	}
+
+	method := strings.SplitN(statusLine, " ", 2)[0]
+	resp, err := http.ReadResponse(bc.Reader, &http.Request{Method: method})
+	if err != nil {
+		return wrapHTTPError(httpErrGroupBackendCommunication, err)
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return wrapHTTPError(httpErrGroupBackendCommunication, err)
+	}
+	bc.SetDeadline(time.Time{})
+	keepAlive = !resp.Close && strings.EqualFold(resp.Header.Get("Connection"), "keep-alive")
+	return
+}
@@ -0,0 +1,127 @@
+package lb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendMirror(t *testing.T) {
+	type mirrored struct {
+		uri, forwardedFor, body string
+	}
+	mirroredCh := make(chan mirrored, 8)
+	unblockCh := make(chan struct{})
+	mirror, mirrorCloser := newTestHTTPBackend(t, "mirror-shadow", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-unblockCh
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mirroredCh <- mirrored{r.RequestURI, r.Header.Get("X-Forwarded-For"), string(body)}
+		w.Write([]byte("mirror"))
+	})
+	defer mirrorCloser()
+	b, closer := newTestHTTPBackend(t, "mirror-primary", func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("primary"))
+	})
+	defer closer()
+
+	route := HTTPFrontendRoute{Path: "/*", Backend: b}
+	route.Mirror.BackendName = "mirror-shadow"
+	route.Mirror.MaxInflight = 1
+	route.Mirror.MaxBodyBytes = 8
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:    "mirror",
+		Timeout: 200 * time.Millisecond,
+		Routes:  []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	counter := func(result string) float64 {
+		return testCounterSum(promHTTPFrontendMirrorRequestsTotal, prometheus.Labels{"frontend": "mirror", "result": result})
+	}
+	waitCounter := func(result string, want float64) {
+		n := counter(result)
+		for i := 0; i < 50 && n < want; i++ {
+			time.Sleep(10 * time.Millisecond)
+			n = counter(result)
+		}
+		if n != want {
+			t.Errorf("got %v mirror requests with result %q, want %v", n, result, want)
+		}
+	}
+	baseOK, baseDropped := counter("ok"), counter("dropped")
+
+	// the mirror gets the request with its body, as it is sent to the primary backend
+	resp, body := doTestRequestOnce(t, fLis, "POST /a?b=c HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody")
+	if resp.StatusCode != http.StatusOK || body != "primary" {
+		t.Fatalf("got %d body %q, want 200 body %q", resp.StatusCode, body, "primary")
+	}
+	select {
+	case m := <-mirroredCh:
+		if m.uri != "/a?b=c" || m.forwardedFor != "127.0.0.1" || m.body != "body" {
+			t.Errorf("got mirrored request %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request isn't mirrored")
+	}
+	waitCounter("ok", baseOK+1)
+
+	// a slow mirror doesn't delay the client, even beyond the frontend timeout
+	startTime := time.Now()
+	resp, _ = doTestRequestOnce(t, fLis, "GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || time.Since(startTime) >= f.GetOpts().Timeout {
+		t.Errorf("got %d after %v, want 200 without delay", resp.StatusCode, time.Since(startTime))
+	}
+
+	// requests beyond the in-flight limit, or with a larger body than the limit, aren't mirrored
+	if resp, _ := doTestRequestOnce(t, fLis, "GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want 200", resp.StatusCode)
+	}
+	waitCounter("dropped", baseDropped+1)
+	time.Sleep(2 * f.GetOpts().Timeout)
+	close(unblockCh)
+	select {
+	case m := <-mirroredCh:
+		if m.uri != "/slow" {
+			t.Errorf("got mirrored request %+v, want /slow", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request isn't mirrored")
+	}
+	waitCounter("ok", baseOK+2)
+	resp, _ = doTestRequestOnce(t, fLis, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 9\r\n\r\ntoo large")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want 200", resp.StatusCode)
+	}
+	waitCounter("dropped", baseDropped+2)
+	select {
+	case m := <-mirroredCh:
+		t.Errorf("got unexpected mirrored request %+v", m)
+	default:
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(route *HTTPFrontendRoute)
+	}{
+		{"both mirror backend and backend name", func(route *HTTPFrontendRoute) { route.Mirror.Backend = mirror }},
+		{"unknown mirror backend", func(route *HTTPFrontendRoute) { route.Mirror.BackendName = "mirror-unknown" }},
+		{"both mirror and redirect", func(route *HTTPFrontendRoute) { route.Backend, route.Redirect.Location = nil, "/" }},
+	} {
+		badRoute := route
+		tc.modify(&badRoute)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "mirror", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
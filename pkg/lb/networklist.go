@@ -0,0 +1,122 @@
+package lb
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ipTrieNode is a node of the binary trie of an IP version. Every node is a prefix of its length in bits.
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	terminal bool
+}
+
+// ipTrie is a binary trie of IP networks, separately for IPv4 and IPv6. Lookups are bounded by the address length,
+// regardless of the count of networks.
+type ipTrie struct {
+	v4, v6 ipTrieNode
+	count  int
+}
+
+// Add adds the network to the trie. Networks which are contained by an added network don't make a difference.
+func (t *ipTrie) Add(network *net.IPNet) {
+	node, ip := &t.v6, network.IP.To16()
+	if len(network.Mask) == net.IPv4len {
+		node, ip = &t.v4, network.IP.To4()
+	}
+	ones, _ := network.Mask.Size()
+	for i := 0; i < ones && !node.terminal; i++ {
+		bit := ip[i/8] >> uint(7-i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	if !node.terminal {
+		node.terminal = true
+		// the networks contained by this one aren't needed anymore
+		node.children = [2]*ipTrieNode{}
+	}
+	t.count++
+}
+
+// Contains reports whether ip is contained by any network of the trie
+func (t *ipTrie) Contains(ip net.IP) bool {
+	node := &t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		node, ip = &t.v4, ip4
+	} else if ip = ip.To16(); ip == nil {
+		return false
+	}
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i >= len(ip)*8 {
+			return false
+		}
+		node = node.children[ip[i/8]>>uint(7-i%8)&1]
+	}
+	return false
+}
+
+// parseNetworkList parses a network list which has a CIDR or an IP address per line. Empty lines and comments which
+// start with "#" are ignored.
+func parseNetworkList(f *os.File) (t *ipTrie, err error) {
+	t = &ipTrie{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var network *net.IPNet
+		if strings.IndexByte(line, '/') >= 0 {
+			if _, network, err = net.ParseCIDR(line); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+		} else {
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid IP address %q", n, line)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		t.Add(network)
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// httpNetworkList is a network list which is loaded from a watched file
+type httpNetworkList struct {
+	*watchedFile
+}
+
+// newHTTPNetworkList loads the network list from the file
+func newHTTPNetworkList(path string) (l *httpNetworkList, err error) {
+	w, err := newWatchedFile(path, "network list", func(f *os.File) (interface{}, error) {
+		return parseNetworkList(f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &httpNetworkList{w}, nil
+}
+
+// Contains reports whether ip is contained by any network of the list
+func (l *httpNetworkList) Contains(ip net.IP) bool {
+	return l.Load().(*ipTrie).Contains(ip)
+}
@@ -0,0 +1,128 @@
+package lb
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIPTrie(t *testing.T) {
+	trie := &ipTrie{}
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.128/25", "192.168.1.0/24", "203.0.113.7/32", "2001:db8::/32", "0.0.0.0/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trie.Add(network)
+	}
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.200", true},
+		{"192.168.2.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"0.0.0.0", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"::", false},
+	} {
+		if got := trie.Contains(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("ip %s: got contained %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+	if trie.Contains(nil) {
+		t.Error("nil ip is contained")
+	}
+
+	// a feed of tens of thousands of networks
+	large := &ipTrie{}
+	for i := 0; i < 40000; i++ {
+		large.Add(&net.IPNet{IP: net.IPv4(100, byte(i>>8), byte(i), 0).To4(), Mask: net.CIDRMask(24, 32)})
+	}
+	if !large.Contains(net.ParseIP("100.156.63.9")) || large.Contains(net.ParseIP("100.156.64.9")) {
+		t.Error("got wrong lookup on large trie")
+	}
+}
+
+func TestHTTPFrontendNetworkListFile(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "networklist", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	file, err := ioutil.TempFile("", "networklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	modTime := time.Now()
+	writeList := func(content string) {
+		if err := ioutil.WriteFile(file.Name(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the modification time changes even if the file is written in the same tick
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(file.Name(), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeList("# deny list\n\n127.0.0.0/8 # local\n2001:db8::1\n")
+
+	route := HTTPFrontendRoute{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{{NetworkListFile: file.Name()}}}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "networklist",
+		Routes: []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	waitCode := func(code int) {
+		var got int
+		for i := 0; i < 60 && got != code; i++ {
+			if i > 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			got = resp.StatusCode
+		}
+		if got != code {
+			t.Fatalf("got %d, want %d", got, code)
+		}
+	}
+	waitCode(http.StatusForbidden)
+
+	// the changed file is reloaded by the worker
+	writeList("10.0.0.0/8\n")
+	waitCode(http.StatusOK)
+
+	// a broken file doesn't replace the list in use
+	writeList("127.0.0.0/8\nbroken\n")
+	time.Sleep(2 * watchedFileCheckInterval)
+	waitCode(http.StatusOK)
+
+	for _, content := range []string{"10.0.0.0/33\n", "not an ip\n"} {
+		writeList(content)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "networklist", Routes: []HTTPFrontendRoute{route}}); err == nil {
+			t.Errorf("network list %q: expected error", content)
+		}
+	}
+	missing := route
+	missing.Restrictions = []HTTPFrontendRestriction{{NetworkListFile: file.Name() + ".missing"}}
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "networklist", Routes: []HTTPFrontendRoute{missing}}); err == nil {
+		t.Error("missing network list file: expected error")
+	}
+}
@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/goinsane/xlog"
+)
+
+// newHTTPBackendOverrides returns the allowed override backends of the options by name
+func newHTTPBackendOverrides(opts *HTTPFrontendOptions) (backends map[string]*HTTPBackend, err error) {
+	if opts.OverrideHeader == "" {
+		if len(opts.OverrideBackends) > 0 || len(opts.OverrideNetworks) > 0 {
+			return nil, errors.New("override backends or networks without override header")
+		}
+		return nil, nil
+	}
+	if strings.IndexFunc(opts.OverrideHeader, isNotToken) >= 0 {
+		return nil, fmt.Errorf("override header %q invalid", opts.OverrideHeader)
+	}
+	// the override is honored only for the allowed backends and networks, so both of them must be given
+	if len(opts.OverrideBackends) == 0 || len(opts.OverrideNetworks) == 0 {
+		return nil, errors.New("override header without override backends and networks")
+	}
+	backends = make(map[string]*HTTPBackend, len(opts.OverrideBackends))
+	for _, b := range opts.OverrideBackends {
+		if b == nil {
+			return nil, errors.New("override backend nil")
+		}
+		backends[b.opts.Name] = b
+	}
+	return backends, nil
+}
+
+// overrideBackend strips the override header of the request, and returns the backend which it names if the backend
+// is allowed and the client is in an allowed network. It returns nil if the override isn't honored.
+func (f *HTTPFrontend) overrideBackend(reqDesc *httpReqDesc) *HTTPBackend {
+	opts := f.options()
+	if opts.overrideHeader == "" {
+		return nil
+	}
+	name := strings.TrimSpace(reqDesc.feHdr.Get(opts.overrideHeader))
+	reqDesc.feHdr.Del(opts.overrideHeader)
+	if name == "" {
+		return nil
+	}
+	b, ok := opts.overrideBackends[name]
+	if ok && reqDesc.feClientIP != nil {
+		for _, network := range opts.OverrideNetworks {
+			if network.Contains(reqDesc.feClientIP) {
+				return b
+			}
+		}
+	}
+	xlog.V(100).Debugf("backend override %q denied on %s", name, reqDesc.FrontendSummary())
+	return nil
+}
@@ -0,0 +1,91 @@
+package lb
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPFrontendBackendOverride(t *testing.T) {
+	newBackend := func(name string) (*HTTPBackend, func()) {
+		return newTestHTTPBackend(t, name, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + "|" + r.Header.Get("X-Simult-Backend")))
+		})
+	}
+	app, closer := newBackend("app")
+	defer closer()
+	staging, closer := newBackend("app-staging")
+	defer closer()
+
+	// the test client is in the local network
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	opts := HTTPFrontendOptions{
+		Name:             "override",
+		DefaultBackend:   app,
+		OverrideHeader:   "x-simult-backend",
+		OverrideBackends: []*HTTPBackend{staging},
+		OverrideNetworks: []*net.IPNet{local},
+		Routes: []HTTPFrontendRoute{
+			{Path: "/api/*", Backend: app},
+			{Path: "/denied/*", Backend: app, Restrictions: []HTTPFrontendRestriction{{Network: local}}},
+		},
+	}
+	check := func(name string, f *HTTPFrontend, header, path string, code int, body string) {
+		fLis := runTestFrontend(t, f)
+		defer fLis.Close()
+		req := "GET " + path + " HTTP/1.1\r\nHost: example.com\r\n"
+		if header != "" {
+			req += "X-Simult-Backend: " + header + "\r\n"
+		}
+		resp, got := doTestRequestOnce(t, fLis, req+"\r\n")
+		if resp.StatusCode != code || (code == http.StatusOK && got != body) {
+			t.Errorf("%s: got %d %q, want %d %q", name, resp.StatusCode, got, code, body)
+		}
+	}
+
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	check("without header", f, "", "/api/x", http.StatusOK, "app|")
+	check("allowed backend", f, "app-staging", "/api/x", http.StatusOK, "app-staging|")
+	check("allowed backend of default backend", f, " app-staging ", "/x", http.StatusOK, "app-staging|")
+	check("other backend", f, "other", "/api/x", http.StatusOK, "app|")
+	check("restricted", f, "app-staging", "/denied/x", http.StatusForbidden, "")
+
+	notAllowed := opts
+	notAllowed.OverrideNetworks = []*net.IPNet{internal}
+	fn, err := f.Fork(notAllowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fn.Close()
+	check("other network", fn, "app-staging", "/api/x", http.StatusOK, "app|")
+
+	// the header is forwarded if the override isn't configured
+	disabled := opts
+	disabled.OverrideHeader, disabled.OverrideBackends, disabled.OverrideNetworks = "", nil, nil
+	if fn, err = f.Fork(disabled); err != nil {
+		t.Fatal(err)
+	}
+	defer fn.Close()
+	check("disabled", fn, "app-staging", "/api/x", http.StatusOK, "app|app-staging")
+
+	for _, tc := range []struct {
+		name   string
+		modify func(opts *HTTPFrontendOptions)
+	}{
+		{"invalid header", func(opts *HTTPFrontendOptions) { opts.OverrideHeader = "X Backend" }},
+		{"without backends", func(opts *HTTPFrontendOptions) { opts.OverrideBackends = nil }},
+		{"without networks", func(opts *HTTPFrontendOptions) { opts.OverrideNetworks = nil }},
+		{"without header", func(opts *HTTPFrontendOptions) { opts.OverrideHeader = "" }},
+	} {
+		badOpts := opts
+		tc.modify(&badOpts)
+		if _, err := f.Fork(badOpts); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
@@ -6,33 +6,71 @@ import (
 	"github.com/goinsane/xmath"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
-	promInitialized                        uint32
-	promHTTPFrontendReadBytes              *prometheus.CounterVec
-	promHTTPFrontendWriteBytes             *prometheus.CounterVec
-	promHTTPFrontendRequestsTotal          *prometheus.CounterVec
-	promHTTPFrontendRequestDurationSeconds *prometheus.HistogramVec
-	promHTTPFrontendConnectionsTotal       *prometheus.CounterVec
-	promHTTPFrontendActiveConnections      *prometheus.GaugeVec
-	promHTTPFrontendIdleConnections        *prometheus.GaugeVec
-	promHTTPFrontendWaitingConnections     *prometheus.GaugeVec
-	promHTTPBackendReadBytes               *prometheus.CounterVec
-	promHTTPBackendWriteBytes              *prometheus.CounterVec
-	promHTTPBackendRequestsTotal           *prometheus.CounterVec
-	promHTTPBackendRequestDurationSeconds  *prometheus.HistogramVec
-	promHTTPBackendTimeToFirstByteSeconds  *prometheus.HistogramVec
-	promHTTPBackendActiveConnections       *prometheus.GaugeVec
-	promHTTPBackendIdleConnections         *prometheus.GaugeVec
-	promHTTPBackendServerHealth            *prometheus.GaugeVec
+	promInitialized                            uint32
+	promHTTPFrontendReadBytes                  *prometheus.CounterVec
+	promHTTPFrontendWriteBytes                 *prometheus.CounterVec
+	promHTTPFrontendRequestsTotal              *prometheus.CounterVec
+	promHTTPFrontendRequestDurationSeconds     *prometheus.HistogramVec
+	promHTTPFrontendProfileDurationSeconds     map[string]*prometheus.HistogramVec
+	promHTTPFrontendConnectionsTotal           *prometheus.CounterVec
+	promHTTPFrontendActiveConnections          *prometheus.GaugeVec
+	promHTTPFrontendIdleConnections            *prometheus.GaugeVec
+	promHTTPFrontendWaitingConnections         *prometheus.GaugeVec
+	promHTTPFrontendDeprecatedTLSConnTotal     *prometheus.CounterVec
+	promHTTPFrontendTLSHandshakeErrorsTotal    *prometheus.CounterVec
+	promHTTPFrontendThrottledBytes             *prometheus.CounterVec
+	promHTTPFrontendThrottledSeconds           *prometheus.CounterVec
+	promHTTPFrontendDrainedConnTotal           *prometheus.CounterVec
+	promHTTPFrontendAuthHookTotal              *prometheus.CounterVec
+	promHTTPFrontendForwardAuthTotal           *prometheus.CounterVec
+	promHTTPFrontendForwardAuthDurationSeconds *prometheus.HistogramVec
+	promHTTPFrontendCoalescedRequestsTotal     *prometheus.CounterVec
+	promHTTPFrontendStampedesPrevented         *prometheus.CounterVec
+	promHTTPFrontendReclaimedConnTotal         *prometheus.CounterVec
+	promHTTPFrontendMirrorRequestsTotal        *prometheus.CounterVec
+	promHTTPFrontendInflightRequests           *prometheus.GaugeVec
+	promHTTPBackendReadBytes                   *prometheus.CounterVec
+	promHTTPBackendWriteBytes                  *prometheus.CounterVec
+	promHTTPBackendRequestsTotal               *prometheus.CounterVec
+	promHTTPBackendRequestDurationSeconds      *prometheus.HistogramVec
+	promHTTPBackendTimeToFirstByteSeconds      *prometheus.HistogramVec
+	promHTTPBackendActiveConnections           *prometheus.GaugeVec
+	promHTTPBackendIdleConnections             *prometheus.GaugeVec
+	promHTTPBackendOutstandingBytes            *prometheus.GaugeVec
+	promHTTPBackendStatusMappedTotal           *prometheus.CounterVec
+	promHTTPBackendServerHealth                *prometheus.GaugeVec
+	promHTTPBackendQueueTimeoutTotal           *prometheus.CounterVec
+	promHTTPBackendQueueClientAbortTotal       *prometheus.CounterVec
+	promHTTPBackendShedTotal                   *prometheus.CounterVec
+	promLBConfigInfo                           *prometheus.GaugeVec
+	promLBConfigLastReloadTimestampSeconds     prometheus.Gauge
+	promLBConfigReloadTotal                    *prometheus.CounterVec
+	promLBConfigFrontends                      prometheus.Gauge
+	promLBConfigRoutes                         prometheus.Gauge
+	promLBConfigBackends                       prometheus.Gauge
+	promLBConfigServers                        prometheus.Gauge
+	promLBBufferMemoryBytes                    prometheus.Gauge
+	promLBBufferMemoryRejectionsTotal          *prometheus.CounterVec
+	promLBReloadInflightRequestsTotal          *prometheus.CounterVec
 )
 
-// PromInitialize initializes prometheus metrics with given namespace. If metrics is initialized, it panics.
-func PromInitialize(namespace string) {
+// PromOptions holds prometheus metrics options
+type PromOptions struct {
+	Namespace      string
+	BucketProfiles map[string][]float64
+}
+
+// PromInitialize initializes prometheus metrics with given options. If metrics is initialized, it panics.
+// Every bucket profile has its own request duration histogram, and its buckets must be in increasing order.
+func PromInitialize(opts PromOptions) {
 	if !atomic.CompareAndSwapUint32(&promInitialized, 0, 1) {
 		panic("prometheus already set")
 	}
+	namespace := opts.Namespace
 
 	histogramBuckets := prometheus.LinearBuckets(0.05, 0.05, 20)
 	for i := range histogramBuckets {
@@ -57,7 +95,7 @@ func PromInitialize(namespace string) {
 		Namespace: namespace,
 		Subsystem: "http_frontend",
 		Name:      "requests_total",
-	}, []string{"frontend", "host", "path", "method", "backend", "server", "code", "listener", "error"})
+	}, []string{"frontend", "host", "path", "method", "backend", "server", "code", "listener", "error", "class"})
 
 	promHTTPFrontendRequestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: namespace,
@@ -66,6 +104,17 @@ func PromInitialize(namespace string) {
 		Buckets:   histogramBuckets,
 	}, []string{"frontend", "host", "path", "method", "backend", "server", "code", "listener"})
 
+	promHTTPFrontendProfileDurationSeconds = make(map[string]*prometheus.HistogramVec, len(opts.BucketProfiles))
+	for profile, buckets := range opts.BucketProfiles {
+		promHTTPFrontendProfileDurationSeconds[profile] = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   "http_frontend",
+			Name:        "profile_request_duration_seconds",
+			ConstLabels: prometheus.Labels{"profile": profile},
+			Buckets:     buckets,
+		}, []string{"frontend", "host", "path", "method", "backend", "server", "code", "listener"})
+	}
+
 	promHTTPFrontendConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: "http_frontend",
@@ -90,6 +139,85 @@ func PromInitialize(namespace string) {
 		Name:      "waiting_connections",
 	}, []string{"frontend", "listener"})
 
+	promHTTPFrontendDeprecatedTLSConnTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "deprecated_tls_connections_total",
+	}, []string{"frontend", "listener", "version", "cipher", "sni"})
+
+	promHTTPFrontendTLSHandshakeErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "tls_handshake_errors_total",
+	}, []string{"frontend", "listener", "reason"})
+
+	promHTTPFrontendThrottledBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "throttled_bytes",
+	}, []string{"frontend", "host", "path", "listener"})
+
+	promHTTPFrontendThrottledSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "throttled_seconds",
+	}, []string{"frontend", "host", "path", "listener"})
+
+	promHTTPFrontendDrainedConnTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "drained_connections_total",
+	}, []string{"frontend", "listener", "close"})
+
+	promHTTPFrontendAuthHookTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "auth_hook_total",
+	}, []string{"frontend", "host", "path", "listener", "result"})
+
+	promHTTPFrontendForwardAuthTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "forward_auth_total",
+	}, []string{"frontend", "host", "path", "listener", "result"})
+
+	promHTTPFrontendForwardAuthDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "forward_auth_duration_seconds",
+		Buckets:   histogramBuckets,
+	}, []string{"frontend", "host", "path", "listener"})
+
+	promHTTPFrontendCoalescedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "coalesced_requests_total",
+	}, []string{"frontend", "host", "path", "listener"})
+
+	promHTTPFrontendStampedesPrevented = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "stampedes_prevented_total",
+	}, []string{"frontend", "host", "path", "listener"})
+
+	promHTTPFrontendReclaimedConnTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "reclaimed_connections_total",
+	}, []string{"frontend", "listener"})
+
+	promHTTPFrontendMirrorRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "mirror_requests_total",
+	}, []string{"frontend", "host", "path", "listener", "result"})
+
+	promHTTPFrontendInflightRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "http_frontend",
+		Name:      "inflight_requests",
+	}, []string{"frontend", "host", "path", "listener"})
+
 	promHTTPBackendReadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: "http_backend",
@@ -120,7 +248,31 @@ func PromInitialize(namespace string) {
 		Subsystem: "http_backend",
 		Name:      "time_to_first_byte_seconds",
 		Buckets:   histogramBuckets,
-	}, []string{"backend", "server", "code", "frontend", "host", "path", "method", "listener"})
+	}, []string{"backend", "server", "code", "frontend", "host", "path", "method", "listener", "response"})
+
+	promHTTPBackendStatusMappedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_backend",
+		Name:      "status_mapped_total",
+	}, []string{"backend", "server", "code", "origcode", "frontend", "host", "path", "method", "listener"})
+
+	promHTTPBackendQueueTimeoutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_backend",
+		Name:      "queue_timeout_total",
+	}, []string{"backend", "frontend", "host", "path", "method", "listener"})
+
+	promHTTPBackendQueueClientAbortTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_backend",
+		Name:      "queue_client_abort_total",
+	}, []string{"backend", "frontend", "host", "path", "method", "listener"})
+
+	promHTTPBackendShedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http_backend",
+		Name:      "shed_total",
+	}, []string{"backend", "frontend", "host", "path", "method", "listener"})
 
 	promHTTPBackendActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -134,11 +286,103 @@ func PromInitialize(namespace string) {
 		Name:      "idle_connections",
 	}, []string{"backend", "server"})
 
+	promHTTPBackendOutstandingBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "http_backend",
+		Name:      "outstanding_bytes",
+	}, []string{"backend", "server"})
+
 	promHTTPBackendServerHealth = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "http_backend",
 		Name:      "server_health",
 	}, []string{"backend", "server"})
+
+	promLBConfigInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "config_info",
+	}, []string{"hash"})
+
+	promLBConfigLastReloadTimestampSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "config_last_reload_timestamp_seconds",
+	})
+
+	promLBConfigReloadTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "config_reload_total",
+	}, []string{"result"})
+
+	promLBConfigFrontends = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "config_frontends",
+	})
+
+	promLBConfigRoutes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "config_routes",
+	})
+
+	promLBConfigBackends = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "config_backends",
+	})
+
+	promLBConfigServers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "config_servers",
+	})
+
+	promLBBufferMemoryBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "buffer_memory_bytes",
+	})
+
+	promLBBufferMemoryRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "buffer_memory_rejections_total",
+	}, []string{"feature"})
+
+	promLBReloadInflightRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "reload_inflight_requests_total",
+	}, []string{"outcome"})
+}
+
+// PromConfigInfo describes an active configuration for config metrics
+type PromConfigInfo struct {
+	Hash      string
+	Frontends int
+	Routes    int
+	Backends  int
+	Servers   int
+}
+
+// PromConfigReloaded updates config metrics after a configuration reload. info is nil if the reload has failed,
+// otherwise it describes the new active configuration.
+func PromConfigReloaded(info *PromConfigInfo) {
+	if info == nil {
+		promLBConfigReloadTotal.With(prometheus.Labels{"result": "failure"}).Inc()
+		return
+	}
+	promLBConfigReloadTotal.With(prometheus.Labels{"result": "success"}).Inc()
+	promLBConfigLastReloadTimestampSeconds.SetToCurrentTime()
+	promLBConfigInfo.Reset()
+	promLBConfigInfo.With(prometheus.Labels{"hash": info.Hash}).Set(1)
+	promLBConfigFrontends.Set(float64(info.Frontends))
+	promLBConfigRoutes.Set(float64(info.Routes))
+	promLBConfigBackends.Set(float64(info.Backends))
+	promLBConfigServers.Set(float64(info.Servers))
 }
 
 // PromReset resets prometheus metrics other than gauge metrics
@@ -147,16 +391,112 @@ func PromReset() {
 	promHTTPFrontendWriteBytes.Reset()
 	promHTTPFrontendRequestsTotal.Reset()
 	promHTTPFrontendRequestDurationSeconds.Reset()
+	for _, vec := range promHTTPFrontendProfileDurationSeconds {
+		vec.Reset()
+	}
 	promHTTPFrontendConnectionsTotal.Reset()
 	//promHTTPFrontendActiveConnections.Reset()
 	//promHTTPFrontendIdleConnections.Reset()
 	//promHTTPFrontendWaitingConnections.Reset()
+	promHTTPFrontendDeprecatedTLSConnTotal.Reset()
+	promHTTPFrontendTLSHandshakeErrorsTotal.Reset()
+	promHTTPFrontendThrottledBytes.Reset()
+	promHTTPFrontendThrottledSeconds.Reset()
+	promHTTPFrontendDrainedConnTotal.Reset()
+	promHTTPFrontendAuthHookTotal.Reset()
+	promHTTPFrontendForwardAuthTotal.Reset()
+	promHTTPFrontendForwardAuthDurationSeconds.Reset()
+	promHTTPFrontendCoalescedRequestsTotal.Reset()
+	promHTTPFrontendStampedesPrevented.Reset()
+	promHTTPFrontendReclaimedConnTotal.Reset()
+	promHTTPFrontendMirrorRequestsTotal.Reset()
+	//promHTTPFrontendInflightRequests.Reset()
 	promHTTPBackendReadBytes.Reset()
 	promHTTPBackendWriteBytes.Reset()
 	promHTTPBackendRequestsTotal.Reset()
 	promHTTPBackendRequestDurationSeconds.Reset()
 	promHTTPBackendTimeToFirstByteSeconds.Reset()
+	promHTTPBackendStatusMappedTotal.Reset()
 	promHTTPBackendActiveConnections.Reset()
 	promHTTPBackendIdleConnections.Reset()
+	promHTTPBackendOutstandingBytes.Reset()
 	promHTTPBackendServerHealth.Reset()
+	promHTTPBackendQueueTimeoutTotal.Reset()
+	promHTTPBackendQueueClientAbortTotal.Reset()
+	promHTTPBackendShedTotal.Reset()
+	promLBBufferMemoryRejectionsTotal.Reset()
+	promLBReloadInflightRequestsTotal.Reset()
+}
+
+// promDeleter is a metric vector whose series can be deleted by their label values
+type promDeleter interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+}
+
+// promDeletePartialMatch deletes the series of given metric vectors which have all of given label values.
+// It returns the count of deleted series.
+func promDeletePartialMatch(labels prometheus.Labels, vecs ...promDeleter) (count int) {
+	for _, vec := range vecs {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			vec.Collect(ch)
+			close(ch)
+		}()
+		matched := make([]prometheus.Labels, 0)
+		for m := range ch {
+			var pb dto.Metric
+			if m.Write(&pb) != nil {
+				continue
+			}
+			seriesLabels := make(prometheus.Labels, len(pb.Label))
+			for _, lp := range pb.Label {
+				seriesLabels[lp.GetName()] = lp.GetValue()
+			}
+			ok := true
+			for k, v := range labels {
+				if lv, found := seriesLabels[k]; !found || lv != v {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				matched = append(matched, seriesLabels)
+			}
+		}
+		for _, seriesLabels := range matched {
+			if vec.Delete(seriesLabels) {
+				count++
+			}
+		}
+	}
+	return
+}
+
+// promDeleteHTTPBackend deletes the series of given backend. If servers is not nil, only series of given servers are deleted.
+func promDeleteHTTPBackend(backend string, servers []string) (count int) {
+	vecs := []promDeleter{
+		promHTTPBackendReadBytes,
+		promHTTPBackendWriteBytes,
+		promHTTPBackendRequestsTotal,
+		promHTTPBackendRequestDurationSeconds,
+		promHTTPBackendTimeToFirstByteSeconds,
+		promHTTPBackendActiveConnections,
+		promHTTPBackendIdleConnections,
+		promHTTPBackendOutstandingBytes,
+		promHTTPBackendStatusMappedTotal,
+		promHTTPBackendServerHealth,
+	}
+	if servers == nil {
+		vecs = append(vecs,
+			promHTTPBackendQueueTimeoutTotal,
+			promHTTPBackendQueueClientAbortTotal,
+			promHTTPBackendShedTotal,
+		)
+		return promDeletePartialMatch(prometheus.Labels{"backend": backend}, vecs...)
+	}
+	for _, server := range servers {
+		count += promDeletePartialMatch(prometheus.Labels{"backend": backend, "server": server}, vecs...)
+	}
+	return
 }
@@ -0,0 +1,180 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// proxyProtocolV1MaxLen is the maximum length of a PROXY protocol v1 header line including CRLF
+	proxyProtocolV1MaxLen = 107
+)
+
+var (
+	proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header from conn, and returns the source address in it.
+// It reads conn exactly up to the end of the header, so conn can be wrapped by TLS after it. The address is nil for the
+// headers which don't advertise a source address, eg UNKNOWN of v1 or LOCAL of v2.
+func readProxyProtocolHeader(conn net.Conn) (addr net.Addr, err error) {
+	buf := make([]byte, len(proxyProtocolV2Sig), proxyProtocolV1MaxLen)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, proxyProtocolReadError(err)
+	}
+	if bytes.Equal(buf, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(conn)
+	}
+	if !bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return nil, errHTTPProxyProtocolHeader
+	}
+	// the line is read byte by byte, not to read the request after it
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= proxyProtocolV1MaxLen {
+			return nil, errHTTPProxyProtocolHeader
+		}
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return nil, proxyProtocolReadError(err)
+		}
+		buf = append(buf, b[0])
+	}
+	return parseProxyProtocolV1(string(buf[:len(buf)-2]))
+}
+
+// parseProxyProtocolV1 parses a PROXY protocol v1 header line without CRLF
+func parseProxyProtocolV1(line string) (addr net.Addr, err error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errHTTPProxyProtocolHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errHTTPProxyProtocolHeader
+	}
+	if len(fields) != 6 {
+		return nil, errHTTPProxyProtocolHeader
+	}
+	// IPv6 addresses of TCP6 may be IPv4-mapped, so the family is determined by the form of the addresses
+	ip := net.ParseIP(fields[2])
+	for _, field := range fields[2:4] {
+		if net.ParseIP(field) == nil || strings.Contains(field, ":") != (fields[1] == "TCP6") {
+			return nil, errHTTPProxyProtocolHeader
+		}
+	}
+	port, e := strconv.ParseUint(fields[4], 10, 16)
+	if e != nil {
+		return nil, errHTTPProxyProtocolHeader
+	}
+	if _, e := strconv.ParseUint(fields[5], 10, 16); e != nil {
+		return nil, errHTTPProxyProtocolHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads the rest of a PROXY protocol v2 header after its signature
+func readProxyProtocolV2(conn net.Conn) (addr net.Addr, err error) {
+	hdr := make([]byte, 4)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return nil, proxyProtocolReadError(err)
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, errHTTPProxyProtocolHeader
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err = io.ReadFull(conn, data); err != nil {
+		return nil, proxyProtocolReadError(err)
+	}
+	switch hdr[0] & 0xf {
+	case 0x0:
+		// LOCAL command is sent by the proxy itself, eg for health-checks
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, errHTTPProxyProtocolHeader
+	}
+	// address family and transport protocol, only TCP over IPv4 and IPv6 have a usable source address
+	var ipLen int
+	switch hdr[1] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(data) < 2*ipLen+4 {
+		return nil, errHTTPProxyProtocolHeader
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, data[:ipLen])
+	port := binary.BigEndian.Uint16(data[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// proxyProtocolReadError wraps the read error of a PROXY protocol header, timeouts are request timeouts
+func proxyProtocolReadError(err error) error {
+	if e := (*net.OpError)(nil); errors.As(err, &e) && e.Timeout() {
+		return wrapHTTPError(httpErrGroupRequestTimeout, err)
+	}
+	return wrapHTTPError(httpErrGroupClientCommunication, err)
+}
+
+// newProxyProtocolHeader returns the PROXY protocol v1 or v2 header which advertises the connection from src to dst.
+// Addresses of different families are advertised as IPv6, and the connection is advertised as unknown if the addresses
+// aren't TCP addresses.
+func newProxyProtocolHeader(v2 bool, src, dst net.Addr) []byte {
+	srcTCPAddr, srcOK := src.(*net.TCPAddr)
+	dstTCPAddr, dstOK := dst.(*net.TCPAddr)
+	var srcIP, dstIP net.IP
+	if srcOK && dstOK {
+		srcIP, dstIP = srcTCPAddr.IP.To4(), dstTCPAddr.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = srcTCPAddr.IP.To16(), dstTCPAddr.IP.To16()
+		}
+	}
+	known := srcIP != nil && dstIP != nil
+
+	if !v2 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP4"
+		if len(srcIP) == net.IPv6len {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, proxyProtocolV1IP(srcIP), proxyProtocolV1IP(dstIP), srcTCPAddr.Port, dstTCPAddr.Port))
+	}
+
+	buf := append([]byte(nil), proxyProtocolV2Sig...)
+	if !known {
+		// PROXY command with unspecified family, the receiver uses the real connection addresses
+		return append(buf, 0x21, 0x00, 0x00, 0x00)
+	}
+	fam := byte(0x11)
+	if len(srcIP) == net.IPv6len {
+		fam = 0x21
+	}
+	n := 2*len(srcIP) + 4
+	buf = append(buf, 0x21, fam, byte(n>>8), byte(n))
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	return append(buf, byte(srcTCPAddr.Port>>8), byte(srcTCPAddr.Port), byte(dstTCPAddr.Port>>8), byte(dstTCPAddr.Port))
+}
+
+// proxyProtocolV1IP formats ip for PROXY protocol v1, IPv4-mapped IPv6 addresses are kept in IPv6 form
+func proxyProtocolV1IP(ip net.IP) string {
+	if len(ip) == net.IPv6len && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
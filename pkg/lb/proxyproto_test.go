@@ -0,0 +1,254 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func testProxyProtocolV2(cmd, fam byte, addrs []byte) string {
+	return string(proxyProtocolV2Sig) + string([]byte{0x20 | cmd, fam, byte(len(addrs) >> 8), byte(len(addrs))}) + string(addrs)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v4 := []byte{10, 0, 0, 1, 192, 0, 2, 1, 0x30, 0x39, 0x00, 0x50}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x00, 0x50)
+	for _, tc := range []struct {
+		hdr  string
+		addr string
+		ok   bool
+	}{
+		{"PROXY TCP4 10.0.0.1 192.0.2.1 12345 80\r\n", "10.0.0.1:12345", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n", "[2001:db8::1]:12345", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN 10.0.0.1 192.0.2.1 12345 80\r\n", "", true},
+		{testProxyProtocolV2(0x1, 0x11, v4), "10.0.0.1:12345", true},
+		{testProxyProtocolV2(0x1, 0x21, v6), "[2001:db8::1]:12345", true},
+		// TLVs after the addresses are skipped
+		{testProxyProtocolV2(0x1, 0x11, append(append([]byte(nil), v4...), 0x04, 0x00, 0x01, 0x00)), "10.0.0.1:12345", true},
+		{testProxyProtocolV2(0x0, 0x00, nil), "", true},
+		{testProxyProtocolV2(0x1, 0x12, v4), "", true},
+		{"PROXY TCP4 10.0.0.1 192.0.2.1 12345\r\n", "", false},
+		{"PROXY TCP4 2001:db8::1 192.0.2.1 12345 80\r\n", "", false},
+		{"PROXY TCP4 10.0.0.1 192.0.2.1 123456 80\r\n", "", false},
+		{"PROXY TCP4  10.0.0.1 192.0.2.1 12345 80\r\n", "", false},
+		{"PROXY UDP4 10.0.0.1 192.0.2.1 12345 80\r\n", "", false},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", false},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "", false},
+		{testProxyProtocolV2(0x1, 0x11, v4[:8]), "", false},
+		{testProxyProtocolV2(0x2, 0x11, v4), "", false},
+		{string(proxyProtocolV2Sig) + "\x11\x11\x00\x00", "", false},
+	} {
+		feConn, peerConn := net.Pipe()
+		go func() {
+			peerConn.Write([]byte(tc.hdr + "rest"))
+			peerConn.Close()
+		}()
+		addr, err := readProxyProtocolHeader(feConn)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: got error %v", tc.hdr, err)
+		} else if tc.ok {
+			if got := addr; (got == nil && tc.addr != "") || (got != nil && got.String() != tc.addr) {
+				t.Errorf("%q: got address %v, want %q", tc.hdr, got, tc.addr)
+			}
+			// the header is read exactly, so the request after it is left on the connection
+			if rest, _ := ioutil.ReadAll(feConn); string(rest) != "rest" {
+				t.Errorf("%q: got %q after header, want %q", tc.hdr, rest, "rest")
+			}
+		}
+		feConn.Close()
+	}
+}
+
+func TestHTTPFrontendProxyProtocol(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "proxyprotocol", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	})
+	defer closer()
+
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	opts := HTTPFrontendOptions{
+		Name: "proxyprotocol",
+		Routes: []HTTPFrontendRoute{
+			// only internal clients are allowed, the test client is a load balancer in the local network
+			{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{{Network: internal, Invert: true}}},
+		},
+		AcceptProxyProtocol:   true,
+		ProxyProtocolNetworks: []*net.IPNet{local},
+	}
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	const req = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	for _, hdr := range []string{
+		"PROXY TCP4 10.0.0.1 192.0.2.1 12345 80\r\n",
+		testProxyProtocolV2(0x1, 0x11, []byte{10, 0, 0, 1, 192, 0, 2, 1, 0x30, 0x39, 0x00, 0x50}),
+	} {
+		resp, body := doTestRequestOnce(t, fLis, hdr+req)
+		if resp.StatusCode != http.StatusOK || body != "10.0.0.1" {
+			t.Errorf("%q: got %d %q, want %d %q", hdr, resp.StatusCode, body, http.StatusOK, "10.0.0.1")
+		}
+	}
+	// the real address is used without an advertised source address
+	if resp, _ := doTestRequestOnce(t, fLis, "PROXY UNKNOWN\r\n"+req); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d for unknown source, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// connections from trusted peers without a valid header are closed
+	labels := prometheus.Labels{"frontend": "proxyprotocol", "error": httpErrGroupProxyProtocol}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	for _, data := range []string{req, "PROXY TCP4 10.0.0.1\r\n" + req} {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(data))
+		if got, _ := ioutil.ReadAll(bufio.NewReader(conn)); len(got) != 0 {
+			t.Errorf("%q: got %q, want closed connection", data, got)
+		}
+		conn.Close()
+	}
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 2 {
+		t.Errorf("got %v proxy protocol errors, want 2", n)
+	}
+
+	// the header from untrusted peers is rejected as a malformed request
+	untrusted := opts
+	untrusted.ProxyProtocolNetworks = []*net.IPNet{internal}
+	fn, err := f.Fork(untrusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fn.Close()
+	fnLis := runTestFrontend(t, fn)
+	defer fnLis.Close()
+	if resp, _ := doTestRequestOnce(t, fnLis, "PROXY TCP4 10.0.0.1 192.0.2.1 12345 80\r\n"+req); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d from untrusted peer, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if resp, _ := doTestRequestOnce(t, fnLis, req); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d without header from untrusted peer, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestNewProxyProtocolHeader(t *testing.T) {
+	addr := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+	for _, tc := range []struct {
+		src, dst net.Addr
+		v1, want string
+	}{
+		{addr("10.0.0.1:12345"), addr("192.0.2.1:80"), "PROXY TCP4 10.0.0.1 192.0.2.1 12345 80\r\n", "10.0.0.1:12345"},
+		{addr("[2001:db8::1]:12345"), addr("[2001:db8::2]:80"), "PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n", "[2001:db8::1]:12345"},
+		{addr("10.0.0.1:12345"), addr("[2001:db8::2]:80"), "PROXY TCP6 ::ffff:10.0.0.1 2001:db8::2 12345 80\r\n", "10.0.0.1:12345"},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, addr("192.0.2.1:80"), "PROXY UNKNOWN\r\n", ""},
+	} {
+		if got := string(newProxyProtocolHeader(false, tc.src, tc.dst)); got != tc.v1 {
+			t.Errorf("%v: got v1 header %q, want %q", tc.src, got, tc.v1)
+		}
+		// both versions are read back as the source address
+		for _, v2 := range []bool{false, true} {
+			feConn, peerConn := net.Pipe()
+			go func() {
+				peerConn.Write(newProxyProtocolHeader(v2, tc.src, tc.dst))
+				peerConn.Close()
+			}()
+			got, err := readProxyProtocolHeader(feConn)
+			if err != nil || (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+				t.Errorf("%v v2=%v: got address %v %v, want %q", tc.src, v2, got, err, tc.want)
+			}
+			feConn.Close()
+		}
+	}
+}
+
+func TestHTTPBackendSendProxyProtocol(t *testing.T) {
+	// the backend responds the source address of the PROXY protocol header of its connection
+	var headers int64
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		addr, err := readProxyProtocolHeader(conn)
+		if err != nil || addr == nil {
+			return
+		}
+		atomic.AddInt64(&headers, 1)
+		rd := bufio.NewReader(conn)
+		for {
+			if _, err := http.ReadRequest(rd); err != nil {
+				return
+			}
+			body := addr.String()
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+		}
+	})
+	defer bLis.Close()
+
+	for _, version := range []HTTPBackendProxyProtocol{HTTPBackendProxyProtocolV1, HTTPBackendProxyProtocolV2} {
+		b, err := NewHTTPBackend(HTTPBackendOptions{
+			Name:              "sendproxyprotocol",
+			Servers:           []string{server},
+			SendProxyProtocol: version,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Activate()
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:             "sendproxyprotocol",
+			MaxKeepAliveReqs: -1,
+			DefaultBackend:   b,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fLis := runTestFrontend(t, f)
+
+		atomic.StoreInt64(&headers, 0)
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", fLis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			rd := bufio.NewReader(conn)
+			// the backend connection is reused for the requests of the same client connection without another header
+			for j := 0; j < 2; j++ {
+				resp := doTestRequest(t, conn, rd, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+				body, _ := ioutil.ReadAll(resp.Body)
+				if string(body) != conn.LocalAddr().String() {
+					t.Errorf("version %d, client %d, request %d: backend got source address %q, want %q", version, i, j, body, conn.LocalAddr().String())
+				}
+			}
+			conn.Close()
+		}
+		// every client connection has its own backend connection
+		if n := atomic.LoadInt64(&headers); n != 2 {
+			t.Errorf("version %d: got %d headers, want 2", version, n)
+		}
+		// nothing else can reuse the backend connections, so they are closed after their client connections end
+		bs := b.bss[server]
+		for endTime := time.Now().Add(2 * time.Second); atomic.LoadInt64(&bs.idleConnCount) != 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(endTime) {
+				t.Fatalf("version %d: got %d idle backend connections, want 0", version, atomic.LoadInt64(&bs.idleConnCount))
+			}
+		}
+		fLis.Close()
+		f.Close()
+		b.Close()
+	}
+}
@@ -0,0 +1,132 @@
+package lb
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// httpRateLimitMaxClients is the maximum count of clients which a rate limiter keeps track of. The least recently
+// seen clients are evicted beyond it, and they start with full buckets if they are seen again.
+const httpRateLimitMaxClients = 65536
+
+// HTTPFrontendRateLimit defines the request rate limit of a restriction per client IP
+type HTTPFrontendRateLimit struct {
+	Requests int
+	Window   time.Duration
+	Burst    int
+}
+
+type httpRateLimitBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// httpRateLimiter is a table of token buckets keyed by client IP with LRU eviction. A bucket is refilled by Requests
+// tokens per Window, and holds Burst tokens at most.
+type httpRateLimiter struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      float64
+	maxClients int
+	buckets    map[string]*list.Element
+	lru        *list.List
+}
+
+func newHTTPRateLimiter(opts *HTTPFrontendRateLimit) (l *httpRateLimiter, err error) {
+	if opts.Requests <= 0 {
+		return nil, fmt.Errorf("requests %d must be positive", opts.Requests)
+	}
+	if opts.Window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+	if opts.Burst < 0 {
+		return nil, fmt.Errorf("burst %d negative", opts.Burst)
+	}
+	burst := opts.Burst
+	if burst == 0 {
+		burst = opts.Requests
+	}
+	return &httpRateLimiter{
+		rate:       float64(opts.Requests) / opts.Window.Seconds(),
+		burst:      float64(burst),
+		maxClients: httpRateLimitMaxClients,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}, nil
+}
+
+// Allow takes a token from the bucket of the client. If there isn't any, it returns false with the duration until
+// the next token.
+func (l *httpRateLimiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b *httpRateLimitBucket
+	if e, found := l.buckets[key]; found {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*httpRateLimitBucket)
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	} else {
+		if l.lru.Len() >= l.maxClients {
+			e := l.lru.Back()
+			l.lru.Remove(e)
+			delete(l.buckets, e.Value.(*httpRateLimitBucket).key)
+		}
+		b = &httpRateLimitBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Len returns the count of clients in the table
+func (l *httpRateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+// isRouteRateLimited takes a token from every rate limit restriction of the route which applies to the request. If
+// any of them hasn't a token, it returns true with the longest duration until their next tokens. Rate limit
+// restrictions without other conditions apply to all requests.
+func (f *HTTPFrontend) isRouteRateLimited(reqDesc *httpReqDesc, route *HTTPFrontendRoute, path, query string) (limited bool, retryAfter time.Duration) {
+	ip := reqDesc.feClientIP
+	key := reqDesc.clientIPString()
+	for i := range route.Restrictions {
+		restriction := &route.Restrictions[i]
+		if restriction.rateLimiter == nil {
+			continue
+		}
+		if restriction.hasCondition() && !restriction.match(ip, path, query, reqDesc.feStatusMethod, reqDesc.feHdr, reqDesc.leClientCert) {
+			continue
+		}
+		if ok, d := restriction.rateLimiter.Allow(key); !ok {
+			limited = true
+			if d > retryAfter {
+				retryAfter = d
+			}
+		}
+	}
+	return
+}
+
+// httpRateLimitedResponse returns the 429 response with Retry-After header in whole seconds, at least 1
+func httpRateLimitedResponse(retryAfter time.Duration) string {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return "HTTP/1.0 429 Too Many Requests\r\nRetry-After: " + strconv.FormatInt(seconds, 10) + "\r\n\r\nToo Many Requests\r\n"
+}
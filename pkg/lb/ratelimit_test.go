@@ -0,0 +1,111 @@
+package lb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPRateLimiter(t *testing.T) {
+	l, err := newHTTPRateLimiter(&HTTPFrontendRateLimit{Requests: 2, Window: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d isn't allowed", i)
+		}
+	}
+	if ok, retryAfter := l.Allow("a"); ok || retryAfter <= 0 || retryAfter > 500*time.Millisecond {
+		t.Errorf("got allowed %v retry after %v, want limited with retry after 500ms at most", ok, retryAfter)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another client is limited")
+	}
+
+	// the least recently seen client is evicted beyond the maximum count of clients
+	l.maxClients = 2
+	l.Allow("b")
+	l.Allow("c")
+	if n := l.Len(); n != 2 {
+		t.Errorf("got %d clients, want 2", n)
+	}
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("least recently seen client isn't evicted")
+	}
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("evicted client doesn't start with full bucket")
+	}
+
+	for _, opts := range []HTTPFrontendRateLimit{
+		{Window: time.Second},
+		{Requests: 1},
+		{Requests: 1, Window: time.Second, Burst: -1},
+	} {
+		if _, err := newHTTPRateLimiter(&opts); err == nil {
+			t.Errorf("rate limit %+v: expected error", opts)
+		}
+	}
+}
+
+func TestHTTPFrontendRateLimit(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "ratelimit", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	route := HTTPFrontendRoute{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+		{Path: "/limited/*", RateLimit: HTTPFrontendRateLimit{Requests: 2, Window: 10 * time.Second}},
+	}}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "ratelimit",
+		Routes: []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"frontend": "ratelimit", "code": "4xx", "error": httpErrGroupRateLimited}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	// the limit is shared by the connections of the client
+	for i, tc := range []struct {
+		path       string
+		code       int
+		retryAfter string
+	}{
+		{"/limited/a", http.StatusOK, ""},
+		{"/other", http.StatusOK, ""},
+		{"/limited/b", http.StatusOK, ""},
+		{"/limited/c", http.StatusTooManyRequests, "5"},
+		{"/other", http.StatusOK, ""},
+	} {
+		resp, _ := doTestRequestOnce(t, fLis, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code || resp.Header.Get("Retry-After") != tc.retryAfter {
+			t.Errorf("request %d: got %d retry after %q, want %d retry after %q", i, resp.StatusCode, resp.Header.Get("Retry-After"), tc.code, tc.retryAfter)
+		}
+	}
+	n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	for i := 0; i < 50 && n < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	}
+	if n != 1 {
+		t.Errorf("got %v rate limited requests, want 1", n)
+	}
+
+	for _, restriction := range []HTTPFrontendRestriction{
+		{RateLimit: HTTPFrontendRateLimit{Requests: 1, Window: time.Second}, AndAfter: true},
+		{RateLimit: HTTPFrontendRateLimit{Requests: 1}},
+	} {
+		badRoute := route
+		badRoute.Restrictions = []HTTPFrontendRestriction{restriction}
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "ratelimit", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("restriction %+v: expected error", restriction)
+		}
+	}
+}
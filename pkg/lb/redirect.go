@@ -0,0 +1,97 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/goinsane/xlog"
+)
+
+const httpRedirectDefaultCode = http.StatusFound
+
+// httpRedirectBackend is the backend and server label of the requests which are answered with redirects
+const httpRedirectBackend = "<redirect>"
+
+// httpRedirect answers requests of a route with a redirect instead of a backend
+type httpRedirect struct {
+	location string
+	code     int
+}
+
+func newHTTPRedirect(route *HTTPFrontendRoute) (r *httpRedirect, err error) {
+	opts := &route.Redirect
+	if route.Backend != nil || route.BackendName != "" || len(route.Backends) > 0 || route.Backup != nil || route.BackupName != "" {
+		return nil, fmt.Errorf("has both redirect and backend")
+	}
+	r = &httpRedirect{
+		location: opts.Location,
+		code:     opts.Code,
+	}
+	if r.code == 0 {
+		r.code = httpRedirectDefaultCode
+	}
+	if r.code < 300 || r.code > 399 {
+		return nil, fmt.Errorf("code %d out of range", r.code)
+	}
+	if r.location == "" || strings.ContainsAny(r.location, "\r\n") {
+		return nil, fmt.Errorf("location %q invalid", r.location)
+	}
+	return
+}
+
+// Location returns the location of the request, by substituting $host and $path of the template. $path is the path and
+// query of the request URI. Leading slashes and backslashes of $path are collapsed to one slash, otherwise a template
+// starting with $path would be a protocol-relative redirect to the host in the path.
+func (r *httpRedirect) Location(reqDesc *httpReqDesc) string {
+	path := reqDesc.feStatusURI
+	if !strings.HasPrefix(path, "/") {
+		path = reqDesc.feURL.RequestURI()
+	}
+	path = "/" + strings.TrimLeft(path, "/\\")
+	return strings.NewReplacer("$host", reqDesc.feURL.Host, "$path", path).Replace(r.location)
+}
+
+// serveRedirect answers the request with the redirect of its route
+func (f *HTTPFrontend) serveRedirect(reqDesc *httpReqDesc, r *httpRedirect) (err error) {
+	hdr := make(http.Header, 4)
+	hdr.Set("Location", r.Location(reqDesc))
+	return f.serveDirectResponse(reqDesc, httpRedirectBackend, r.code, hdr, nil)
+}
+
+// serveHTTPSRedirect answers the request with a redirect to https on the same host and URI. Methods other than GET and
+// HEAD are preserved by 307 and 308 instead of 302 and 301. Requests without a host are answered with 400.
+func (f *HTTPFrontend) serveHTTPSRedirect(reqDesc *httpReqDesc) (err error) {
+	opts := f.options()
+	host := reqDesc.feURL.Hostname()
+	if host == "" {
+		err = errHTTPRedirectMissingHost
+		xlog.V(100).Debugf("serve error on %s: %v", reqDesc.FrontendSummary(), err)
+		reqDesc.feConn.Write([]byte(httpBadRequest))
+		return
+	}
+	if opts.RedirectToHTTPSPort > 0 && opts.RedirectToHTTPSPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(opts.RedirectToHTTPSPort))
+	} else if strings.IndexByte(host, ':') >= 0 {
+		host = "[" + host + "]"
+	}
+	path := reqDesc.feStatusURI
+	if !strings.HasPrefix(path, "/") {
+		path = reqDesc.feURL.RequestURI()
+	}
+	safe := reqDesc.feStatusMethod == "GET" || reqDesc.feStatusMethod == "HEAD"
+	code := http.StatusMovedPermanently
+	switch {
+	case opts.RedirectTemporary && safe:
+		code = http.StatusFound
+	case opts.RedirectTemporary:
+		code = http.StatusTemporaryRedirect
+	case !safe:
+		code = http.StatusPermanentRedirect
+	}
+	hdr := make(http.Header, 4)
+	hdr.Set("Location", "https://"+host+path)
+	return f.serveDirectResponse(reqDesc, httpRedirectBackend, code, hdr, nil)
+}
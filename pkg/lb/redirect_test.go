@@ -0,0 +1,202 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendRedirect(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "redirect", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+	defer closer()
+
+	permanent := HTTPFrontendRoute{Host: "old.example.com", Path: "/*"}
+	permanent.Redirect.Location = "https://new.example.com$path"
+	permanent.Redirect.Code = http.StatusMovedPermanently
+	found := HTTPFrontendRoute{Path: "/moved/*"}
+	found.Redirect.Location = "http://$host/new$path"
+	relative := HTTPFrontendRoute{Host: "rel.example.com", Path: "/*"}
+	relative.Redirect.Location = "$path"
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "redirect",
+		MaxKeepAliveReqs: -1,
+		Routes:           []HTTPFrontendRoute{permanent, found, relative},
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"frontend": "redirect", "backend": httpRedirectBackend, "server": httpRedirectBackend, "code": "3xx", "error": ""}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	for _, tc := range []struct {
+		host, uri string
+		code      int
+		location  string
+	}{
+		{"old.example.com", "/a/b?c=d", http.StatusMovedPermanently, "https://new.example.com/a/b?c=d"},
+		{"www.example.com:8080", "/moved/x", http.StatusFound, "http://www.example.com:8080/new/moved/x"},
+		{"www.example.com", "/other", http.StatusOK, ""},
+		{"rel.example.com", "//evil.example/x", http.StatusFound, "/evil.example/x"},
+		{"rel.example.com", "/\\/evil.example/x", http.StatusFound, "/evil.example/x"},
+	} {
+		resp, _ := doTestRequestOnce(t, fLis, "GET "+tc.uri+" HTTP/1.1\r\nHost: "+tc.host+"\r\n\r\n")
+		if resp.StatusCode != tc.code || resp.Header.Get("Location") != tc.location {
+			t.Errorf("host %q uri %q: got %d location %q, want %d location %q", tc.host, tc.uri, resp.StatusCode, resp.Header.Get("Location"), tc.code, tc.location)
+		}
+	}
+	n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	for i := 0; i < 50 && n < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	}
+	if n != 4 {
+		t.Errorf("got %v redirected requests, want 4", n)
+	}
+
+	// the connection is kept alive without a request body, and closed with one
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for i, req := range []string{
+		"GET /moved/x HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"POST /moved/x HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody",
+	} {
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+		if wantClose := i > 0; resp.StatusCode != http.StatusFound || resp.Close != wantClose {
+			t.Errorf("request %d: got %d close %v, want %d close %v", i, resp.StatusCode, resp.Close, http.StatusFound, wantClose)
+		}
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("connection isn't closed after redirect of request with body")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(route *HTTPFrontendRoute)
+	}{
+		{"code out of range", func(route *HTTPFrontendRoute) { route.Redirect.Code = http.StatusOK }},
+		{"code without location", func(route *HTTPFrontendRoute) { route.Redirect.Location = "" }},
+		{"both redirect and backend", func(route *HTTPFrontendRoute) { route.Backend = b }},
+	} {
+		badRoute := permanent
+		tc.modify(&badRoute)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "redirect", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestHTTPFrontendRedirectToHTTPS(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "httpsredirect", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+	defer closer()
+
+	dir, err := ioutil.TempDir("", "httpsredirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := NewACMEManager(ACMEManagerOptions{
+		CacheDir: dir,
+		Hosts:    []string{"acme.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	opts := HTTPFrontendOptions{
+		Name:             "httpsredirect",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+		ACME:             m,
+		RedirectToHTTPS:  true,
+	}
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		req      string
+		code     int
+		location string
+	}{
+		{"GET /a/b?c=d HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", http.StatusMovedPermanently, "https://example.com/a/b?c=d"},
+		{"HEAD / HTTP/1.1\r\nHost: [::1]\r\n\r\n", http.StatusMovedPermanently, "https://[::1]/"},
+		{"DELETE /x HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusPermanentRedirect, "https://example.com/x"},
+		{"GET /.well-known/acme-challenge/x HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusMovedPermanently, "https://example.com/.well-known/acme-challenge/x"},
+		{"GET /.well-known/acme-challenge/x HTTP/1.1\r\nHost: acme.example.com\r\n\r\n", http.StatusNotFound, ""},
+	} {
+		// the connection is kept alive by all redirects
+		resp := doTestRequest(t, conn, r, tc.req)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code || resp.Header.Get("Location") != tc.location || resp.Close {
+			t.Errorf("%q: got %d %q close %v, want %d %q", tc.req, resp.StatusCode, resp.Header.Get("Location"), resp.Close, tc.code, tc.location)
+		}
+	}
+
+	if resp, _ := doTestRequestOnce(t, fLis, "GET / HTTP/1.0\r\n\r\n"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d without host, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	opts.RedirectToHTTPSPort = 8443
+	opts.RedirectTemporary = true
+	f2, err := f.Fork(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	f2Lis := runTestFrontend(t, f2)
+	defer f2Lis.Close()
+	for _, tc := range []struct {
+		req      string
+		code     int
+		location string
+	}{
+		{"GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusFound, "https://example.com:8443/a"},
+		{"POST /a HTTP/1.1\r\nHost: [::1]:80\r\nContent-Length: 0\r\n\r\n", http.StatusTemporaryRedirect, "https://[::1]:8443/a"},
+	} {
+		if resp, _ := doTestRequestOnce(t, f2Lis, tc.req); resp.StatusCode != tc.code || resp.Header.Get("Location") != tc.location {
+			t.Errorf("%q: got %d %q, want %d %q", tc.req, resp.StatusCode, resp.Header.Get("Location"), tc.code, tc.location)
+		}
+	}
+
+	opts.RedirectToHTTPSPort = 65536
+	if _, err := f.Fork(opts); err == nil {
+		t.Error("expected error for port out of range")
+	}
+}
@@ -0,0 +1,82 @@
+package lb
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HTTPFrontendRequestID is type of handling of request ids which correlate the requests of frontends and backends
+type HTTPFrontendRequestID int
+
+const (
+	// HTTPFrontendRequestIDNone defines that request ids aren't handled, the request id header is forwarded as is
+	HTTPFrontendRequestIDNone = HTTPFrontendRequestID(iota)
+
+	// HTTPFrontendRequestIDGenerate defines that a request id is generated for the requests without one, and the
+	// client-supplied ones are kept
+	HTTPFrontendRequestIDGenerate
+
+	// HTTPFrontendRequestIDOverwrite defines that a request id is generated for all requests, and the client-supplied
+	// ones are overwritten
+	HTTPFrontendRequestIDOverwrite
+)
+
+// httpDefaultRequestIDHeader is the request id header if it isn't given
+const httpDefaultRequestIDHeader = "X-Request-ID"
+
+// requestIDReaders buffer random bytes, so request ids are generated without a global lock or a syscall per request
+var requestIDReaders = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(rand.Reader, 4096)
+	},
+}
+
+// genRequestID returns a 128-bit random request id in hex
+func genRequestID() string {
+	var id [16]byte
+	rd := requestIDReaders.Get().(*bufio.Reader)
+	if _, err := io.ReadFull(rd, id[:]); err != nil {
+		copy(id[:], genRandByteSlice(len(id)))
+	}
+	requestIDReaders.Put(rd)
+	return hex.EncodeToString(id[:])
+}
+
+func newHTTPRequestIDHeader(opts *HTTPFrontendOptions) (header string, err error) {
+	switch opts.RequestID {
+	case HTTPFrontendRequestIDNone:
+		return "", nil
+	case HTTPFrontendRequestIDGenerate, HTTPFrontendRequestIDOverwrite:
+	default:
+		return "", fmt.Errorf("request id %d unknown", opts.RequestID)
+	}
+	header = opts.RequestIDHeader
+	if header == "" {
+		header = httpDefaultRequestIDHeader
+	}
+	if strings.IndexFunc(header, isNotToken) >= 0 {
+		return "", fmt.Errorf("request id header %q invalid", header)
+	}
+	return http.CanonicalHeaderKey(header), nil
+}
+
+// setRequestID sets the request id of the request, and generates it if the request doesn't have one or client-supplied
+// ones are overwritten. The request id is forwarded to backends in the request id header.
+func (f *HTTPFrontend) setRequestID(reqDesc *httpReqDesc) {
+	opts := f.options()
+	if opts.requestIDHeader == "" {
+		return
+	}
+	id := strings.TrimSpace(reqDesc.feHdr.Get(opts.requestIDHeader))
+	if id == "" || opts.RequestID == HTTPFrontendRequestIDOverwrite {
+		id = genRequestID()
+	}
+	reqDesc.feHdr.Set(opts.requestIDHeader, id)
+	reqDesc.feRequestIDHeader, reqDesc.feRequestID = opts.requestIDHeader, id
+}
@@ -0,0 +1,105 @@
+package lb
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestGenRequestID(t *testing.T) {
+	rgx := regexp.MustCompile("^[0-9a-f]{32}$")
+	var mu sync.Mutex
+	ids := make(map[string]struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id := genRequestID()
+				mu.Lock()
+				ids[id] = struct{}{}
+				mu.Unlock()
+				if !rgx.MatchString(id) {
+					t.Errorf("got request id %q, want 32 hex digits", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(ids) != 8000 {
+		t.Errorf("got %d unique request ids, want 8000", len(ids))
+	}
+}
+
+func TestHTTPFrontendRequestID(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "requestid", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(r.URL.Query().Get("header"))))
+	})
+	defer closer()
+
+	rgx := regexp.MustCompile("^[0-9a-f]{32}$")
+	for _, tc := range []struct {
+		name   string
+		mode   HTTPFrontendRequestID
+		header string
+		sent   string
+		want   string
+	}{
+		{"none", HTTPFrontendRequestIDNone, "", "abc", "abc"},
+		{"generate missing", HTTPFrontendRequestIDGenerate, "", "", ""},
+		{"generate kept", HTTPFrontendRequestIDGenerate, "", "abc", "abc"},
+		{"overwrite", HTTPFrontendRequestIDOverwrite, "", "abc", ""},
+		{"custom header", HTTPFrontendRequestIDGenerate, "x-trace", "", ""},
+	} {
+		f, err := NewHTTPFrontend(HTTPFrontendOptions{
+			Name:            "requestid",
+			DefaultBackend:  b,
+			RequestID:       tc.mode,
+			RequestIDHeader: tc.header,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := "X-Request-ID"
+		if tc.header != "" {
+			header = tc.header
+		}
+		fLis := runTestFrontend(t, f)
+		req := "GET /?header=" + header + " HTTP/1.1\r\nHost: example.com\r\n"
+		if tc.sent != "" {
+			req += header + ": " + tc.sent + "\r\n"
+		}
+		resp, body := doTestRequestOnce(t, fLis, req+"\r\n")
+		fLis.Close()
+		f.Close()
+
+		// an empty want is a generated id, which is sent to both of backend and client
+		got := resp.Header.Get(header)
+		switch {
+		case tc.mode == HTTPFrontendRequestIDNone:
+			if got != "" || body != tc.want {
+				t.Errorf("%s: got response id %q and backend id %q, want %q only toward backend", tc.name, got, body, tc.want)
+			}
+		case tc.want == "":
+			if !rgx.MatchString(got) || body != got {
+				t.Errorf("%s: got response id %q and backend id %q, want the same generated id", tc.name, got, body)
+			}
+		case got != tc.want || body != tc.want:
+			t.Errorf("%s: got response id %q and backend id %q, want %q", tc.name, got, body, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts HTTPFrontendOptions
+	}{
+		{"unknown mode", HTTPFrontendOptions{Name: "requestid", RequestID: HTTPFrontendRequestID(-1)}},
+		{"invalid header", HTTPFrontendOptions{Name: "requestid", RequestID: HTTPFrontendRequestIDGenerate, RequestIDHeader: "X Request"}},
+	} {
+		if _, err := NewHTTPFrontend(tc.opts); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goinsane/xlog"
+)
+
+// httpFixedResponseBackend is the backend and server label of the requests which are answered with fixed responses
+const httpFixedResponseBackend = "<response>"
+
+// httpFixedResponse answers requests of a route with a canned response instead of a backend
+type httpFixedResponse struct {
+	code        int
+	contentType string
+	body        []byte
+}
+
+func newHTTPFixedResponse(route *HTTPFrontendRoute) (r *httpFixedResponse, err error) {
+	opts := &route.Response
+	if route.Backend != nil || route.BackendName != "" || len(route.Backends) > 0 || route.Backup != nil || route.BackupName != "" {
+		return nil, fmt.Errorf("has both response and backend")
+	}
+	if route.Redirect.Location != "" || route.Redirect.Code != 0 {
+		return nil, fmt.Errorf("has both response and redirect")
+	}
+	r = &httpFixedResponse{
+		code:        opts.StatusCode,
+		contentType: opts.ContentType,
+		body:        []byte(opts.Body),
+	}
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	if r.code < 200 || r.code > 599 {
+		return nil, fmt.Errorf("status code %d out of range", r.code)
+	}
+	if (r.code == http.StatusNoContent || r.code == http.StatusNotModified) && len(r.body) > 0 {
+		return nil, fmt.Errorf("status code %d doesn't allow body", r.code)
+	}
+	if strings.ContainsAny(r.contentType, "\r\n") {
+		return nil, fmt.Errorf("content type %q invalid", r.contentType)
+	}
+	return
+}
+
+// newHTTPDeniedResponse returns the status code and the raw response of the restricted requests on the route. The
+// connection is closed after the response, like the default 403 one.
+func newHTTPDeniedResponse(route *HTTPFrontendRoute) (code string, resp []byte, err error) {
+	c := route.DeniedStatusCode
+	if c == 0 {
+		c = http.StatusForbidden
+	}
+	if c < 400 || c > 599 {
+		return "", nil, fmt.Errorf("status code %d out of range", c)
+	}
+	body := route.DeniedBody
+	if body == "" {
+		body = http.StatusText(c) + "\r\n"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.0 %d %s\r\n", c, http.StatusText(c))
+	if route.DeniedRetryAfter > 0 {
+		// Retry-After is in whole seconds, it isn't rounded down to zero
+		fmt.Fprintf(&buf, "Retry-After: %d\r\n", (route.DeniedRetryAfter+time.Second-1)/time.Second)
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(body)
+	return strconv.Itoa(c), buf.Bytes(), nil
+}
+
+// serveFixedResponse answers the request with the fixed response of its route
+func (f *HTTPFrontend) serveFixedResponse(reqDesc *httpReqDesc, r *httpFixedResponse) (err error) {
+	hdr := make(http.Header, 4)
+	if r.contentType != "" {
+		hdr.Set("Content-Type", r.contentType)
+	}
+	return f.serveDirectResponse(reqDesc, httpFixedResponseBackend, r.code, hdr, r.body)
+}
+
+// serveDirectResponse answers the request by the frontend, and labels it with given name as backend and server. The
+// connection is kept alive unless the request has a body, which isn't read, or either side closes it.
+func (f *HTTPFrontend) serveDirectResponse(reqDesc *httpReqDesc, name string, code int, hdr http.Header, body []byte) (err error) {
+	reqDesc.beFinal = true
+	reqDesc.beName = name
+	reqDesc.beServer = name
+	reqDesc.beStatusCode = strconv.Itoa(code)
+	reqDesc.beStatusCodeGrouped = groupHTTPStatusCode(reqDesc.beStatusCode)
+
+	hasBody := reqDesc.feHdr.Get("Transfer-Encoding") != ""
+	if contentLength, e := httpContentLength(reqDesc.feHdr); e != nil || contentLength > 0 {
+		hasBody = true
+	}
+	connection := strings.ToLower(reqDesc.feHdr.Get("Connection"))
+	keepAlive := !hasBody && !reqDesc.feClose && connection != "close" &&
+		(reqDesc.feStatusVersion == "HTTP/1.1" || connection == "keep-alive")
+
+	statusLine := fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+	if code != http.StatusNoContent && code != http.StatusNotModified {
+		hdr.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if reqDesc.leTLSWarnHeader {
+		hdr.Add("Warning", `299 - "TLS upgrade required"`)
+	}
+	switch {
+	case !keepAlive:
+		hdr.Set("Connection", "close")
+		if reqDesc.feDrain && reqDesc.feDrainHeader {
+			hdr.Set("X-Drain", "true")
+		}
+	case reqDesc.feStatusVersion == "HTTP/1.0":
+		hdr.Set("Connection", "keep-alive")
+	}
+
+	if !reqDesc.claimResponse() {
+		err = errHTTPRequestBudgetExceeded
+		return
+	}
+	reqDesc.feConn.Writer.WriteString(statusLine + "\r\n")
+	hdr.Write(reqDesc.feConn.Writer)
+	reqDesc.feConn.Writer.WriteString("\r\n")
+	if reqDesc.feStatusMethod != "HEAD" {
+		reqDesc.feConn.Writer.Write(body)
+	}
+	if e := reqDesc.feConn.Flush(); e != nil {
+		err = wrapHTTPError(httpErrGroupClientCommunication, e)
+		xlog.V(100).Debugf("serve error on %s: write direct response to frontend: %v", reqDesc.FrontendSummary(), err)
+		return
+	}
+	if reqDesc.feTap != nil {
+		reqDesc.feTap.SetResponse(statusLine, hdr)
+	}
+
+	if !keepAlive {
+		err = wrapHTTPError("communication", errExpectedEOF)
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendFixedResponse(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "response", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	})
+	defer closer()
+
+	robots := HTTPFrontendRoute{Path: "/robots.txt"}
+	robots.Response.ContentType = "text/plain"
+	robots.Response.Body = "User-agent: *\nDisallow: /\n"
+	maintenance := HTTPFrontendRoute{Path: "/maintenance/*"}
+	maintenance.Response.StatusCode = http.StatusServiceUnavailable
+	maintenance.Response.Body = "down for maintenance"
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "response",
+		MaxKeepAliveReqs: -1,
+		Routes:           []HTTPFrontendRoute{robots, maintenance},
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"frontend": "response", "backend": httpFixedResponseBackend, "server": httpFixedResponseBackend, "code": "5xx", "error": ""}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+
+	// fixed responses keep the connection alive
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for i, tc := range []struct {
+		req         string
+		code        int
+		contentType string
+		body        string
+		close       bool
+	}{
+		{"GET /robots.txt HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusOK, "text/plain", robots.Response.Body, false},
+		{"HEAD /robots.txt HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusOK, "text/plain", "", false},
+		{"GET /maintenance/x HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", http.StatusServiceUnavailable, "", maintenance.Response.Body, false},
+		{"GET /maintenance/y HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusServiceUnavailable, "", maintenance.Response.Body, false},
+		{"GET /maintenance/z HTTP/1.0\r\n\r\n", http.StatusServiceUnavailable, "", maintenance.Response.Body, true},
+	} {
+		if _, err := conn.Write([]byte(tc.req)); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		method := "GET"
+		if i == 1 {
+			method = "HEAD"
+		}
+		resp, err := http.ReadResponse(r, &http.Request{Method: method})
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code || resp.Header.Get("Content-Type") != tc.contentType || string(body) != tc.body || resp.Close != tc.close {
+			t.Errorf("request %d: got %d content type %q body %q close %v, want %d content type %q body %q close %v", i,
+				resp.StatusCode, resp.Header.Get("Content-Type"), body, resp.Close, tc.code, tc.contentType, tc.body, tc.close)
+		}
+		// responses to HEAD requests have the content length of the body
+		if i == 1 && resp.ContentLength != int64(len(robots.Response.Body)) {
+			t.Errorf("request %d: got content length %d, want %d", i, resp.ContentLength, len(robots.Response.Body))
+		}
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("connection isn't closed after response to HTTP/1.0 request without keep-alive")
+	}
+
+	n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	for i := 0; i < 50 && n < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	}
+	if n != 3 {
+		t.Errorf("got %v maintenance responses, want 3", n)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(route *HTTPFrontendRoute)
+	}{
+		{"status code out of range", func(route *HTTPFrontendRoute) { route.Response.StatusCode = http.StatusContinue }},
+		{"body with no content", func(route *HTTPFrontendRoute) { route.Response.StatusCode = http.StatusNoContent }},
+		{"both response and redirect", func(route *HTTPFrontendRoute) { route.Redirect.Location = "/" }},
+		{"both response and backend", func(route *HTTPFrontendRoute) { route.Backend = b }},
+	} {
+		badRoute := robots
+		tc.modify(&badRoute)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "response", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
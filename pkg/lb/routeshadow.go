@@ -0,0 +1,228 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// globSubsetBudget limits the states explored by globSubset. Patterns like "*a??????????????" need exponentially many.
+const globSubsetBudget = 10000
+
+// globOther is a rune which doesn't occur in patterns, it stands for every rune which isn't a literal of them
+const globOther = -1
+
+// globSubset reports whether every string matched by wildcarded pattern a is matched by wildcarded pattern b.
+// "*" matches any string and "?" matches any rune. decided is false if the answer couldn't be computed in globSubsetBudget.
+func globSubset(a, b string) (subset bool, decided bool) {
+	if a == b || b == "*" {
+		return true, true
+	}
+	ra, rb := []rune(a), []rune(b)
+	alphabet := []rune{globOther}
+	seen := make(map[rune]struct{})
+	for _, p := range [][]rune{ra, rb} {
+		for _, r := range p {
+			if _, ok := seen[r]; ok || r == '*' || r == '?' {
+				continue
+			}
+			seen[r] = struct{}{}
+			alphabet = append(alphabet, r)
+		}
+	}
+
+	// states of a pattern are the numbers of its runes matched, closed over the stars which match empty strings
+	closure := func(p []rune, states []bool) {
+		for i := 0; i < len(p); i++ {
+			if states[i] && p[i] == '*' {
+				states[i+1] = true
+			}
+		}
+	}
+	step := func(p []rune, states []bool, r rune) (next []bool) {
+		next = make([]bool, len(p)+1)
+		for i := 0; i < len(p); i++ {
+			if !states[i] {
+				continue
+			}
+			switch p[i] {
+			case '*':
+				next[i] = true
+			case '?':
+				next[i+1] = true
+			case r:
+				next[i+1] = true
+			}
+		}
+		closure(p, next)
+		return
+	}
+	key := func(sa, sb []bool) string {
+		var sbuf strings.Builder
+		for _, s := range [][]bool{sa, sb} {
+			for _, v := range s {
+				if v {
+					sbuf.WriteByte('1')
+				} else {
+					sbuf.WriteByte('0')
+				}
+			}
+			sbuf.WriteByte('|')
+		}
+		return sbuf.String()
+	}
+	empty := func(states []bool) bool {
+		for _, v := range states {
+			if v {
+				return false
+			}
+		}
+		return true
+	}
+
+	// a string matched by a but not by b is searched over the pairs of state sets of both patterns
+	type pair struct{ sa, sb []bool }
+	sa, sb := make([]bool, len(ra)+1), make([]bool, len(rb)+1)
+	sa[0], sb[0] = true, true
+	closure(ra, sa)
+	closure(rb, sb)
+	visited := map[string]struct{}{key(sa, sb): {}}
+	queue := []pair{{sa, sb}}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if p.sa[len(ra)] && !p.sb[len(rb)] {
+			return false, true
+		}
+		for _, r := range alphabet {
+			next := pair{step(ra, p.sa, r), step(rb, p.sb, r)}
+			if empty(next.sa) {
+				continue
+			}
+			k := key(next.sa, next.sb)
+			if _, ok := visited[k]; ok {
+				continue
+			}
+			if len(visited) >= globSubsetBudget {
+				return false, false
+			}
+			visited[k] = struct{}{}
+			queue = append(queue, next)
+		}
+	}
+	return true, true
+}
+
+// HTTPFrontendRouteShadow describes a route which can never match, because an earlier route matches all of its requests.
+// Indexes are of the routes in evaluation order, as GetOpts returns them.
+type HTTPFrontendRouteShadow struct {
+	Index      int
+	Host       string
+	Path       string
+	ShadowedBy int
+}
+
+func (s HTTPFrontendRouteShadow) String() string {
+	return fmt.Sprintf("route %d (host %q path %q) is shadowed by route %d", s.Index, s.Host, s.Path, s.ShadowedBy)
+}
+
+// matchesHostsOf reports whether every host pattern of route r2 is definitely a subset of a host pattern of the route
+func (r *HTTPFrontendRoute) matchesHostsOf(r2 *HTTPFrontendRoute) bool {
+	for _, host2 := range r2.hosts {
+		covered := false
+		for _, host := range r.hosts {
+			if ok, decided := globSubset(strings.ToLower(host2), strings.ToLower(host)); ok && decided {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesMethodsOf reports whether the route matches every method matched by route r2
+func (r *HTTPFrontendRoute) matchesMethodsOf(r2 *HTTPFrontendRoute) bool {
+	if r.methods == nil {
+		return true
+	}
+	if r2.methods == nil {
+		return false
+	}
+	for method := range r2.methods {
+		if _, ok := r.methods[method]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesHeadersOf reports whether the header patterns of the route definitely match every request matched by the
+// header patterns of route r2
+func (r *HTTPFrontendRoute) matchesHeadersOf(r2 *HTTPFrontendRoute) bool {
+	patterns2 := make(map[string]string, len(r2.Headers))
+	for name, pattern := range r2.Headers {
+		patterns2[http.CanonicalHeaderKey(name)] = strings.ToLower(pattern)
+	}
+	for name, pattern := range r.Headers {
+		pattern2, ok := patterns2[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if ok, decided := globSubset(pattern2, strings.ToLower(pattern)); !ok || !decided {
+			return false
+		}
+	}
+	return true
+}
+
+// queryPattern returns the lowercase query pattern of a route. Routes without query pattern match any query.
+func queryPattern(query string) string {
+	if query == "" {
+		return "*"
+	}
+	return strings.ToLower(query)
+}
+
+// findShadowedRoutes returns the routes whose host, path and query patterns are definitely subsets of the ones of an earlier
+// route which matches all of their methods and headers, in the order of routes. Restrictions don't make a difference, because a
+// restricted request doesn't fall through to later routes, unless the earlier route continues on restricted. Routes which
+// couldn't be decided in the budget, and routes with regexp patterns, aren't reported.
+func findShadowedRoutes(routes []HTTPFrontendRoute) (shadows []HTTPFrontendRouteShadow) {
+	for j := range routes {
+		rj := &routes[j]
+		for i := 0; i < j; i++ {
+			ri := &routes[i]
+			// subsets of regexps aren't computed
+			if ri.HostIsRegexp || ri.PathIsRegexp || rj.HostIsRegexp || rj.PathIsRegexp {
+				continue
+			}
+			// restricted requests fall through to later routes
+			if ri.ContinueOnRestricted && len(ri.Restrictions) > 0 {
+				continue
+			}
+			if !ri.matchesMethodsOf(rj) || !ri.matchesHeadersOf(rj) {
+				continue
+			}
+			if !ri.matchesHostsOf(rj) {
+				continue
+			}
+			if ok, decided := globSubset(strings.ToLower(rj.Path), strings.ToLower(ri.Path)); !ok || !decided {
+				continue
+			}
+			if ok, decided := globSubset(queryPattern(rj.Query), queryPattern(ri.Query)); !ok || !decided {
+				continue
+			}
+			shadows = append(shadows, HTTPFrontendRouteShadow{
+				Index:      j,
+				Host:       strings.Join(rj.hosts, ","),
+				Path:       rj.Path,
+				ShadowedBy: i,
+			})
+			break
+		}
+	}
+	return
+}
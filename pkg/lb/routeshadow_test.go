@@ -0,0 +1,99 @@
+package lb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobSubset(t *testing.T) {
+	explosive := "*a" + strings.Repeat("?", 16)
+	for _, tc := range []struct {
+		a, b            string
+		subset, decided bool
+	}{
+		{"/api/*", "*", true, true},
+		{"/api/*", "/*", true, true},
+		{"/*", "/api/*", false, true},
+		{"/api/v1", "/api/*", true, true},
+		{"/api", "/api/*", false, true},
+		{"/a?c", "/a*", true, true},
+		{"/a*", "/a?c", false, true},
+		{"/a?c", "/a?*", true, true},
+		{"/a*c", "/a?c", false, true},
+		{"/abc", "/a?c", true, true},
+		{"?", "*", true, true},
+		{"*", "?", false, true},
+		{"??", "*?", true, true},
+		{"*?", "??", false, true},
+		{"*a*", "*a*a*", false, true},
+		{"*a*a*", "*a*", true, true},
+		{"*ab*", "*a*b*", true, true},
+		{"*a*b*", "*ab*", false, true},
+		{"a.example.com", "*.example.com", true, true},
+		{"example.com", "*.example.com", false, true},
+		{"*.a.example.com", "*.example.com", true, true},
+		{"ex?mple.com", "example.com", false, true},
+		{"ça/*", "?a/*", true, true},
+		// subsets of such patterns need exponentially many states
+		{explosive + "b", explosive + "*", false, false},
+		{explosive, explosive, true, true},
+	} {
+		subset, decided := globSubset(tc.a, tc.b)
+		if subset != tc.subset || decided != tc.decided {
+			t.Errorf("%q subset of %q: got %v decided %v, want %v decided %v", tc.a, tc.b, subset, decided, tc.subset, tc.decided)
+		}
+	}
+}
+
+func TestHTTPFrontendShadowedRoutes(t *testing.T) {
+	routes := []HTTPFrontendRoute{
+		{Host: "*.example.com", Path: "/api/*"},
+		{Host: "www.example.com", Path: "/api/v?/*"},
+		{Host: "example.com", Path: "/api/*"},
+		{Path: "/static/*"},
+		{Host: "cdn.example.com", Path: "/static/img/*"},
+		// a restricted request doesn't fall through, so restrictions don't prevent shadowing
+		{Host: "*", Path: "/*", Restrictions: []HTTPFrontendRestriction{{Path: "/admin/*"}}},
+		{Host: "EXAMPLE.COM", Path: "/other"},
+		// definitely a subset, but it isn't decided in the budget
+		{Host: "api.example.com", Path: "*a" + strings.Repeat("?", 16) + "*"},
+		{Host: "api.example.com", Path: "*a" + strings.Repeat("?", 16) + "b"},
+	}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "shadow",
+		Routes: routes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := []HTTPFrontendRouteShadow{
+		{Index: 1, Host: "www.example.com", Path: "/api/v?/*", ShadowedBy: 0},
+		{Index: 4, Host: "cdn.example.com", Path: "/static/img/*", ShadowedBy: 3},
+		{Index: 6, Host: "EXAMPLE.COM", Path: "/other", ShadowedBy: 5},
+	}
+	got := f.ShadowedRoutes()
+	if len(got) != len(want) {
+		t.Fatalf("got shadowed routes %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got shadowed route %v, want %v", got[i], want[i])
+		}
+	}
+
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "shadow", Routes: routes, StrictRoutes: true}); err == nil || !strings.Contains(err.Error(), "route 1") {
+		t.Errorf("got error %v, want shadowed route 1 error in strict mode", err)
+	}
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "shadow", Routes: routes[2:4], StrictRoutes: true}); err != nil {
+		t.Errorf("got error %v, want no error without shadowed routes in strict mode", err)
+	}
+	// a restricted request falls through to the later route
+	fallthroughRoutes := []HTTPFrontendRoute{
+		{Path: "/internal/*", Restrictions: []HTTPFrontendRestriction{{Path: "/internal/admin/*"}}, ContinueOnRestricted: true},
+		{Path: "/internal/admin/*"},
+	}
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "shadow", Routes: fallthroughRoutes, StrictRoutes: true}); err != nil {
+		t.Errorf("got error %v, want no error for route continuing on restricted in strict mode", err)
+	}
+}
@@ -0,0 +1,51 @@
+package lb
+
+import (
+	"net/http"
+	"strings"
+)
+
+// checkHTTPRequestSmuggling returns an error if the request header block can be parsed differently by backends, or if
+// the end of the request body is ambiguous. It normalizes duplicate Content-Length values and the casing of chunked
+// Transfer-Encoding, so the body is framed the same way by backends.
+func checkHTTPRequestSmuggling(hdr http.Header, lines []httpHeaderLine) error {
+	for _, ln := range lines {
+		if ln.Line != "" && (ln.Line[0] == ' ' || ln.Line[0] == '\t') {
+			return errHTTPSmugglingObsFold
+		}
+		if ln.Name == "" || len(ln.Name) == len(ln.Line) || strings.IndexFunc(ln.Name, isNotToken) >= 0 {
+			return errHTTPSmugglingHeaderName
+		}
+	}
+
+	contentLengths, transferEncodings := hdr["Content-Length"], hdr["Transfer-Encoding"]
+	if len(contentLengths) > 0 && len(transferEncodings) > 0 {
+		return errHTTPSmugglingFraming
+	}
+
+	contentLength := ""
+	for _, value := range contentLengths {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" || strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+				return errHTTPSmugglingContentLength
+			}
+			if contentLength != "" && v != contentLength {
+				return errHTTPSmugglingContentLength
+			}
+			contentLength = v
+		}
+	}
+	if len(contentLengths) > 0 {
+		hdr["Content-Length"] = []string{contentLength}
+	}
+
+	// bodies are relayed only by chunked transfer coding, so other codings can't be framed
+	if len(transferEncodings) > 0 {
+		if len(transferEncodings) > 1 || !strings.EqualFold(strings.TrimSpace(transferEncodings[0]), "chunked") {
+			return errHTTPSmugglingTransferEncoding
+		}
+		hdr["Transfer-Encoding"] = []string{"chunked"}
+	}
+	return nil
+}
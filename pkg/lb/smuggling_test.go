@@ -0,0 +1,115 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCheckHTTPRequestSmuggling(t *testing.T) {
+	for _, tc := range []struct {
+		fields string
+		want   error
+		cl, te string
+	}{
+		{"Content-Length: 5\r\n", nil, "5", ""},
+		{"Content-Length: 5\r\nContent-Length: 5\r\n", nil, "5", ""},
+		{"Content-Length: 5, 5\r\n", nil, "5", ""},
+		{"Transfer-Encoding: Chunked\r\n", nil, "", "chunked"},
+		{"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n", errHTTPSmugglingFraming, "", ""},
+		{"Content-Length: 5\r\nContent-Length: 6\r\n", errHTTPSmugglingContentLength, "", ""},
+		{"Content-Length: 5, 6\r\n", errHTTPSmugglingContentLength, "", ""},
+		{"Content-Length: +5\r\n", errHTTPSmugglingContentLength, "", ""},
+		{"Transfer-Encoding: gzip, chunked\r\n", errHTTPSmugglingTransferEncoding, "", ""},
+		{"Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n", errHTTPSmugglingTransferEncoding, "", ""},
+		{"Transfer-Encoding: identity\r\n", errHTTPSmugglingTransferEncoding, "", ""},
+		{"Transfer-Encoding : chunked\r\n", errHTTPSmugglingHeaderName, "", ""},
+		{"X-Tag\x01: a\r\n", errHTTPSmugglingHeaderName, "", ""},
+		{"X-Tag\r\n", errHTTPSmugglingHeaderName, "", ""},
+		{"X-Tag: a\r\n b\r\n", errHTTPSmugglingObsFold, "", ""},
+		{"X-Tag: a\r\n\tTransfer-Encoding: chunked\r\n", errHTTPSmugglingObsFold, "", ""},
+	} {
+		_, hdr, lines, _, err := splitHTTPHeader(bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: example.com\r\n"+tc.fields+"\r\n")), maxHTTPHeadersLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkHTTPRequestSmuggling(hdr, lines); err != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.fields, err, tc.want)
+			continue
+		}
+		if tc.want == nil && (hdr.Get("Content-Length") != tc.cl || hdr.Get("Transfer-Encoding") != tc.te) {
+			t.Errorf("%q: got %v, want normalized Content-Length %q and Transfer-Encoding %q", tc.fields, hdr, tc.cl, tc.te)
+		}
+	}
+}
+
+func TestHTTPFrontendRequestSmuggling(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "smuggling", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	defer closer()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:             "smuggling",
+		MaxKeepAliveReqs: -1,
+		DefaultBackend:   b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"frontend": "smuggling", "error": httpErrGroupSmuggling}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	for _, req := range []string{
+		"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /admin HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\nContent-Length: 44\r\n\r\nGET /admin HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: example.com\r\nX-Tag: a\r\n Transfer-Encoding: chunked\r\nContent-Length: 0\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(conn)
+		resp := doTestRequest(t, conn, rd, req)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", req, resp.StatusCode, http.StatusBadRequest)
+		}
+		// the connection is closed, so the smuggled request isn't served
+		ioutil.ReadAll(resp.Body)
+		if data, _ := ioutil.ReadAll(rd); len(data) != 0 {
+			t.Errorf("%q: got %q after 400, want closed connection", req, data)
+		}
+		conn.Close()
+	}
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base; n != 3 {
+		t.Errorf("got %v smuggling errors, want 3", n)
+	}
+
+	// chunked body is relayed by its chunks, so the bytes after the last chunk aren't served as a request
+	resp, body := doTestRequestOnce(t, fLis, "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || body != "abc" {
+		t.Errorf("got %d %q for chunked body, want %d %q", resp.StatusCode, body, http.StatusOK, "abc")
+	}
+
+	conn, err := net.Dial("tcp", fLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nGET /admin HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if data, err := ioutil.ReadAll(conn); err != nil || strings.Contains(string(data), "200 OK") {
+		t.Errorf("got %q %v for invalid chunk size, want closed connection", data, err)
+	}
+}
@@ -0,0 +1,92 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// HTTPFrontendWeightedBackend defines a backend of a route with its share of the requests on the route
+type HTTPFrontendWeightedBackend struct {
+	Backend     *HTTPBackend
+	BackendName string
+	Weight      int
+}
+
+type httpSplitBackend struct {
+	backend    *HTTPBackend
+	backendRef *httpBackendRef
+	weight     int
+	current    int
+}
+
+// httpTrafficSplit distributes the requests of a route between its weighted backends by smooth weighted round-robin,
+// so every backend gets its share evenly interleaved with the others
+type httpTrafficSplit struct {
+	mu       sync.Mutex
+	backends []httpSplitBackend
+	total    int
+}
+
+func newHTTPTrafficSplit(route *HTTPFrontendRoute) (s *httpTrafficSplit, err error) {
+	if route.Backend != nil || route.BackendName != "" {
+		return nil, errors.New("has both backend and backends")
+	}
+	s = &httpTrafficSplit{
+		backends: make([]httpSplitBackend, 0, len(route.Backends)),
+	}
+	for i := range route.Backends {
+		wb := &route.Backends[i]
+		if wb.Weight < 0 {
+			return nil, fmt.Errorf("backend %d weight %d negative", i, wb.Weight)
+		}
+		sb := httpSplitBackend{
+			backend: wb.Backend,
+			weight:  wb.Weight,
+		}
+		if wb.BackendName != "" {
+			if wb.Backend != nil {
+				return nil, fmt.Errorf("backend %d has both backend and backend name %q", i, wb.BackendName)
+			}
+			sb.backendRef, err = httpBackends.Resolve(wb.BackendName)
+			if err != nil {
+				return nil, err
+			}
+		} else if wb.Backend == nil {
+			return nil, fmt.Errorf("backend %d has no backend", i)
+		}
+		// backends with zero weight stay in the options, but they don't get any request
+		if sb.weight == 0 {
+			continue
+		}
+		if s.total+sb.weight < s.total {
+			return nil, errors.New("total weight overflows")
+		}
+		s.total += sb.weight
+		s.backends = append(s.backends, sb)
+	}
+	if s.total <= 0 {
+		return nil, errors.New("no backend has weight")
+	}
+	return
+}
+
+// Next returns the backend of the next request, or nil if the referred one isn't active
+func (s *httpTrafficSplit) Next() *HTTPBackend {
+	s.mu.Lock()
+	best := -1
+	for i := range s.backends {
+		sb := &s.backends[i]
+		sb.current += sb.weight
+		if best < 0 || sb.current > s.backends[best].current {
+			best = i
+		}
+	}
+	sb := &s.backends[best]
+	sb.current -= s.total
+	s.mu.Unlock()
+	if sb.backendRef != nil {
+		return sb.backendRef.Get()
+	}
+	return sb.backend
+}
@@ -0,0 +1,90 @@
+package lb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendTrafficSplit(t *testing.T) {
+	newBackend := func(name string) (*HTTPBackend, func()) {
+		return newTestHTTPBackend(t, name, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	stable, stableCloser := newBackend("split-stable")
+	defer stableCloser()
+	canary, canaryCloser := newBackend("split-canary")
+	defer canaryCloser()
+	excluded, excludedCloser := newBackend("split-excluded")
+	defer excludedCloser()
+
+	route := HTTPFrontendRoute{
+		Path: "/*",
+		Backends: []HTTPFrontendWeightedBackend{
+			{Backend: stable, Weight: 3},
+			{BackendName: "split-canary", Weight: 1},
+			{Backend: excluded, Weight: 0},
+		},
+	}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:   "split",
+		Routes: []HTTPFrontendRoute{route},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	labels := prometheus.Labels{"frontend": "split", "backend": "split-canary"}
+	base := testCounterSum(promHTTPFrontendRequestsTotal, labels)
+	counts := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		resp, body := doTestRequestOnce(t, fLis, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != 200 {
+			t.Fatalf("request %d: got %d, want 200", i, resp.StatusCode)
+		}
+		counts[body]++
+		// shares are interleaved, every 4 requests have a canary one
+		if i%4 == 3 && counts["split-canary"] != (i+1)/4 {
+			t.Errorf("request %d: got %d canary requests, want %d", i, counts["split-canary"], (i+1)/4)
+		}
+	}
+	if counts["split-stable"] != 15 || counts["split-canary"] != 5 || counts["split-excluded"] != 0 {
+		t.Errorf("got request counts %v, want 15 stable and 5 canary", counts)
+	}
+	n := testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	for i := 0; i < 50 && n < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = testCounterSum(promHTTPFrontendRequestsTotal, labels) - base
+	}
+	if n != 5 {
+		t.Errorf("got %v requests with canary backend label, want 5", n)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(route *HTTPFrontendRoute)
+	}{
+		{"no weight", func(route *HTTPFrontendRoute) {
+			route.Backends = []HTTPFrontendWeightedBackend{{Backend: stable}, {Backend: canary}}
+		}},
+		{"negative weight", func(route *HTTPFrontendRoute) {
+			route.Backends = []HTTPFrontendWeightedBackend{{Backend: stable, Weight: 1}, {Backend: canary, Weight: -1}}
+		}},
+		{"no backend", func(route *HTTPFrontendRoute) {
+			route.Backends = []HTTPFrontendWeightedBackend{{Weight: 1}}
+		}},
+		{"both backend and backends", func(route *HTTPFrontendRoute) { route.Backend = stable }},
+	} {
+		badRoute := route
+		tc.modify(&badRoute)
+		if _, err := f.Fork(HTTPFrontendOptions{Name: "split", Routes: []HTTPFrontendRoute{badRoute}}); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
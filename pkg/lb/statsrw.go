@@ -3,6 +3,7 @@ package lb
 import (
 	"io"
 	"sync/atomic"
+	"time"
 )
 
 type statsReader struct {
@@ -22,6 +23,27 @@ func (sr *statsReader) Reset() {
 	atomic.StoreInt64(&sr.N, 0)
 }
 
+// maxBytesReader reads at most N bytes from R, and fails with errHTTPResponseTooLarge when R has more
+type maxBytesReader struct {
+	R io.Reader
+	N int64
+}
+
+func (mr *maxBytesReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	if int64(len(p)) > mr.N+1 {
+		p = p[:mr.N+1]
+	}
+	n, err = mr.R.Read(p)
+	if int64(n) > mr.N {
+		n, err = int(mr.N), errHTTPResponseTooLarge
+	}
+	mr.N -= int64(n)
+	return
+}
+
 type statsWriter struct {
 	W io.Writer
 	N int64
@@ -38,3 +60,112 @@ func (sw *statsWriter) Write(p []byte) (n int, err error) {
 func (sw *statsWriter) Reset() {
 	atomic.StoreInt64(&sw.N, 0)
 }
+
+type counterWriter struct {
+	W io.Writer
+	C *int64
+	N int64
+}
+
+func (cw *counterWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.W.Write(p)
+	if n > 0 {
+		atomic.AddInt64(cw.C, int64(n))
+		atomic.AddInt64(&cw.N, int64(n))
+	}
+	return
+}
+
+func (cw *counterWriter) Flush() error {
+	if wr, ok := cw.W.(flusher); ok {
+		return wr.Flush()
+	}
+	return nil
+}
+
+// Release subtracts written bytes from the counter
+func (cw *counterWriter) Release() {
+	atomic.AddInt64(cw.C, -atomic.SwapInt64(&cw.N, 0))
+}
+
+// deadlineWriter extends the read deadline of Conn by Timeout on each write, it limits idle time of the copy which reads from Conn
+type deadlineWriter struct {
+	W       io.Writer
+	Conn    *bufConn
+	Timeout time.Duration
+}
+
+func (dw *deadlineWriter) Write(p []byte) (n int, err error) {
+	dw.Conn.SetReadDeadline(time.Now().Add(dw.Timeout))
+	return dw.W.Write(p)
+}
+
+func (dw *deadlineWriter) Flush() error {
+	if wr, ok := dw.W.(flusher); ok {
+		return wr.Flush()
+	}
+	return nil
+}
+
+// writeDeadlineWriter extends the write deadline of Conn by Timeout on each write and flush, it limits the time which
+// a write to Conn can't make progress
+type writeDeadlineWriter struct {
+	W       io.Writer
+	Conn    *bufConn
+	Timeout time.Duration
+}
+
+func (dw *writeDeadlineWriter) Write(p []byte) (n int, err error) {
+	dw.Conn.SetWriteDeadline(time.Now().Add(dw.Timeout))
+	return dw.W.Write(p)
+}
+
+func (dw *writeDeadlineWriter) Flush() error {
+	dw.Conn.SetWriteDeadline(time.Now().Add(dw.Timeout))
+	if wr, ok := dw.W.(flusher); ok {
+		return wr.Flush()
+	}
+	return nil
+}
+
+// flushWriter flushes F after every write to W
+type flushWriter struct {
+	W io.Writer
+	F flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (n int, err error) {
+	n, err = fw.W.Write(p)
+	if err == nil {
+		err = fw.F.Flush()
+	}
+	return
+}
+
+// sideWriter records the first error of the underlying writer
+type sideWriter struct {
+	W   io.Writer
+	Err error
+}
+
+func (sw *sideWriter) Write(p []byte) (n int, err error) {
+	n, err = sw.W.Write(p)
+	if err != nil && sw.Err == nil {
+		sw.Err = err
+	}
+	return
+}
+
+func (sw *sideWriter) Flush() (err error) {
+	if wr, ok := sw.W.(flusher); ok {
+		err = wr.Flush()
+	}
+	if err != nil && sw.Err == nil {
+		sw.Err = err
+	}
+	return
+}
+
+type flusher interface {
+	Flush() error
+}
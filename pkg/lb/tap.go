@@ -0,0 +1,284 @@
+package lb
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	httpTapDefaultDuration   = 5 * time.Minute
+	httpTapDefaultMaxEntries = 100
+)
+
+// HTTPFrontendTapOptions holds options of a tap which records matching requests of a HTTPFrontend
+type HTTPFrontendTapOptions struct {
+	ClientIP         string
+	RequestIDPattern string
+	Duration         time.Duration
+	MaxEntries       int
+	MaxBodyBytes     int
+}
+
+// HTTPFrontendTapEntry is a request recorded by a tap.
+// Bodies are the first bytes of the bodies as transferred, eg with chunked encoding.
+// BodyDropped reports that a body wasn't captured because the buffer memory limit has been exceeded.
+type HTTPFrontendTapEntry struct {
+	Time           time.Time     `json:"time"`
+	Duration       time.Duration `json:"duration"`
+	Listener       string        `json:"listener"`
+	RemoteAddr     string        `json:"remote_addr"`
+	TLSVersion     string        `json:"tls_version,omitempty"`
+	TLSServerName  string        `json:"tls_server_name,omitempty"`
+	RequestLine    string        `json:"request_line"`
+	RequestHeader  http.Header   `json:"request_header"`
+	RequestBody    []byte        `json:"request_body,omitempty"`
+	Backend        string        `json:"backend"`
+	Server         string        `json:"server"`
+	ResponseLine   string        `json:"response_line"`
+	ResponseHeader http.Header   `json:"response_header"`
+	ResponseBody   []byte        `json:"response_body,omitempty"`
+	BodyDropped    bool          `json:"body_dropped,omitempty"`
+	Error          string        `json:"error"`
+}
+
+// HTTPFrontendTapStatus describes the last tap of a HTTPFrontend with its entries from oldest to newest
+type HTTPFrontendTapStatus struct {
+	Options HTTPFrontendTapOptions `json:"options"`
+	Expires time.Time              `json:"expires"`
+	Active  bool                   `json:"active"`
+	Entries []HTTPFrontendTapEntry `json:"entries"`
+}
+
+// httpTap records matching requests into a bounded ring buffer until it expires
+type httpTap struct {
+	opts         HTTPFrontendTapOptions
+	clientIP     net.IP
+	requestIDRgx *regexp.Regexp
+	expires      time.Time
+
+	mu      sync.Mutex
+	entries []HTTPFrontendTapEntry
+	next    int
+	closed  bool
+}
+
+func newHTTPTap(opts HTTPFrontendTapOptions) (t *httpTap, err error) {
+	t = &httpTap{
+		opts: opts,
+	}
+	if opts.ClientIP == "" && opts.RequestIDPattern == "" {
+		t, err = nil, errors.New("tap needs client ip or request id pattern")
+		return
+	}
+	if opts.ClientIP != "" {
+		t.clientIP = net.ParseIP(opts.ClientIP)
+		if t.clientIP == nil {
+			t, err = nil, errors.New("tap client ip invalid")
+			return
+		}
+	}
+	if opts.RequestIDPattern != "" {
+		reg := regexp.QuoteMeta(opts.RequestIDPattern)
+		reg = strings.Replace(reg, "\\*", ".*", -1)
+		reg = strings.Replace(reg, "\\?", ".", -1)
+		t.requestIDRgx = regexp.MustCompile("^" + reg + "$")
+	}
+	if t.opts.Duration <= 0 {
+		t.opts.Duration = httpTapDefaultDuration
+	}
+	if t.opts.MaxEntries <= 0 {
+		t.opts.MaxEntries = httpTapDefaultMaxEntries
+	}
+	if t.opts.MaxBodyBytes < 0 {
+		t.opts.MaxBodyBytes = 0
+	}
+	t.expires = time.Now().Add(t.opts.Duration)
+	t.entries = make([]HTTPFrontendTapEntry, 0, t.opts.MaxEntries)
+	return
+}
+
+// Expired reports whether the tap has expired
+func (t *httpTap) Expired() bool {
+	return !time.Now().Before(t.expires)
+}
+
+// Match reports whether the request should be recorded. Both of client ip and request id must match if they are given.
+func (t *httpTap) Match(reqDesc *httpReqDesc) bool {
+	if t.Expired() {
+		return false
+	}
+	if t.clientIP != nil && !t.clientIP.Equal(reqDesc.feClientIP) {
+		return false
+	}
+	if t.requestIDRgx != nil {
+		requestID := reqDesc.feRequestID
+		if reqDesc.feRequestIDHeader == "" {
+			requestID = reqDesc.feHdr.Get("X-Request-Id")
+		}
+		if !t.requestIDRgx.MatchString(requestID) {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds the entry, and overwrites the oldest one when the buffer is full. The entry is dropped if the tap is closed.
+// The captured bodies of dropped and overwritten entries are released from the buffer memory.
+func (t *httpTap) Add(entry HTTPFrontendTapEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		releaseTapEntry(&entry)
+		return
+	}
+	if len(t.entries) < t.opts.MaxEntries {
+		t.entries = append(t.entries, entry)
+	} else {
+		releaseTapEntry(&t.entries[t.next])
+		t.entries[t.next] = entry
+	}
+	t.next = (t.next + 1) % t.opts.MaxEntries
+}
+
+// Close drops the entries and releases their captured bodies from the buffer memory
+func (t *httpTap) Close() {
+	t.mu.Lock()
+	for i := range t.entries {
+		releaseTapEntry(&t.entries[i])
+	}
+	t.entries = nil
+	t.next = 0
+	t.closed = true
+	t.mu.Unlock()
+}
+
+func releaseTapEntry(entry *HTTPFrontendTapEntry) {
+	bufferMemory.Release(int64(cap(entry.RequestBody) + cap(entry.ResponseBody)))
+	entry.RequestBody, entry.ResponseBody = nil, nil
+}
+
+// Status returns the status of the tap
+func (t *httpTap) Status() (st HTTPFrontendTapStatus) {
+	st.Options = t.opts
+	st.Expires = t.expires
+	st.Active = !t.Expired()
+	t.mu.Lock()
+	st.Entries = make([]HTTPFrontendTapEntry, 0, len(t.entries))
+	if len(t.entries) >= t.opts.MaxEntries {
+		st.Entries = append(st.Entries, t.entries[t.next:]...)
+		st.Entries = append(st.Entries, t.entries[:t.next]...)
+	} else {
+		st.Entries = append(st.Entries, t.entries...)
+	}
+	t.mu.Unlock()
+	return
+}
+
+// httpTapRecord is the entry of a request in progress. It is written by ingress and engress goroutines concurrently.
+type httpTapRecord struct {
+	tap          *httpTap
+	mu           sync.Mutex
+	entry        HTTPFrontendTapEntry
+	maxBodyBytes int
+	finished     bool
+}
+
+func newHTTPTapRecord(t *httpTap, reqDesc *httpReqDesc, startTime time.Time) *httpTapRecord {
+	return &httpTapRecord{
+		tap: t,
+		entry: HTTPFrontendTapEntry{
+			Time:          startTime,
+			Listener:      reqDesc.leName,
+			RemoteAddr:    reqDesc.feConn.RemoteAddr().String(),
+			TLSVersion:    reqDesc.leTLSVersion,
+			TLSServerName: reqDesc.leTLSServerName,
+			RequestLine:   reqDesc.feStatusLine,
+			RequestHeader: reqDesc.feHdr.Clone(),
+		},
+		maxBodyBytes: t.opts.MaxBodyBytes,
+	}
+}
+
+// SetResponse records the response status line and header which are sent to the frontend
+func (r *httpTapRecord) SetResponse(statusLine string, hdr http.Header) {
+	r.mu.Lock()
+	if !r.finished {
+		r.entry.ResponseLine = statusLine
+		r.entry.ResponseHeader = hdr.Clone()
+	}
+	r.mu.Unlock()
+}
+
+// RequestBodyWriter returns a writer which passes writes to w and captures them as request body
+func (r *httpTapRecord) RequestBodyWriter(w io.Writer) io.Writer {
+	if r.maxBodyBytes <= 0 {
+		return w
+	}
+	return &tapWriter{W: w, R: r, Body: &r.entry.RequestBody}
+}
+
+// ResponseBodyWriter returns a writer which passes writes to w and captures them as response body
+func (r *httpTapRecord) ResponseBodyWriter(w io.Writer) io.Writer {
+	if r.maxBodyBytes <= 0 {
+		return w
+	}
+	return &tapWriter{W: w, R: r, Body: &r.entry.ResponseBody}
+}
+
+// Finish completes the entry and adds it to the tap. Later writes to the record are ignored.
+func (r *httpTapRecord) Finish(reqDesc *httpReqDesc, err error) {
+	r.mu.Lock()
+	r.finished = true
+	r.entry.Duration = time.Now().Sub(r.entry.Time)
+	r.entry.Backend = reqDesc.beName
+	r.entry.Server = reqDesc.beServer
+	if err != nil {
+		r.entry.Error = err.Error()
+	}
+	entry := r.entry
+	r.mu.Unlock()
+	r.tap.Add(entry)
+}
+
+// tapWriter passes writes to W and captures the first bytes of them into the body of the record.
+// The body buffer is allocated with its maximum size from the buffer memory by the first write.
+type tapWriter struct {
+	W       io.Writer
+	R       *httpTapRecord
+	Body    *[]byte
+	dropped bool
+}
+
+func (tw *tapWriter) Write(p []byte) (n int, err error) {
+	n, err = tw.W.Write(p)
+	tw.R.mu.Lock()
+	if !tw.R.finished && n > 0 && *tw.Body == nil && !tw.dropped {
+		if bufferMemory.TryAcquire(memBudgetFeatureTap, int64(tw.R.maxBodyBytes)) {
+			*tw.Body = make([]byte, 0, tw.R.maxBodyBytes)
+		} else {
+			tw.dropped = true
+			tw.R.entry.BodyDropped = true
+		}
+	}
+	if m := cap(*tw.Body) - len(*tw.Body); !tw.R.finished && m > 0 && n > 0 {
+		if m > n {
+			m = n
+		}
+		*tw.Body = append(*tw.Body, p[:m]...)
+	}
+	tw.R.mu.Unlock()
+	return
+}
+
+func (tw *tapWriter) Flush() error {
+	if wr, ok := tw.W.(flusher); ok {
+		return wr.Flush()
+	}
+	return nil
+}
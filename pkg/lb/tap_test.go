@@ -0,0 +1,165 @@
+package lb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendTap(t *testing.T) {
+	b, bCloser := newTestHTTPBackend(t, "tap", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Test", "tap")
+		w.Write([]byte("echo " + string(body)))
+	})
+	defer bCloser()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "tap",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	doRequest := func(i int, requestID string) {
+		doTestRequestOnce(t, fLis, "POST /"+strconv.Itoa(i)+" HTTP/1.1\r\nHost: example.com\r\nX-Request-Id: "+requestID+"\r\nContent-Length: 6\r\n\r\nabcdef")
+	}
+	waitEntries := func(n int) (st HTTPFrontendTapStatus) {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if st, _ = f.TapStatus(); len(st.Entries) >= n {
+				break
+			}
+		}
+		return
+	}
+
+	if _, ok := f.TapStatus(); ok {
+		t.Fatal("got tap status before tap started")
+	}
+	for _, opts := range []HTTPFrontendTapOptions{{}, {ClientIP: "localhost"}} {
+		if err := f.StartTap(opts); err == nil {
+			t.Errorf("tap options %+v: expected error", opts)
+		}
+	}
+
+	if err := f.StartTap(HTTPFrontendTapOptions{ClientIP: "127.0.0.1", MaxEntries: 2, MaxBodyBytes: 4}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		doRequest(i, "req-"+strconv.Itoa(i))
+	}
+	st := waitEntries(2)
+	if !st.Active || len(st.Entries) != 2 {
+		t.Fatalf("got tap status %+v", st)
+	}
+	for i, e := range st.Entries {
+		path := strconv.Itoa(i + 1)
+		if e.RequestLine != "POST /"+path+" HTTP/1.1" || e.RequestHeader.Get("X-Request-Id") != "req-"+path || e.RequestHeader.Get("X-Forwarded-For") != "" {
+			t.Errorf("entry %d: got request %q %v", i, e.RequestLine, e.RequestHeader)
+		}
+		if string(e.RequestBody) != "abcd" || string(e.ResponseBody) != "echo" {
+			t.Errorf("entry %d: got bodies %q %q", i, e.RequestBody, e.ResponseBody)
+		}
+		if e.ResponseLine != "HTTP/1.1 200 OK" || e.ResponseHeader.Get("X-Test") != "tap" || e.Backend != "tap" || e.Server == "" || e.Error != "" {
+			t.Errorf("entry %d: got response %q %v on %q %q with error %q", i, e.ResponseLine, e.ResponseHeader, e.Backend, e.Server, e.Error)
+		}
+	}
+
+	if err := f.StartTap(HTTPFrontendTapOptions{RequestIDPattern: "match-*"}); err != nil {
+		t.Fatal(err)
+	}
+	doRequest(0, "other")
+	doRequest(1, "match-1")
+	st = waitEntries(1)
+	time.Sleep(50 * time.Millisecond)
+	if st, _ = f.TapStatus(); len(st.Entries) != 1 || st.Entries[0].RequestHeader.Get("X-Request-Id") != "match-1" || st.Entries[0].RequestBody != nil {
+		t.Fatalf("got tap entries %+v with request id pattern", st.Entries)
+	}
+
+	if err := f.StartTap(HTTPFrontendTapOptions{ClientIP: "127.0.0.1", Duration: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if f.activeTap() != nil {
+		t.Fatal("expired tap is still active")
+	}
+	doRequest(0, "")
+	time.Sleep(50 * time.Millisecond)
+	if st, ok := f.TapStatus(); !ok || st.Active || len(st.Entries) != 0 {
+		t.Fatalf("got expired tap status %+v", st)
+	}
+
+	if err := f.StartTap(HTTPFrontendTapOptions{ClientIP: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	f.StopTap()
+	doRequest(0, "")
+	time.Sleep(50 * time.Millisecond)
+	if st, ok := f.TapStatus(); !ok || st.Active || len(st.Entries) != 0 {
+		t.Fatalf("got stopped tap status %+v", st)
+	}
+}
+
+func TestHTTPFrontendTapBufferMemory(t *testing.T) {
+	b, bCloser := newTestHTTPBackend(t, "tapmem", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("echo " + string(body)))
+	})
+	defer bCloser()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:           "tapmem",
+		DefaultBackend: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	base := BufferMemoryUsage()
+	rejections := prometheus.Labels{"feature": memBudgetFeatureTap}
+	baseRejections := testCounterSum(promLBBufferMemoryRejectionsTotal, rejections)
+	SetBufferMemoryLimit(base + 24)
+	defer SetBufferMemoryLimit(0)
+
+	if err := f.StartTap(HTTPFrontendTapOptions{ClientIP: "127.0.0.1", MaxEntries: 2, MaxBodyBytes: 8}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		doTestRequestOnce(t, fLis, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\n\r\nabcdef")
+		time.Sleep(50 * time.Millisecond)
+	}
+	st, _ := f.TapStatus()
+	if len(st.Entries) != 2 {
+		t.Fatalf("got tap entries %+v", st.Entries)
+	}
+	if e := st.Entries[0]; string(e.RequestBody) != "abcdef" || e.ResponseBody != nil || !e.BodyDropped {
+		t.Errorf("entry 0: got bodies %q %q dropped %v, want only request body", e.RequestBody, e.ResponseBody, e.BodyDropped)
+	}
+	if e := st.Entries[1]; e.RequestBody != nil || e.ResponseBody != nil || !e.BodyDropped {
+		t.Errorf("entry 1: got bodies %q %q dropped %v, want no body", e.RequestBody, e.ResponseBody, e.BodyDropped)
+	}
+	if n := BufferMemoryUsage() - base; n != 8 {
+		t.Errorf("got buffer memory %d, want 8", n)
+	}
+	if n := testCounterSum(promLBBufferMemoryRejectionsTotal, rejections) - baseRejections; n != 3 {
+		t.Errorf("got %v rejections, want 3", n)
+	}
+
+	if err := f.StartTap(HTTPFrontendTapOptions{ClientIP: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := BufferMemoryUsage() - base; n != 0 {
+		t.Errorf("got buffer memory %d after tap replaced, want 0", n)
+	}
+}
@@ -0,0 +1,159 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Take takes n tokens from the bucket and returns the duration to wait until they become available
+func (tb *tokenBucket) Take(n int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// Idle reports whether the bucket hasn't been used since given duration
+func (tb *tokenBucket) Idle(d time.Duration) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return time.Now().Sub(tb.last) > d
+}
+
+type httpThrottle struct {
+	route         *tokenBucket
+	perClientRate int64
+	clients       map[string]*tokenBucket
+	clientsMu     sync.Mutex
+}
+
+func newHTTPThrottle(routeRate, perClientRate int64) *httpThrottle {
+	if routeRate <= 0 && perClientRate <= 0 {
+		return nil
+	}
+	t := &httpThrottle{}
+	if routeRate > 0 {
+		t.route = newTokenBucket(routeRate)
+	}
+	if perClientRate > 0 {
+		t.perClientRate = perClientRate
+		t.clients = make(map[string]*tokenBucket)
+	}
+	return t
+}
+
+// Buckets returns the token buckets which apply to given client
+func (t *httpThrottle) Buckets(client string) (buckets []*tokenBucket) {
+	if t.route != nil {
+		buckets = append(buckets, t.route)
+	}
+	if t.perClientRate > 0 {
+		t.clientsMu.Lock()
+		tb := t.clients[client]
+		if tb == nil {
+			tb = newTokenBucket(t.perClientRate)
+			t.clients[client] = tb
+		}
+		t.clientsMu.Unlock()
+		buckets = append(buckets, tb)
+	}
+	return
+}
+
+// Cleanup removes client buckets idle longer than given duration
+func (t *httpThrottle) Cleanup(d time.Duration) {
+	t.clientsMu.Lock()
+	for client, tb := range t.clients {
+		if tb.Idle(d) {
+			delete(t.clients, client)
+		}
+	}
+	t.clientsMu.Unlock()
+}
+
+// throttleWriter writes to W at the rates of Buckets. The wait is interrupted when Ctx is done, and its error is
+// grouped by CtxErrGroup.
+type throttleWriter struct {
+	W                io.Writer
+	Ctx              context.Context
+	CtxErrGroup      string
+	Buckets          []*tokenBucket
+	ThrottledBytes   prometheus.Counter
+	ThrottledSeconds prometheus.Counter
+}
+
+const throttleChunkSize = 16 * 1024
+
+func (tw *throttleWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		var d time.Duration
+		for _, tb := range tw.Buckets {
+			if e := tb.Take(len(chunk)); e > d {
+				d = e
+			}
+		}
+		if d > 0 {
+			tw.ThrottledBytes.Add(float64(len(chunk)))
+			tw.ThrottledSeconds.Add(d.Seconds())
+			// written bytes shouldn't wait in the buffer while sleeping
+			if err = tw.Flush(); err != nil {
+				return
+			}
+			tmr := time.NewTimer(d)
+			select {
+			case <-tmr.C:
+			case <-tw.Ctx.Done():
+				tmr.Stop()
+				err = wrapHTTPError(tw.CtxErrGroup, tw.Ctx.Err())
+				return
+			}
+		}
+		var m int
+		m, err = tw.W.Write(chunk)
+		n += m
+		if err != nil {
+			return
+		}
+		p = p[m:]
+	}
+	return
+}
+
+func (tw *throttleWriter) Flush() error {
+	if wr, ok := tw.W.(flusher); ok {
+		return wr.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clock is the source of current time, it is stubbed by tests
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// HTTPFrontendTimeWindow defines the weekly time window of a restriction. Start and End are wall clock times in the
+// form of "15:04" or "15:04:05" in Location, and End may be "24:00". A window whose End isn't after Start crosses
+// midnight. Days are the weekdays which the window starts on, eg "mon", and empty Days means every day. Empty Location
+// means UTC.
+type HTTPFrontendTimeWindow struct {
+	Days     []string
+	Start    string
+	End      string
+	Location string
+}
+
+// isZero reports whether the time window isn't defined
+func (w *HTTPFrontendTimeWindow) isZero() bool {
+	return len(w.Days) == 0 && w.Start == "" && w.End == "" && w.Location == ""
+}
+
+// httpTimeWindow matches times by the wall clock of its location, so on DST transitions the skipped wall clock times
+// are never in the window and the repeated ones are in the window both times.
+type httpTimeWindow struct {
+	days     [7]bool
+	start    int
+	end      int
+	location *time.Location
+	clock    clock
+}
+
+func newHTTPTimeWindow(opts *HTTPFrontendTimeWindow) (w *httpTimeWindow, err error) {
+	w = &httpTimeWindow{
+		location: time.UTC,
+		clock:    systemClock{},
+	}
+	if opts.Start == "" || opts.End == "" {
+		return nil, errors.New("start and end must be given")
+	}
+	if w.start, err = parseWallClock(opts.Start); err != nil || w.start >= 24*60*60 {
+		return nil, fmt.Errorf("start %q invalid", opts.Start)
+	}
+	if w.end, err = parseWallClock(opts.End); err != nil {
+		return nil, fmt.Errorf("end %q invalid", opts.End)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("start %q and end %q are same", opts.Start, opts.End)
+	}
+	if opts.Location != "" {
+		if w.location, err = time.LoadLocation(opts.Location); err != nil {
+			return nil, fmt.Errorf("location %q invalid: %w", opts.Location, err)
+		}
+	}
+	if len(opts.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	for _, day := range opts.Days {
+		weekday, ok := parseWeekday(day)
+		if !ok {
+			return nil, fmt.Errorf("day %q invalid", day)
+		}
+		w.days[weekday] = true
+	}
+	return w, nil
+}
+
+// Contains reports whether t is in the time window
+func (w *httpTimeWindow) Contains(t time.Time) bool {
+	t = t.In(w.location)
+	hour, min, sec := t.Clock()
+	clock, weekday := hour*60*60+min*60+sec, t.Weekday()
+	if w.start < w.end {
+		return w.days[weekday] && w.start <= clock && clock < w.end
+	}
+	// the window crosses midnight, so the early part belongs to the window which started on the previous day
+	return (w.days[weekday] && w.start <= clock) || (w.days[(weekday+6)%7] && clock < w.end)
+}
+
+// parseWallClock parses the wall clock time in the form of "15:04" or "15:04:05" to seconds since midnight. "24:00" is
+// the end of the day.
+func parseWallClock(s string) (int, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, errors.New("invalid wall clock time")
+	}
+	var values [3]int
+	for i, field := range fields {
+		if len(field) != 2 {
+			return 0, errors.New("invalid wall clock time")
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil || v < 0 || (i == 0 && v > 24) || (i > 0 && v > 59) {
+			return 0, errors.New("invalid wall clock time")
+		}
+		values[i] = v
+	}
+	seconds := values[0]*60*60 + values[1]*60 + values[2]
+	if seconds > 24*60*60 {
+		return 0, errors.New("invalid wall clock time")
+	}
+	return seconds, nil
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWeekday parses the weekday by its English name or the first three letters of it, case-insensitively
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	if len(s) < 3 {
+		return 0, false
+	}
+	weekday, ok := weekdayNames[s[:3]]
+	if !ok || (len(s) > 3 && s != strings.ToLower(weekday.String())) {
+		return 0, false
+	}
+	return weekday, true
+}
@@ -0,0 +1,143 @@
+package lb
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+func TestHTTPTimeWindowContains(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	at := func(loc *time.Location, year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+	for _, tc := range []struct {
+		name   string
+		window HTTPFrontendTimeWindow
+		t      time.Time
+		want   bool
+	}{
+		// 2021-03-01 is a monday
+		{"in window", HTTPFrontendTimeWindow{Start: "09:00", End: "17:00"}, at(time.UTC, 2021, 3, 1, 9, 0), true},
+		{"end is excluded", HTTPFrontendTimeWindow{Start: "09:00", End: "17:00"}, at(time.UTC, 2021, 3, 1, 17, 0), false},
+		{"other day", HTTPFrontendTimeWindow{Days: []string{"tue"}, Start: "09:00", End: "17:00"}, at(time.UTC, 2021, 3, 1, 10, 0), false},
+		{"until end of day", HTTPFrontendTimeWindow{Days: []string{"Monday"}, Start: "22:00", End: "24:00"}, at(time.UTC, 2021, 3, 1, 23, 59), true},
+		{"location", HTTPFrontendTimeWindow{Start: "09:00", End: "17:00", Location: "America/New_York"}, at(time.UTC, 2021, 3, 1, 10, 0), false},
+		{"crossing midnight before", HTTPFrontendTimeWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(time.UTC, 2021, 3, 1, 23, 0), true},
+		{"crossing midnight after", HTTPFrontendTimeWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(time.UTC, 2021, 3, 2, 5, 59), true},
+		{"crossing midnight next start", HTTPFrontendTimeWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(time.UTC, 2021, 3, 2, 23, 0), false},
+		{"crossing midnight previous day", HTTPFrontendTimeWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(time.UTC, 2021, 3, 1, 1, 0), false},
+		{"crossing midnight of week", HTTPFrontendTimeWindow{Days: []string{"sat"}, Start: "22:00", End: "06:00"}, at(time.UTC, 2021, 3, 7, 3, 0), true},
+		// clocks are set forward from 02:00 to 03:00 on 2021-03-14, and back from 02:00 to 01:00 on 2021-11-07
+		{"after spring forward", HTTPFrontendTimeWindow{Start: "01:30", End: "03:30", Location: "America/New_York"}, at(time.UTC, 2021, 3, 14, 7, 15), true},
+		{"spring forward gap", HTTPFrontendTimeWindow{Start: "02:00", End: "03:00", Location: "America/New_York"}, at(time.UTC, 2021, 3, 14, 7, 0), false},
+		{"first of repeated hour", HTTPFrontendTimeWindow{Start: "01:00", End: "02:00", Location: "America/New_York"}, at(time.UTC, 2021, 11, 7, 5, 30), true},
+		{"second of repeated hour", HTTPFrontendTimeWindow{Start: "01:00", End: "02:00", Location: "America/New_York"}, at(time.UTC, 2021, 11, 7, 6, 30), true},
+		{"after repeated hour", HTTPFrontendTimeWindow{Start: "01:00", End: "02:00", Location: "America/New_York"}, at(newYork, 2021, 11, 7, 2, 0), false},
+	} {
+		w, err := newHTTPTimeWindow(&tc.window)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := w.Contains(tc.t); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, window := range []HTTPFrontendTimeWindow{
+		{End: "06:00"},
+		{Start: "9:00", End: "17:00"},
+		{Start: "24:00", End: "06:00"},
+		{Start: "09:00", End: "24:01"},
+		{Start: "09:00", End: "09:00"},
+		{Start: "09:00", End: "17:00", Days: []string{"mo"}},
+		{Start: "09:00", End: "17:00", Days: []string{"monkey"}},
+		{Start: "09:00", End: "17:00", Location: "Nowhere/Nothing"},
+	} {
+		if _, err := newHTTPTimeWindow(&window); err == nil {
+			t.Errorf("%+v: expected error", window)
+		}
+	}
+}
+
+func TestHTTPFrontendRestrictionTimeWindow(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "restricttime", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer closer()
+
+	// external clients are restricted in the nightly window, the test client is in the local network
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	window := HTTPFrontendTimeWindow{Start: "23:00", End: "01:00"}
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name: "restricttime",
+		Routes: []HTTPFrontendRoute{
+			{Path: "/local/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+				{Network: local, Invert: true, AndAfter: true},
+				{TimeWindow: window},
+			}},
+			{Path: "/internal/*", Backend: b, Restrictions: []HTTPFrontendRestriction{
+				{Network: internal, Invert: true, AndAfter: true},
+				{TimeWindow: window},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	c := &testClock{}
+	for _, route := range f.options().Routes {
+		route.Restrictions[1].timeWindow.clock = c
+	}
+	for _, tc := range []struct {
+		now  time.Time
+		path string
+		code int
+	}{
+		{time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC), "/internal/x", http.StatusOK},
+		{time.Date(2021, 3, 1, 23, 30, 0, 0, time.UTC), "/internal/x", http.StatusForbidden},
+		{time.Date(2021, 3, 2, 0, 30, 0, 0, time.UTC), "/internal/x", http.StatusForbidden},
+		{time.Date(2021, 3, 2, 0, 30, 0, 0, time.UTC), "/local/x", http.StatusOK},
+		{time.Date(2021, 3, 2, 1, 0, 0, 0, time.UTC), "/internal/x", http.StatusOK},
+	} {
+		c.Set(tc.now)
+		resp, _ := doTestRequestOnce(t, fLis, "GET "+tc.path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s at %v: got %d, want %d", tc.path, tc.now, resp.StatusCode, tc.code)
+		}
+	}
+
+	if _, err := f.Fork(HTTPFrontendOptions{Name: "restricttime", Routes: []HTTPFrontendRoute{
+		{Path: "/*", Backend: b, Restrictions: []HTTPFrontendRestriction{{TimeWindow: HTTPFrontendTimeWindow{Start: "23:00"}}}},
+	}}); err == nil {
+		t.Error("time window without end: expected error")
+	}
+}
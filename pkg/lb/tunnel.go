@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelWriter flushes every write of the tunnel, and records the time of the last activity
+type tunnelWriter struct {
+	C            *bufConn
+	LastActivity *int64
+	Err          error
+}
+
+func (tw *tunnelWriter) Write(p []byte) (n int, err error) {
+	atomic.StoreInt64(tw.LastActivity, time.Now().UnixNano())
+	n, err = tw.C.Write(p)
+	if err == nil {
+		err = tw.C.Flush()
+	}
+	if err != nil && tw.Err == nil {
+		tw.Err = err
+	}
+	return
+}
+
+// serveHTTPTunnel relays bytes between the client and the backend server in both directions after the backend server
+// switched protocols, until either side closes its connection. Both connections are closed when the tunnel ends.
+// The tunnel is closed if no byte is relayed in either direction for idleTimeout, zero or negative means unlimited.
+func serveHTTPTunnel(feConn, beConn *bufConn, idleTimeout time.Duration) (err error) {
+	lastActivity := time.Now().UnixNano()
+	var idle uint32
+	done := make(chan struct{})
+	defer close(done)
+	if idleTimeout > 0 {
+		go func() {
+			tm := time.NewTimer(idleTimeout)
+			defer tm.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-tm.C:
+				}
+				d := time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity)))
+				if d < idleTimeout {
+					tm.Reset(idleTimeout - d)
+					continue
+				}
+				atomic.StoreUint32(&idle, 1)
+				feConn.Close()
+				beConn.Close()
+				return
+			}
+		}()
+	}
+
+	copyCh := make(chan error, 2)
+	relay := func(dst, src *bufConn, readGroup, writeGroup string) {
+		dstTW := &tunnelWriter{C: dst, LastActivity: &lastActivity}
+		_, e := io.Copy(dstTW, src.Reader)
+		if dstTW.Err != nil {
+			e = wrapHTTPError(writeGroup, dstTW.Err)
+		} else if e == nil || errors.Is(e, io.EOF) {
+			e = wrapHTTPError(httpErrGroupCommunication, errExpectedEOF)
+		} else {
+			e = wrapHTTPError(readGroup, e)
+		}
+		copyCh <- e
+	}
+	go relay(beConn, feConn, httpErrGroupClientCommunication, httpErrGroupBackendCommunication)
+	go relay(feConn, beConn, httpErrGroupBackendCommunication, httpErrGroupClientCommunication)
+
+	// the first side which ends the tunnel determines the result, the other side ends by closing the connections
+	err = <-copyCh
+	feConn.Close()
+	beConn.Close()
+	<-copyCh
+	if atomic.LoadUint32(&idle) != 0 {
+		err = errHTTPTunnelIdleTimeout
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package lb
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHTTPFrontendTunnel(t *testing.T) {
+	server, bLis := runTestBackendServer(t, func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(rd); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello"))
+		// echo until the client closes the tunnel
+		io.Copy(conn, rd)
+	})
+	defer bLis.Close()
+
+	b, err := NewHTTPBackend(HTTPBackendOptions{
+		Name:    "tunnel",
+		Servers: []string{server},
+		Timeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Activate()
+
+	f, err := NewHTTPFrontend(HTTPFrontendOptions{
+		Name:                 "tunnel",
+		MaxKeepAliveReqs:     -1,
+		Timeout:              200 * time.Millisecond,
+		DefaultBackend:       b,
+		WebSocketPassthrough: true,
+		TunnelIdleTimeout:    500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fLis := runTestFrontend(t, f)
+	defer fLis.Close()
+
+	open := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(conn)
+		resp := doTestRequest(t, conn, rd, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		return conn, rd
+	}
+	expect := func(rd *bufio.Reader, want string) {
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(rd, buf); err != nil || string(buf) != want {
+			t.Fatalf("got %q %v through tunnel, want %q", buf, err, want)
+		}
+	}
+
+	readLabels := prometheus.Labels{"frontend": "tunnel", "code": "1xx"}
+	readBase := testCounterSum(promHTTPFrontendReadBytes, readLabels)
+	conn, rd := open()
+	expect(rd, "hello")
+	conn.Write([]byte("ping"))
+	expect(rd, "ping")
+	// the tunnel outlives the timeouts of frontend and backend
+	time.Sleep(300 * time.Millisecond)
+	conn.Write([]byte("pong"))
+	expect(rd, "pong")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := testCounterSum(promHTTPFrontendReadBytes, readLabels) - readBase; n < float64(len("pingpong")) {
+		t.Errorf("got %v read bytes, want tunneled bytes to be counted", n)
+	}
+
+	idleLabels := prometheus.Labels{"frontend": "tunnel", "error": httpErrGroupTunnelIdleTimeout}
+	idleBase := testCounterSum(promHTTPFrontendRequestsTotal, idleLabels)
+	conn, rd = open()
+	defer conn.Close()
+	expect(rd, "hello")
+	start := time.Now()
+	if data, err := ioutil.ReadAll(rd); err != nil || len(data) != 0 {
+		t.Errorf("got %q %v, want closed connection after idle timeout", data, err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("tunnel closed after %v, want idle timeout", d)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := testCounterSum(promHTTPFrontendRequestsTotal, idleLabels) - idleBase; n != 1 {
+		t.Errorf("got %v tunnel idle timeout errors, want 1", n)
+	}
+}
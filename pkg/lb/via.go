@@ -0,0 +1,48 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func newHTTPViaPseudonym(opts *HTTPFrontendOptions) (pseudonym string, err error) {
+	if !opts.Via {
+		if opts.ViaPseudonym != "" || opts.ViaLoopDetection {
+			return "", errors.New("via pseudonym or loop detection without via")
+		}
+		return "", nil
+	}
+	pseudonym = opts.ViaPseudonym
+	if pseudonym == "" {
+		pseudonym = opts.Name
+	}
+	if pseudonym == "" || strings.IndexFunc(pseudonym, isNotToken) >= 0 {
+		return "", fmt.Errorf("via pseudonym %q invalid", pseudonym)
+	}
+	return pseudonym, nil
+}
+
+// viaProtocol returns the received-protocol of Via header by the HTTP version, eg "1.1" for "HTTP/1.1"
+func viaProtocol(version string) string {
+	return strings.TrimPrefix(version, "HTTP/")
+}
+
+// hasViaPseudonym reports whether any received-by of the Via header is the pseudonym, case-insensitively
+func hasViaPseudonym(hdr http.Header, pseudonym string) bool {
+	for _, value := range hdr["Via"] {
+		for _, element := range strings.Split(value, ",") {
+			fields := strings.Fields(element)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], pseudonym) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addVia appends the Via element of the pseudonym to the Via header, the existing values are kept
+func addVia(hdr http.Header, version, pseudonym string) {
+	hdr["Via"] = append(hdr["Via"], viaProtocol(version)+" "+pseudonym)
+}
@@ -0,0 +1,77 @@
+package lb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPFrontendVia(t *testing.T) {
+	b, closer := newTestHTTPBackend(t, "via", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Via", "1.1 backend")
+		w.Write([]byte(strings.Join(r.Header["Via"], ",")))
+	})
+	defer closer()
+
+	opts := HTTPFrontendOptions{
+		Name:           "simult-fe1",
+		DefaultBackend: b,
+		Via:            true,
+	}
+	f, err := NewHTTPFrontend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	check := func(name string, f *HTTPFrontend, req string, code int, body, via string) {
+		fLis := runTestFrontend(t, f)
+		defer fLis.Close()
+		resp, got := doTestRequestOnce(t, fLis, req)
+		if resp.StatusCode != code {
+			t.Errorf("%s: got %d, want %d", name, resp.StatusCode, code)
+			return
+		}
+		if code != http.StatusOK {
+			return
+		}
+		if got != body {
+			t.Errorf("%s: backend got Via %q, want %q", name, got, body)
+		}
+		if got := strings.Join(resp.Header["Via"], ","); got != via {
+			t.Errorf("%s: got response Via %q, want %q", name, got, via)
+		}
+	}
+	check("without via", f, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusOK, "1.1 simult-fe1", "1.1 backend,1.1 simult-fe1")
+	check("with via", f, "GET / HTTP/1.0\r\nHost: example.com\r\nVia: 1.0 fred, 1.1 p.example.net\r\n\r\n", http.StatusOK,
+		"1.0 fred, 1.1 p.example.net,1.0 simult-fe1", "1.1 backend,1.0 simult-fe1")
+	check("loop without detection", f, "GET / HTTP/1.1\r\nHost: example.com\r\nVia: 1.1 simult-fe1\r\n\r\n", http.StatusOK,
+		"1.1 simult-fe1,1.1 simult-fe1", "1.1 backend,1.1 simult-fe1")
+
+	loop := opts
+	loop.ViaPseudonym = "edge"
+	loop.ViaLoopDetection = true
+	fl, err := f.Fork(loop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	check("pseudonym", fl, "GET / HTTP/1.1\r\nHost: example.com\r\nVia: 1.1 simult-fe1\r\n\r\n", http.StatusOK,
+		"1.1 simult-fe1,1.1 edge", "1.1 backend,1.1 edge")
+	check("loop", fl, "GET / HTTP/1.1\r\nHost: example.com\r\nVia: 1.1 other (comment), 1.1 EDGE\r\n\r\n", http.StatusLoopDetected, "", "")
+
+	for _, tc := range []struct {
+		name   string
+		modify func(opts *HTTPFrontendOptions)
+	}{
+		{"invalid pseudonym", func(opts *HTTPFrontendOptions) { opts.ViaPseudonym = "simult fe1" }},
+		{"pseudonym without via", func(opts *HTTPFrontendOptions) { opts.Via, opts.ViaPseudonym = false, "edge" }},
+		{"loop detection without via", func(opts *HTTPFrontendOptions) { opts.Via, opts.ViaLoopDetection = false, true }},
+	} {
+		badOpts := opts
+		tc.modify(&badOpts)
+		if _, err := f.Fork(badOpts); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
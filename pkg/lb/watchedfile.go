@@ -0,0 +1,74 @@
+package lb
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// watchedFileCheckInterval is the minimum interval between two checks of the modification time of a watched file
+const watchedFileCheckInterval = time.Second
+
+// watchedFile is a file which is parsed by its parse function, and parsed again when the modification time or the
+// size of the file changes. Reloads replace the value atomically, and a value which couldn't be reloaded stays in use.
+type watchedFile struct {
+	path      string
+	kind      string
+	parse     func(f *os.File) (value interface{}, err error)
+	value     atomic.Value
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+// newWatchedFile loads the file by parse. kind describes the file in errors.
+func newWatchedFile(path, kind string, parse func(f *os.File) (value interface{}, err error)) (w *watchedFile, err error) {
+	w = &watchedFile{
+		path:  path,
+		kind:  kind,
+		parse: parse,
+	}
+	if _, err = w.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Load returns the value which is parsed from the file
+func (w *watchedFile) Load() interface{} {
+	return w.value.Load()
+}
+
+// Reload loads the file if it has been changed since last load. It mustn't be called concurrently.
+func (w *watchedFile) Reload() (reloaded bool, err error) {
+	w.lastCheck = time.Now()
+	f, err := os.Open(w.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if w.value.Load() != nil && fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return false, nil
+	}
+	// a file which couldn't be parsed isn't parsed again until it changes
+	w.modTime, w.size = fi.ModTime(), fi.Size()
+	value, err := w.parse(f)
+	if err != nil {
+		return false, fmt.Errorf("%s file %q: %w", w.kind, w.path, err)
+	}
+	w.value.Store(value)
+	return true, nil
+}
+
+// Check reloads the file if the check interval has been elapsed since last check
+func (w *watchedFile) Check() (reloaded bool, err error) {
+	if time.Since(w.lastCheck) < watchedFileCheckInterval {
+		return false, nil
+	}
+	return w.Reload()
+}
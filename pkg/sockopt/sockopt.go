@@ -0,0 +1,45 @@
+// Package sockopt sets socket options on the connections of frontends, backends and health-checks.
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrDSCPUnsupported is returned when DSCP marking isn't supported on the platform
+var ErrDSCPUnsupported = errors.New("dscp marking is not supported on this platform")
+
+// CheckDSCP checks that dscp is a 6-bit DSCP value which can be set on the platform. Zero means no marking.
+func CheckDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("dscp %d out of range 0-63", dscp)
+	}
+	if dscp != 0 && !dscpSupported {
+		return ErrDSCPUnsupported
+	}
+	return nil
+}
+
+// DSCPControl returns a Control function for net.Dialer which marks the sockets with dscp.
+// IP_TOS is set on IPv4 sockets, and IPV6_TCLASS is set on IPv6 ones.
+func DSCPControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return setDSCP(c, strings.HasSuffix(network, "6"), dscp)
+	}
+}
+
+// SetDSCP marks the connection with dscp, the address family is determined by its local address
+func SetDSCP(conn *net.TCPConn, dscp int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	return setDSCP(rawConn, ipv6, dscp)
+}
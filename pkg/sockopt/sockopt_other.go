@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package sockopt
+
+import (
+	"syscall"
+)
+
+const dscpSupported = false
+
+func setDSCP(c syscall.RawConn, ipv6 bool, dscp int) error {
+	return ErrDSCPUnsupported
+}
@@ -0,0 +1,31 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const dscpSupported = true
+
+var setsockoptInt = syscall.SetsockoptInt
+
+func setDSCP(c syscall.RawConn, ipv6 bool, dscp int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if ipv6 {
+			sockErr = setsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+			return
+		}
+		sockErr = setsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("set dscp %d: %w", dscp, sockErr)
+	}
+	return nil
+}
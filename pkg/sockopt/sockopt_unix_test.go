@@ -0,0 +1,74 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package sockopt
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type testSockopt struct {
+	level, opt, value int
+}
+
+func TestDSCPControl(t *testing.T) {
+	var calls []testSockopt
+	var sockErr error
+	setsockoptInt = func(fd, level, opt, value int) error {
+		calls = append(calls, testSockopt{level, opt, value})
+		return sockErr
+	}
+	defer func() { setsockoptInt = syscall.SetsockoptInt }()
+
+	for _, tc := range []struct {
+		network, address string
+		want             testSockopt
+	}{
+		{"tcp4", "127.0.0.1:0", testSockopt{syscall.IPPROTO_IP, syscall.IP_TOS, 46 << 2}},
+		{"tcp6", "[::1]:0", testSockopt{syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 46 << 2}},
+	} {
+		lis, err := net.Listen(tc.network, tc.address)
+		if err != nil {
+			t.Logf("network %s: %v", tc.network, err)
+			continue
+		}
+		go func() {
+			if conn, err := lis.Accept(); err == nil {
+				conn.Close()
+			}
+		}()
+
+		calls, sockErr = nil, nil
+		conn, err := (&net.Dialer{Control: DSCPControl(46)}).Dial(tc.network, lis.Addr().String())
+		if err != nil {
+			t.Fatalf("network %s: %v", tc.network, err)
+		}
+		if len(calls) != 1 || calls[0] != tc.want {
+			t.Errorf("network %s: got setsockopt calls %v on dial, want %v", tc.network, calls, tc.want)
+		}
+		calls = nil
+		if err := SetDSCP(conn.(*net.TCPConn), 46); err != nil || len(calls) != 1 || calls[0] != tc.want {
+			t.Errorf("network %s: got setsockopt calls %v error %v on conn, want %v", tc.network, calls, err, tc.want)
+		}
+		conn.Close()
+
+		sockErr = syscall.EINVAL
+		_, err = (&net.Dialer{Control: DSCPControl(10)}).Dial(tc.network, lis.Addr().String())
+		if !errors.Is(err, syscall.EINVAL) || !strings.Contains(err.Error(), "set dscp 10") {
+			t.Errorf("network %s: got dial error %v, want set dscp error", tc.network, err)
+		}
+		lis.Close()
+	}
+}
+
+func TestCheckDSCP(t *testing.T) {
+	for dscp, ok := range map[int]bool{0: true, 46: true, 63: true, -1: false, 64: false, 184: false} {
+		if err := CheckDSCP(dscp); (err == nil) != ok {
+			t.Errorf("dscp %d: got error %v", dscp, err)
+		}
+	}
+}